@@ -32,5 +32,8 @@ func showMIME() {
 		log.Fatal(err)
 	}
 	mime, _ := magic.MimeTypeFromReader(f)
+	if mime == "" {
+		mime = magic.MimeTypeByExtension(file)
+	}
 	fmt.Println(mime)
 }
@@ -15,6 +15,17 @@
 //
 //   camget -o <filename> <file-blobref>
 //
+// Directories are restored recursively, with their files' names,
+// permissions, ownership (as root), modtimes, extended attributes,
+// symlinks, fifos, sockets and (as root) devices. A permanode is restored as its current camliContent:
+//
+//   camget -o <dir> <permanode-blobref>
+//
+// A directory or permanode can also be written as a tar stream, built
+// by the server with -tar, or by camget itself with -localtar:
+//
+//   camget -localtar <dir-blobref> | tar -tvf -
+//
 // TODO(bradfitz): camget isn't very fleshed out. In general, using 'cammount' to just
 // mount a tree is an easier way to get files back.
 package main
@@ -46,7 +57,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"net/url"
 	"path/filepath"
+	"regexp"
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver/localdisk" // used for the blob cache
@@ -54,6 +67,7 @@ import (
 	"camlistore.org/pkg/client"
 	"camlistore.org/pkg/httputil"
 	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/osutil"
 	"camlistore.org/pkg/schema"
 )
 
@@ -64,9 +78,17 @@ var (
 	flagOutput   = flag.String("o", "-", "Output file/directory to create.  Use -f to overwrite.")
 	flagGraph    = flag.Bool("graph", false, "Output a graphviz directed graph .dot file of the provided root schema blob, to be rendered with 'dot -Tsvg -o graph.svg graph.dot'")
 	flagContents = flag.Bool("contents", false, "If true and the target blobref is a 'bytes' or 'file' schema blob, the contents of that file are output instead.")
-	flagShared   = flag.String("shared", "", "If non-empty, the URL of a \"share\" blob. The URL will be used as the root of future fetches. Only \"haveref\" shares are currently supported.")
+	flagShared   = flag.String("shared", "", "If non-empty, the URL of a \"share\" blob. The URL will be used as the root of future fetches, through the share, and of transitive shares, through everything reachable from its target. Only \"haveref\" shares are currently supported. "+
+		"It may also be the signed URL of a single blob, which is written to the -o file (or stdout).")
+	flagVerify   = flag.Bool("verify", false, "If true, every fetched blob is hashed, and every file written is read back and hashed, for the digests to be checked. Any mismatch is an error.")
+	flagTar      = flag.Bool("tar", false, "If true, the target directory or permanode is exported by the server as a tar stream of everything reachable from it, written to the -o file (or stdout).")
+	flagLocalTar = flag.Bool("localtar", false, "Like -tar, but the tar stream is built by camget from the fetched blobs, without temporary files, for when the client has more CPU to spare than the server. Also works with --shared.")
 )
 
+// permanodeContent returns the camliContent of a permanode, or nil,
+// when the server can be searched; it can't through shares.
+var permanodeContent func(pn *blobref.BlobRef) (*blobref.BlobRef, error)
+
 func main() {
 	client.AddFlags()
 	flag.Parse()
@@ -74,10 +96,29 @@ func main() {
 	if *flagGraph && flag.NArg() != 1 {
 		log.Fatalf("The --graph option requires exactly one parameter.")
 	}
+	if *flagTar && flag.NArg() != 1 {
+		log.Fatalf("The --tar option requires exactly one parameter.")
+	}
+	if *flagTar && *flagShared != "" {
+		log.Fatalf("The --tar option can't be used with --shared.")
+	}
+	if *flagLocalTar && (*flagTar || flag.NArg() != 1 && *flagShared == "") {
+		log.Fatalf("The --localtar option requires exactly one parameter, and excludes --tar.")
+	}
 
 	var cl *client.Client
 	var items []*blobref.BlobRef
 
+	if *flagShared != "" && isSignedBlobURL(*flagShared) {
+		if flag.NArg() != 0 {
+			log.Fatal("No arguments permitted when using --shared")
+		}
+		if err := fetchSignedURL(*flagShared, *flagOutput); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *flagShared != "" {
 		if client.ExplicitServer() != "" {
 			log.Fatal("Can't use --shared with an explicit blobserver; blobserver is implicit from the --shared URL.")
@@ -93,6 +134,8 @@ func main() {
 		items = append(items, target)
 	} else {
 		cl = client.NewOrFail()
+		permanodeContent = cl.PermanodeContent
+		filesWithContents = cl.FilesWithContents
 		for n := 0; n < flag.NArg(); n++ {
 			arg := flag.Arg(n)
 			br := blobref.Parse(arg)
@@ -105,6 +148,7 @@ func main() {
 
 	httpStats := &httputil.StatsTransport{
 		VerboseLog: *flagHTTP,
+		Transport:  cl.BaseTransport(),
 	}
 	if *flagHTTP {
 		httpStats.Transport = &http.Transport{
@@ -112,10 +156,27 @@ func main() {
 				log.Printf("Dialing %s", addr)
 				return net.Dial(net_, addr)
 			},
+			DialTLS: cl.DialTLSFunc(),
 		}
 	}
 	cl.SetHTTPClient(&http.Client{Transport: httpStats})
 
+	if *flagLocalTar {
+		// Straight from the server, as the disk cache below
+		// would be temporary files.
+		var fetcher blobref.StreamingFetcher = cl
+		if *flagVerify {
+			fetcher = verifyingFetcher{fetcher}
+		}
+		if err := writeLocalTar(fetcher, items[0], *flagOutput); err != nil {
+			log.Fatal(err)
+		}
+		if *flagVerbose {
+			log.Printf("HTTP requests: %d\n", httpStats.Requests())
+		}
+		return
+	}
+
 	// Put a local disk cache in front of the HTTP client.
 	// TODO: this could be better about proactively cleaning things.
 	// Fetching 2 TB shouldn't write 2 TB to /tmp before it's done.
@@ -132,7 +193,20 @@ func main() {
 	if *flagVerbose {
 		log.Printf("Using temp blob cache directory %s", cacheDir)
 	}
-	fetcher := cacher.NewCachingFetcher(diskcache, cl)
+	var fetcher blobref.StreamingFetcher = cacher.NewCachingFetcher(diskcache, cl)
+	if *flagVerify {
+		fetcher = verifyingFetcher{fetcher}
+	}
+
+	if *flagTar {
+		if err := fetchTar(cl, items[0], *flagOutput); err != nil {
+			log.Fatal(err)
+		}
+		if *flagVerbose {
+			log.Printf("HTTP requests: %d\n", httpStats.Requests())
+		}
+		return
+	}
 
 	for _, br := range items {
 		if *flagGraph {
@@ -170,11 +244,95 @@ func main() {
 		}
 	}
 
+	if *flagVerify {
+		log.Printf("Verified %d blobs and the whole contents of %d files", verifiedBlobs, verifiedFiles)
+		if uncheckedFiles > 0 {
+			log.Printf("The whole contents of %d files couldn't be checked, without a server index", uncheckedFiles)
+		}
+	}
 	if *flagVerbose {
 		log.Printf("HTTP requests: %d\n", httpStats.Requests())
 	}
 }
 
+// fetchTar writes the server's tar export of br to the file targ,
+// or to stdout if targ is "-".
+func fetchTar(cl *client.Client, br *blobref.BlobRef, targ string) error {
+	rc, err := cl.FetchTar(br)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if targ == "-" {
+		if _, err := io.Copy(os.Stdout, rc); err != nil {
+			return fmt.Errorf("Failed reading tar of %q: %v", br, err)
+		}
+		return nil
+	}
+	f, err := os.OpenFile(targ, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed reading tar of %q: %v", br, err)
+	}
+	return f.Close()
+}
+
+var signedBlobURLRx = regexp.MustCompile(`/camli/` + blobref.Pattern + `$`)
+
+// isSignedBlobURL reports whether rawurl is the signed URL of a blob,
+// as minted by the server's signedurl handler.
+func isSignedBlobURL(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	return err == nil && u.Query().Get("sig") != "" && signedBlobURLRx.MatchString(u.Path)
+}
+
+// fetchSignedURL writes the blob of the signed URL rawurl to the file
+// targ, or to stdout if targ is "-", checking its digest.
+func fetchSignedURL(rawurl, targ string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	br := blobref.FromPattern(signedBlobURLRx, u.Path)
+	if br == nil {
+		return fmt.Errorf("no blobref in signed URL %s", rawurl)
+	}
+	res, err := http.Get(rawurl)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("fetching %s: status %s", br, res.Status)
+	}
+	var rc io.ReadCloser = res.Body
+	if h := br.Hash(); h != nil {
+		rc = &verifyingReader{rc: res.Body, br: br, h: h}
+	}
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if targ != "-" {
+		f, err = os.OpenFile(targ, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return fmt.Errorf("fetching %s: %v", br, err)
+	}
+	if f != nil {
+		return f.Close()
+	}
+	return nil
+}
+
 func fetch(src blobref.StreamingFetcher, br *blobref.BlobRef) (r io.ReadCloser, err error) {
 	if *flagVerbose {
 		log.Printf("Fetching %s", br.String())
@@ -226,22 +384,43 @@ func smartFetch(src blobref.StreamingFetcher, targ string, br *blobref.BlobRef)
 	sc.BlobRef = br
 
 	switch sc.Type {
+	case "permanode":
+		if permanodeContent == nil {
+			return fmt.Errorf("can't find the content of permanode %v through a share; fetch its content instead", br)
+		}
+		content, err := permanodeContent(br)
+		if err != nil {
+			return fmt.Errorf("finding the content of permanode %v: %v", br, err)
+		}
+		if content == nil {
+			return fmt.Errorf("permanode %v has no camliContent", br)
+		}
+		if *flagVerbose {
+			log.Printf("Fetching content %v of permanode %v", content, br)
+		}
+		return smartFetch(src, targ, content)
 	case "directory":
-		dir := filepath.Join(targ, sc.FileName)
+		dir := filepath.Join(targ, sc.FileNameString())
 		if *flagVerbose {
 			log.Printf("Fetching directory %v into %s", br, dir)
 		}
-		if err := os.MkdirAll(dir, sc.FileMode()); err != nil {
+		// Writable until its entries are in.
+		if err := os.MkdirAll(dir, 0700); err != nil {
 			return err
 		}
-		if err := setFileMeta(dir, sc); err != nil {
-			log.Print(err)
-		}
 		entries := blobref.Parse(sc.Entries)
 		if entries == nil {
 			return fmt.Errorf("bad entries blobref: %v", sc.Entries)
 		}
-		return smartFetch(src, dir, entries)
+		if err := smartFetch(src, dir, entries); err != nil {
+			return err
+		}
+		// Last, so writing the entries doesn't change the
+		// mtime.
+		if err := setFileMeta(dir, sc); err != nil {
+			log.Print(err)
+		}
+		return nil
 	case "static-set":
 		if *flagVerbose {
 			log.Printf("Fetching directory entries %v into %s", br, targ)
@@ -253,7 +432,8 @@ func smartFetch(src blobref.StreamingFetcher, targ string, br *blobref.BlobRef)
 			br   *blobref.BlobRef
 			errc chan<- error
 		}
-		workc := make(chan work, len(sc.Members))
+		members := append(sc.Members, sc.MergeSets...)
+		workc := make(chan work, len(members))
 		defer close(workc)
 		for i := 0; i < numWorkers; i++ {
 			go func() {
@@ -263,7 +443,9 @@ func smartFetch(src blobref.StreamingFetcher, targ string, br *blobref.BlobRef)
 			}()
 		}
 		var errcs []<-chan error
-		for _, m := range sc.Members {
+		// Merged sets are static-sets of more entries of the
+		// same directory, so they're fetched into targ too.
+		for _, m := range members {
 			dref := blobref.Parse(m)
 			if dref == nil {
 				return fmt.Errorf("bad member blobref: %v", m)
@@ -287,13 +469,16 @@ func smartFetch(src blobref.StreamingFetcher, targ string, br *blobref.BlobRef)
 		fr.LoadAllChunks()
 		defer fr.Close()
 
-		name := filepath.Join(targ, sc.FileName)
+		name := filepath.Join(targ, sc.FileNameString())
 
-		if fi, err := os.Stat(name); err == nil && fi.Size() == fi.Size() {
+		if fi, err := os.Stat(name); err == nil && fi.Size() == fr.Size() {
 			if *flagVerbose {
 				log.Printf("Skipping %s; already exists.", name)
-				return nil
 			}
+			if *flagVerify {
+				return verifyFile(name, br)
+			}
+			return nil
 		}
 
 		if *flagVerbose {
@@ -308,6 +493,57 @@ func smartFetch(src blobref.StreamingFetcher, targ string, br *blobref.BlobRef)
 		if _, err := io.Copy(f, fr); err != nil {
 			return fmt.Errorf("Copying %s to %s: %v", br, name, err)
 		}
+		if *flagVerify {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			if err := verifyFile(name, br); err != nil {
+				return err
+			}
+		}
+		if err := setFileMeta(name, sc); err != nil {
+			log.Print(err)
+		}
+		return nil
+	case "symlink":
+		name := filepath.Join(targ, sc.FileNameString())
+		target := sc.SymlinkTargetString()
+		if *flagVerbose {
+			log.Printf("Creating symlink %s to %s", name, target)
+		}
+		if err := os.Symlink(target, name); err != nil {
+			if os.IsExist(err) {
+				if *flagVerbose {
+					log.Printf("Skipping %s; already exists.", name)
+				}
+				return nil
+			}
+			return err
+		}
+		if err := setFileMeta(name, sc); err != nil {
+			log.Print(err)
+		}
+		return nil
+	case "fifo", "socket", "char-device", "block-device":
+		name := filepath.Join(targ, sc.FileNameString())
+		if *flagVerbose {
+			log.Printf("Creating %s %s", sc.Type, name)
+		}
+		if err := osutil.Mknod(name, sc.FileMode(), sc.DeviceMajor, sc.DeviceMinor); err != nil {
+			if os.IsExist(err) {
+				if *flagVerbose {
+					log.Printf("Skipping %s; already exists.", name)
+				}
+				return nil
+			}
+			// Only root may create devices; the rest of
+			// the tree is still worth restoring.
+			if os.IsPermission(err) && os.Getuid() != 0 {
+				log.Printf("Not creating %s %s: %v", sc.Type, name, err)
+				return nil
+			}
+			return err
+		}
 		if err := setFileMeta(name, sc); err != nil {
 			log.Print(err)
 		}
@@ -318,15 +554,28 @@ func smartFetch(src blobref.StreamingFetcher, targ string, br *blobref.BlobRef)
 	panic("unreachable")
 }
 
+// setFileMeta restores the ownership, permissions, extended
+// attributes and modtime of the file, directory or symlink name. Only
+// the ownership of symlinks is restored, as the others are their
+// target's.
 func setFileMeta(name string, sc *schema.Superset) error {
-	err1 := os.Chmod(name, sc.FileMode())
-	var err2 error
+	// Ownership first, as chown clears the setuid and setgid bits.
+	// Only root may give files away, so others only keep theirs.
+	err1 := os.Lchown(name, sc.MapUid(), sc.MapGid())
+	if os.IsPermission(err1) && os.Getuid() != 0 {
+		err1 = nil
+	}
+	if sc.Type == "symlink" {
+		return err1
+	}
+	err2 := os.Chmod(name, sc.FileMode())
+	err3 := osutil.SetXattrs(name, sc.UnixXattrs)
+	var err4 error
 	if mt := sc.ModTime(); !mt.IsZero() {
-		err2 = os.Chtimes(name, mt, mt)
+		err4 = os.Chtimes(name, mt, mt)
 	}
-	err3 := os.Chown(name, sc.UnixOwnerId, sc.UnixGroupId)
 	// Return first non-nil error for logging.
-	for _, err := range []error{err1, err2, err3} {
+	for _, err := range []error{err1, err2, err3, err4} {
 		if err != nil {
 			return err
 		}
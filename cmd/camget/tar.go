@@ -0,0 +1,190 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+)
+
+// writeLocalTar writes a tar stream of br, a directory, file, symlink
+// or permanode, built from the blobs fetched from src, to the file
+// targ, or to stdout if targ is "-". Unlike fetchTar, the server only
+// serves blobs; and unlike smartFetch, nothing is written to disk.
+func writeLocalTar(src blobref.StreamingFetcher, br *blobref.BlobRef, targ string) error {
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if targ != "-" {
+		var err error
+		f, err = os.OpenFile(targ, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	tw := tar.NewWriter(w)
+	err := tarFetch(src, tw, "", br)
+	if err == nil {
+		err = tw.Close()
+	}
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// tarFetch writes to tw the entries of br, and of everything below it,
+// in the tar directory dir.
+func tarFetch(src blobref.StreamingFetcher, tw *tar.Writer, dir string, br *blobref.BlobRef) error {
+	rc, err := fetch(src, br)
+	if err != nil {
+		return err
+	}
+	sc, err := schema.ParseSuperset(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("blob %v is not a schema blob: %v", br, err)
+	}
+	sc.BlobRef = br
+
+	name := path.Join(dir, tarName(sc.FileNameString()))
+	switch sc.Type {
+	case "permanode":
+		if permanodeContent == nil {
+			return fmt.Errorf("can't find the content of permanode %v through a share; fetch its content instead", br)
+		}
+		content, err := permanodeContent(br)
+		if err != nil {
+			return fmt.Errorf("finding the content of permanode %v: %v", br, err)
+		}
+		if content == nil {
+			return fmt.Errorf("permanode %v has no camliContent", br)
+		}
+		return tarFetch(src, tw, dir, content)
+	case "directory":
+		if *flagVerbose {
+			log.Printf("Archiving directory %v as %s", br, name)
+		}
+		if err := tw.WriteHeader(tarHeader(sc, name+"/", tar.TypeDir, 0755)); err != nil {
+			return err
+		}
+		entries := blobref.Parse(sc.Entries)
+		if entries == nil {
+			return fmt.Errorf("bad entries blobref: %v", sc.Entries)
+		}
+		return tarFetch(src, tw, name, entries)
+	case "static-set":
+		for _, m := range append(sc.Members, sc.MergeSets...) {
+			dref := blobref.Parse(m)
+			if dref == nil {
+				return fmt.Errorf("bad member blobref: %v", m)
+			}
+			if err := tarFetch(src, tw, dir, dref); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "file":
+		fr, err := schema.NewFileReader(blobref.SeekerFromStreamingFetcher(src), br)
+		if err != nil {
+			return fmt.Errorf("NewFileReader: %v", err)
+		}
+		defer fr.Close()
+		if *flagVerbose {
+			log.Printf("Archiving %s as %s ...", br, name)
+		}
+		hdr := tarHeader(sc, name, tar.TypeReg, 0644)
+		hdr.Size = fr.Size()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		n, err := io.Copy(tw, fr)
+		if err == nil && n != hdr.Size {
+			err = fmt.Errorf("read %d bytes; schema says %d", n, hdr.Size)
+		}
+		if err != nil {
+			return fmt.Errorf("Copying %s to %s: %v", br, name, err)
+		}
+		return nil
+	case "symlink":
+		hdr := tarHeader(sc, name, tar.TypeSymlink, 0777)
+		hdr.Linkname = sc.SymlinkTargetString()
+		return tw.WriteHeader(hdr)
+	case "fifo":
+		return tw.WriteHeader(tarHeader(sc, name, tar.TypeFifo, 0644))
+	case "char-device", "block-device":
+		typ := byte(tar.TypeBlock)
+		if sc.Type == "char-device" {
+			typ = tar.TypeChar
+		}
+		hdr := tarHeader(sc, name, typ, 0644)
+		hdr.Devmajor = int64(sc.DeviceMajor)
+		hdr.Devminor = int64(sc.DeviceMinor)
+		return tw.WriteHeader(hdr)
+	case "socket":
+		// Like tar(1), which has no type for them.
+		if *flagVerbose {
+			log.Printf("Not archiving socket %s", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown blob type: %s", sc.Type)
+}
+
+// tarHeader returns the tar header of sc, named name, with its
+// permissions, or perm if it has none, its owner and its modtime.
+func tarHeader(sc *schema.Superset, name string, typ byte, perm int64) *tar.Header {
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: typ,
+		Mode:     perm,
+		Uid:      sc.UnixOwnerId,
+		Gid:      sc.UnixGroupId,
+		Uname:    sc.UnixOwner,
+		Gname:    sc.UnixGroup,
+		ModTime:  sc.ModTime(),
+	}
+	if m, err := strconv.ParseUint(sc.UnixPermission, 8, 64); err == nil {
+		hdr.Mode = int64(m)
+	}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = time.Now()
+	}
+	return hdr
+}
+
+// tarName makes a name from a schema blob safe to use as a tar path
+// element.
+func tarName(name string) string {
+	name = strings.Replace(name, "/", "_", -1)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
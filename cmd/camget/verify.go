@@ -0,0 +1,112 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// filesWithContents returns the file schema blobs with the contents
+// of a whole file's digest, when the server can be searched; it can't
+// through shares.
+var filesWithContents func(wholeRef *blobref.BlobRef) ([]*blobref.BlobRef, error)
+
+// The counts of verified blobs and files, and of files whose whole
+// contents couldn't be checked.
+var verifiedBlobs, verifiedFiles, uncheckedFiles int64
+
+// verifyingFetcher is a StreamingFetcher hashing the blobs it fetches,
+// whose readers fail at their end if a blob doesn't match its
+// blobref.
+type verifyingFetcher struct {
+	src blobref.StreamingFetcher
+}
+
+func (f verifyingFetcher) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, error) {
+	rc, size, err := f.src.FetchStreaming(br)
+	if err != nil {
+		return nil, 0, err
+	}
+	h := br.Hash()
+	if h == nil {
+		log.Printf("Can't verify %s: unsupported hash", br)
+		return rc, size, nil
+	}
+	return &verifyingReader{rc: rc, br: br, h: h}, size, nil
+}
+
+type verifyingReader struct {
+	rc io.ReadCloser
+	br *blobref.BlobRef
+	h  hash.Hash
+}
+
+func (r *verifyingReader) Read(p []byte) (n int, err error) {
+	n, err = r.rc.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		if !r.br.HashMatches(r.h) {
+			return n, fmt.Errorf("verification failed: blob %s is corrupt; its contents have digest %x", r.br, r.h.Sum(nil))
+		}
+		atomic.AddInt64(&verifiedBlobs, 1)
+	}
+	return
+}
+
+func (r *verifyingReader) Close() error {
+	return r.rc.Close()
+}
+
+// verifyFile checks that the file name, as written on disk, has the
+// contents indexed for the file schema br.
+func verifyFile(name string, br *blobref.BlobRef) error {
+	if filesWithContents == nil {
+		atomic.AddInt64(&uncheckedFiles, 1)
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	wholeRef := blobref.FromHash("sha1", h)
+	files, err := filesWithContents(wholeRef)
+	if err != nil {
+		log.Printf("Can't verify the whole contents of %s: %v", name, err)
+		atomic.AddInt64(&uncheckedFiles, 1)
+		return nil
+	}
+	for _, f := range files {
+		if f.Equal(br) {
+			atomic.AddInt64(&verifiedFiles, 1)
+			return nil
+		}
+	}
+	return fmt.Errorf("verification failed: %s has digest %s, which isn't the one indexed for file %s", name, wholeRef, br)
+}
@@ -76,7 +76,7 @@ func main() {
 			errorf("Error creating root with %v: %v", root, err)
 		}
 	} else {
-		camfs = fs.NewCamliFileSystem(fetcher)
+		camfs = fs.NewCamliFileSystem(client, fetcher)
 		log.Printf("starting with fs %#v", camfs)
 	}
 
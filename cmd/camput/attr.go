@@ -28,6 +28,9 @@ import (
 type attrCmd struct {
 	add bool
 	del bool
+
+	importFile string // CSV or JSON file of attributes to import
+	format     string // of importFile, if not its extension
 }
 
 func init() {
@@ -35,6 +38,8 @@ func init() {
 		cmd := new(attrCmd)
 		flags.BoolVar(&cmd.add, "add", false, `Adds attribute (e.g. "tag")`)
 		flags.BoolVar(&cmd.del, "del", false, "Deletes named attribute [value]")
+		flags.StringVar(&cmd.importFile, "import", "", "Optional CSV or JSON file of permanodes, or of files uploaded with 'camput file -filenodes', and the attributes to set on them, such as from a photo manager. The claims are signed and uploaded in batches.")
+		flags.StringVar(&cmd.format, "format", "", "The format of the -import file, 'csv' or 'json'. Defaults to the extension of its name.")
 		return cmd
 	})
 }
@@ -48,10 +53,17 @@ func (c *attrCmd) Examples() []string {
 		"<permanode> <name> <value>         Set attribute",
 		"--add <permanode> <name> <value>   Adds attribute (e.g. \"tag\")",
 		"--del <permanode> <name> [<value>] Deletes named attribute [value",
+		"--import=tags.csv                  Sets the attributes of a CSV or JSON file",
 	}
 }
 
 func (c *attrCmd) RunCommand(up *Uploader, args []string) error {
+	if c.importFile != "" {
+		if len(args) != 0 || c.add || c.del {
+			return UsageError("--import takes no arguments, nor --add or --del")
+		}
+		return c.importAttrs(up, c.importFile)
+	}
 	if len(args) != 3 {
 		return errors.New("Attr takes 3 args: <permanode> <attr> <value>")
 	}
@@ -0,0 +1,230 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+)
+
+// attrImportBatch is how many claims of an import are uploaded at
+// once.
+const attrImportBatch = 100
+
+// An attrImport is the attributes of an import file, to set on a
+// permanode, or on the permanode of a file.
+type attrImport struct {
+	where     string // position in the import file, for errors
+	permanode string // or "" if file is set
+	file      string
+	attrs     attrFlags
+}
+
+// readAttrImport reads the attributes of an import file of format
+// "csv" or "json".
+//
+// A CSV file starts with a header line. Its first column is
+// "permanode" or "file", and the next ones are attribute names,
+// which may be repeated for attributes with several values. Empty
+// cells are skipped:
+//
+//   file,title,tag,tag
+//   /photos/beach.jpg,"Beach, at last",summer,2012
+//
+// A JSON file is a list of objects with a "permanode" or a "file",
+// and "attrs", whose values are strings or lists of strings:
+//
+//   [{"permanode": "sha1-...", "attrs": {"title": "Beach", "tag": ["summer", "2012"]}}]
+func readAttrImport(r io.Reader, format string) ([]*attrImport, error) {
+	switch format {
+	case "csv":
+		return readAttrImportCSV(r)
+	case "json":
+		return readAttrImportJSON(r)
+	}
+	return nil, fmt.Errorf("unknown import format %q", format)
+}
+
+func readAttrImportCSV(r io.Reader) ([]*attrImport, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %v", err)
+	}
+	if len(header) < 2 || (header[0] != "permanode" && header[0] != "file") {
+		return nil, fmt.Errorf(`CSV header must be "permanode" or "file", then attribute names; got %q`, header)
+	}
+	var imports []*attrImport
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return imports, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) > len(header) {
+			return nil, fmt.Errorf("line %d: %d columns; the header has %d", line, len(row), len(header))
+		}
+		ai := &attrImport{where: fmt.Sprintf("line %d", line)}
+		if header[0] == "file" {
+			ai.file = row[0]
+		} else {
+			ai.permanode = row[0]
+		}
+		for i, value := range row[1:] {
+			if value != "" {
+				ai.attrs = append(ai.attrs, [2]string{header[i+1], value})
+			}
+		}
+		imports = append(imports, ai)
+	}
+}
+
+func readAttrImportJSON(r io.Reader) ([]*attrImport, error) {
+	var records []struct {
+		Permanode string
+		File      string
+		Attrs     map[string]interface{}
+	}
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, fmt.Errorf("reading JSON: %v", err)
+	}
+	var imports []*attrImport
+	for i, rec := range records {
+		ai := &attrImport{where: fmt.Sprintf("record %d", i+1), permanode: rec.Permanode, file: rec.File}
+		if (ai.permanode == "") == (ai.file == "") {
+			return nil, fmt.Errorf(`%s: needs either a "permanode" or a "file"`, ai.where)
+		}
+		names := make([]string, 0, len(rec.Attrs))
+		for name := range rec.Attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			switch v := rec.Attrs[name].(type) {
+			case string:
+				ai.attrs = append(ai.attrs, [2]string{name, v})
+			case []interface{}:
+				for _, vv := range v {
+					s, ok := vv.(string)
+					if !ok {
+						return nil, fmt.Errorf("%s: attribute %q has a non-string value %v", ai.where, name, vv)
+					}
+					ai.attrs = append(ai.attrs, [2]string{name, s})
+				}
+			default:
+				return nil, fmt.Errorf("%s: attribute %q is neither a string nor a list of strings", ai.where, name)
+			}
+		}
+		imports = append(imports, ai)
+	}
+	return imports, nil
+}
+
+// importFormat returns the format of the import file name, by its
+// extension, unless format is given.
+func importFormat(name, format string) string {
+	if format != "" {
+		return format
+	}
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+}
+
+// permanodeRef returns the permanode of the import: the given one, or
+// the planned permanode of the file's contents that "camput file
+// -filenodes" makes.
+func (ai *attrImport) permanodeRef(up *Uploader) (*blobref.BlobRef, error) {
+	if ai.file == "" {
+		pn := blobref.Parse(ai.permanode)
+		if pn == nil {
+			return nil, fmt.Errorf("%s: error parsing blobref %q", ai.where, ai.permanode)
+		}
+		return pn, nil
+	}
+	sum, err := up.wholeFileDigest(ai.file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ai.where, err)
+	}
+	pr, err := up.UploadPlannedPermanode(sum.String(), time.Unix(0, 0))
+	if err != nil {
+		return nil, fmt.Errorf("%s: permanode of %s: %v", ai.where, ai.file, err)
+	}
+	return pr.BlobRef, nil
+}
+
+// importAttrs signs the claims of the attributes of the import file
+// name, and uploads them in batches.
+func (c *attrCmd) importAttrs(up *Uploader, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	imports, err := readAttrImport(f, importFormat(name, c.format))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	var batch []*client.UploadHandle
+	var whats []string
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		prs, err := up.Client.UploadMany(batch)
+		if err != nil {
+			return err
+		}
+		for i, what := range whats {
+			handleResult(what, prs[i], nil)
+		}
+		batch, whats = nil, nil
+		return nil
+	}
+	for _, ai := range imports {
+		pn, err := ai.permanodeRef(up)
+		if err != nil {
+			return err
+		}
+		for _, cl := range attrClaims(pn, ai.attrs) {
+			signed, err := up.SignMap(cl.m, time.Time{})
+			if err != nil {
+				return fmt.Errorf("%s: error signing %s: %v", ai.where, cl.what, err)
+			}
+			batch = append(batch, client.NewUploadHandleFromString(signed))
+			whats = append(whats, cl.what)
+		}
+		if len(batch) >= attrImportBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
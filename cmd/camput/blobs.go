@@ -17,7 +17,6 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"errors"
 	"flag"
@@ -27,6 +26,7 @@ import (
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/readerutil"
 )
 
 type blobCmd struct{}
@@ -67,29 +67,29 @@ func (c *blobCmd) RunCommand(up *Uploader, args []string) error {
 			return err
 		}
 		put, err := up.Upload(handle)
+		if c, ok := handle.Contents.(io.Closer); ok {
+			c.Close()
+		}
 		handleResult("blob", put, err)
 		continue
 	}
 	return nil
 }
 
+// maxStdinMem is the most of stdin kept in memory by "camput blob -".
+// The rest is spooled to a temporary file.
+const maxStdinMem = 1 << 20
+
 func stdinBlobHandle() (uh *client.UploadHandle, err error) {
-	var buf bytes.Buffer
-	size, err := io.Copy(&buf, stdin)
-	if err != nil {
-		return
-	}
-	// TODO(bradfitz,mpl): limit this buffer size?
-	file := buf.Bytes()
 	s1 := sha1.New()
-	size, err = io.Copy(s1, &buf)
+	spool, err := readerutil.NewSpool(io.TeeReader(stdin, s1), maxStdinMem)
 	if err != nil {
 		return
 	}
 	return &client.UploadHandle{
 		BlobRef:  blobref.FromHash("sha1", s1),
-		Size:     size,
-		Contents: io.LimitReader(bytes.NewReader(file), size),
+		Size:     spool.Size(),
+		Contents: spool,
 	}, nil
 }
 
@@ -107,12 +107,13 @@ func fileBlobHandle(up *Uploader, path string) (uh *client.UploadHandle, err err
 	}
 	ref, size, err := blobDetails(file)
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
 	return &client.UploadHandle{
 		BlobRef:  ref,
 		Size:     size,
-		Contents: io.LimitReader(file, size),
+		Contents: file,
 	}, nil
 }
 
@@ -25,6 +25,7 @@ import (
 	"os"
 	"sort"
 
+	"camlistore.org/pkg/blobserver/localdisk"
 	"camlistore.org/pkg/client"
 	"camlistore.org/pkg/httputil"
 	"camlistore.org/pkg/jsonsign"
@@ -36,6 +37,10 @@ var (
 	flagHelp    = flag.Bool("help", false, "print usage")
 	flagVerbose = flag.Bool("verbose", false, "extra debug logging")
 	flagHTTP    = flag.Bool("verbose_http", false, "show HTTP request summaries")
+	flagLimit   = flag.Int64("rate-limit", 0, "If non-zero, the maximum rate, in bytes per second, of all the uploads together.")
+	flagStats   = flag.Bool("stats", false, "After uploading, print to stderr how many bytes were sent to the server versus stored, the rest being in blobs the server already had.")
+	flagQueue   = flag.String("offline-queue", "", "If non-empty, a directory where blobs go while the server is unreachable, to be uploaded by the next camput run with the same -offline-queue that reaches the server.")
+	flagJSON    = flag.Bool("json-progress", false, "Write JSON objects to stdout, one per line: progress events every second, with the files done, bytes uploaded, dedup hits and ETA, and results instead of the plain blobrefs.")
 )
 
 var ErrUsage = UsageError("invalid command usage")
@@ -144,8 +149,15 @@ func handleResult(what string, pr *client.PutResult, err error) error {
 	if err != nil {
 		log.Printf("Error putting %s: %s", what, err)
 		wereErrors = true
+		if progress != nil {
+			writeEvent(&resultEvent{Event: "result", What: what, Error: err.Error()})
+		}
 		return err
 	}
+	if progress != nil {
+		writeEvent(&resultEvent{Event: "result", What: what, BlobRef: pr.BlobRef.String()})
+		return nil
+	}
 	fmt.Println(pr.BlobRef.String())
 	return nil
 }
@@ -158,9 +170,27 @@ func newUploader() *Uploader {
 
 	httpStats := &httputil.StatsTransport{
 		VerboseLog: *flagHTTP,
+		Transport:  cc.BaseTransport(),
+	}
+	if *flagLimit > 0 {
+		httpStats.Transport = &httputil.RateLimitedTransport{
+			Transport:      cc.BaseTransport(),
+			BytesPerSecond: *flagLimit,
+		}
 	}
 	cc.SetHTTPClient(&http.Client{Transport: httpStats})
 
+	if *flagQueue != "" {
+		if err := os.MkdirAll(*flagQueue, 0700); err != nil {
+			log.Fatalf("Error creating offline queue: %v", err)
+		}
+		q, err := localdisk.New(*flagQueue)
+		if err != nil {
+			log.Fatalf("Error opening offline queue: %v", err)
+		}
+		cc.SetOfflineQueue(q)
+	}
+
 	pwd, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("os.Getwd: %v", err)
@@ -176,6 +206,18 @@ func newUploader() *Uploader {
 	}
 }
 
+// flushOfflineQueue uploads the blobs left in the offline queue by
+// previous runs, if the server is reachable.
+func flushOfflineQueue(up *Uploader) {
+	n, err := up.FlushOfflineQueue()
+	if n > 0 {
+		log.Printf("Uploaded %d blobs from the offline queue %s.", n, *flagQueue)
+	}
+	if err != nil {
+		log.Printf("Not done uploading the offline queue %s: %v", *flagQueue, err)
+	}
+}
+
 func hasFlags(flags *flag.FlagSet) bool {
 	any := false
 	flags.VisitAll(func(*flag.Flag) {
@@ -235,7 +277,18 @@ func camputMain(args ...string) {
 	if err != nil {
 		err = ErrUsage
 	} else {
+		if *flagQueue != "" && up != nil {
+			flushOfflineQueue(up)
+		}
+		if *flagJSON && up != nil {
+			progress = newJSONProgress(up)
+			progress.start()
+		}
 		err = cmd.RunCommand(up, cmdFlags.Args())
+		if progress != nil {
+			progress.stop()
+			progress = nil
+		}
 	}
 	if ue, isUsage := err.(UsageError); isUsage {
 		if isUsage {
@@ -251,6 +304,14 @@ func camputMain(args ...string) {
 		}
 		exit(1)
 	}
+	if *flagQueue != "" && up != nil && up.Offline() {
+		st := up.Stats()
+		log.Printf("Server unreachable; queued %d blobs (%d bytes) in %s, to upload on the next run with -offline-queue.",
+			st.Queued.Blobs, st.Queued.Bytes, *flagQueue)
+	}
+	if *flagStats && up != nil {
+		writeDedupReport(stderr, up.Stats())
+	}
 	if *flagVerbose {
 		stats := up.Stats()
 		log.Printf("Client stats: %s", stats.String())
@@ -18,10 +18,19 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
 )
 
 // env is the environment that a camput test runs within.
@@ -79,3 +88,331 @@ func TestUploadingChangingDirectory(t *testing.T) {
 	// ... verify it doesn't hang.
 	t.Logf("TODO")
 }
+
+func TestIgnoreRules(t *testing.T) {
+	root, err := ioutil.TempDir("", "camput-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"src/build", "src/lib", "node_modules", "logs"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a.tmp", "src/a.o", "src/a.c", "src/lib/b.o", "logs/x.log", "build"} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignoreFile := "# object files\n*.o\nbuild/\n/lib/*.c\n"
+	if err := ioutil.WriteFile(filepath.Join(root, "src", ignoreFileName), []byte(ignoreFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := newIgnoreRules(root, []string{"*.tmp", "node_modules/", "logs/*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tu := &TreeUpload{up: &Uploader{}}
+	srcRules, err := tu.withIgnoreFile(rules, filepath.Join(root, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || len(srcRules) != 6 {
+		t.Fatalf("got %d and %d rules; want 3 and 6", len(rules), len(srcRules))
+	}
+	tests := []struct {
+		rules ignoreRules
+		file  string
+		want  bool
+	}{
+		{rules, "a.tmp", true},
+		{rules, "node_modules", true},
+		{rules, "logs", false},
+		{rules, "logs/x.log", true},
+		{rules, "build", false},
+		{rules, "src/a.o", false},
+		{srcRules, "src/a.o", true},
+		{srcRules, "src/a.c", false},
+		{srcRules, "src/lib/b.o", true},
+		{srcRules, "src/build", true},
+		{srcRules, "src/lib", false},
+	}
+	for _, tt := range tests {
+		fullPath := filepath.Join(root, tt.file)
+		fi, err := os.Lstat(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.rules.ignored(fullPath, fi); got != tt.want {
+			t.Errorf("ignored(%q) = %v; want %v", tt.file, got, tt.want)
+		}
+	}
+
+	if _, err := newIgnoreRules(root, []string{"[oops"}); err == nil {
+		t.Errorf("bad pattern accepted")
+	}
+}
+
+func TestFlatStatCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camput-statcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheFile := filepath.Join(dir, "statcache")
+	c := newFlatStatCache(cacheFile)
+	if _, err := c.CachedPutResult(dir, file, fi); err != errCacheMiss {
+		t.Fatalf("empty cache: err = %v; want a miss", err)
+	}
+	pr := &client.PutResult{BlobRef: blobref.SHA1FromString("foo"), Size: 3}
+	for i := 0; i < 2*staleStatCacheLines; i++ {
+		c.AddCachedPutResult(dir, file, fi, pr)
+	}
+	c.af.Close()
+
+	c = newFlatStatCache(cacheFile)
+	got, err := c.CachedPutResult(dir, file, fi)
+	if err != nil {
+		t.Fatalf("reloaded cache: %v", err)
+	}
+	if !got.BlobRef.Equal(pr.BlobRef) || got.Size != pr.Size {
+		t.Errorf("cached result = %v; want %v", got, pr)
+	}
+	b, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 1 {
+		t.Errorf("reloaded cache file has %d lines; want compaction to 1", n)
+	}
+
+	mtime := fi.ModTime().Add(time.Hour)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Lstat(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CachedPutResult(dir, file, fi); err != errCacheMiss {
+		t.Errorf("modified file: err = %v; want a miss", err)
+	}
+}
+
+func TestWatchChanges(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("changes are only watched on linux")
+	}
+	dir, err := ioutil.TempDir("", "camput-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	changes, err := watchChanges(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitChange := func(what string) {
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change noticed after %s", what)
+		}
+	}
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0700); err != nil {
+		t.Fatal(err)
+	}
+	waitChange("mkdir")
+	// Let the new directory be watched.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-changes:
+	default:
+	}
+	if err := ioutil.WriteFile(filepath.Join(sub, "file"), []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitChange("writing a file in a new directory")
+}
+
+func TestPermanodeClaims(t *testing.T) {
+	c := &permanodeCmd{name: "Some Name", tag: "foo,bar", content: "sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"}
+	for _, s := range []string{"author=Brad", "author=Mathieu", "url=http://example.com/?a=b"} {
+		if err := c.attrs.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.attrs.Set("noequals"); err == nil {
+		t.Error("attribute without a value accepted")
+	}
+	pn := blobref.SHA1FromString("some permanode")
+	claims, err := c.claims(pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"set-attribute title=Some Name",
+		"add-attribute tag=foo",
+		"add-attribute tag=bar",
+		"set-attribute author=Brad",
+		"add-attribute author=Mathieu",
+		"set-attribute url=http://example.com/?a=b",
+		"set-attribute camliContent=sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33",
+	}
+	var got []string
+	for _, cl := range claims {
+		if cl.m["permaNode"] != pn.String() {
+			t.Errorf("claim %v isn't on the permanode", cl.m)
+		}
+		got = append(got, fmt.Sprintf("%s %s=%s", cl.m["claimType"], cl.m["attribute"], cl.m["value"]))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("claims = %q; want %q", got, want)
+	}
+
+	c = &permanodeCmd{content: "not-a-blobref"}
+	if _, err := c.claims(pn); err == nil {
+		t.Error("invalid content blobref accepted")
+	}
+}
+
+func TestReadAttrImport(t *testing.T) {
+	tests := []struct {
+		format, in string
+		want       []*attrImport // nil if an error is expected
+	}{
+		{
+			format: "csv",
+			in:     "file,title,tag,tag\n/photos/beach.jpg,\"Beach, at last\",summer,2012\n/photos/cat.jpg,Cat,,\n",
+			want: []*attrImport{
+				{where: "line 2", file: "/photos/beach.jpg", attrs: attrFlags{{"title", "Beach, at last"}, {"tag", "summer"}, {"tag", "2012"}}},
+				{where: "line 3", file: "/photos/cat.jpg", attrs: attrFlags{{"title", "Cat"}}},
+			},
+		},
+		{format: "csv", in: "blob,title\nsha1-foo,x\n"},
+		{format: "csv", in: "permanode,title\nsha1-foo,x,y\n"},
+		{
+			format: "json",
+			in:     `[{"permanode": "sha1-foo", "attrs": {"title": "Beach", "tag": ["summer", "2012"]}}]`,
+			want: []*attrImport{
+				{where: "record 1", permanode: "sha1-foo", attrs: attrFlags{{"tag", "summer"}, {"tag", "2012"}, {"title", "Beach"}}},
+			},
+		},
+		{format: "json", in: `[{"attrs": {"title": "Beach"}}]`},
+		{format: "json", in: `[{"file": "a.jpg", "attrs": {"rating": 5}}]`},
+		{format: "xml", in: "<attrs/>"},
+	}
+	for i, tt := range tests {
+		got, err := readAttrImport(strings.NewReader(tt.in), tt.format)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%d. %s import %q: want an error", i, tt.format, tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. %s import: %v", i, tt.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d. %s import = %+v; want %+v", i, tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestDedupReport(t *testing.T) {
+	var buf bytes.Buffer
+	writeDedupReport(&buf, client.Stats{
+		UploadRequests: client.ByCountAndBytes{Blobs: 10, Bytes: 4 << 20},
+		Uploads:        client.ByCountAndBytes{Blobs: 3, Bytes: 1 << 20},
+	})
+	want := "Stored:          10 blobs, 4.0 MiB\n" +
+		"Uploaded:         3 blobs, 1.0 MiB\n" +
+		"Already had:      7 blobs, 3.0 MiB (75.0% of the bytes not sent)\n"
+	if buf.String() != want {
+		t.Errorf("report = %q; want %q", buf.String(), want)
+	}
+
+	for n, want := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 << 30: "5.0 GiB"} {
+		if got := humanBytes(n); got != want {
+			t.Errorf("humanBytes(%d) = %q; want %q", n, got, want)
+		}
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camput-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var fis []os.FileInfo
+	for _, name := range []string{"a", "b"} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, make([]byte, 100), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fis = append(fis, fi)
+	}
+
+	p := &jsonProgress{
+		began: time.Unix(1000, 0),
+		stats: func() client.Stats {
+			var st client.Stats
+			st.UploadRequests.Blobs, st.UploadRequests.Bytes = 3, 300
+			st.Uploads.Blobs, st.Uploads.Bytes = 1, 100
+			return st
+		},
+	}
+	p.startScan()
+	p.addTotal(fis[0])
+	p.addTotal(fis[1])
+	p.addDone(fis[0], true)
+	now := time.Unix(1010, 0)
+	if ev := p.event("progress", now); ev.ETA != 0 || !ev.Scanning {
+		t.Errorf("while scanning: ETA = %v, scanning = %v; want no ETA", ev.ETA, ev.Scanning)
+	}
+	p.endScan()
+	got := p.event("progress", now)
+	want := &progressEvent{
+		Event:         "progress",
+		Elapsed:       10,
+		TotalFiles:    2,
+		TotalBytes:    200,
+		DoneFiles:     1,
+		DoneBytes:     100,
+		SkippedFiles:  1,
+		UploadedBlobs: 1,
+		UploadedBytes: 100,
+		DedupBlobs:    2,
+		DedupBytes:    200,
+		ETA:           10,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("event = %+v; want %+v", got, want)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+	progress = p
+	defer func() { progress = nil }()
+	handleResult("file", &client.PutResult{BlobRef: blobref.SHA1FromString("foo")}, nil)
+	if want := `{"event":"result","what":"file","blobRef":"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"}` + "\n"; buf.String() != want {
+		t.Errorf("result = %q; want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"camlistore.org/pkg/client"
+)
+
+// writeDedupReport writes to w the --stats report of st: the blobs and
+// bytes stored, those of them actually uploaded, and those the server
+// already had, which content addressing spared from being sent again.
+func writeDedupReport(w io.Writer, st client.Stats) {
+	stored, sent, dedup := st.UploadRequests, st.Uploads, st.Dedup()
+	fmt.Fprintf(w, "Stored:      %6d blobs, %s\n", stored.Blobs, humanBytes(stored.Bytes))
+	fmt.Fprintf(w, "Uploaded:    %6d blobs, %s\n", sent.Blobs, humanBytes(sent.Bytes))
+	if q := st.Queued; q.Blobs > 0 {
+		fmt.Fprintf(w, "Queued:      %6d blobs, %s\n", q.Blobs, humanBytes(q.Bytes))
+	}
+	fmt.Fprintf(w, "Already had: %6d blobs, %s", dedup.Blobs, humanBytes(dedup.Bytes))
+	if stored.Bytes > 0 {
+		fmt.Fprintf(w, " (%.1f%% of the bytes not sent)", 100*float64(dedup.Bytes)/float64(stored.Bytes))
+	}
+	fmt.Fprintln(w)
+}
+
+// humanBytes formats n bytes with a binary unit, such as "1.5 MiB".
+func humanBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, i := float64(n)/(1<<10), 0
+	for v >= 1<<10 && i < len(units)-1 {
+		v /= 1 << 10
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
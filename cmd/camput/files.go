@@ -37,6 +37,7 @@ import (
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/osutil"
 	"camlistore.org/pkg/schema"
 )
 
@@ -51,6 +52,12 @@ type fileCmd struct {
 
 	havecache, statcache bool
 
+	uploads      int    // files uploaded concurrently
+	chunkUploads int    // chunks of a file uploaded concurrently
+	inline       int    // files smaller than this are inline in their file schema blob
+	exclude      string // comma-separated patterns of files left out of directory uploads
+	watch        bool   // keep uploading the directory as it changes
+
 	// Go into in-memory stats mode only; doesn't actually upload.
 	memstats bool
 	histo    string // optional histogram output filename
@@ -68,6 +75,16 @@ func init() {
 		flags.StringVar(&cmd.name, "name", "", "Optional name attribute to set on permanode when using -permanode.")
 		flags.StringVar(&cmd.tag, "tag", "", "Optional tag(s) to set on permanode when using -permanode or -filenodes. Single value or comma separated.")
 
+		flags.IntVar(&cmd.uploads, "uploads", uploadWorkers, "Number of files of a directory to upload concurrently.")
+		flags.IntVar(&cmd.chunkUploads, "chunkuploads", 4, "Number of chunks of a file to upload concurrently. The chunks are statted in batches first, to only upload the missing ones. "+
+			"Each file being uploaded holds up to 3 x chunkuploads MB of chunks in memory, so on devices with little memory, lower -uploads and -chunkuploads.")
+		flags.IntVar(&cmd.inline, "inline", 0, "Files smaller than this many bytes, at most 65536, have their contents in their file schema blob instead of in a blob of their own, "+
+			"which halves the blobs of trees of small files. 0 disables it.")
+		flags.StringVar(&cmd.exclude, "exclude", "", "Optional glob pattern(s) of files to leave out of directory uploads, such as '*.tmp,node_modules/'. Single value or comma separated. "+
+			"Patterns with a slash match paths relative to the uploaded directory; a trailing slash matches only directories. "+
+			"The same patterns, one per line, may also be listed in a directory's "+ignoreFileName+" file.")
+		flags.BoolVar(&cmd.watch, "watch", false, "Keep running, uploading the directory again whenever it changes and setting the new version as the content of its permanode. "+
+			"The permanode is created the first time, named after the directory or -name, with the tags of -tag, and remembered for the next runs.")
 		flags.BoolVar(&cmd.diskUsage, "du", false, "Dry run mode: only show disk usage information, without upload or statting dest. Used for testing skipDirs configs, mostly.")
 
 		if debug, _ := strconv.ParseBool(os.Getenv("CAMLI_DEBUG")); debug {
@@ -107,15 +124,43 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 			return UsageError("--vivify excludes any other option")
 		}
 	}
-	if c.name != "" && !c.makePermanode {
-		return UsageError("Can't set name without using --permanode")
+	if c.name != "" && !c.makePermanode && !c.watch {
+		return UsageError("Can't set name without using --permanode or --watch")
+	}
+	if c.tag != "" && !c.makePermanode && !c.filePermanodes && !c.watch {
+		return UsageError("Can't set tag without using --permanode, --filenodes or --watch")
 	}
-	if c.tag != "" && !c.makePermanode && !c.filePermanodes {
-		return UsageError("Can't set tag without using --permanode or --filenodes")
+	if c.watch {
+		if c.vivify || c.makePermanode || c.diskUsage {
+			return UsageError("--watch can't be used with --vivify, --permanode or --du")
+		}
+		if len(args) != 1 {
+			return UsageError("--watch needs exactly one directory argument")
+		}
+		if fi, err := os.Stat(args[0]); err != nil || !fi.IsDir() {
+			return UsageError("--watch needs exactly one directory argument")
+		}
 	}
 	if c.histo != "" && !c.memstats {
 		return UsageError("Can't use histo without memstats")
 	}
+	if c.uploads < 1 {
+		return UsageError("uploads must be at least 1")
+	}
+	if c.chunkUploads < 1 {
+		return UsageError("chunkuploads must be at least 1")
+	}
+	schema.SetChunkUploadConcurrency(c.chunkUploads)
+	if c.inline < 0 || c.inline > 64<<10 {
+		return UsageError("inline must be between 0 and 65536")
+	}
+	schema.SetInlineThreshold(c.inline)
+	if c.exclude != "" {
+		up.exclude = strings.Split(c.exclude, ",")
+		if _, err := newIgnoreRules("", up.exclude); err != nil {
+			return UsageError(err.Error())
+		}
+	}
 	if c.memstats {
 		sr := new(statsStatReceiver)
 		up.altStatReceiver = sr
@@ -129,6 +174,7 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 			if c.statcache {
 				cache := NewFlatStatCache(gen)
 				up.statCache = cache
+				up.resumeCache = NewResumeCache(gen)
 			}
 			if c.havecache {
 				cache := NewFlatHaveCache(gen)
@@ -143,7 +189,7 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 			return UsageError("A gpg key is needed to create permanodes; configure one or use vivify mode.")
 		}
 	}
-	up.fileOpts = &fileOptions{permanode: c.filePermanodes, tag: c.tag, vivify: c.vivify}
+	up.fileOpts = &fileOptions{permanode: c.filePermanodes, tag: c.tag, vivify: c.vivify, uploads: c.uploads}
 
 	var (
 		permaNode *client.PutResult
@@ -159,6 +205,9 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 			return fmt.Errorf("Uploading permanode: %v", err)
 		}
 	}
+	if c.watch {
+		return c.watchTree(up, args[0])
+	}
 	if c.diskUsage {
 		if len(args) != 1 {
 			return fmt.Errorf("The --du flag can only be used with exactly one directory argument")
@@ -196,7 +245,9 @@ func (c *fileCmd) RunCommand(up *Uploader, args []string) error {
 			t.Start()
 			lastPut, err = t.Wait()
 		} else {
+			progress.addTotal(fi)
 			lastPut, err = up.UploadFile(filename)
+			progress.addDone(fi, false)
 		}
 		if handleResult("file", lastPut, err) != nil {
 			return err
@@ -286,9 +337,13 @@ type stats struct {
 }
 
 func (s *stats) incr(n *node) {
+	s.add(n.fi)
+}
+
+func (s *stats) add(fi os.FileInfo) {
 	s.files++
-	if !n.fi.IsDir() {
-		s.bytes += n.fi.Size()
+	if !fi.IsDir() {
+		s.bytes += fi.Size()
 	}
 }
 
@@ -316,6 +371,26 @@ func (up *Uploader) open(path string) (http.File, error) {
 	return up.fs.Open(path)
 }
 
+// addXattrs records the extended attributes of n's file or directory
+// in m, except the "security." ones, such as SELinux labels, which
+// are the host's business.
+func (up *Uploader) addXattrs(m schema.Map, n *node) {
+	if up.fs != nil || n.fi.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+	xattrs, err := osutil.Xattrs(n.fullPath)
+	if err != nil {
+		vlog.Printf("Not recording the extended attributes of %s: %v", n.fullPath, err)
+		return
+	}
+	for name := range xattrs {
+		if strings.HasPrefix(name, "security.") {
+			delete(xattrs, name)
+		}
+	}
+	m.SetUnixXattrs(xattrs)
+}
+
 func (up *Uploader) uploadNode(n *node) (*client.PutResult, error) {
 	fi := n.fi
 	mode := fi.Mode()
@@ -323,6 +398,7 @@ func (up *Uploader) uploadNode(n *node) (*client.PutResult, error) {
 		return up.uploadNodeRegularFile(n)
 	}
 	m := schema.NewCommonFileMap(n.fullPath, fi)
+	up.addXattrs(m, n)
 	switch {
 	case mode&os.ModeSymlink != 0:
 		// TODO(bradfitz): use VFS here; not os.Readlink
@@ -331,15 +407,11 @@ func (up *Uploader) uploadNode(n *node) (*client.PutResult, error) {
 			return nil, err
 		}
 		m.SetSymlinkTarget(target)
-	case mode&os.ModeDevice != 0:
-		// including mode & os.ModeCharDevice
-		fallthrough
-	case mode&os.ModeSocket != 0:
-		fallthrough
-	case mode&os.ModeNamedPipe != 0: // FIFO
-		fallthrough
 	default:
-		return nil, schema.ErrUnimplemented
+		// Devices (including char devices), sockets and FIFOs.
+		if err := m.SetSpecialFile(fi); err != nil {
+			return nil, err
+		}
 	case fi.IsDir():
 		ss := new(schema.StaticSet)
 		for _, c := range n.children {
@@ -349,7 +421,16 @@ func (up *Uploader) uploadNode(n *node) (*client.PutResult, error) {
 			}
 			ss.Add(pr.BlobRef)
 		}
-		sspr, err := up.UploadMap(ss.Map())
+		top, subsets, err := ss.Maps()
+		if err != nil {
+			return nil, err
+		}
+		for _, sub := range subsets {
+			if _, err := up.UploadMap(sub); err != nil {
+				return nil, err
+			}
+		}
+		sspr, err := up.UploadMap(top)
 		if err != nil {
 			return nil, err
 		}
@@ -466,6 +547,7 @@ func (up *Uploader) fileMapFromDuplicate(bs blobserver.StatReceiver, fileMap sch
 
 func (up *Uploader) uploadNodeRegularFile(n *node) (*client.PutResult, error) {
 	m := schema.NewCommonFileMap(n.fullPath, n.fi)
+	up.addXattrs(m, n)
 	m["camliType"] = "file"
 	file, err := up.open(n.fullPath)
 	if err != nil {
@@ -501,8 +583,16 @@ func (up *Uploader) uploadNodeRegularFile(n *node) (*client.PutResult, error) {
 		sum     string           // "sha1-xxxxx"
 	)
 
+	// A resumed upload skips the duplicate check, since hashing the
+	// whole file again is what resuming saves, unless the digest is
+	// needed for the permanode anyway.
+	var resumeFrom *schema.Checkpoint
+	if up.resumeCache != nil && size >= resumeMinSize {
+		resumeFrom = up.resumeCache.Checkpoint(n.fullPath, n.fi)
+	}
+
 	const dupCheckThreshold = 256 << 10
-	if size > dupCheckThreshold {
+	if size > dupCheckThreshold && (resumeFrom == nil || up.fileOpts.wantFilePermanode()) {
 		sumRef, err := up.wholeFileDigest(n.fullPath)
 		if err == nil {
 			sum = sumRef.String()
@@ -515,8 +605,14 @@ func (up *Uploader) uploadNodeRegularFile(n *node) (*client.PutResult, error) {
 	if blobref == nil {
 		if sum == "" && up.fileOpts.wantFilePermanode() {
 			fileContents = &trackDigestReader{r: fileContents}
+			// The digest needs all of the contents.
+			resumeFrom = nil
+		}
+		if up.resumeCache != nil && size >= resumeMinSize {
+			blobref, err = up.writeFileMapResumable(m, n, file, fileContents, resumeFrom)
+		} else {
+			blobref, err = schema.WriteFileMap(up.statReceiver(), m, fileContents)
 		}
-		blobref, err = schema.WriteFileMap(up.statReceiver(), m, fileContents)
 		if err != nil {
 			return nil, err
 		}
@@ -633,6 +729,7 @@ func (up *Uploader) NewTreeUpload(dir string) *TreeUpload {
 }
 
 func (t *TreeUpload) Start() {
+	progress.startScan()
 	go t.run()
 }
 
@@ -738,7 +835,9 @@ type TreeUpload struct {
 }
 
 // fi is optional (will be statted if nil)
-func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo) (nod *node, err error) {
+// The files under fullPath matching rules, or the ignore files on the
+// way, are left out.
+func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo, rules ignoreRules) (nod *node, err error) {
 	defer func() {
 		if err == nil && nod != nil {
 			t.stattedc <- nod
@@ -760,6 +859,10 @@ func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo) (nod *node, err e
 	if !fi.IsDir() {
 		return n, nil
 	}
+	rules, err = t.withIgnoreFile(rules, fullPath)
+	if err != nil {
+		return nil, err
+	}
 	f, err := t.up.open(fullPath)
 	if err != nil {
 		return nil, err
@@ -771,7 +874,12 @@ func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo) (nod *node, err e
 	}
 	sort.Sort(byFileName(fis))
 	for _, fi := range fis {
-		depn, err := t.statPath(filepath.Join(fullPath, filepath.Base(fi.Name())), fi)
+		childPath := filepath.Join(fullPath, filepath.Base(fi.Name()))
+		if rules.ignored(childPath, fi) {
+			vlog.Printf("Ignoring %s", childPath)
+			continue
+		}
+		depn, err := t.statPath(childPath, fi, rules)
 		if err != nil {
 			return nil, err
 		}
@@ -780,6 +888,8 @@ func (t *TreeUpload) statPath(fullPath string, fi os.FileInfo) (nod *node, err e
 	return n, nil
 }
 
+// uploadWorkers is how many files a tree upload uploads at once by
+// default.
 const uploadWorkers = 5
 
 func (t *TreeUpload) run() {
@@ -790,7 +900,11 @@ func (t *TreeUpload) run() {
 	var root *node // nil until received and set in loop below.
 	rootc := make(chan *node, 1)
 	go func() {
-		n, err := t.statPath(t.base, nil)
+		rules, err := newIgnoreRules(t.base, t.up.exclude)
+		if err != nil {
+			log.Fatalf("Error in exclude patterns: %v", err)
+		}
+		n, err := t.statPath(t.base, nil, rules)
 		if err != nil {
 			log.Fatalf("Error scanning files under %s: %v", t.base, err)
 		}
@@ -830,7 +944,7 @@ func (t *TreeUpload) run() {
 			}
 		})
 	} else {
-		upload = NewNodeWorker(uploadWorkers, func(n *node, ok bool) {
+		upload = NewNodeWorker(t.up.fileOpts.uploadWorkers(), func(n *node, ok bool) {
 			if !ok {
 				log.Printf("done with all uploads.")
 				uploadsdonec <- true
@@ -885,19 +999,23 @@ Loop:
 			root = n
 		case n := <-uploadedc:
 			t.uploaded.incr(n)
+			progress.addDone(n.fi, false)
 			lastUpload = n.fullPath
 		case n := <-skippedc:
 			t.skipped.incr(n)
+			progress.addDone(n.fi, true)
 		case n, ok := <-stattedc:
 			if !ok {
 				log.Printf("done stattting:")
 				dumpStats()
+				progress.endScan()
 				close(checkStatCache)
 				stattedc = nil
 				continue
 			}
 			lastStat = n.fullPath
 			t.total.incr(n)
+			progress.addTotal(n.fi)
 			checkStatCache <- n
 		case <-ticker.C:
 			dumpStats()
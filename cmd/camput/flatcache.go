@@ -79,7 +79,14 @@ func escapeGen(gen string) string {
 }
 
 func NewFlatStatCache(gen string) *FlatStatCache {
-	filename := filepath.Join(osutil.CacheDir(), "camput.statcache." + escapeGen(gen))
+	return newFlatStatCache(filepath.Join(osutil.CacheDir(), "camput.statcache."+escapeGen(gen)))
+}
+
+// staleStatCacheLines is how many superseded lines a stat cache file
+// may have, beyond as many as it has live ones, before it's rewritten.
+const staleStatCacheLines = 100
+
+func newFlatStatCache(filename string) *FlatStatCache {
 	fc := &FlatStatCache{
 		filename: filename,
 		m:        make(map[string]fileInfoPutRes),
@@ -90,10 +97,11 @@ func NewFlatStatCache(gen string) *FlatStatCache {
 		return fc
 	}
 	if err != nil {
-		log.Fatalf("opening camput stat cache: %v", filename, err)
+		log.Fatalf("opening camput stat cache %s: %v", filename, err)
 	}
 	defer f.Close()
 	br := bufio.NewReader(f)
+	lines := 0
 	for {
 		ln, err := br.ReadString('\n')
 		if err == io.EOF {
@@ -103,6 +111,7 @@ func NewFlatStatCache(gen string) *FlatStatCache {
 			log.Printf("Warning: (ignoring) reading stat cache: %v", err)
 			break
 		}
+		lines++
 		ln = strings.TrimSpace(ln)
 		f := strings.Split(ln, "\t")
 		if len(f) < 3 {
@@ -129,9 +138,48 @@ func NewFlatStatCache(gen string) *FlatStatCache {
 		}
 	}
 	vlog.Printf("Flatcache read %d entries from %s", len(fc.m), filename)
+	// Every upload of a changed file appends a line, so the
+	// superseded ones are dropped once they dominate.
+	if stale := lines - len(fc.m); stale > len(fc.m)+staleStatCacheLines {
+		fc.compact()
+	}
 	return fc
 }
 
+// compact rewrites the cache file with only the live entries.
+func (c *FlatStatCache) compact() {
+	tmp := c.filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Warning: (ignoring) compacting stat cache: %v", err)
+		return
+	}
+	bw := bufio.NewWriter(f)
+	for key, val := range c.m {
+		bw.WriteString(statCacheLine(key, val))
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		log.Printf("Warning: (ignoring) compacting stat cache: %v", err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		log.Printf("Warning: (ignoring) compacting stat cache: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, c.filename); err != nil {
+		log.Printf("Warning: (ignoring) compacting stat cache: %v", err)
+		return
+	}
+	vlog.Printf("Flatcache compacted %s to %d entries", c.filename, len(c.m))
+}
+
+func statCacheLine(key string, val fileInfoPutRes) string {
+	return fmt.Sprintf("%s\t%s\t%s/%d\n", key, val.Fingerprint, val.Result.BlobRef.String(), val.Result.Size)
+}
+
 var _ UploadCache = (*FlatStatCache)(nil)
 
 var errCacheMiss = errors.New("not in cache")
@@ -183,7 +231,7 @@ func (c *FlatStatCache) AddCachedPutResult(pwd, filename string, fi os.FileInfo,
 	}
 	// TODO: flocking. see leveldb-go.
 	c.af.Seek(0, os.SEEK_END)
-	c.af.Write([]byte(fmt.Sprintf("%s\t%s\t%s/%d\n", key, val.Fingerprint, val.Result.BlobRef.String(), val.Result.Size)))
+	c.af.Write([]byte(statCacheLine(key, val)))
 }
 
 type FlatHaveCache struct {
@@ -204,7 +252,7 @@ func NewFlatHaveCache(gen string) *FlatHaveCache {
 		return c
 	}
 	if err != nil {
-		log.Fatalf("opening camput have-cache: %v", filename, err)
+		log.Fatalf("opening camput have-cache %s: %v", filename, err)
 	}
 	br := bufio.NewReader(f)
 	for {
@@ -0,0 +1,135 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is the name of the files listing, one per line, the
+// patterns of the files to leave out of uploads of their directory.
+const ignoreFileName = ".camliignore"
+
+// An ignoreRule is a glob pattern of files to leave out of tree
+// uploads. A pattern without a slash matches the names of files at
+// any depth; one with a slash matches the slash-separated paths
+// relative to the directory it's from. A trailing slash matches only
+// directories.
+type ignoreRule struct {
+	dir      string // the directory of the rule
+	pattern  string
+	anchored bool // pattern matches relative paths, not names
+	dirOnly  bool
+}
+
+type ignoreRules []ignoreRule
+
+// parseIgnoreRule returns the rule of dir for pattern, and false if
+// pattern is blank or a comment.
+func parseIgnoreRule(dir, pattern string) (ignoreRule, bool, error) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return ignoreRule{}, false, nil
+	}
+	r := ignoreRule{dir: dir}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		r.anchored = true
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return ignoreRule{}, false, fmt.Errorf("invalid ignore pattern %q", pattern)
+	}
+	r.pattern = pattern
+	return r, true, nil
+}
+
+// newIgnoreRules returns the rules of dir for patterns.
+func newIgnoreRules(dir string, patterns []string) (ignoreRules, error) {
+	var rs ignoreRules
+	for _, p := range patterns {
+		r, ok, err := parseIgnoreRule(dir, p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rs = append(rs, r)
+		}
+	}
+	return rs, nil
+}
+
+// ignored reports whether the file at fullPath, with info fi, is left
+// out by rs.
+func (rs ignoreRules) ignored(fullPath string, fi os.FileInfo) bool {
+	for _, r := range rs {
+		if r.dirOnly && !fi.IsDir() {
+			continue
+		}
+		name := filepath.Base(fullPath)
+		if r.anchored {
+			rel, err := filepath.Rel(r.dir, fullPath)
+			if err != nil {
+				continue
+			}
+			name = filepath.ToSlash(rel)
+		}
+		if ok, _ := path.Match(r.pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withIgnoreFile returns rs plus the rules of dir's ignore file, if
+// it has one.
+func (t *TreeUpload) withIgnoreFile(rs ignoreRules, dir string) (ignoreRules, error) {
+	f, err := t.up.open(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		patterns = append(patterns, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	more, err := newIgnoreRules(dir, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, ignoreFileName), err)
+	}
+	if len(more) == 0 {
+		return rs, nil
+	}
+	// Not appending to rs in place, as its siblings share it.
+	all := make(ignoreRules, 0, len(rs)+len(more))
+	return append(append(all, rs...), more...), nil
+}
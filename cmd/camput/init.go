@@ -35,12 +35,14 @@ import (
 
 type initCmd struct {
 	gpgkey string
+	newKey bool
 }
 
 func init() {
 	RegisterCommand("init", func(flags *flag.FlagSet) CommandRunner {
 		cmd := new(initCmd)
 		flags.StringVar(&cmd.gpgkey, "gpgkey", "", "GPG key to use for signing (overrides $GPGKEY environment)")
+		flags.BoolVar(&cmd.newKey, "newkey", false, "Generate a new key for this device, added to "+osutil.IdentitySecretRing()+", instead of using an existing one.")
 		return cmd
 	})
 }
@@ -57,6 +59,7 @@ func (c *initCmd) Examples() []string {
 	return []string{
 		"",
 		"--gpgkey=XXXXX",
+		"--newkey",
 	}
 }
 
@@ -77,6 +80,22 @@ func (c *initCmd) keyId() (string, error) {
 	return "", errors.New("Initialization requires your public GPG key.  Set --gpgkey=<pubid> or set $GPGKEY in your environment.  Run gpg --list-secret-keys to find their key IDs.")
 }
 
+// generateKey adds a new key to the identity secret ring and returns
+// its key id.
+func (c *initCmd) generateKey() (string, error) {
+	ent, err := jsonsign.NewEntity()
+	if err != nil {
+		return "", fmt.Errorf("generating new key: %v", err)
+	}
+	ring := osutil.IdentitySecretRing()
+	if err := jsonsign.AppendKeyRing(ring, ent); err != nil {
+		return "", fmt.Errorf("adding new key to %s: %v", ring, err)
+	}
+	keyId := ent.PrimaryKey.KeyIdShortString()
+	log.Printf("Generated key %s in %s", keyId, ring)
+	return keyId, nil
+}
+
 func (c *initCmd) getPublicKeyArmoredFromFile(secretRingFileName, keyId string) (b []byte, err error) {
 	entity, err := jsonsign.EntityFromSecring(keyId, secretRingFileName)
 	if err == nil {
@@ -115,7 +134,13 @@ func (c *initCmd) RunCommand(_ *Uploader, args []string) error {
 	os.Mkdir(osutil.CamliConfigDir(), 0700)
 	os.Mkdir(blobDir, 0700)
 
-	keyId, err := c.keyId()
+	var keyId string
+	var err error
+	if c.newKey {
+		keyId, err = c.generateKey()
+	} else {
+		keyId, err = c.keyId()
+	}
 	if err != nil {
 		return err
 	}
@@ -141,6 +166,10 @@ func (c *initCmd) RunCommand(_ *Uploader, args []string) error {
 	}
 
 	log.Printf("Your Camlistore identity (your GPG public key's blobref) is: %s", bref.String())
+	if c.newKey {
+		log.Printf("For this device's claims to count as your main identity's, upload its public key with "+
+			"\"camput blob %s\", then run \"camtool delegate %s\" where your main key is configured.", keyBlobPath, bref)
+	}
 
 	_, err = os.Stat(client.ConfigFilePath())
 	if err == nil {
@@ -23,6 +23,7 @@ import (
 	"strings"
 	"time"
 
+	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/client"
 	"camlistore.org/pkg/schema"
 )
@@ -30,6 +31,8 @@ import (
 type permanodeCmd struct {
 	name    string
 	tag     string
+	attrs   attrFlags
+	content string
 	key     string // else random
 	sigTime string
 }
@@ -39,12 +42,34 @@ func init() {
 		cmd := new(permanodeCmd)
 		flags.StringVar(&cmd.name, "name", "", "Optional name attribute to set on new permanode")
 		flags.StringVar(&cmd.tag, "tag", "", "Optional tag(s) to set on new permanode; comma separated.")
+		flags.Var(&cmd.attrs, "attr", "Optional attribute to set on new permanode, as name=value. May be repeated; repeating a name adds values.")
+		flags.StringVar(&cmd.content, "content", "", "Optional blobref, such as of a file, to set as the new permanode's camliContent.")
 		flags.StringVar(&cmd.key, "key", "", "Optional key to create deterministic ('planned') permanodes. Must also use --sigtime.")
 		flags.StringVar(&cmd.sigTime, "sigtime", "", "Optional time to put in the OpenPGP signature packet instead of the current time. Required when producing a deterministic permanode (with --key). In format YYYY-MM-DD HH:MM:SS")
 		return cmd
 	})
 }
 
+// attrFlags are the name=value attributes of repeated -attr flags.
+type attrFlags [][2]string
+
+func (a *attrFlags) String() string {
+	var s []string
+	for _, nv := range *a {
+		s = append(s, nv[0]+"="+nv[1])
+	}
+	return strings.Join(s, ",")
+}
+
+func (a *attrFlags) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return fmt.Errorf("attribute %q not of form name=value", s)
+	}
+	*a = append(*a, [2]string{s[:i], s[i+1:]})
+	return nil
+}
+
 func (c *permanodeCmd) Usage() {
 	errf("Usage: camput [globalopts] permanode [permanodeopts]\n")
 }
@@ -53,48 +78,115 @@ func (c *permanodeCmd) Examples() []string {
 	return []string{
 		"                               (create a new permanode)",
 		`-name="Some Name" -tag=foo,bar (with attributes added)`,
+		`-attr=author=Brad -attr=author=Mathieu -content=sha1-xxx (with any attributes, and content)`,
 	}
 }
 
+// A permanodeClaim is a claim on the new permanode, and what it is
+// reported as.
+type permanodeClaim struct {
+	what string
+	m    schema.Map
+}
+
+// claims returns the claims setting the attributes of the flags on
+// the permanode pn.
+func (c *permanodeCmd) claims(pn *blobref.BlobRef) ([]permanodeClaim, error) {
+	var claims []permanodeClaim
+	if c.name != "" {
+		claims = append(claims, permanodeClaim{"claim-permanode-title", schema.NewSetAttributeClaim(pn, "title", c.name)})
+	}
+	if c.tag != "" {
+		for _, tag := range strings.Split(c.tag, ",") {
+			claims = append(claims, permanodeClaim{"claim-permanode-tag", schema.NewAddAttributeClaim(pn, "tag", tag)})
+		}
+	}
+	claims = append(claims, attrClaims(pn, c.attrs)...)
+	if c.content != "" {
+		content := blobref.Parse(c.content)
+		if content == nil {
+			return nil, fmt.Errorf("Error parsing content blobref %q", c.content)
+		}
+		claims = append(claims, permanodeClaim{"claim-permanode-content", schema.NewSetAttributeClaim(pn, "camliContent", content.String())})
+	}
+	return claims, nil
+}
+
+// attrClaims returns the claims setting the attributes on the
+// permanode pn: the first value of a name is set, and the next ones
+// added.
+func attrClaims(pn *blobref.BlobRef, attrs attrFlags) []permanodeClaim {
+	var claims []permanodeClaim
+	set := make(map[string]bool)
+	for _, nv := range attrs {
+		name, value := nv[0], nv[1]
+		m := schema.NewSetAttributeClaim(pn, name, value)
+		if set[name] {
+			m = schema.NewAddAttributeClaim(pn, name, value)
+		}
+		set[name] = true
+		claims = append(claims, permanodeClaim{"claim-permanode-attr", m})
+	}
+	return claims
+}
+
 func (c *permanodeCmd) RunCommand(up *Uploader, args []string) error {
 	if len(args) > 0 {
 		return errors.New("Permanode command doesn't take any additional arguments")
 	}
 
-	var (
-		permaNode *client.PutResult
-		err       error
-	)
 	if (c.key != "") != (c.sigTime != "") {
 		return errors.New("Both --key and --sigtime must be used to produce deterministic permanodes.")
 	}
-	if c.key == "" {
-		// Normal case, with a random permanode.
-		permaNode, err = up.UploadNewPermanode()
-	} else {
+	unsigned := schema.NewUnsignedPermanode() // normal case, with a random permanode
+	var sigTime time.Time
+	if c.key != "" {
 		const format = "2006-01-02 15:04:05"
-		sigTime, err := time.Parse(format, c.sigTime)
+		var err error
+		sigTime, err = time.Parse(format, c.sigTime)
 		if err != nil {
 			return fmt.Errorf("Error parsing time %q; expecting time of form %q", c.sigTime, format)
 		}
-		permaNode, err = up.UploadPlannedPermanode(c.key, sigTime)
+		unsigned = schema.NewPlannedPermanode(c.key)
 	}
-	if handleResult("permanode", permaNode, err) != nil {
+
+	// The permanode and its claims are all signed before any is
+	// uploaded, and then the claims are uploaded at once.
+	signedPermanode, err := up.SignMap(unsigned, sigTime)
+	if err != nil {
+		return fmt.Errorf("Error signing permanode: %v", err)
+	}
+	pn := blobref.SHA1FromString(signedPermanode)
+	claims, err := c.claims(pn)
+	if err != nil {
 		return err
 	}
+	signed := make([]string, len(claims))
+	for i, cl := range claims {
+		if signed[i], err = up.SignMap(cl.m, time.Time{}); err != nil {
+			return fmt.Errorf("Error signing %s: %v", cl.what, err)
+		}
+	}
 
-	if c.name != "" {
-		put, err := up.UploadAndSignMap(schema.NewSetAttributeClaim(permaNode.BlobRef, "title", c.name))
-		handleResult("claim-permanode-title", put, err)
+	permaNode, err := up.uploadString(signedPermanode)
+	if handleResult("permanode", permaNode, err) != nil {
+		return err
 	}
-	if c.tag != "" {
-		tags := strings.Split(c.tag, ",")
-		m := schema.NewSetAttributeClaim(permaNode.BlobRef, "tag", tags[0])
-		for _, tag := range tags {
-			m = schema.NewAddAttributeClaim(permaNode.BlobRef, "tag", tag)
-			put, err := up.UploadAndSignMap(m)
-			handleResult("claim-permanode-tag", put, err)
-		}
+	type result struct {
+		pr  *client.PutResult
+		err error
+	}
+	results := make([]chan result, len(signed))
+	for i, s := range signed {
+		results[i] = make(chan result, 1)
+		go func(s string, ch chan<- result) {
+			pr, err := up.uploadString(s)
+			ch <- result{pr, err}
+		}(s, results[i])
+	}
+	for i, ch := range results {
+		r := <-ch
+		handleResult(claims[i].what, r.pr, r.err)
 	}
 	return nil
 }
@@ -0,0 +1,189 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/client"
+)
+
+// progressInterval is how often --json-progress reports progress.
+const progressInterval = time.Second
+
+// progress is the --json-progress reporter, or nil if progress isn't
+// reported. Its methods may be called on nil.
+var progress *jsonProgress
+
+// A progressEvent is a line of --json-progress output about the
+// progress so far, or the last one, with Event "done".
+type progressEvent struct {
+	Event    string  `json:"event"` // "progress" or "done"
+	Elapsed  float64 `json:"elapsedSeconds"`
+	Scanning bool    `json:"scanning"` // whether more files may be found
+
+	TotalFiles   int64 `json:"totalFiles"` // found so far
+	TotalBytes   int64 `json:"totalBytes"`
+	DoneFiles    int64 `json:"doneFiles"` // uploaded or skipped
+	DoneBytes    int64 `json:"doneBytes"`
+	SkippedFiles int64 `json:"skippedFiles"` // known uploaded by the stat cache
+
+	UploadedBlobs int   `json:"uploadedBlobs"` // sent to the server
+	UploadedBytes int64 `json:"uploadedBytes"`
+	DedupBlobs    int   `json:"dedupBlobs"` // not sent, as the server had them
+	DedupBytes    int64 `json:"dedupBytes"`
+
+	// ETA is the estimated number of seconds left, once the files
+	// are all found and some are done.
+	ETA float64 `json:"etaSeconds,omitempty"`
+}
+
+// A resultEvent is a line of --json-progress output for each result,
+// instead of the plain blobref.
+type resultEvent struct {
+	Event   string `json:"event"` // "result"
+	What    string `json:"what"`
+	BlobRef string `json:"blobRef,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type jsonProgress struct {
+	began time.Time
+	stats func() client.Stats
+
+	mu       sync.Mutex
+	scans    int // tree uploads still statting files
+	total    stats
+	done     stats
+	skipped  stats
+	stopc    chan bool // closed to stop reporting
+	stoppedc chan bool // closed when reporting stops
+}
+
+func newJSONProgress(up *Uploader) *jsonProgress {
+	return &jsonProgress{
+		began: time.Now(),
+		stats: up.Stats,
+	}
+}
+
+// addTotal notes the file or directory fi, to be uploaded.
+func (p *jsonProgress) addTotal(fi os.FileInfo) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total.add(fi)
+}
+
+// addDone notes that fi was uploaded, or skipped thanks to the stat
+// cache.
+func (p *jsonProgress) addDone(fi os.FileInfo, skipped bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done.add(fi)
+	if skipped {
+		p.skipped.add(fi)
+	}
+}
+
+// startScan notes that a tree upload started statting files, and
+// endScan that it's done.
+func (p *jsonProgress) startScan() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scans++
+}
+
+func (p *jsonProgress) endScan() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scans--
+}
+
+func (p *jsonProgress) event(name string, now time.Time) *progressEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.stats()
+	dedup := st.Dedup()
+	ev := &progressEvent{
+		Event:         name,
+		Elapsed:       now.Sub(p.began).Seconds(),
+		Scanning:      p.scans > 0,
+		TotalFiles:    p.total.files,
+		TotalBytes:    p.total.bytes,
+		DoneFiles:     p.done.files,
+		DoneBytes:     p.done.bytes,
+		SkippedFiles:  p.skipped.files,
+		UploadedBlobs: st.Uploads.Blobs,
+		UploadedBytes: st.Uploads.Bytes,
+		DedupBlobs:    dedup.Blobs,
+		DedupBytes:    dedup.Bytes,
+	}
+	if !ev.Scanning && ev.DoneBytes > 0 && ev.Elapsed > 0 {
+		rate := float64(ev.DoneBytes) / ev.Elapsed
+		ev.ETA = float64(ev.TotalBytes-ev.DoneBytes) / rate
+	}
+	return ev
+}
+
+// start reports progress every progressInterval until stop.
+func (p *jsonProgress) start() {
+	p.stopc = make(chan bool)
+	p.stoppedc = make(chan bool)
+	go func() {
+		defer close(p.stoppedc)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				writeEvent(p.event("progress", now))
+			case <-p.stopc:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops reporting progress, and reports the "done" event.
+func (p *jsonProgress) stop() {
+	close(p.stopc)
+	<-p.stoppedc
+	writeEvent(p.event("done", time.Now()))
+}
+
+var writeMu sync.Mutex // serializes the lines of writeEvent
+
+func writeEvent(ev interface{}) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	json.NewEncoder(stdout).Encode(ev)
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/osutil"
+	"camlistore.org/pkg/schema"
+)
+
+const (
+	// resumeMinSize is the size from which files are uploaded
+	// resumably.
+	resumeMinSize = 32 << 20
+
+	// resumeInterval is how many bytes of a file are uploaded
+	// between two checkpoints.
+	resumeInterval = 16 << 20
+)
+
+// ResumeCache records how far along the uploads of large files are,
+// so an interrupted camput can pick them up where it stopped instead
+// of starting over. Like the stat cache, it is per server storage
+// generation, and assumes the blobs uploaded before are still there.
+type ResumeCache struct {
+	dir string
+}
+
+// resumeState is the content of the file of one upload in progress.
+type resumeState struct {
+	Path        string             `json:"path"`
+	Fingerprint statFingerprint    `json:"fingerprint"`
+	Checkpoint  *schema.Checkpoint `json:"checkpoint"`
+}
+
+func NewResumeCache(gen string) *ResumeCache {
+	return &ResumeCache{
+		dir: filepath.Join(osutil.CacheDir(), "camput.resume."+escapeGen(gen)),
+	}
+}
+
+func (c *ResumeCache) filename(fullPath string) string {
+	h := sha1.New()
+	io.WriteString(h, fullPath)
+	return filepath.Join(c.dir, fmt.Sprintf("%x.json", h.Sum(nil)))
+}
+
+// Checkpoint returns the last checkpoint of the upload of fullPath,
+// or nil if there's none or the file changed since.
+func (c *ResumeCache) Checkpoint(fullPath string, fi os.FileInfo) *schema.Checkpoint {
+	b, err := ioutil.ReadFile(c.filename(fullPath))
+	if err != nil {
+		return nil
+	}
+	var st resumeState
+	if err := json.Unmarshal(b, &st); err != nil {
+		log.Printf("Ignoring corrupt resume state of %s: %v", fullPath, err)
+		return nil
+	}
+	if st.Path != fullPath || st.Fingerprint != fileInfoToFingerprint(fi) || st.Checkpoint == nil {
+		return nil
+	}
+	return st.Checkpoint
+}
+
+// Save records cp as the last checkpoint of the upload of fullPath.
+func (c *ResumeCache) Save(fullPath string, fi os.FileInfo, cp *schema.Checkpoint) {
+	b, err := json.Marshal(&resumeState{
+		Path:        fullPath,
+		Fingerprint: fileInfoToFingerprint(fi),
+		Checkpoint:  cp,
+	})
+	if err != nil {
+		log.Printf("Error encoding resume state of %s: %v", fullPath, err)
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		log.Printf("Error creating resume state directory: %v", err)
+		return
+	}
+	// Written to a temp file then renamed, so a crash mid-write
+	// leaves the previous checkpoint.
+	filename := c.filename(fullPath)
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		log.Printf("Error saving resume state of %s: %v", fullPath, err)
+		return
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		log.Printf("Error saving resume state of %s: %v", fullPath, err)
+	}
+}
+
+// Done forgets the upload of fullPath, once it's complete.
+func (c *ResumeCache) Done(fullPath string) {
+	if err := os.Remove(c.filename(fullPath)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing resume state of %s: %v", fullPath, err)
+	}
+}
+
+// writeFileMapResumable is like schema.WriteFileMap on the contents r
+// of n's file, but checkpoints as it goes, and resumes from the
+// checkpoint from, if not nil, seeking file past what was uploaded.
+func (up *Uploader) writeFileMapResumable(m schema.Map, n *node, file io.ReadSeeker, r io.Reader, from *schema.Checkpoint) (*blobref.BlobRef, error) {
+	if from != nil {
+		if _, err := file.Seek(from.Offset, os.SEEK_SET); err != nil {
+			return nil, err
+		}
+		r = io.LimitReader(file, n.fi.Size()-from.Offset)
+		vlog.Printf("Resuming upload of %s at byte %d", n.fullPath, from.Offset)
+	}
+	br, err := schema.WriteFileMapCheckpointed(up.statReceiver(), m, r, from, resumeInterval, func(cp *schema.Checkpoint) {
+		up.resumeCache.Save(n.fullPath, n.fi, cp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	up.resumeCache.Done(n.fullPath)
+	return br, nil
+}
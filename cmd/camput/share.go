@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"time"
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/client"
@@ -27,12 +28,14 @@ import (
 
 type shareCmd struct {
 	transitive bool
+	expires    time.Duration
 }
 
 func init() {
 	RegisterCommand("share", func(flags *flag.FlagSet) CommandRunner {
 		cmd := new(shareCmd)
 		flags.BoolVar(&cmd.transitive, "transitive", false, "share everything reachable from the given blobref")
+		flags.DurationVar(&cmd.expires, "expires", 0, "If non-zero, how long from now the share remains valid, e.g. 72h")
 		return cmd
 	})
 }
@@ -56,12 +59,20 @@ func (c *shareCmd) RunCommand(up *Uploader, args []string) error {
 	if br == nil {
 		return UsageError("invalid blobref")
 	}
-	pr, err := up.UploadShare(br, c.transitive)
+	if c.expires < 0 {
+		return UsageError("negative -expires")
+	}
+	pr, err := up.UploadShare(br, c.transitive, c.expires)
 	handleResult("share", pr, err)
 	return nil
 }
 
-func (up *Uploader) UploadShare(target *blobref.BlobRef, transitive bool) (*client.PutResult, error) {
+// UploadShare signs and uploads a share of target. If expires is
+// non-zero, the share is only valid for that long from now.
+func (up *Uploader) UploadShare(target *blobref.BlobRef, transitive bool, expires time.Duration) (*client.PutResult, error) {
 	unsigned := schema.NewShareRef(schema.ShareHaveRef, target, transitive)
+	if expires > 0 {
+		unsigned.SetShareExpiration(time.Now().Add(expires))
+	}
 	return up.UploadAndSignMap(unsigned)
 }
@@ -46,6 +46,14 @@ type Uploader struct {
 	statCache UploadCache
 	haveCache HaveCache
 
+	// resumeCache, if not nil, records the progress of large
+	// file uploads, to resume them if interrupted.
+	resumeCache *ResumeCache
+
+	// exclude are the patterns of files left out of tree uploads,
+	// as in an ignore file of their root.
+	exclude []string
+
 	fs http.FileSystem // virtual filesystem to read from; nil means OS filesystem.
 }
 
@@ -56,6 +64,9 @@ type fileOptions struct {
 	// the above permanode.
 	tag    string
 	vivify bool
+	// uploads is how many files are uploaded at once, or zero
+	// for uploadWorkers.
+	uploads int
 }
 
 func (o *fileOptions) tags() []string {
@@ -73,6 +84,13 @@ func (o *fileOptions) wantVivify() bool {
 	return o != nil && o.vivify
 }
 
+func (o *fileOptions) uploadWorkers() int {
+	if o == nil || o.uploads < 1 {
+		return uploadWorkers
+	}
+	return o.uploads
+}
+
 // sigTime optionally specifies the signature time.
 // If zero, the current time is used.
 func (up *Uploader) SignMap(m schema.Map, sigTime time.Time) (string, error) {
@@ -0,0 +1,155 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/osutil"
+	"camlistore.org/pkg/schema"
+)
+
+const (
+	// watchSettle is how long a watched tree must be left alone
+	// after a change before it's uploaded again, so a burst of
+	// changes makes one upload.
+	watchSettle = 5 * time.Second
+
+	// watchPoll is how often the trees are uploaded again where
+	// changes can't be watched.
+	watchPoll = time.Minute
+)
+
+// watchTree uploads dir, then uploads it again every time it changes,
+// forever, setting the camliContent of its permanode to every new
+// version.
+func (c *fileCmd) watchTree(up *Uploader, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	permaNode, err := c.watchPermanode(up, dir)
+	if err != nil {
+		return err
+	}
+	changes, err := watchChanges(dir)
+	if err != nil {
+		return err
+	}
+	log.Printf("Watching %s with permanode %s", dir, permaNode)
+	var last string
+	for {
+		t := up.NewTreeUpload(dir)
+		t.Start()
+		pr, err := t.Wait()
+		switch {
+		case err != nil:
+			log.Printf("Error uploading %s: %v", dir, err)
+		case pr.BlobRef.String() != last:
+			put, err := up.UploadAndSignMap(schema.NewSetAttributeClaim(permaNode, "camliContent", pr.BlobRef.String()))
+			if handleResult("claim-permanode-content", put, err) == nil {
+				last = pr.BlobRef.String()
+			}
+		}
+		<-changes
+		for {
+			select {
+			case <-changes:
+				continue
+			case <-time.After(watchSettle):
+			}
+			break
+		}
+	}
+}
+
+// watchPermanode returns the permanode of the watched directory dir,
+// creating it the first time. The permanodes of the watched
+// directories are remembered per server storage generation, so they
+// persist across runs.
+func (c *fileCmd) watchPermanode(up *Uploader, dir string) (*blobref.BlobRef, error) {
+	var filename string
+	if gen, err := up.StorageGeneration(); err != nil {
+		log.Printf("WARNING: not remembering the permanode of %s; failed to retrieve server's storage generation: %v", dir, err)
+	} else {
+		filename = filepath.Join(osutil.CacheDir(), "camput.watch."+escapeGen(gen))
+		if br := watchedPermanode(filename, dir); br != nil {
+			return br, nil
+		}
+	}
+
+	pr, err := up.UploadNewPermanode()
+	if err != nil {
+		return nil, fmt.Errorf("Uploading permanode: %v", err)
+	}
+	name := c.name
+	if name == "" {
+		name = filepath.Base(dir)
+	}
+	put, err := up.UploadAndSignMap(schema.NewSetAttributeClaim(pr.BlobRef, "name", name))
+	if handleResult("claim-permanode-name", put, err) != nil {
+		return nil, err
+	}
+	for _, tag := range up.fileOpts.tags() {
+		m := schema.NewAddAttributeClaim(pr.BlobRef, "tag", tag)
+		put, err := up.UploadAndSignMap(m)
+		if handleResult("claim-permanode-tag", put, err) != nil {
+			return nil, err
+		}
+	}
+	if filename != "" {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%s\t%s\n", dir, pr.BlobRef)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			log.Printf("WARNING: not remembering the permanode of %s: %v", dir, err)
+		}
+	}
+	return pr.BlobRef, nil
+}
+
+// watchedPermanode returns the permanode of dir in the file of the
+// watched directories, or nil if dir isn't there.
+func watchedPermanode(filename, dir string) *blobref.BlobRef {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var br *blobref.BlobRef
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) == 2 && fields[0] == dir {
+			if pn := blobref.Parse(fields[1]); pn != nil {
+				br = pn
+			}
+		}
+	}
+	return br
+}
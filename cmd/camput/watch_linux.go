@@ -0,0 +1,85 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"camlistore.org/pkg/osutil"
+)
+
+const inotifyMask = syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MODIFY |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// watchChanges returns a channel receiving a value, whenever there's
+// none pending already, when the tree at dir changes.
+func watchChanges(dir string) (<-chan bool, error) {
+	fd, err := syscall.InotifyInit()
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	addInotifyWatches(fd, dir)
+	changes := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				log.Fatalf("Error watching %s: %v", dir, err)
+			}
+			// Whatever changed, the new directories need
+			// watching too. Adding the watch of an already
+			// watched directory is a no-op.
+			addInotifyWatches(fd, dir)
+			select {
+			case changes <- true:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// addInotifyWatches watches all the directories of the tree at dir,
+// but camput's cache directory, where each upload writes.
+func addInotifyWatches(fd int, dir string) {
+	cacheDir := osutil.CacheDir()
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		if path == cacheDir {
+			return filepath.SkipDir
+		}
+		if _, err := syscall.InotifyAddWatch(fd, path, inotifyMask); err != nil {
+			if err == syscall.ENOSPC {
+				log.Printf("Can't watch %s: too many watches; see /proc/sys/fs/inotify/max_user_watches", path)
+				return filepath.SkipDir
+			}
+			log.Printf("Can't watch %s: %v", path, err)
+		}
+		return nil
+	})
+}
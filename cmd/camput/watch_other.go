@@ -0,0 +1,37 @@
+// +build !linux
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "time"
+
+// watchChanges returns a channel receiving a value whenever the tree
+// at dir may have changed. Without a way to watch the file system
+// here yet, that's every watchPoll.
+func watchChanges(dir string) (<-chan bool, error) {
+	changes := make(chan bool, 1)
+	go func() {
+		for _ = range time.Tick(watchPoll) {
+			select {
+			case changes <- true:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
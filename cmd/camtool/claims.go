@@ -0,0 +1,131 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+)
+
+type claimsCmd struct {
+	attr string
+	at   string
+	json bool
+}
+
+func init() {
+	RegisterCommand("claims", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(claimsCmd)
+		flags.StringVar(&cmd.attr, "attr", "", "Only list the claims on this attribute.")
+		flags.StringVar(&cmd.at, "at", "", "Optional RFC 3339 time, such as 2013-01-02T15:04:05Z, after which claims are ignored.")
+		flags.BoolVar(&cmd.json, "json", false, "Print the server's history response as JSON.")
+		return cmd
+	})
+}
+
+func (c *claimsCmd) Usage() {
+	errf(`Usage: camtool [globalopts] claims [claimsopts] <permanode>
+
+Lists the claims on the permanode, oldest first, with their signer and
+the values of their attribute once each was applied, as found by the
+server's index.
+`)
+}
+
+func (c *claimsCmd) Examples() []string {
+	return []string{
+		"<permanode>",
+		"-attr=title -at=2013-01-01T00:00:00Z <permanode>",
+	}
+}
+
+// A historyClaim is a claim of the search handler's history response.
+type historyClaim struct {
+	BlobRef string   `json:"blobref"`
+	Signer  string   `json:"signer"`
+	Date    string   `json:"date"`
+	Type    string   `json:"type"`
+	Attr    string   `json:"attr"`
+	Value   string   `json:"value"`
+	Values  []string `json:"values"`
+}
+
+func (c *claimsCmd) RunCommand(args []string) error {
+	if len(args) != 1 {
+		return UsageError("claims takes exactly one permanode")
+	}
+	pn := blobref.Parse(args[0])
+	if pn == nil {
+		return UsageError(fmt.Sprintf("invalid blobref %q", args[0]))
+	}
+	q := url.Values{"permanode": {pn.String()}}
+	if c.attr != "" {
+		q.Set("attr", c.attr)
+	}
+	if c.at != "" {
+		if _, err := time.Parse(time.RFC3339, c.at); err != nil {
+			return UsageError(fmt.Sprintf("invalid -at time: %v", err))
+		}
+		q.Set("at", c.at)
+	}
+	res, err := newClient().QuerySearch("history", q)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		out, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s\n", out)
+		return nil
+	}
+	// Round-tripping through JSON to get the claims typed.
+	b, err := json.Marshal(res["history"])
+	if err != nil {
+		return err
+	}
+	var claims []historyClaim
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return fmt.Errorf("invalid history response: %v", err)
+	}
+	for _, cl := range claims {
+		fmt.Fprintln(stdout, formatClaim(cl))
+	}
+	return nil
+}
+
+// formatClaim returns the line listing cl.
+func formatClaim(cl historyClaim) string {
+	values := make([]string, len(cl.Values))
+	for i, v := range cl.Values {
+		values[i] = strconv.Quote(v)
+	}
+	change := cl.Attr
+	if cl.Value != "" {
+		change += " " + strconv.Quote(cl.Value)
+	}
+	return fmt.Sprintf("%s %s %-13s %s => [%s] (by %s)",
+		cl.Date, cl.BlobRef, cl.Type, change, strings.Join(values, ", "), cl.Signer)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"camlistore.org/pkg/client"
+)
+
+type configCmd struct{}
+
+func init() {
+	RegisterCommand("config", func(flags *flag.FlagSet) CommandRunner {
+		return new(configCmd)
+	})
+}
+
+func (c *configCmd) Usage() {
+	errf(`Usage: camtool [globalopts] config
+
+Prints the client configuration in effect, after the global options,
+and what discovery finds out about the server.
+`)
+}
+
+func (c *configCmd) RunCommand(args []string) error {
+	if len(args) != 0 {
+		return UsageError("config takes no arguments")
+	}
+	cl := newClient()
+	show := func(name string, value interface{}) {
+		fmt.Fprintf(stdout, "%-20s %v\n", name+":", value)
+	}
+	orErr := func(v string, err error) string {
+		if err != nil {
+			return fmt.Sprintf("(%v)", err)
+		}
+		return v
+	}
+	show("Config file", client.ConfigFilePath())
+	show("Server", cl.Server())
+	show("Blob root", orErr(cl.BlobRoot()))
+	show("Search root", orErr(cl.SearchRoot()))
+	show("Storage generation", orErr(cl.StorageGeneration()))
+	if signer := cl.SignerPublicKeyBlobref(); signer != nil {
+		show("Signer", signer)
+	} else {
+		show("Signer", "(none)")
+	}
+	show("Secret ring", cl.SecretRingFile())
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/schema"
+)
+
+type delegateCmd struct {
+	revoke bool
+}
+
+func init() {
+	RegisterCommand("delegate", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(delegateCmd)
+		flags.BoolVar(&cmd.revoke, "revoke", false, "Revoke the given delegation blob instead, such as for a lost device.")
+		return cmd
+	})
+}
+
+func (c *delegateCmd) Usage() {
+	errf(`Usage: camtool [globalopts] delegate [delegateopts] <pubkey-blobref>
+       camtool [globalopts] delegate -revoke <delegation-blobref>
+
+Signs with the configured key, and uploads, a "delegation" to the public
+key blob of another key, such as that of a device made with
+"camput init -newkey", so the claims it signs count as yours. The
+public key blob must already be on the server. A revoked delegation's
+key claims nothing for you anymore, not even its earlier claims.
+`)
+}
+
+func (c *delegateCmd) Examples() []string {
+	return []string{
+		"sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007",
+		"-revoke sha1-f1d2d2f924e986ac86fdf7b36c94bcdf32beec15",
+	}
+}
+
+func (c *delegateCmd) RunCommand(args []string) error {
+	if len(args) != 1 {
+		return UsageError("delegate takes exactly one blobref")
+	}
+	br := blobref.Parse(args[0])
+	if br == nil {
+		return fmt.Errorf("invalid blobref %q", args[0])
+	}
+	cc := newClient()
+	var m schema.Map
+	if c.revoke {
+		m = schema.NewRevocation(br)
+	} else {
+		keyId, err := jsonsign.PublicKeyId(cc, br)
+		if err != nil {
+			return fmt.Errorf("fetching public key %s: %v", br, err)
+		}
+		errf("Delegating to key %s\n", keyId)
+		m = schema.NewDelegation(br)
+	}
+	pr, err := signAndUpload(cc, m)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, pr.BlobRef)
+	return nil
+}
+
+// signAndUpload signs m with the client's configured key and uploads it.
+func signAndUpload(cc *client.Client, m schema.Map) (*client.PutResult, error) {
+	pr, err := cc.UploadAndSignMap(m)
+	if err == client.ErrNoSigner {
+		return nil, errors.New("no signing key configured; run \"camput init\" first")
+	}
+	return pr, err
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+)
+
+type deleteCmd struct {
+	gc     bool
+	dryRun bool
+}
+
+func init() {
+	RegisterCommand("delete", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(deleteCmd)
+		flags.BoolVar(&cmd.gc, "gc", false, "Run the server's garbage collector afterwards, removing the deleted blobs.")
+		flags.BoolVar(&cmd.dryRun, "dryrun", false, "With -gc, only list what the garbage collector would remove.")
+		return cmd
+	})
+}
+
+func (c *deleteCmd) Usage() {
+	errf(`Usage: camtool [globalopts] delete [deleteopts] <blobref>...
+       camtool [globalopts] delete -gc [-dryrun]
+
+Signs with the configured key, and uploads, a "delete" claim for each
+permanode or claim given. A deleted permanode's claims are deleted with
+it; deleting a delete claim undoes it. Nothing is removed from the
+server until its garbage collector runs, which -gc does.
+`)
+}
+
+func (c *deleteCmd) Examples() []string {
+	return []string{
+		"sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007",
+		"-gc -dryrun",
+		"-gc sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007",
+	}
+}
+
+func (c *deleteCmd) RunCommand(args []string) error {
+	if len(args) == 0 && !c.gc {
+		return UsageError("delete takes at least one blobref, or -gc")
+	}
+	if c.dryRun && !c.gc {
+		return UsageError("-dryrun requires -gc")
+	}
+	var targets []*blobref.BlobRef
+	for _, arg := range args {
+		br := blobref.Parse(arg)
+		if br == nil {
+			return UsageError(fmt.Sprintf("invalid blobref %q", arg))
+		}
+		targets = append(targets, br)
+	}
+	cc := newClient()
+	for _, br := range targets {
+		pr, err := signAndUpload(cc, schema.NewDeleteClaim(br))
+		if err != nil {
+			return fmt.Errorf("deleting %s: %v", br, err)
+		}
+		fmt.Fprintln(stdout, pr.BlobRef)
+	}
+	if !c.gc {
+		return nil
+	}
+	report, err := cc.GC(c.dryRun)
+	if err != nil {
+		return err
+	}
+	for _, g := range report.Garbage {
+		fmt.Fprintf(stdout, "%s %d\n", g.BlobRef, g.Size)
+	}
+	verb := "Removed"
+	if !report.Removed {
+		verb = "Would remove"
+	}
+	errf("%s %d of %d blobs, %d bytes\n", verb, len(report.Garbage), report.Blobs, report.GarbageSize)
+	return nil
+}
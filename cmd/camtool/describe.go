@@ -0,0 +1,74 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+
+	"camlistore.org/pkg/blobref"
+)
+
+type describeCmd struct{}
+
+func init() {
+	RegisterCommand("describe", func(flags *flag.FlagSet) CommandRunner {
+		return new(describeCmd)
+	})
+}
+
+func (c *describeCmd) Usage() {
+	errf(`Usage: camtool [globalopts] describe <blobref> [<blobref>...]
+
+Prints, as JSON, the server's search handler description of the blobs
+and of those they reference.
+`)
+}
+
+func (c *describeCmd) RunCommand(args []string) error {
+	if len(args) == 0 {
+		return UsageError("describe takes at least one blobref")
+	}
+	var brs []*blobref.BlobRef
+	for _, arg := range args {
+		br := blobref.Parse(arg)
+		if br == nil {
+			return UsageError(fmt.Sprintf("invalid blobref %q", arg))
+		}
+		brs = append(brs, br)
+	}
+	cl := newClient()
+	meta := make(map[string]interface{})
+	for _, br := range brs {
+		res, err := cl.QuerySearch("describe", url.Values{"blobref": {br.String()}})
+		if err != nil {
+			return err
+		}
+		m, _ := res["meta"].(map[string]interface{})
+		for k, v := range m {
+			meta[k] = v
+		}
+	}
+	out, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s\n", out)
+	return nil
+}
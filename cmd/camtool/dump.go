@@ -0,0 +1,165 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+)
+
+type dumpCmd struct {
+	depth int
+}
+
+func init() {
+	RegisterCommand("dump", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(dumpCmd)
+		flags.IntVar(&cmd.depth, "depth", 0, "How many levels of references of the schema blobs to follow, such as a file's parts, and their parts.")
+		return cmd
+	})
+}
+
+func (c *dumpCmd) Usage() {
+	errf(`Usage: camtool [globalopts] dump [dumpopts] <blobref> [<blobref>...]
+
+Fetches the blobs and pretty-prints those that are schema blobs, and
+the size of the others, following the blobs referenced by the schema
+blobs, other than their signers, to -depth levels.
+`)
+}
+
+func (c *dumpCmd) Examples() []string {
+	return []string{
+		"<blobref>",
+		"-depth=2 <file-blobref>   (the file, its parts and theirs)",
+	}
+}
+
+// A dumper prints blobs, each once.
+type dumper struct {
+	fetch func(*blobref.BlobRef) ([]byte, error)
+	seen  map[string]bool
+}
+
+func (c *dumpCmd) RunCommand(args []string) error {
+	if len(args) == 0 {
+		return UsageError("dump takes at least one blobref")
+	}
+	var brs []*blobref.BlobRef
+	for _, arg := range args {
+		br := blobref.Parse(arg)
+		if br == nil {
+			return UsageError(fmt.Sprintf("invalid blobref %q", arg))
+		}
+		brs = append(brs, br)
+	}
+	cl := newClient()
+	d := &dumper{
+		fetch: func(br *blobref.BlobRef) ([]byte, error) {
+			rc, _, err := cl.FetchStreaming(br)
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		},
+		seen: make(map[string]bool),
+	}
+	for _, br := range brs {
+		if err := d.dump(br, 0, c.depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dump prints br, at depth, then the blobs it references up to
+// maxDepth.
+func (d *dumper) dump(br *blobref.BlobRef, depth, maxDepth int) error {
+	if d.seen[br.String()] {
+		return nil
+	}
+	d.seen[br.String()] = true
+	b, err := d.fetch(br)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %v", br, err)
+	}
+	indent := strings.Repeat("  ", depth)
+	if !schema.LikelySchemaBlob(b) {
+		fmt.Fprintf(stdout, "%s%s: %d bytes, not a schema blob\n", indent, br, len(b))
+		return nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		fmt.Fprintf(stdout, "%s%s: %d bytes, invalid schema blob: %v\n", indent, br, len(b), err)
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, indent, "  "); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s%s: %d bytes, %q schema blob\n%s%s\n", indent, br, len(b), m["camliType"], indent, buf.Bytes())
+	if depth >= maxDepth {
+		return nil
+	}
+	for _, ref := range schemaRefs(m) {
+		if err := d.dump(ref, depth+1, maxDepth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaRefs returns the blobrefs referenced by the schema blob m,
+// other than its signer's, in order.
+func schemaRefs(m map[string]interface{}) []*blobref.BlobRef {
+	var refs []*blobref.BlobRef
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			if br := blobref.Parse(v); br != nil {
+				refs = append(refs, br)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				if k != "camliSigner" {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(v[k])
+			}
+		}
+	}
+	walk(m)
+	return refs
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+)
+
+func TestDump(t *testing.T) {
+	blobs := make(map[string]string)
+	add := func(s string) string {
+		br := blobref.SHA1FromString(s)
+		blobs[br.String()] = s
+		return br.String()
+	}
+	chunk := add("some file contents")
+	bytesRef := add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "bytes", "parts": [{"blobRef": %q, "size": 18}]}`, chunk))
+	file := add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "fileName": "foo.txt", "camliSigner": %q, "parts": [{"bytesRef": %q, "size": 18}]}`, chunk, bytesRef))
+
+	dump := func(depth int) string {
+		var buf bytes.Buffer
+		stdout = &buf
+		defer func() { stdout = os.Stdout }()
+		d := &dumper{
+			fetch: func(br *blobref.BlobRef) ([]byte, error) {
+				s, ok := blobs[br.String()]
+				if !ok {
+					return nil, os.ErrNotExist
+				}
+				return []byte(s), nil
+			},
+			seen: make(map[string]bool),
+		}
+		if err := d.dump(blobref.MustParse(file), 0, depth); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	out := dump(0)
+	if !strings.HasPrefix(out, file+": ") || !strings.Contains(out, `"file" schema blob`) {
+		t.Errorf("depth 0 dump doesn't describe the file:\n%s", out)
+	}
+	if strings.Contains(out, bytesRef+":") {
+		t.Errorf("depth 0 dump followed references:\n%s", out)
+	}
+
+	out = dump(2)
+	for _, want := range []string{
+		"  " + bytesRef + `: `,
+		`"bytes" schema blob`,
+		"    " + chunk + ": 18 bytes, not a schema blob",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("depth 2 dump lacks %q:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, chunk+": "); n != 1 {
+		t.Errorf("depth 2 dump has the chunk %d times; want once, the signer not being followed:\n%s", n, out)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"camlistore.org/pkg/osutil"
+	"camlistore.org/pkg/serverconfig"
+)
+
+type dumpconfigCmd struct {
+	prefix string
+}
+
+func init() {
+	RegisterCommand("dumpconfig", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(dumpconfigCmd)
+		flags.StringVar(&cmd.prefix, "prefix", "", "Optional handler prefix, such as /sync/, to print only the configuration of.")
+		return cmd
+	})
+}
+
+func (c *dumpconfigCmd) Usage() {
+	errf(`Usage: camtool [globalopts] dumpconfig [dumpconfigopts] [serverconfig]
+
+Prints the low-level handler configuration the server generates from
+its config file, and installs, as JSON. The file defaults to the
+server's; relative names are in the server's config directory, as
+with camlistored's -configfile.
+`)
+}
+
+func (c *dumpconfigCmd) Examples() []string {
+	return []string{
+		"",
+		"-prefix=/sync/ /etc/camlistore/server-config.json",
+	}
+}
+
+func (c *dumpconfigCmd) RunCommand(args []string) error {
+	var file string
+	switch len(args) {
+	case 0:
+		file = osutil.UserServerConfigPath()
+	case 1:
+		file = args[0]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(osutil.CamliConfigDir(), file)
+		}
+	default:
+		return UsageError("dumpconfig takes at most one config file")
+	}
+	conf, err := serverconfig.Load(file)
+	if err != nil {
+		return err
+	}
+	var v interface{} = conf.Obj
+	if c.prefix != "" {
+		prefix := "/"
+		if p := strings.Trim(c.prefix, "/"); p != "" {
+			prefix += p + "/"
+		}
+		prefixes, _ := conf.Obj["prefixes"].(map[string]interface{})
+		h, ok := prefixes[prefix]
+		if !ok {
+			return fmt.Errorf("no handler at prefix %q in the configuration of %s", prefix, file)
+		}
+		v = h
+	}
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s\n", out)
+	return nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/osutil"
+)
+
+type encryptRingCmd struct {
+	decrypt bool
+}
+
+func init() {
+	RegisterCommand("encryptring", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(encryptRingCmd)
+		flags.BoolVar(&cmd.decrypt, "decrypt", false, "Decrypt the secret ring back to plain OpenPGP packets instead.")
+		return cmd
+	})
+}
+
+func (c *encryptRingCmd) Usage() {
+	errf(`Usage: camtool [globalopts] encryptring [encryptringopts] [secretring]
+
+Encrypts a secret ring file in place with a passphrase, by default the
+server's identitySecretRing. The server then asks for the passphrase
+when it starts, with gpg-agent or pinentry, unless it's in the
+%s environment variable.
+`, jsonsign.SecringPassphraseEnv)
+}
+
+func (c *encryptRingCmd) Examples() []string {
+	return []string{
+		"",
+		"~/.camlistore/identity-secring.gpg",
+		"-decrypt",
+	}
+}
+
+func (c *encryptRingCmd) RunCommand(args []string) error {
+	if len(args) > 1 {
+		return UsageError("encryptring takes at most one secret ring file")
+	}
+	file := osutil.IdentitySecretRing()
+	if len(args) == 1 {
+		file = args[0]
+	}
+	if c.decrypt {
+		if err := jsonsign.DecryptKeyRingFile(file); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Decrypted %s\n", file)
+		return nil
+	}
+	pass, err := askNewPassword("Passphrase for " + file)
+	if err != nil {
+		return err
+	}
+	if err := jsonsign.EncryptKeyRingFile(file, []byte(pass)); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Encrypted %s\n", file)
+	return nil
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type exportSiteCmd struct {
+	out     string
+	baseURL string
+}
+
+func init() {
+	RegisterCommand("exportsite", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(exportSiteCmd)
+		flags.StringVar(&cmd.out, "o", "", "The directory to write the site to. Required.")
+		flags.StringVar(&cmd.baseURL, "url", "", "The URL the site will be hosted at, replacing the publish root's URL in its feeds.")
+		return cmd
+	})
+}
+
+func (c *exportSiteCmd) Usage() {
+	errf(`Usage: camtool [globalopts] exportsite -o <dir> [exportsiteopts] <publish root URL>
+
+Renders a publish root, such as a gallery or a blog, to a directory of
+static HTML pages and files, for hosting a public mirror on any static
+web host. The pages are those the publish handler serves to the public:
+every page, image, file and feed under the publish root's URL linked
+from its root page. Links between them are rewritten to be relative.
+`)
+}
+
+func (c *exportSiteCmd) Examples() []string {
+	return []string{
+		"-o /tmp/pics https://camlistore.example.com/pics/",
+		"-o /tmp/blog -url=http://blog.example.com/ https://camlistore.example.com/blog/",
+	}
+}
+
+func (c *exportSiteCmd) RunCommand(args []string) error {
+	if len(args) != 1 {
+		return UsageError("exportsite takes exactly one publish root URL")
+	}
+	if c.out == "" {
+		return UsageError("no output directory; use -o")
+	}
+	root, err := url.Parse(args[0])
+	if err != nil || (root.Scheme != "http" && root.Scheme != "https") {
+		return UsageError(fmt.Sprintf("invalid publish root URL %q", args[0]))
+	}
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+	}
+	e := newSiteExporter(root, c.out, http.DefaultClient)
+	e.baseURL = c.baseURL
+	if err := e.export(); err != nil {
+		return err
+	}
+	errf("Exported %d pages and %d files to %s\n", len(e.html), len(e.files)-len(e.html), c.out)
+	return nil
+}
+
+// linkRx matches the links of an HTML page: its href and src
+// attributes.
+var linkRx = regexp.MustCompile(`(?i)(\s(?:href|src)\s*=\s*)(['"])([^'"]*)(['"])`)
+
+// A siteExporter crawls a publish root to a directory.
+type siteExporter struct {
+	root    *url.URL
+	dir     string
+	client  *http.Client
+	baseURL string // or "" to leave the feeds' URLs
+
+	queue []*url.URL
+	seen  map[string]bool   // URLs queued, without fragments
+	files map[string]string // of the URLs fetched, to their local paths
+	html  []*sitePage       // written once every link's path is known
+}
+
+// A sitePage is an HTML page, before its links are rewritten.
+type sitePage struct {
+	u     *url.URL
+	local string
+	body  string
+}
+
+func newSiteExporter(root *url.URL, dir string, client *http.Client) *siteExporter {
+	return &siteExporter{
+		root:   root,
+		dir:    dir,
+		client: client,
+		seen:   make(map[string]bool),
+		files:  make(map[string]string),
+	}
+}
+
+// inRoot reports whether u is under the publish root.
+func (e *siteExporter) inRoot(u *url.URL) bool {
+	return u.Scheme == e.root.Scheme && u.Host == e.root.Host && strings.HasPrefix(u.Path, e.root.Path)
+}
+
+func urlKey(u *url.URL) string {
+	v := *u
+	v.Fragment = ""
+	return v.String()
+}
+
+func (e *siteExporter) enqueue(u *url.URL) {
+	if !e.inRoot(u) || e.seen[urlKey(u)] {
+		return
+	}
+	e.seen[urlKey(u)] = true
+	e.queue = append(e.queue, u)
+}
+
+var nonWordRx = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// localPath returns the path, relative to the output directory and
+// slash-separated, of the page or file at u. Pages are the index.html
+// of their directory, and query strings, which static hosts ignore,
+// are part of the file name.
+func (e *siteExporter) localPath(u *url.URL, isHTML bool) string {
+	rel := strings.TrimPrefix(u.Path, e.root.Path)
+	ext := path.Ext(rel)
+	switch {
+	case isHTML && ext != ".html" && ext != ".htm":
+		rel = path.Join(rel, "index.html")
+	case rel == "" || strings.HasSuffix(rel, "/"):
+		rel += "index.html"
+	}
+	if u.RawQuery != "" {
+		ext := path.Ext(rel)
+		q := strings.Trim(nonWordRx.ReplaceAllString(u.RawQuery, "_"), "_")
+		rel = strings.TrimSuffix(rel, ext) + "_" + q + ext
+	}
+	return rel
+}
+
+// export crawls the publish root.
+func (e *siteExporter) export() error {
+	e.enqueue(e.root)
+	for len(e.queue) > 0 {
+		u := e.queue[0]
+		e.queue = e.queue[1:]
+		if err := e.fetch(u); err != nil {
+			return fmt.Errorf("fetching %s: %v", u, err)
+		}
+	}
+	for _, p := range e.html {
+		if err := e.writeFile(p.local, strings.NewReader(e.rewriteLinks(p))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *siteExporter) writeFile(local string, r io.Reader) error {
+	name := filepath.Join(e.dir, filepath.FromSlash(local))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fetch saves the page or file at u, queueing the links of pages.
+func (e *siteExporter) fetch(u *url.URL) error {
+	res, err := e.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		// A broken link shouldn't stop the export.
+		errf("Skipping %s: %s\n", u, res.Status)
+		return nil
+	}
+	ct := res.Header.Get("Content-Type")
+	isHTML := strings.HasPrefix(ct, "text/html")
+	local := e.localPath(u, isHTML)
+	e.files[urlKey(u)] = local
+	if !isHTML {
+		if e.baseURL == "" || !strings.Contains(ct, "xml") {
+			return e.writeFile(local, res.Body)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		feed := strings.Replace(string(b), e.root.String(), e.baseURL, -1)
+		return e.writeFile(local, strings.NewReader(feed))
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	p := &sitePage{u: u, local: local, body: string(b)}
+	for _, m := range linkRx.FindAllStringSubmatch(p.body, -1) {
+		if target := e.resolve(p, m[3]); target != nil {
+			e.enqueue(target)
+		}
+	}
+	e.html = append(e.html, p)
+	return nil
+}
+
+// resolve returns the URL of the link in page p, or nil if it's not a
+// link to follow.
+func (e *siteExporter) resolve(p *sitePage, link string) *url.URL {
+	ref, err := url.Parse(html.UnescapeString(link))
+	if err != nil || (ref.Scheme != "" && ref.Scheme != "http" && ref.Scheme != "https") {
+		return nil
+	}
+	if ref.Path == "" && ref.RawQuery == "" {
+		// A fragment of the page itself.
+		return nil
+	}
+	return p.u.ResolveReference(ref)
+}
+
+// rewriteLinks returns the body of p with its links to the pages and
+// files exported made relative to p.
+func (e *siteExporter) rewriteLinks(p *sitePage) string {
+	from := path.Dir(p.local)
+	return linkRx.ReplaceAllStringFunc(p.body, func(attr string) string {
+		m := linkRx.FindStringSubmatch(attr)
+		target := e.resolve(p, m[3])
+		if target == nil {
+			return attr
+		}
+		local, ok := e.files[urlKey(target)]
+		if !ok {
+			return attr
+		}
+		rel, err := filepath.Rel(filepath.FromSlash(from), filepath.FromSlash(local))
+		if err != nil {
+			return attr
+		}
+		link := (&url.URL{Path: filepath.ToSlash(rel), Fragment: target.Fragment}).String()
+		return m[1] + m[2] + html.EscapeString(link) + m[4]
+	})
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportSite(t *testing.T) {
+	base := ""
+	pages := map[string]string{
+		"/pics/": `<html><head><link rel='stylesheet' href='/pics/=s/camli.css'>` +
+			`<link rel='alternate' type='application/atom+xml' href='/pics/-/=a'></head>` +
+			`<body><a href='/pics/-/h0123456789'><img src='/pics/-/h0123456789/=i/sun+set.jpg?mw=200&amp;mh=200'></a>` +
+			`<a href='?page=1'>next</a> <a href='/ui/'>ui</a> <a href='#top'>top</a> <a href='http://example.com/'>elsewhere</a>` +
+			`<a href='/pics/-/missing'>broken</a></body></html>`,
+		"/pics/?page=1":                      `<html><body><a href='/pics/'>first</a></body></html>`,
+		"/pics/-/h0123456789":                `<html><body><a href='/pics/-/h0123456789/=f/sun+set.jpg'>download</a> <a href='/pics/#top'>up</a></body></html>`,
+		"/pics/=s/camli.css":                 `body { color: black }`,
+		"/pics/-/=a":                         `<feed><link href='%s/pics/-/h0123456789'/></feed>`,
+		"/pics/-/h0123456789/=f/sun+set.jpg": "full",
+		"/pics/-/h0123456789/=i/sun+set.jpg?mw=200&mh=200": "thumb",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, ok := pages[req.URL.RequestURI()]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		switch {
+		case strings.HasPrefix(body, "<html>"):
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		case strings.HasPrefix(body, "<feed>"):
+			rw.Header().Set("Content-Type", "application/atom+xml")
+			body = fmt.Sprintf(body, base)
+		default:
+			rw.Header().Set("Content-Type", "application/octet-stream")
+		}
+		fmt.Fprint(rw, body)
+	}))
+	defer ts.Close()
+	base = ts.URL
+
+	dir, err := ioutil.TempDir("", "exportsite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, _ := url.Parse(ts.URL + "/pics/")
+	e := newSiteExporter(root, dir, http.DefaultClient)
+	e.baseURL = "http://mirror.example.com/"
+	var skipped bytes.Buffer
+	stderr = &skipped
+	defer func() { stderr = os.Stderr }()
+	if err := e.export(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"index.html": `<html><head><link rel='stylesheet' href='=s/camli.css'>` +
+			`<link rel='alternate' type='application/atom+xml' href='-/=a'></head>` +
+			`<body><a href='-/h0123456789/index.html'><img src='-/h0123456789/=i/sun+set_mw_200_mh_200.jpg'></a>` +
+			`<a href='index_page_1.html'>next</a> <a href='/ui/'>ui</a> <a href='#top'>top</a> <a href='http://example.com/'>elsewhere</a>` +
+			`<a href='/pics/-/missing'>broken</a></body></html>`,
+		"index_page_1.html":            `<html><body><a href='index.html'>first</a></body></html>`,
+		"-/h0123456789/index.html":     `<html><body><a href='=f/sun+set.jpg'>download</a> <a href='../../index.html#top'>up</a></body></html>`,
+		"=s/camli.css":                 `body { color: black }`,
+		"-/=a":                         `<feed><link href='http://mirror.example.com/-/h0123456789'/></feed>`,
+		"-/h0123456789/=f/sun+set.jpg": "full",
+		"-/h0123456789/=i/sun+set_mw_200_mh_200.jpg": "thumb",
+	}
+	if !strings.Contains(skipped.String(), "/pics/-/missing: 404") {
+		t.Errorf("broken link not reported; stderr = %q", skipped.String())
+	}
+	for name, contents := range want {
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s not exported: %v", name, err)
+			continue
+		}
+		if string(b) != contents {
+			t.Errorf("%s = %s\nwant %s", name, b, contents)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+)
+
+type fsckCmd struct{}
+
+func init() {
+	RegisterCommand("fsck", func(flags *flag.FlagSet) CommandRunner {
+		return new(fsckCmd)
+	})
+}
+
+func (c *fsckCmd) Usage() {
+	errf(`Usage: camtool [globalopts] fsck
+
+Fetches every blob of the configured server, checking its digest and
+size against its blobref and enumerated size, and prints those that
+don't match.
+`)
+}
+
+func (c *fsckCmd) RunCommand(args []string) error {
+	if len(args) != 0 {
+		return UsageError("fsck takes no arguments")
+	}
+	cl := newClient()
+	blobs := make(chan blobref.SizedBlobRef, 100)
+	enumErr := make(chan error, 1)
+	go func() {
+		enumErr <- cl.SimpleEnumerateBlobs(blobs)
+	}()
+	var checked, bad int
+	for sb := range blobs {
+		checked++
+		if err := checkBlob(cl, sb); err != nil {
+			bad++
+			fmt.Fprintf(stdout, "%s: %v\n", sb.BlobRef, err)
+		}
+	}
+	if err := <-enumErr; err != nil {
+		return fmt.Errorf("enumerate error: %v", err)
+	}
+	if *flagVerbose {
+		log.Printf("Checked %d blobs", checked)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d blobs are corrupt", bad, checked)
+	}
+	return nil
+}
+
+// A corruptBlobError is the error of checkBlob when a blob was
+// fetched but doesn't match its blobref or size, rather than failing
+// to be fetched.
+type corruptBlobError string
+
+func (e corruptBlobError) Error() string { return string(e) }
+
+// checkBlob fetches sb and returns an error if it doesn't hash to its
+// blobref or is not of its enumerated size.
+func checkBlob(cl *client.Client, sb blobref.SizedBlobRef) error {
+	h := sb.BlobRef.Hash()
+	if h == nil {
+		return errors.New("unsupported hash")
+	}
+	rc, _, err := cl.FetchStreaming(sb.BlobRef)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	n, err := io.Copy(h, rc)
+	if err != nil {
+		return err
+	}
+	if n != sb.Size {
+		return corruptBlobError(fmt.Sprintf("size %d, enumerated as %d", n, sb.Size))
+	}
+	if !sb.BlobRef.HashMatches(h) {
+		return corruptBlobError("digest mismatch")
+	}
+	return nil
+}
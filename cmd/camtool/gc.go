@@ -0,0 +1,141 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+)
+
+type gcCmd struct {
+	remove bool
+	list   bool
+}
+
+func init() {
+	RegisterCommand("gc", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(gcCmd)
+		flags.BoolVar(&cmd.remove, "remove", false, "Remove the garbage. Without it, gc only reports what it would remove.")
+		flags.BoolVar(&cmd.list, "list", false, "Also list each blob of the garbage, with its size and type.")
+		return cmd
+	})
+}
+
+func (c *gcCmd) Usage() {
+	errf(`Usage: camtool [globalopts] gc [gcopts] [<root blobref>...]
+
+Runs the server's garbage collector, and prints the blobs and bytes of
+the garbage, by type. The garbage is the deleted permanodes and claims,
+and the blobs only they reference. If roots are given, it is also every
+blob not reachable from them, or from the claims of the permanodes
+reachable from them.
+
+Nothing is removed without -remove: check the report of a run without
+it first.
+`)
+}
+
+func (c *gcCmd) Examples() []string {
+	return []string{
+		"",
+		"-list sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007",
+		"-remove sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007",
+	}
+}
+
+func (c *gcCmd) RunCommand(args []string) error {
+	var roots []*blobref.BlobRef
+	for _, arg := range args {
+		br := blobref.Parse(arg)
+		if br == nil {
+			return UsageError(fmt.Sprintf("invalid root blobref %q", arg))
+		}
+		roots = append(roots, br)
+	}
+	report, err := newClient().GCFrom(roots, !c.remove)
+	if err != nil {
+		return err
+	}
+	if c.list {
+		for _, g := range report.Garbage {
+			fmt.Fprintf(stdout, "%s %d %s\n", g.BlobRef, g.Size, garbageType(g))
+		}
+	}
+	for _, tt := range garbageByType(report.Garbage) {
+		fmt.Fprintf(stdout, "%-12s %8d blobs %14d bytes\n", tt.typ, tt.blobs, tt.bytes)
+	}
+	if report.Removed {
+		errf("Removed %d of %d blobs, %d bytes\n", len(report.Garbage), report.Blobs, report.GarbageSize)
+		return nil
+	}
+	errf("Would remove %d of %d blobs, %d bytes\n", len(report.Garbage), report.Blobs, report.GarbageSize)
+	if len(report.Garbage) > 0 {
+		errf("Nothing removed; run again with -remove to remove them.\n")
+	}
+	return nil
+}
+
+// A typeTotal is the garbage of a type.
+type typeTotal struct {
+	typ   string
+	blobs int
+	bytes int64
+}
+
+// garbageByType returns the totals of garbage by type, the largest
+// first.
+func garbageByType(garbage []client.GCGarbage) []*typeTotal {
+	byType := make(map[string]*typeTotal)
+	var totals []*typeTotal
+	for _, g := range garbage {
+		typ := garbageType(g)
+		tt, ok := byType[typ]
+		if !ok {
+			tt = &typeTotal{typ: typ}
+			byType[typ] = tt
+			totals = append(totals, tt)
+		}
+		tt.blobs++
+		tt.bytes += g.Size
+	}
+	sort.Sort(byBytes(totals))
+	return totals
+}
+
+// garbageType returns the camliType of g, or "data" for the blobs that
+// aren't schema blobs, such as file chunks.
+func garbageType(g client.GCGarbage) string {
+	if g.Type == "" {
+		return "data"
+	}
+	return g.Type
+}
+
+type byBytes []*typeTotal
+
+func (s byBytes) Len() int      { return len(s) }
+func (s byBytes) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byBytes) Less(i, j int) bool {
+	if s[i].bytes != s[j].bytes {
+		return s[i].bytes > s[j].bytes
+	}
+	return s[i].typ < s[j].typ
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+)
+
+type ipfsCmd struct {
+	api     string
+	publish bool
+	key     string
+}
+
+func init() {
+	RegisterCommand("ipfs", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(ipfsCmd)
+		flags.StringVar(&cmd.api, "api", "http://127.0.0.1:5001", "The URL of the IPFS daemon's HTTP API.")
+		flags.BoolVar(&cmd.publish, "publish", false, "Publish the mapping under the IPNS name of the daemon's key -key.")
+		flags.StringVar(&cmd.key, "key", "self", "With -publish, the name of the IPFS key to publish the mapping with.")
+		return cmd
+	})
+}
+
+func (c *ipfsCmd) Usage() {
+	errf(`Usage: camtool [globalopts] ipfs [ipfsopts] <blobref>...
+
+Exports files to IPFS, so they stay available while the server is
+offline: adds and pins, on an IPFS daemon, the contents of the files
+of each blobref, a share, a permanode, a file or a directory. Shares
+export their target, permanodes their camliContent, and directories
+their files, recursively.
+
+Then adds the mapping of the files' blobrefs to their IPFS paths, in
+JSON, and prints its IPFS path. With -publish, the mapping is also
+published under the daemon's IPNS name, which stays the same as the
+mapping is updated.
+`)
+}
+
+func (c *ipfsCmd) Examples() []string {
+	return []string{
+		"sha1-0e5e80e1c2cd3b1b8d5ea5bd1e6b1b6d2e2b8f5a",
+		"-publish -key=photos <share blobref>",
+	}
+}
+
+func (c *ipfsCmd) RunCommand(args []string) error {
+	if len(args) == 0 {
+		return UsageError("no blobrefs to export")
+	}
+	var refs []*blobref.BlobRef
+	for _, arg := range args {
+		br := blobref.Parse(arg)
+		if br == nil {
+			return UsageError(fmt.Sprintf("invalid blobref %q", arg))
+		}
+		refs = append(refs, br)
+	}
+	cl := newClient()
+	e := &ipfsExporter{
+		fetcher: blobref.SeekerFromStreamingFetcher(cl),
+		content: cl.PermanodeContent,
+		ipfs:    &ipfsAPI{base: strings.TrimSuffix(c.api, "/"), client: http.DefaultClient},
+	}
+	for _, br := range refs {
+		if err := e.export(br, ""); err != nil {
+			return fmt.Errorf("exporting %v: %v", br, err)
+		}
+	}
+	mapping, err := e.addMapping()
+	if err != nil {
+		return fmt.Errorf("adding the mapping: %v", err)
+	}
+	fmt.Fprintf(stdout, "mapping /ipfs/%s\n", mapping)
+	if !c.publish {
+		return nil
+	}
+	name, err := e.ipfs.publish(mapping, c.key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "published /ipns/%s\n", name)
+	return nil
+}
+
+// An ipfsFile is a file of the mapping of an IPFS export.
+type ipfsFile struct {
+	BlobRef string `json:"blobRef"` // of the file schema blob
+	Path    string `json:"path"`    // in the exported directories
+	Size    int64  `json:"size"`
+	IPFS    string `json:"ipfs"` // the IPFS path of the contents
+}
+
+// ipfsMapping is the mapping of an IPFS export.
+type ipfsMapping struct {
+	Exported string     `json:"exported"` // RFC 3339
+	Files    []ipfsFile `json:"files"`
+}
+
+type ipfsExporter struct {
+	fetcher blobref.SeekFetcher
+	content func(pn *blobref.BlobRef) (*blobref.BlobRef, error)
+	ipfs    *ipfsAPI
+
+	files []ipfsFile
+}
+
+// export adds the files of br, at dir in the exported directories.
+func (e *ipfsExporter) export(br *blobref.BlobRef, dir string) error {
+	rc, _, err := e.fetcher.Fetch(br)
+	if err != nil {
+		return err
+	}
+	ss, err := schema.ParseSuperset(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("%v isn't a schema blob: %v", br, err)
+	}
+	switch ss.Type {
+	case "share":
+		if ss.ShareExpired(time.Now()) {
+			return fmt.Errorf("share %v expired", br)
+		}
+		if ss.Target == nil {
+			return fmt.Errorf("share %v has no target", br)
+		}
+		return e.export(ss.Target, dir)
+	case "permanode":
+		content, err := e.content(br)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			return fmt.Errorf("permanode %v has no camliContent", br)
+		}
+		return e.export(content, dir)
+	case "file":
+		fr, err := ss.NewFileReader(e.fetcher)
+		if err != nil {
+			return err
+		}
+		defer fr.Close()
+		name := ss.FileNameString()
+		if name == "" {
+			name = br.String()
+		}
+		hash, err := e.ipfs.add(name, fr)
+		if err != nil {
+			return fmt.Errorf("adding file %v: %v", br, err)
+		}
+		e.files = append(e.files, ipfsFile{
+			BlobRef: br.String(),
+			Path:    path.Join(dir, name),
+			Size:    int64(ss.SumPartsSize()),
+			IPFS:    "/ipfs/" + hash,
+		})
+		return nil
+	case "directory":
+		dr, err := ss.NewDirReader(e.fetcher)
+		if err != nil {
+			return err
+		}
+		members, err := dr.StaticSet()
+		if err != nil {
+			return err
+		}
+		sub := path.Join(dir, ss.FileNameString())
+		for _, m := range members {
+			if err := e.export(m, sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%v is a %q; want a share, a permanode, a file or a directory", br, ss.Type)
+}
+
+// addMapping adds the mapping of the exported files, and returns its
+// hash.
+func (e *ipfsExporter) addMapping() (string, error) {
+	b, err := json.MarshalIndent(&ipfsMapping{
+		Exported: schema.RFC3339FromTime(time.Now()),
+		Files:    e.files,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return e.ipfs.add("camlistore-ipfs.json", bytes.NewReader(b))
+}
+
+// ipfsAPI is a client of an IPFS daemon's HTTP API.
+type ipfsAPI struct {
+	base   string // such as "http://127.0.0.1:5001"
+	client *http.Client
+}
+
+// call POSTs body, of type contentType, to the API command cmd with
+// args, and decodes the JSON response into res.
+func (a *ipfsAPI) call(cmd string, args url.Values, contentType string, body io.Reader, res interface{}) error {
+	req, err := http.NewRequest("POST", a.base+"/api/v0/"+cmd+"?"+args.Encode(), body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Message string }
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Message != "" {
+			return fmt.Errorf("ipfs %s: %s", cmd, e.Message)
+		}
+		return fmt.Errorf("ipfs %s: %s", cmd, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// add adds and pins the contents of r, and returns their hash.
+func (a *ipfsAPI) add(name string, r io.Reader) (string, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fw, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(fw, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	var res struct {
+		Name string
+		Hash string
+	}
+	err := a.call("add", url.Values{"pin": {"true"}}, mw.FormDataContentType(), pr, &res)
+	// Unblock the writer if the call failed early.
+	pr.Close()
+	if err != nil {
+		return "", err
+	}
+	if res.Hash == "" {
+		return "", errors.New("ipfs add: no hash in response")
+	}
+	return res.Hash, nil
+}
+
+// publish publishes /ipfs/hash under the IPNS name of key, and
+// returns the name.
+func (a *ipfsAPI) publish(hash, key string) (string, error) {
+	var res struct {
+		Name  string
+		Value string
+	}
+	err := a.call("name/publish", url.Values{"arg": {"/ipfs/" + hash}, "key": {key}}, "", nil, &res)
+	if err != nil {
+		return "", err
+	}
+	return res.Name, nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/test"
+)
+
+// fakeIPFS is an IPFS daemon's API, hashing the files it adds as
+// Qm0, Qm1, and so on.
+type fakeIPFS struct {
+	added     map[string]string // hash to contents
+	published string
+}
+
+func (f *fakeIPFS) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/api/v0/add":
+		if req.FormValue("pin") != "true" {
+			http.Error(rw, `{"Message": "not pinned"}`, http.StatusBadRequest)
+			return
+		}
+		file, hdr, err := req.FormFile("file")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(file)
+		hash := fmt.Sprintf("Qm%d", len(f.added))
+		f.added[hash] = string(b)
+		fmt.Fprintf(rw, `{"Name": %q, "Hash": %q, "Size": "%d"}`, hdr.Filename, hash, len(b))
+	case "/api/v0/name/publish":
+		f.published = req.FormValue("arg")
+		fmt.Fprintf(rw, `{"Name": "QmKey%s", "Value": %q}`, req.FormValue("key"), f.published)
+	default:
+		http.Error(rw, `{"Message": "unknown command"}`, http.StatusNotFound)
+	}
+}
+
+func TestIPFSExport(t *testing.T) {
+	sto := new(test.Fetcher)
+	add := func(s string) *blobref.BlobRef {
+		b := &test.Blob{Contents: s}
+		sto.AddBlob(b)
+		return b.BlobRef()
+	}
+	file := func(name, contents string) *blobref.BlobRef {
+		chunk := add(contents)
+		return add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "fileName": %q, "parts": [{"blobRef": %q, "size": %d}]}`,
+			name, chunk, len(contents)))
+	}
+	hello := file("hello.txt", "Hello.")
+	bye := file("bye.txt", "Bye.")
+	set := add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "static-set", "members": [%q, %q]}`, hello, bye))
+	dir := add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "directory", "fileName": "notes", "entries": %q}`, set))
+	share := add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "share", "authType": "haveref", "target": %q}`, dir))
+	pn := add(`{"camliVersion": 1, "camliType": "permanode", "random": "x"}`)
+	expired := add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "share", "authType": "haveref", "target": %q, "expires": "2013-01-01T00:00:00Z"}`, dir))
+
+	fake := &fakeIPFS{added: make(map[string]string)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	e := &ipfsExporter{
+		fetcher: sto,
+		content: func(br *blobref.BlobRef) (*blobref.BlobRef, error) {
+			if br.String() != pn.String() {
+				t.Fatalf("content of %v asked", br)
+			}
+			return hello, nil
+		},
+		ipfs: &ipfsAPI{base: ts.URL, client: http.DefaultClient},
+	}
+	for _, br := range []*blobref.BlobRef{share, pn} {
+		if err := e.export(br, ""); err != nil {
+			t.Fatalf("exporting %v: %v", br, err)
+		}
+	}
+	if err := e.export(expired, ""); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("exporting an expired share: %v", err)
+	}
+	mapping, err := e.addMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m ipfsMapping
+	if err := json.Unmarshal([]byte(fake.added[mapping]), &m); err != nil {
+		t.Fatalf("mapping %q: %v", fake.added[mapping], err)
+	}
+	want := []string{
+		"notes/hello.txt 6 Hello.",
+		"notes/bye.txt 4 Bye.",
+		"hello.txt 6 Hello.",
+	}
+	if len(m.Files) != len(want) {
+		t.Fatalf("mapping files = %v; want %d", m.Files, len(want))
+	}
+	for i, f := range m.Files {
+		got := fmt.Sprintf("%s %d %s", f.Path, f.Size, fake.added[strings.TrimPrefix(f.IPFS, "/ipfs/")])
+		if got != want[i] {
+			t.Errorf("file %d = %q; want %q", i, got, want[i])
+		}
+	}
+	if m.Files[0].BlobRef != hello.String() {
+		t.Errorf("blobRef of hello.txt = %s; want %s", m.Files[0].BlobRef, hello)
+	}
+
+	name, err := e.ipfs.publish(mapping, "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "QmKeyphotos" || fake.published != "/ipfs/"+mapping {
+		t.Errorf("published %q as %q", fake.published, name)
+	}
+}
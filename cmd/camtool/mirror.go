@@ -0,0 +1,280 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/client"
+)
+
+type mirrorCmd struct{}
+
+func init() {
+	RegisterCommand("mirror", func(flags *flag.FlagSet) CommandRunner {
+		return new(mirrorCmd)
+	})
+}
+
+func (c *mirrorCmd) Usage() {
+	errf(`Usage: camtool [globalopts] mirror <dir> [<root blobref>...]
+
+Mirrors the server's blobs to a directory, such as on a removable
+drive, for an offsite backup. The blobs are copied to <dir>/blobs, a
+store of the same layout as a server's blobPath, with a minimal server
+config serving them, <dir>/server-config.json:
+
+  camlistored -configfile=<dir>/server-config.json
+
+Only the blobs missing from the mirror are copied, so running mirror
+again with the same directory tops it up.
+
+If roots are given, only the blobs the garbage collector would keep
+from them are copied: those reachable from them, or from the claims of
+the permanodes reachable from them.
+`)
+}
+
+func (c *mirrorCmd) Examples() []string {
+	return []string{
+		"/media/backup/camlistore",
+		"/media/backup/photos sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007",
+	}
+}
+
+func (c *mirrorCmd) RunCommand(args []string) error {
+	if len(args) == 0 {
+		return UsageError("no mirror directory")
+	}
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	var roots []*blobref.BlobRef
+	for _, arg := range args[1:] {
+		br := blobref.Parse(arg)
+		if br == nil {
+			return UsageError(fmt.Sprintf("invalid root blobref %q", arg))
+		}
+		roots = append(roots, br)
+	}
+	cl := newClient()
+	m := &mirror{src: cl}
+	if len(roots) > 0 {
+		report, err := cl.GCFrom(roots, true)
+		if err != nil {
+			return fmt.Errorf("finding the blobs of the roots: %v", err)
+		}
+		m.skip = make(map[string]bool)
+		for _, g := range report.Garbage {
+			m.skip[g.BlobRef] = true
+		}
+	}
+	if err := m.open(dir); err != nil {
+		return err
+	}
+	err = m.copy()
+	errf("Copied %d blobs, %d bytes, to %s\n", m.copied, m.bytes, dir)
+	if m.skip != nil {
+		errf("Skipped %d blobs not kept from the roots\n", m.skipped)
+	}
+	return err
+}
+
+// mirrorSource is the server that mirror copies from.
+type mirrorSource interface {
+	SimpleEnumerateBlobs(ch chan<- blobref.SizedBlobRef) error
+	FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, error)
+}
+
+// A mirror copies blobs to a local disk store.
+type mirror struct {
+	src  mirrorSource
+	skip map[string]bool // blobs not to copy, or nil
+	dest *localdisk.DiskStorage
+
+	copied, skipped, errors int
+	bytes                   int64
+}
+
+// open creates, if needed, the mirror at dir, and its config.
+func (m *mirror) open(dir string) error {
+	blobDir := filepath.Join(dir, "blobs")
+	if err := os.MkdirAll(blobDir, 0700); err != nil {
+		return err
+	}
+	ds, err := localdisk.New(blobDir)
+	if err != nil {
+		return err
+	}
+	m.dest = ds
+	configFile := filepath.Join(dir, "server-config.json")
+	if _, err := os.Stat(configFile); !os.IsNotExist(err) {
+		// Keep any edits of the existing config.
+		return err
+	}
+	return writeMirrorConfig(configFile, blobDir)
+}
+
+// writeMirrorConfig writes to filename a low-level server config
+// serving the blobs of blobDir, on localhost only.
+func writeMirrorConfig(filename, blobDir string) error {
+	b, err := json.MarshalIndent(map[string]interface{}{
+		"handlerConfig": true,
+		"listen":        "localhost:3179",
+		"auth":          "localhost",
+		"prefixes": map[string]interface{}{
+			"/": map[string]interface{}{
+				"handler":     "root",
+				"handlerArgs": map[string]interface{}{"blobRoot": "/bs/"},
+			},
+			"/bs/": map[string]interface{}{
+				"handler":     "storage-filesystem",
+				"handlerArgs": map[string]interface{}{"path": blobDir},
+			},
+		},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(b, '\n'))
+}
+
+// writeFileAtomic writes b to filename through a temporary file, so an
+// interrupted write, such as by a drive being unplugged, doesn't leave
+// it truncated.
+func writeFileAtomic(filename string, b []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// copy copies the source's blobs missing from the mirror.
+func (m *mirror) copy() error {
+	srcBlobs := make(chan blobref.SizedBlobRef, 100)
+	destBlobs := make(chan blobref.SizedBlobRef, 100)
+	srcErr := make(chan error, 1)
+	destErr := make(chan error, 1)
+	go func() {
+		srcErr <- m.src.SimpleEnumerateBlobs(srcBlobs)
+	}()
+	go func() {
+		destErr <- enumerateAllTo(m.dest, destBlobs)
+	}()
+
+	missing := make(chan blobref.SizedBlobRef)
+	sizeMismatch := make(chan *blobref.BlobRef)
+	go client.ListMissingDestinationBlobs(missing, sizeMismatch, srcBlobs, destBlobs)
+For:
+	for {
+		select {
+		case br := <-sizeMismatch:
+			log.Printf("WARNING: blobref %v has differing sizes on the server and the mirror", br)
+			m.errors++
+		case sb, ok := <-missing:
+			if !ok {
+				break For
+			}
+			m.copyBlob(sb)
+		}
+	}
+
+	if err := <-srcErr; err != nil {
+		return fmt.Errorf("enumerating the server's blobs: %v", err)
+	}
+	if err := <-destErr; err != nil {
+		return fmt.Errorf("enumerating the mirror's blobs: %v", err)
+	}
+	if m.errors > 0 {
+		return fmt.Errorf("%d errors while mirroring", m.errors)
+	}
+	return nil
+}
+
+func (m *mirror) copyBlob(sb blobref.SizedBlobRef) {
+	if m.skip[sb.BlobRef.String()] {
+		m.skipped++
+		return
+	}
+	rc, _, err := m.src.FetchStreaming(sb.BlobRef)
+	if err != nil {
+		log.Printf("Error fetching %s: %v", sb.BlobRef, err)
+		m.errors++
+		return
+	}
+	defer rc.Close()
+	got, err := m.dest.ReceiveBlob(sb.BlobRef, rc)
+	if err != nil {
+		log.Printf("Error writing %s to the mirror: %v", sb.BlobRef, err)
+		m.errors++
+		return
+	}
+	if *flagVerbose {
+		log.Printf("Mirrored %s", sb.BlobRef)
+	}
+	m.copied++
+	m.bytes += got.Size
+}
+
+// enumerateAllTo sends every blob of e to ch, in order, and closes it.
+func enumerateAllTo(e blobserver.BlobEnumerator, ch chan<- blobref.SizedBlobRef) error {
+	defer close(ch)
+	const batch = 1000
+	after := ""
+	for {
+		page := make(chan blobref.SizedBlobRef)
+		errch := make(chan error, 1)
+		go func() {
+			errch <- e.EnumerateBlobs(page, after, batch, 0)
+		}()
+		got := 0
+		for sb := range page {
+			got++
+			after = sb.BlobRef.String()
+			ch <- sb
+		}
+		if err := <-errch; err != nil {
+			return err
+		}
+		if got < batch {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/test"
+)
+
+// fakeMirrorSource is a server of the blobs added to it.
+type fakeMirrorSource struct {
+	test.Fetcher
+	blobs []*test.Blob
+}
+
+func (s *fakeMirrorSource) add(contents string) *test.Blob {
+	b := &test.Blob{Contents: contents}
+	s.AddBlob(b)
+	s.blobs = append(s.blobs, b)
+	return b
+}
+
+func (s *fakeMirrorSource) SimpleEnumerateBlobs(ch chan<- blobref.SizedBlobRef) error {
+	defer close(ch)
+	var sbs []blobref.SizedBlobRef
+	for _, b := range s.blobs {
+		sbs = append(sbs, blobref.SizedBlobRef{BlobRef: b.BlobRef(), Size: b.Size()})
+	}
+	sort.Sort(sizedByRef(sbs))
+	for _, sb := range sbs {
+		ch <- sb
+	}
+	return nil
+}
+
+type sizedByRef []blobref.SizedBlobRef
+
+func (s sizedByRef) Len() int           { return len(s) }
+func (s sizedByRef) Less(i, j int) bool { return s[i].BlobRef.String() < s[j].BlobRef.String() }
+func (s sizedByRef) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func TestMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := new(fakeMirrorSource)
+	src.add("foo")
+	src.add("bar")
+	mirrorTo := func(dir string, skip map[string]bool) *mirror {
+		m := &mirror{src: src, skip: skip}
+		if err := m.open(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.copy(); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	if m := mirrorTo(dir, nil); m.copied != 2 || m.bytes != 6 {
+		t.Errorf("first mirror copied %d blobs, %d bytes; want 2, 6", m.copied, m.bytes)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "server-config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf struct {
+		Prefixes map[string]struct {
+			Handler     string
+			HandlerArgs map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(b, &conf); err != nil {
+		t.Fatalf("config %s: %v", b, err)
+	}
+	if bs := conf.Prefixes["/bs/"]; bs.Handler != "storage-filesystem" || bs.HandlerArgs["path"] != filepath.Join(dir, "blobs") {
+		t.Errorf("config /bs/ = %+v", bs)
+	}
+
+	baz := src.add("bazz")
+	if m := mirrorTo(dir, nil); m.copied != 1 || m.bytes != 4 {
+		t.Errorf("top-up copied %d blobs, %d bytes; want 1, 4", m.copied, m.bytes)
+	}
+	ds, err := localdisk.New(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range src.blobs {
+		rc, _, err := ds.FetchStreaming(b.BlobRef())
+		if err != nil {
+			t.Errorf("fetching %s from the mirror: %v", b.BlobRef(), err)
+			continue
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(got) != b.Contents {
+			t.Errorf("mirrored %s = %q, %v; want %q", b.BlobRef(), got, err, b.Contents)
+		}
+	}
+
+	sub := filepath.Join(dir, "subset")
+	m := mirrorTo(sub, map[string]bool{baz.BlobRef().String(): true})
+	if m.copied != 2 || m.skipped != 1 {
+		t.Errorf("subset copied %d, skipped %d; want 2, 1", m.copied, m.skipped)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/misc/pinentry"
+)
+
+type passwdCmd struct {
+	vivify bool
+	role   string
+	acl    bool
+	file   string
+}
+
+func init() {
+	RegisterCommand("passwd", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(passwdCmd)
+		flags.BoolVar(&cmd.vivify, "vivify", false, "Also ask for a password allowing only uploads of new files (vivify).")
+		flags.StringVar(&cmd.role, "role", "", "Optional role of the user: read, readwrite or admin (the default).")
+		flags.BoolVar(&cmd.acl, "acl", false, "Limit the user to the blobs granted to it by camliACL attributes.")
+		flags.StringVar(&cmd.file, "file", "", "Users file, of a \"users:file\" auth string, in which to add or replace the user, instead of printing an auth string.")
+		return cmd
+	})
+}
+
+func (c *passwdCmd) Usage() {
+	errf(`Usage: camtool [globalopts] passwd [passwdopts] <username>
+
+Asks for a password and prints a "userpass" auth string for the server
+config, or sets the user's line of a users file, with the password
+bcrypt-hashed so the config doesn't hold it in the clear. Clients
+still need the password itself. The server reads a users file when it
+starts.
+`)
+}
+
+func (c *passwdCmd) Examples() []string {
+	return []string{
+		"joe",
+		"-vivify joe",
+		"-file=users -role=read alice",
+		"-file=users -acl bob",
+	}
+}
+
+func (c *passwdCmd) RunCommand(args []string) error {
+	if len(args) != 1 {
+		return UsageError("passwd takes exactly one username")
+	}
+	user := args[0]
+	if user == "" || strings.Contains(user, ":") {
+		return errors.New("username can't be empty or contain a colon")
+	}
+	if c.role != "" {
+		if _, err := auth.ParseRole(c.role); err != nil {
+			return err
+		}
+	}
+	if c.acl && c.role == "admin" {
+		return errors.New("an acl user can't have the admin role")
+	}
+	hash, err := askHashedPassword("Password for " + user)
+	if err != nil {
+		return err
+	}
+	line := user + ":" + hash
+	if c.vivify {
+		hash, err := askHashedPassword("Vivify password for " + user)
+		if err != nil {
+			return err
+		}
+		line += ":vivify=" + hash
+	}
+	if c.role != "" {
+		line += ":role=" + c.role
+	}
+	if c.acl {
+		line += ":acl"
+	}
+	if c.file == "" {
+		fmt.Fprintf(stdout, "userpass:%s\n", line)
+		return nil
+	}
+	return setLine(auth.ConfigPath(c.file), user, line)
+}
+
+// askHashedPassword asks twice for a password and returns its hash.
+func askHashedPassword(prompt string) (string, error) {
+	pass, err := askNewPassword(prompt)
+	if err != nil {
+		return "", err
+	}
+	return auth.HashPassword(pass)
+}
+
+// askNewPassword asks twice for a password and returns it.
+func askNewPassword(prompt string) (string, error) {
+	pass, err := (&pinentry.Request{Prompt: prompt}).GetPIN()
+	if err != nil {
+		return "", err
+	}
+	errf("\n")
+	if pass == "" {
+		return "", errors.New("empty password")
+	}
+	again, err := (&pinentry.Request{Prompt: prompt + " (again)"}).GetPIN()
+	if err != nil {
+		return "", err
+	}
+	errf("\n")
+	if again != pass {
+		return "", errors.New("passwords don't match")
+	}
+	return pass, nil
+}
+
+// setLine replaces the line of name in a users or tokens file, or
+// appends line if name has none, creating the file if needed. An
+// empty line removes name's.
+func setLine(file, name, line string) error {
+	old, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var buf bytes.Buffer
+	found := false
+	for _, l := range strings.SplitAfter(string(old), "\n") {
+		if l == "" {
+			continue
+		}
+		if strings.HasPrefix(l, name+":") {
+			if !found && line != "" {
+				buf.WriteString(line + "\n")
+			}
+			found = true
+			continue
+		}
+		buf.WriteString(l)
+		if !strings.HasSuffix(l, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	if !found {
+		if line == "" {
+			return fmt.Errorf("no %q in %s", name, file)
+		}
+		buf.WriteString(line + "\n")
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/schema"
+)
+
+type rotateKeyCmd struct {
+	updateConfig bool
+}
+
+func init() {
+	RegisterCommand("rotatekey", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(rotateKeyCmd)
+		flags.BoolVar(&cmd.updateConfig, "update-config", false, "Also change the client config to sign with the new key from now on.")
+		return cmd
+	})
+}
+
+func (c *rotateKeyCmd) Usage() {
+	errf(`Usage: camtool [globalopts] rotatekey [rotatekeyopts]
+
+Generates a new signing key, adds it to the client's secret ring, and
+uploads its public key with a "delegation" to it signed by the current
+key. The server then counts the claims signed by either key as those
+of the same owner, so the old key can be retired without re-signing
+its claims.
+`)
+}
+
+func (c *rotateKeyCmd) Examples() []string {
+	return []string{
+		"",
+		"-update-config",
+	}
+}
+
+func (c *rotateKeyCmd) RunCommand(args []string) error {
+	if len(args) != 0 {
+		return UsageError("rotatekey takes no arguments")
+	}
+	cc := newClient()
+	oldSigner := cc.SignerPublicKeyBlobref()
+	if oldSigner == nil {
+		return errors.New("no signing key configured; run \"camput init\" first")
+	}
+	conf, err := readClientConfig()
+	if err != nil {
+		return err
+	}
+	pubKeyDir, _ := conf["selfPubKeyDir"].(string)
+	if pubKeyDir == "" {
+		return fmt.Errorf("no selfPubKeyDir in %s", client.ConfigFilePath())
+	}
+
+	ring := cc.SecretRingFile()
+	ent, err := jsonsign.NewEntity()
+	if err != nil {
+		return err
+	}
+	armored, err := jsonsign.ArmoredPublicKey(ent)
+	if err != nil {
+		return err
+	}
+	newSigner := blobref.SHA1FromString(armored)
+	if err := jsonsign.AppendKeyRing(ring, ent); err != nil {
+		return err
+	}
+	keyId := ent.PrimaryKey.KeyIdString()
+	errf("Added key %s to %s\n", keyId, ring)
+
+	pubFile := filepath.Join(pubKeyDir, newSigner.String()+".camli")
+	if err := ioutil.WriteFile(pubFile, []byte(armored), 0644); err != nil {
+		return err
+	}
+	if _, err := cc.Upload(client.NewUploadHandleFromString(armored)); err != nil {
+		return fmt.Errorf("uploading public key %s: %v", newSigner, err)
+	}
+
+	pr, err := signAndUpload(cc, schema.NewDelegation(newSigner))
+	if err != nil {
+		return fmt.Errorf("uploading delegation: %v", err)
+	}
+	errf("Uploaded delegation %s from %s to %s\n", pr.BlobRef, oldSigner, newSigner)
+
+	if !c.updateConfig {
+		errf("To sign with the new key, set \"keyId\" to %q and \"publicKeyBlobref\" to %q in %s.\n",
+			keyId, newSigner, client.ConfigFilePath())
+		return nil
+	}
+	conf["keyId"] = keyId
+	conf["publicKeyBlobref"] = newSigner.String()
+	if err := writeClientConfig(conf); err != nil {
+		return err
+	}
+	errf("Updated %s to sign with key %s\n", client.ConfigFilePath(), keyId)
+	return nil
+}
+
+// readClientConfig returns the client config file as is, without
+// expanding its expressions, so it can be written back.
+func readClientConfig() (map[string]interface{}, error) {
+	slurp, err := ioutil.ReadFile(client.ConfigFilePath())
+	if err != nil {
+		return nil, err
+	}
+	conf := make(map[string]interface{})
+	if err := json.Unmarshal(slurp, &conf); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", client.ConfigFilePath(), err)
+	}
+	return conf, nil
+}
+
+func writeClientConfig(conf map[string]interface{}) error {
+	jsonBytes, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := client.ConfigFilePath()
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, jsonBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,355 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type searchCmd struct {
+	json bool
+	max  int
+}
+
+func init() {
+	RegisterCommand("search", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(searchCmd)
+		flags.BoolVar(&cmd.json, "json", false, "Print the description of each matching permanode as JSON, instead of just its blobref.")
+		flags.IntVar(&cmd.max, "max", 0, "Optional maximum number of results to ask the server for.")
+		return cmd
+	})
+}
+
+func (c *searchCmd) Usage() {
+	errf(`Usage: camtool [globalopts] search [searchopts] <expression>
+
+An expression is a list of space-separated terms, all of which must
+match. Values containing spaces may be double-quoted.
+
+  WORD               any attribute contains WORD
+  tag:VALUE          has tag VALUE
+  title:VALUE        title contains VALUE
+  attr:NAME:VALUE    attribute NAME is VALUE
+  is:image           content is an image
+  mime:TYPE          content MIME type starts with TYPE
+  minwidth:N, maxwidth:N, minheight:N, maxheight:N
+                     image content dimensions, in pixels
+  minaspect:F, maxaspect:F
+                     image content width to height ratio
+`)
+}
+
+func (c *searchCmd) Examples() []string {
+	return []string{
+		`tag:taxes mime:application/pdf   (all PDFs tagged "taxes")`,
+		`-json 'title:"summer vacation" minaspect:2'`,
+	}
+}
+
+// A searchTerm is one term of a search expression.
+type searchTerm struct {
+	op    string // "" for a bare word, else the part before the first colon
+	attr  string // for op "attr"
+	value string
+}
+
+// imageTermParams maps the image constraint terms to the search
+// handler parameters implementing them.
+var imageTermParams = map[string]string{
+	"minwidth":  "minWidth",
+	"maxwidth":  "maxWidth",
+	"minheight": "minHeight",
+	"maxheight": "maxHeight",
+	"minaspect": "minAspect",
+	"maxaspect": "maxAspect",
+}
+
+// splitSearchExpr splits expr on spaces, except within double quotes.
+func splitSearchExpr(expr string) ([]string, error) {
+	var (
+		words  []string
+		word   []rune
+		quoted bool
+		inWord bool
+	)
+	for _, r := range expr {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case r == ' ' && !quoted:
+			if inWord {
+				words = append(words, string(word))
+			}
+			word, inWord = word[:0], false
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote in search expression")
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+func parseSearchExpr(expr string) ([]searchTerm, error) {
+	words, err := splitSearchExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	var terms []searchTerm
+	for _, w := range words {
+		i := strings.Index(w, ":")
+		if i < 0 {
+			terms = append(terms, searchTerm{value: w})
+			continue
+		}
+		t := searchTerm{op: w[:i], value: w[i+1:]}
+		switch t.op {
+		case "tag", "title", "mime":
+		case "attr":
+			j := strings.Index(t.value, ":")
+			if j <= 0 {
+				return nil, fmt.Errorf("invalid term %q; want attr:NAME:VALUE", w)
+			}
+			t.attr, t.value = t.value[:j], t.value[j+1:]
+		case "is":
+			if t.value != "image" {
+				return nil, fmt.Errorf("unsupported term %q", w)
+			}
+		default:
+			if _, ok := imageTermParams[t.op]; !ok {
+				return nil, fmt.Errorf("unknown search operator %q in %q", t.op, w)
+			}
+			if _, err := strconv.ParseFloat(t.value, 64); err != nil {
+				return nil, fmt.Errorf("invalid number in %q", w)
+			}
+		}
+		terms = append(terms, t)
+	}
+	if len(terms) == 0 {
+		return nil, errors.New("empty search expression")
+	}
+	return terms, nil
+}
+
+// isAttrTerm reports whether t can be answered by the search
+// handler's permanodeattr endpoint.
+func (t searchTerm) isAttrTerm() bool {
+	switch t.op {
+	case "", "tag", "title", "attr":
+		return true
+	}
+	return false
+}
+
+// serverQuery returns the search handler endpoint and parameters
+// used to fetch the candidate results for terms, signed by signer.
+// The first attribute term, if any, is done by the server; the rest
+// are filtered locally by match.
+func serverQuery(terms []searchTerm, signer string) (endpoint string, args url.Values) {
+	args = url.Values{}
+	for _, t := range terms {
+		if param, ok := imageTermParams[t.op]; ok {
+			args.Set(param, t.value)
+		}
+	}
+	for _, t := range terms {
+		if !t.isAttrTerm() {
+			continue
+		}
+		args.Set("signer", signer)
+		switch t.op {
+		case "":
+			args.Set("value", t.value)
+			args.Set("fuzzy", "true")
+		case "tag":
+			args.Set("attr", "tag")
+			args.Set("value", t.value)
+		case "title":
+			args.Set("attr", "title")
+			args.Set("value", t.value)
+			args.Set("fuzzy", "true")
+		case "attr":
+			args.Set("attr", t.attr)
+			args.Set("value", t.value)
+		}
+		return "permanodeattr", args
+	}
+	return "recent", args
+}
+
+// match reports whether the permanode pn, as described in meta,
+// matches t.
+func (t searchTerm) match(meta map[string]interface{}, pn string) bool {
+	attr := permanodeAttrs(meta, pn)
+	contains := func(s, sub string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+	switch t.op {
+	case "":
+		for _, vv := range attr {
+			for _, v := range vv {
+				if contains(v, t.value) {
+					return true
+				}
+			}
+		}
+		return false
+	case "tag":
+		for _, v := range attr["tag"] {
+			if v == t.value {
+				return true
+			}
+		}
+		return false
+	case "title":
+		for _, v := range attr["title"] {
+			if contains(v, t.value) {
+				return true
+			}
+		}
+		return false
+	case "attr":
+		for _, v := range attr[t.attr] {
+			if v == t.value {
+				return true
+			}
+		}
+		return false
+	case "is":
+		return strings.HasPrefix(contentMIMEType(meta, attr), "image/")
+	case "mime":
+		return strings.HasPrefix(contentMIMEType(meta, attr), t.value)
+	}
+	// Image dimension terms are done by the server.
+	return true
+}
+
+// permanodeAttrs returns the attributes of pn in the search
+// response's meta, or nil.
+func permanodeAttrs(meta map[string]interface{}, pn string) map[string][]string {
+	des, _ := meta[pn].(map[string]interface{})
+	pnm, _ := des["permanode"].(map[string]interface{})
+	am, _ := pnm["attr"].(map[string]interface{})
+	attr := make(map[string][]string)
+	for k, v := range am {
+		vl, _ := v.([]interface{})
+		for _, s := range vl {
+			if s, ok := s.(string); ok {
+				attr[k] = append(attr[k], s)
+			}
+		}
+	}
+	return attr
+}
+
+// contentMIMEType returns the MIME type of the file that is the
+// camliContent of a permanode with attributes attr, or "".
+func contentMIMEType(meta map[string]interface{}, attr map[string][]string) string {
+	cc := attr["camliContent"]
+	if len(cc) == 0 {
+		return ""
+	}
+	des, _ := meta[cc[len(cc)-1]].(map[string]interface{})
+	file, _ := des["file"].(map[string]interface{})
+	mime, _ := file["mimeType"].(string)
+	return mime
+}
+
+func (c *searchCmd) RunCommand(args []string) error {
+	if len(args) == 0 {
+		return UsageError("search requires an expression")
+	}
+	terms, err := parseSearchExpr(strings.Join(args, " "))
+	if err != nil {
+		return UsageError(err.Error())
+	}
+
+	cl := newClient()
+	signer := cl.SignerPublicKeyBlobref()
+	if signer == nil {
+		return errors.New("no public key configured; needed to search the signer's permanodes")
+	}
+	endpoint, qargs := serverQuery(terms, signer.String())
+	if c.max > 0 {
+		qargs.Set("max", strconv.Itoa(c.max))
+	}
+	res, err := cl.QuerySearch(endpoint, qargs)
+	if err != nil {
+		return err
+	}
+	meta, _ := res["meta"].(map[string]interface{})
+
+	var candidates []string
+	switch endpoint {
+	case "permanodeattr":
+		list, _ := res["withAttr"].([]interface{})
+		for _, v := range list {
+			m, _ := v.(map[string]interface{})
+			if pn, ok := m["permanode"].(string); ok {
+				candidates = append(candidates, pn)
+			}
+		}
+	case "recent":
+		list, _ := res["recent"].([]interface{})
+		for _, v := range list {
+			m, _ := v.(map[string]interface{})
+			if pn, ok := m["blobref"].(string); ok {
+				candidates = append(candidates, pn)
+			}
+		}
+	}
+
+	var results []string
+Candidates:
+	for _, pn := range candidates {
+		for _, t := range terms {
+			if !t.match(meta, pn) {
+				continue Candidates
+			}
+		}
+		results = append(results, pn)
+	}
+
+	if !c.json {
+		for _, pn := range results {
+			fmt.Fprintln(stdout, pn)
+		}
+		return nil
+	}
+	described := make([]interface{}, 0, len(results))
+	for _, pn := range results {
+		described = append(described, meta[pn])
+	}
+	out, err := json.MarshalIndent(described, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s\n", out)
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSearchExpr(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    []searchTerm
+		wantErr bool
+	}{
+		{expr: "tag:taxes mime:application/pdf", want: []searchTerm{
+			{op: "tag", value: "taxes"},
+			{op: "mime", value: "application/pdf"},
+		}},
+		{expr: `title:"summer vacation"  minaspect:2`, want: []searchTerm{
+			{op: "title", value: "summer vacation"},
+			{op: "minaspect", value: "2"},
+		}},
+		{expr: "attr:camliRoot:home foo", want: []searchTerm{
+			{op: "attr", attr: "camliRoot", value: "home"},
+			{value: "foo"},
+		}},
+		{expr: "", wantErr: true},
+		{expr: `title:"oops`, wantErr: true},
+		{expr: "attr:novalue", wantErr: true},
+		{expr: "is:video", wantErr: true},
+		{expr: "minwidth:big", wantErr: true},
+		{expr: "bogus:x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSearchExpr(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSearchExpr(%q) error = %v; want error: %v", tt.expr, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSearchExpr(%q) = %+v; want %+v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestSearchTermMatch(t *testing.T) {
+	meta := map[string]interface{}{
+		"sha1-pn": map[string]interface{}{
+			"permanode": map[string]interface{}{
+				"attr": map[string]interface{}{
+					"tag":          []interface{}{"taxes", "2012"},
+					"title":        []interface{}{"Tax Return"},
+					"camliContent": []interface{}{"sha1-file"},
+				},
+			},
+		},
+		"sha1-file": map[string]interface{}{
+			"file": map[string]interface{}{"mimeType": "application/pdf"},
+		},
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"tag:taxes mime:application/pdf", true},
+		{"tag:tax", false},
+		{"title:return", true},
+		{"is:image", false},
+		{"2012", true},
+		{"attr:tag:2012", true},
+	}
+	for _, tt := range tests {
+		terms, err := parseSearchExpr(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := true
+		for _, term := range terms {
+			got = got && term.match(meta, "sha1-pn")
+		}
+		if got != tt.want {
+			t.Errorf("%q matched = %v; want %v", tt.expr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+)
+
+type syncCmd struct {
+	src       string
+	dest      string
+	removeSrc bool
+	loop      bool
+	verify    bool
+	sample    float64 // fraction of the common blobs checked by -verify
+}
+
+func init() {
+	RegisterCommand("sync", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(syncCmd)
+		flags.StringVar(&cmd.src, "src", "", "Source blobserver prefix (generally a mirrored queue partition). Defaults to the configured server.")
+		flags.StringVar(&cmd.dest, "dest", "", "Destination blobserver, or 'stdout' to just enumerate the -src blobs to stdout.")
+		flags.BoolVar(&cmd.removeSrc, "removesrc", false, "Remove each blob from the source after syncing to the destination; for queue processing.")
+		flags.BoolVar(&cmd.loop, "loop", false, "Sync in a loop once done; requires -removesrc.")
+		flags.BoolVar(&cmd.verify, "verify", false, "Instead of copying, compare the source and destination: their blob listings, and the contents of the blobs both list, refetched from both sides and hashed, to find silent corruption in either store.")
+		flags.Float64Var(&cmd.sample, "sample", 1, "With -verify, the fraction of the blobs on both sides to refetch and hash, picked at random; 1 checks them all.")
+		return cmd
+	})
+}
+
+func (c *syncCmd) Usage() {
+	errf(`Usage: camtool [globalopts] sync [syncopts]
+
+Copies the blobs of the source blobserver missing from the destination.
+With -verify, checks the blobs of both instead, reporting each problem
+found on a line of its own.
+`)
+}
+
+func (c *syncCmd) Examples() []string {
+	return []string{
+		"-dest=http://backup:3179/bs",
+		"-src=http://localhost:3179/sto-sync-queue/ -dest=http://backup:3179/bs -removesrc -loop",
+		"-dest=http://backup:3179/bs -verify -sample=0.05",
+	}
+}
+
+type SyncStats struct {
+	BlobsCopied int
+	BytesCopied int64
+	ErrorCount  int
+}
+
+func (c *syncCmd) RunCommand(args []string) error {
+	if len(args) != 0 {
+		return UsageError("sync takes no arguments")
+	}
+	if c.dest == "" {
+		return UsageError("No -dest specified.")
+	}
+	if c.loop && !c.removeSrc {
+		return UsageError("Can't use -loop without -removesrc")
+	}
+	if c.verify && (c.removeSrc || c.loop || c.dest == "stdout") {
+		return UsageError("Can't use -verify with -removesrc, -loop or -dest=stdout")
+	}
+	if c.sample <= 0 || c.sample > 1 {
+		return UsageError("-sample must be more than 0, and at most 1")
+	}
+
+	sc := c.client(c.src)
+	dc := c.client(c.dest)
+	if c.verify {
+		stats, err := c.doVerify(sc, dc)
+		fmt.Fprintf(stdout, "Checked %d of the %d blobs on both sides: %d corrupt on the source, %d on the destination, %d fetch errors. "+
+			"%d size mismatches, %d blobs missing from the destination, %d from the source.\n",
+			stats.Checked, stats.Common, stats.CorruptSrc, stats.CorruptDest, stats.FetchErrors,
+			stats.SizeMismatch, stats.OnlySrc, stats.OnlyDest)
+		if err != nil {
+			return fmt.Errorf("verify failed: %v", err)
+		}
+		if n := stats.problems(); n > 0 {
+			return fmt.Errorf("verify found %d problems", n)
+		}
+		return nil
+	}
+	passNum := 0
+	for {
+		passNum++
+		stats, err := c.doPass(sc, dc)
+		if *flagVerbose {
+			log.Printf("sync stats - pass: %d, blobs: %d, bytes %d\n", passNum, stats.BlobsCopied, stats.BytesCopied)
+		}
+		if err != nil {
+			return fmt.Errorf("sync failed: %v", err)
+		}
+		if !c.loop {
+			return nil
+		}
+	}
+}
+
+// client returns a client for the blobserver prefix server, or for
+// the configured server if it's empty.
+func (c *syncCmd) client(server string) *client.Client {
+	if server == "" {
+		return newClient()
+	}
+	cl := client.New(server)
+	if err := cl.SetupAuth(); err != nil {
+		log.Fatal(err)
+	}
+	if *flagVerbose {
+		cl.SetLogger(log.New(os.Stderr, "", 0))
+	}
+	return cl
+}
+
+func (c *syncCmd) doPass(sc, dc *client.Client) (stats SyncStats, retErr error) {
+	srcBlobs := make(chan blobref.SizedBlobRef, 100)
+	destBlobs := make(chan blobref.SizedBlobRef, 100)
+	srcErr := make(chan error)
+	destErr := make(chan error)
+
+	go func() {
+		srcErr <- sc.SimpleEnumerateBlobs(srcBlobs)
+	}()
+	checkSourceError := func() {
+		if err := <-srcErr; err != nil {
+			retErr = fmt.Errorf("Enumerate error from source: %v", err)
+		}
+	}
+
+	if c.dest == "stdout" {
+		for sb := range srcBlobs {
+			fmt.Fprintf(stdout, "%s %d\n", sb.BlobRef, sb.Size)
+		}
+		checkSourceError()
+		return
+	}
+
+	go func() {
+		destErr <- dc.SimpleEnumerateBlobs(destBlobs)
+	}()
+	checkDestError := func() {
+		if err := <-destErr; err != nil {
+			retErr = fmt.Errorf("Enumerate error from destination: %v", err)
+		}
+	}
+
+	destNotHaveBlobs := make(chan blobref.SizedBlobRef)
+	sizeMismatch := make(chan *blobref.BlobRef)
+	readSrcBlobs := srcBlobs
+	if *flagVerbose {
+		readSrcBlobs = loggingBlobRefChannel(srcBlobs)
+	}
+	mismatches := []*blobref.BlobRef{}
+	go client.ListMissingDestinationBlobs(destNotHaveBlobs, sizeMismatch, readSrcBlobs, destBlobs)
+For:
+	for {
+		select {
+		case br := <-sizeMismatch:
+			// TODO(bradfitz): check both sides and repair, carefully.  For now, fail.
+			log.Printf("WARNING: blobref %v has differing sizes on source and dest", br)
+			stats.ErrorCount++
+			mismatches = append(mismatches, br)
+		case sb, ok := <-destNotHaveBlobs:
+			if !ok {
+				break For
+			}
+			if *flagVerbose {
+				log.Printf("Destination needs blob: %s", sb)
+			}
+
+			blobReader, size, err := sc.FetchStreaming(sb.BlobRef)
+			if err != nil {
+				stats.ErrorCount++
+				log.Printf("Error fetching %s: %v", sb.BlobRef, err)
+				continue
+			}
+			if size != sb.Size {
+				blobReader.Close()
+				stats.ErrorCount++
+				log.Printf("Source blobserver's enumerate size of %d for blob %s doesn't match its Get size of %d",
+					sb.Size, sb.BlobRef, size)
+				continue
+			}
+			uh := &client.UploadHandle{BlobRef: sb.BlobRef, Size: size, Contents: blobReader}
+			pr, err := dc.Upload(uh)
+			blobReader.Close()
+			if err != nil {
+				stats.ErrorCount++
+				log.Printf("Upload of %s to destination blobserver failed: %v", sb.BlobRef, err)
+				continue
+			}
+			if !pr.Skipped {
+				stats.BlobsCopied++
+				stats.BytesCopied += pr.Size
+			}
+			if c.removeSrc {
+				if err = sc.RemoveBlob(sb.BlobRef); err != nil {
+					stats.ErrorCount++
+					log.Printf("Failed to delete %s from source: %v", sb.BlobRef, err)
+				}
+			}
+		}
+	}
+
+	checkSourceError()
+	checkDestError()
+	if retErr == nil && stats.ErrorCount > 0 {
+		retErr = fmt.Errorf("%d errors during sync", stats.ErrorCount)
+	}
+	return stats, retErr
+}
+
+func loggingBlobRefChannel(ch <-chan blobref.SizedBlobRef) chan blobref.SizedBlobRef {
+	ch2 := make(chan blobref.SizedBlobRef)
+	go func() {
+		defer close(ch2)
+		var last time.Time
+		var nblob, nbyte int64
+		for v := range ch {
+			ch2 <- v
+			nblob++
+			nbyte += v.Size
+			now := time.Now()
+			if last.IsZero() || now.After(last.Add(1*time.Second)) {
+				last = now
+				log.Printf("At source blob %v (%d blobs, %d bytes)", v.BlobRef, nblob, nbyte)
+			}
+		}
+		log.Printf("Total blobs: %d, %d bytes", nblob, nbyte)
+	}()
+	return ch2
+}
+
+type reindexCmd struct {
+	index string
+}
+
+func init() {
+	RegisterCommand("reindex", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(reindexCmd)
+		flags.StringVar(&cmd.index, "index", "", "URL prefix of the server's index handler, such as http://localhost:3179/index-mem/.")
+		return cmd
+	})
+}
+
+func (c *reindexCmd) Usage() {
+	errf(`Usage: camtool [globalopts] reindex -index=<url>
+
+Sends the blobs of the configured server missing from its index to the
+index handler, such as after the index was wiped.
+`)
+}
+
+func (c *reindexCmd) RunCommand(args []string) error {
+	if len(args) != 0 {
+		return UsageError("reindex takes no arguments")
+	}
+	if c.index == "" || c.index == "stdout" {
+		return UsageError("No -index specified.")
+	}
+	sync := &syncCmd{dest: c.index}
+	stats, err := sync.doPass(newClient(), sync.client(c.index))
+	if err != nil {
+		return fmt.Errorf("reindex failed: %v", err)
+	}
+	fmt.Fprintf(stdout, "Reindexed %d blobs, %d bytes\n", stats.BlobsCopied, stats.BytesCopied)
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+)
+
+// verifyWorkers is how many blobs sync -verify checks at once.
+const verifyWorkers = 8
+
+// VerifyStats are the results of a sync -verify pass.
+type VerifyStats struct {
+	Common       int // blobs enumerated by both sides
+	Checked      int // of those, refetched and hashed on both sides
+	OnlySrc      int // missing from the destination
+	OnlyDest     int // missing from the source
+	SizeMismatch int
+	CorruptSrc   int
+	CorruptDest  int
+	FetchErrors  int
+}
+
+func (s VerifyStats) problems() int {
+	return s.OnlySrc + s.SizeMismatch + s.CorruptSrc + s.CorruptDest + s.FetchErrors
+}
+
+// countCheck counts and reports err, the result of checkBlob of sb on
+// the side named side.
+func countCheck(corrupt, fetchErrors *int, side string, sb blobref.SizedBlobRef, err error) {
+	switch err.(type) {
+	case nil:
+		return
+	case corruptBlobError:
+		*corrupt++
+		fmt.Fprintf(stdout, "CORRUPT %s %s: %v\n", side, sb.BlobRef, err)
+	default:
+		*fetchErrors++
+		fmt.Fprintf(stdout, "FETCH-ERROR %s %s: %v\n", side, sb.BlobRef, err)
+	}
+}
+
+// doVerify compares the blobs of sc and dc: their listings, and the
+// contents of a fraction c.sample of the blobs enumerated by both,
+// which are fetched from both sides and hashed. Problems are reported
+// to stdout, one per line.
+func (c *syncCmd) doVerify(sc, dc *client.Client) (stats VerifyStats, retErr error) {
+	srcBlobs := make(chan blobref.SizedBlobRef, 100)
+	destBlobs := make(chan blobref.SizedBlobRef, 100)
+	srcEnumErr := make(chan error, 1)
+	destEnumErr := make(chan error, 1)
+	go func() {
+		srcEnumErr <- sc.SimpleEnumerateBlobs(srcBlobs)
+	}()
+	go func() {
+		destEnumErr <- dc.SimpleEnumerateBlobs(destBlobs)
+	}()
+
+	// The workers only count what they check, and the loop below
+	// the rest.
+	var mu sync.Mutex // guards the workers' counts
+	var wg sync.WaitGroup
+	work := make(chan blobref.SizedBlobRef)
+	for i := 0; i < verifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sb := range work {
+				srcErr := checkBlob(sc, sb)
+				destErr := checkBlob(dc, sb)
+				mu.Lock()
+				stats.Checked++
+				countCheck(&stats.CorruptSrc, &stats.FetchErrors, "source", sb, srcErr)
+				countCheck(&stats.CorruptDest, &stats.FetchErrors, "destination", sb, destErr)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	src := &blobref.ChanPeeker{Ch: srcBlobs}
+	dst := &blobref.ChanPeeker{Ch: destBlobs}
+	for src.Peek() != nil || dst.Peek() != nil {
+		switch {
+		case dst.Peek() == nil || src.Peek() != nil && src.Peek().BlobRef.String() < dst.Peek().BlobRef.String():
+			sb := src.Take()
+			fmt.Fprintf(stdout, "MISSING destination %s\n", sb.BlobRef)
+			stats.OnlySrc++
+		case src.Peek() == nil || src.Peek().BlobRef.String() > dst.Peek().BlobRef.String():
+			db := dst.Take()
+			if *flagVerbose {
+				fmt.Fprintf(stdout, "MISSING source %s\n", db.BlobRef)
+			}
+			stats.OnlyDest++
+		default:
+			sb, db := src.Take(), dst.Take()
+			stats.Common++
+			if sb.Size != db.Size {
+				fmt.Fprintf(stdout, "SIZE-MISMATCH %s: %d bytes on source, %d on destination\n", sb.BlobRef, sb.Size, db.Size)
+				stats.SizeMismatch++
+				continue
+			}
+			if c.sample >= 1 || rand.Float64() < c.sample {
+				work <- *sb
+			}
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err := <-srcEnumErr; err != nil {
+		retErr = fmt.Errorf("Enumerate error from source: %v", err)
+	}
+	if err := <-destEnumErr; err != nil && retErr == nil {
+		retErr = fmt.Errorf("Enumerate error from destination: %v", err)
+	}
+	return stats, retErr
+}
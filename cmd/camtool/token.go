@@ -0,0 +1,89 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"camlistore.org/pkg/auth"
+)
+
+type tokenCmd struct {
+	file   string
+	role   string
+	revoke bool
+}
+
+func init() {
+	RegisterCommand("token", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(tokenCmd)
+		flags.StringVar(&cmd.file, "file", "tokens", "Tokens file, as named by the server config's \"tokens\" key.")
+		flags.StringVar(&cmd.role, "role", "", "Optional role of the token: read, readwrite or admin (the default).")
+		flags.BoolVar(&cmd.revoke, "revoke", false, "Revoke the named token instead of creating it.")
+		return cmd
+	})
+}
+
+func (c *tokenCmd) Usage() {
+	errf(`Usage: camtool [globalopts] token [tokenopts] <name>
+
+Creates an API token, replacing any of the same name, and prints it
+once; only its hash is kept in the tokens file. Clients present it with
+an auth string of "token:<token>". The server notices changes to the
+file, so -revoke takes effect within seconds.
+`)
+}
+
+func (c *tokenCmd) Examples() []string {
+	return []string{
+		"-role=readwrite phone",
+		"-revoke phone",
+	}
+}
+
+func (c *tokenCmd) RunCommand(args []string) error {
+	if len(args) != 1 {
+		return UsageError("token takes exactly one name")
+	}
+	name := args[0]
+	if name == "" || strings.Contains(name, ":") {
+		return errors.New("token name can't be empty or contain a colon")
+	}
+	file := auth.ConfigPath(c.file)
+	if c.revoke {
+		return setLine(file, name, "")
+	}
+	token, hash, err := auth.NewToken()
+	if err != nil {
+		return err
+	}
+	line := name + ":" + hash
+	if c.role != "" {
+		if _, err := auth.ParseRole(c.role); err != nil {
+			return err
+		}
+		line += ":role=" + c.role
+	}
+	if err := setLine(file, name, line); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s\n", token)
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+)
+
+type versionsCmd struct {
+	get  int
+	out  string
+	json bool
+}
+
+func init() {
+	RegisterCommand("versions", func(flags *flag.FlagSet) CommandRunner {
+		cmd := new(versionsCmd)
+		flags.IntVar(&cmd.get, "get", 0, "Fetch the contents of this version, numbered from 1 as listed, instead of listing the versions.")
+		flags.StringVar(&cmd.out, "o", "-", "With -get, the file to write the contents to, or - for stdout.")
+		flags.BoolVar(&cmd.json, "json", false, "Print the server's versions response as JSON.")
+		return cmd
+	})
+}
+
+func (c *versionsCmd) Usage() {
+	errf(`Usage: camtool [globalopts] versions [versionsopts] <permanode>
+
+Lists the versions of the permanode's content, oldest first: each
+camliContent it was given, with the date, and the size and name of
+files, as found by the server's index. With -get, fetches the
+contents of one of them.
+`)
+}
+
+func (c *versionsCmd) Examples() []string {
+	return []string{
+		"<permanode>",
+		"-get=2 -o=report-v2.txt <permanode>",
+	}
+}
+
+// A contentVersion is a version of the search handler's versions
+// response.
+type contentVersion struct {
+	Content   string `json:"content"`
+	Claim     string `json:"claim"`
+	Date      string `json:"date"`
+	CamliType string `json:"camliType"`
+	Size      int64  `json:"size"`
+	FileName  string `json:"fileName"`
+}
+
+func (c *versionsCmd) RunCommand(args []string) error {
+	if len(args) != 1 {
+		return UsageError("versions takes exactly one permanode")
+	}
+	pn := blobref.Parse(args[0])
+	if pn == nil {
+		return UsageError(fmt.Sprintf("invalid blobref %q", args[0]))
+	}
+	if c.get < 0 {
+		return UsageError("-get must be a version number, from 1")
+	}
+	cl := newClient()
+	res, err := cl.QuerySearch("versions", url.Values{"permanode": {pn.String()}})
+	if err != nil {
+		return err
+	}
+	if c.json && c.get == 0 {
+		out, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s\n", out)
+		return nil
+	}
+	// Round-tripping through JSON to get the versions typed.
+	b, err := json.Marshal(res["versions"])
+	if err != nil {
+		return err
+	}
+	var versions []contentVersion
+	if err := json.Unmarshal(b, &versions); err != nil {
+		return fmt.Errorf("invalid versions response: %v", err)
+	}
+	if c.get == 0 {
+		for i, v := range versions {
+			fmt.Fprintln(stdout, formatVersion(i+1, v))
+		}
+		return nil
+	}
+	if c.get > len(versions) {
+		return fmt.Errorf("permanode %v has %d versions; no version %d", pn, len(versions), c.get)
+	}
+	v := versions[c.get-1]
+	if v.CamliType != "file" {
+		return fmt.Errorf("version %d, %s, isn't a file; fetch it with camget", c.get, v.Content)
+	}
+	br := blobref.Parse(v.Content)
+	if br == nil {
+		return fmt.Errorf("invalid content blobref %q in versions response", v.Content)
+	}
+	fr, err := schema.NewFileReader(blobref.SeekerFromStreamingFetcher(cl), br)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	if c.out == "-" {
+		_, err = io.Copy(stdout, fr)
+	} else {
+		var f *os.File
+		f, err = os.Create(c.out)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, fr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("fetching version %d, %s: %v", c.get, v.Content, err)
+	}
+	return nil
+}
+
+// formatVersion returns the line listing v, the nth version.
+func formatVersion(n int, v contentVersion) string {
+	line := fmt.Sprintf("%3d %s %s", n, v.Date, v.Content)
+	switch v.CamliType {
+	case "file":
+		line += fmt.Sprintf(" %d bytes %q", v.Size, v.FileName)
+	case "":
+	default:
+		line += " " + v.CamliType
+	}
+	return line
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package acme obtains and renews TLS certificates from a certificate
+// authority speaking ACME (RFC 8555), such as Let's Encrypt, proving
+// control of the hostname with the HTTP-01 challenge.
+package acme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LetsEncryptURL is the directory of Let's Encrypt's production CA.
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// ChallengePath is the path prefix of the HTTP-01 challenge responses.
+const ChallengePath = "/.well-known/acme-challenge/"
+
+// pollInterval is how often an authorization or an order is checked
+// while the CA processes it.
+var pollInterval = 2 * time.Second
+
+const (
+	// pollTimeout is how long the CA may take to process one.
+	pollTimeout = 2 * time.Minute
+
+	// maxResponse limits the size of the CA's responses.
+	maxResponse = 1 << 20
+)
+
+// A Client talks to an ACME CA on behalf of the account of its key.
+type Client struct {
+	DirectoryURL string
+	Key          *ecdsa.PrivateKey // of the account; must be P-256
+	HTTPClient   *http.Client      // or nil for http.DefaultClient
+
+	dir   *directory
+	kid   string // account URL, once registered
+	nonce string // next nonce to use, or empty
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// An Error is a problem document returned by the CA.
+type Error struct {
+	Status int
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("acme: %d %s: %s", e.Status, e.Type, e.Detail)
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *Error   `json:"error"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+	Error  *Error `json:"error"`
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) discover() error {
+	if c.dir != nil {
+		return nil
+	}
+	res, err := c.httpClient().Get(c.DirectoryURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme: fetching directory %s: %v", c.DirectoryURL, res.Status)
+	}
+	dir := new(directory)
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxResponse)).Decode(dir); err != nil {
+		return fmt.Errorf("acme: decoding directory: %v", err)
+	}
+	if dir.NewNonce == "" || dir.NewAccount == "" || dir.NewOrder == "" {
+		return errors.New("acme: incomplete directory")
+	}
+	c.dir = dir
+	return nil
+}
+
+func (c *Client) fetchNonce() (string, error) {
+	if n := c.nonce; n != "" {
+		c.nonce = ""
+		return n, nil
+	}
+	res, err := c.httpClient().Head(c.dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	n := res.Header.Get("Replay-Nonce")
+	if n == "" {
+		return "", errors.New("acme: no nonce from the CA")
+	}
+	return n, nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwk returns the JSON Web Key of the account's public key, with its
+// members in the order of its thumbprint (RFC 7638).
+func (c *Client) jwk() string {
+	pub := c.Key.PublicKey
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		b64(pad32(pub.X)), b64(pad32(pub.Y)))
+}
+
+func pad32(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) >= 32 {
+		return b
+	}
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// KeyAuthorization returns the response to the HTTP-01 challenge of
+// token.
+func (c *Client) KeyAuthorization(token string) string {
+	sum := sha256.Sum256([]byte(c.jwk()))
+	return token + "." + b64(sum[:])
+}
+
+// post sends payload, or a POST-as-GET if payload is nil, to url
+// signed by the account key, and decodes the JSON response into v if
+// not nil. It retries once if the CA rejects the nonce.
+func (c *Client) post(url string, payload interface{}, v interface{}) (*http.Response, []byte, error) {
+	for retry := 0; ; retry++ {
+		res, body, err := c.postOnce(url, payload)
+		if e, ok := err.(*Error); ok && e.Type == "urn:ietf:params:acme:error:badNonce" && retry == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if v != nil {
+			if err := json.Unmarshal(body, v); err != nil {
+				return nil, nil, fmt.Errorf("acme: decoding response of %s: %v", url, err)
+			}
+		}
+		return res, body, nil
+	}
+}
+
+func (c *Client) postOnce(url string, payload interface{}) (*http.Response, []byte, error) {
+	nonce, err := c.fetchNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	var key string
+	if c.kid != "" {
+		key = fmt.Sprintf(`"kid":%q`, c.kid)
+	} else {
+		key = `"jwk":` + c.jwk()
+	}
+	protected := b64([]byte(fmt.Sprintf(`{"alg":"ES256",%s,"nonce":%q,"url":%q}`, key, nonce, url)))
+	var encPayload string
+	if payload != nil {
+		js, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		encPayload = b64(js)
+	}
+	sum := sha256.Sum256([]byte(protected + "." + encPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.Key, sum[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	sig := append(pad32(r), pad32(s)...)
+	jws, _ := json.Marshal(map[string]string{
+		"protected": protected,
+		"payload":   encPayload,
+		"signature": b64(sig),
+	})
+
+	res, err := c.httpClient().Post(url, "application/jose+json", bytes.NewReader(jws))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	c.nonce = res.Header.Get("Replay-Nonce")
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponse))
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode >= 400 {
+		e := &Error{Status: res.StatusCode}
+		if json.Unmarshal(body, e) != nil || e.Type == "" {
+			e.Detail = strings.TrimSpace(string(body))
+		}
+		return nil, nil, e
+	}
+	return res, body, nil
+}
+
+// Register finds or creates the account of the client's key, agreeing
+// to the CA's terms of service. email, if not empty, is the account's
+// contact.
+func (c *Client) Register(email string) error {
+	if err := c.discover(); err != nil {
+		return err
+	}
+	req := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		req["contact"] = []string{"mailto:" + email}
+	}
+	res, _, err := c.post(c.dir.NewAccount, req, nil)
+	if err != nil {
+		return err
+	}
+	c.kid = res.Header.Get("Location")
+	if c.kid == "" {
+		return errors.New("acme: no account URL from the CA")
+	}
+	return nil
+}
+
+// ObtainCertificate orders a certificate for hostname and key from
+// the CA, and returns its chain, leaf first, in DER. publish is called
+// with the path and the body of the HTTP-01 challenge responses to
+// serve on port 80 of hostname while the CA checks them. The client
+// must be registered.
+func (c *Client) ObtainCertificate(hostname string, key crypto.Signer, publish func(path, body string)) ([][]byte, error) {
+	if c.kid == "" {
+		return nil, errors.New("acme: client not registered")
+	}
+	o := new(order)
+	res, _, err := c.post(c.dir.NewOrder, map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": hostname}},
+	}, o)
+	if err != nil {
+		return nil, err
+	}
+	orderURL := res.Header.Get("Location")
+	for _, authzURL := range o.Authorizations {
+		if err := c.authorize(authzURL, publish); err != nil {
+			return nil, err
+		}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hostname},
+		DNSNames: []string{hostname},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := c.post(o.Finalize, map[string]string{"csr": b64(csr)}, o); err != nil {
+		return nil, err
+	}
+	for deadline := time.Now().Add(pollTimeout); o.Status != "valid"; {
+		switch {
+		case o.Status == "invalid":
+			return nil, fmt.Errorf("acme: order for %s is invalid: %v", hostname, o.Error)
+		case time.Now().After(deadline):
+			return nil, fmt.Errorf("acme: order for %s still %s", hostname, o.Status)
+		}
+		time.Sleep(pollInterval)
+		if _, _, err := c.post(orderURL, nil, o); err != nil {
+			return nil, err
+		}
+	}
+
+	_, body, err := c.post(o.Certificate, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var chain [][]byte
+	for {
+		var b *pem.Block
+		b, body = pem.Decode(body)
+		if b == nil {
+			break
+		}
+		if b.Type == "CERTIFICATE" {
+			chain = append(chain, b.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("acme: no certificate from the CA")
+	}
+	return chain, nil
+}
+
+// authorize completes the HTTP-01 challenge of the authorization at
+// authzURL, if it isn't valid yet.
+func (c *Client) authorize(authzURL string, publish func(path, body string)) error {
+	authz := new(authorization)
+	if _, _, err := c.post(authzURL, nil, authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	var chal *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return errors.New("acme: the CA offers no http-01 challenge")
+	}
+	path := ChallengePath + chal.Token
+	publish(path, c.KeyAuthorization(chal.Token))
+	defer publish(path, "")
+	if _, _, err := c.post(chal.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(pollTimeout); ; {
+		time.Sleep(pollInterval)
+		if _, _, err := c.post(authzURL, nil, authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			for _, ch := range authz.Challenges {
+				if ch.Error != nil {
+					return fmt.Errorf("acme: challenge failed: %v", ch.Error)
+				}
+			}
+			return fmt.Errorf("acme: authorization is %s", authz.Status)
+		}
+		if time.Now().After(deadline) {
+			return errors.New("acme: timeout waiting for the CA to check the challenge")
+		}
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCA is an ACME CA checking the JWS signatures, and the HTTP-01
+// challenge responses with the Manager's handler.
+type fakeCA struct {
+	t         *testing.T
+	srv       *httptest.Server
+	challenge http.Handler
+	caKey     *ecdsa.PrivateKey
+	caCert    *x509.Certificate
+
+	mu       sync.Mutex
+	nonces   int
+	jwk      string // of the account
+	validity time.Duration
+	issued   int
+	lastCert []byte // PEM
+	authzOK  bool
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	ca := &fakeCA{t: t, validity: 90 * 24 * time.Hour}
+	var err error
+	ca.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.caKey.PublicKey, ca.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.caCert, _ = x509.ParseCertificate(der)
+	ca.srv = httptest.NewServer(ca)
+	return ca
+}
+
+func (ca *fakeCA) url(path string) string { return ca.srv.URL + path }
+
+func (ca *fakeCA) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.nonces++
+	rw.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", ca.nonces))
+	if req.URL.Path == "/dir" {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"newNonce":   ca.url("/nonce"),
+			"newAccount": ca.url("/account"),
+			"newOrder":   ca.url("/order"),
+		})
+		return
+	}
+	if req.URL.Path == "/nonce" {
+		return
+	}
+	payload := ca.verify(req)
+	switch req.URL.Path {
+	case "/account":
+		rw.Header().Set("Location", ca.url("/account/1"))
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{"status":"valid"}`)
+	case "/order":
+		rw.Header().Set("Location", ca.url("/order/1"))
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(rw, `{"status":"pending","authorizations":[%q],"finalize":%q}`, ca.url("/authz"), ca.url("/finalize"))
+	case "/authz":
+		status := "pending"
+		if ca.authzOK {
+			status = "valid"
+		}
+		fmt.Fprintf(rw, `{"status":%q,"challenges":[{"type":"dns-01","url":"x","token":"dns"},{"type":"http-01","url":%q,"token":"tok"}]}`, status, ca.url("/chal"))
+	case "/chal":
+		rec := httptest.NewRecorder()
+		ca.challenge.ServeHTTP(rec, httptest.NewRequest("GET", ChallengePath+"tok", nil))
+		sum := sha256.Sum256([]byte(ca.jwk))
+		if want := "tok." + base64.RawURLEncoding.EncodeToString(sum[:]); rec.Body.String() != want {
+			ca.t.Errorf("challenge response = %q; want %q", rec.Body.String(), want)
+		} else {
+			ca.authzOK = true
+		}
+		fmt.Fprint(rw, `{"status":"processing"}`)
+	case "/finalize":
+		var m struct{ CSR string }
+		json.Unmarshal(payload, &m)
+		der, _ := base64.RawURLEncoding.DecodeString(m.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(rw, `{"type":"urn:ietf:params:acme:error:badCSR"}`, http.StatusBadRequest)
+			return
+		}
+		ca.issued++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(ca.issued + 1)),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(ca.validity),
+			DNSNames:     csr.DNSNames,
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, tmpl, ca.caCert, csr.PublicKey, ca.caKey)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ca.lastCert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+		fmt.Fprintf(rw, `{"status":"valid","certificate":%q}`, ca.url("/cert"))
+	case "/cert":
+		rw.Write(ca.lastCert)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// verify checks the JWS of req, and returns its payload.
+func (ca *fakeCA) verify(req *http.Request) []byte {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		ca.t.Errorf("%s: decoding JWS: %v", req.URL.Path, err)
+		return nil
+	}
+	prot, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var hdr struct {
+		Alg string
+		JWK json.RawMessage
+		Kid string
+		URL string
+	}
+	if err := json.Unmarshal(prot, &hdr); err != nil {
+		ca.t.Errorf("%s: decoding protected header: %v", req.URL.Path, err)
+		return nil
+	}
+	if hdr.URL != ca.url(req.URL.Path) {
+		ca.t.Errorf("%s: JWS url = %q", req.URL.Path, hdr.URL)
+	}
+	if hdr.JWK != nil {
+		ca.jwk = string(hdr.JWK)
+	} else if hdr.Kid != ca.url("/account/1") {
+		ca.t.Errorf("%s: JWS kid = %q", req.URL.Path, hdr.Kid)
+	}
+	var jwk struct{ X, Y string }
+	json.Unmarshal([]byte(ca.jwk), &jwk)
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	sum := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		ca.t.Errorf("%s: bad JWS signature", req.URL.Path)
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload
+}
+
+func TestManager(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Millisecond
+
+	ca := newFakeCA(t)
+	defer ca.srv.Close()
+	dir, err := ioutil.TempDir("", "camli-acme-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newManager := func() *Manager {
+		m := &Manager{Hostname: "camli.example.com", DirectoryURL: ca.url("/dir"), CacheDir: dir}
+		ca.mu.Lock()
+		ca.challenge = m.HTTPHandler(nil)
+		ca.mu.Unlock()
+		return m
+	}
+	m := newManager()
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "camli.example.com"})
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if got := cert.Leaf.DNSNames; len(got) != 1 || got[0] != "camli.example.com" {
+		t.Errorf("certificate names = %v", got)
+	}
+	if ca.issued != 1 {
+		t.Fatalf("issued %d certificates; want 1", ca.issued)
+	}
+
+	// Restarted, the manager uses the cached certificate.
+	m = newManager()
+	if err := m.Start(); err != nil {
+		t.Fatalf("restarted Start: %v", err)
+	}
+	if ca.issued != 1 {
+		t.Errorf("issued %d certificates after restarting; want 1", ca.issued)
+	}
+
+	// A certificate close to expiring is renewed, and the renewed one
+	// served.
+	ca.validity = renewBefore / 2
+	ca.authzOK = false
+	if err := m.renew(); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if !m.renewalDue() {
+		t.Errorf("short-lived certificate not due for renewal")
+	}
+	ca.validity = 90 * 24 * time.Hour
+	ca.authzOK = false
+	if err := m.renew(); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	renewed, _ := m.GetCertificate(nil)
+	if renewed.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 || m.renewalDue() {
+		t.Errorf("not serving the renewed certificate")
+	}
+}
+
+func TestHTTPHandlerRedirects(t *testing.T) {
+	m := &Manager{Hostname: "camli.example.com"}
+	rec := httptest.NewRecorder()
+	m.HTTPHandler(nil).ServeHTTP(rec, httptest.NewRequest("GET", "http://camli.example.com/ui/?x=1", nil))
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusMovedPermanently || !strings.HasPrefix(loc, "https://camli.example.com/ui/") {
+		t.Errorf("redirect = %d %q", rec.Code, loc)
+	}
+	rec = httptest.NewRecorder()
+	m.HTTPHandler(nil).ServeHTTP(rec, httptest.NewRequest("GET", ChallengePath+"unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown challenge = %d; want 404", rec.Code)
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// renewBefore is how long before its expiry a certificate is
+	// renewed.
+	renewBefore = 30 * 24 * time.Hour
+
+	// checkInterval is how often the certificate is checked for
+	// renewal, and how soon a failed renewal is retried.
+	checkInterval = 12 * time.Hour
+)
+
+// A Manager keeps a certificate for Hostname, obtained from the CA at
+// DirectoryURL and stored in CacheDir, serving it to TLS clients with
+// GetCertificate and renewing it before it expires.
+type Manager struct {
+	Hostname     string
+	Email        string // of the account, or empty
+	DirectoryURL string // or empty for LetsEncryptURL
+	CacheDir     string
+	HTTPClient   *http.Client // or nil for http.DefaultClient
+
+	mu         sync.Mutex
+	cert       *tls.Certificate
+	challenges map[string]string // path => HTTP-01 response
+	client     *Client
+}
+
+// Start loads the cached certificate, obtains one if it's missing or
+// due for renewal, and renews it in the background from then on. The
+// challenge handler must already be serving, on port 80 of Hostname.
+func (m *Manager) Start() error {
+	if m.Hostname == "" {
+		return errors.New("acme: no hostname")
+	}
+	if err := os.MkdirAll(m.CacheDir, 0700); err != nil {
+		return err
+	}
+	if cert, err := m.loadCert(); err == nil {
+		m.setCert(cert)
+	} else if !os.IsNotExist(err) {
+		log.Printf("acme: ignoring cached certificate of %s: %v", m.Hostname, err)
+	}
+	if m.renewalDue() {
+		if err := m.renew(); err != nil {
+			if m.currentCert() == nil {
+				return err
+			}
+			log.Printf("acme: renewing certificate of %s: %v", m.Hostname, err)
+		}
+	}
+	go m.renewLoop()
+	return nil
+}
+
+// GetCertificate returns the current certificate. It's meant for
+// tls.Config.GetCertificate, so a renewed certificate is served
+// without restarting.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := m.currentCert(); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("acme: no certificate for %s yet", m.Hostname)
+}
+
+// HTTPHandler returns a handler serving the HTTP-01 challenge
+// responses, and passing the other requests to fallback. A nil
+// fallback redirects them to HTTPS.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, ChallengePath) {
+			if fallback != nil {
+				fallback.ServeHTTP(rw, req)
+				return
+			}
+			u := *req.URL
+			u.Scheme = "https"
+			u.Host = m.Hostname
+			http.Redirect(rw, req, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		m.mu.Lock()
+		body, ok := m.challenges[req.URL.Path]
+		m.mu.Unlock()
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write([]byte(body))
+	})
+}
+
+func (m *Manager) publish(path, body string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.challenges == nil {
+		m.challenges = make(map[string]string)
+	}
+	if body == "" {
+		delete(m.challenges, path)
+	} else {
+		m.challenges[path] = body
+	}
+}
+
+func (m *Manager) currentCert() *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cert
+}
+
+func (m *Manager) setCert(cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cert = cert
+}
+
+func (m *Manager) renewalDue() bool {
+	cert := m.currentCert()
+	return cert == nil || time.Now().Add(renewBefore).After(cert.Leaf.NotAfter)
+}
+
+func (m *Manager) renewLoop() {
+	for {
+		time.Sleep(checkInterval)
+		if !m.renewalDue() {
+			continue
+		}
+		if err := m.renew(); err != nil {
+			log.Printf("acme: renewing certificate of %s: %v", m.Hostname, err)
+		}
+	}
+}
+
+// renew obtains a new certificate, with a new key, and stores and
+// serves it.
+func (m *Manager) renew() error {
+	client, err := m.registeredClient()
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	chain, err := client.ObtainCertificate(m.Hostname, key, m.publish)
+	if err != nil {
+		return err
+	}
+	cert, err := newCert(chain, key)
+	if err != nil {
+		return err
+	}
+	if err := m.storeCert(chain, key); err != nil {
+		return err
+	}
+	m.setCert(cert)
+	log.Printf("acme: obtained certificate of %s, valid until %v", m.Hostname, cert.Leaf.NotAfter)
+	return nil
+}
+
+func (m *Manager) registeredClient() (*Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	dirURL := m.DirectoryURL
+	if dirURL == "" {
+		dirURL = LetsEncryptURL
+	}
+	c := &Client{DirectoryURL: dirURL, Key: key, HTTPClient: m.HTTPClient}
+	if err := c.Register(m.Email); err != nil {
+		return nil, err
+	}
+	m.client = c
+	return c, nil
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.CacheDir, name)
+}
+
+// accountKey returns the cached account key, or a new one.
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	file := m.path("account.key")
+	if pemBytes, err := ioutil.ReadFile(file); err == nil {
+		return parseKey(pemBytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pemBytes, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(file, pemBytes, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *Manager) loadCert() (*tls.Certificate, error) {
+	pemBytes, err := ioutil.ReadFile(m.path(m.Hostname + ".crt"))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(m.path(m.Hostname + ".key"))
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	var chain [][]byte
+	for {
+		var b *pem.Block
+		b, pemBytes = pem.Decode(pemBytes)
+		if b == nil {
+			break
+		}
+		chain = append(chain, b.Bytes)
+	}
+	return newCert(chain, key)
+}
+
+func (m *Manager) storeCert(chain [][]byte, key *ecdsa.PrivateKey) error {
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := ioutil.WriteFile(m.path(m.Hostname+".key"), keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.path(m.Hostname+".crt"), certPEM, 0600)
+}
+
+func newCert(chain [][]byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("acme: empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.X.Cmp(key.X) != 0 || pub.Y.Cmp(key.Y) != 0 {
+		return nil, errors.New("acme: certificate doesn't match its key")
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseKey(pemBytes []byte) (*ecdsa.PrivateKey, error) {
+	b, _ := pem.Decode(pemBytes)
+	if b == nil || b.Type != "EC PRIVATE KEY" {
+		return nil, errors.New("acme: no EC private key")
+	}
+	return x509.ParseECPrivateKey(b.Bytes)
+}
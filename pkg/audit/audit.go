@@ -0,0 +1,369 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit keeps a tamper-evident log of the server's
+// security-relevant events.
+//
+// Each event is an "auditEntry" blob, written to storage dedicated to
+// the log, and holding the blobref of the entry before it: changing,
+// removing or inserting an entry breaks the chain, which Verify
+// checks. The "audit" handler, for admins, serves the entries and the
+// result of Verify.
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+// The events logged.
+const (
+	EventAuthFailure  = "authFailure"  // failed authentication
+	EventLockout      = "lockout"      // IP or account locked out
+	EventLogin        = "login"        // browser login
+	EventShare        = "share"        // share claim signed
+	EventDelete       = "delete"       // delete claim signed
+	EventRemove       = "remove"       // blobs removed
+	EventServerStart  = "serverStart"  // server started, with its config
+	EventRestart      = "restart"      // server restarting to reload its config
+	EventConfigChange = "configChange" // config file written
+	EventSignedURL    = "signedURL"    // signed blob URL minted
+)
+
+// An Entry is an event of the log, as stored in its blob.
+type Entry struct {
+	CamliVersion int    `json:"camliVersion"`
+	CamliType    string `json:"camliType"` // "auditEntry"
+	Seq          int    `json:"seq"`       // from 1
+	Prev         string `json:"prev,omitempty"`
+	Time         string `json:"time"` // RFC 3339
+	Event        string `json:"event"`
+	User         string `json:"user,omitempty"`
+	RemoteAddr   string `json:"remoteAddr,omitempty"`
+	Detail       string `json:"detail,omitempty"`
+	Suppressed   int    `json:"suppressed,omitempty"` // noisy events of this kind not logged before it
+}
+
+// The noisy events, those anyone can cause at will, are each logged at
+// most maxNoisy times per rateWindow. The next entry of an event
+// logged after some were suppressed counts them.
+var noisy = map[string]bool{
+	EventAuthFailure: true,
+	EventLockout:     true,
+}
+
+var rateWindow = time.Minute
+
+const maxNoisy = 30
+
+// An eventRate is the rate limit state of a noisy event.
+type eventRate struct {
+	start      time.Time // of the current window
+	n          int       // logged in the window
+	suppressed int       // since the last logged
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("audit", newHandlerFromConfig)
+	auth.SetAuditHooks(func(req *http.Request, user string) {
+		Log(req, EventAuthFailure, user, req.URL.Path)
+	}, func(req *http.Request, key string) {
+		Log(req, EventLockout, "", key)
+	})
+}
+
+// A Handler writes the audit log to its storage, and serves it.
+type Handler struct {
+	sto blobserver.Storage
+
+	mu   sync.Mutex
+	refs []*blobref.BlobRef // of the entries, by Seq-1; nil if missing
+	rate map[string]*eventRate
+}
+
+var (
+	logMu  sync.Mutex
+	logger *Handler // or nil, to not log
+)
+
+func newHandlerFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	storagePrefix := conf.RequiredString("storage")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	sto, err := ld.GetStorage(storagePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("audit handler's storage of %q error: %v", storagePrefix, err)
+	}
+	h, err := NewHandler(sto)
+	if err != nil {
+		return nil, err
+	}
+	logMu.Lock()
+	logger = h
+	logMu.Unlock()
+	return h, nil
+}
+
+// NewHandler returns the Handler of the log in sto, storage that
+// holds nothing else.
+func NewHandler(sto blobserver.Storage) (*Handler, error) {
+	h := &Handler{sto: sto}
+	after := ""
+	const batch = 1000
+	for {
+		ch := make(chan blobref.SizedBlobRef)
+		errch := make(chan error, 1)
+		go func() {
+			errch <- sto.EnumerateBlobs(ch, after, batch, 0)
+		}()
+		var got []*blobref.BlobRef
+		for sb := range ch {
+			got = append(got, sb.BlobRef)
+			after = sb.BlobRef.String()
+		}
+		if err := <-errch; err != nil {
+			return nil, err
+		}
+		for _, br := range got {
+			e, err := h.fetch(br)
+			if err != nil {
+				log.Printf("audit: ignoring %s: %v", br, err)
+				continue
+			}
+			for len(h.refs) < e.Seq {
+				h.refs = append(h.refs, nil)
+			}
+			if h.refs[e.Seq-1] != nil {
+				log.Printf("audit: ignoring %s, another entry %d", br, e.Seq)
+				continue
+			}
+			h.refs[e.Seq-1] = br
+		}
+		if len(got) < batch {
+			return h, nil
+		}
+	}
+}
+
+// fetch returns the entry of br, after checking br is the digest of
+// its blob.
+func (h *Handler) fetch(br *blobref.BlobRef) (*Entry, error) {
+	rc, _, err := h.sto.FetchStreaming(br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	blob, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	hash := br.Hash()
+	if hash == nil {
+		return nil, fmt.Errorf("unsupported digest")
+	}
+	hash.Write(blob)
+	if !br.HashMatches(hash) {
+		return nil, fmt.Errorf("content doesn't match digest")
+	}
+	e := new(Entry)
+	if err := json.Unmarshal(blob, e); err != nil {
+		return nil, err
+	}
+	if e.CamliType != "auditEntry" || e.Seq < 1 {
+		return nil, fmt.Errorf("not an audit entry")
+	}
+	return e, nil
+}
+
+// Log adds the event to the server's audit log, if it has an audit
+// handler. req, the request causing the event, may be nil. Errors
+// are only logged, so as not to fail what's being audited.
+func Log(req *http.Request, event, user, detail string) {
+	logMu.Lock()
+	h := logger
+	logMu.Unlock()
+	if h == nil {
+		return
+	}
+	h.Log(req, event, user, detail)
+}
+
+// Log adds the event to h, unless it's a noisy one over its rate
+// limit, as the package's Log.
+func (h *Handler) Log(req *http.Request, event, user, detail string) {
+	e := &Entry{Event: event, User: user, Detail: detail}
+	if noisy[event] {
+		var ok bool
+		if e.Suppressed, ok = h.allow(event); !ok {
+			return
+		}
+	}
+	if req != nil {
+		e.RemoteAddr = req.RemoteAddr
+	}
+	if err := h.Add(e); err != nil {
+		log.Printf("audit: logging %s event: %v", event, err)
+	}
+}
+
+// allow reports whether the noisy event may be logged now and, if so,
+// how many of it were suppressed since it last was.
+func (h *Handler) allow(event string) (suppressed int, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rate == nil {
+		h.rate = make(map[string]*eventRate)
+	}
+	r, ok := h.rate[event]
+	if !ok {
+		r = new(eventRate)
+		h.rate[event] = r
+	}
+	now := time.Now()
+	if now.Sub(r.start) >= rateWindow {
+		r.start, r.n = now, 0
+	}
+	if r.n >= maxNoisy {
+		r.suppressed++
+		return 0, false
+	}
+	r.n++
+	suppressed, r.suppressed = r.suppressed, 0
+	return suppressed, true
+}
+
+// Add sets e's chaining fields, and writes it as the log's next entry.
+func (h *Handler) Add(e *Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e.CamliVersion = 1
+	e.CamliType = "auditEntry"
+	e.Seq = len(h.refs) + 1
+	e.Prev = ""
+	if n := len(h.refs); n > 0 && h.refs[n-1] != nil {
+		e.Prev = h.refs[n-1].String()
+	}
+	if e.Time == "" {
+		e.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	blob, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	br := blobref.SHA1FromString(string(blob))
+	if _, err := h.sto.ReceiveBlob(br, bytes.NewReader(blob)); err != nil {
+		return err
+	}
+	h.refs = append(h.refs, br)
+	return nil
+}
+
+// Entries returns the entries after the after-th, at most limit.
+func (h *Handler) Entries(after, limit int) ([]*Entry, error) {
+	h.mu.Lock()
+	refs := h.refs
+	h.mu.Unlock()
+	if after < 0 {
+		after = 0
+	}
+	var entries []*Entry
+	for i := after; i < len(refs) && len(entries) < limit; i++ {
+		if refs[i] == nil {
+			return entries, fmt.Errorf("entry %d is missing", i+1)
+		}
+		e, err := h.fetch(refs[i])
+		if err != nil {
+			return entries, fmt.Errorf("entry %d, %s: %v", i+1, refs[i], err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Verify checks the chain of the log's entries, returning their
+// number and, if the chain is broken, why.
+func (h *Handler) Verify() (n int, err error) {
+	h.mu.Lock()
+	refs := h.refs
+	h.mu.Unlock()
+	for i, br := range refs {
+		if br == nil {
+			return len(refs), fmt.Errorf("entry %d is missing", i+1)
+		}
+		e, err := h.fetch(br)
+		if err != nil {
+			return len(refs), fmt.Errorf("entry %d, %s: %v", i+1, br, err)
+		}
+		want := ""
+		if i > 0 {
+			want = refs[i-1].String()
+		}
+		if e.Seq != i+1 || e.Prev != want {
+			return len(refs), fmt.Errorf("entry %d, %s, doesn't follow entry %d", i+1, br, i)
+		}
+	}
+	return len(refs), nil
+}
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// ServeHTTP serves, as JSON, the entries after the one numbered by
+// the "after" parameter, at most "limit", or, at "verify", the result
+// of Verify.
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ret := make(map[string]interface{})
+	switch req.Header.Get("X-PrefixHandler-PathSuffix") {
+	case "":
+		after, _ := strconv.Atoi(req.FormValue("after"))
+		limit, _ := strconv.Atoi(req.FormValue("limit"))
+		if limit <= 0 || limit > maxLimit {
+			limit = defaultLimit
+		}
+		entries, err := h.Entries(after, limit)
+		ret["entries"] = entries
+		if err != nil {
+			ret["error"] = err.Error()
+		}
+	case "verify":
+		n, err := h.Verify()
+		ret["entries"] = n
+		ret["verified"] = err == nil
+		if err != nil {
+			ret["error"] = err.Error()
+		}
+	default:
+		http.NotFound(rw, req)
+		return
+	}
+	httputil.ReturnJSON(rw, ret)
+}
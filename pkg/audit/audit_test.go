@@ -0,0 +1,159 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/audit"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver/localdisk"
+)
+
+// newHandler returns a Handler with an empty log, and the storage of
+// the log, to remove with cleanup.
+func newHandler(t *testing.T) (h *audit.Handler, sto *localdisk.DiskStorage, cleanup func()) {
+	dir, err := ioutil.TempDir("", "camli-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	sto, err = localdisk.New(dir)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	h, err = audit.NewHandler(sto)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return h, sto, cleanup
+}
+
+func TestChain(t *testing.T) {
+	h, sto, cleanup := newHandler(t)
+	defer cleanup()
+	const n = 5
+	for i := 0; i < n; i++ {
+		if err := h.Add(&audit.Entry{Event: audit.EventAuthFailure, User: fmt.Sprintf("user%d", i)}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if got, err := h.Verify(); got != n || err != nil {
+		t.Fatalf("Verify = %d, %v; want %d, nil", got, err, n)
+	}
+
+	// Reloaded from its storage, the log has the same entries.
+	h, err := audit.NewHandler(sto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := h.Entries(1, 2)
+	if err != nil {
+		t.Fatalf("Entries: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Seq != 2 || entries[1].User != "user2" {
+		t.Fatalf("Entries(1, 2) = %+v; want the 2nd and 3rd", entries)
+	}
+	if got, err := h.Verify(); got != n || err != nil {
+		t.Fatalf("reloaded Verify = %d, %v; want %d, nil", got, err, n)
+	}
+
+	// Replacing an entry breaks the chain.
+	second := entries[0]
+	if err := sto.RemoveBlobs([]*blobref.BlobRef{blobref.Parse(entries[1].Prev)}); err != nil {
+		t.Fatal(err)
+	}
+	second.User = "someone else"
+	blob, err := json.MarshalIndent(second, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sto.ReceiveBlob(blobref.SHA1FromString(string(blob)), bytes.NewReader(blob)); err != nil {
+		t.Fatal(err)
+	}
+	h, err = audit.NewHandler(sto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Verify(); err == nil {
+		t.Errorf("Verify succeeded with a replaced entry")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	defer audit.SetRateWindow(audit.SetRateWindow(50 * time.Millisecond))
+	h, _, cleanup := newHandler(t)
+	defer cleanup()
+	req, _ := http.NewRequest("GET", "http://example.com/bs/camli/stat", nil)
+	const extra = 5
+	for i := 0; i < audit.MaxNoisy+extra; i++ {
+		h.Log(req, audit.EventAuthFailure, fmt.Sprintf("user%d", i), "")
+	}
+	h.Log(req, audit.EventShare, "", "")
+	if n, _ := h.Verify(); n != audit.MaxNoisy+1 {
+		t.Fatalf("got %d entries; want the %d auth failures allowed and the share", n, audit.MaxNoisy)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	h.Log(req, audit.EventAuthFailure, "joe", "")
+	entries, err := h.Entries(audit.MaxNoisy+1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].User != "joe" || entries[0].Suppressed != extra {
+		t.Errorf("entry after the window = %+v; want joe's, with %d suppressed", entries, extra)
+	}
+}
+
+func TestServeEntries(t *testing.T) {
+	h, _, cleanup := newHandler(t)
+	defer cleanup()
+	for _, user := range []string{"alice", "bob"} {
+		if err := h.Add(&audit.Entry{Event: audit.EventLogin, User: user}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, after := range []string{"-1", "0", ""} {
+		req, _ := http.NewRequest("GET", "http://example.com/audit/?after="+after, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var ret struct {
+			Entries []audit.Entry `json:"entries"`
+			Error   string        `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&ret); err != nil {
+			t.Fatalf("after=%s: %v", after, err)
+		}
+		if rec.Code != 200 || ret.Error != "" || len(ret.Entries) != 2 || ret.Entries[0].User != "alice" {
+			t.Errorf("after=%s: %d, %+v; want both entries", after, rec.Code, ret)
+		}
+		if ct := rec.HeaderMap.Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+			t.Errorf("after=%s: Content-Type = %q", after, ct)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"sync"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// An ACLChecker decides which blobs the users with the "acl" option
+// may access.
+type ACLChecker interface {
+	// ACLAllows reports whether user may access br: read it if op
+	// is OpGet, or also change it, with claims, if op has OpSign.
+	ACLAllows(user string, br *blobref.BlobRef, op Operation) bool
+	// ACLCreated records that user had the new permanode br
+	// signed, so it may write it before linking it to what it's
+	// granted.
+	ACLCreated(user string, br *blobref.BlobRef)
+	// ACLMayLink reports whether user may link br, with a claim,
+	// to a permanode it writes, which would grant it br.
+	ACLMayLink(user string, br *blobref.BlobRef) bool
+}
+
+var (
+	aclMu      sync.RWMutex
+	aclChecker ACLChecker
+)
+
+// SetACLChecker sets the checker of the blob accesses of ACL users.
+// Until one is set, ACL users may not access any blob.
+func SetACLChecker(c ACLChecker) {
+	aclMu.Lock()
+	defer aclMu.Unlock()
+	aclChecker = c
+}
+
+// A restrictor is an AuthMode that may authenticate ACL users.
+type restrictor interface {
+	// aclUser returns the name of the ACL user req is
+	// authenticated as, if any.
+	aclUser(req *http.Request) (user string, ok bool)
+}
+
+func (up *UserPass) aclUser(req *http.Request) (string, bool) {
+	if !up.ACL {
+		return "", false
+	}
+	user, pass, err := basicAuth(req)
+	if err != nil || user != up.Username {
+		return "", false
+	}
+	if !up.passMatches(up.Password, pass) && (up.VivifyPass == "" || !up.passMatches(up.VivifyPass, pass)) {
+		return "", false
+	}
+	return user, true
+}
+
+func (u *Users) aclUser(req *http.Request) (string, bool) {
+	user, _, err := basicAuth(req)
+	if err != nil {
+		return "", false
+	}
+	up, ok := u.users[user]
+	if !ok {
+		return "", false
+	}
+	return up.aclUser(req)
+}
+
+// ACLUser returns the name of the ACL user req is authenticated as,
+// according to the auth mode of the request's path. Requests of ACL
+// users must only reach the blobs AllowedBlob allows.
+func ACLUser(req *http.Request) (user string, ok bool) {
+	r, isRestrictor := modeFor(req).(restrictor)
+	if !isRestrictor {
+		return "", false
+	}
+	return r.aclUser(req)
+}
+
+func currentACLChecker() ACLChecker {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+	return aclChecker
+}
+
+// AllowedBlob reports whether req may do op, OpGet or OpSign, on br.
+// The requests of users other than ACL users are always allowed:
+// Allowed is what checks them.
+func AllowedBlob(req *http.Request, br *blobref.BlobRef, op Operation) bool {
+	user, ok := ACLUser(req)
+	if !ok {
+		return true
+	}
+	c := currentACLChecker()
+	return c != nil && c.ACLAllows(user, br, op)
+}
+
+// AllowedLink reports whether req may link br to a permanode with a
+// claim. The requests of users other than ACL users are always
+// allowed.
+func AllowedLink(req *http.Request, br *blobref.BlobRef) bool {
+	user, ok := ACLUser(req)
+	if !ok {
+		return true
+	}
+	c := currentACLChecker()
+	return c != nil && c.ACLMayLink(user, br)
+}
+
+// ACLCreated records that req, if from an ACL user, had the new
+// permanode br signed.
+func ACLCreated(req *http.Request, br *blobref.BlobRef) {
+	user, ok := ACLUser(req)
+	if !ok {
+		return
+	}
+	if c := currentACLChecker(); c != nil {
+		c.ACLCreated(user, br)
+	}
+}
+
+// DenyACLUsers wraps handler to deny the requests of ACL users, for
+// the handlers that could reveal or change blobs they're not granted.
+func DenyACLUsers(handler func(conn http.ResponseWriter, req *http.Request)) func(conn http.ResponseWriter, req *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		if _, ok := ACLUser(req); ok {
+			conn.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler(conn, req)
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package auth
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"net"
@@ -25,8 +26,10 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 
 	"camlistore.org/pkg/netutil"
+	"camlistore.org/third_party/code.google.com/p/go.crypto/bcrypt"
 )
 
 // Operation represents a bitmask of operations. See the OpX constants.
@@ -45,10 +48,35 @@ const (
 	OpAll    = OpUpload | OpEnumerate | OpStat | OpRemove | OpGet | OpSign
 )
 
+// The operations allowed to users of each role.
+const (
+	RoleRead      = OpRead
+	RoleReadWrite = OpRW | OpSign
+	RoleAdmin     = OpAll
+)
+
+var roles = map[string]Operation{
+	"read":      RoleRead,
+	"readwrite": RoleReadWrite,
+	"admin":     RoleAdmin,
+}
+
+// ParseRole returns the operations allowed to the role named name:
+// "read", "readwrite" or "admin".
+func ParseRole(name string) (Operation, error) {
+	if ops, ok := roles[name]; ok {
+		return ops, nil
+	}
+	return 0, fmt.Errorf("Unknown role %q; want read, readwrite or admin", name)
+}
+
 var kBasicAuthPattern *regexp.Regexp = regexp.MustCompile(`^Basic ([a-zA-Z0-9\+/=]+)`)
 
 var (
 	mode AuthMode // the auth logic depending on the choosen auth mechanism
+
+	prefixMu    sync.RWMutex
+	prefixModes map[string]AuthMode // URL path prefix => mode overriding mode
 )
 
 type AuthMode interface {
@@ -66,49 +94,110 @@ func FromEnv() (AuthMode, error) {
 
 // FromConfig parses authConfig and accordingly sets up the AuthMode
 // that will be used for all upcoming authentication exchanges. The
-// supported modes are UserPass and DevAuth. UserPass requires an authConfig
-// of the kind "userpass:joe:ponies". If the CAMLI_ADVERTISED_PASSWORD
-// environment variable is defined, the mode will default to DevAuth.
+// supported modes are UserPass, Users, Token, OIDC, ClientCert and
+// DevAuth. UserPass requires an authConfig of the kind
+// "userpass:joe:ponies", where the password may be a bcrypt hash, as
+// made by HashPassword. Users, for several users with roles, requires
+// one of the kind "users:file", Token one of the kind "token:xxx", OIDC
+// "oidc", and ClientCert one of the kind "clientcert:ca-file". If the
+// CAMLI_ADVERTISED_PASSWORD environment variable is defined, the mode
+// will default to DevAuth.
 func FromConfig(authConfig string) (AuthMode, error) {
-	pieces := strings.Split(authConfig, ":")
-	if len(pieces) < 1 {
-		return nil, fmt.Errorf("Invalid auth string: %q", authConfig)
-	}
-	authType := pieces[0]
-
 	if pw := os.Getenv("CAMLI_ADVERTISED_PASSWORD"); pw != "" {
 		// the vivify mode password is automatically set to "vivi" + Password
 		mode = &DevAuth{pw, "vivi" + pw}
 		return mode, nil
 	}
+	am, err := NewMode(authConfig)
+	if err != nil {
+		return nil, err
+	}
+	mode = am
+	return mode, nil
+}
+
+// NewMode parses authConfig, in the syntax of FromConfig, and returns
+// the AuthMode it describes, without making it the server's auth mode.
+func NewMode(authConfig string) (AuthMode, error) {
+	pieces := strings.Split(authConfig, ":")
+	if len(pieces) < 1 {
+		return nil, fmt.Errorf("Invalid auth string: %q", authConfig)
+	}
+	authType := pieces[0]
 
 	switch authType {
 	case "none":
-		mode = None{}
+		return None{}, nil
 	case "localhost":
-		mode = Localhost{}
+		return Localhost{}, nil
+	case "oidc":
+		return OIDC{}, nil
+	case "clientcert":
+		return newClientCertMode(strings.TrimPrefix(authConfig, "clientcert:"))
+	case "users":
+		return NewUsersFromFile(strings.TrimPrefix(authConfig, "users:"))
+	case "token":
+		if len(pieces) != 2 || pieces[1] == "" {
+			return nil, fmt.Errorf("Wrong token auth string; needs to be \"token:xxx\"")
+		}
+		return Token(pieces[1]), nil
 	case "userpass":
 		if len(pieces) < 3 {
 			return nil, fmt.Errorf("Wrong userpass auth string; needs to be \"userpass:user:password\"")
 		}
-		username := pieces[1]
-		password := pieces[2]
-		mode = &UserPass{Username: username, Password: password}
+		up := &UserPass{Username: pieces[1], Password: pieces[2]}
 		for _, opt := range pieces[3:] {
 			switch {
 			case opt == "+localhost":
-				mode.(*UserPass).OrLocalhost = true
+				up.OrLocalhost = true
 			case strings.HasPrefix(opt, "vivify="):
 				// optional vivify mode password: "userpass:joe:ponies:vivify=rainbowdash"
-				mode.(*UserPass).VivifyPass = strings.Replace(opt, "vivify=", "", -1)
+				up.VivifyPass = strings.Replace(opt, "vivify=", "", -1)
+			case strings.HasPrefix(opt, "role="):
+				ops, err := ParseRole(strings.TrimPrefix(opt, "role="))
+				if err != nil {
+					return nil, err
+				}
+				up.Ops = ops
+			case opt == "acl":
+				up.ACL = true
 			default:
 				return nil, fmt.Errorf("Unknown userpass option %q", opt)
 			}
 		}
-	default:
-		return nil, fmt.Errorf("Unknown auth type: %q", authType)
+		if up.ACL {
+			if up.Ops == 0 {
+				up.Ops = RoleReadWrite
+			}
+			if up.Ops&^RoleReadWrite != 0 {
+				return nil, fmt.Errorf("An acl user can't have the admin role")
+			}
+		}
+		return up, nil
 	}
-	return mode, nil
+	return nil, fmt.Errorf("Unknown auth type: %q", authType)
+}
+
+// SetPrefixModes sets the auth modes overriding the server's for the
+// requests whose URL path starts with a prefix; the longest matching
+// prefix wins. It replaces any modes set before.
+func SetPrefixModes(m map[string]AuthMode) {
+	prefixMu.Lock()
+	defer prefixMu.Unlock()
+	prefixModes = m
+}
+
+// modeFor returns the auth mode that applies to req.
+func modeFor(req *http.Request) AuthMode {
+	prefixMu.RLock()
+	defer prefixMu.RUnlock()
+	am, best := mode, ""
+	for prefix, pm := range prefixModes {
+		if len(prefix) > len(best) && strings.HasPrefix(req.URL.Path, prefix) {
+			am, best = pm, prefix
+		}
+	}
+	return am
 }
 
 func basicAuth(req *http.Request) (string, string, error) {
@@ -137,14 +226,68 @@ func basicAuth(req *http.Request) (string, string, error) {
 // UserPass is used when the auth string provided in the config
 // is of the kind "userpass:username:pass"
 // Possible options appended to the config string are
-// "+localhost" and "vivify=pass", where pass will be the
-// alternative password which only allows the vivify operation.
+// "+localhost", "vivify=pass", where pass will be the
+// alternative password which only allows the vivify operation,
+// "role=name", limiting the user to the operations of a role, and
+// "acl", limiting the user to the blobs granted to it by ACL claims
+// (see SetACLChecker).
+// Either password may be a bcrypt hash, as made by HashPassword,
+// so the config doesn't hold it in the clear.
 type UserPass struct {
 	Username, Password string
 	OrLocalhost        bool // if true, allow localhost ident auth too
 	// Alternative password used (only) for the vivify operation.
 	// It is checked when uploading, but Password takes precedence.
 	VivifyPass string
+	// Ops are the operations allowed with Password. Zero means
+	// OpAll, or RoleReadWrite for an ACL user.
+	Ops Operation
+	// ACL is whether the user may only access the blobs granted
+	// to it by ACL claims.
+	ACL bool
+
+	mu      sync.Mutex
+	matched map[string][sha256.Size]byte // bcrypt hash => SHA-256 of its password
+}
+
+// bcryptPrefix starts the hashes made by HashPassword.
+const bcryptPrefix = "$2a$"
+
+// HashPassword returns the bcrypt hash of pass, for use as the
+// password of a "userpass" auth string.
+func HashPassword(pass string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// passMatches reports whether pass is the password want, which may be
+// a bcrypt hash. Checking a bcrypt hash is deliberately slow, so the
+// SHA-256 of the password last found to match each hash is kept, to
+// check the following requests with.
+func (up *UserPass) passMatches(want, pass string) bool {
+	if !strings.HasPrefix(want, bcryptPrefix) {
+		return pass == want
+	}
+	sum := sha256.Sum256([]byte(pass))
+	up.mu.Lock()
+	known, ok := up.matched[want]
+	up.mu.Unlock()
+	if ok && known == sum {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(want), []byte(pass)) != nil {
+		return false
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.matched == nil {
+		up.matched = make(map[string][sha256.Size]byte)
+	}
+	up.matched[want] = sum
+	return true
 }
 
 func (up *UserPass) AllowedAccess(req *http.Request) Operation {
@@ -156,17 +299,30 @@ func (up *UserPass) AllowedAccess(req *http.Request) Operation {
 	if err != nil {
 		return 0
 	}
+	return up.allowedAccess(user, pass)
+}
+
+func (up *UserPass) allowedAccess(user, pass string) Operation {
 	if user == up.Username {
-		if pass == up.Password {
-			return OpAll
+		if up.passMatches(up.Password, pass) {
+			if up.Ops == 0 {
+				return OpAll
+			}
+			return up.Ops
 		}
-		if pass == up.VivifyPass {
-			return OpVivify
+		if up.VivifyPass != "" && up.passMatches(up.VivifyPass, pass) {
+			if up.Ops == 0 {
+				return OpVivify
+			}
+			return OpVivify & up.Ops
 		}
 	}
 	return 0
 }
 
+// AddAuthHeader adds the username and password to req. A hashed
+// password is only of use in a server's config: the header then won't
+// authenticate.
 func (up *UserPass) AddAuthHeader(req *http.Request) {
 	req.SetBasicAuth(up.Username, up.Password)
 }
@@ -265,17 +421,50 @@ func IsLocalhost(req *http.Request) bool {
 	return localhostAuthorized(req)
 }
 
-// TODO(mpl): if/when we ever need it:
-// func AllowedWithAuth(am AuthMode, req *http.Request, op Operation) bool
-
 // Allowed returns whether the given request
-// has access to perform all the operations in op.
+// has access to perform all the operations in op, according to the
+// auth mode of the request's path.
 func Allowed(req *http.Request, op Operation) bool {
-	if op|OpUpload != 0 {
+	return AllowedWithAuth(modeFor(req), req, op)
+}
+
+// AllowedWithAuth returns whether the given request
+// has access to perform all the operations in op, according to am,
+// or, if am accepts them, to the server's API tokens. The requests of
+// IPs and accounts that too often failed to authenticate are denied
+// for a while.
+func AllowedWithAuth(am AuthMode, req *http.Request, op Operation) bool {
+	if op&OpUpload != 0 {
 		// upload (at least from camput) requires stat and get too
 		op = op | OpVivify
 	}
-	return mode.AllowedAccess(req)&op == op
+	if TriedAuthorization(req) && lockedOut(req) {
+		return false
+	}
+	allowed, tokenAllowed := am.AllowedAccess(req), Operation(0)
+	if acceptsTokens(am) {
+		tokenAllowed = tokenAccess(req)
+	}
+	if TriedAuthorization(req) {
+		if allowed == 0 && tokenAllowed == 0 {
+			noteFailure(req)
+		} else {
+			noteSuccess(req)
+		}
+	}
+	return allowed&op == op || tokenAllowed&op == op
+}
+
+// acceptsTokens reports whether the server's API tokens are honoured
+// along with am. They stand in for credentials, so not for the modes
+// requiring something else, such as being local or a client
+// certificate.
+func acceptsTokens(am AuthMode) bool {
+	switch am.(type) {
+	case *UserPass, *Users, *DevAuth, OIDC:
+		return true
+	}
+	return false
 }
 
 func TriedAuthorization(req *http.Request) bool {
@@ -298,6 +487,27 @@ type Handler struct {
 	http.Handler
 }
 
+// RoleHandler serves the requests that only read, with GET, HEAD,
+// OPTIONS or PROPFIND, if they're allowed ReadOp, and the others if
+// they're allowed WriteOp.
+type RoleHandler struct {
+	http.Handler
+	ReadOp, WriteOp Operation
+}
+
+func (h RoleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := h.WriteOp
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		op = h.ReadOp
+	}
+	if Allowed(r, op) {
+		h.Handler.ServeHTTP(w, r)
+	} else {
+		sendUnauthorizedTo(w, r)
+	}
+}
+
 // ServeHTTP serves only if this request and auth mode are allowed all Operations.
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.serveHTTPForOp(w, r, OpAll)
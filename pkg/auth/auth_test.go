@@ -0,0 +1,555 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+)
+
+func TestPrefixModes(t *testing.T) {
+	defer func(old AuthMode) { mode = old }(mode)
+	defer SetPrefixModes(nil)
+
+	mode = &UserPass{Username: "joe", Password: "ponies"}
+	admin, err := NewMode("userpass:admin:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetPrefixModes(map[string]AuthMode{
+		"/pub/":       None{},
+		"/ui/":        admin,
+		"/ui/public/": None{},
+	})
+	tests := []struct {
+		path       string
+		user, pass string
+		want       bool
+	}{
+		{"/bs/camli/sha1-abc", "joe", "ponies", true},
+		{"/bs/camli/sha1-abc", "admin", "secret", false},
+		{"/bs/camli/sha1-abc", "", "", false},
+		{"/pub/foo", "", "", true},
+		{"/ui/", "joe", "ponies", false},
+		{"/ui/", "admin", "secret", true},
+		{"/ui/public/x", "", "", true},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com"+tt.path, nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		if got := Allowed(req, OpGet); got != tt.want {
+			t.Errorf("Allowed(%s as %q) = %v; want %v", tt.path, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestNewMode(t *testing.T) {
+	am, err := NewMode("userpass:joe:ponies:+localhost:vivify=rainbow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, ok := am.(*UserPass)
+	if !ok || !up.OrLocalhost || up.VivifyPass != "rainbow" {
+		t.Errorf("NewMode = %#v", am)
+	}
+	if _, err := NewMode("bogus"); err == nil {
+		t.Errorf("NewMode of an unknown type succeeded")
+	}
+}
+
+func TestHashedUserPass(t *testing.T) {
+	hash, err := HashPassword("ponies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vivHash, err := HashPassword("rainbow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := NewMode("userpass:joe:" + hash + ":vivify=" + vivHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, pass string
+		want       Operation
+	}{
+		{"joe", "ponies", OpAll},
+		{"joe", "ponies", OpAll}, // remembered match
+		{"joe", "rainbow", OpVivify},
+		{"joe", hash, 0},
+		{"joe", "wrong", 0},
+		{"bob", "ponies", 0},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/bs/", nil)
+		req.SetBasicAuth(tt.user, tt.pass)
+		if got := am.AllowedAccess(req); got != tt.want {
+			t.Errorf("AllowedAccess(%q, %q) = %v; want %v", tt.user, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestUsersFile(t *testing.T) {
+	defer func(old AuthMode) { mode = old }(mode)
+	f, err := ioutil.TempFile("", "camli-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "# users\njoe:ponies\n\nalice:rainbow:role=read\nbob:sparkle:role=readwrite\n")
+	f.Close()
+
+	mode, err = NewMode("users:" + f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, user, pass string
+		op                 Operation
+		want               bool
+	}{
+		{"GET", "joe", "ponies", OpAll, true},
+		{"GET", "alice", "rainbow", OpGet, true},
+		{"GET", "alice", "rainbow", OpUpload, false},
+		{"GET", "alice", "ponies", OpGet, false},
+		{"GET", "bob", "sparkle", OpUpload | OpSign, true},
+		{"GET", "bob", "sparkle", OpRemove, false},
+		{"GET", "carol", "x", OpGet, false},
+		// With no vivify password, an empty one doesn't match it.
+		{"GET", "joe", "", OpVivify, false},
+		{"GET", "alice", "", OpGet, false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "http://example.com/bs/", nil)
+		req.SetBasicAuth(tt.user, tt.pass)
+		if got := Allowed(req, tt.op); got != tt.want {
+			t.Errorf("Allowed(%q, %v) = %v; want %v", tt.user, tt.op, got, tt.want)
+		}
+	}
+
+	h := RoleHandler{http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), RoleRead, RoleReadWrite}
+	for _, tt := range []struct {
+		method string
+		want   int
+	}{
+		{"GET", 200},
+		{"PROPFIND", 200},
+		{"POST", 401},
+	} {
+		req, _ := http.NewRequest(tt.method, "http://example.com/ui/", nil)
+		req.SetBasicAuth("alice", "rainbow")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("read-only %s = %d; want %d", tt.method, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	defer SetTokensFile("")
+	dir, err := ioutil.TempDir("", "camli-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens")
+	if err := SetTokensFile(file); err != nil {
+		t.Fatalf("SetTokensFile of a missing file: %v", err)
+	}
+	rw, rwHash, _ := NewToken()
+	ro, roHash, _ := NewToken()
+	writeTokens := func(s string) {
+		if err := ioutil.WriteFile(file, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Make the change noticed at once.
+		tokens.checked = time.Time{}
+		tokens.modTime = time.Time{}
+	}
+	writeTokens("script:" + rwHash + ":role=readwrite\nphone:" + roHash + ":role=read\n")
+
+	um, _ := NewMode("userpass:joe:ponies")
+	check := func(token string, op Operation, want bool) {
+		req, _ := http.NewRequest("GET", "http://example.com/bs/", nil)
+		if token != "" {
+			Token(token).AddAuthHeader(req)
+		}
+		if got := AllowedWithAuth(um, req, op); got != want {
+			t.Errorf("token %q, op %v: allowed = %v; want %v", token, op, got, want)
+		}
+	}
+	check(rw, OpUpload, true)
+	check(rw, OpRemove, false)
+	check(ro, OpGet, true)
+	check(ro, OpUpload, false)
+	check("bogus", OpGet, false)
+	check("", OpGet, false)
+
+	writeTokens("script:" + rwHash + ":role=readwrite\n")
+	check(rw, OpUpload, true)
+	check(ro, OpGet, false)
+}
+
+func TestTokensPrefixModes(t *testing.T) {
+	defer func(old AuthMode) { mode = old }(mode)
+	defer SetPrefixModes(nil)
+	defer SetTokensFile("")
+	dir, err := ioutil.TempDir("", "camli-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens")
+	token, hash, _ := NewToken()
+	if err := ioutil.WriteFile(file, []byte("script:"+hash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTokensFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	mode = &UserPass{Username: "joe", Password: "ponies"}
+	SetPrefixModes(map[string]AuthMode{
+		"/local/": Localhost{},
+		"/tok/":   Token("other"),
+	})
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/bs/camli/stat", true},
+		{"/local/camli/stat", false},
+		{"/tok/camli/stat", false},
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com"+tt.path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		Token(token).AddAuthHeader(req)
+		if got := Allowed(req, OpGet); got != tt.want {
+			t.Errorf("token on %s: allowed = %v; want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	newCert := func(cn string, isCA bool, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  isCA,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	ca, caKey := newCert("Family CA", true, nil, nil)
+	alice, _ := newCert("alice", false, ca, caKey)
+	bob, _ := newCert("bob", false, ca, caKey)
+	otherCA, otherKey := newCert("Other CA", true, nil, nil)
+	mallory, _ := newCert("alice", false, otherCA, otherKey)
+
+	dir, err := ioutil.TempDir("", "camli-clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	subjects := filepath.Join(dir, "subjects")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+	ioutil.WriteFile(subjects, []byte("alice:alice@example.com:role=read\n"), 0600)
+
+	am, err := NewMode("clientcert:" + caFile + ":subjects=" + subjects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ClientCAs() == nil {
+		t.Errorf("ClientCAs = nil after a clientcert mode")
+	}
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want Operation
+	}{
+		{"alice", alice, RoleRead},
+		{"bob", bob, 0},         // not in the subjects file
+		{"mallory", mallory, 0}, // of another CA
+		{"none", nil, 0},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "https://example.com/ui/", nil)
+		req.TLS = &tls.ConnectionState{}
+		if tt.cert != nil {
+			req.TLS.PeerCertificates = []*x509.Certificate{tt.cert}
+		}
+		if got := am.AllowedAccess(req); got != tt.want {
+			t.Errorf("AllowedAccess of %s = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+type testACL map[string]bool // "user blobref" => may access
+
+func (c testACL) ACLAllows(user string, br *blobref.BlobRef, op Operation) bool {
+	return c[user+" "+br.String()]
+}
+
+func (c testACL) ACLCreated(user string, br *blobref.BlobRef) {
+	c[user+" "+br.String()] = true
+}
+
+func (c testACL) ACLMayLink(user string, br *blobref.BlobRef) bool {
+	return c.ACLAllows(user, br, OpGet)
+}
+
+func TestACLUsers(t *testing.T) {
+	defer func(old AuthMode) { mode = old }(mode)
+	defer SetACLChecker(nil)
+	if _, err := NewMode("userpass:alice:secret:acl:role=admin"); err == nil {
+		t.Errorf("NewMode accepted an acl admin")
+	}
+	var err error
+	mode, err = NewMode("userpass:alice:secret:acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ops := mode.(*UserPass).Ops; ops != RoleReadWrite {
+		t.Errorf("acl user's Ops = %v; want %v", ops, RoleReadWrite)
+	}
+
+	granted := blobref.MustParse("sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33")
+	other := blobref.MustParse("sha1-62cdb7020ff920e5aa642c3d4066950dd1f01f4d")
+	req, _ := http.NewRequest("GET", "http://example.com/bs/camli/"+granted.String(), nil)
+	req.SetBasicAuth("alice", "secret")
+	if user, ok := ACLUser(req); !ok || user != "alice" {
+		t.Fatalf("ACLUser = %q, %v; want alice, true", user, ok)
+	}
+	if AllowedBlob(req, granted, OpGet) {
+		t.Errorf("ACL user allowed a blob with no ACL checker")
+	}
+
+	acl := testACL{"alice " + granted.String(): true}
+	SetACLChecker(acl)
+	if !AllowedBlob(req, granted, OpGet) || AllowedBlob(req, other, OpGet) {
+		t.Errorf("AllowedBlob of granted, other = %v, %v; want true, false",
+			AllowedBlob(req, granted, OpGet), AllowedBlob(req, other, OpGet))
+	}
+	ACLCreated(req, other)
+	if !AllowedBlob(req, other, OpSign) {
+		t.Errorf("ACL user not allowed the permanode it created")
+	}
+
+	wrong, _ := http.NewRequest("GET", "http://example.com/bs/camli/"+granted.String(), nil)
+	wrong.SetBasicAuth("alice", "wrong")
+	if _, ok := ACLUser(wrong); ok {
+		t.Errorf("ACLUser accepted a wrong password")
+	}
+	empty, _ := http.NewRequest("GET", "http://example.com/bs/camli/"+granted.String(), nil)
+	empty.SetBasicAuth("alice", "")
+	if _, ok := ACLUser(empty); ok {
+		t.Errorf("ACLUser accepted an empty password")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	defer func(old AuthMode) { mode = old }(mode)
+	defer func() { recentFailures = make(map[string]*failures) }()
+	mode = &UserPass{Username: "joe", Password: "ponies"}
+	attempt := func(user, pass, from string) bool {
+		req, _ := http.NewRequest("GET", "http://example.com/bs/camli/stat", nil)
+		req.RemoteAddr = from
+		req.SetBasicAuth(user, pass)
+		return Allowed(req, OpStat)
+	}
+
+	for i := 0; i < maxUserFailures; i++ {
+		if attempt("joe", "wrong", fmt.Sprintf("10.0.0.%d:1234", i)) {
+			t.Fatalf("wrong password allowed")
+		}
+	}
+	if attempt("joe", "ponies", "10.0.1.1:1234") {
+		t.Errorf("locked out account allowed")
+	}
+
+	for i := 0; i < maxIPFailures; i++ {
+		attempt(fmt.Sprintf("user%d", i), "wrong", "10.0.2.1:1234")
+	}
+	if attempt("joe", "ponies", "10.0.2.1:1234") {
+		t.Errorf("locked out IP allowed")
+	}
+
+	// Requests counted once, however often they're checked.
+	recentFailures = make(map[string]*failures)
+	req, _ := http.NewRequest("GET", "http://example.com/bs/camli/stat", nil)
+	req.RemoteAddr = "10.0.3.1:1234"
+	req.SetBasicAuth("joe", "wrong")
+	for i := 0; i < maxUserFailures; i++ {
+		Allowed(req, OpStat)
+	}
+	if !attempt("joe", "ponies", "10.0.3.2:1234") {
+		t.Errorf("right password denied after a single failed request")
+	}
+}
+
+func TestLockoutCap(t *testing.T) {
+	defer func(old AuthMode) { mode = old }(mode)
+	defer func(old int) { maxTracked = old }(maxTracked)
+	defer func() { recentFailures = make(map[string]*failures) }()
+	mode = &UserPass{Username: "joe", Password: "ponies"}
+	maxTracked = 10
+	audited := 0
+	SetAuditHooks(func(*http.Request, string) { audited++ }, nil)
+	defer SetAuditHooks(nil, nil)
+	fail := func(user, from string) {
+		req, _ := http.NewRequest("GET", "http://example.com/bs/camli/stat", nil)
+		req.RemoteAddr = from
+		req.SetBasicAuth(user, "wrong")
+		Allowed(req, OpStat)
+	}
+
+	for i := 0; i < 100; i++ {
+		fail(fmt.Sprintf("user%d", i), fmt.Sprintf("10.0.0.%d:1234", i))
+	}
+	if n := len(recentFailures); n > maxTracked {
+		t.Errorf("tracking %d IPs and accounts; want at most %d", n, maxTracked)
+	}
+	if audited != 100 {
+		t.Errorf("audited %d failures; want 100", audited)
+	}
+
+	// Locked out keys aren't evicted to make room.
+	recentFailures = make(map[string]*failures)
+	for i := 0; i < maxUserFailures; i++ {
+		fail("joe", "10.0.1.1:1234")
+	}
+	for i := 0; i < 100; i++ {
+		fail(fmt.Sprintf("user%d", i), fmt.Sprintf("10.0.2.%d:1234", i))
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/bs/camli/stat", nil)
+	req.RemoteAddr = "10.0.3.1:1234"
+	req.SetBasicAuth("joe", "ponies")
+	if Allowed(req, OpStat) {
+		t.Errorf("locked out account allowed after other failures filled the table")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	defer func(old AuthMode) { mode = old }(mode)
+	defer SetPrefixModes(nil)
+	defer SetTokensFile("")
+
+	mode = &UserPass{Username: "joe", Password: "ponies", OrLocalhost: true}
+	SetPrefixModes(map[string]AuthMode{"/pub/": None{}})
+	dir, err := ioutil.TempDir("", "camli-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := SetTokensFile(filepath.Join(dir, "tokens")); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://example.com"+DiscoveryPath, nil)
+	DiscoveryHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("status %d", rec.Code)
+	}
+	var d Discovery
+	if err := json.Unmarshal(rec.Body.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(d.Schemes), "[localhost token userpass]"; got != want {
+		t.Errorf("schemes = %s; want %s", got, want)
+	}
+	if got, want := fmt.Sprint(d.Prefixes["/pub/"]), "[none token]"; got != want {
+		t.Errorf("schemes of /pub/ = %s; want %s", got, want)
+	}
+	if d.TokenHelp == "" {
+		t.Errorf("no tokenHelp with a tokens file")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	defer SetReplayWindow(0)
+	req, _ := http.NewRequest("POST", "http://example.com/sig/camli/sig/sign", nil)
+	if err := CheckReplay(req); err != nil {
+		t.Fatalf("with replay protection off: %v", err)
+	}
+
+	SetReplayWindow(time.Minute)
+	if err := CheckReplay(req); err != errReplayStale {
+		t.Errorf("without timestamp: %v; want errReplayStale", err)
+	}
+	AddReplayHeaders(req)
+	if err := CheckReplay(req); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := CheckReplay(req); err != errReplayReused {
+		t.Errorf("replayed request: %v; want errReplayReused", err)
+	}
+	AddReplayHeaders(req)
+	if err := CheckReplay(req); err != nil {
+		t.Errorf("request with a new nonce: %v", err)
+	}
+	req.Header.Set(NonceHeader, "fresh")
+	req.Header.Set(TimestampHeader, fmt.Sprint(time.Now().Add(-2*time.Minute).Unix()))
+	if err := CheckReplay(req); err != errReplayStale {
+		t.Errorf("stale request: %v; want errReplayStale", err)
+	}
+	req.Header.Del(NonceHeader)
+	req.Header.Set(TimestampHeader, fmt.Sprint(time.Now().Unix()))
+	if err := CheckReplay(req); err != errReplayNonce {
+		t.Errorf("without nonce: %v; want errReplayNonce", err)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	clientCAsMu sync.Mutex
+	clientCAs   *x509.CertPool // of all ClientCert modes, or nil
+)
+
+// ClientCert is the auth mode of TLS client certificates signed by
+// its CAs. Its auth string is of the kind "clientcert:ca-file", or
+// "clientcert:ca-file:subjects=file", where each line of the subjects
+// file is of the kind "common-name:user[:role=name]", mapping the
+// subject common names of certificates to users. Without a subjects
+// file, any certificate of the CAs is allowed all operations, as the
+// user of its common name. Relative files are in the Camlistore
+// configuration directory.
+type ClientCert struct {
+	CAs *x509.CertPool
+	// Users maps the allowed certificates' subject common names to
+	// their users, or is nil to allow all certificates of CAs.
+	Users map[string]CertUser
+}
+
+// A CertUser is the user of a client certificate.
+type CertUser struct {
+	Name string
+	Ops  Operation
+}
+
+// ClientCAs returns the CAs of the client certificates the server's
+// auth modes accept, for its TLS config, or nil if none do.
+func ClientCAs() *x509.CertPool {
+	clientCAsMu.Lock()
+	defer clientCAsMu.Unlock()
+	return clientCAs
+}
+
+func newClientCertMode(config string) (*ClientCert, error) {
+	if config == "" {
+		return nil, errors.New("Wrong clientcert auth string; needs to be \"clientcert:ca-file[:subjects=file]\"")
+	}
+	caFile, subjectsFile := config, ""
+	if i := strings.Index(config, ":subjects="); i >= 0 {
+		caFile, subjectsFile = config[:i], config[i+len(":subjects="):]
+	}
+	pemBytes, err := ioutil.ReadFile(ConfigPath(caFile))
+	if err != nil {
+		return nil, err
+	}
+	cc := &ClientCert{CAs: x509.NewCertPool()}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", caFile, err)
+		}
+		certs = append(certs, cert)
+		cc.CAs.AddCert(cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no CA certificates", caFile)
+	}
+	if subjectsFile != "" {
+		if cc.Users, err = readCertSubjects(subjectsFile); err != nil {
+			return nil, err
+		}
+	}
+	clientCAsMu.Lock()
+	defer clientCAsMu.Unlock()
+	if clientCAs == nil {
+		clientCAs = x509.NewCertPool()
+	}
+	for _, cert := range certs {
+		clientCAs.AddCert(cert)
+	}
+	return cc, nil
+}
+
+func readCertSubjects(file string) (map[string]CertUser, error) {
+	f, err := os.Open(ConfigPath(file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]CertUser)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pieces := strings.Split(line, ":")
+		if len(pieces) < 2 || pieces[0] == "" || pieces[1] == "" {
+			return nil, fmt.Errorf("%s:%d: want \"common-name:user[:role=name]\"", file, n)
+		}
+		u := CertUser{Name: pieces[1], Ops: OpAll}
+		for _, opt := range pieces[2:] {
+			if !strings.HasPrefix(opt, "role=") {
+				return nil, fmt.Errorf("%s:%d: unknown option %q", file, n, opt)
+			}
+			if u.Ops, err = ParseRole(strings.TrimPrefix(opt, "role=")); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+			}
+		}
+		users[pieces[0]] = u
+	}
+	return users, sc.Err()
+}
+
+// User returns the user of req's client certificate, if it has one
+// signed by the CAs and allowed.
+func (cc *ClientCert) User(req *http.Request) (CertUser, bool) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return CertUser{}, false
+	}
+	leaf := req.TLS.PeerCertificates[0]
+	inter := x509.NewCertPool()
+	for _, c := range req.TLS.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         cc.CAs,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return CertUser{}, false
+	}
+	cn := leaf.Subject.CommonName
+	if cc.Users == nil {
+		return CertUser{Name: cn, Ops: OpAll}, true
+	}
+	u, ok := cc.Users[cn]
+	return u, ok
+}
+
+func (cc *ClientCert) AllowedAccess(req *http.Request) Operation {
+	u, ok := cc.User(req)
+	if !ok {
+		return 0
+	}
+	return u.Ops
+}
+
+// AddAuthHeader does nothing: clients present certificates in the TLS
+// handshake.
+func (cc *ClientCert) AddAuthHeader(req *http.Request) {}
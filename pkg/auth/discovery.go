@@ -0,0 +1,131 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// DiscoveryPath is the well-known path where the server describes the
+// authentication it accepts, to anyone, so clients can pick a scheme
+// without being told.
+const DiscoveryPath = "/.well-known/camlistore-auth"
+
+// The schemes of a Discovery.
+const (
+	SchemeUserPass   = "userpass"   // HTTP basic auth
+	SchemeToken      = "token"      // "Authorization: Bearer" API token
+	SchemeClientCert = "clientcert" // TLS client certificate
+	SchemeOIDC       = "oidc"       // browser session from an OpenID Connect login
+	SchemeLocalhost  = "localhost"  // requests from the server's host
+	SchemeNone       = "none"       // no authentication needed
+)
+
+// Discovery describes the authentication a server accepts.
+type Discovery struct {
+	// Schemes are those the server's auth mode and API tokens
+	// accept.
+	Schemes []string `json:"schemes"`
+	// Prefixes are the schemes accepted by the prefixes whose auth
+	// differs from the server's, by prefix.
+	Prefixes map[string][]string `json:"prefixes,omitempty"`
+	// LoginURL is where browsers log in, if the server has an
+	// oidc handler.
+	LoginURL string `json:"loginURL,omitempty"`
+	// TokenHelp says how to get an API token, if the server has
+	// a tokens file.
+	TokenHelp string `json:"tokenHelp,omitempty"`
+}
+
+const tokenHelp = "API tokens are created by the server's owner, with \"camtool token\"."
+
+// Discover returns the description of the server's authentication.
+func Discover() *Discovery {
+	tokensMu.RLock()
+	haveTokens := tokens != nil
+	tokensMu.RUnlock()
+
+	d := &Discovery{Schemes: modeSchemes(mode, haveTokens)}
+	prefixMu.RLock()
+	for prefix, am := range prefixModes {
+		if d.Prefixes == nil {
+			d.Prefixes = make(map[string][]string)
+		}
+		d.Prefixes[prefix] = modeSchemes(am, haveTokens)
+	}
+	prefixMu.RUnlock()
+
+	sessionMu.RLock()
+	d.LoginURL = loginPath
+	sessionMu.RUnlock()
+	if haveTokens {
+		d.TokenHelp = tokenHelp
+	}
+	return d
+}
+
+// modeSchemes returns the schemes am accepts, and the API tokens too
+// if the server has some.
+func modeSchemes(am AuthMode, haveTokens bool) []string {
+	set := make(map[string]bool)
+	switch am := am.(type) {
+	case *UserPass:
+		set[SchemeUserPass] = true
+		if am.OrLocalhost {
+			set[SchemeLocalhost] = true
+		}
+	case *Users, *DevAuth:
+		set[SchemeUserPass] = true
+	case Token:
+		set[SchemeToken] = true
+	case *ClientCert:
+		set[SchemeClientCert] = true
+	case OIDC:
+		set[SchemeOIDC] = true
+	case Localhost:
+		set[SchemeLocalhost] = true
+	case None:
+		set[SchemeNone] = true
+	}
+	if haveTokens {
+		set[SchemeToken] = true
+	}
+	schemes := make([]string, 0, len(set))
+	for s := range set {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// DiscoveryHandler serves Discover's description as JSON, at
+// DiscoveryPath.
+func DiscoveryHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(rw, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.MarshalIndent(Discover(), "", "  ")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(b)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The lockout policy: a client IP or an account that fails to
+// authenticate maxFailures times within failureWindow is locked out
+// for lockoutTime, even with the right credentials.
+var (
+	maxIPFailures   = 20
+	maxUserFailures = 10
+	failureWindow   = 10 * time.Minute
+	lockoutTime     = 15 * time.Minute
+
+	// maxTracked is the most IPs and accounts with recent failures
+	// tracked. Past it, the expired ones are forgotten, then the
+	// oldest not locked out, since the accounts are the attacker's
+	// to choose.
+	maxTracked = 10000
+)
+
+// failures are the recent authentication failures of an IP or account.
+type failures struct {
+	n           int
+	first       time.Time     // of the n failures
+	lockedUntil time.Time     // or zero
+	lastReq     *http.Request // last failed request, not to count it twice
+}
+
+var (
+	failMu         sync.Mutex
+	recentFailures = make(map[string]*failures) // keyed by "ip:1.2.3.4" or "user:joe"
+)
+
+// The audit hooks, set by SetAuditHooks.
+var (
+	auditFailure func(req *http.Request, user string)
+	auditLockout func(req *http.Request, key string)
+)
+
+// SetAuditHooks sets the functions called, to log them to the audit
+// log, on a failed authentication, as user if any, and on the lockout
+// of an "ip:" or "user:" key. It's for package audit, which depends on
+// this one.
+func SetAuditHooks(failure func(req *http.Request, user string), lockout func(req *http.Request, key string)) {
+	failMu.Lock()
+	defer failMu.Unlock()
+	auditFailure, auditLockout = failure, lockout
+}
+
+// failureKeys returns the keys of the IP and, if any, the account of
+// req in recentFailures.
+func failureKeys(req *http.Request) (ipKey, userKey string) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	ipKey = "ip:" + ip
+	if user, _, err := basicAuth(req); err == nil && user != "" {
+		userKey = "user:" + user
+	}
+	return
+}
+
+// lockedOut reports whether req's IP or account is locked out.
+func lockedOut(req *http.Request) bool {
+	ipKey, userKey := failureKeys(req)
+	now := time.Now()
+	failMu.Lock()
+	defer failMu.Unlock()
+	for _, k := range []string{ipKey, userKey} {
+		if f, ok := recentFailures[k]; ok && now.Before(f.lockedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// noteFailure records that req failed to authenticate, locks out its
+// IP or account if they failed too often, and logs it.
+func noteFailure(req *http.Request) {
+	ipKey, userKey := failureKeys(req)
+	now := time.Now()
+	failMu.Lock()
+	defer failMu.Unlock()
+	counted := false
+	for _, k := range []string{ipKey, userKey} {
+		if k == "" {
+			continue
+		}
+		f, ok := recentFailures[k]
+		if !ok {
+			if !makeRoom(now) {
+				log.Printf("auth: not tracking failures of %s, tracking %d locked out IPs and accounts", k, len(recentFailures))
+				continue
+			}
+		}
+		if !ok || now.Sub(f.first) > failureWindow {
+			f = &failures{first: now}
+			recentFailures[k] = f
+		}
+		if f.lastReq == req {
+			continue
+		}
+		f.lastReq = req
+		f.n++
+		counted = true
+		max := maxIPFailures
+		if k == userKey {
+			max = maxUserFailures
+		}
+		if f.n >= max && now.After(f.lockedUntil) {
+			f.lockedUntil = now.Add(lockoutTime)
+			log.Printf("auth: locking out %s for %v after %d failed authentications", k, lockoutTime, f.n)
+			if auditLockout != nil {
+				auditLockout(req, k)
+			}
+		}
+	}
+	if !counted {
+		return
+	}
+	user := strings.TrimPrefix(userKey, "user:")
+	if user != "" {
+		log.Printf("auth: failed authentication as %s from %s, for %s", user, req.RemoteAddr, req.URL.Path)
+	} else {
+		log.Printf("auth: failed authentication from %s, for %s", req.RemoteAddr, req.URL.Path)
+	}
+	if auditFailure != nil {
+		auditFailure(req, user)
+	}
+}
+
+// makeRoom makes room, if needed, in recentFailures for another key,
+// and reports whether there is. failMu must be held.
+func makeRoom(now time.Time) bool {
+	if len(recentFailures) < maxTracked {
+		return true
+	}
+	var oldest string
+	for k, f := range recentFailures {
+		if now.Before(f.lockedUntil) {
+			continue
+		}
+		if now.Sub(f.first) > failureWindow {
+			delete(recentFailures, k)
+			continue
+		}
+		if oldest == "" || f.first.Before(recentFailures[oldest].first) {
+			oldest = k
+		}
+	}
+	if len(recentFailures) >= maxTracked && oldest != "" {
+		delete(recentFailures, oldest)
+	}
+	return len(recentFailures) < maxTracked
+}
+
+// noteSuccess forgets the failures of the account req authenticated
+// as. Those of its IP are kept, since an IP may try several accounts.
+func noteSuccess(req *http.Request) {
+	_, userKey := failureKeys(req)
+	if userKey == "" {
+		return
+	}
+	failMu.Lock()
+	defer failMu.Unlock()
+	if f, ok := recentFailures[userKey]; ok && time.Now().After(f.lockedUntil) {
+		delete(recentFailures, userKey)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionCookie is the name of the cookie of OIDC sessions.
+const sessionCookie = "camli_session"
+
+var (
+	sessionMu  sync.RWMutex
+	sessionKey []byte // signs session cookies
+	loginPath  string // where browsers log in, or ""
+)
+
+func init() {
+	sessionKey = make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		panic(err)
+	}
+}
+
+// OIDC is the auth mode of browsers logged in with an OpenID Connect
+// provider, by the "oidc" handler, which gives them a session cookie.
+// Its auth string is "oidc". API clients use tokens instead; see
+// Tokens.
+type OIDC struct{}
+
+func (OIDC) AllowedAccess(req *http.Request) Operation {
+	_, ops, ok := Session(req)
+	if !ok {
+		return 0
+	}
+	return ops
+}
+
+func (OIDC) AddAuthHeader(req *http.Request) {}
+
+// SetLoginPath sets where browsers without a session are sent to log
+// in, by the handlers requiring authentication.
+func SetLoginPath(path string) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	loginPath = path
+}
+
+// SetSessionKey sets the key signing session cookies, so the sessions
+// survive restarts. By default, the key is random.
+func SetSessionKey(key []byte) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	sessionKey = key
+}
+
+type session struct {
+	User    string    `json:"u"`
+	Ops     Operation `json:"o"`
+	Expires int64     `json:"e"`
+}
+
+func signSession(payload []byte) []byte {
+	sessionMu.RLock()
+	defer sessionMu.RUnlock()
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// SetSession gives the browser of rw a session cookie allowing user
+// ops until ttl from now.
+func SetSession(rw http.ResponseWriter, req *http.Request, user string, ops Operation, ttl time.Duration) {
+	payload, _ := json.Marshal(&session{User: user, Ops: ops, Expires: time.Now().Add(ttl).Unix()})
+	enc := base64.URLEncoding
+	http.SetCookie(rw, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    enc.EncodeToString(payload) + "." + enc.EncodeToString(signSession(payload)),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   isSecure(req),
+		HttpOnly: true,
+	})
+}
+
+// isSecure is httputil.IsSecure, which auth can't import: whether req
+// was made over HTTPS, directly or through a trusted proxy.
+func isSecure(req *http.Request) bool {
+	return req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// ClearSession ends the session of the browser of rw.
+func ClearSession(rw http.ResponseWriter) {
+	http.SetCookie(rw, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// Session returns the user and operations of req's session cookie, and
+// whether it has a valid one.
+func Session(req *http.Request) (user string, ops Operation, ok bool) {
+	c, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return
+	}
+	i := strings.Index(c.Value, ".")
+	if i < 0 {
+		return
+	}
+	enc := base64.URLEncoding
+	payload, err := enc.DecodeString(c.Value[:i])
+	if err != nil {
+		return
+	}
+	sig, err := enc.DecodeString(c.Value[i+1:])
+	if err != nil || !hmac.Equal(sig, signSession(payload)) {
+		return
+	}
+	var s session
+	if json.Unmarshal(payload, &s) != nil || time.Now().Unix() > s.Expires {
+		return
+	}
+	return s.User, s.Ops, true
+}
+
+// sendUnauthorizedTo is SendUnauthorized, except that it sends
+// browsers that may log in with OIDC to the login page.
+func sendUnauthorizedTo(w http.ResponseWriter, r *http.Request) {
+	sessionMu.RLock()
+	login := loginPath
+	sessionMu.RUnlock()
+	if _, ok := modeFor(r).(OIDC); ok && login != "" && r.Method == "GET" &&
+		strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, login+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	SendUnauthorized(w)
+}
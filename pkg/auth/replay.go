@@ -0,0 +1,111 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With replay protection on, the requests to the state-changing
+// endpoints, such as signing, must carry the time they were made, in
+// Unix seconds, and a nonce never sent before, so requests captured
+// on the way, such as by an untrusted proxy, can't be sent again.
+const (
+	TimestampHeader = "X-Camli-Timestamp"
+	NonceHeader     = "X-Camli-Nonce"
+)
+
+// maxNonceLen bounds the nonces remembered.
+const maxNonceLen = 128
+
+var (
+	errReplayStale  = errors.New("auth: request timestamp missing or outside the replay window")
+	errReplayNonce  = errors.New("auth: request nonce missing or too long")
+	errReplayReused = errors.New("auth: request nonce already used")
+)
+
+var (
+	replayMu     sync.Mutex
+	replayWindow time.Duration        // or zero, if off
+	nonces       map[string]time.Time // nonce => expiry
+	noncesPruned time.Time
+)
+
+// SetReplayWindow turns replay protection on, rejecting requests
+// whose timestamps are further than window from the server's clock,
+// or off, if window is zero.
+func SetReplayWindow(window time.Duration) {
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	replayWindow = window
+	nonces = make(map[string]time.Time)
+}
+
+// CheckReplay returns an error if replay protection is on and req is
+// stale, has no nonce, or has the nonce of an earlier request. The
+// nonces are remembered for as long as their request's timestamp is
+// in the window.
+func CheckReplay(req *http.Request) error {
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	if replayWindow == 0 {
+		return nil
+	}
+	now := time.Now()
+	secs, err := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return errReplayStale
+	}
+	ts := time.Unix(secs, 0)
+	if ts.Before(now.Add(-replayWindow)) || ts.After(now.Add(replayWindow)) {
+		return errReplayStale
+	}
+	nonce := req.Header.Get(NonceHeader)
+	if nonce == "" || len(nonce) > maxNonceLen {
+		return errReplayNonce
+	}
+	if now.Sub(noncesPruned) > replayWindow {
+		for n, exp := range nonces {
+			if now.After(exp) {
+				delete(nonces, n)
+			}
+		}
+		noncesPruned = now
+	}
+	if exp, ok := nonces[nonce]; ok && !now.After(exp) {
+		return errReplayReused
+	}
+	nonces[nonce] = ts.Add(replayWindow)
+	return nil
+}
+
+// AddReplayHeaders sets the timestamp and a new nonce of req, for
+// servers with replay protection on.
+func AddReplayHeaders(req *http.Request) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set(NonceHeader, hex.EncodeToString(b))
+}
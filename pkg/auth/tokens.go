@@ -0,0 +1,196 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokensRecheck is how often, at most, a tokens file is checked for
+// changes.
+const tokensRecheck = 2 * time.Second
+
+// Tokens are long-lived API tokens, each allowing the operations of a
+// role to the requests bearing it in an "Authorization: Bearer"
+// header. They're listed in a file, one per line, of the kind
+// "name:hash[:role=name]", where hash is the token's HashToken. The
+// file is reread when it changes, so removing a token's line revokes
+// it. Blank lines and lines starting with "#" are ignored.
+type Tokens struct {
+	file string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	ops     map[string]Operation // HashToken => allowed operations
+}
+
+var (
+	tokensMu sync.RWMutex
+	tokens   *Tokens // or nil
+)
+
+// SetTokensFile sets the server's API tokens to those of the tokens
+// file, relative to the configuration directory as for ConfigPath.
+// The file needn't exist yet. An empty file disables tokens.
+func SetTokensFile(file string) error {
+	var t *Tokens
+	if file != "" {
+		t = &Tokens{file: ConfigPath(file)}
+		if err := t.load(); err != nil {
+			return err
+		}
+	}
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	tokens = t
+	return nil
+}
+
+// NewToken returns a new random API token and its hash, for its line
+// of a tokens file.
+func NewToken() (token, hash string, err error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hex SHA-256 of token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// load rereads the file if it changed since it was last read.
+func (t *Tokens) load() error {
+	fi, err := os.Stat(t.file)
+	if os.IsNotExist(err) {
+		t.ops, t.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if t.ops != nil && fi.ModTime().Equal(t.modTime) {
+		return nil
+	}
+	f, err := os.Open(t.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ops := make(map[string]Operation)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pieces := strings.Split(line, ":")
+		if len(pieces) < 2 || len(pieces[1]) != sha256.Size*2 {
+			return fmt.Errorf("%s:%d: want \"name:hash[:role=name]\"", t.file, n)
+		}
+		op := OpAll
+		for _, opt := range pieces[2:] {
+			if !strings.HasPrefix(opt, "role=") {
+				return fmt.Errorf("%s:%d: unknown token option %q", t.file, n, opt)
+			}
+			if op, err = ParseRole(strings.TrimPrefix(opt, "role=")); err != nil {
+				return fmt.Errorf("%s:%d: %v", t.file, n, err)
+			}
+		}
+		ops[pieces[1]] = op
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	t.ops, t.modTime = ops, fi.ModTime()
+	return nil
+}
+
+// bearerToken returns the token of req's "Authorization: Bearer"
+// header, or "".
+func bearerToken(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[len("Bearer "):])
+}
+
+// AllowedAccess returns the operations allowed by req's token.
+func (t *Tokens) AllowedAccess(req *http.Request) Operation {
+	token := bearerToken(req)
+	if token == "" {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now := time.Now(); now.Sub(t.checked) > tokensRecheck {
+		t.checked = now
+		if err := t.load(); err != nil {
+			// Keep the tokens last loaded.
+			log.Printf("auth: reloading tokens: %v", err)
+		}
+	}
+	return t.ops[HashToken(token)]
+}
+
+// AddAuthHeader does nothing: the tokens are hashed.
+func (t *Tokens) AddAuthHeader(req *http.Request) {}
+
+// tokenAccess returns the operations the server's API tokens allow
+// req.
+func tokenAccess(req *http.Request) Operation {
+	tokensMu.RLock()
+	t := tokens
+	tokensMu.RUnlock()
+	if t == nil {
+		return 0
+	}
+	return t.AllowedAccess(req)
+}
+
+// Token is the client side of API tokens: the auth mode of an auth
+// string of the kind "token:xxx", sending the token with requests. As a
+// server's mode, it allows requests bearing the token.
+type Token string
+
+func (tok Token) AllowedAccess(req *http.Request) Operation {
+	if subtle.ConstantTimeCompare([]byte(bearerToken(req)), []byte(tok)) == 1 {
+		return OpAll
+	}
+	return 0
+}
+
+func (tok Token) AddAuthHeader(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+string(tok))
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"camlistore.org/pkg/osutil"
+)
+
+// Users is the auth mode of several users, each with its own password
+// and role. Its auth string is "users:file", where each line of file
+// is of the kind "username:pass[:options]", the rest of a "userpass"
+// auth string. Blank lines and lines starting with "#" are ignored.
+// A relative file is in the Camlistore configuration directory.
+type Users struct {
+	users map[string]*UserPass
+}
+
+// ConfigPath returns the path of a users or tokens file named in the
+// config: file itself if absolute, else file in the Camlistore
+// configuration directory.
+func ConfigPath(file string) string {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(osutil.CamliConfigDir(), file)
+	}
+	return file
+}
+
+// NewUsersFromFile returns the Users listed in file.
+func NewUsersFromFile(file string) (*Users, error) {
+	f, err := os.Open(ConfigPath(file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	u := &Users{users: make(map[string]*UserPass)}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		am, err := NewMode("userpass:" + line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		up := am.(*UserPass)
+		if up.OrLocalhost {
+			return nil, fmt.Errorf("%s:%d: +localhost isn't supported in a users file", file, n)
+		}
+		if _, dup := u.users[up.Username]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate user %q", file, n, up.Username)
+		}
+		u.users[up.Username] = up
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (u *Users) AllowedAccess(req *http.Request) Operation {
+	user, pass, err := basicAuth(req)
+	if err != nil {
+		return 0
+	}
+	up, ok := u.users[user]
+	if !ok {
+		return 0
+	}
+	return up.allowedAccess(user, pass)
+}
+
+// AddAuthHeader does nothing: a users file is only of use in a
+// server's config.
+func (u *Users) AddAuthHeader(req *http.Request) {}
@@ -18,7 +18,6 @@ package gethandler
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -28,6 +27,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 
@@ -36,6 +36,7 @@ import (
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/httputil"
 	"camlistore.org/pkg/misc/httprange" // TODO: delete this package, use http.ServeContent
+	"camlistore.org/pkg/schema"
 )
 
 var kGetPattern = regexp.MustCompile(`/camli/` + blobref.Pattern + `$`)
@@ -58,6 +59,34 @@ func CreateGetHandler(fetcher blobref.StreamingFetcher) func(http.ResponseWriter
 	}
 }
 
+// A ShareGuard is consulted by all Handlers on every blob access made
+// through a share, after the share and the path from it have been
+// validated.
+type ShareGuard interface {
+	// ShareAccess is called before blob is served to req, which
+	// reached it through share. A non-nil error denies the access.
+	ShareAccess(req *http.Request, share, blob *blobref.BlobRef) error
+}
+
+var (
+	guardMu    sync.RWMutex
+	shareGuard ShareGuard
+)
+
+// SetShareGuard sets the guard of the accesses made through shares,
+// replacing any previous one. Until one is set, they're all allowed.
+func SetShareGuard(g ShareGuard) {
+	guardMu.Lock()
+	defer guardMu.Unlock()
+	shareGuard = g
+}
+
+func getShareGuard() ShareGuard {
+	guardMu.RLock()
+	defer guardMu.RUnlock()
+	return shareGuard
+}
+
 const fetchFailureDelayNs = 200e6 // 200 ms
 const maxJSONSize = 64 * 1024     // should be enough for everyone
 
@@ -69,7 +98,20 @@ func (h *Handler) ServeHTTP(conn http.ResponseWriter, req *http.Request) {
 	}
 
 	switch {
-	case h.AllowGlobalAccess || auth.Allowed(req, auth.OpGet):
+	case h.AllowGlobalAccess:
+		serveBlobRef(conn, req, blobRef, h.Fetcher)
+	case isSignedURL(req):
+		if !validSignedURL(req, blobRef) {
+			http.Error(conn, "Invalid or expired signed URL", http.StatusForbidden)
+			return
+		}
+		serveBlobRef(conn, req, blobRef, h.Fetcher)
+	case auth.Allowed(req, auth.OpGet):
+		if !auth.AllowedBlob(req, blobRef, auth.OpGet) {
+			log.Printf("ACL user denied access to %s", blobRef)
+			http.Error(conn, "Forbidden", http.StatusForbidden)
+			return
+		}
 		serveBlobRef(conn, req, blobRef, h.Fetcher)
 	case auth.TriedAuthorization(req):
 		log.Printf("Attempted authorization failed on %s", req.URL)
@@ -233,21 +275,30 @@ func handleGetViaSharing(conn http.ResponseWriter, req *http.Request,
 				auth.SendUnauthorized(conn)
 				return
 			}
-			jd := json.NewDecoder(file)
-			m := make(map[string]interface{})
-			if err := jd.Decode(&m); err != nil {
+			ss, err := schema.ParseSuperset(file)
+			if err != nil {
 				log.Printf("Fetch chain 0 of %s wasn't JSON: %v", br.String(), err)
 				auth.SendUnauthorized(conn)
 				return
 			}
-			if m["camliType"].(string) != "share" {
-				log.Printf("Fetch chain 0 of %s wasn't a share", br.String())
+			if ss.Type != "share" || ss.AuthType != schema.ShareHaveRef {
+				log.Printf("Fetch chain 0 of %s wasn't a haveref share", br.String())
+				auth.SendUnauthorized(conn)
+				return
+			}
+			if ss.ShareExpired(time.Now()) {
+				log.Printf("Fetch chain 0 of %s is an expired share", br.String())
 				auth.SendUnauthorized(conn)
 				return
 			}
-			if len(fetchChain) > 1 && fetchChain[1].String() != m["target"].(string) {
+			if len(fetchChain) > 1 && (ss.Target == nil || fetchChain[1].String() != ss.Target.String()) {
 				log.Printf("Fetch chain 0->1 (%s -> %q) unauthorized, expected hop to %q",
-					br.String(), fetchChain[1].String(), m["target"])
+					br.String(), fetchChain[1].String(), ss.Target)
+				auth.SendUnauthorized(conn)
+				return
+			}
+			if len(fetchChain) > 2 && !ss.Transitive {
+				log.Printf("Fetch chain 0 of %s is a non-transitive share; can't hop past its target", br.String())
 				auth.SendUnauthorized(conn)
 				return
 			}
@@ -271,7 +322,7 @@ func handleGetViaSharing(conn http.ResponseWriter, req *http.Request,
 				return
 			}
 			saught := fetchChain[i+1].String()
-			if bytes.IndexAny(slurpBytes, saught) == -1 {
+			if !bytes.Contains(slurpBytes, []byte(saught)) {
 				log.Printf("Fetch chain %d of %s failed; no reference to %s",
 					i, br.String(), saught)
 				auth.SendUnauthorized(conn)
@@ -280,6 +331,14 @@ func handleGetViaSharing(conn http.ResponseWriter, req *http.Request,
 		}
 	}
 
+	if guard := getShareGuard(); guard != nil {
+		if err := guard.ShareAccess(req, fetchChain[0], blobRef); err != nil {
+			log.Printf("Access to %s via share %s denied: %v", blobRef, fetchChain[0], err)
+			auth.SendUnauthorized(conn)
+			return
+		}
+	}
+
 	viaPathOkay = true
 
 	serveBlobRef(conn, req, blobRef, fetcher)
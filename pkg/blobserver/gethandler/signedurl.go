@@ -0,0 +1,91 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gethandler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// A signed URL grants GET access to one blob until it expires,
+// without authentication, such as to embed an image in an email. Its
+// "expires" and "sig" query parameters are checked with the URL
+// signing key, not by the auth mode.
+
+var (
+	urlKeyMu sync.RWMutex
+	urlKey   []byte
+)
+
+func init() {
+	urlKey = make([]byte, 32)
+	if _, err := rand.Read(urlKey); err != nil {
+		panic(err)
+	}
+}
+
+// SetURLSigningKey sets the key of signed URLs, so they stay valid
+// across restarts. By default, the key is random.
+func SetURLSigningKey(key []byte) {
+	urlKeyMu.Lock()
+	defer urlKeyMu.Unlock()
+	urlKey = key
+}
+
+func urlSignature(br *blobref.BlobRef, expires int64) []byte {
+	urlKeyMu.RLock()
+	defer urlKeyMu.RUnlock()
+	mac := hmac.New(sha256.New, urlKey)
+	mac.Write([]byte(br.String() + "|" + strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)
+}
+
+// SignedURLQuery returns the query string of the signed URL of br,
+// valid until expires, to append to its URL on a get handler.
+func SignedURLQuery(br *blobref.BlobRef, expires time.Time) string {
+	exp := expires.Unix()
+	v := url.Values{}
+	v.Set("expires", strconv.FormatInt(exp, 10))
+	v.Set("sig", hex.EncodeToString(urlSignature(br, exp)))
+	return v.Encode()
+}
+
+// isSignedURL reports whether req is for a signed URL, valid or not.
+func isSignedURL(req *http.Request) bool {
+	return req.URL.Query().Get("sig") != ""
+}
+
+// validSignedURL reports whether req is for a signed URL of br that
+// hasn't expired.
+func validSignedURL(req *http.Request, br *blobref.BlobRef) bool {
+	q := req.URL.Query()
+	exp, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	sig, err := hex.DecodeString(q.Get("sig"))
+	return err == nil && hmac.Equal(sig, urlSignature(br, exp))
+}
@@ -17,12 +17,14 @@ limitations under the License.
 package handlers
 
 import (
+	"camlistore.org/pkg/audit"
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/httputil"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 )
 
 const maxRemovesPerRequest = 1000
@@ -86,6 +88,8 @@ func handleRemove(conn http.ResponseWriter, req *http.Request, storage blobserve
 		return
 	}
 
+	audit.Log(req, audit.EventRemove, "", strings.Join(toRemoveStr, " "))
+
 	reply := make(map[string]interface{}, 0)
 	reply["removed"] = toRemoveStr
 	httputil.ReturnJSON(conn, reply)
@@ -163,6 +163,14 @@ type Generationer interface {
 	ResetStorageGeneration() error
 }
 
+// Shutdowner is implemented by storage and handlers with work to
+// finish before the server exits, such as queued blobs to copy.
+type Shutdowner interface {
+	// Shutdown stops starting new work and returns once the work
+	// in progress is done, or with an error once deadline passes.
+	Shutdown(deadline time.Time) error
+}
+
 type Storage interface {
 	blobref.StreamingFetcher
 	BlobReceiver
@@ -0,0 +1,31 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package buildinfo reports the version of the running binary.
+package buildinfo
+
+// GitInfo is the git revision the binary was built from. It's set at
+// link time, with:
+//   go build -ldflags "-X camlistore.org/pkg/buildinfo.GitInfo <rev>"
+var GitInfo string
+
+// Version returns the build's version, or "unknown".
+func Version() string {
+	if GitInfo != "" {
+		return GitInfo
+	}
+	return "unknown"
+}
@@ -14,6 +14,23 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// Package client implements a Camlistore client, for Go programs to
+// use a Camlistore server as camput, camget and camtool do.
+//
+// A Client is made with New, for a server URL, or with NewOrFail,
+// for the server and auth of the user's client config file and the
+// command-line flags added by AddFlags. On first use, it discovers
+// the server's configuration: its blob, search and other handler
+// URLs, which the handler-specific methods use.
+//
+// Blobs are checked for with StatBlobs, uploaded with Upload or
+// UploadMany, and fetched with FetchStreaming or FetchVia. Schema
+// blobs that are claims are signed and uploaded with
+// UploadAndSignMap, using the configured key. QuerySearch and its
+// helpers query the search handler.
+//
+// Requests failing for reasons likely to pass, such as network
+// errors, are retried per the client's RetryPolicy.
 package client
 
 import (
@@ -30,9 +47,11 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"camlistore.org/pkg/auth"
 	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/schema"
 )
 
@@ -54,10 +73,16 @@ type Client struct {
 	discoErr       error
 	searchRoot     string // Handler prefix, or "" if none
 	downloadHelper string // or "" if none
+	tarHelper      string // or "" if none
+	gcRoot         string // or "" if none
 	storageGen     string // storage generation, or "" if not reported
 
 	authMode auth.AuthMode
 
+	// trustedCert is the SHA-1 fingerprint, in lowercase hex, of
+	// the only TLS certificate trusted for the server, or "".
+	trustedCert string
+
 	httpClient *http.Client
 	haveCache  HaveCache
 
@@ -67,10 +92,18 @@ type Client struct {
 	// via maps the access path from a share root to a desired target.
 	// It is non-nil when in "sharing" mode, where the Client is fetching
 	// a share.
-	via map[string]string // target => via (target is referenced from via)
+	viaMu sync.Mutex
+	via   map[string]string // target => via (target is referenced from via)
 
 	log     *log.Logger // not nil
 	reqGate chan bool
+
+	retryMu sync.Mutex
+	retry   RetryPolicy
+
+	offlineMu    sync.Mutex
+	offlineQueue blobserver.Storage // or nil
+	offlineErr   error              // why the server is unreachable, or nil
 }
 
 const maxParallelHTTP = 5
@@ -85,12 +118,17 @@ func New(server string) *Client {
 		httpClient: http.DefaultClient,
 		reqGate:    make(chan bool, maxParallelHTTP),
 		haveCache:  noHaveCache{},
+		retry:      DefaultRetryPolicy,
 	}
 }
 
 func NewOrFail() *Client {
 	c := New(blobServerOrDie())
 	c.log = log.New(os.Stderr, "", log.Ldate|log.Ltime)
+	if fp := trustedCertFromConfig(); fp != "" {
+		c.trustedCert = fp
+		c.httpClient = &http.Client{Transport: c.BaseTransport()}
+	}
 	err := c.SetupAuth()
 	if err != nil {
 		log.Fatal(err)
@@ -130,8 +168,10 @@ func NewFromShareRoot(shareBlobURL string) (c *Client, target *blobref.BlobRef,
 	if ss.Target == nil {
 		return nil, nil, fmt.Errorf("No target.")
 	}
+	if ss.ShareExpired(time.Now()) {
+		return nil, nil, fmt.Errorf("Share %s expired at %s", root, ss.Expires)
+	}
 	c.via[ss.Target.String()] = root
-	// TODO(bradfitz): send via in requests, populate via as we fetch more things
 	return c, ss.Target, nil
 }
 
@@ -183,6 +223,18 @@ var ErrNoSearchRoot = errors.New("client: server doesn't support search")
 // server doesn't report a storage generation value.
 var ErrNoStorageGeneration = errors.New("client: server doesn't report a storage generation")
 
+// Server returns the server the client was created for, as given,
+// before discovery.
+func (c *Client) Server() string {
+	return c.server
+}
+
+// BlobRoot returns the server's blob handler URL prefix, the part
+// before "/camli/", as found by discovery.
+func (c *Client) BlobRoot() (string, error) {
+	return c.prefix()
+}
+
 // SearchRoot returns the server's search handler.
 // If the server isn't running an index and search handler, the error
 // will be ErrNoSearchRoot.
@@ -284,6 +336,29 @@ func (c *Client) FileHasContents(f, wholeRef *blobref.BlobRef) bool {
 	return res.Header.Get("X-Camli-Contents") == wholeRef.String()
 }
 
+// FetchTar returns a tar stream of everything reachable from br, a
+// directory schema blob or a permanode, as made by the server's
+// "tar helper". The caller must close the returned ReadCloser.
+func (c *Client) FetchTar(br *blobref.BlobRef) (io.ReadCloser, error) {
+	c.condDiscovery()
+	if c.discoErr != nil {
+		return nil, c.discoErr
+	}
+	if c.tarHelper == "" {
+		return nil, errors.New("client: server has no tar helper")
+	}
+	req := c.newRequest("GET", c.tarHelper+br.String())
+	res, err := c.doReq(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("client: got status code %d fetching tar of %s", res.StatusCode, br)
+	}
+	return res.Body, nil
+}
+
 func (c *Client) prefix() (string, error) {
 	c.prefixOnce.Do(func() { c.initPrefix() })
 	if c.prefixErr != nil {
@@ -339,6 +414,14 @@ func (c *Client) doDiscovery() {
 		return
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		msg := fmt.Sprintf("Got status %q from blobserver URL %q during configuration discovery", res.Status, c.discoRoot())
+		if d, err := c.AuthDiscovery(); err == nil {
+			msg += fmt.Sprintf("; the server accepts auth of the kinds %s", strings.Join(d.Schemes, ", "))
+		}
+		c.discoErr = errors.New(msg)
+		return
+	}
 	if res.StatusCode != 200 {
 		c.discoErr = fmt.Errorf("Got status %q from blobserver URL %q during configuration discovery", res.Status, c.discoRoot())
 		return
@@ -375,6 +458,25 @@ func (c *Client) doDiscovery() {
 		c.downloadHelper = u.String()
 	}
 
+	tarHelper, ok := m["tarHelper"].(string)
+	if ok {
+		u, err := root.Parse(tarHelper)
+		if err != nil {
+			c.discoErr = fmt.Errorf("client: invalid tarHelper %q; failed to resolve", tarHelper)
+			return
+		}
+		c.tarHelper = u.String()
+	}
+
+	if gcRoot, ok := m["gcRoot"].(string); ok {
+		u, err := root.Parse(gcRoot)
+		if err != nil {
+			c.discoErr = fmt.Errorf("client: invalid gcRoot %q; failed to resolve", gcRoot)
+			return
+		}
+		c.gcRoot = u.String()
+	}
+
 	c.storageGen, _ = m["storageGeneration"].(string)
 
 	blobRoot, ok := m["blobRoot"].(string)
@@ -390,6 +492,31 @@ func (c *Client) doDiscovery() {
 	c.prefixv = strings.TrimRight(u.String(), "/")
 }
 
+// AuthDiscovery returns the description of the authentication the
+// server accepts, from its well-known auth discovery path, so the auth
+// to use needn't be known in advance.
+func (c *Client) AuthDiscovery() (*auth.Discovery, error) {
+	u, err := url.Parse(c.discoRoot())
+	if err != nil {
+		return nil, err
+	}
+	u.Path, u.RawQuery = auth.DiscoveryPath, ""
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	res, err := c.doReq(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("client: got status %q from %s", res.Status, u)
+	}
+	d := new(auth.Discovery)
+	if err := json.NewDecoder(res.Body).Decode(d); err != nil {
+		return nil, fmt.Errorf("client: parsing auth discovery: %v", err)
+	}
+	return d, nil
+}
+
 func (c *Client) newRequest(method, url string, body ...io.Reader) *http.Request {
 	var bodyR io.Reader
 	if len(body) > 0 {
@@ -402,15 +529,30 @@ func (c *Client) newRequest(method, url string, body ...io.Reader) *http.Request
 	if err != nil {
 		panic(err.Error())
 	}
-	// not done by http.NewRequest in Go 1.0:
-	if br, ok := bodyR.(*bytes.Reader); ok {
-		req.ContentLength = int64(br.Len())
+	if bodyR != nil {
+		setReplayBody(req, bodyR)
 	}
 	c.authMode.AddAuthHeader(req)
 	return req
 }
 
+// doReq sends req, retrying it per the client's retry policy if it
+// can be sent again.
 func (c *Client) doReq(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := c.doReqOnce(req)
+		next := replay(req)
+		if next == nil || !c.shouldRetry(res, err, attempt) {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		req = next
+	}
+}
+
+func (c *Client) doReqOnce(req *http.Request) (*http.Response, error) {
 	c.reqGate <- true
 	defer func() {
 		<-c.reqGate
@@ -38,8 +38,12 @@ import (
 // A main binary must call AddFlags to expose these.
 var flagServer *string
 
+// flagProfile, if set, selects a server profile of the config file.
+var flagProfile *string
+
 func AddFlags() {
 	flagServer = flag.String("blobserver", "", "camlistore blob server")
+	flagProfile = flag.String("server", "", "Name of the server profile to use, from the \"servers\" of the config file, instead of its top-level \"blobServer\" and \"auth\".")
 }
 
 // ExplicitServer returns the blobserver given in the flags, if any.
@@ -79,15 +83,48 @@ func cleanServer(server string) string {
 	return server
 }
 
+// serverConfig returns the part of the config file about the server
+// talked to: the server profile given with --server, or else the
+// top-level config. Either has the "blobServer", "auth" and
+// "trustedCert" keys, as in:
+//
+//   {
+//     "blobServer": "https://home.example.com:3179",
+//     "auth": "userpass:alice:secret",
+//     "servers": {
+//       "offsite": {
+//         "blobServer": "https://replica.example.net",
+//         "auth": "userpass:alice:other-secret",
+//         "trustedCert": "79:20:5a:..."
+//       }
+//     },
+//     ...
+//   }
+//
+// The trustedCert is the hex SHA-1 fingerprint of the server's TLS
+// certificate, such as a self-signed one, trusted instead of any
+// certificate authority.
+func serverConfig() map[string]interface{} {
+	configOnce.Do(parseConfig)
+	if flagProfile == nil || *flagProfile == "" {
+		return config
+	}
+	servers, _ := config["servers"].(map[string]interface{})
+	profile, ok := servers[*flagProfile].(map[string]interface{})
+	if !ok {
+		log.Fatalf("No server %q in the \"servers\" of %q", *flagProfile, ConfigFilePath())
+	}
+	return profile
+}
+
 func blobServerOrDie() string {
 	if flagServer != nil && *flagServer != "" {
 		return cleanServer(*flagServer)
 	}
-	configOnce.Do(parseConfig)
-	value, ok := config["blobServer"]
+	value, ok := serverConfig()["blobServer"]
 	var server string
 	if ok {
-		server = value.(string)
+		server, _ = value.(string)
 	}
 	server = cleanServer(server)
 	if !ok || server == "" {
@@ -96,6 +133,16 @@ func blobServerOrDie() string {
 	return server
 }
 
+// trustedCertFromConfig returns the normalized trustedCert of the
+// server config, or "" if none.
+func trustedCertFromConfig() string {
+	if flagServer != nil && *flagServer != "" {
+		return ""
+	}
+	fp, _ := serverConfig()["trustedCert"].(string)
+	return normalizeFingerprint(fp)
+}
+
 func (c *Client) SetupAuth() error {
 	configOnce.Do(parseConfig)
 	if flagServer != nil && *flagServer != "" {
@@ -105,7 +152,7 @@ func (c *Client) SetupAuth() error {
 		c.authMode = auth.None{}
 		return nil
 	}
-	return c.SetupAuthFromConfig(config)
+	return c.SetupAuthFromConfig(serverConfig())
 }
 
 func (c *Client) SetupAuthFromConfig(conf jsonconfig.Obj) error {
@@ -0,0 +1,93 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// ErrNoGCRoot is returned by GC if the server has no garbage
+// collector.
+var ErrNoGCRoot = errors.New("client: server doesn't have a garbage collector")
+
+// A GCReport is the server's garbage collector's report of a
+// collection.
+type GCReport struct {
+	Blobs       int         `json:"blobs"` // in the server's storage
+	Garbage     []GCGarbage `json:"garbage"`
+	GarbageSize int64       `json:"garbageSize"`
+	Removed     bool        `json:"removed"` // false for dry runs
+}
+
+type GCGarbage struct {
+	BlobRef string `json:"blobRef"`
+	Size    int64  `json:"size"`
+	Type    string `json:"type,omitempty"` // camliType, or "" if not a schema blob
+}
+
+// GC runs the server's garbage collector, which removes the blobs of
+// deleted permanodes and claims. With dryRun, it only reports what it
+// would remove.
+func (c *Client) GC(dryRun bool) (*GCReport, error) {
+	return c.GCFrom(nil, dryRun)
+}
+
+// GCFrom is like GC, but if roots is not empty, the garbage is also
+// every blob not reachable from roots, or from the claims of the
+// permanodes reachable from them.
+func (c *Client) GCFrom(roots []*blobref.BlobRef, dryRun bool) (*GCReport, error) {
+	c.condDiscovery()
+	if c.discoErr != nil {
+		return nil, c.discoErr
+	}
+	if c.gcRoot == "" {
+		return nil, ErrNoGCRoot
+	}
+	method := "POST"
+	if dryRun {
+		method = "GET"
+	}
+	gcURL := c.gcRoot
+	if len(roots) > 0 {
+		v := url.Values{}
+		for _, br := range roots {
+			v.Add("root", br.String())
+		}
+		gcURL += "?" + v.Encode()
+	}
+	res, err := c.doReq(c.newRequest(method, gcURL))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, fmt.Errorf("client: got status %q from garbage collector %s: %s", res.Status, c.gcRoot, msg)
+	}
+	report := new(GCReport)
+	if err := json.NewDecoder(res.Body).Decode(report); err != nil {
+		return nil, fmt.Errorf("client: error parsing garbage collector response: %v", err)
+	}
+	return report, nil
+}
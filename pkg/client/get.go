@@ -48,6 +48,8 @@ func (c *Client) viaPathTo(b *blobref.BlobRef) (path []*blobref.BlobRef) {
 	if c.via == nil {
 		return nil
 	}
+	c.viaMu.Lock()
+	defer c.viaMu.Unlock()
 	it := b.String()
 	// Append path backwards first,
 	for {
@@ -115,9 +117,11 @@ func (c *Client) FetchVia(b *blobref.BlobRef, v []*blobref.BlobRef) (io.ReadClos
 	}
 	// If it looks like a JSON schema blob (starts with '{')
 	if schema.LikelySchemaBlob(buf.Bytes()) {
+		c.viaMu.Lock()
 		for _, blobstr := range blobsRx.FindAllString(buf.String(), -1) {
 			c.via[blobstr] = b.String()
 		}
+		c.viaMu.Unlock()
 	}
 	// Read from the multireader, but close the HTTP response body.
 	type rc struct {
@@ -0,0 +1,142 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+// SetOfflineQueue sets q, such as a local disk storage, as the offline
+// queue of c. Once the server is found unreachable, uploads go to q
+// instead, as if the server had received them, and StatBlobs reports
+// no blobs. FlushOfflineQueue sends them on later.
+func (c *Client) SetOfflineQueue(q blobserver.Storage) {
+	c.offlineMu.Lock()
+	defer c.offlineMu.Unlock()
+	c.offlineQueue = q
+}
+
+// Offline reports whether c found the server unreachable, and so
+// queues its uploads.
+func (c *Client) Offline() bool {
+	c.offlineMu.Lock()
+	defer c.offlineMu.Unlock()
+	return c.offlineErr != nil
+}
+
+// goOffline reports whether a request that failed with err is to go
+// to the offline queue: if there's one, and err means the server is
+// unreachable, rather than that it refused the request. If so, c is
+// offline from then on.
+func (c *Client) goOffline(err error) bool {
+	if _, ok := err.(*url.Error); !ok {
+		return false
+	}
+	c.offlineMu.Lock()
+	defer c.offlineMu.Unlock()
+	if c.offlineQueue == nil {
+		return false
+	}
+	if c.offlineErr == nil {
+		c.offlineErr = err
+		c.logf("client: server unreachable, queueing uploads offline: %v", err)
+	}
+	return true
+}
+
+// queueUpload puts the blob of pr, the pr.Size bytes read from r, in
+// the offline queue.
+func (c *Client) queueUpload(pr *PutResult, r io.Reader) (*PutResult, error) {
+	sb, err := c.offlineQueue.ReceiveBlob(pr.BlobRef, io.LimitReader(r, pr.Size))
+	if err != nil {
+		return nil, fmt.Errorf("client: error queueing %v offline: %v", pr.BlobRef, err)
+	}
+	c.statsMutex.Lock()
+	c.stats.Queued.Blobs++
+	c.stats.Queued.Bytes += sb.Size
+	c.statsMutex.Unlock()
+	pr.Size = sb.Size
+	return pr, nil
+}
+
+// FlushOfflineQueue uploads the blobs of the offline queue to the
+// server, removing each once the server has it, and returns how many
+// it uploaded. If the server is, or becomes, unreachable, the rest stay
+// queued, and the error is returned.
+func (c *Client) FlushOfflineQueue() (n int, err error) {
+	c.offlineMu.Lock()
+	q := c.offlineQueue
+	c.offlineMu.Unlock()
+	if q == nil {
+		return 0, nil
+	}
+
+	var queued []blobref.SizedBlobRef
+	const batch = 1000
+	after := ""
+	for {
+		ch := make(chan blobref.SizedBlobRef, batch)
+		if err := q.EnumerateBlobs(ch, after, batch, 0); err != nil {
+			return 0, fmt.Errorf("client: error enumerating the offline queue: %v", err)
+		}
+		got := 0
+		for sb := range ch {
+			queued = append(queued, sb)
+			after = sb.BlobRef.String()
+			got++
+		}
+		if got < batch {
+			break
+		}
+	}
+
+	for _, sb := range queued {
+		if err := c.offlineError(); err != nil {
+			return n, err
+		}
+		rc, _, err := q.FetchStreaming(sb.BlobRef)
+		if err != nil {
+			return n, fmt.Errorf("client: error reading %v from the offline queue: %v", sb.BlobRef, err)
+		}
+		_, err = c.Upload(&UploadHandle{BlobRef: sb.BlobRef, Size: sb.Size, Contents: rc})
+		rc.Close()
+		if err != nil {
+			return n, err
+		}
+		// If the server became unreachable, Upload queued the
+		// blob again, rather than uploading it.
+		if err := c.offlineError(); err != nil {
+			return n, err
+		}
+		if err := q.RemoveBlobs([]*blobref.BlobRef{sb.BlobRef}); err != nil {
+			return n, fmt.Errorf("client: error removing %v from the offline queue: %v", sb.BlobRef, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (c *Client) offlineError() error {
+	c.offlineMu.Lock()
+	defer c.offlineMu.Unlock()
+	return c.offlineErr
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/handlers"
+	"camlistore.org/pkg/blobserver/localdisk"
+)
+
+// configStorage is a Storage the upload handler can build URLs for.
+type configStorage struct {
+	blobserver.Storage
+	urlBase string
+}
+
+func (s *configStorage) Config() *blobserver.Config {
+	return &blobserver.Config{Writable: true, Readable: true, URLBase: s.urlBase}
+}
+
+func newDiskStorage(t *testing.T) (*localdisk.DiskStorage, string) {
+	dir, err := ioutil.TempDir("", "camli-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := localdisk.New(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return ds, dir
+}
+
+func TestOfflineQueue(t *testing.T) {
+	queue, queueDir := newDiskStorage(t)
+	defer os.RemoveAll(queueDir)
+	server, serverDir := newDiskStorage(t)
+	defer os.RemoveAll(serverDir)
+
+	sto := &configStorage{Storage: server}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bs/camli/stat", handlers.CreateStatHandler(sto))
+	mux.HandleFunc("/bs/camli/upload", handlers.CreateUploadHandler(sto))
+	down := httptest.NewServer(mux)
+	down.Close()
+
+	c := New(down.URL + "/bs")
+	c.authMode = auth.None{}
+	c.SetRetryPolicy(RetryPolicy{})
+	c.SetOfflineQueue(queue)
+	h := NewUploadHandleFromString("some blob")
+	pr, err := c.Upload(h)
+	if err != nil {
+		t.Fatalf("offline Upload: %v", err)
+	}
+	if !c.Offline() {
+		t.Error("client not offline after an upload to an unreachable server")
+	}
+	if pr.Skipped || pr.Size != int64(len("some blob")) {
+		t.Errorf("offline Upload = %+v", pr)
+	}
+	if _, err := blobserver.StatBlob(queue, h.BlobRef); err != nil {
+		t.Errorf("blob not queued: %v", err)
+	}
+	if st := c.Stats(); st.Queued.Blobs != 1 || st.Uploads.Blobs != 0 || st.Dedup().Blobs != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+	if n, err := c.FlushOfflineQueue(); n != 0 || err == nil {
+		t.Errorf("offline FlushOfflineQueue = %d, %v; want 0 and an error", n, err)
+	}
+
+	// The next run, with the server reachable.
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	sto.urlBase = ts.URL + "/bs"
+	c = New(sto.urlBase)
+	c.authMode = auth.None{}
+	c.SetOfflineQueue(queue)
+	n, err := c.FlushOfflineQueue()
+	if n != 1 || err != nil {
+		t.Fatalf("FlushOfflineQueue = %d, %v; want 1, nil", n, err)
+	}
+	if c.Offline() {
+		t.Error("client offline with the server reachable")
+	}
+	if _, err := blobserver.StatBlob(server, h.BlobRef); err != nil {
+		t.Errorf("queued blob not uploaded: %v", err)
+	}
+	if _, err := blobserver.StatBlob(queue, h.BlobRef); err == nil {
+		t.Error("uploaded blob still queued")
+	}
+}
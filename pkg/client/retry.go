@@ -0,0 +1,135 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A RetryPolicy is how a Client retries the requests that fail for
+// reasons likely to pass: network errors, and the 502, 503 and 504
+// statuses of overloaded or restarting servers and proxies.
+//
+// Only requests that can be sent again are retried: those without a
+// body, those with an in-memory body, and uploads of contents that
+// are an io.Seeker, such as an *os.File.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first
+	// attempt. Zero disables retries.
+	MaxRetries int
+
+	// Backoff is the wait before the first retry. It doubles
+	// before each next one.
+	Backoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of new Clients.
+var DefaultRetryPolicy = RetryPolicy{MaxRetries: 3, Backoff: 500 * time.Millisecond}
+
+// retrySleep is time.Sleep, but tests don't wait.
+var retrySleep = time.Sleep
+
+// SetRetryPolicy sets how the client retries failed requests.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
+	c.retry = p
+}
+
+func (c *Client) retryPolicy() RetryPolicy {
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
+	return c.retry
+}
+
+// shouldRetry reports whether a request that got res and err, after
+// attempt attempts, is to be retried, and if so waits for the retry.
+func (c *Client) shouldRetry(res *http.Response, err error, attempt int) bool {
+	p := c.retryPolicy()
+	if attempt > p.MaxRetries || !retryable(res, err) {
+		return false
+	}
+	if err != nil {
+		c.logf("client: retrying after error: %v", err)
+	} else {
+		c.logf("client: retrying %s after status %q", res.Request.URL, res.Status)
+	}
+	retrySleep(p.Backoff << uint(attempt-1))
+	return true
+}
+
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.log != nil {
+		c.log.Printf(format, args...)
+	}
+}
+
+// replayBody is the body of a request that can be sent again.
+type replayBody struct {
+	io.Reader
+	data []byte
+}
+
+func (*replayBody) Close() error { return nil }
+
+// setReplayBody sets the body of req to r, if r is in memory, such that
+// req can be replayed.
+func setReplayBody(req *http.Request, r io.Reader) {
+	switch r.(type) {
+	case *bytes.Reader, *bytes.Buffer, *strings.Reader:
+	default:
+		return
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		// Can't happen with these readers.
+		panic(err.Error())
+	}
+	req.Body = &replayBody{bytes.NewReader(data), data}
+	req.ContentLength = int64(len(data))
+}
+
+// replay returns a copy of req to send again, or nil if req can't be.
+func replay(req *http.Request) *http.Request {
+	if req.Body == nil {
+		return req
+	}
+	rb, ok := req.Body.(*replayBody)
+	if !ok {
+		return nil
+	}
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.Body = &replayBody{bytes.NewReader(rb.data), rb.data}
+	return req2
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/auth"
+)
+
+func init() {
+	retrySleep = func(time.Duration) {}
+}
+
+// flakyServer fails its first failures requests with status.
+type flakyServer struct {
+	status   int
+	failures int
+
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (s *flakyServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	s.mu.Lock()
+	s.bodies = append(s.bodies, string(body))
+	n := len(s.bodies)
+	s.mu.Unlock()
+	if n <= s.failures {
+		http.Error(rw, "try later", s.status)
+		return
+	}
+	io.WriteString(rw, "ok")
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		method   string
+		body     io.Reader
+		status   int
+		failures int
+		policy   RetryPolicy
+
+		wantStatus   int
+		wantAttempts int
+	}{
+		{"GET", nil, 503, 2, DefaultRetryPolicy, 200, 3},
+		{"POST", strings.NewReader("camliversion=1"), 502, 3, DefaultRetryPolicy, 200, 4},
+		{"GET", nil, 504, 5, DefaultRetryPolicy, 504, 4},
+		{"GET", nil, 503, 1, RetryPolicy{}, 503, 1},
+		// Not an error that's likely to pass.
+		{"GET", nil, 500, 1, DefaultRetryPolicy, 500, 1},
+		// Not a body that can be sent again.
+		{"POST", io.MultiReader(strings.NewReader("x")), 503, 1, DefaultRetryPolicy, 503, 1},
+	}
+	for i, tt := range tests {
+		fs := &flakyServer{status: tt.status, failures: tt.failures}
+		ts := httptest.NewServer(fs)
+		c := New(ts.URL)
+		c.authMode = auth.None{}
+		c.SetRetryPolicy(tt.policy)
+		res, err := c.doReq(c.newRequest(tt.method, ts.URL+"/", tt.body))
+		if err != nil {
+			t.Errorf("%d. request error: %v", i, err)
+			ts.Close()
+			continue
+		}
+		res.Body.Close()
+		ts.Close()
+		if res.StatusCode != tt.wantStatus {
+			t.Errorf("%d. status = %d; want %d", i, res.StatusCode, tt.wantStatus)
+		}
+		if len(fs.bodies) != tt.wantAttempts {
+			t.Errorf("%d. attempts = %d; want %d", i, len(fs.bodies), tt.wantAttempts)
+		}
+		for _, body := range fs.bodies {
+			if body != fs.bodies[0] {
+				t.Errorf("%d. retried with body %q; first sent %q", i, body, fs.bodies[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/search"
+)
+
+// QuerySearch does a GET request on the server's search handler,
+// for the given endpoint (e.g. "describe" or "permanodeattr") and
+// query parameters, and returns the decoded JSON response.
+//
+// The request always asks for the current version of the search API
+// response layout, in which described blobs are under "meta".
+func (c *Client) QuerySearch(endpoint string, args url.Values) (map[string]interface{}, error) {
+	sr, err := c.SearchRoot()
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	for k, vv := range args {
+		q[k] = vv
+	}
+	q.Set("version", strconv.Itoa(search.APIVersion))
+	u := sr + "camli/search/" + endpoint + "?" + q.Encode()
+	req := c.newRequest("GET", u)
+	res, err := c.doReq(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var ret map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 8<<20)).Decode(&ret); err != nil {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, fmt.Errorf("client: error parsing JSON from URL %s (status %d): %v", u, res.StatusCode, err)
+	}
+	if e, ok := ret["error"].(string); ok {
+		return nil, fmt.Errorf("client: search error from %s: %s", u, e)
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("client: got status code %d from URL %s", res.StatusCode, u)
+	}
+	return ret, nil
+}
+
+// PermanodeContent returns the current camliContent of the permanode
+// pn, as described by the server's search handler, or nil if it has
+// none.
+func (c *Client) PermanodeContent(pn *blobref.BlobRef) (*blobref.BlobRef, error) {
+	res, err := c.QuerySearch("describe", url.Values{"blobref": {pn.String()}})
+	if err != nil {
+		return nil, err
+	}
+	meta, _ := res["meta"].(map[string]interface{})
+	des, _ := meta[pn.String()].(map[string]interface{})
+	if des == nil {
+		return nil, fmt.Errorf("client: permanode %s not described by the server", pn)
+	}
+	perma, _ := des["permanode"].(map[string]interface{})
+	attr, _ := perma["attr"].(map[string]interface{})
+	contents, _ := attr["camliContent"].([]interface{})
+	if len(contents) == 0 {
+		return nil, nil
+	}
+	s, _ := contents[0].(string)
+	br := blobref.Parse(s)
+	if br == nil {
+		return nil, fmt.Errorf("client: permanode %s has an invalid camliContent %q", pn, s)
+	}
+	return br, nil
+}
+
+// FilesWithContents returns the file schema blobs the server's index
+// knows to have the entire contents of wholeRef, the digest of a whole
+// file.
+func (c *Client) FilesWithContents(wholeRef *blobref.BlobRef) ([]*blobref.BlobRef, error) {
+	res, err := c.QuerySearch("files", url.Values{"wholedigest": {wholeRef.String()}})
+	if err != nil {
+		return nil, err
+	}
+	list, _ := res["files"].([]interface{})
+	var files []*blobref.BlobRef
+	for _, v := range list {
+		s, _ := v.(string)
+		if br := blobref.Parse(s); br != nil {
+			files = append(files, br)
+		}
+	}
+	return files, nil
+}
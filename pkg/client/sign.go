@@ -0,0 +1,64 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/schema"
+)
+
+// ErrNoSigner is returned by SignMap if the client has no public key
+// configured.
+var ErrNoSigner = errors.New("client: no public key configured")
+
+var _ schema.Signer = (*Client)(nil)
+
+// SignMap signs m, setting its camliSigner, with the client's
+// configured key, and returns the signed JSON.
+func (c *Client) SignMap(m schema.Map) (string, error) {
+	signer := c.SignerPublicKeyBlobref()
+	if signer == nil {
+		return "", ErrNoSigner
+	}
+	m["camliSigner"] = signer.String()
+	unsigned, err := m.JSON()
+	if err != nil {
+		return "", err
+	}
+	sr := &jsonsign.SignRequest{
+		UnsignedJSON:  unsigned,
+		Fetcher:       c.GetBlobFetcher(),
+		EntityFetcher: &jsonsign.FileEntityFetcher{File: c.SecretRingFile()},
+	}
+	signed, err := sr.Sign()
+	if err != nil {
+		return "", fmt.Errorf("client: signing %s: %v", m["camliType"], err)
+	}
+	return signed, nil
+}
+
+// UploadAndSignMap signs m with SignMap and uploads it.
+func (c *Client) UploadAndSignMap(m schema.Map) (*PutResult, error) {
+	signed, err := c.SignMap(m)
+	if err != nil {
+		return nil, err
+	}
+	return c.Upload(NewUploadHandleFromString(signed))
+}
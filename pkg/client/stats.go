@@ -28,6 +28,19 @@ type Stats struct {
 	// The uploads which were actually sent to the blobserver
 	// due to the server not having the blobs
 	Uploads ByCountAndBytes
+
+	// The uploads which went to the offline queue, as the server
+	// was unreachable.
+	Queued ByCountAndBytes
+}
+
+// Dedup returns the uploads that were requested but neither sent nor
+// queued, as the server already had the blobs.
+func (s *Stats) Dedup() ByCountAndBytes {
+	return ByCountAndBytes{
+		Blobs: s.UploadRequests.Blobs - s.Uploads.Blobs - s.Queued.Blobs,
+		Bytes: s.UploadRequests.Bytes - s.Uploads.Bytes - s.Queued.Bytes,
+	}
 }
 
 func (s *Stats) String() string {
@@ -0,0 +1,65 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrustedCert(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	defer ts.Close()
+	fp := certFingerprint(ts.TLS.Certificates[0].Certificate[0])
+
+	// The fingerprint as openssl prints it.
+	var colons []string
+	for i := 0; i < len(fp); i += 2 {
+		colons = append(colons, strings.ToUpper(fp[i:i+2]))
+	}
+	if got := normalizeFingerprint(strings.Join(colons, ":")); got != fp {
+		t.Errorf("normalized fingerprint = %q; want %q", got, fp)
+	}
+
+	for _, tt := range []struct {
+		trusted string
+		wantErr bool
+	}{
+		{fp, false},
+		{strings.Repeat("0", len(fp)), true},
+	} {
+		c := New(ts.URL)
+		c.trustedCert = tt.trusted
+		hc := &http.Client{Transport: c.BaseTransport()}
+		res, err := hc.Get(ts.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("trusting %s: error = %v; want error: %v", tt.trusted, err, tt.wantErr)
+		}
+	}
+
+	if New(ts.URL).DialTLSFunc() != nil {
+		t.Error("DialTLSFunc not nil without a trusted certificate")
+	}
+}
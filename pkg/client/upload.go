@@ -32,6 +32,7 @@ import (
 	"time"
 
 	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/readerutil"
 )
 
 var _ = log.Printf
@@ -161,9 +162,8 @@ func (c *Client) jsonFromResponse(requestName string, resp *http.Response) (map[
 		io.Copy(os.Stderr, resp.Body)
 		return nil, errors.New(fmt.Sprintf("After %s request, HTTP response code is %d; no JSON to parse.", requestName, resp.StatusCode))
 	}
-	// TODO: LimitReader here for paranoia
 	buf := new(bytes.Buffer)
-	io.Copy(buf, resp.Body)
+	io.Copy(buf, io.LimitReader(resp.Body, 5<<20))
 	resp.Body.Close()
 	jmap := make(map[string]interface{})
 	if jerr := json.Unmarshal(buf.Bytes(), &jmap); jerr != nil {
@@ -194,7 +194,7 @@ func (c *Client) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.Bl
 		needed++
 		fmt.Fprintf(&buf, "&blob%d=%s", needed, blob)
 	}
-	if needed == 0 {
+	if needed == 0 || c.Offline() {
 		return nil
 	}
 
@@ -208,6 +208,9 @@ func (c *Client) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.Bl
 
 	pfx, err := c.prefix()
 	if err != nil {
+		if c.goOffline(err) {
+			return nil
+		}
 		return err
 	}
 	req := c.newRequest("POST", fmt.Sprintf("%s/camli/stat", pfx), &buf)
@@ -215,6 +218,9 @@ func (c *Client) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.Bl
 
 	resp, err := c.doReq(req)
 	if err != nil {
+		if c.goOffline(err) {
+			return nil
+		}
 		return fmt.Errorf("stat HTTP error: %v", err)
 	}
 	if resp.Body != nil {
@@ -236,19 +242,26 @@ func (c *Client) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.Bl
 	return nil
 }
 
+// maxInMemorySlurp is the most of an upload of unknown size that is
+// kept in memory to find its size. The rest goes to a temporary file.
+const maxInMemorySlurp = 4 << 20
+
 // Figure out the size of the contents.
 // If the size was provided, trust it.
-// If the size was not provided (-1), slurp.
+// If the size was not provided (-1), measure it if possible or else
+// spool, in which case the returned reader is a *readerutil.Spool to close.
 func readerAndSize(h *UploadHandle) (io.Reader, int64, error) {
 	if h.Size != -1 {
 		return h.Contents, h.Size, nil
 	}
-	var b bytes.Buffer
-	n, err := io.Copy(&b, h.Contents)
+	if size, ok := readerutil.ReaderSize(h.Contents); ok {
+		return h.Contents, size, nil
+	}
+	s, err := readerutil.NewSpool(h.Contents, maxInMemorySlurp)
 	if err != nil {
 		return nil, 0, err
 	}
-	return &b, n, nil
+	return s, s.Size(), nil
 }
 
 func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
@@ -262,6 +275,9 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 	if err != nil {
 		return nil, fmt.Errorf("client: error slurping upload handle to find its length: %v", err)
 	}
+	if s, ok := bodyReader.(*readerutil.Spool); ok {
+		defer s.Close()
+	}
 
 	c.statsMutex.Lock()
 	c.stats.UploadRequests.Blobs++
@@ -273,6 +289,9 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 		pr.Skipped = true
 		return pr, nil
 	}
+	if c.Offline() {
+		return c.queueUpload(pr, bodyReader)
+	}
 
 	blobrefStr := h.BlobRef.String()
 
@@ -280,6 +299,9 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 	// server and if not, the URL to upload it to.
 	pfx, err := c.prefix()
 	if err != nil {
+		if c.goOffline(err) {
+			return c.queueUpload(pr, bodyReader)
+		}
 		return nil, err
 	}
 	url_ := fmt.Sprintf("%s/camli/stat", pfx)
@@ -288,6 +310,9 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 
 	resp, err := c.doReq(req)
 	if err != nil {
+		if c.goOffline(err) {
+			return c.queueUpload(pr, bodyReader)
+		}
 		return errorf("stat http error: %v", err)
 	}
 	defer resp.Body.Close()
@@ -320,45 +345,31 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 		log.Printf("Uploading: %s (%d bytes)", blobrefStr, bodySize)
 	}
 
-	pipeReader, pipeWriter := io.Pipe()
-	multipartWriter := multipart.NewWriter(pipeWriter)
-
-	copyResult := make(chan error, 1)
-	go func() {
-		defer pipeWriter.Close()
-		part, err := multipartWriter.CreateFormFile(blobrefStr, blobrefStr)
-		if err != nil {
-			copyResult <- err
-			return
+	// The upload is retried if the contents can be read again.
+	seeker, canSeek := bodyReader.(io.Seeker)
+	for attempt := 1; ; attempt++ {
+		resp, err = c.postMultipart(stat.uploadUrl, blobrefStr, bodyReader, bodySize, h.Vivify)
+		if !canSeek || !c.shouldRetry(resp, err, attempt) {
+			break
 		}
-		_, err = io.Copy(part, bodyReader)
-		if err == nil {
-			err = multipartWriter.Close()
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if _, err := seeker.Seek(0, os.SEEK_SET); err != nil {
+			return errorf("failed to rewind contents to retry upload: %v", err)
 		}
-		copyResult <- err
-	}()
-
-	// TODO(bradfitz): verbosity levels. make this VLOG(2) or something. it's noisy:
-	// c.log.Printf("Uploading %s to URL: %s", blobrefStr, stat.uploadUrl)
-
-	req = c.newRequest("POST", stat.uploadUrl)
-	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
-	if h.Vivify {
-		req.Header.Add("X-Camlistore-Vivify", "1")
 	}
-	req.Body = ioutil.NopCloser(pipeReader)
-	req.ContentLength = multipartOverhead + bodySize + int64(len(blobrefStr))*2
-	resp, err = c.doReq(req)
 	if err != nil {
+		if canSeek && c.goOffline(err) {
+			if _, err := seeker.Seek(0, os.SEEK_SET); err != nil {
+				return errorf("failed to rewind contents to queue upload: %v", err)
+			}
+			return c.queueUpload(pr, bodyReader)
+		}
 		return errorf("upload http error: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// check error from earlier copy
-	if err := <-copyResult; err != nil {
-		return errorf("failed to copy contents into multipart writer: %v", err)
-	}
-
 	// The only valid HTTP responses are 200 and 303.
 	if resp.StatusCode != 200 && resp.StatusCode != 303 {
 		return errorf("invalid http response %d in upload response", resp.StatusCode)
@@ -431,3 +442,105 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 
 	return nil, errors.New("Server didn't receive blob.")
 }
+
+// postMultipart does the multipart POST to uploadUrl of the blob
+// blobrefStr, of size bodySize, read from body.
+func (c *Client) postMultipart(uploadUrl, blobrefStr string, body io.Reader, bodySize int64, vivify bool) (*http.Response, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(pipeWriter)
+
+	copyResult := make(chan error, 1)
+	go func() {
+		defer pipeWriter.Close()
+		part, err := multipartWriter.CreateFormFile(blobrefStr, blobrefStr)
+		if err != nil {
+			copyResult <- err
+			return
+		}
+		// Never more than what the Content-Length promises,
+		// even if the contents grew since they were measured.
+		_, err = io.Copy(part, io.LimitReader(body, bodySize))
+		if err == nil {
+			err = multipartWriter.Close()
+		}
+		copyResult <- err
+	}()
+
+	// TODO(bradfitz): verbosity levels. make this VLOG(2) or something. it's noisy:
+	// c.log.Printf("Uploading %s to URL: %s", blobrefStr, uploadUrl)
+
+	req := c.newRequest("POST", uploadUrl)
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	if vivify {
+		req.Header.Add("X-Camlistore-Vivify", "1")
+	}
+	req.Body = ioutil.NopCloser(pipeReader)
+	req.ContentLength = multipartOverhead + bodySize + int64(len(blobrefStr))*2
+	resp, err := c.doReq(req)
+	if err != nil {
+		// Unblock the copy, if the request failed before
+		// reading the whole body.
+		pipeReader.CloseWithError(err)
+		<-copyResult
+		return nil, err
+	}
+
+	// check error from earlier copy
+	if err := <-copyResult; err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to copy contents into multipart writer: %v", err)
+	}
+	return resp, nil
+}
+
+// UploadMany uploads the blobs of hs, in the order of hs, with a
+// single stat request for all of them and then, concurrently, uploads
+// of those the server doesn't have. It returns the first error.
+func (c *Client) UploadMany(hs []*UploadHandle) ([]*PutResult, error) {
+	var brs []*blobref.BlobRef
+	for _, h := range hs {
+		brs = append(brs, h.BlobRef)
+	}
+	have := make(map[string]int64)
+	ch := make(chan blobref.SizedBlobRef)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- c.StatBlobs(ch, brs, 0)
+		close(ch)
+	}()
+	for sb := range ch {
+		have[sb.BlobRef.String()] = sb.Size
+	}
+	if err := <-errch; err != nil {
+		return nil, err
+	}
+
+	results := make([]*PutResult, len(hs))
+	errs := make([]chan error, len(hs))
+	for i, h := range hs {
+		errs[i] = make(chan error, 1)
+		if size, ok := have[h.BlobRef.String()]; ok {
+			if closer, ok := h.Contents.(io.Closer); ok {
+				closer.Close()
+			}
+			results[i] = &PutResult{BlobRef: h.BlobRef, Size: size, Skipped: true}
+			errs[i] <- nil
+			continue
+		}
+		go func(i int, h *UploadHandle) {
+			pr, err := c.Upload(h)
+			results[i] = pr
+			errs[i] <- err
+		}(i, h)
+	}
+	var firstErr error
+	for _, errc := range errs {
+		if err := <-errc; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// dateMonthSamples is the maximum number of permanodes in a month's
+// folder.
+const dateMonthSamples = "1000"
+
+// dateDir implements fuse.Node and is a read-only folder of the
+// signer's recent permanodes by date, as the search handler's
+// calendar dates them: the folder of years, a year's folder of
+// months, or a month's folder of permanodes.
+type dateDir struct {
+	fs   *CamliFileSystem
+	date string // "", a year like "2011", or a month like "2011-07"
+}
+
+func (n *dateDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: os.ModeDir | 0500,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+func (n *dateDir) children() ([]namedNode, fuse.Error) {
+	q := url.Values{"samples": {"0"}}
+	switch len(n.date) {
+	case 0:
+		q.Set("granularity", "year")
+	case len("2006"):
+		q.Set("granularity", "month")
+		q.Set("date", n.date)
+	default:
+		q.Set("granularity", "month")
+		q.Set("date", n.date)
+		q.Set("samples", dateMonthSamples)
+	}
+	sr, err := n.fs.search("calendar", q)
+	if err != nil {
+		log.Printf("fs: searching calendar of %q: %v", n.date, err)
+		return nil, fuse.EIO
+	}
+
+	var kids []namedNode
+	for _, b := range sr.Calendar {
+		switch len(n.date) {
+		case 0:
+			kids = append(kids, namedNode{b.Date, &dateDir{fs: n.fs, date: b.Date}})
+		case len("2006"):
+			month := strings.TrimPrefix(b.Date, n.date+"-")
+			kids = append(kids, namedNode{month, &dateDir{fs: n.fs, date: b.Date}})
+		default:
+			kids = append(kids, n.fs.permanodeNodes(sr, b.Samples)...)
+		}
+	}
+	return uniqueNames(kids), nil
+}
+
+func (n *dateDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	kids, err := n.children()
+	if err != nil {
+		return nil, err
+	}
+	return dirents(kids), nil
+}
+
+func (n *dateDir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	kids, err := n.children()
+	if err != nil {
+		return nil, err
+	}
+	return lookupNamed(kids, name)
+}
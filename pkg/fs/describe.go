@@ -0,0 +1,191 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/search"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// searchResponse is the part of the search handler's responses the
+// filesystem uses.
+type searchResponse struct {
+	Recent []struct {
+		BlobRef string `json:"blobref"`
+		ModTime string `json:"modtime"`
+	} `json:"recent"`
+	WithAttr []struct {
+		Permanode string `json:"permanode"`
+	} `json:"withAttr"`
+	Calendar []struct {
+		Date    string   `json:"date"`
+		Count   int      `json:"count"`
+		Samples []string `json:"samples"`
+	} `json:"calendar"`
+	Meta map[string]*describedBlob `json:"meta"`
+}
+
+// describedBlob is a blob as described by the search handler.
+type describedBlob struct {
+	BlobRef   string `json:"blobRef"`
+	CamliType string `json:"camliType"`
+	Size      int64  `json:"size"`
+	Permanode *struct {
+		Attr map[string][]string `json:"attr"`
+	} `json:"permanode"`
+	File *search.FileInfo `json:"file"`
+}
+
+// search queries the search handler's endpoint.
+func (fs *CamliFileSystem) search(endpoint string, args url.Values) (*searchResponse, error) {
+	res, err := fs.client.QuerySearch(endpoint, args)
+	if err != nil {
+		return nil, err
+	}
+	// Round-tripping through JSON to get the response typed.
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	sr := new(searchResponse)
+	if err := json.Unmarshal(b, sr); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// describe describes the permanode pn and, as the search handler
+// does, its members and their camliContent.
+func (fs *CamliFileSystem) describe(pn *blobref.BlobRef) (*searchResponse, error) {
+	return fs.search("describe", url.Values{"blobref": {pn.String()}})
+}
+
+// attr returns the first value of the permanode's attribute, or "".
+func (b *describedBlob) attr(name string) string {
+	if b == nil || b.Permanode == nil || len(b.Permanode.Attr[name]) == 0 {
+		return ""
+	}
+	return b.Permanode.Attr[name][0]
+}
+
+// content returns the description of the permanode pn's camliContent,
+// or nil if it has none or it wasn't described.
+func (sr *searchResponse) content(pn string) *describedBlob {
+	cref := sr.Meta[pn].attr("camliContent")
+	if cref == "" {
+		return nil
+	}
+	return sr.Meta[cref]
+}
+
+// title returns the name of the permanode pn: its title, else the
+// file name of its camliContent, else its blobref.
+func (sr *searchResponse) title(pn string) string {
+	if t := sr.Meta[pn].attr("title"); t != "" {
+		return t
+	}
+	if c := sr.content(pn); c != nil && c.File != nil && c.File.FileName != "" {
+		return c.File.FileName
+	}
+	return pn
+}
+
+// permanodeNode returns the node of the permanode pn, a file if its
+// camliContent is a file, else a folder of its members. dir is the
+// folder pn is a member of, if any.
+func (fs *CamliFileSystem) permanodeNode(sr *searchResponse, pn *blobref.BlobRef, dir *permanodeDir) fuse.Node {
+	if c := sr.content(pn.String()); c != nil && c.File != nil {
+		return &permanodeFile{
+			fs:        fs,
+			dir:       dir,
+			name:      sr.title(pn.String()),
+			permanode: pn,
+			content:   blobref.Parse(c.BlobRef),
+			size:      c.File.Size,
+		}
+	}
+	return &permanodeDir{fs: fs, permanode: pn}
+}
+
+// permanodeNodes returns the nodes of the permanodes pns, named by
+// their titles, for a read-only folder.
+func (fs *CamliFileSystem) permanodeNodes(sr *searchResponse, pns []string) []namedNode {
+	var nodes []namedNode
+	for _, s := range pns {
+		if pn := blobref.Parse(s); pn != nil {
+			nodes = append(nodes, namedNode{sr.title(s), fs.permanodeNode(sr, pn, nil)})
+		}
+	}
+	return uniqueNames(nodes)
+}
+
+// fuseName makes s usable as a file name.
+func fuseName(s string) string {
+	s = strings.Replace(s, "/", "_", -1)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// A namedNode is an entry of a synthesized folder.
+type namedNode struct {
+	name string
+	node fuse.Node
+}
+
+// dirents returns the entries of the folder of nodes, whose names
+// must be unique.
+func dirents(nodes []namedNode) []fuse.Dirent {
+	ents := make([]fuse.Dirent, len(nodes))
+	for i, nn := range nodes {
+		ents[i] = fuse.Dirent{Name: nn.name}
+	}
+	return ents
+}
+
+// lookupNamed returns the node of nodes named name.
+func lookupNamed(nodes []namedNode, name string) (fuse.Node, fuse.Error) {
+	for _, nn := range nodes {
+		if nn.name == name {
+			return nn.node, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// uniqueNames makes the names of nodes usable as file names, and drops
+// the nodes whose name is already taken; the first node with a name
+// wins.
+func uniqueNames(nodes []namedNode) []namedNode {
+	seen := make(map[string]bool)
+	uniq := nodes[:0]
+	for _, nn := range nodes {
+		nn.name = fuseName(nn.name)
+		if !seen[nn.name] {
+			seen[nn.name] = true
+			uniq = append(uniq, nn)
+		}
+	}
+	return uniq
+}
@@ -23,11 +23,13 @@ import (
 	"io"
 	"log"
 	"os"
+	"runtime"
 	"sync"
 	"syscall"
 	"time"
 
 	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
 	"camlistore.org/pkg/lru"
 	"camlistore.org/pkg/schema"
 
@@ -44,6 +46,7 @@ var errNotDir = fuse.Errno(syscall.ENOTDIR)
 
 type CamliFileSystem struct {
 	fetcher blobref.SeekFetcher
+	client  *client.Client // or nil, if rooted at a directory
 	root    fuse.Node
 
 	// IgnoreOwners, if true, collapses all file ownership to the
@@ -68,9 +71,11 @@ func newCamliFileSystem(fetcher blobref.SeekFetcher) *CamliFileSystem {
 }
 
 // NewCamliFileSystem returns a filesystem with a generic base, from which users
-// can navigate by blobref, tag, date, etc.
-func NewCamliFileSystem(fetcher blobref.SeekFetcher) *CamliFileSystem {
+// can navigate by blobref, tag, date, etc. The client is used to
+// search the server and to upload and sign what is written.
+func NewCamliFileSystem(client *client.Client, fetcher blobref.SeekFetcher) *CamliFileSystem {
 	fs := newCamliFileSystem(fetcher)
+	fs.client = client
 	fs.root = &root{fs: fs} // root.go
 	return fs
 }
@@ -258,13 +263,14 @@ func (n *node) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
 		*schema.Superset
 		error
 	}
+	members, err := setss.StaticSetMembers(n.fs.fetcher)
+	if err != nil {
+		log.Printf("reading members of static set %s: %v", setRef, err)
+		return nil, fuse.EIO
+	}
 	var ssc []chan res
-	for _, member := range setss.Members {
-		memberRef := blobref.Parse(member)
-		if memberRef == nil {
-			log.Printf("invalid blobref of %q in static set %s", member, setRef)
-			return nil, fuse.EIO
-		}
+	for _, memberRef := range members {
+		memberRef := memberRef
 		ch := make(chan res, 1)
 		ssc = append(ssc, ch)
 		// TODO: move the cmd/camput/chanworker.go into its own package, and use it here. only
@@ -323,14 +329,36 @@ func (n *node) populateAttr() error {
 		n.attr.Blocks = 0 // TODO: set?
 	case "directory":
 		// Nothing special? Just prevent default case.
-	case "symlink":
+	case "symlink", "fifo", "socket":
 		// Nothing special? Just prevent default case.
+	case "char-device", "block-device":
+		n.attr.Rdev = fuseRdev(ss.DeviceMajor, ss.DeviceMinor)
 	default:
 		log.Printf("unknown attr ss.Type %q in populateAttr", ss.Type)
 	}
 	return nil
 }
 
+// fuseRdev encodes device numbers the way the kernel's FUSE expects.
+func fuseRdev(major, minor uint32) uint32 {
+	if runtime.GOOS == "darwin" {
+		return major<<24 | minor&0xffffff
+	}
+	return minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12
+}
+
+func (n *node) Readlink(req *fuse.ReadlinkRequest, intr fuse.Intr) (string, fuse.Error) {
+	ss, err := n.schema()
+	if err != nil {
+		log.Printf("readlink of %v: %v", n.blobref, err)
+		return "", fuse.EIO
+	}
+	if ss.Type != "symlink" {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return ss.SymlinkTargetString(), nil
+}
+
 func (fs *CamliFileSystem) Root() (fuse.Node, fuse.Error) {
 	return fs.root, nil
 }
@@ -0,0 +1,292 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// permanodeDir implements fuse.Node with a permanode whose
+// camliContent isn't a file. It is a folder of its camliMember
+// permanodes and, if its camliContent is a static directory, of that
+// directory's read-only entries.
+//
+// Files created in it are uploaded when closed, as file schemas that
+// are the camliContent of new member permanodes. Its folders are new
+// member permanodes, titled by their names.
+type permanodeDir struct {
+	fs        *CamliFileSystem
+	permanode *blobref.BlobRef
+}
+
+func (d *permanodeDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: os.ModeDir | 0700,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+// children returns the entries of d and d's description, looked up
+// anew each time so other clients' changes show.
+func (d *permanodeDir) children(intr fuse.Intr) ([]namedNode, *describedBlob, fuse.Error) {
+	sr, err := d.fs.describe(d.permanode)
+	if err != nil {
+		log.Printf("fs: describing %v: %v", d.permanode, err)
+		return nil, nil, fuse.EIO
+	}
+	des := sr.Meta[d.permanode.String()]
+	if des == nil || des.Permanode == nil {
+		log.Printf("fs: %v is not a described permanode", d.permanode)
+		return nil, nil, fuse.EIO
+	}
+	var kids []namedNode
+	for _, member := range des.Permanode.Attr["camliMember"] {
+		mdes := sr.Meta[member]
+		pn := blobref.Parse(member)
+		if pn == nil || mdes == nil || mdes.Permanode == nil {
+			continue
+		}
+		kids = append(kids, namedNode{sr.title(member), d.fs.permanodeNode(sr, pn, d)})
+	}
+	if c := sr.content(d.permanode.String()); c != nil && c.CamliType == "directory" {
+		static := &node{fs: d.fs, blobref: blobref.Parse(c.BlobRef)}
+		ents, err := static.ReadDir(intr)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ent := range ents {
+			n, err := static.Lookup(ent.Name, intr)
+			if err != nil {
+				return nil, nil, err
+			}
+			kids = append(kids, namedNode{ent.Name, n})
+		}
+	}
+	return uniqueNames(kids), des, nil
+}
+
+func (d *permanodeDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	kids, _, err := d.children(intr)
+	if err != nil {
+		return nil, err
+	}
+	return dirents(kids), nil
+}
+
+func (d *permanodeDir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	kids, _, err := d.children(intr)
+	if err != nil {
+		return nil, err
+	}
+	return lookupNamed(kids, name)
+}
+
+// sign signs and uploads the schema blob m, as the change named what.
+func (fs *CamliFileSystem) sign(what string, m schema.Map) (*blobref.BlobRef, fuse.Error) {
+	pr, err := fs.client.UploadAndSignMap(m)
+	if err != nil {
+		log.Printf("fs: uploading %s: %v", what, err)
+		return nil, fuse.EIO
+	}
+	return pr.BlobRef, nil
+}
+
+// newMember creates a permanode titled name, a member of d.
+func (d *permanodeDir) newMember(name string) (*blobref.BlobRef, fuse.Error) {
+	pn, err := d.fs.sign("permanode", schema.NewUnsignedPermanode())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.fs.sign("title claim", schema.NewSetAttributeClaim(pn, "title", name)); err != nil {
+		return nil, err
+	}
+	if _, err := d.fs.sign("camliMember claim", schema.NewAddAttributeClaim(d.permanode, "camliMember", pn.String())); err != nil {
+		return nil, err
+	}
+	return pn, nil
+}
+
+func (d *permanodeDir) exists(name string, intr fuse.Intr) (bool, fuse.Error) {
+	kids, _, err := d.children(intr)
+	if err != nil {
+		return false, err
+	}
+	_, err = lookupNamed(kids, name)
+	return err == nil, nil
+}
+
+func (d *permanodeDir) Mkdir(req *fuse.MkdirRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	if exists, err := d.exists(req.Name, intr); err != nil || exists {
+		if err == nil {
+			err = fuse.Errno(syscall.EEXIST)
+		}
+		return nil, err
+	}
+	pn, err := d.newMember(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &permanodeDir{fs: d.fs, permanode: pn}, nil
+}
+
+// Create makes a file whose permanode is created once it's written.
+func (d *permanodeDir) Create(req *fuse.CreateRequest, res *fuse.CreateResponse, intr fuse.Intr) (fuse.Node, fuse.Handle, fuse.Error) {
+	if exists, err := d.exists(req.Name, intr); err != nil || exists {
+		if err == nil {
+			err = fuse.Errno(syscall.EEXIST)
+		}
+		return nil, nil, err
+	}
+	f := &permanodeFile{fs: d.fs, dir: d, name: req.Name}
+	return f, &fileWriter{f}, nil
+}
+
+// Remove removes the member named by req from d. The member itself
+// is left as it is.
+func (d *permanodeDir) Remove(req *fuse.RemoveRequest, intr fuse.Intr) fuse.Error {
+	kids, des, err := d.children(intr)
+	if err != nil {
+		return err
+	}
+	n, err := lookupNamed(kids, req.Name)
+	if err != nil {
+		return err
+	}
+	var pn *blobref.BlobRef
+	switch n := n.(type) {
+	case *permanodeDir:
+		pn = n.permanode
+	case *permanodeFile:
+		pn = n.permanode
+	}
+	if pn == nil || !isMember(des, pn) {
+		return fuse.EPERM
+	}
+	m := schema.NewDelAttributeClaim(d.permanode, "camliMember")
+	m["value"] = pn.String()
+	_, err = d.fs.sign("camliMember claim", m)
+	return err
+}
+
+func isMember(des *describedBlob, pn *blobref.BlobRef) bool {
+	for _, member := range des.Permanode.Attr["camliMember"] {
+		if member == pn.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// permanodeFile implements fuse.Node with a permanode whose
+// camliContent is a file. Writing it, which replaces its contents,
+// uploads a new file schema and sets it as the camliContent.
+type permanodeFile struct {
+	fs   *CamliFileSystem
+	dir  *permanodeDir // the folder it's a member of, or nil
+	name string
+
+	mu        sync.Mutex
+	permanode *blobref.BlobRef // nil until first written, if created
+	content   *blobref.BlobRef // the file schema, or nil if none yet
+	size      int64
+}
+
+func (f *permanodeFile) Attr() fuse.Attr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mode := os.FileMode(0400)
+	if f.dir != nil {
+		mode = 0600
+	}
+	return fuse.Attr{
+		Mode: mode,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+		Size: uint64(f.size),
+	}
+}
+
+func (f *permanodeFile) Open(req *fuse.OpenRequest, res *fuse.OpenResponse, intr fuse.Intr) (fuse.Handle, fuse.Error) {
+	if req.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		if f.dir == nil {
+			return nil, fuse.EPERM
+		}
+		// Only whole rewrites are supported: the fuse package
+		// buffers writes after a truncation, into WriteAll.
+		return &fileWriter{f}, nil
+	}
+	f.mu.Lock()
+	content := f.content
+	f.mu.Unlock()
+	if content == nil {
+		return staticFileNode(""), nil
+	}
+	fr, err := schema.NewFileReader(f.fs.fetcher, content)
+	if err != nil {
+		log.Printf("fs: reading file %v: %v", content, err)
+		return nil, fuse.EIO
+	}
+	return &nodeReader{n: &node{fs: f.fs, blobref: content}, fr: fr}, nil
+}
+
+// fileWriter is a handle to a permanodeFile being rewritten.
+type fileWriter struct {
+	f *permanodeFile
+}
+
+// WriteAll uploads data as the new contents of the file.
+func (w *fileWriter) WriteAll(data []byte, intr fuse.Intr) fuse.Error {
+	f := w.f
+	fileRef, err := schema.WriteFileFromReader(f.fs.client, f.name, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("fs: uploading file %q: %v", f.name, err)
+		return fuse.EIO
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.permanode == nil {
+		pn, err := f.fs.sign("permanode", schema.NewUnsignedPermanode())
+		if err != nil {
+			return err
+		}
+		if _, err := f.fs.sign("camliContent claim", schema.NewSetAttributeClaim(pn, "camliContent", fileRef.String())); err != nil {
+			return err
+		}
+		if _, err := f.fs.sign("camliMember claim", schema.NewAddAttributeClaim(f.dir.permanode, "camliMember", pn.String())); err != nil {
+			return err
+		}
+		f.permanode = pn
+	} else {
+		if _, err := f.fs.sign("camliContent claim", schema.NewSetAttributeClaim(f.permanode, "camliContent", fileRef.String())); err != nil {
+			return err
+		}
+	}
+	f.content = fileRef
+	f.size = int64(len(data))
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"log"
+	"os"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// recentDir implements fuse.Node and is the read-only folder of the
+// most recently modified permanodes, named by their titles.
+type recentDir struct {
+	fs *CamliFileSystem
+}
+
+func (n *recentDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: os.ModeDir | 0500,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+func (n *recentDir) recent() ([]namedNode, fuse.Error) {
+	sr, err := n.fs.search("recent", nil)
+	if err != nil {
+		log.Printf("fs: searching recent permanodes: %v", err)
+		return nil, fuse.EIO
+	}
+	var pns []string
+	for _, r := range sr.Recent {
+		pns = append(pns, r.BlobRef)
+	}
+	return n.fs.permanodeNodes(sr, pns), nil
+}
+
+func (n *recentDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	recent, err := n.recent()
+	if err != nil {
+		return nil, err
+	}
+	return dirents(recent), nil
+}
+
+func (n *recentDir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	recent, err := n.recent()
+	if err != nil {
+		return nil, err
+	}
+	return lookupNamed(recent, name)
+}
@@ -43,6 +43,8 @@ func (n *root) Attr() fuse.Attr {
 func (n *root) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
 	return []fuse.Dirent{
 		{Name: "WELCOME.txt"},
+		{Name: "roots"},
+		{Name: "recent"},
 		{Name: "tag"},
 		{Name: "date"},
 		{Name: "sha1-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"},
@@ -54,9 +56,18 @@ func (n *root) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
 	case ".quitquitquit":
 		log.Fatalf("Shutting down due to root .quitquitquit lookup.")
 	case "WELCOME.txt":
-		return staticFileNode("Welcome to CamlistoreFS.\n\nFor now you can only cd into a sha1-xxxx directory, if you know the blobref of a directory or a file.\n"), nil
-	case "tag", "date":
-		return notImplementDirNode{}, nil
+		return staticFileNode("Welcome to CamlistoreFS.\n\n" +
+			"Your roots are in roots, where each folder is a permanode; files and folders made in them are uploaded as permanodes too.\n" +
+			"The most recently modified permanodes are in recent, and they are also in tag, by tag, and in date, by year and month.\n" +
+			"You can also cd into a sha1-xxxx directory, if you know the blobref of a directory or a file.\n"), nil
+	case "roots":
+		return &rootsDir{fs: n.fs}, nil
+	case "recent":
+		return &recentDir{fs: n.fs}, nil
+	case "tag":
+		return &tagDir{fs: n.fs}, nil
+	case "date":
+		return &dateDir{fs: n.fs}, nil
 	case "sha1-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx":
 		return notImplementDirNode{}, nil
 	}
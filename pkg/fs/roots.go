@@ -0,0 +1,108 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"syscall"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// rootsDir implements fuse.Node and is the folder of the roots: the
+// signer's permanodes with a camliRoot attribute, named by it. Its
+// folders are new roots.
+type rootsDir struct {
+	fs *CamliFileSystem
+}
+
+func (n *rootsDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: os.ModeDir | 0700,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+func (n *rootsDir) roots() ([]namedNode, fuse.Error) {
+	signer := n.fs.client.SignerPublicKeyBlobref()
+	if signer == nil {
+		log.Printf("fs: no public key configured to find the roots of")
+		return nil, fuse.EIO
+	}
+	sr, err := n.fs.search("permanodeattr", url.Values{
+		"signer": {signer.String()},
+		"attr":   {"camliRoot"},
+	})
+	if err != nil {
+		log.Printf("fs: searching roots: %v", err)
+		return nil, fuse.EIO
+	}
+	var roots []namedNode
+	for _, wa := range sr.WithAttr {
+		pn := blobref.Parse(wa.Permanode)
+		name := sr.Meta[wa.Permanode].attr("camliRoot")
+		if pn == nil || name == "" {
+			continue
+		}
+		roots = append(roots, namedNode{name, &permanodeDir{fs: n.fs, permanode: pn}})
+	}
+	return uniqueNames(roots), nil
+}
+
+func (n *rootsDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	roots, err := n.roots()
+	if err != nil {
+		return nil, err
+	}
+	return dirents(roots), nil
+}
+
+func (n *rootsDir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	roots, err := n.roots()
+	if err != nil {
+		return nil, err
+	}
+	return lookupNamed(roots, name)
+}
+
+// Mkdir creates a new root, also titled by its name.
+func (n *rootsDir) Mkdir(req *fuse.MkdirRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	roots, err := n.roots()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := lookupNamed(roots, req.Name); err == nil {
+		return nil, fuse.Errno(syscall.EEXIST)
+	}
+	pn, err := n.fs.sign("permanode", schema.NewUnsignedPermanode())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := n.fs.sign("camliRoot claim", schema.NewSetAttributeClaim(pn, "camliRoot", req.Name)); err != nil {
+		return nil, err
+	}
+	if _, err := n.fs.sign("title claim", schema.NewSetAttributeClaim(pn, "title", req.Name)); err != nil {
+		return nil, err
+	}
+	return &permanodeDir{fs: n.fs, permanode: pn}, nil
+}
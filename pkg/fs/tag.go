@@ -0,0 +1,109 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"sort"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// tagDir implements fuse.Node and is a read-only folder of the
+// signer's tagged permanodes. With no tag, it is the folder of all
+// the tags, each a tagDir of the permanodes with that tag.
+type tagDir struct {
+	fs  *CamliFileSystem
+	tag string // or "" for the folder of tags
+}
+
+func (n *tagDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: os.ModeDir | 0500,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+func (n *tagDir) children() ([]namedNode, fuse.Error) {
+	signer := n.fs.client.SignerPublicKeyBlobref()
+	if signer == nil {
+		log.Printf("fs: no public key configured to find the tags of")
+		return nil, fuse.EIO
+	}
+	q := url.Values{
+		"signer": {signer.String()},
+		"attr":   {"tag"},
+	}
+	if n.tag != "" {
+		q.Set("value", n.tag)
+	}
+	sr, err := n.fs.search("permanodeattr", q)
+	if err != nil {
+		log.Printf("fs: searching tag %q: %v", n.tag, err)
+		return nil, fuse.EIO
+	}
+
+	// The index also finds permanodes by their former tags, so
+	// their current ones are checked.
+	tagged := make(map[string]bool)
+	var pns []string
+	for _, wa := range sr.WithAttr {
+		des := sr.Meta[wa.Permanode]
+		if des == nil || des.Permanode == nil {
+			continue
+		}
+		for _, tag := range des.Permanode.Attr["tag"] {
+			tagged[tag] = true
+			if tag == n.tag {
+				pns = append(pns, wa.Permanode)
+				break
+			}
+		}
+	}
+	if n.tag != "" {
+		return n.fs.permanodeNodes(sr, pns), nil
+	}
+	tags := make([]string, 0, len(tagged))
+	for tag := range tagged {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	var kids []namedNode
+	for _, tag := range tags {
+		kids = append(kids, namedNode{tag, &tagDir{fs: n.fs, tag: tag}})
+	}
+	return uniqueNames(kids), nil
+}
+
+func (n *tagDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	kids, err := n.children()
+	if err != nil {
+		return nil, err
+	}
+	return dirents(kids), nil
+}
+
+func (n *tagDir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	kids, err := n.children()
+	if err != nil {
+		return nil, err
+	}
+	return lookupNamed(kids, name)
+}
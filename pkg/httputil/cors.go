@@ -0,0 +1,139 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS is a Cross-Origin Resource Sharing policy, letting pages from
+// other origins make requests to a handler.
+type CORS struct {
+	// Origins are the allowed origins, such as
+	// "https://app.example.com", or "*" for any.
+	Origins []string
+	// Methods are the allowed methods.
+	Methods []string
+	// Headers are the request headers allowed, or "*" for any.
+	Headers []string
+	// ExposeHeaders are the response headers scripts may read.
+	ExposeHeaders []string
+	// MaxAge is how long, in seconds, browsers may cache a
+	// preflight's answer. Zero means not to say.
+	MaxAge int
+	// Credentials is whether requests may carry cookies and HTTP
+	// authentication. It must not be set along with the "*" origin.
+	Credentials bool
+}
+
+func (c *CORS) allowedOrigin(origin string) bool {
+	for _, o := range c.Origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) allowedMethod(method string) bool {
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders returns the allowed headers of a preflight that asked
+// for the comma-separated requested, and whether they're all allowed.
+func (c *CORS) allowedHeaders(requested string) (string, bool) {
+	allowed := make(map[string]bool)
+	for _, h := range c.Headers {
+		if h == "*" {
+			return requested, true
+		}
+		allowed[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !allowed[http.CanonicalHeaderKey(h)] {
+			return "", false
+		}
+	}
+	return strings.Join(c.Headers, ", "), true
+}
+
+// Handler returns h, answering preflight requests and adding CORS
+// headers to the responses to requests from allowed origins. Since
+// browsers send preflight requests without credentials, they're
+// answered without calling h.
+func (c *CORS) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		rw.Header().Add("Vary", "Origin")
+		preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+		if !c.allowedOrigin(origin) {
+			if preflight {
+				ForbiddenError(rw, "Origin %q not allowed", origin)
+				return
+			}
+			h.ServeHTTP(rw, req)
+			return
+		}
+		hdr := rw.Header()
+		if c.Credentials || !c.allowedOrigin("*") {
+			hdr.Set("Access-Control-Allow-Origin", origin)
+		} else {
+			hdr.Set("Access-Control-Allow-Origin", "*")
+		}
+		if c.Credentials {
+			hdr.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if len(c.ExposeHeaders) > 0 {
+				hdr.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+			}
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		method := req.Header.Get("Access-Control-Request-Method")
+		if !c.allowedMethod(method) {
+			ForbiddenError(rw, "Method %q not allowed", method)
+			return
+		}
+		headers, ok := c.allowedHeaders(req.Header.Get("Access-Control-Request-Headers"))
+		if !ok {
+			ForbiddenError(rw, "Requested headers not allowed")
+			return
+		}
+		hdr.Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+		if headers != "" {
+			hdr.Set("Access-Control-Allow-Headers", headers)
+		}
+		if c.MaxAge > 0 {
+			hdr.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
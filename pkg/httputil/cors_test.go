@@ -0,0 +1,82 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	c := &CORS{
+		Origins: []string{"https://app.example.com"},
+		Methods: []string{"GET", "POST"},
+		Headers: []string{"Authorization", "Content-Type"},
+		MaxAge:  600,
+	}
+	served := false
+	h := c.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		served = true
+	}))
+	tests := []struct {
+		method, origin string
+		reqMethod      string // Access-Control-Request-Method
+		reqHeaders     string
+		wantCode       int
+		wantServed     bool
+		wantOrigin     string
+		wantMaxAge     string
+	}{
+		{method: "GET", wantCode: 200, wantServed: true},
+		{method: "GET", origin: "https://app.example.com", wantCode: 200, wantServed: true,
+			wantOrigin: "https://app.example.com"},
+		{method: "GET", origin: "https://evil.example.com", wantCode: 200, wantServed: true},
+		{method: "OPTIONS", origin: "https://app.example.com", reqMethod: "POST",
+			reqHeaders: "content-type, authorization", wantCode: 204,
+			wantOrigin: "https://app.example.com", wantMaxAge: "600"},
+		{method: "OPTIONS", origin: "https://app.example.com", reqMethod: "DELETE", wantCode: 403,
+			wantOrigin: "https://app.example.com"},
+		{method: "OPTIONS", origin: "https://app.example.com", reqMethod: "POST",
+			reqHeaders: "X-Bogus", wantCode: 403, wantOrigin: "https://app.example.com"},
+		{method: "OPTIONS", origin: "https://evil.example.com", reqMethod: "GET", wantCode: 403},
+	}
+	for i, tt := range tests {
+		served = false
+		req, _ := http.NewRequest(tt.method, "http://example.com/bs/camli/enumerate-blobs", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.reqMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", tt.reqMethod)
+		}
+		if tt.reqHeaders != "" {
+			req.Header.Set("Access-Control-Request-Headers", tt.reqHeaders)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantCode || served != tt.wantServed {
+			t.Errorf("%d. code = %d, served = %v; want %d, %v", i, rec.Code, served, tt.wantCode, tt.wantServed)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+			t.Errorf("%d. Allow-Origin = %q; want %q", i, got, tt.wantOrigin)
+		}
+		if got := rec.Header().Get("Access-Control-Max-Age"); got != tt.wantMaxAge {
+			t.Errorf("%d. Max-Age = %q; want %q", i, got, tt.wantMaxAge)
+		}
+	}
+}
@@ -123,7 +123,7 @@ func BaseURL(urlStr string, req *http.Request) (string, error) {
 	}
 	prefix := path.Clean(defaultURL.Path)
 	scheme := "http"
-	if req.TLS != nil {
+	if IsSecure(req) {
 		scheme = "https"
 	}
 	host := req.Host
@@ -147,7 +147,7 @@ func RequestTargetPort(req *http.Request) int {
 			return int(port)
 		}
 	}
-	if req.TLS != nil {
+	if IsSecure(req) {
 		return 443
 	}
 	return 80
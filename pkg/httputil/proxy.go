@@ -0,0 +1,135 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks of the reverse proxies, such as
+// nginx, whose X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host headers say who the client is and which URL it
+// requested.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a list of CIDRs, such as "10.0.0.0/8",
+// or single addresses.
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	var tp TrustedProxies
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			tp = append(tp, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network %q: %v", s, err)
+		}
+		tp = append(tp, n)
+	}
+	return tp, nil
+}
+
+func (tp TrustedProxies) trusted(ip net.IP) bool {
+	for _, n := range tp {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// firstValue returns the first of the comma-separated values of the
+// header, as the client-nearest proxy set it.
+func firstValue(h http.Header, name string) string {
+	v := h.Get(name)
+	if i := strings.Index(v, ","); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// FixRequest makes req, if it came from a trusted proxy, look like the
+// client's request to the proxy: its RemoteAddr becomes the client's,
+// per X-Forwarded-For, which is then removed, and its Host that of
+// X-Forwarded-Host. The X-Forwarded-Proto and X-Forwarded-Host of
+// requests not from trusted proxies are removed, so IsSecure and other
+// code can trust the ones left. Their X-Forwarded-For is kept, for
+// IsProxied.
+func (tp TrustedProxies) FixRequest(req *http.Request) {
+	h := req.Header
+	if !tp.trusted(remoteIP(req.RemoteAddr)) {
+		h.Del("X-Forwarded-Proto")
+		h.Del("X-Forwarded-Host")
+		return
+	}
+	if ff := h.Get("X-Forwarded-For"); ff != "" {
+		h.Del("X-Forwarded-For")
+		// Each proxy appends the address it got the request from:
+		// the client is the last one not a trusted proxy.
+		hops := strings.Split(ff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			req.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+			if !tp.trusted(ip) {
+				break
+			}
+		}
+	}
+	if host := firstValue(h, "X-Forwarded-Host"); host != "" {
+		req.Host = host
+	}
+	if proto := firstValue(h, "X-Forwarded-Proto"); proto != "" {
+		h.Set("X-Forwarded-Proto", strings.ToLower(proto))
+	}
+}
+
+// IsSecure reports whether the client made req over HTTPS, directly or
+// through a trusted proxy; see TrustedProxies.
+func IsSecure(req *http.Request) bool {
+	return req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// IsProxied reports whether req, once fixed by FixRequest, came
+// through a proxy that isn't trusted, per its X-Forwarded-For or
+// Forwarded header. Its RemoteAddr is then the proxy's, which says
+// nothing of the client's.
+func IsProxied(req *http.Request) bool {
+	return req.Header.Get("X-Forwarded-For") != "" || req.Header.Get("Forwarded") != ""
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	tp, err := ParseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseTrustedProxies([]string{"bogus"}); err == nil {
+		t.Errorf("ParseTrustedProxies of a bogus address succeeded")
+	}
+	tests := []struct {
+		remote, ff, fhost, fproto string
+		wantRemote, wantHost      string
+		wantSecure, wantProxied   bool
+	}{
+		// Untrusted: headers ignored.
+		{"192.0.2.1:1234", "203.0.113.5", "evil.example.com", "https",
+			"192.0.2.1:1234", "camli.internal:3179", false, true},
+		// Through nginx on localhost.
+		{"127.0.0.1:5555", "203.0.113.5", "camli.example.com", "https",
+			"203.0.113.5:0", "camli.example.com", true, false},
+		// Through two trusted proxies, with a spoofed first hop.
+		{"10.1.1.1:80", "1.2.3.4, 203.0.113.5, 10.2.2.2", "", "http",
+			"203.0.113.5:0", "camli.internal:3179", false, false},
+		// Trusted, but no forwarding headers.
+		{"127.0.0.1:5555", "", "", "",
+			"127.0.0.1:5555", "camli.internal:3179", false, false},
+	}
+	for i, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://camli.internal:3179/ui/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.ff != "" {
+			req.Header.Set("X-Forwarded-For", tt.ff)
+		}
+		if tt.fhost != "" {
+			req.Header.Set("X-Forwarded-Host", tt.fhost)
+		}
+		if tt.fproto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.fproto)
+		}
+		tp.FixRequest(req)
+		if req.RemoteAddr != tt.wantRemote || req.Host != tt.wantHost || IsSecure(req) != tt.wantSecure ||
+			IsProxied(req) != tt.wantProxied {
+			t.Errorf("%d. got remote %q, host %q, secure %v, proxied %v; want %q, %q, %v, %v", i,
+				req.RemoteAddr, req.Host, IsSecure(req), IsProxied(req),
+				tt.wantRemote, tt.wantHost, tt.wantSecure, tt.wantProxied)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimitedTransport wraps another RoundTripper (or uses the
+// default one) and limits the rate at which the bodies of all its
+// requests, together, are sent.
+type RateLimitedTransport struct {
+	// Transport optionally specifies the transport to use.
+	// If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// BytesPerSecond is the rate limit. If zero, there's none.
+	BytesPerSecond int64
+
+	mu   sync.Mutex
+	next time.Time // when the bytes sent so far are due
+}
+
+func (t *RateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if req.Body == nil || t.BytesPerSecond <= 0 {
+		return rt.RoundTrip(req)
+	}
+	// A RoundTripper mustn't modify the request.
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.Body = &rateLimitedBody{t: t, body: req.Body}
+	return rt.RoundTrip(req2)
+}
+
+// wait sleeps until n more bytes may be sent.
+func (t *RateLimitedTransport) wait(n int) {
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		// Idle time isn't saved up for later bursts.
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(t.BytesPerSecond))
+	d := t.next.Sub(now)
+	t.mu.Unlock()
+	time.Sleep(d)
+}
+
+type rateLimitedBody struct {
+	t    *RateLimitedTransport
+	body io.ReadCloser
+}
+
+func (b *rateLimitedBody) Read(p []byte) (n int, err error) {
+	// Small reads, so the sleeps are short and the rate smooth.
+	if max := int(b.t.BytesPerSecond / 10); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err = b.body.Read(p)
+	if n > 0 {
+		b.t.wait(n)
+	}
+	return
+}
+
+func (b *rateLimitedBody) Close() error {
+	return b.body.Close()
+}
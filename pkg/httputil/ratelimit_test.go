@@ -0,0 +1,58 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(ioutil.Discard, req.Body)
+	}))
+	defer ts.Close()
+
+	// Two concurrent uploads of 50 kB each, at 200 kB/s together,
+	// should take about half a second.
+	const size = 50 << 10
+	c := &http.Client{Transport: &RateLimitedTransport{BytesPerSecond: 200 << 10}}
+	t0 := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.Post(ts.URL, "application/octet-stream", strings.NewReader(strings.Repeat("x", size)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(t0); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("uploads took %v; want about 500ms", d)
+	}
+}
@@ -168,6 +168,77 @@ func imageDebug(msg string) {
 	}
 }
 
+// exifOrientation returns the rotation and flip that the EXIF
+// metadata read from r asks for. ok is false if there's no EXIF
+// orientation.
+func exifOrientation(r io.Reader) (angle int, flipMode FlipDirection, ok bool) {
+	ex, err := exif.Decode(r)
+	if err != nil {
+		imageDebug("No valid EXIF; will not rotate or flip.")
+		return
+	}
+	tag, err := ex.Get(exif.Orientation)
+	if err != nil {
+		imageDebug("No \"Orientation\" tag in EXIF; will not rotate or flip.")
+		return
+	}
+	switch tag.Val[1] {
+	case 1:
+		// do nothing
+	case 2:
+		flipMode = 2
+	case 3:
+		angle = 180
+	case 4:
+		angle = 180
+		flipMode = 2
+	case 5:
+		angle = -90
+		flipMode = 2
+	case 6:
+		angle = -90
+	case 7:
+		angle = 90
+		flipMode = 2
+	case 8:
+		angle = 90
+	}
+	return angle, flipMode, true
+}
+
+// Config is like image.Config, but with the dimensions corrected
+// for the image's EXIF orientation.
+type Config struct {
+	Width, Height int
+	Format        string
+
+	// Modified is whether Decode with default options rotates
+	// or flips the image.
+	Modified bool
+}
+
+// DecodeConfig returns the format and dimensions of the image in r,
+// as it would be returned by Decode with default options.
+func DecodeConfig(r io.Reader) (Config, error) {
+	var buf bytes.Buffer
+	tr := io.TeeReader(io.LimitReader(r, 2<<20), &buf)
+	angle, flipMode, _ := exifOrientation(tr)
+	conf, format, err := image.DecodeConfig(io.MultiReader(&buf, r))
+	if err != nil {
+		return Config{}, err
+	}
+	c := Config{
+		Width:    conf.Width,
+		Height:   conf.Height,
+		Format:   format,
+		Modified: angle != 0 || flipMode != 0,
+	}
+	if angle == 90 || angle == -90 {
+		c.Width, c.Height = c.Height, c.Width
+	}
+	return c, nil
+}
+
 // Decode decodes an image from r using the provided decoding options.
 // The string returned is the format name returned by image.Decode.
 // If opts is nil, the defaults are used.
@@ -177,38 +248,11 @@ func Decode(r io.Reader, opts *DecodeOpts) (image.Image, string, error) {
 	angle := 0
 	flipMode := FlipDirection(0)
 	if opts.useEXIF() {
-		ex, err := exif.Decode(tr)
-		if err != nil {
-			imageDebug("No valid EXIF; will not rotate or flip.")
-			return image.Decode(io.MultiReader(&buf, r))
-		}
-		tag, err := ex.Get(exif.Orientation)
-		if err != nil {
-			imageDebug("No \"Orientation\" tag in EXIF; will not rotate or flip.")
+		var ok bool
+		angle, flipMode, ok = exifOrientation(tr)
+		if !ok {
 			return image.Decode(io.MultiReader(&buf, r))
 		}
-		orient := tag.Val[1]
-		switch orient {
-		case 1:
-			// do nothing
-		case 2:
-			flipMode = 2
-		case 3:
-			angle = 180
-		case 4:
-			angle = 180
-			flipMode = 2
-		case 5:
-			angle = -90
-			flipMode = 2
-		case 6:
-			angle = -90
-		case 7:
-			angle = 90
-			flipMode = 2
-		case 8:
-			angle = 90
-		}
 	} else {
 		if opts.forcedRotate() {
 			var ok bool
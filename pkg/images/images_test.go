@@ -133,3 +133,31 @@ func TestForcedCorrection(t *testing.T) {
 		}
 	}
 }
+
+// TestDecodeConfig checks that DecodeConfig reports the dimensions
+// of the EXIF-corrected image, as Decode returns it.
+func TestDecodeConfig(t *testing.T) {
+	straightF := straightFImage(t)
+	for _, v := range sampleNames(t) {
+		if !strings.Contains(v, "exif") {
+			continue
+		}
+		name := path.Join(datadir, v)
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf, err := DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if conf.Width != straightF.Bounds().Dx() || conf.Height != straightF.Bounds().Dy() {
+			t.Errorf("%s: DecodeConfig = %dx%d; want %dx%d", name, conf.Width, conf.Height,
+				straightF.Bounds().Dx(), straightF.Bounds().Dy())
+		}
+		if want := v != "f1-exif.jpg"; conf.Modified != want {
+			t.Errorf("%s: Modified = %v; want %v", name, conf.Modified, want)
+		}
+	}
+}
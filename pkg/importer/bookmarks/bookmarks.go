@@ -0,0 +1,317 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bookmarks imports bookmarks from Pinboard, Delicious, or a
+// browser's bookmarks export file.
+//
+// Its importerArgs are the "source": "pinboard", with the account's
+// API "authToken" ("user:TOKEN"); "delicious", with its "username"
+// and "password"; or "file", with the "file" path, on the server, of
+// a bookmarks file exported by a browser, in the Netscape bookmark
+// format. With "archivePages" true, a snapshot of each bookmarked
+// page is stored too:
+//
+//   "importerArgs": {
+//       "source": "pinboard",
+//       "authToken": "user:0123456789ABCDEF",
+//       "archivePages": true
+//   }
+//
+// Each bookmark is a permanode, with the "url", "title",
+// "description", "tag" and "startDate" (when bookmarked) attributes,
+// and its page's snapshot, if any, as camliContent. The bookmarks
+// are the members of the root permanode's "bookmarks" path. Only the
+// bookmarks made or changed since the last import are listed from
+// Pinboard and Delicious.
+package bookmarks
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/importer"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/schema"
+)
+
+// The API endpoints of the sources, which share Delicious's API.
+var (
+	pinboardURL  = "https://api.pinboard.in/v1/"
+	deliciousURL = "https://api.del.icio.us/v1/"
+)
+
+// maxSnapshotSize is the size of the largest page archived.
+const maxSnapshotSize = 10 << 20
+
+func init() {
+	importer.Register("bookmarks", newFromConfig)
+}
+
+type imp struct {
+	host           *importer.Host
+	source         string
+	authToken      string // for pinboard
+	user, password string // for delicious
+	file           string
+	archive        bool
+}
+
+func newFromConfig(host *importer.Host, conf jsonconfig.Obj) (importer.Importer, error) {
+	im := &imp{
+		host:   host,
+		source: conf.RequiredString("source"),
+	}
+	switch im.source {
+	case "pinboard":
+		im.authToken = conf.RequiredString("authToken")
+	case "delicious":
+		im.user = conf.RequiredString("username")
+		im.password = conf.RequiredString("password")
+	case "file":
+		im.file = conf.RequiredString("file")
+	default:
+		return nil, fmt.Errorf(`unknown bookmarks source %q; want "pinboard", "delicious" or "file"`, im.source)
+	}
+	im.archive = conf.OptionalBool("archivePages", false)
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+// A bookmark is a bookmark of any source.
+type bookmark struct {
+	URL         string
+	Title       string
+	Description string
+	Tags        []string
+	Time        time.Time // or zero if unknown
+}
+
+// apiPosts are the posts of the Delicious API.
+type apiPosts struct {
+	Posts []struct {
+		Href        string `xml:"href,attr"`
+		Description string `xml:"description,attr"` // the title
+		Extended    string `xml:"extended,attr"`
+		Tag         string `xml:"tag,attr"` // space-separated
+		Time        string `xml:"time,attr"`
+	} `xml:"post"`
+}
+
+// parseAPIPosts reads the bookmarks of a posts/all response.
+func parseAPIPosts(r io.Reader) ([]*bookmark, error) {
+	var posts apiPosts
+	if err := xml.NewDecoder(r).Decode(&posts); err != nil {
+		return nil, err
+	}
+	var bms []*bookmark
+	for _, p := range posts.Posts {
+		bm := &bookmark{
+			URL:         p.Href,
+			Title:       p.Description,
+			Description: p.Extended,
+			Tags:        strings.Fields(p.Tag),
+		}
+		if t, err := time.Parse(time.RFC3339, p.Time); err == nil {
+			bm.Time = t
+		}
+		bms = append(bms, bm)
+	}
+	return bms, nil
+}
+
+// fetchAPIPosts lists the bookmarks made or changed since the cursor
+// from, if not "".
+func (im *imp) fetchAPIPosts(from string) ([]*bookmark, error) {
+	args := url.Values{}
+	base := deliciousURL
+	if im.source == "pinboard" {
+		base = pinboardURL
+		args.Set("auth_token", im.authToken)
+	}
+	if from != "" {
+		args.Set("fromdt", from)
+	}
+	req, err := http.NewRequest("GET", base+"posts/all?"+args.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if im.source == "delicious" {
+		req.SetBasicAuth(im.user, im.password)
+	}
+	res, err := im.host.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: listing bookmarks: %s", im.source, res.Status)
+	}
+	bms, err := parseAPIPosts(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: listing bookmarks: %v", im.source, err)
+	}
+	return bms, nil
+}
+
+func (im *imp) Run(ctx *importer.RunContext) error {
+	root, err := im.host.RootObject()
+	if err != nil {
+		return err
+	}
+	if err := root.SetAttr("title", "Bookmarks ("+im.source+")"); err != nil {
+		return err
+	}
+	list, err := root.ChildPathObject("bookmarks")
+	if err != nil {
+		return err
+	}
+
+	ctx.SetStatus("listing bookmarks")
+	var bms []*bookmark
+	var from string
+	if im.source == "file" {
+		f, err := os.Open(im.file)
+		if err != nil {
+			return err
+		}
+		bms, err = parseNetscape(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", im.file, err)
+		}
+	} else {
+		if from, err = ctx.Cursor("time"); err != nil {
+			return err
+		}
+		if bms, err = im.fetchAPIPosts(from); err != nil {
+			return err
+		}
+	}
+
+	latest := from
+	for i, bm := range bms {
+		if ctx.Stopped() {
+			return importer.ErrInterrupted
+		}
+		ctx.SetStatus("importing bookmark %d of %d", i+1, len(bms))
+		o, err := im.importBookmark(bm)
+		if err != nil {
+			return fmt.Errorf("bookmark %s: %v", bm.URL, err)
+		}
+		if err := list.AddAttr("camliMember", o.PermanodeRef().String()); err != nil {
+			return err
+		}
+		ctx.AddItems(1)
+		if !bm.Time.IsZero() {
+			if t := bm.Time.UTC().Format(time.RFC3339); t > latest {
+				latest = t
+			}
+		}
+	}
+	if im.source != "file" && latest != from {
+		return ctx.SetCursor("time", latest)
+	}
+	return nil
+}
+
+func (im *imp) importBookmark(bm *bookmark) (*importer.Object, error) {
+	o, err := im.host.PlannedObject("bookmark:" + bm.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.SetAttrs(
+		"url", bm.URL,
+		"title", bm.Title,
+		"description", bm.Description,
+	); err != nil {
+		return nil, err
+	}
+	if !bm.Time.IsZero() {
+		if err := o.SetAttr("startDate", schema.RFC3339FromTime(bm.Time)); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.SetAttrValues("tag", bm.Tags); err != nil {
+		return nil, err
+	}
+	if im.archive && o.Attr("camliContent") == "" {
+		// A page that can't be archived doesn't fail the import;
+		// it's tried again when the bookmark is imported again.
+		br, err := im.archivePage(bm.URL)
+		if err != nil {
+			log.Printf("bookmarks: not archiving %s: %v", bm.URL, err)
+		} else if err := o.SetAttr("camliContent", br); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// archivePage stores the page at u as a file, and returns its
+// blobref.
+func (im *imp) archivePage(u string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+		return "", fmt.Errorf("can't archive %q", u)
+	}
+	res, err := im.host.HTTPClient().Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", u, res.Status)
+	}
+	page, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSnapshotSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(page) > maxSnapshotSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", u, maxSnapshotSize)
+	}
+	fileMap := schema.NewFileMap(snapshotName(pu, res.Header.Get("Content-Type")))
+	fileMap["unixMtime"] = schema.RFC3339FromTime(time.Now())
+	br, err := schema.WriteFileMap(im.host.Target(), fileMap, bytes.NewReader(page))
+	if err != nil {
+		return "", err
+	}
+	return br.String(), nil
+}
+
+// snapshotName returns the file name of the snapshot of the page at
+// u, of the given content type.
+func snapshotName(u *url.URL, contentType string) string {
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = "index"
+	}
+	if strings.HasPrefix(contentType, "text/html") && path.Ext(name) == "" {
+		name += ".html"
+	}
+	return u.Host + "-" + name
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bookmarks
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/importer/importertest"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+func TestParseAPIPosts(t *testing.T) {
+	bms, err := parseAPIPosts(strings.NewReader(`<?xml version="1.0" encoding="UTF-8" ?>
+<posts user="joe">
+  <post href="http://camlistore.org/" time="2013-04-20T03:16:20Z" description="Camlistore" extended="Content-addressable storage" tag="go storage" hash="abc" />
+  <post href="http://golang.org/" time="2013-04-19T10:00:00Z" description="Go &amp; more" extended="" tag="" />
+</posts>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*bookmark{
+		{
+			URL:         "http://camlistore.org/",
+			Title:       "Camlistore",
+			Description: "Content-addressable storage",
+			Tags:        []string{"go", "storage"},
+			Time:        time.Date(2013, 4, 20, 3, 16, 20, 0, time.UTC),
+		},
+		{
+			URL:   "http://golang.org/",
+			Title: "Go & more",
+			Tags:  []string{},
+			Time:  time.Date(2013, 4, 19, 10, 0, 0, 0, time.UTC),
+		},
+	}
+	if len(bms) != len(want) {
+		t.Fatalf("got %d bookmarks; want %d", len(bms), len(want))
+	}
+	for i, bm := range bms {
+		if !reflect.DeepEqual(bm, want[i]) {
+			t.Errorf("bookmark %d = %+v; want %+v", i, bm, want[i])
+		}
+	}
+}
+
+func TestParseNetscapeNotBookmarks(t *testing.T) {
+	if _, err := parseNetscape(strings.NewReader("<html></html>")); err == nil {
+		t.Error("parsing a non-bookmarks file succeeded")
+	}
+}
+
+func TestSnapshotName(t *testing.T) {
+	tests := []struct {
+		url, ctype, want string
+	}{
+		{"http://camlistore.org/", "text/html; charset=utf-8", "camlistore.org-index.html"},
+		{"http://golang.org/doc/effective_go.html", "text/html", "golang.org-effective_go.html"},
+		{"http://example.com/paper.pdf", "application/pdf", "example.com-paper.pdf"},
+		{"http://example.com/about", "text/plain", "example.com-about"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := snapshotName(u, tt.ctype); got != tt.want {
+			t.Errorf("snapshotName(%q, %q) = %q; want %q", tt.url, tt.ctype, got, tt.want)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	f, err := ioutil.TempFile("", "bookmarks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1366427000">Go</H3>
+    <DL><p>
+        <DT><A HREF="http://golang.org/" ADD_DATE="1366365600" TAGS="go, programming">The Go &amp; Programming Language</A>
+        <DD>Go's site
+        <DT><A HREF="place:sort=8&amp;maxResults=10">Most Visited</A>
+    </DL><p>
+    <DT><a href="http://camlistore.org/?a=1&amp;b=2">Camlistore</a>
+</DL><p>
+`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := importertest.NewEnv(t, "bookmarks")
+	im, err := newFromConfig(env.Host, jsonconfig.Obj{"source": "file", "file": f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Run(t, im)
+
+	root, err := env.Host.RootObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := root.ChildPathObject("bookmarks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The place: link isn't imported.
+	members := list.Attrs("camliMember")
+	if len(members) != 2 {
+		t.Fatalf("bookmarks list has members %q; want 2", members)
+	}
+	golang, err := env.Host.PlannedObject("bookmark:http://golang.org/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members[0] != golang.PermanodeRef().String() {
+		t.Errorf("first member %s; want the golang.org bookmark %s", members[0], golang.PermanodeRef())
+	}
+	tags := golang.Attrs("tag")
+	sort.Strings(tags)
+	if golang.Attr("url") != "http://golang.org/" || golang.Attr("title") != "The Go & Programming Language" ||
+		golang.Attr("description") != "Go's site" || golang.Attr("startDate") != "2013-04-19T10:00:00Z" ||
+		!reflect.DeepEqual(tags, []string{"go", "programming"}) {
+		t.Errorf("golang.org bookmark url %q, title %q, description %q, startDate %q, tags %q",
+			golang.Attr("url"), golang.Attr("title"), golang.Attr("description"), golang.Attr("startDate"), tags)
+	}
+
+	// Importing the same bookmarks again changes nothing.
+	n := env.NumBlobs()
+	im, err = newFromConfig(env.Host, jsonconfig.Obj{"source": "file", "file": f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Run(t, im)
+	if got := env.NumBlobs(); got != n {
+		t.Errorf("re-import uploaded %d more blobs; want none", got-n)
+	}
+}
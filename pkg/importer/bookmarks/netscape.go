@@ -0,0 +1,91 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bookmarks
+
+import (
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// linkRx matches a bookmark's link, "<A HREF=... >title</A>",
+	// and the description following it, if any.
+	linkRx = regexp.MustCompile(`(?is)<a\s([^>]*)>(.*?)</a>(?:\s*<dd>([^<]*))?`)
+
+	// attrRx matches an attribute of a link.
+	attrRx = regexp.MustCompile(`(?s)([a-zA-Z_]+)\s*=\s*"([^"]*)"`)
+)
+
+// parseNetscape reads the bookmarks of a file in the Netscape bookmark
+// format, which browsers export:
+//
+//   <!DOCTYPE NETSCAPE-Bookmark-file-1>
+//   <DL><p>
+//       <DT><A HREF="http://camlistore.org/" ADD_DATE="1366427780" TAGS="go,storage">Camlistore</A>
+//       <DD>Content-addressable storage
+//   </DL><p>
+//
+// Folders are ignored.
+func parseNetscape(r io.Reader) ([]*bookmark, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	if !strings.Contains(strings.ToUpper(s[:min(len(s), 1024)]), "NETSCAPE-BOOKMARK-FILE-1") {
+		return nil, errors.New("not a Netscape bookmark file")
+	}
+	var bms []*bookmark
+	for _, m := range linkRx.FindAllStringSubmatch(s, -1) {
+		attrs := make(map[string]string)
+		for _, am := range attrRx.FindAllStringSubmatch(m[1], -1) {
+			attrs[strings.ToUpper(am[1])] = html.UnescapeString(am[2])
+		}
+		href := attrs["HREF"]
+		if href == "" || strings.HasPrefix(href, "place:") || strings.HasPrefix(href, "javascript:") {
+			continue
+		}
+		bm := &bookmark{
+			URL:         href,
+			Title:       strings.TrimSpace(html.UnescapeString(m[2])),
+			Description: strings.TrimSpace(html.UnescapeString(m[3])),
+		}
+		for _, tag := range strings.Split(attrs["TAGS"], ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				bm.Tags = append(bm.Tags, tag)
+			}
+		}
+		if sec, err := strconv.ParseInt(attrs["ADD_DATE"], 10, 64); err == nil && sec > 0 {
+			bm.Time = time.Unix(sec, 0)
+		}
+		bms = append(bms, bm)
+	}
+	return bms, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
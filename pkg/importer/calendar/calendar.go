@@ -0,0 +1,165 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package calendar imports the events of iCalendar (.ics) files.
+//
+// Its importerArgs are the "calendars" to import: the URLs of
+// published calendars ("webcal:" URLs are fetched over HTTP), or the
+// paths of files on the server:
+//
+//   "importerArgs": {
+//       "calendars": [
+//           "https://www.google.com/calendar/ical/.../basic.ics",
+//           "/home/bob/calendars/work.ics"
+//       ]
+//   }
+//
+// Each event is a permanode with the "startDate" and "endDate" (if
+// known) attributes, "title" (the event's summary), "location" and
+// "description". The events are the members of the root permanode's
+// "events" path. The calendars are imported again in full each run,
+// updating the events which changed.
+package calendar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"camlistore.org/pkg/importer"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/schema"
+)
+
+func init() {
+	importer.Register("calendar", newFromConfig)
+}
+
+type imp struct {
+	host      *importer.Host
+	calendars []string
+}
+
+func newFromConfig(host *importer.Host, conf jsonconfig.Obj) (importer.Importer, error) {
+	im := &imp{
+		host:      host,
+		calendars: conf.RequiredList("calendars"),
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if len(im.calendars) == 0 {
+		return nil, errors.New("no calendars to import")
+	}
+	return im, nil
+}
+
+func (im *imp) Run(ctx *importer.RunContext) error {
+	root, err := im.host.RootObject()
+	if err != nil {
+		return err
+	}
+	if err := root.SetAttr("title", "Calendars"); err != nil {
+		return err
+	}
+	list, err := root.ChildPathObject("events")
+	if err != nil {
+		return err
+	}
+	for _, cal := range im.calendars {
+		if ctx.Stopped() {
+			return importer.ErrInterrupted
+		}
+		ctx.SetStatus("reading %s", cal)
+		events, err := im.readCalendar(cal)
+		if err != nil {
+			return fmt.Errorf("calendar %s: %v", cal, err)
+		}
+		for i, ev := range events {
+			if ctx.Stopped() {
+				return importer.ErrInterrupted
+			}
+			ctx.SetStatus("importing event %d of %d of %s", i+1, len(events), cal)
+			if err := im.importEvent(list, ev); err != nil {
+				return fmt.Errorf("event %s: %v", ev.key(), err)
+			}
+			ctx.AddItems(1)
+		}
+	}
+	return nil
+}
+
+// readCalendar reads the events of the calendar at the URL or path
+// cal.
+func (im *imp) readCalendar(cal string) ([]*event, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(cal, "webcal://") {
+		cal = "http://" + strings.TrimPrefix(cal, "webcal://")
+	}
+	if strings.HasPrefix(cal, "http://") || strings.HasPrefix(cal, "https://") {
+		res, err := im.host.HTTPClient().Get(cal)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("fetching: %s", res.Status)
+		}
+		r = res.Body
+	} else {
+		f, err := os.Open(cal)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+	return parseICS(r)
+}
+
+// importEvent makes the permanode of ev, a member of list.
+func (im *imp) importEvent(list *importer.Object, ev *event) error {
+	o, err := im.host.PlannedObject(ev.key())
+	if err != nil {
+		return err
+	}
+	if err := o.SetAttr("startDate", schema.RFC3339FromTime(ev.start)); err != nil {
+		return err
+	}
+	var end string
+	if !ev.end.IsZero() {
+		end = schema.RFC3339FromTime(ev.end)
+	}
+	for _, a := range []struct{ attr, value string }{
+		{"endDate", end},
+		{"title", ev.summary},
+		{"location", ev.location},
+		{"description", ev.description},
+	} {
+		var values []string
+		if a.value != "" {
+			values = []string{a.value}
+		}
+		// Set, or deleted if the event lost it.
+		if err := o.SetAttrValues(a.attr, values); err != nil {
+			return err
+		}
+	}
+	return list.AddAttr("camliMember", o.PermanodeRef().String())
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package calendar
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An event is a VEVENT of an iCalendar file.
+type event struct {
+	uid          string
+	recurrenceID string // of a changed occurrence of a recurring event
+	summary      string
+	location     string
+	description  string
+	start, end   time.Time // end is zero if unknown
+	allDay       bool
+	duration     time.Duration // from DURATION, if there's no DTEND
+}
+
+// key returns the event's key, unique across calendars.
+func (e *event) key() string {
+	if e.recurrenceID != "" {
+		return "event:" + e.uid + "/" + e.recurrenceID
+	}
+	return "event:" + e.uid
+}
+
+// A property is a content line: "NAME;PARAM=VALUE:value".
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// parseProperty parses the unfolded content line line.
+func parseProperty(line string) (*property, error) {
+	p := &property{params: make(map[string]string)}
+	// The value follows the first colon not in a quoted
+	// parameter value.
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return nil, fmt.Errorf("no value in line %q", line)
+	}
+	p.value = line[colon+1:]
+	parts := strings.Split(line[:colon], ";")
+	p.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		if i := strings.Index(param, "="); i > 0 {
+			p.params[strings.ToUpper(param[:i])] = strings.Trim(param[i+1:], `"`)
+		}
+	}
+	return p, nil
+}
+
+var textUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, `;`, `\,`, `,`, `\n`, "\n", `\N`, "\n")
+
+// text returns the value of a TEXT property.
+func (p *property) text() string {
+	return strings.TrimSpace(textUnescaper.Replace(p.value))
+}
+
+// time returns the value of a DATE or DATE-TIME property, and whether
+// it's a DATE. Times without a UTC designator are in the location of
+// the TZID parameter, if Go knows it, or else in the local time zone.
+func (p *property) time() (t time.Time, isDate bool, err error) {
+	if p.params["VALUE"] == "DATE" || len(p.value) == len("20060102") {
+		t, err = time.ParseInLocation("20060102", p.value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(p.value, "Z") {
+		t, err = time.Parse("20060102T150405Z", p.value)
+		return t, false, err
+	}
+	loc := time.Local
+	if tzid := p.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", p.value, loc)
+	return t, false, err
+}
+
+// parseDuration parses a DURATION value, such as "P1D" or "PT1H30M".
+func parseDuration(s string) (time.Duration, error) {
+	orig := s
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("bad duration %q", orig)
+	}
+	s = s[1:]
+	var d time.Duration
+	inTime := false
+	for s != "" {
+		if s[0] == 'T' {
+			inTime = true
+			s = s[1:]
+			continue
+		}
+		i := strings.IndexAny(s, "WDHMS")
+		if i <= 0 {
+			return 0, fmt.Errorf("bad duration %q", orig)
+		}
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, fmt.Errorf("bad duration %q", orig)
+		}
+		unit := time.Duration(0)
+		switch {
+		case s[i] == 'W':
+			unit = 7 * 24 * time.Hour
+		case s[i] == 'D':
+			unit = 24 * time.Hour
+		case s[i] == 'H' && inTime:
+			unit = time.Hour
+		case s[i] == 'M' && inTime:
+			unit = time.Minute
+		case s[i] == 'S' && inTime:
+			unit = time.Second
+		default:
+			return 0, fmt.Errorf("bad duration %q", orig)
+		}
+		d += time.Duration(n) * unit
+		s = s[i+1:]
+	}
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
+
+// parseICS reads the events of an iCalendar (RFC 5545) file:
+//
+//   BEGIN:VCALENDAR
+//   BEGIN:VEVENT
+//   UID:20130421T100000Z-42@example.com
+//   DTSTART;TZID=Europe/Paris:20130421T120000
+//   DTEND;TZID=Europe/Paris:20130421T140000
+//   SUMMARY:Lunch
+//   LOCATION:Le Procope\, Paris
+//   END:VEVENT
+//   END:VCALENDAR
+//
+// Events without a UID or a start are skipped. Recurrence rules are
+// ignored: a recurring event is imported as its first occurrence.
+func parseICS(r io.Reader) ([]*event, error) {
+	var (
+		events  []*event
+		ev      *event // the VEVENT being read, if any
+		depth   int    // of the components nested in ev, such as VALARMs
+		inCal   bool
+		sawCal  bool
+		lines   []string
+		br      = bufio.NewReader(r)
+		readErr error
+	)
+	// Unfold the lines: one beginning with a space or a tab continues
+	// the previous one.
+	for readErr == nil {
+		var line string
+		line, readErr = br.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if readErr != io.EOF {
+		return nil, readErr
+	}
+	for _, line := range lines {
+		p, err := parseProperty(line)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case p.name == "BEGIN" && strings.ToUpper(p.value) == "VCALENDAR":
+			inCal, sawCal = true, true
+			continue
+		case p.name == "END" && strings.ToUpper(p.value) == "VCALENDAR":
+			inCal = false
+			continue
+		case !inCal:
+			continue
+		}
+		if ev == nil {
+			if p.name == "BEGIN" && strings.ToUpper(p.value) == "VEVENT" {
+				ev = new(event)
+			}
+			continue
+		}
+		if depth > 0 || p.name == "BEGIN" {
+			switch p.name {
+			case "BEGIN":
+				depth++
+			case "END":
+				depth--
+			}
+			continue
+		}
+		switch p.name {
+		case "END":
+			if ev.uid != "" && !ev.start.IsZero() {
+				events = append(events, ev)
+			}
+			ev = nil
+		case "UID":
+			ev.uid = p.text()
+		case "RECURRENCE-ID":
+			ev.recurrenceID = p.value
+		case "SUMMARY":
+			ev.summary = p.text()
+		case "LOCATION":
+			ev.location = p.text()
+		case "DESCRIPTION":
+			ev.description = p.text()
+		case "DTSTART":
+			if ev.start, ev.allDay, err = p.time(); err != nil {
+				return nil, fmt.Errorf("bad DTSTART %q", p.value)
+			}
+		case "DTEND":
+			if ev.end, _, err = p.time(); err != nil {
+				return nil, fmt.Errorf("bad DTEND %q", p.value)
+			}
+		case "DURATION":
+			if ev.duration, err = parseDuration(p.value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !sawCal {
+		return nil, errors.New("not an iCalendar file")
+	}
+	for _, ev := range events {
+		switch {
+		case !ev.end.IsZero():
+		case ev.duration != 0:
+			ev.end = ev.start.Add(ev.duration)
+		case ev.allDay:
+			// An all-day event without an end lasts the day.
+			ev.end = ev.start.AddDate(0, 0, 1)
+		}
+	}
+	return events, nil
+}
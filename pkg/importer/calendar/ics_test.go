@@ -0,0 +1,224 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package calendar
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/importer/importertest"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+func TestParseICS(t *testing.T) {
+	const ics = "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"BEGIN:VTIMEZONE\r\n" +
+		"TZID:Europe/Paris\r\n" +
+		"END:VTIMEZONE\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:lunch@example.com\r\n" +
+		"DTSTART;TZID=\"Europe/Paris\":20130421T120000\r\n" +
+		"DTEND;TZID=\"Europe/Paris\":20130421T140000\r\n" +
+		"SUMMARY:Lunch\r\n" +
+		"LOCATION:Le Procope\\, Paris\r\n" +
+		"DESCRIPTION:A long\\ndescription\\, folded\r\n" +
+		"  over two lines.\r\n" +
+		"BEGIN:VALARM\r\n" +
+		"DESCRIPTION:Reminder\r\n" +
+		"TRIGGER:-PT15M\r\n" +
+		"END:VALARM\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:call@example.com\r\n" +
+		"RECURRENCE-ID:20130422T090000Z\r\n" +
+		"DTSTART:20130422T090000Z\r\n" +
+		"DURATION:PT1H30M\r\n" +
+		"SUMMARY:Call\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:holiday@example.com\r\n" +
+		"DTSTART;VALUE=DATE:20130501\r\n" +
+		"SUMMARY:Holiday\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"SUMMARY:No UID\r\n" +
+		"DTSTART:20130422T090000Z\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	events, err := parseICS(strings.NewReader(ics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("got %d events; want 3", len(events))
+	}
+	utc := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	_, parisErr := time.LoadLocation("Europe/Paris")
+	tests := []struct {
+		i                              int
+		key                            string
+		start, end                     time.Time
+		summary, location, description string
+	}{
+		{0, "event:lunch@example.com", utc("2013-04-21T10:00:00Z"), utc("2013-04-21T12:00:00Z"),
+			"Lunch", "Le Procope, Paris", "A long\ndescription, folded over two lines."},
+		{1, "event:call@example.com/20130422T090000Z", utc("2013-04-22T09:00:00Z"), utc("2013-04-22T10:30:00Z"),
+			"Call", "", ""},
+	}
+	for _, tt := range tests {
+		if tt.i == 0 && parisErr != nil {
+			// No time zone database to place the lunch in.
+			continue
+		}
+		e := events[tt.i]
+		if e.key() != tt.key || !e.start.Equal(tt.start) || !e.end.Equal(tt.end) ||
+			e.summary != tt.summary || e.location != tt.location || e.description != tt.description {
+			t.Errorf("event %d = %s from %v to %v, %q at %q: %q; want %s from %v to %v, %q at %q: %q",
+				tt.i, e.key(), e.start, e.end, e.summary, e.location, e.description,
+				tt.key, tt.start, tt.end, tt.summary, tt.location, tt.description)
+		}
+	}
+	e := events[2]
+	if e.key() != "event:holiday@example.com" || !e.allDay || e.summary != "Holiday" {
+		t.Errorf("event 2 = %s, all-day %v, %q; want the all-day holiday", e.key(), e.allDay, e.summary)
+	}
+	if got := e.start.Format("2006-01-02 15:04"); got != "2013-05-01 00:00" {
+		t.Errorf("all-day start = %s; want 2013-05-01 00:00, local time", got)
+	}
+	if d := e.end.Sub(e.start); d != 24*time.Hour {
+		t.Errorf("all-day duration = %v; want a day", d)
+	}
+
+	if _, err := parseICS(strings.NewReader("BEGIN:VCARD\r\nEND:VCARD\r\n")); err == nil {
+		t.Error("parsing a vCard succeeded")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"P1D", 24 * time.Hour},
+		{"PT1H30M", 90 * time.Minute},
+		{"P1W", 7 * 24 * time.Hour},
+		{"-PT15M", -15 * time.Minute},
+		{"P1DT12H", 36 * time.Hour},
+		{"PT", 0},
+	}
+	for _, tt := range tests {
+		got, err := parseDuration(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseDuration(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"1H", "P1H", "PTH", "PT1X"} {
+		if _, err := parseDuration(bad); err == nil {
+			t.Errorf("parseDuration(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	f, err := ioutil.TempFile("", "calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	writeCalendar := func(location string) {
+		ics := "BEGIN:VCALENDAR\r\n" +
+			"VERSION:2.0\r\n" +
+			"BEGIN:VEVENT\r\n" +
+			"UID:call@example.com\r\n" +
+			"DTSTART:20130422T090000Z\r\n" +
+			"DTEND:20130422T103000Z\r\n" +
+			"SUMMARY:Call\r\n"
+		if location != "" {
+			ics += "LOCATION:" + location + "\r\n"
+		}
+		ics += "END:VEVENT\r\n" +
+			"END:VCALENDAR\r\n"
+		if err := ioutil.WriteFile(f.Name(), []byte(ics), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCalendar("Room 1")
+
+	env := importertest.NewEnv(t, "calendar")
+	conf := jsonconfig.Obj{"calendars": []interface{}{f.Name()}}
+	run := func() {
+		im, err := newFromConfig(env.Host, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.Run(t, im)
+	}
+	run()
+
+	root, err := env.Host.RootObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := root.ChildPathObject("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call, err := env.Host.PlannedObject("event:call@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members := list.Attrs("camliMember"); len(members) != 1 || members[0] != call.PermanodeRef().String() {
+		t.Errorf("events list has members %q; want the call %s", members, call.PermanodeRef())
+	}
+	if call.Attr("startDate") != "2013-04-22T09:00:00Z" || call.Attr("endDate") != "2013-04-22T10:30:00Z" ||
+		call.Attr("title") != "Call" || call.Attr("location") != "Room 1" || len(call.Attrs("description")) != 0 {
+		t.Errorf("call startDate %q, endDate %q, title %q, location %q, description %q",
+			call.Attr("startDate"), call.Attr("endDate"), call.Attr("title"), call.Attr("location"), call.Attrs("description"))
+	}
+
+	// Importing the same calendar again changes nothing.
+	n := env.NumBlobs()
+	run()
+	if got := env.NumBlobs(); got != n {
+		t.Errorf("re-import uploaded %d more blobs; want none", got-n)
+	}
+
+	// An event losing its location loses the attribute.
+	writeCalendar("")
+	run()
+	call, err = env.Host.PlannedObject("event:call@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := call.Attrs("location"); len(v) != 0 {
+		t.Errorf("call location %q after the calendar dropped it; want none", v)
+	}
+	if got := env.NumBlobs(); got != n+1 {
+		t.Errorf("dropping the location uploaded %d blobs; want its del-attribute claim", got-n)
+	}
+}
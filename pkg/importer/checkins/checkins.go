@@ -0,0 +1,338 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package checkins imports a location history: the check-ins of a
+// Foursquare account, or a Google Latitude history export.
+//
+// Its importerArgs are the "source": "foursquare", with the OAuth
+// "accessToken" of the account; or "latitude", with the "file" path,
+// on the server, of the history exported by Google Takeout
+// (LocationHistory.json):
+//
+//   "importerArgs": {
+//       "source": "foursquare",
+//       "accessToken": "..."
+//   }
+//
+// Each check-in or location is a permanode with the "latitude" and
+// "longitude" attributes, in decimal degrees, and the "startDate"
+// attribute, when it was there. Check-ins also have the venue's name
+// as "title", and the shout as "description". The check-ins are the
+// members of the root permanode's "checkins" path, and the locations
+// of its "locations" path. Only what's newer than the last import is
+// imported.
+package checkins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"camlistore.org/pkg/importer"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/schema"
+)
+
+// foursquareURL is the Foursquare API endpoint.
+var foursquareURL = "https://api.foursquare.com/v2/"
+
+// foursquareVersion is the API version the responses are parsed as.
+const foursquareVersion = "20130420"
+
+// checkinsPerPage is how many check-ins are listed per API call,
+// Foursquare's maximum.
+const checkinsPerPage = 250
+
+func init() {
+	importer.Register("checkins", newFromConfig)
+}
+
+type imp struct {
+	host        *importer.Host
+	source      string
+	accessToken string // for foursquare
+	file        string // for latitude
+}
+
+func newFromConfig(host *importer.Host, conf jsonconfig.Obj) (importer.Importer, error) {
+	im := &imp{
+		host:   host,
+		source: conf.RequiredString("source"),
+	}
+	switch im.source {
+	case "foursquare":
+		im.accessToken = conf.RequiredString("accessToken")
+	case "latitude":
+		im.file = conf.RequiredString("file")
+	default:
+		return nil, fmt.Errorf(`unknown checkins source %q; want "foursquare" or "latitude"`, im.source)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+// A place is where someone was, when.
+type place struct {
+	key         string // unique within the source
+	lat, long   float64
+	time        time.Time
+	title       string // or "" for locations
+	description string
+}
+
+func (im *imp) Run(ctx *importer.RunContext) error {
+	root, err := im.host.RootObject()
+	if err != nil {
+		return err
+	}
+	if im.source == "foursquare" {
+		if err := root.SetAttr("title", "Foursquare check-ins"); err != nil {
+			return err
+		}
+		return im.importCheckins(ctx, root)
+	}
+	if err := root.SetAttr("title", "Latitude location history"); err != nil {
+		return err
+	}
+	return im.importLocations(ctx, root)
+}
+
+// importPlace makes the permanode of p, a member of list.
+func (im *imp) importPlace(list *importer.Object, p *place) error {
+	o, err := im.host.PlannedObject(p.key)
+	if err != nil {
+		return err
+	}
+	if err := o.SetAttrs(
+		"latitude", strconv.FormatFloat(p.lat, 'f', -1, 64),
+		"longitude", strconv.FormatFloat(p.long, 'f', -1, 64),
+		"startDate", schema.RFC3339FromTime(p.time),
+	); err != nil {
+		return err
+	}
+	if p.title != "" {
+		if err := o.SetAttr("title", p.title); err != nil {
+			return err
+		}
+	}
+	if p.description != "" {
+		if err := o.SetAttr("description", p.description); err != nil {
+			return err
+		}
+	}
+	return list.AddAttr("camliMember", o.PermanodeRef().String())
+}
+
+type foursquareCheckins struct {
+	Meta struct {
+		Code        int    `json:"code"`
+		ErrorDetail string `json:"errorDetail"`
+	} `json:"meta"`
+	Response struct {
+		Checkins struct {
+			Count int `json:"count"`
+			Items []struct {
+				ID        string `json:"id"`
+				CreatedAt int64  `json:"createdAt"` // Unix time
+				Shout     string `json:"shout"`
+				Venue     *struct {
+					Name     string `json:"name"`
+					Location struct {
+						Lat float64 `json:"lat"`
+						Lng float64 `json:"lng"`
+					} `json:"location"`
+				} `json:"venue"`
+			} `json:"items"`
+		} `json:"checkins"`
+	} `json:"response"`
+}
+
+// parseCheckins reads the places of the check-ins of a users/checkins
+// response, and how many check-ins it lists, including those without a
+// venue, which are skipped.
+func parseCheckins(r io.Reader) (places []*place, n int, err error) {
+	var res foursquareCheckins
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, 0, err
+	}
+	if res.Meta.Code != http.StatusOK {
+		return nil, 0, fmt.Errorf("foursquare: error %d: %s", res.Meta.Code, res.Meta.ErrorDetail)
+	}
+	items := res.Response.Checkins.Items
+	for _, it := range items {
+		if it.Venue == nil {
+			continue
+		}
+		places = append(places, &place{
+			key:         "checkin:" + it.ID,
+			lat:         it.Venue.Location.Lat,
+			long:        it.Venue.Location.Lng,
+			time:        time.Unix(it.CreatedAt, 0),
+			title:       it.Venue.Name,
+			description: it.Shout,
+		})
+	}
+	return places, len(items), nil
+}
+
+func (im *imp) importCheckins(ctx *importer.RunContext, root *importer.Object) error {
+	list, err := root.ChildPathObject("checkins")
+	if err != nil {
+		return err
+	}
+	after, err := ctx.Cursor("createdAt")
+	if err != nil {
+		return err
+	}
+	latest := after
+	defer func() {
+		if latest != after {
+			ctx.SetCursor("createdAt", latest)
+		}
+	}()
+	for offset := 0; ; offset += checkinsPerPage {
+		ctx.SetStatus("importing check-ins from %d", offset)
+		args := url.Values{
+			"oauth_token": {im.accessToken},
+			"v":           {foursquareVersion},
+			"limit":       {strconv.Itoa(checkinsPerPage)},
+			"offset":      {strconv.Itoa(offset)},
+			"sort":        {"oldestfirst"},
+		}
+		if after != "" {
+			args.Set("afterTimestamp", after)
+		}
+		res, err := im.host.HTTPClient().Get(foursquareURL + "users/self/checkins?" + args.Encode())
+		if err != nil {
+			return err
+		}
+		places, n, err := parseCheckins(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, p := range places {
+			if ctx.Stopped() {
+				return importer.ErrInterrupted
+			}
+			if err := im.importPlace(list, p); err != nil {
+				return fmt.Errorf("check-in %s: %v", p.key, err)
+			}
+			ctx.AddItems(1)
+			// Oldest first, so the check-ins before the
+			// cursor are all imported.
+			latest = strconv.FormatInt(p.time.Unix(), 10)
+		}
+		if n < checkinsPerPage {
+			return nil
+		}
+	}
+}
+
+type latitudeHistory struct {
+	Locations []struct {
+		TimestampMs string `json:"timestampMs"`
+		LatitudeE7  int64  `json:"latitudeE7"`
+		LongitudeE7 int64  `json:"longitudeE7"`
+	} `json:"locations"`
+}
+
+// parseLocations reads the places of a Latitude history export newer
+// than afterMs, in milliseconds since the epoch, oldest first.
+func parseLocations(r io.Reader, afterMs int64) ([]*place, error) {
+	var hist latitudeHistory
+	if err := json.NewDecoder(r).Decode(&hist); err != nil {
+		return nil, err
+	}
+	var places []*place
+	for _, l := range hist.Locations {
+		ms, err := strconv.ParseInt(l.TimestampMs, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad timestampMs %q", l.TimestampMs)
+		}
+		if ms <= afterMs {
+			continue
+		}
+		places = append(places, &place{
+			key:  "location:" + l.TimestampMs,
+			lat:  float64(l.LatitudeE7) / 1e7,
+			long: float64(l.LongitudeE7) / 1e7,
+			time: time.Unix(0, ms*int64(time.Millisecond)),
+		})
+	}
+	// Exports list the most recent first.
+	sort.Sort(byTime(places))
+	return places, nil
+}
+
+type byTime []*place
+
+func (s byTime) Len() int           { return len(s) }
+func (s byTime) Less(i, j int) bool { return s[i].time.Before(s[j].time) }
+func (s byTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (im *imp) importLocations(ctx *importer.RunContext, root *importer.Object) error {
+	list, err := root.ChildPathObject("locations")
+	if err != nil {
+		return err
+	}
+	cursor, err := ctx.Cursor("timestampMs")
+	if err != nil {
+		return err
+	}
+	var afterMs int64
+	if cursor != "" {
+		if afterMs, err = strconv.ParseInt(cursor, 10, 64); err != nil {
+			return fmt.Errorf("bad timestampMs cursor %q", cursor)
+		}
+	}
+	ctx.SetStatus("reading %s", im.file)
+	f, err := os.Open(im.file)
+	if err != nil {
+		return err
+	}
+	places, err := parseLocations(f, afterMs)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", im.file, err)
+	}
+	latest := afterMs
+	defer func() {
+		if latest != afterMs {
+			ctx.SetCursor("timestampMs", strconv.FormatInt(latest, 10))
+		}
+	}()
+	for i, p := range places {
+		if ctx.Stopped() {
+			return importer.ErrInterrupted
+		}
+		ctx.SetStatus("importing location %d of %d", i+1, len(places))
+		if err := im.importPlace(list, p); err != nil {
+			return fmt.Errorf("location %s: %v", p.key, err)
+		}
+		ctx.AddItems(1)
+		latest = p.time.UnixNano() / int64(time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checkins
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/importer/importertest"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+func TestParseCheckins(t *testing.T) {
+	places, n, err := parseCheckins(strings.NewReader(`{"meta": {"code": 200},
+		"response": {"checkins": {"count": 2, "items": [
+			{"id": "c1", "createdAt": 1366427780, "type": "checkin", "shout": "Coffee!",
+			 "venue": {"id": "v1", "name": "Blue Bottle", "location": {"lat": 37.776, "lng": -122.423}}},
+			{"id": "c2", "createdAt": 1366431380, "type": "shout"}]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(places) != 1 {
+		t.Fatalf("got %d places of %d check-ins; want 1 of 2", len(places), n)
+	}
+	want := &place{
+		key:         "checkin:c1",
+		lat:         37.776,
+		long:        -122.423,
+		time:        time.Unix(1366427780, 0),
+		title:       "Blue Bottle",
+		description: "Coffee!",
+	}
+	if !reflect.DeepEqual(places[0], want) {
+		t.Errorf("place = %+v; want %+v", places[0], want)
+	}
+
+	_, _, err = parseCheckins(strings.NewReader(`{"meta": {"code": 401, "errorType": "invalid_auth", "errorDetail": "OAuth token invalid or revoked."}}`))
+	if err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("error of failed call = %v", err)
+	}
+}
+
+func TestParseLocations(t *testing.T) {
+	const hist = `{"locations": [
+		{"timestampMs": "1366431380500", "latitudeE7": 377760000, "longitudeE7": -1224230000, "accuracy": 20},
+		{"timestampMs": "1366427780000", "latitudeE7": 377749000, "longitudeE7": -1224194000, "accuracy": 30},
+		{"timestampMs": "1366424180000", "latitudeE7": 377700000, "longitudeE7": -1224100000}]}`
+	places, err := parseLocations(strings.NewReader(hist), 1366424180000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*place{
+		{key: "location:1366427780000", lat: 37.7749, long: -122.4194, time: time.Unix(1366427780, 0)},
+		{key: "location:1366431380500", lat: 37.776, long: -122.423, time: time.Unix(1366431380, 500e6)},
+	}
+	if len(places) != len(want) {
+		t.Fatalf("got %d places; want %d", len(places), len(want))
+	}
+	for i, p := range places {
+		if !reflect.DeepEqual(p, want[i]) {
+			t.Errorf("place %d = %+v; want %+v", i, p, want[i])
+		}
+	}
+}
+
+// writeHistory writes a Latitude history export of the JSON locations
+// to the file name.
+func writeHistory(t *testing.T, name, locations string) {
+	if err := ioutil.WriteFile(name, []byte(`{"locations": [`+locations+`]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	f, err := ioutil.TempFile("", "latitude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	const older = `{"timestampMs": "1366427780000", "latitudeE7": 377749000, "longitudeE7": -1224194000}`
+	writeHistory(t, f.Name(), older)
+
+	env := importertest.NewEnv(t, "checkins")
+	conf := jsonconfig.Obj{"source": "latitude", "file": f.Name()}
+	im, err := newFromConfig(env.Host, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Run(t, im)
+
+	root, err := env.Host.RootObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := root.Attr("title"); got != "Latitude location history" {
+		t.Errorf("root title %q", got)
+	}
+	list, err := root.ChildPathObject("locations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, err := env.Host.PlannedObject("location:1366427780000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members := list.Attrs("camliMember"); !reflect.DeepEqual(members, []string{loc.PermanodeRef().String()}) {
+		t.Errorf("locations list has members %q; want the location %s", members, loc.PermanodeRef())
+	}
+	if loc.Attr("latitude") != "37.7749" || loc.Attr("longitude") != "-122.4194" ||
+		loc.Attr("startDate") != "2013-04-20T03:16:20Z" || loc.Attr("title") != "" {
+		t.Errorf("location latitude %q, longitude %q, startDate %q, title %q",
+			loc.Attr("latitude"), loc.Attr("longitude"), loc.Attr("startDate"), loc.Attr("title"))
+	}
+
+	// Importing the same history again changes nothing.
+	n := env.NumBlobs()
+	im, err = newFromConfig(env.Host, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Run(t, im)
+	if got := env.NumBlobs(); got != n {
+		t.Errorf("re-import uploaded %d more blobs; want none", got-n)
+	}
+
+	// A new export, listing the most recent first, adds only its new
+	// location.
+	writeHistory(t, f.Name(), `{"timestampMs": "1366431380500", "latitudeE7": 377760000, "longitudeE7": -1224230000}, `+older)
+	im, err = newFromConfig(env.Host, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Run(t, im)
+	list, err = root.ChildPathObject("locations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members := list.Attrs("camliMember"); len(members) != 2 {
+		t.Errorf("locations list has members %q after the new export; want 2", members)
+	}
+}
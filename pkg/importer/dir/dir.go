@@ -0,0 +1,275 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dir imports the files dropped in a directory of the server,
+// such as a shared folder or the upload target of a camera.
+//
+// Its importerArgs are the "dir" to watch, which is scanned every
+// "pollSeconds" (60 by default; 0 to scan once per run), and what to
+// do "afterImport" with the files imported: "keep" them (the
+// default), "delete" them, or "move" them to the "archiveDir":
+//
+//   "importerArgs": {
+//       "dir": "/srv/camera-uploads",
+//       "afterImport": "move",
+//       "archiveDir": "/srv/camera-archive"
+//   }
+//
+// The handler usually has "runOnStart" true, so the directory is
+// watched until the import is stopped. Files are imported once they
+// haven't been modified for "settleSeconds" (10 by default), so
+// they're complete. Hidden files and directories, whose names begin
+// with ".", are skipped.
+//
+// Each file is stored as a file schema blob, with its modification
+// time, and is the camliContent of a permanode, a member of the root
+// permanode's "files" path. The same contents dropped twice make one
+// permanode.
+package dir
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/importer"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/schema"
+)
+
+func init() {
+	importer.Register("dir", newFromConfig)
+}
+
+type imp struct {
+	host        *importer.Host
+	dir         string
+	afterImport string // "keep", "delete" or "move"
+	archiveDir  string // for "move"
+	poll        time.Duration
+	settle      time.Duration
+
+	// kept is the state of the files kept after their import, by
+	// path, so they're only imported again when they change. It's
+	// only used by Run, which isn't called concurrently.
+	kept map[string]fileState
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+func stateOf(fi os.FileInfo) fileState {
+	return fileState{fi.Size(), fi.ModTime()}
+}
+
+func newFromConfig(host *importer.Host, conf jsonconfig.Obj) (importer.Importer, error) {
+	im := &imp{
+		host:        host,
+		dir:         conf.RequiredString("dir"),
+		afterImport: conf.OptionalString("afterImport", "keep"),
+		archiveDir:  conf.OptionalString("archiveDir", ""),
+		poll:        time.Duration(conf.OptionalInt("pollSeconds", 60)) * time.Second,
+		settle:      time.Duration(conf.OptionalInt("settleSeconds", 10)) * time.Second,
+		kept:        make(map[string]fileState),
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	switch im.afterImport {
+	case "keep", "delete":
+		if im.archiveDir != "" {
+			return nil, fmt.Errorf(`archiveDir is only for afterImport "move"`)
+		}
+	case "move":
+		if im.archiveDir == "" {
+			return nil, fmt.Errorf(`afterImport "move" needs an archiveDir`)
+		}
+	default:
+		return nil, fmt.Errorf(`unknown afterImport %q; want "keep", "delete" or "move"`, im.afterImport)
+	}
+	if im.poll < 0 || im.settle < 0 {
+		return nil, fmt.Errorf("negative pollSeconds or settleSeconds")
+	}
+	var err error
+	if im.dir, err = filepath.Abs(im.dir); err != nil {
+		return nil, err
+	}
+	if im.archiveDir != "" {
+		if im.archiveDir, err = filepath.Abs(im.archiveDir); err != nil {
+			return nil, err
+		}
+	}
+	return im, nil
+}
+
+func (im *imp) Run(ctx *importer.RunContext) error {
+	root, err := im.host.RootObject()
+	if err != nil {
+		return err
+	}
+	if err := root.SetAttr("title", "Files of "+im.dir); err != nil {
+		return err
+	}
+	files, err := root.ChildPathObject("files")
+	if err != nil {
+		return err
+	}
+	for {
+		ctx.SetStatus("scanning %s", im.dir)
+		paths, err := im.scan(time.Now())
+		if err != nil {
+			return err
+		}
+		for i, path := range paths {
+			if ctx.Stopped() {
+				return importer.ErrInterrupted
+			}
+			ctx.SetStatus("importing file %d of %d: %s", i+1, len(paths), path)
+			if err := im.importFile(files, path); err != nil {
+				// Such as a file removed or unreadable, which
+				// doesn't stop the others.
+				log.Printf("dir importer: %s: %v", path, err)
+				continue
+			}
+			ctx.AddItems(1)
+		}
+		if im.poll == 0 {
+			return nil
+		}
+		ctx.SetStatus("waiting for new files in %s", im.dir)
+		select {
+		case <-ctx.StopChan():
+			return nil
+		case <-time.After(im.poll):
+		}
+	}
+}
+
+// skipName returns whether the file or directory name is hidden.
+func skipName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// scan returns the paths of the files of the directory to import, as
+// of now.
+func (im *imp) scan(now time.Time) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(im.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == im.dir {
+				return err
+			}
+			log.Printf("dir importer: %v", err)
+			return nil
+		}
+		if path == im.dir {
+			return nil
+		}
+		if fi.IsDir() {
+			if skipName(fi.Name()) || path == im.archiveDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || skipName(fi.Name()) {
+			return nil
+		}
+		if now.Sub(fi.ModTime()) < im.settle {
+			return nil
+		}
+		if st, ok := im.kept[path]; ok && st == stateOf(fi) {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
+// importFile makes the permanode of the file at path, a member of
+// files, and then keeps, deletes or moves the file.
+func (im *imp) importFile(files *importer.Object, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fileMap := schema.NewCommonFileMap(path, fi)
+	fileMap["camliType"] = "file"
+	fileRef, err := schema.WriteFileMap(im.host.Target(), fileMap, f)
+	if err != nil {
+		return err
+	}
+	o, err := im.host.PlannedObject("file:" + fileRef.String())
+	if err != nil {
+		return err
+	}
+	if err := o.SetAttr("camliContent", fileRef.String()); err != nil {
+		return err
+	}
+	if err := files.AddAttr("camliMember", o.PermanodeRef().String()); err != nil {
+		return err
+	}
+
+	// Only what was imported may go.
+	after, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stateOf(after) != stateOf(fi) {
+		return fmt.Errorf("modified during its import; importing it again later")
+	}
+	switch im.afterImport {
+	case "delete":
+		return os.Remove(path)
+	case "move":
+		return im.archive(path)
+	}
+	im.kept[path] = stateOf(fi)
+	return nil
+}
+
+// archive moves the file at path to the same place in the archive
+// directory, without replacing a file there.
+func (im *imp) archive(path string) error {
+	rel, err := filepath.Rel(im.dir, path)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(im.archiveDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		ext := filepath.Ext(rel)
+		dest = filepath.Join(im.archiveDir, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(rel, ext), i, ext))
+	}
+	return os.Rename(path, dest)
+}
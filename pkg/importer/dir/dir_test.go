@@ -0,0 +1,104 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/jsonconfig"
+)
+
+func TestScanAndArchive(t *testing.T) {
+	td, err := ioutil.TempDir("", "dir-importer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	drop := filepath.Join(td, "drop")
+	archive := filepath.Join(drop, "archive")
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a.jpg", "sub/b.jpg", ".hidden", ".tmp/c.jpg", "archive/a.jpg", "new.jpg"} {
+		path := filepath.Join(drop, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if name != "new.jpg" {
+			os.Chtimes(path, old, old)
+		}
+	}
+
+	im, err := newFromConfig(nil, jsonconfig.Obj{"dir": drop, "afterImport": "move", "archiveDir": archive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := im.(*imp)
+	paths, err := d.scan(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(drop, "a.jpg"), filepath.Join(drop, "sub/b.jpg")}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("scan = %q; want %q", paths, want)
+	}
+
+	// archive/a.jpg exists already.
+	if err := d.archive(want[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.archive(want[1]); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.jpg", "a.1.jpg", "sub/b.jpg"} {
+		if _, err := os.Stat(filepath.Join(archive, name)); err != nil {
+			t.Errorf("not archived: %v", err)
+		}
+	}
+	if paths, _ := d.scan(time.Now()); len(paths) != 0 {
+		t.Errorf("scan after archiving = %q; want none", paths)
+	}
+
+	fi, err := os.Stat(filepath.Join(drop, "new.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.kept[filepath.Join(drop, "new.jpg")] = stateOf(fi)
+	if paths, _ := d.scan(time.Now().Add(time.Hour)); len(paths) != 0 {
+		t.Errorf("scan of an imported, kept file = %q; want none", paths)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	bad := []jsonconfig.Obj{
+		{"dir": "/tmp", "afterImport": "move"},
+		{"dir": "/tmp", "afterImport": "delete", "archiveDir": "/tmp/a"},
+		{"dir": "/tmp", "afterImport": "shred"},
+		{"dir": "/tmp", "pollSeconds": -1.0},
+	}
+	for _, conf := range bad {
+		if _, err := newFromConfig(nil, conf); err == nil {
+			t.Errorf("config %v accepted", conf)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package flickr imports the photos of a Flickr account.
+//
+// Its importerArgs are the "apiKey" and "apiSecret" of a Flickr
+// application, and the "accessToken" and "accessSecret" of the
+// account, granting the application read access to it:
+//
+//   "importerArgs": {
+//       "apiKey": "...",
+//       "apiSecret": "...",
+//       "accessToken": "...",
+//       "accessSecret": "..."
+//   }
+//
+// Each photo is a permanode, whose camliContent is the original
+// file, as uploaded to Flickr with its EXIF metadata, and whose
+// "title", "description" and "tag" attributes are Flickr's. The
+// photos are the members of the root permanode's "photos" path, and
+// each set is a collection of its photos, a member of the "sets"
+// path. Photos not updated on Flickr since the last import aren't
+// fetched again.
+package flickr
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/importer"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/schema"
+)
+
+// apiURL is the Flickr REST API endpoint.
+var apiURL = "https://api.flickr.com/services/rest/"
+
+// photosPerPage is how many photos are listed per API call, Flickr's
+// maximum.
+const photosPerPage = 500
+
+// photoExtras are the photo fields listed with each photo.
+const photoExtras = "description,date_upload,date_taken,last_update,original_format,tags,url_o"
+
+func init() {
+	importer.Register("flickr", newFromConfig)
+}
+
+type imp struct {
+	host  *importer.Host
+	creds oauthCreds
+}
+
+func newFromConfig(host *importer.Host, conf jsonconfig.Obj) (importer.Importer, error) {
+	im := &imp{
+		host: host,
+		creds: oauthCreds{
+			consumerKey:    conf.RequiredString("apiKey"),
+			consumerSecret: conf.RequiredString("apiSecret"),
+			token:          conf.RequiredString("accessToken"),
+			tokenSecret:    conf.RequiredString("accessSecret"),
+		},
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+// flexInt is an integer that Flickr sends either as a JSON number or
+// as a string, depending on the method.
+type flexInt int
+
+func (n *flexInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("flickr: bad integer %s", b)
+	}
+	*n = flexInt(v)
+	return nil
+}
+
+// content is a text field, which Flickr wraps in an object.
+type content struct {
+	Content string `json:"_content"`
+}
+
+type photo struct {
+	ID             string  `json:"id"`
+	Title          string  `json:"title"`
+	Description    content `json:"description"`
+	DateUpload     string  `json:"dateupload"` // Unix time
+	DateTaken      string  `json:"datetaken"`  // "2006-01-02 15:04:05"
+	Granularity    flexInt `json:"datetakengranularity"`
+	LastUpdate     string  `json:"lastupdate"`
+	Tags           string  `json:"tags"` // space-separated
+	Farm           flexInt `json:"farm"`
+	Server         string  `json:"server"`
+	OriginalSecret string  `json:"originalsecret"`
+	OriginalFormat string  `json:"originalformat"`
+	URLOriginal    string  `json:"url_o"`
+}
+
+type photoPage struct {
+	Page  flexInt `json:"page"`
+	Pages flexInt `json:"pages"`
+	Photo []photo `json:"photo"`
+}
+
+type photoset struct {
+	ID          string  `json:"id"`
+	Title       content `json:"title"`
+	Description content `json:"description"`
+}
+
+type photosetsPage struct {
+	Page     flexInt    `json:"page"`
+	Pages    flexInt    `json:"pages"`
+	Photoset []photoset `json:"photoset"`
+}
+
+// call calls the API method with args, and decodes its response into
+// v.
+func (im *imp) call(method string, args url.Values, v interface{}) error {
+	args.Set("method", method)
+	args.Set("format", "json")
+	args.Set("nojsoncallback", "1")
+	im.creds.sign("GET", apiURL, args, time.Now(), newNonce())
+	res, err := im.host.HTTPClient().Get(apiURL + "?" + args.Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("flickr: %s: %s", method, res.Status)
+	}
+	return decodeResponse(method, res, v)
+}
+
+func decodeResponse(method string, res *http.Response, v interface{}) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("flickr: %s: %v", method, err)
+	}
+	var stat struct {
+		Stat    string `json:"stat"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(raw, &stat); err != nil {
+		return fmt.Errorf("flickr: %s: %v", method, err)
+	}
+	if stat.Stat != "ok" {
+		return fmt.Errorf("flickr: %s: error %d: %s", method, stat.Code, stat.Message)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("flickr: %s: %v", method, err)
+	}
+	return nil
+}
+
+func (im *imp) Run(ctx *importer.RunContext) error {
+	root, err := im.host.RootObject()
+	if err != nil {
+		return err
+	}
+	if err := root.SetAttr("title", "Flickr"); err != nil {
+		return err
+	}
+	if err := im.importPhotos(ctx, root); err != nil {
+		return err
+	}
+	return im.importSets(ctx, root)
+}
+
+func (im *imp) importPhotos(ctx *importer.RunContext, root *importer.Object) error {
+	photos, err := root.ChildPathObject("photos")
+	if err != nil {
+		return err
+	}
+	if err := photos.SetAttr("title", "Flickr photos"); err != nil {
+		return err
+	}
+	for page := 1; ; page++ {
+		ctx.SetStatus("importing photos, page %d", page)
+		var res struct {
+			Photos photoPage `json:"photos"`
+		}
+		args := url.Values{
+			"user_id":  {"me"},
+			"extras":   {photoExtras},
+			"per_page": {strconv.Itoa(photosPerPage)},
+			"page":     {strconv.Itoa(page)},
+		}
+		if err := im.call("flickr.people.getPhotos", args, &res); err != nil {
+			return err
+		}
+		for _, p := range res.Photos.Photo {
+			if ctx.Stopped() {
+				return importer.ErrInterrupted
+			}
+			o, err := im.importPhoto(p)
+			if err != nil {
+				return fmt.Errorf("flickr: photo %s: %v", p.ID, err)
+			}
+			if err := photos.AddAttr("camliMember", o.PermanodeRef().String()); err != nil {
+				return err
+			}
+			ctx.AddItems(1)
+		}
+		if page >= int(res.Photos.Pages) {
+			return nil
+		}
+	}
+}
+
+// originalURL returns the URL of the photo as uploaded.
+func (p *photo) originalURL() string {
+	if p.URLOriginal != "" {
+		return p.URLOriginal
+	}
+	return fmt.Sprintf("https://farm%d.staticflickr.com/%s/%s_%s_o.%s",
+		p.Farm, p.Server, p.ID, p.OriginalSecret, p.OriginalFormat)
+}
+
+// modTime returns when the photo was taken, if Flickr knows it to the
+// second, or else when it was uploaded.
+func (p *photo) modTime() (time.Time, bool) {
+	if p.Granularity == 0 {
+		if t, err := time.Parse("2006-01-02 15:04:05", p.DateTaken); err == nil {
+			return t, true
+		}
+	}
+	if sec, err := strconv.ParseInt(p.DateUpload, 10, 64); err == nil && sec > 0 {
+		return time.Unix(sec, 0), true
+	}
+	return time.Time{}, false
+}
+
+func (im *imp) importPhoto(p photo) (*importer.Object, error) {
+	o, err := im.host.PlannedObject("photo:" + p.ID)
+	if err != nil {
+		return nil, err
+	}
+	if o.Attr("camliContent") == "" || o.Attr("flickrLastUpdate") != p.LastUpdate {
+		fileRef, err := im.fetchPhoto(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.SetAttr("camliContent", fileRef); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.SetAttrs(
+		"flickrId", p.ID,
+		"title", p.Title,
+		"description", p.Description.Content,
+		"flickrLastUpdate", p.LastUpdate,
+	); err != nil {
+		return nil, err
+	}
+	if err := o.SetAttrValues("tag", strings.Fields(p.Tags)); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// fetchPhoto stores the original file of p, and returns its blobref.
+func (im *imp) fetchPhoto(p photo) (string, error) {
+	res, err := im.host.HTTPClient().Get(p.originalURL())
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", p.originalURL(), res.Status)
+	}
+	fileMap := schema.NewFileMap(p.ID + "." + p.OriginalFormat)
+	if t, ok := p.modTime(); ok {
+		fileMap["unixMtime"] = schema.RFC3339FromTime(t)
+	}
+	br, err := schema.WriteFileMap(im.host.Target(), fileMap, res.Body)
+	if err != nil {
+		return "", err
+	}
+	return br.String(), nil
+}
+
+func (im *imp) importSets(ctx *importer.RunContext, root *importer.Object) error {
+	sets, err := root.ChildPathObject("sets")
+	if err != nil {
+		return err
+	}
+	if err := sets.SetAttr("title", "Flickr sets"); err != nil {
+		return err
+	}
+	for page := 1; ; page++ {
+		ctx.SetStatus("importing sets, page %d", page)
+		var res struct {
+			Photosets photosetsPage `json:"photosets"`
+		}
+		args := url.Values{"page": {strconv.Itoa(page)}}
+		if err := im.call("flickr.photosets.getList", args, &res); err != nil {
+			return err
+		}
+		for _, ps := range res.Photosets.Photoset {
+			if ctx.Stopped() {
+				return importer.ErrInterrupted
+			}
+			o, err := im.importSet(ctx, ps)
+			if err != nil {
+				return fmt.Errorf("flickr: set %s: %v", ps.ID, err)
+			}
+			if err := sets.AddAttr("camliMember", o.PermanodeRef().String()); err != nil {
+				return err
+			}
+		}
+		if page >= int(res.Photosets.Pages) {
+			return nil
+		}
+	}
+}
+
+// importSet makes the collection of the photos of ps. Photos not
+// imported yet, such as those uploaded during the import, are left
+// for the next run.
+func (im *imp) importSet(ctx *importer.RunContext, ps photoset) (*importer.Object, error) {
+	o, err := im.host.PlannedObject("set:" + ps.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.SetAttrs(
+		"flickrId", ps.ID,
+		"title", ps.Title.Content,
+		"description", ps.Description.Content,
+	); err != nil {
+		return nil, err
+	}
+	var members []string
+	for page := 1; ; page++ {
+		ctx.SetStatus("importing set %q, page %d", ps.Title.Content, page)
+		var res struct {
+			Photoset photoPage `json:"photoset"`
+		}
+		args := url.Values{
+			"photoset_id": {ps.ID},
+			"per_page":    {strconv.Itoa(photosPerPage)},
+			"page":        {strconv.Itoa(page)},
+		}
+		if err := im.call("flickr.photosets.getPhotos", args, &res); err != nil {
+			return nil, err
+		}
+		for _, p := range res.Photoset.Photo {
+			po, err := im.host.PlannedObject("photo:" + p.ID)
+			if err != nil {
+				return nil, err
+			}
+			if po.Attr("camliContent") == "" {
+				log.Printf("flickr: photo %s of set %s not imported yet; skipping", p.ID, ps.ID)
+				continue
+			}
+			members = append(members, po.PermanodeRef().String())
+		}
+		if page >= int(res.Photoset.Pages) {
+			break
+		}
+	}
+	if err := o.SetAttrValues("camliMember", members); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flickr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOAuthSign(t *testing.T) {
+	// The example of the OAuth 1.0 specification, appendix A.5.
+	c := &oauthCreds{
+		consumerKey:    "dpf43f3p2l4k3l03",
+		consumerSecret: "kd94hf93k423kf44",
+		token:          "nnch734d00sl2jdk",
+		tokenSecret:    "pfkkdhi9sl3r4s00",
+	}
+	params := url.Values{"file": {"vacation.jpg"}, "size": {"original"}}
+	c.sign("GET", "http://photos.example.net/photos", params, time.Unix(1191242096, 0), "kllo9940pd9333jh")
+	if got, want := params.Get("oauth_signature"), "tR3+Ty81lMeYAr/Fid0kMTYa/WM="; got != want {
+		t.Errorf("signature = %q; want %q", got, want)
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	body := func(s string) *http.Response {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(s))}
+	}
+	var res struct {
+		Photos photoPage `json:"photos"`
+	}
+	err := decodeResponse("flickr.people.getPhotos", body(`{"photos": {"page": 2, "pages": "3",
+		"photo": [{"id": "42", "title": "Beach", "description": {"_content": "At last"},
+		"datetaken": "2013-04-19 20:21:45", "datetakengranularity": "0", "tags": "summer sea"}]}, "stat": "ok"}`), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Photos.Page != 2 || res.Photos.Pages != 3 || len(res.Photos.Photo) != 1 {
+		t.Fatalf("decoded %+v", res.Photos)
+	}
+	p := res.Photos.Photo[0]
+	if p.Title != "Beach" || p.Description.Content != "At last" || p.Tags != "summer sea" {
+		t.Errorf("decoded photo %+v", p)
+	}
+	if mt, ok := p.modTime(); !ok || !mt.Equal(time.Date(2013, 4, 19, 20, 21, 45, 0, time.UTC)) {
+		t.Errorf("modTime = %v, %v", mt, ok)
+	}
+
+	err = decodeResponse("flickr.people.getPhotos", body(`{"stat": "fail", "code": 98, "message": "Invalid auth token"}`), &res)
+	if err == nil || !strings.Contains(err.Error(), "Invalid auth token") {
+		t.Errorf("error of failed call = %v", err)
+	}
+}
+
+func TestModTimeApproximate(t *testing.T) {
+	// Only the month is known of when it was taken.
+	p := &photo{DateTaken: "2013-04-01 00:00:00", Granularity: 4, DateUpload: "1366427780"}
+	if mt, ok := p.modTime(); !ok || mt.Unix() != 1366427780 {
+		t.Errorf("modTime = %v, %v; want the upload time", mt, ok)
+	}
+	var n flexInt
+	if err := json.Unmarshal([]byte(`"x"`), &n); err == nil {
+		t.Errorf("unmarshaling a non-integer succeeded")
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flickr
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// oauthCreds are the OAuth 1.0a credentials of an application, and of
+// the account it was granted access to.
+type oauthCreds struct {
+	consumerKey, consumerSecret string
+	token, tokenSecret          string
+}
+
+// sign adds the OAuth parameters to params, those of a request of
+// method to baseURL, with their HMAC-SHA1 signature.
+func (c *oauthCreds) sign(method, baseURL string, params url.Values, now time.Time, nonce string) {
+	params.Set("oauth_consumer_key", c.consumerKey)
+	params.Set("oauth_token", c.token)
+	params.Set("oauth_signature_method", "HMAC-SHA1")
+	params.Set("oauth_timestamp", strconv.FormatInt(now.Unix(), 10))
+	params.Set("oauth_nonce", nonce)
+	params.Set("oauth_version", "1.0")
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var norm bytes.Buffer
+	for _, k := range keys {
+		vs := append([]string(nil), params[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			if norm.Len() > 0 {
+				norm.WriteByte('&')
+			}
+			norm.WriteString(oauthEscape(k) + "=" + oauthEscape(v))
+		}
+	}
+	base := method + "&" + oauthEscape(baseURL) + "&" + oauthEscape(norm.String())
+
+	mac := hmac.New(sha1.New, []byte(oauthEscape(c.consumerSecret)+"&"+oauthEscape(c.tokenSecret)))
+	mac.Write([]byte(base))
+	params.Set("oauth_signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// oauthEscape percent-encodes s as OAuth requires: all but the
+// unreserved characters of RFC 3986.
+func oauthEscape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("error reading random bytes: " + err.Error())
+	}
+	return fmt.Sprintf("%x", b)
+}
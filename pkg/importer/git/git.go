@@ -0,0 +1,441 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package git imports a git repository of the server: its objects and
+// its refs.
+//
+// Its importerArgs are the "repo" path, of a repository or of its
+// working tree, and optionally the "git" program, found in $PATH by
+// default:
+//
+//   "importerArgs": {
+//       "repo": "/home/joe/src/camlistore"
+//   }
+//
+// A git object's name is the SHA-1 of its loose format, so each object
+// is stored as a blob of that format, whose blobref is sha1- and the
+// object's name. Objects larger than the largest blob are stored as
+// files instead, named by the root permanode's "camliGitObject:" +
+// object name attributes.
+//
+// The root permanode is the repository's: its camliContent is the
+// list of its refs, in git's info/refs format, and its "gitHead"
+// attribute is the ref, or commit, of its HEAD. Each ref is a
+// permanode too, whose camliContent is the blobref of the object it
+// names, at the root permanode's "camliPath:" + ref name, such as
+// "camliPath:refs/heads/master". Each import makes new versions of
+// them. Only the objects that are new since the last import are
+// imported.
+//
+// The repository is served below <prefix>git/ as git's "dumb" HTTP
+// protocol, so it can be cloned back:
+//
+//   git clone http://localhost:3179/importer-git/git/ camlistore
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/importer"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/schema"
+)
+
+// largeObjectAttrPrefix prefixes the names of the root permanode's
+// attributes naming the files of the objects too large for a blob.
+const largeObjectAttrPrefix = "camliGitObject:"
+
+var objectNameRx = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+func init() {
+	importer.Register("git", newFromConfig)
+}
+
+type imp struct {
+	host *importer.Host
+	repo string
+	git  string
+}
+
+func newFromConfig(host *importer.Host, conf jsonconfig.Obj) (importer.Importer, error) {
+	im := &imp{
+		host: host,
+		repo: conf.RequiredString("repo"),
+		git:  conf.OptionalString("git", "git"),
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+func (im *imp) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(im.git, args...)
+	cmd.Dir = im.repo
+	return cmd
+}
+
+// output runs git with args, and returns what it wrote.
+func (im *imp) output(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := im.command(args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return string(out), nil
+}
+
+// A ref is a ref of the repository, and the object it names.
+type ref struct {
+	name, object string
+}
+
+// refs returns the refs of the repository, sorted by name, and its
+// HEAD, a ref name or, if detached, an object name.
+func (im *imp) refs() (refs []ref, head string, err error) {
+	out, err := im.output("for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, "", err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 {
+			refs = append(refs, ref{name: f[1], object: f[0]})
+		}
+	}
+	sort.Sort(byName(refs))
+	if out, err := im.output("symbolic-ref", "-q", "HEAD"); err == nil {
+		return refs, strings.TrimSpace(out), nil
+	}
+	out, err = im.output("rev-parse", "HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	return refs, strings.TrimSpace(out), nil
+}
+
+type byName []ref
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// infoRefs returns refs in the format of git's info/refs file.
+func infoRefs(refs []ref) string {
+	var buf bytes.Buffer
+	for _, r := range refs {
+		fmt.Fprintf(&buf, "%s\t%s\n", r.object, r.name)
+	}
+	return buf.String()
+}
+
+// newObjects returns the names of the objects reachable from the
+// refs, but not from the objects of old, the refs of the last import.
+func (im *imp) newObjects(old []string) ([]string, error) {
+	args := []string{"rev-list", "--objects", "--all"}
+	var not []string
+	for _, obj := range old {
+		// Those deleted since can't be excluded; what they
+		// reached is imported again, if still there.
+		if err := im.command("cat-file", "-e", obj).Run(); err == nil {
+			not = append(not, obj)
+		}
+	}
+	if len(not) > 0 {
+		args = append(append(args, "--not"), not...)
+	}
+	out, err := im.output(args...)
+	if err != nil {
+		return nil, err
+	}
+	var objs []string
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) > 0 {
+			objs = append(objs, f[0])
+		}
+	}
+	return objs, nil
+}
+
+// errStop is returned by a readObjects callback to stop reading.
+var errStop = errors.New("stop")
+
+// readObjects reads the objects named objs with "git cat-file
+// --batch", calling fn with each one's type, size and contents, which
+// must be read before fn returns.
+func (im *imp) readObjects(objs []string, fn func(name, typ string, size int64, r io.Reader) error) (err error) {
+	cmd := im.command("cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return
+		}
+		err = cmd.Wait()
+	}()
+	go func() {
+		w := bufio.NewWriter(stdin)
+		for _, obj := range objs {
+			if _, err := fmt.Fprintln(w, obj); err != nil {
+				break
+			}
+		}
+		w.Flush()
+		stdin.Close()
+	}()
+
+	br := bufio.NewReader(stdout)
+	for i := 0; i < len(objs); i++ {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("git cat-file: %v", err)
+		}
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			return fmt.Errorf("git cat-file: unexpected %q", strings.TrimSpace(line))
+		}
+		size, err := strconv.ParseInt(f[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("git cat-file: bad size in %q", strings.TrimSpace(line))
+		}
+		lr := &io.LimitedReader{R: br, N: size}
+		if err := fn(f[0], f[1], size, lr); err != nil {
+			return err
+		}
+		if lr.N != 0 {
+			return fmt.Errorf("object %s not read", f[0])
+		}
+		if b, err := br.ReadByte(); err != nil || b != '\n' {
+			return fmt.Errorf("git cat-file: missing newline after object %s", f[0])
+		}
+	}
+	return nil
+}
+
+// looseHeader returns the header of the loose format of an object.
+func looseHeader(typ string, size int64) string {
+	return fmt.Sprintf("%s %d\x00", typ, size)
+}
+
+// storeObject stores the object name, of type typ and size, read from
+// r, in its loose format, to dst. It returns the blobref of the file
+// it's stored as, if too large for a blob, or nil.
+func storeObject(dst blobserver.StatReceiver, name, typ string, size int64, r io.Reader) (*blobref.BlobRef, error) {
+	header := looseHeader(typ, size)
+	h := sha1.New()
+	loose := io.TeeReader(io.MultiReader(strings.NewReader(header), r), h)
+	checkName := func() error {
+		if got := fmt.Sprintf("%x", h.Sum(nil)); got != name {
+			return fmt.Errorf("object %s has SHA-1 %s", name, got)
+		}
+		return nil
+	}
+	if int64(len(header))+size > blobserver.MaxBlobSize {
+		fileRef, err := schema.WriteFileMap(dst, schema.NewFileMap(name), loose)
+		if err != nil {
+			return nil, err
+		}
+		return fileRef, checkName()
+	}
+	b, err := ioutil.ReadAll(loose)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkName(); err != nil {
+		return nil, err
+	}
+	_, err = dst.ReceiveBlob(blobref.Parse("sha1-"+name), bytes.NewReader(b))
+	return nil, err
+}
+
+func (im *imp) Run(ctx *importer.RunContext) error {
+	root, err := im.host.RootObject()
+	if err != nil {
+		return err
+	}
+	title := strings.TrimSuffix(filepath.Base(im.repo), ".git")
+	if err := root.SetAttr("title", "git repository "+title); err != nil {
+		return err
+	}
+	ctx.SetStatus("listing refs")
+	refs, head, err := im.refs()
+	if err != nil {
+		return err
+	}
+	tips, err := ctx.Cursor("refs")
+	if err != nil {
+		return err
+	}
+	ctx.SetStatus("listing new objects")
+	objs, err := im.newObjects(strings.Fields(tips))
+	if err != nil {
+		return err
+	}
+
+	stopped := false
+	err = im.readObjects(objs, func(name, typ string, size int64, r io.Reader) error {
+		if ctx.Stopped() {
+			stopped = true
+			return errStop
+		}
+		ctx.SetStatus("importing %s %s", typ, name)
+		fileRef, err := storeObject(im.host.Target(), name, typ, size, r)
+		if err != nil {
+			return err
+		}
+		if fileRef != nil {
+			if err := root.SetAttr(largeObjectAttrPrefix+name, fileRef.String()); err != nil {
+				return err
+			}
+		}
+		ctx.AddItems(1)
+		return nil
+	})
+	if stopped {
+		return importer.ErrInterrupted
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx.SetStatus("importing refs")
+	refsRef, err := schema.WriteFileFromReader(im.host.Target(), "info-refs", strings.NewReader(infoRefs(refs)))
+	if err != nil {
+		return err
+	}
+	if err := root.SetAttrs("camliContent", refsRef.String(), "gitHead", head); err != nil {
+		return err
+	}
+	var newTips []string
+	for _, r := range refs {
+		o, err := root.ChildPathObject(r.name)
+		if err != nil {
+			return err
+		}
+		if err := o.SetAttrs("title", r.name, "camliContent", "sha1-"+r.object); err != nil {
+			return err
+		}
+		newTips = append(newTips, r.object)
+	}
+	return ctx.SetCursor("refs", strings.Join(newTips, " "))
+}
+
+// openObject opens the loose format of the object name, from a blob
+// of src, or from the file largeRef.
+func openObject(src blobref.SeekFetcher, name string, largeRef *blobref.BlobRef) (io.ReadCloser, error) {
+	if largeRef != nil {
+		return schema.NewFileReader(src, largeRef)
+	}
+	rc, _, err := src.Fetch(blobref.Parse("sha1-" + name))
+	return rc, err
+}
+
+// ServeHTTP serves the repository below git/, with git's dumb HTTP
+// protocol.
+func (im *imp) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
+	if !strings.HasPrefix(suffix, "git/") || (req.Method != "GET" && req.Method != "HEAD") {
+		http.NotFound(rw, req)
+		return
+	}
+	root, err := im.host.RootObject()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	src := blobref.SeekerFromStreamingFetcher(im.host.Target())
+	switch path := strings.TrimPrefix(suffix, "git/"); {
+	case path == "HEAD":
+		head := root.Attr("gitHead")
+		if head == "" {
+			http.NotFound(rw, req)
+			return
+		}
+		if strings.HasPrefix(head, "refs/") {
+			head = "ref: " + head
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(rw, "%s\n", head)
+	case path == "info/refs":
+		refsRef := blobref.Parse(root.Attr("camliContent"))
+		if refsRef == nil {
+			http.NotFound(rw, req)
+			return
+		}
+		fr, err := schema.NewFileReader(src, refsRef)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer fr.Close()
+		rw.Header().Set("Content-Type", "text/plain")
+		io.Copy(rw, fr)
+	case path == "objects/info/packs":
+		// Everything is a loose object.
+		rw.Header().Set("Content-Type", "text/plain")
+	case strings.HasPrefix(path, "objects/") && len(path) == len("objects/xx/")+38 && path[len("objects/xx")] == '/':
+		name := path[len("objects/"):len("objects/xx")] + path[len("objects/xx/"):]
+		if !objectNameRx.MatchString(name) {
+			http.NotFound(rw, req)
+			return
+		}
+		rc, err := openObject(src, name, blobref.Parse(root.Attr(largeObjectAttrPrefix+name)))
+		if err != nil {
+			http.NotFound(rw, req)
+			return
+		}
+		defer rc.Close()
+		rw.Header().Set("Content-Type", "application/x-git-loose-object")
+		zw := zlib.NewWriter(rw)
+		if _, err := io.Copy(zw, rc); err != nil {
+			log.Printf("git importer: serving object %s: %v", name, err)
+			return
+		}
+		zw.Close()
+	default:
+		http.NotFound(rw, req)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package git
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/test"
+)
+
+// newTestRepo returns a repository with a commit of a file, and a
+// function to commit another.
+func newTestRepo(t *testing.T) (im *imp, commit func(name, contents string), cleanup func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "git-importer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	im = &imp{repo: dir, git: "git"}
+	git := func(args ...string) {
+		cmd := im.command(args...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+	commit = func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", name)
+		git("commit", "-q", "-m", "add "+name)
+	}
+	git("init", "-q")
+	git("symbolic-ref", "HEAD", "refs/heads/master")
+	commit("README", "Hello.\n")
+	return im, commit, func() { os.RemoveAll(dir) }
+}
+
+func TestImportObjects(t *testing.T) {
+	im, commit, cleanup := newTestRepo(t)
+	defer cleanup()
+
+	refs, head, err := im.refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].name != "refs/heads/master" || head != "refs/heads/master" {
+		t.Fatalf("refs = %v, HEAD = %q", refs, head)
+	}
+	if got, want := infoRefs(refs), refs[0].object+"\trefs/heads/master\n"; got != want {
+		t.Errorf("infoRefs = %q; want %q", got, want)
+	}
+
+	objs, err := im.newObjects(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 3 {
+		t.Fatalf("objects = %q; want a commit, a tree and a blob", objs)
+	}
+	sto := new(test.Fetcher)
+	types := make(map[string]string)
+	err = im.readObjects(objs, func(name, typ string, size int64, r io.Reader) error {
+		types[name] = typ
+		large, err := storeObject(sto, name, typ, size, r)
+		if large != nil {
+			t.Errorf("object %s stored as a file", name)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types[refs[0].object] != "commit" {
+		t.Errorf("type of the commit = %q", types[refs[0].object])
+	}
+	for _, name := range objs {
+		rc, err := openObject(sto, name, nil)
+		if err != nil {
+			t.Errorf("object %s not stored as blob sha1-%s: %v", name, name, err)
+			continue
+		}
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if !strings.HasPrefix(string(b), types[name]+" ") {
+			t.Errorf("object %s = %q; want its loose format", name, b)
+		}
+	}
+
+	commit("LICENSE", "Public domain.\n")
+	objs, err = im.newObjects([]string{refs[0].object, "0123456789012345678901234567890123456789"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 3 {
+		t.Errorf("new objects of the second commit = %q; want a commit, a tree and a blob", objs)
+	}
+}
+
+func TestStoreObjectBadName(t *testing.T) {
+	_, err := storeObject(new(test.Fetcher), "0123456789012345678901234567890123456789", "blob", 3, strings.NewReader("abc"))
+	if err == nil {
+		t.Error("storing an object of the wrong name succeeded")
+	}
+}
@@ -0,0 +1,406 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/jsonsign/signhandler"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+)
+
+// cursorAttrPrefix prefixes the names of the root permanode's
+// attributes holding cursors.
+const cursorAttrPrefix = "camliImportCursor:"
+
+// plannedTime is the signature time of planned permanodes, so their
+// blobrefs are the same on every run.
+var plannedTime = time.Unix(0, 0)
+
+// Host is what an importer imports with: the storage and index of the
+// handler, and its identity, to sign claims.
+type Host struct {
+	typ, prefix string
+	target      blobserver.Storage
+	search      *search.Handler
+	signer      *signhandler.Handler
+	client      *http.Client // or nil for http.DefaultClient
+
+	mu   sync.Mutex // protects root
+	root *Object
+}
+
+// NewHost returns the Host of an importer of type typ, at prefix,
+// uploading to target, indexed by sh, and signing with signer. It's
+// for running importers outside of an importer handler, as in tests.
+func NewHost(typ, prefix string, target blobserver.Storage, sh *search.Handler, signer *signhandler.Handler) *Host {
+	return &Host{
+		typ:    typ,
+		prefix: prefix,
+		target: target,
+		search: sh,
+		signer: signer,
+	}
+}
+
+// Target returns the storage to upload imported content to.
+func (h *Host) Target() blobserver.Storage {
+	return h.target
+}
+
+// Search returns the search handler of the imported content's index.
+func (h *Host) Search() *search.Handler {
+	return h.search
+}
+
+// HTTPClient returns the client to fetch from the service with.
+func (h *Host) HTTPClient() *http.Client {
+	if h.client == nil {
+		return http.DefaultClient
+	}
+	return h.client
+}
+
+// upload signs m, at t or now if t is zero, and stores it unless the
+// target has it already.
+func (h *Host) upload(m schema.Map, t time.Time) (*blobref.BlobRef, error) {
+	signed, err := h.signer.SignMapAt(m, t)
+	if err != nil {
+		return nil, fmt.Errorf("error signing %s: %v", m.Type(), err)
+	}
+	uh := client.NewUploadHandleFromString(signed)
+	if _, err := blobserver.StatBlob(h.target, uh.BlobRef); err == nil {
+		return uh.BlobRef, nil
+	}
+	if _, err := h.target.ReceiveBlob(uh.BlobRef, uh.Contents); err != nil {
+		return nil, fmt.Errorf("error uploading %s: %v", m.Type(), err)
+	}
+	return uh.BlobRef, nil
+}
+
+// NewObject returns a new permanode.
+func (h *Host) NewObject() (*Object, error) {
+	pn, err := h.upload(schema.NewUnsignedPermanode(), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return &Object{h: h, pn: pn, attr: make(url.Values)}, nil
+}
+
+// PlannedObject returns the permanode of key, which is the same on
+// every run of the handler, creating it if needed. Keys only need to
+// be unique within the handler, such as the IDs of the service's
+// items.
+func (h *Host) PlannedObject(key string) (*Object, error) {
+	pn, err := h.upload(schema.NewPlannedPermanode(h.plannedKey(key)), plannedTime)
+	if err != nil {
+		return nil, err
+	}
+	return h.ObjectFromRef(pn)
+}
+
+func (h *Host) plannedKey(key string) string {
+	return "camliImport:" + h.typ + ":" + h.prefix + ":" + key
+}
+
+// ObjectFromRef returns the permanode pn, with its attributes as
+// known to the index.
+func (h *Host) ObjectFromRef(pn *blobref.BlobRef) (*Object, error) {
+	des, err := h.search.NewDescribeRequest().DescribeSync(pn)
+	if err != nil {
+		return nil, err
+	}
+	o := &Object{h: h, pn: pn, attr: make(url.Values)}
+	if des != nil && des.Permanode != nil {
+		for k, v := range des.Permanode.Attr {
+			o.attr[k] = append([]string(nil), v...)
+		}
+	}
+	return o, nil
+}
+
+// RootObject returns the handler's root permanode, with the
+// "camliImportRoot" attribute set to the importer type and the
+// handler's prefix.
+func (h *Host) RootObject() (*Object, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.root != nil {
+		return h.root, nil
+	}
+	root, err := h.PlannedObject("root")
+	if err != nil {
+		return nil, err
+	}
+	if err := root.SetAttr("camliImportRoot", h.typ+":"+h.prefix); err != nil {
+		return nil, err
+	}
+	h.root = root
+	return root, nil
+}
+
+// Object is a permanode made by an importer. Its attributes are
+// cached, so an Object should only be changed through its methods.
+type Object struct {
+	h  *Host
+	pn *blobref.BlobRef
+
+	mu   sync.Mutex // protects attr
+	attr url.Values
+}
+
+// PermanodeRef returns the blobref of the object's permanode.
+func (o *Object) PermanodeRef() *blobref.BlobRef {
+	return o.pn
+}
+
+// Attr returns the first value of the attribute attr, or "".
+func (o *Object) Attr(attr string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if v := o.attr[attr]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Attrs returns the values of the attribute attr.
+func (o *Object) Attrs(attr string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.attr[attr]...)
+}
+
+// SetAttr sets the attribute attr to value, unless it only has that
+// value already. As the index doesn't keep empty values, setting attr
+// to "" clears it, and does nothing if it has no values.
+func (o *Object) SetAttr(attr, value string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if v := o.attr[attr]; len(v) == 1 && v[0] == value || len(v) == 0 && value == "" {
+		return nil
+	}
+	if _, err := o.h.upload(schema.NewSetAttributeClaim(o.pn, attr, value), time.Time{}); err != nil {
+		return err
+	}
+	if value == "" {
+		delete(o.attr, attr)
+		return nil
+	}
+	o.attr[attr] = []string{value}
+	return nil
+}
+
+// SetAttrs sets the attributes of keyval, pairs of names and values,
+// with SetAttr.
+func (o *Object) SetAttrs(keyval ...string) error {
+	if len(keyval)%2 == 1 {
+		panic("importer: odd number of arguments to SetAttrs")
+	}
+	for i := 0; i < len(keyval); i += 2 {
+		if err := o.SetAttr(keyval[i], keyval[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddAttr adds value to the values of the attribute attr, unless it's
+// there already.
+func (o *Object) AddAttr(attr, value string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, v := range o.attr[attr] {
+		if v == value {
+			return nil
+		}
+	}
+	if _, err := o.h.upload(schema.NewAddAttributeClaim(o.pn, attr, value), time.Time{}); err != nil {
+		return err
+	}
+	o.attr[attr] = append(o.attr[attr], value)
+	return nil
+}
+
+// SetAttrValues sets the values of the attribute attr to values,
+// unless it has those values already. It deletes attr if values is
+// empty.
+func (o *Object) SetAttrValues(attr string, values []string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if sameValues(o.attr[attr], values) {
+		return nil
+	}
+	if len(values) == 0 {
+		if _, err := o.h.upload(schema.NewDelAttributeClaim(o.pn, attr), time.Time{}); err != nil {
+			return err
+		}
+		delete(o.attr, attr)
+		return nil
+	}
+	var set []string
+	for i, v := range values {
+		m := schema.NewAddAttributeClaim(o.pn, attr, v)
+		if i == 0 {
+			m = schema.NewSetAttributeClaim(o.pn, attr, v)
+		}
+		if _, err := o.h.upload(m, time.Time{}); err != nil {
+			o.attr[attr] = set
+			return err
+		}
+		set = append(set, v)
+	}
+	o.attr[attr] = set
+	return nil
+}
+
+// sameValues returns whether a and b have the same values, in any
+// order.
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, v := range a {
+		count[v]++
+	}
+	for _, v := range b {
+		if count[v] == 0 {
+			return false
+		}
+		count[v]--
+	}
+	return true
+}
+
+// ChildPathObject returns the object at the path claim "camliPath:" +
+// name of o, creating it if needed.
+func (o *Object) ChildPathObject(name string) (*Object, error) {
+	attr := "camliPath:" + name
+	if v := o.Attr(attr); v != "" {
+		if br := blobref.Parse(v); br != nil {
+			return o.h.ObjectFromRef(br)
+		}
+	}
+	child, err := o.h.PlannedObject(o.pn.String() + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.SetAttr(attr, child.pn.String()); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// RunContext is the state of an import.
+type RunContext struct {
+	host  *Host
+	stopc chan bool // closed by stop
+
+	mu     sync.Mutex // protects the following
+	status string
+	items  int
+}
+
+// NewRunContext returns the context of an import with host, run
+// outside of an importer handler.
+func NewRunContext(host *Host) *RunContext {
+	return &RunContext{host: host, stopc: make(chan bool)}
+}
+
+// Host returns the host to import with.
+func (rc *RunContext) Host() *Host {
+	return rc.host
+}
+
+func (rc *RunContext) stop() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	select {
+	case <-rc.stopc:
+	default:
+		close(rc.stopc)
+	}
+}
+
+// Stopped returns whether the import was asked to stop.
+func (rc *RunContext) Stopped() bool {
+	select {
+	case <-rc.stopc:
+		return true
+	default:
+		return false
+	}
+}
+
+// StopChan returns a channel closed when the import is asked to stop,
+// for importers waiting on the service.
+func (rc *RunContext) StopChan() <-chan bool {
+	return rc.stopc
+}
+
+// SetStatus sets the status shown by the handler.
+func (rc *RunContext) SetStatus(format string, args ...interface{}) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.status = fmt.Sprintf(format, args...)
+}
+
+// AddItems counts n more items imported.
+func (rc *RunContext) AddItems(n int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.items += n
+}
+
+func (rc *RunContext) progress() (status string, items int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.status, rc.items
+}
+
+// Cursor returns the value of the cursor name, saved on the root
+// permanode by SetCursor, or "" if none.
+func (rc *RunContext) Cursor(name string) (string, error) {
+	root, err := rc.host.RootObject()
+	if err != nil {
+		return "", err
+	}
+	return root.Attr(cursorAttrPrefix + name), nil
+}
+
+// SetCursor saves value as the cursor name, such as the date or ID of
+// the last item imported, so the next run can carry on from there.
+func (rc *RunContext) SetCursor(name, value string) error {
+	if strings.Contains(name, ":") {
+		return fmt.Errorf("invalid cursor name %q", name)
+	}
+	root, err := rc.host.RootObject()
+	if err != nil {
+		return err
+	}
+	return root.SetAttr(cursorAttrPrefix+name, value)
+}
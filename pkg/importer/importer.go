@@ -0,0 +1,429 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package importer imports content from other services, such as
+// photo sites, into permanodes.
+//
+// An importer handler is configured for each account of a service.
+// Its "type" is the importer, registered by its package with
+// Register, and "importerArgs" are its own configuration, such as the
+// account's credentials:
+//
+//   "/importer-flickr/": {
+//       "handler": "importer",
+//       "handlerArgs": {
+//           "type": "flickr",
+//           "blobRoot": "/bs-and-maybe-also-index/",
+//           "searchRoot": "/my-search/",
+//           "jsonSignRoot": "/sighelper/",
+//           "importerArgs": {...}
+//       }
+//   }
+//
+// With "runOnStart" true, an import starts with the server, such as
+// for importers that watch for changes until stopped. With a
+// "schedule", imports start at its times, such as "@every 6h", "@daily"
+// or, as a cron specification, "30 4 * * 1-5" for 4:30 on weekdays. A
+// scheduled import is skipped if the previous one is still running.
+//
+// The blobRoot must be indexed by the searchRoot's index. Each
+// handler has a root permanode, which holds the state of its imports
+// as attributes, such as the cursors of incremental imports.
+//
+// The handler's root page shows the status of the import. A POST to
+// <prefix>start starts an import, unless one is running, and a POST
+// to <prefix>stop asks the running import to stop. <prefix>status
+// returns the status in JSON. Importers that are http.Handlers serve
+// the handler's other requests, such as to export what they imported.
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/jsonsign/signhandler"
+	"camlistore.org/pkg/search"
+)
+
+// An Importer imports the content of one account of a service.
+type Importer interface {
+	// Run imports content until it's done, or until ctx is
+	// stopped. Importers should save their progress as cursors,
+	// so the next run carries on from there.
+	Run(ctx *RunContext) error
+}
+
+// ErrInterrupted is returned by importers that stopped because they
+// were asked to.
+var ErrInterrupted = errors.New("importer: interrupted")
+
+// A Constructor returns the importer for an account, configured by
+// conf, the handler's "importerArgs". It must call conf.Validate.
+type Constructor func(host *Host, conf jsonconfig.Obj) (Importer, error)
+
+var (
+	mu    sync.Mutex
+	ctors = make(map[string]Constructor)
+)
+
+// Register makes the importer type typ available to importer
+// handlers. It panics if typ is registered twice.
+func Register(typ string, ctor Constructor) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := ctors[typ]; ok {
+		panic("importer: Constructor already registered for type: " + typ)
+	}
+	ctors[typ] = ctor
+}
+
+func constructor(typ string) Constructor {
+	mu.Lock()
+	defer mu.Unlock()
+	return ctors[typ]
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("importer", newFromConfig)
+}
+
+func newFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	typ := conf.RequiredString("type")
+	blobRoot := conf.RequiredString("blobRoot")
+	searchRoot := conf.RequiredString("searchRoot")
+	signRoot := conf.RequiredString("jsonSignRoot")
+	args := conf.OptionalObject("importerArgs")
+	runOnStart := conf.OptionalBool("runOnStart", false)
+	scheduleSpec := conf.OptionalString("schedule", "")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	var sched *schedule
+	if scheduleSpec != "" {
+		var err error
+		if sched, err = parseSchedule(scheduleSpec); err != nil {
+			return nil, err
+		}
+	}
+	ctor := constructor(typ)
+	if ctor == nil {
+		return nil, fmt.Errorf("importer type %q not known or loaded", typ)
+	}
+	bs, err := ld.GetStorage(blobRoot)
+	if err != nil {
+		return nil, fmt.Errorf("importer handler's blobRoot of %q error: %v", blobRoot, err)
+	}
+	si, err := ld.GetHandler(searchRoot)
+	if err != nil {
+		return nil, fmt.Errorf("importer handler's searchRoot of %q error: %v", searchRoot, err)
+	}
+	sh, ok := si.(*search.Handler)
+	if !ok {
+		return nil, fmt.Errorf("importer handler's searchRoot of %q is of type %T, expecting a search handler",
+			searchRoot, si)
+	}
+	h, err := ld.GetHandler(signRoot)
+	if err != nil {
+		return nil, fmt.Errorf("importer handler's jsonSignRoot of %q error: %v", signRoot, err)
+	}
+	sigh, ok := h.(*signhandler.Handler)
+	if !ok {
+		return nil, fmt.Errorf("importer handler's jsonSignRoot of %q is of type %T, expecting a jsonsign handler",
+			signRoot, h)
+	}
+	host := NewHost(typ, ld.MyPrefix(), bs, sh, sigh)
+	imp, err := ctor(host, args)
+	if err != nil {
+		return nil, fmt.Errorf("importer %q: %v", typ, err)
+	}
+	ih := newHandler(host, imp)
+	ih.persistent = true
+	ih.sched = sched
+	if runOnStart {
+		ih.Start()
+	}
+	if sched != nil {
+		go ih.runSchedule()
+	}
+	return ih, nil
+}
+
+// errRunning is returned by Start when an import is already running.
+var errRunning = errors.New("an import is already running")
+
+// lastRunAttr is the attribute of the root permanode saving the
+// runStatus of the last import, in JSON, so it survives restarts.
+const lastRunAttr = "camliImportLastRun"
+
+// A runStatus is how an import went.
+type runStatus struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Status   string    `json:"status"`
+	Items    int       `json:"items"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (st *runStatus) statusMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"started":  st.Started.UTC().Format(time.RFC3339),
+		"finished": st.Finished.UTC().Format(time.RFC3339),
+		"status":   st.Status,
+		"items":    st.Items,
+	}
+	if st.Error != "" {
+		m["error"] = st.Error
+	}
+	return m
+}
+
+// Handler runs the imports of an importer, and serves their status.
+type Handler struct {
+	host  *Host
+	imp   Importer
+	sched *schedule // or nil
+
+	// persistent is whether the status of the last import is saved
+	// on the root permanode.
+	persistent bool
+	loadOnce   sync.Once // of the saved status
+
+	mu       sync.Mutex  // protects following
+	run      *RunContext // the running import, or nil
+	started  time.Time   // of the running import
+	last     *runStatus  // of the last finished import, or nil
+	runs     int         // since the server started
+	failures int         // of the runs, those which failed
+	skipped  int         // scheduled runs skipped, as an import was running
+	nextRun  time.Time   // of the schedule
+}
+
+func newHandler(host *Host, imp Importer) *Handler {
+	return &Handler{host: host, imp: imp}
+}
+
+// Start starts an import, unless one is running.
+func (h *Handler) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.run != nil {
+		return errRunning
+	}
+	rc := &RunContext{
+		host:   h.host,
+		stopc:  make(chan bool),
+		status: "running",
+	}
+	h.run = rc
+	h.started = time.Now()
+	h.runs++
+	started := h.started
+	go func() {
+		err := h.imp.Run(rc)
+		if err != nil {
+			log.Printf("importer %s of type %s: %v", h.host.prefix, h.host.typ, err)
+		}
+		st := &runStatus{Started: started, Finished: time.Now()}
+		st.Status, st.Items = rc.progress()
+		if err != nil {
+			st.Error = err.Error()
+		}
+		h.mu.Lock()
+		h.run = nil
+		h.last = st
+		if err != nil && err != ErrInterrupted {
+			h.failures++
+		}
+		h.mu.Unlock()
+		if h.persistent {
+			h.saveLastRun(st)
+		}
+	}()
+	return nil
+}
+
+// Stop asks the running import, if any, to stop. It doesn't wait for
+// it to return.
+func (h *Handler) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.run != nil {
+		h.run.stop()
+	}
+}
+
+// runSchedule starts the imports at the times of h's schedule,
+// skipping those while the previous import is still running.
+func (h *Handler) runSchedule() {
+	for {
+		next := h.sched.next(time.Now())
+		if next.IsZero() {
+			log.Printf("importer %s: no time to start on in schedule %q", h.host.prefix, h.sched)
+			return
+		}
+		h.mu.Lock()
+		h.nextRun = next
+		h.mu.Unlock()
+		time.Sleep(next.Sub(time.Now()))
+		if err := h.Start(); err == errRunning {
+			log.Printf("importer %s: skipping the import scheduled at %v; the previous one is still running",
+				h.host.prefix, next.Format(time.RFC3339))
+			h.mu.Lock()
+			h.skipped++
+			h.mu.Unlock()
+		}
+	}
+}
+
+func (h *Handler) saveLastRun(st *runStatus) {
+	b, err := json.Marshal(st)
+	if err == nil {
+		var root *Object
+		if root, err = h.host.RootObject(); err == nil {
+			err = root.SetAttr(lastRunAttr, string(b))
+		}
+	}
+	if err != nil {
+		log.Printf("importer %s: saving the status of the last import: %v", h.host.prefix, err)
+	}
+}
+
+// loadLastRun loads the saved status of the last import, from before
+// the server started, unless an import finished since.
+func (h *Handler) loadLastRun() {
+	if !h.persistent {
+		return
+	}
+	h.loadOnce.Do(func() {
+		root, err := h.host.RootObject()
+		if err != nil {
+			log.Printf("importer %s: loading the status of the last import: %v", h.host.prefix, err)
+			return
+		}
+		saved := root.Attr(lastRunAttr)
+		if saved == "" {
+			return
+		}
+		st := new(runStatus)
+		if err := json.Unmarshal([]byte(saved), st); err != nil {
+			log.Printf("importer %s: bad saved status of the last import %q: %v", h.host.prefix, saved, err)
+			return
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.last == nil {
+			h.last = st
+		}
+	})
+}
+
+// StatusMap returns the status of the handler's imports, for status
+// handlers.
+func (h *Handler) StatusMap() map[string]interface{} {
+	h.loadLastRun()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m := map[string]interface{}{
+		"type":       h.host.typ,
+		"running":    h.run != nil,
+		"runs":       h.runs,
+		"failedRuns": h.failures,
+	}
+	if h.run != nil {
+		m["status"], m["items"] = h.run.progress()
+		m["started"] = h.started.UTC().Format(time.RFC3339)
+	}
+	if h.sched != nil {
+		m["schedule"] = h.sched.String()
+		m["skippedRuns"] = h.skipped
+		if !h.nextRun.IsZero() {
+			m["nextRun"] = h.nextRun.UTC().Format(time.RFC3339)
+		}
+	}
+	if h.last != nil {
+		m["lastRun"] = h.last.statusMap()
+	}
+	return m
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
+	switch {
+	case suffix == "" && req.Method == "GET":
+		h.serveStatusPage(rw, req)
+	case suffix == "status" && req.Method == "GET":
+		httputil.ReturnJSON(rw, h.StatusMap())
+	case suffix == "start" && req.Method == "POST":
+		if err := h.Start(); err != nil {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		httputil.ReturnJSON(rw, h.StatusMap())
+	case suffix == "stop" && req.Method == "POST":
+		h.Stop()
+		httputil.ReturnJSON(rw, h.StatusMap())
+	default:
+		if hh, ok := h.imp.(http.Handler); ok {
+			hh.ServeHTTP(rw, req)
+			return
+		}
+		httputil.ErrorRouting(rw, req)
+	}
+}
+
+func (h *Handler) serveStatusPage(rw http.ResponseWriter, req *http.Request) {
+	h.loadLastRun()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(rw, "<h1>%s Importer Status</h1>", html.EscapeString(h.host.typ))
+	if h.run != nil {
+		status, items := h.run.progress()
+		fmt.Fprintf(rw, "<p><b>Running since %s: </b>%s; %d items imported.</p>",
+			h.started.Format(time.RFC3339), html.EscapeString(status), items)
+		fmt.Fprintf(rw, "<form method=post action=stop><input type=submit value=Stop></form>")
+	} else {
+		fmt.Fprintf(rw, "<p><b>Idle.</b></p>")
+		fmt.Fprintf(rw, "<form method=post action=start><input type=submit value=Start></form>")
+	}
+	if h.sched != nil {
+		fmt.Fprintf(rw, "<p>Scheduled %s", html.EscapeString(h.sched.String()))
+		if !h.nextRun.IsZero() {
+			fmt.Fprintf(rw, "; next import at %s", h.nextRun.Format(time.RFC3339))
+		}
+		fmt.Fprintf(rw, ". %d scheduled imports skipped while one was running.</p>", h.skipped)
+	}
+	fmt.Fprintf(rw, "<p>%d imports since the server started, %d failed.</p>", h.runs, h.failures)
+	if h.last != nil {
+		fmt.Fprintf(rw, "<h2>Last import:</h2><ul>")
+		fmt.Fprintf(rw, "<li>Started: %s</li>", h.last.Started.Format(time.RFC3339))
+		fmt.Fprintf(rw, "<li>Finished: %s</li>", h.last.Finished.Format(time.RFC3339))
+		fmt.Fprintf(rw, "<li>Status: %s</li>", html.EscapeString(h.last.Status))
+		fmt.Fprintf(rw, "<li>Items imported: %d</li>", h.last.Items)
+		if h.last.Error != "" {
+			fmt.Fprintf(rw, "<li>Error: %s</li>", html.EscapeString(h.last.Error))
+		}
+		fmt.Fprintf(rw, "</ul>")
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/jsonconfig"
+)
+
+// blockingImporter imports an item, then waits to be stopped.
+type blockingImporter struct {
+	started chan bool
+}
+
+func (bi blockingImporter) Run(ctx *RunContext) error {
+	ctx.SetStatus("importing")
+	ctx.AddItems(1)
+	bi.started <- true
+	<-ctx.StopChan()
+	ctx.SetStatus("stopped")
+	return errors.New("interrupted")
+}
+
+func waitIdle(t *testing.T, h *Handler) map[string]interface{} {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if m := h.StatusMap(); m["running"] == false {
+			return m
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("import still running after Stop")
+	return nil
+}
+
+func TestHandlerRuns(t *testing.T) {
+	bi := blockingImporter{make(chan bool)}
+	h := newHandler(&Host{typ: "test", prefix: "/importer-test/"}, bi)
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start = %v", err)
+	}
+	<-bi.started
+	if err := h.Start(); err != errRunning {
+		t.Errorf("second Start = %v; want %v", err, errRunning)
+	}
+	m := h.StatusMap()
+	if m["running"] != true || m["status"] != "importing" || m["items"] != 1 {
+		t.Errorf("status of running import = %v", m)
+	}
+
+	h.Stop()
+	m = waitIdle(t, h)
+	last, ok := m["lastRun"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no lastRun in status %v", m)
+	}
+	if last["status"] != "stopped" || last["items"] != 1 || last["error"] != "interrupted" {
+		t.Errorf("status of last import = %v", last)
+	}
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start after Stop = %v", err)
+	}
+	<-bi.started
+	h.Stop()
+	if m := waitIdle(t, h); m["runs"] != 2 || m["failedRuns"] != 2 {
+		t.Errorf("runs, failedRuns = %v, %v; want 2, 2", m["runs"], m["failedRuns"])
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	ctor := func(*Host, jsonconfig.Obj) (Importer, error) { return nil, nil }
+	Register("test-twice", ctor)
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a type twice didn't panic")
+		}
+	}()
+	Register("test-twice", ctor)
+}
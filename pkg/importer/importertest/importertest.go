@@ -0,0 +1,134 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package importertest runs importers against in-memory storage and
+// index, for their tests.
+package importertest
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/importer"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/jsonsign/signhandler"
+	"camlistore.org/pkg/osutil"
+	"camlistore.org/pkg/search"
+	"camlistore.org/pkg/test"
+)
+
+// testKeyID is the ID of the key of pkg/jsonsign/testdata's secret
+// ring, the imports are signed with.
+const testKeyID = "26F5ABDA"
+
+// An Env is the storage and index of an importer's imports.
+type Env struct {
+	Host  *importer.Host
+	Index *index.Index
+
+	sto *storage
+}
+
+// storage is the target of the imports: it keeps the blobs it
+// receives in memory, and indexes them.
+type storage struct {
+	*index.Index
+	blobs *test.Fetcher
+
+	mu sync.Mutex
+	n  int // blobs received
+}
+
+func (s *storage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	sb, err := s.blobs.ReceiveBlob(br, source)
+	if err != nil {
+		return sb, err
+	}
+	contents, _ := s.blobs.BlobContents(br)
+	if _, err := s.Index.ReceiveBlob(br, strings.NewReader(contents)); err != nil {
+		return sb, err
+	}
+	s.mu.Lock()
+	s.n++
+	s.mu.Unlock()
+	return sb, nil
+}
+
+func (s *storage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
+	return s.blobs.StatBlobs(dest, blobs, wait)
+}
+
+func (s *storage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, error) {
+	return s.blobs.FetchStreaming(br)
+}
+
+// NewEnv returns the Env of an importer of type typ, with an empty
+// storage and index.
+func NewEnv(t *testing.T, typ string) *Env {
+	root, err := osutil.GoPackagePath("camlistore.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretRing := filepath.Join(root, "pkg", "jsonsign", "testdata", "test-secring.gpg")
+	entity, err := jsonsign.EntityFromSecring(testKeyID, secretRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := jsonsign.ArmoredPublicKey(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := &test.Blob{Contents: armored}
+	keys := new(test.Fetcher)
+	keys.AddBlob(pubKey)
+	h, err := blobserver.CreateHandler("jsonsign", nil, jsonconfig.Obj{"keyId": testKeyID, "secretRing": secretRing})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := index.NewMemoryIndex()
+	sto := &storage{Index: idx, blobs: new(test.Fetcher)}
+	idx.KeyFetcher = keys
+	idx.BlobSource = sto.blobs
+	sh := search.NewHandler(idx, pubKey.BlobRef())
+	return &Env{
+		Host:  importer.NewHost(typ, "/importer-"+typ+"/", sto, sh, h.(*signhandler.Handler)),
+		Index: idx,
+		sto:   sto,
+	}
+}
+
+// Run runs an import with imp, failing t if it fails.
+func (e *Env) Run(t *testing.T, imp importer.Importer) {
+	if err := imp.Run(importer.NewRunContext(e.Host)); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+}
+
+// NumBlobs returns the number of blobs uploaded by the imports.
+func (e *Env) NumBlobs() int {
+	e.sto.mu.Lock()
+	defer e.sto.mu.Unlock()
+	return e.sto.n
+}
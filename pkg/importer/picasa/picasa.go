@@ -0,0 +1,340 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package picasa imports the albums and photos of a Picasa Web Albums
+// account.
+//
+// Its importerArgs are the "clientId" and "clientSecret" of a Google
+// API project, and the OAuth "refreshToken" of the account, granting
+// the project access to the https://picasaweb.google.com/data/ scope:
+//
+//   "importerArgs": {
+//       "clientId": "...",
+//       "clientSecret": "...",
+//       "refreshToken": "..."
+//   }
+//
+// Each photo is a permanode, whose camliContent is the file at its
+// original resolution, if Picasa has it, and whose "title" is its
+// caption and "tag"s its keywords. Each album is a collection of its
+// photos, with its "title" and "description", and a member of the
+// root permanode's "albums" path. Photos not updated on Picasa since
+// the last import aren't fetched again.
+package picasa
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/importer"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/schema"
+
+	"camlistore.org/third_party/code.google.com/p/goauth2/oauth"
+)
+
+// feedURL is the URL of the Picasa Web Albums data API feeds of the
+// authenticated user.
+var feedURL = "https://picasaweb.google.com/data/feed/api/user/default"
+
+// entriesPerPage is how many albums or photos are listed per request.
+const entriesPerPage = 1000
+
+const (
+	scope    = "https://picasaweb.google.com/data/"
+	authURL  = "https://accounts.google.com/o/oauth2/auth"
+	tokenURL = "https://accounts.google.com/o/oauth2/token"
+)
+
+func init() {
+	importer.Register("picasa", newFromConfig)
+}
+
+type imp struct {
+	host      *importer.Host
+	transport *oauth.Transport
+}
+
+func newFromConfig(host *importer.Host, conf jsonconfig.Obj) (importer.Importer, error) {
+	im := &imp{
+		host: host,
+		transport: &oauth.Transport{
+			Config: &oauth.Config{
+				ClientId:     conf.RequiredString("clientId"),
+				ClientSecret: conf.RequiredString("clientSecret"),
+				Scope:        scope,
+				AuthURL:      authURL,
+				TokenURL:     tokenURL,
+			},
+			Token: &oauth.Token{
+				RefreshToken: conf.RequiredString("refreshToken"),
+			},
+		},
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+// An Atom feed of the data API. Its elements are in the Atom, the
+// gphoto (http://schemas.google.com/photos/2007) and the Media RSS
+// (http://search.yahoo.com/mrss/) namespaces.
+type feed struct {
+	Entries []entry `xml:"http://www.w3.org/2005/Atom entry"`
+}
+
+// An entry is an album or a photo.
+type entry struct {
+	ID        string `xml:"http://schemas.google.com/photos/2007 id"`
+	Title     string `xml:"http://www.w3.org/2005/Atom title"`
+	Summary   string `xml:"http://www.w3.org/2005/Atom summary"` // or a photo's caption
+	Updated   string `xml:"http://www.w3.org/2005/Atom updated"`
+	Timestamp string `xml:"http://schemas.google.com/photos/2007 timestamp"` // when taken, in ms
+	Content   struct {
+		Src  string `xml:"src,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"http://www.w3.org/2005/Atom content"`
+	Group struct {
+		Keywords string `xml:"http://search.yahoo.com/mrss/ keywords"` // comma-separated
+		Content  []struct {
+			URL    string `xml:"url,attr"`
+			Medium string `xml:"medium,attr"`
+		} `xml:"http://search.yahoo.com/mrss/ content"`
+	} `xml:"http://search.yahoo.com/mrss/ group"`
+}
+
+func parseFeed(r io.Reader) ([]entry, error) {
+	var f feed
+	if err := xml.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	return f.Entries, nil
+}
+
+// originalURL returns the URL of the photo's file at its original
+// resolution, which Picasa serves as the content of feeds requested
+// with "imgmax=d".
+func (e *entry) originalURL() string {
+	if e.Content.Src != "" {
+		return e.Content.Src
+	}
+	for _, c := range e.Group.Content {
+		if c.Medium == "image" {
+			return c.URL
+		}
+	}
+	return ""
+}
+
+func (e *entry) tags() []string {
+	var tags []string
+	for _, k := range strings.Split(e.Group.Keywords, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			tags = append(tags, k)
+		}
+	}
+	return tags
+}
+
+// takenTime returns when the photo was taken.
+func (e *entry) takenTime() (time.Time, bool) {
+	ms, err := strconv.ParseInt(e.Timestamp, 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+// getFeed fetches all the entries of the feed at u, with args.
+func (im *imp) getFeed(u string, args url.Values) ([]entry, error) {
+	var entries []entry
+	for start := 1; ; start += entriesPerPage {
+		args.Set("start-index", strconv.Itoa(start))
+		args.Set("max-results", strconv.Itoa(entriesPerPage))
+		req, err := http.NewRequest("GET", u+"?"+args.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("GData-Version", "2")
+		res, err := im.transport.Client().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("picasa: fetching %s: %s", u, res.Status)
+		}
+		page, err := parseFeed(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("picasa: reading %s: %v", u, err)
+		}
+		entries = append(entries, page...)
+		if len(page) < entriesPerPage {
+			return entries, nil
+		}
+	}
+}
+
+func (im *imp) Run(ctx *importer.RunContext) error {
+	im.transport.Transport = im.host.HTTPClient().Transport
+	if err := im.transport.Refresh(); err != nil {
+		return fmt.Errorf("picasa: refreshing the access token: %v", err)
+	}
+	root, err := im.host.RootObject()
+	if err != nil {
+		return err
+	}
+	if err := root.SetAttr("title", "Picasa"); err != nil {
+		return err
+	}
+	albumsObj, err := root.ChildPathObject("albums")
+	if err != nil {
+		return err
+	}
+	if err := albumsObj.SetAttr("title", "Picasa albums"); err != nil {
+		return err
+	}
+	ctx.SetStatus("listing albums")
+	albums, err := im.getFeed(feedURL, url.Values{"kind": {"album"}})
+	if err != nil {
+		return err
+	}
+	for i, a := range albums {
+		if ctx.Stopped() {
+			return importer.ErrInterrupted
+		}
+		ctx.SetStatus("importing album %d of %d: %s", i+1, len(albums), a.Title)
+		o, err := im.importAlbum(ctx, a)
+		if err != nil {
+			return fmt.Errorf("picasa: album %s: %v", a.ID, err)
+		}
+		if err := albumsObj.AddAttr("camliMember", o.PermanodeRef().String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *imp) importAlbum(ctx *importer.RunContext, a entry) (*importer.Object, error) {
+	o, err := im.host.PlannedObject("album:" + a.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.SetAttrs(
+		"picasaId", a.ID,
+		"title", a.Title,
+		"description", a.Summary,
+	); err != nil {
+		return nil, err
+	}
+	photos, err := im.getFeed(feedURL+"/albumid/"+url.QueryEscape(a.ID), url.Values{
+		"kind":   {"photo"},
+		"imgmax": {"d"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, p := range photos {
+		if ctx.Stopped() {
+			return nil, importer.ErrInterrupted
+		}
+		po, err := im.importPhoto(p)
+		if err != nil {
+			return nil, fmt.Errorf("photo %s: %v", p.ID, err)
+		}
+		if po == nil {
+			continue
+		}
+		members = append(members, po.PermanodeRef().String())
+		ctx.AddItems(1)
+	}
+	if err := o.SetAttrValues("camliMember", members); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// importPhoto makes the permanode of the photo p, or returns nil if
+// it has no file.
+func (im *imp) importPhoto(p entry) (*importer.Object, error) {
+	u := p.originalURL()
+	if u == "" {
+		log.Printf("picasa: photo %s has no file; skipping", p.ID)
+		return nil, nil
+	}
+	o, err := im.host.PlannedObject("photo:" + p.ID)
+	if err != nil {
+		return nil, err
+	}
+	if o.Attr("camliContent") == "" || o.Attr("picasaUpdated") != p.Updated {
+		fileRef, err := im.fetchPhoto(p, u)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.SetAttr("camliContent", fileRef); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.SetAttrs(
+		"picasaId", p.ID,
+		"title", p.Summary,
+		"picasaUpdated", p.Updated,
+	); err != nil {
+		return nil, err
+	}
+	if err := o.SetAttrValues("tag", p.tags()); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// fetchPhoto stores the file of p at u, and returns its blobref.
+func (im *imp) fetchPhoto(p entry, u string) (string, error) {
+	res, err := im.transport.Client().Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", u, res.Status)
+	}
+	name := p.Title
+	if name == "" {
+		if pu, err := url.Parse(u); err == nil {
+			name = path.Base(pu.Path)
+		}
+	}
+	fileMap := schema.NewFileMap(name)
+	if t, ok := p.takenTime(); ok {
+		fileMap["unixMtime"] = schema.RFC3339FromTime(t)
+	}
+	br, err := schema.WriteFileMap(im.host.Target(), fileMap, res.Body)
+	if err != nil {
+		return "", err
+	}
+	return br.String(), nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package picasa
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const albumFeed = `<?xml version='1.0' encoding='UTF-8'?>
+<feed xmlns='http://www.w3.org/2005/Atom' xmlns:openSearch='http://a9.com/-/spec/opensearch/1.1/'
+      xmlns:gphoto='http://schemas.google.com/photos/2007' xmlns:media='http://search.yahoo.com/mrss/'>
+  <title>test</title>
+  <openSearch:totalResults>1</openSearch:totalResults>
+  <entry>
+    <id>https://picasaweb.google.com/data/entry/user/123/albumid/5869</id>
+    <updated>2013-04-21T10:03:37.181Z</updated>
+    <title>Trip to Paris</title>
+    <summary>Spring, 2013.</summary>
+    <gphoto:id>5869</gphoto:id>
+    <gphoto:numphotos>1</gphoto:numphotos>
+  </entry>
+</feed>`
+
+const photoFeed = `<?xml version='1.0' encoding='UTF-8'?>
+<feed xmlns='http://www.w3.org/2005/Atom' xmlns:gphoto='http://schemas.google.com/photos/2007'
+      xmlns:media='http://search.yahoo.com/mrss/'>
+  <entry>
+    <id>https://picasaweb.google.com/data/entry/user/123/albumid/5869/photoid/5870</id>
+    <updated>2013-04-21T10:05:12.000Z</updated>
+    <title>IMG_0042.JPG</title>
+    <summary>The Eiffel Tower.</summary>
+    <content type='image/jpeg' src='https://lh3.googleusercontent.com/a/d/IMG_0042.JPG'/>
+    <gphoto:id>5870</gphoto:id>
+    <gphoto:timestamp>1366538400000</gphoto:timestamp>
+    <media:group>
+      <media:content url='https://lh3.googleusercontent.com/a/IMG_0042.JPG' medium='image'/>
+      <media:keywords>paris, tower,</media:keywords>
+    </media:group>
+  </entry>
+  <entry>
+    <gphoto:id>5871</gphoto:id>
+    <title>IMG_0043.JPG</title>
+    <media:group>
+      <media:content url='https://lh3.googleusercontent.com/a/s1600/IMG_0043.JPG' medium='image'/>
+    </media:group>
+  </entry>
+</feed>`
+
+func TestParseAlbums(t *testing.T) {
+	albums, err := parseFeed(strings.NewReader(albumFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 1 {
+		t.Fatalf("got %d albums; want 1", len(albums))
+	}
+	a := albums[0]
+	if a.ID != "5869" || a.Title != "Trip to Paris" || a.Summary != "Spring, 2013." {
+		t.Errorf("album = %+v", a)
+	}
+}
+
+func TestParsePhotos(t *testing.T) {
+	photos, err := parseFeed(strings.NewReader(photoFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(photos) != 2 {
+		t.Fatalf("got %d photos; want 2", len(photos))
+	}
+	p := photos[0]
+	if p.ID != "5870" || p.Title != "IMG_0042.JPG" || p.Summary != "The Eiffel Tower." || p.Updated != "2013-04-21T10:05:12.000Z" {
+		t.Errorf("photo = %+v", p)
+	}
+	if got, want := p.originalURL(), "https://lh3.googleusercontent.com/a/d/IMG_0042.JPG"; got != want {
+		t.Errorf("originalURL = %q; want %q", got, want)
+	}
+	if got, want := p.tags(), []string{"paris", "tower"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tags = %q; want %q", got, want)
+	}
+	taken, ok := p.takenTime()
+	if got, want := taken.UTC().Format("2006-01-02T15:04:05Z"), "2013-04-21T10:00:00Z"; !ok || got != want {
+		t.Errorf("takenTime = %s, %v; want %s", got, ok, want)
+	}
+
+	p = photos[1]
+	if got, want := p.originalURL(), "https://lh3.googleusercontent.com/a/s1600/IMG_0043.JPG"; got != want {
+		t.Errorf("originalURL without content = %q; want %q", got, want)
+	}
+	if tags := p.tags(); len(tags) != 0 {
+		t.Errorf("tags without keywords = %q", tags)
+	}
+	if _, ok := p.takenTime(); ok {
+		t.Error("takenTime without timestamp is ok")
+	}
+}
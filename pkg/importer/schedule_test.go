@@ -0,0 +1,80 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package importer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// A Saturday.
+	now := time.Date(2013, 4, 20, 10, 17, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"@every 6h", "2013-04-20 16:17:30"},
+		{"@hourly", "2013-04-20 11:00:00"},
+		{"@daily", "2013-04-21 00:00:00"},
+		{"@weekly", "2013-04-21 00:00:00"},
+		{"@monthly", "2013-05-01 00:00:00"},
+		{"*/15 * * * *", "2013-04-20 10:30:00"},
+		{"30 4 * * 1-5", "2013-04-22 04:30:00"},
+		{"0 9,18 * * *", "2013-04-20 18:00:00"},
+		{"0 0 1 1 *", "2014-01-01 00:00:00"},
+		{"0 12 * * 7", "2013-04-21 12:00:00"},
+		// Either the day of the month or of the week.
+		{"0 0 25 * 1", "2013-04-22 00:00:00"},
+		{"17 10 * * *", "2013-04-21 10:17:00"},
+		{"0 0 30 2 *", "never"},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tt.spec, err)
+			continue
+		}
+		got := "never"
+		if next := s.next(now); !next.IsZero() {
+			got = next.Format("2006-01-02 15:04:05")
+		}
+		if got != tt.want {
+			t.Errorf("next of %q = %s; want %s", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"@every 10s",
+		"@every often",
+		"@sometimes",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded", spec)
+		}
+	}
+}
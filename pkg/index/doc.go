@@ -44,5 +44,11 @@ for search operations:
  * For GetOwnerClaims(permanode, signer):
    "claim|<permanode-blobref>|<keyid>|<date>|<claim-blobref>" => "<URL:type>|<URL:attr>|<URL:value>"
 
+ * Delegations, making the claims of the delegate key the delegator's:
+   "delegation|<delegator-keyid>|<delegate-keyid>|<delegation-blobref>" = "1"
+   "delegatedby|<delegate-keyid>|<delegator-keyid>|<delegation-blobref>" = "1"
+   and their revocations, by the delegator or the delegate:
+   "revocation|<delegation-blobref>|<revocation-blobref>" = "<signer-keyid>"
+
 */
 package index
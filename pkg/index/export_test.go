@@ -16,6 +16,8 @@ limitations under the License.
 
 package index
 
+import "time"
+
 func ExpReverseTimeString(s string) string {
 	return reverseTimeString(s)
 }
@@ -23,3 +25,7 @@ func ExpReverseTimeString(s string) string {
 func ExpUnreverseTimeString(s string) string {
 	return unreverseTimeString(s)
 }
+
+func ExpEXIFTime(head []byte) (time.Time, bool) {
+	return exifTime(head)
+}
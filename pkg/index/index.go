@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -185,7 +186,9 @@ func closeIterator(it Iterator, perr *error) {
 	}
 }
 
-// isDeleted returns whether br (a blobref or a claim) should be considered deleted.
+// isDeleted returns whether br (a permanode or a claim) should be
+// considered deleted: whether it has a delete claim that isn't itself
+// deleted.
 func (x *Index) isDeleted(br *blobref.BlobRef) bool {
 	var err error
 	it := x.queryPrefix(keyDeleted, br)
@@ -207,7 +210,9 @@ func (x *Index) isDeleted(br *blobref.BlobRef) bool {
 		// TODO(mpl): Each delete and undo delete adds a level of
 		// recursion so this could recurse far. is there a way to
 		// go faster in a worst case scenario?
-		return !x.isDeleted(delClaimRef)
+		if !x.isDeleted(delClaimRef) {
+			return true
+		}
 	}
 	return false
 }
@@ -216,7 +221,7 @@ func (x *Index) GetRecentPermanodes(dest chan *search.Result, owner *blobref.Blo
 	defer close(dest)
 	// TODO(bradfitz): this will need to be a context wrapper too, like storage
 
-	keyId, err := x.keyId(owner)
+	keyIds, err := x.keyIds(owner)
 	if err == ErrNotFound {
 		return nil
 	}
@@ -224,7 +229,38 @@ func (x *Index) GetRecentPermanodes(dest chan *search.Result, owner *blobref.Blo
 		return err
 	}
 
+	// Each key's most recent permanodes include those of the most
+	// recent overall that it modified last.
+	var results []*search.Result
+	for _, keyId := range keyIds {
+		res, err := x.recentPermanodes(owner, keyId, limit, nil)
+		if err != nil {
+			return err
+		}
+		results = append(results, res...)
+	}
+	if len(keyIds) > 1 {
+		sort.Stable(byLastModTime(results))
+	}
+	var seenPermanode dupSkipper
 	sent := 0
+	for _, r := range results {
+		if seenPermanode.Dup(r.BlobRef.String()) {
+			continue
+		}
+		dest <- r
+		sent++
+		if sent == limit {
+			break
+		}
+	}
+	return nil
+}
+
+// recentPermanodes returns the permanodes most recently modified by
+// the claims of keyId, at most limit, the most recent first. If keep
+// is not nil, only the permanodes it keeps are returned.
+func (x *Index) recentPermanodes(owner *blobref.BlobRef, keyId string, limit int, keep func(pn *blobref.BlobRef) (bool, error)) (results []*search.Result, err error) {
 	var seenPermanode dupSkipper
 
 	it := x.queryPrefix(keyRecentPermanode, keyId)
@@ -249,11 +285,70 @@ func (x *Index) GetRecentPermanodes(dest chan *search.Result, owner *blobref.Blo
 		if seenPermanode.Dup(permaStr) {
 			continue
 		}
-		dest <- &search.Result{
+		if keep != nil {
+			ok, err := keep(permaRef)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		results = append(results, &search.Result{
 			BlobRef:     permaRef,
 			Signer:      owner, // TODO(bradfitz): kinda. usually. for now.
 			LastModTime: mTimeSec,
+		})
+		if len(results) == limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+func (x *Index) GetDatedPermanodes(dest chan *search.Result, owner *blobref.BlobRef, limit int) (err error) {
+	defer close(dest)
+
+	keyIds, err := x.keyIds(owner)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The permanodes with a date are in the pndate rows; the
+	// others are dated by their last modification, and found in
+	// the recent ones. Each list's first limit make the first
+	// limit overall.
+	dates := make(map[string]permanodeTimes)
+	var results []*search.Result
+	for _, keyId := range keyIds {
+		dated, err := x.datedPermanodes(owner, keyId, limit, dates)
+		if err != nil {
+			return err
+		}
+		undated, err := x.recentPermanodes(owner, keyId, limit, func(pn *blobref.BlobRef) (bool, error) {
+			pt, err := x.cachedPermanodeTimes(pn, owner, dates)
+			return pt.date.IsZero(), err
+		})
+		if err != nil {
+			return err
+		}
+		for _, r := range undated {
+			r.Date = r.LastModTime
+		}
+		results = append(results, dated...)
+		results = append(results, undated...)
+	}
+	sort.Stable(byDate(results))
+	var seenPermanode dupSkipper
+	sent := 0
+	for _, r := range results {
+		if seenPermanode.Dup(r.BlobRef.String()) {
+			continue
 		}
+		dest <- r
 		sent++
 		if sent == limit {
 			break
@@ -262,8 +357,135 @@ func (x *Index) GetRecentPermanodes(dest chan *search.Result, owner *blobref.Blo
 	return nil
 }
 
+// datedPermanodes returns the permanodes dated by the claims of keyId,
+// at most limit, the most recent date first. dates caches the times of
+// the permanodes looked at.
+func (x *Index) datedPermanodes(owner *blobref.BlobRef, keyId string, limit int, dates map[string]permanodeTimes) (results []*search.Result, err error) {
+	var seenPermanode dupSkipper
+
+	it := x.queryPrefix(keyPermanodeDate, keyId)
+	defer closeIterator(it, &err)
+	for it.Next() {
+		permaStr := it.Value()
+		parts := strings.SplitN(it.Key(), "|", 4)
+		if len(parts) != 4 {
+			continue
+		}
+		rowDate, err := time.Parse(time.RFC3339, unreverseTimeString(parts[2]))
+		if err != nil {
+			continue
+		}
+		permaRef := blobref.Parse(permaStr)
+		if permaRef == nil {
+			continue
+		}
+		if x.isDeleted(permaRef) {
+			continue
+		}
+		pt, err := x.cachedPermanodeTimes(permaRef, owner, dates)
+		if err != nil {
+			return nil, err
+		}
+		if !pt.date.Equal(rowDate) {
+			// A row of a date since changed.
+			continue
+		}
+		if seenPermanode.Dup(permaStr) {
+			continue
+		}
+		results = append(results, &search.Result{
+			BlobRef:     permaRef,
+			Signer:      owner,
+			LastModTime: pt.modTime.Unix(),
+			Date:        pt.date.Unix(),
+		})
+		if len(results) == limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+// permanodeTimes are the times of a permanode, per the claims of its
+// owner.
+type permanodeTimes struct {
+	date    time.Time // camliDate or EXIF time, or zero if none
+	modTime time.Time // of the last claim
+}
+
+func (x *Index) cachedPermanodeTimes(pn, owner *blobref.BlobRef, cache map[string]permanodeTimes) (permanodeTimes, error) {
+	if pt, ok := cache[pn.String()]; ok {
+		return pt, nil
+	}
+	pt, err := x.permanodeTimes(pn, owner)
+	if err != nil {
+		return pt, err
+	}
+	cache[pn.String()] = pt
+	return pt, nil
+}
+
+// permanodeTimes returns the times of the permanode pn, per the claims
+// of owner. Its date is its camliDate attribute, or else the EXIF time
+// of its camliContent image.
+func (x *Index) permanodeTimes(pn, owner *blobref.BlobRef) (pt permanodeTimes, err error) {
+	claims, err := x.GetOwnerClaims(pn, owner)
+	if err != nil {
+		return pt, err
+	}
+	sort.Sort(claims)
+	var date, content string
+	for _, cl := range claims {
+		pt.modTime = cl.Date
+		var v *string
+		switch cl.Attr {
+		case "camliDate":
+			v = &date
+		case "camliContent":
+			v = &content
+		default:
+			continue
+		}
+		switch cl.Type {
+		case "set-attribute", "add-attribute":
+			*v = cl.Value
+		case "del-attribute":
+			if cl.Value == "" || cl.Value == *v {
+				*v = ""
+			}
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		pt.date = t.UTC().Truncate(time.Second)
+		return pt, nil
+	}
+	if br := blobref.Parse(content); br != nil {
+		t, err := x.GetFileTime(br)
+		if err == nil {
+			pt.date = t.UTC()
+			return pt, nil
+		}
+		if err != os.ErrNotExist {
+			return pt, err
+		}
+	}
+	return pt, nil
+}
+
+type byLastModTime []*search.Result
+
+func (s byLastModTime) Len() int           { return len(s) }
+func (s byLastModTime) Less(i, j int) bool { return s[i].LastModTime > s[j].LastModTime }
+func (s byLastModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byDate []*search.Result
+
+func (s byDate) Len() int           { return len(s) }
+func (s byDate) Less(i, j int) bool { return s[i].Date > s[j].Date }
+func (s byDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 func (x *Index) GetOwnerClaims(permaNode, owner *blobref.BlobRef) (cl search.ClaimList, err error) {
-	keyId, err := x.keyId(owner)
+	keyIds, err := x.keyIds(owner)
 	if err == ErrNotFound {
 		err = nil
 		return
@@ -271,6 +493,15 @@ func (x *Index) GetOwnerClaims(permaNode, owner *blobref.BlobRef) (cl search.Cla
 	if err != nil {
 		return nil, err
 	}
+	for _, keyId := range keyIds {
+		if cl, err = x.appendOwnerClaims(cl, permaNode, owner, keyId); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (x *Index) appendOwnerClaims(cl search.ClaimList, permaNode, owner *blobref.BlobRef, keyId string) (_ search.ClaimList, err error) {
 	prefix := pipes("claim", permaNode, keyId, "")
 	it := x.queryPrefixString(prefix)
 	defer closeIterator(it, &err)
@@ -284,6 +515,17 @@ func (x *Index) GetOwnerClaims(permaNode, owner *blobref.BlobRef) (cl search.Cla
 		if claimRef == nil {
 			continue
 		}
+		if x.isDeleted(claimRef) {
+			continue
+		}
+		attr, value := urld(valPart[1]), urld(valPart[2])
+		if search.IsBlobReferenceAttribute(attr) || strings.HasPrefix(attr, "camliPath:") {
+			// Links to deleted permanodes, such as
+			// members, are hidden with them.
+			if target := blobref.Parse(value); target != nil && x.isDeleted(target) {
+				continue
+			}
+		}
 		date, _ := time.Parse(time.RFC3339, keyPart[3])
 		cl = append(cl, &search.Claim{
 			BlobRef:   claimRef,
@@ -291,11 +533,11 @@ func (x *Index) GetOwnerClaims(permaNode, owner *blobref.BlobRef) (cl search.Cla
 			Permanode: permaNode,
 			Date:      date,
 			Type:      urld(valPart[0]),
-			Attr:      urld(valPart[1]),
-			Value:     urld(valPart[2]),
+			Attr:      attr,
+			Value:     value,
 		})
 	}
-	return
+	return cl, nil
 }
 
 func (x *Index) GetBlobMimeType(blob *blobref.BlobRef) (mime string, size int64, err error) {
@@ -307,6 +549,11 @@ func (x *Index) GetBlobMimeType(blob *blobref.BlobRef) (mime string, size int64,
 	if err != nil {
 		return
 	}
+	if strings.HasSuffix(meta, "|application/json; camliType=permanode") || strings.HasSuffix(meta, "|application/json; camliType=claim") {
+		if x.isDeleted(blob) {
+			return "", 0, os.ErrNotExist
+		}
+	}
 	pos := strings.Index(meta, "|")
 	if pos < 0 {
 		panic(fmt.Sprintf("Bogus index row for key %q: got value %q", key, meta))
@@ -321,23 +568,128 @@ func (x *Index) keyId(signer *blobref.BlobRef) (string, error) {
 	return x.s.Get("signerkeyid:" + signer.String())
 }
 
-func (x *Index) PermanodeOfSignerAttrValue(signer *blobref.BlobRef, attr, val string) (permaNode *blobref.BlobRef, err error) {
+// keyIds returns the key ids whose claims are signer's: those of the
+// keys its key is connected to by "delegation" blobs. The chain is
+// followed up to the key that delegated first, such as the oldest key
+// of rotated ones, and from there down to all its delegates. The first
+// key id is that root's.
+func (x *Index) keyIds(signer *blobref.BlobRef) ([]string, error) {
 	keyId, err := x.keyId(signer)
+	if err != nil {
+		return nil, err
+	}
+	root := keyId
+	seen := map[string]bool{root: true}
+	for {
+		delegators, err := x.delegationKeyIds(keyDelegatedBy, root)
+		if err != nil {
+			return nil, err
+		}
+		if len(delegators) == 0 || seen[delegators[0]] {
+			break
+		}
+		root = delegators[0]
+		seen[root] = true
+	}
+	ids := []string{root}
+	seen = map[string]bool{root: true}
+	for i := 0; i < len(ids); i++ {
+		delegates, err := x.delegationKeyIds(keyDelegation, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range delegates {
+			if !seen[d] {
+				seen[d] = true
+				ids = append(ids, d)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// delegationKeyIds returns the key ids that keyId delegated to, for
+// keyDelegation, or that delegated to keyId, for keyDelegatedBy, by
+// delegations not revoked.
+func (x *Index) delegationKeyIds(key *keyType, keyId string) (ids []string, err error) {
+	it := x.queryPrefix(key, keyId)
+	defer closeIterator(it, &err)
+	for it.Next() {
+		// parts are [name, keyId, other key id, delegation blobref].
+		parts := strings.Split(it.Key(), "|")
+		if len(parts) != 4 {
+			continue
+		}
+		br := blobref.Parse(parts[3])
+		if br == nil {
+			continue
+		}
+		revoked, err := x.delegationRevoked(br, parts[1], parts[2])
+		if err != nil {
+			return nil, err
+		}
+		if !revoked {
+			ids = append(ids, parts[2])
+		}
+	}
+	return ids, nil
+}
+
+// delegationRevoked reports whether the delegation between the keys
+// a and b has a revocation signed by either.
+func (x *Index) delegationRevoked(delegation *blobref.BlobRef, a, b string) (revoked bool, err error) {
+	it := x.queryPrefix(keyRevocation, delegation)
+	defer closeIterator(it, &err)
+	for it.Next() {
+		if signer := it.Value(); signer == a || signer == b {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (x *Index) PermanodeOfSignerAttrValue(signer *blobref.BlobRef, attr, val string) (permaNode *blobref.BlobRef, err error) {
+	keyIds, err := x.keyIds(signer)
 	if err == ErrNotFound {
 		return nil, os.ErrNotExist
 	}
 	if err != nil {
 		return nil, err
 	}
+	// With several keys, the permanode of the most recent claim.
+	var newest string // reverse claim time
+	for _, keyId := range keyIds {
+		pn, rt, err := x.permanodeOfKeyAttrValue(keyId, attr, val)
+		if err != nil {
+			return nil, err
+		}
+		if pn != nil && (permaNode == nil || rt < newest) {
+			permaNode, newest = pn, rt
+		}
+	}
+	if permaNode == nil {
+		return nil, os.ErrNotExist
+	}
+	return permaNode, nil
+}
+
+// permanodeOfKeyAttrValue returns the permanode of keyId's most recent
+// claim setting attr to val, if not deleted, and the claim's reverse
+// time.
+func (x *Index) permanodeOfKeyAttrValue(keyId, attr, val string) (permaNode *blobref.BlobRef, reverseTime string, err error) {
 	it := x.queryPrefix(keySignerAttrValue, keyId, attr, val)
 	defer closeIterator(it, &err)
 	if it.Next() {
 		permaRef := blobref.Parse(it.Value())
 		if permaRef != nil && !x.isDeleted(permaRef) {
-			return permaRef, nil
+			// parts are ["signerattrvalue", keyId, attr, val, reverse claimdate, claimref].
+			if parts := strings.Split(it.Key(), "|"); len(parts) == 6 {
+				reverseTime = parts[4]
+			}
+			return permaRef, reverseTime, nil
 		}
 	}
-	return nil, os.ErrNotExist
+	return nil, "", nil
 }
 
 // This is just like PermanodeOfSignerAttrValue except we return multiple and dup-suppress.
@@ -352,7 +704,7 @@ func (x *Index) SearchPermanodesWithAttr(dest chan<- *blobref.BlobRef, request *
 		return errors.New("index: missing Attribute in SearchPermanodesWithAttr")
 	}
 
-	keyId, err := x.keyId(request.Signer)
+	keyIds, err := x.keyIds(request.Signer)
 	if err == ErrNotFound {
 		return nil
 	}
@@ -360,6 +712,18 @@ func (x *Index) SearchPermanodesWithAttr(dest chan<- *blobref.BlobRef, request *
 		return err
 	}
 	seen := make(map[string]bool)
+	for _, keyId := range keyIds {
+		if err := x.searchKeyPermanodesWithAttr(dest, keyId, request, seen); err != nil {
+			return err
+		}
+		if len(seen) == request.MaxResults {
+			break
+		}
+	}
+	return nil
+}
+
+func (x *Index) searchKeyPermanodesWithAttr(dest chan<- *blobref.BlobRef, keyId string, request *search.PermanodeByAttrRequest, seen map[string]bool) (err error) {
 	var it *prefixIter
 	// TODO(mpl): test this case in particular when making a test for that method.
 	if request.Query == "" {
@@ -392,7 +756,7 @@ func (x *Index) SearchPermanodesWithAttr(dest chan<- *blobref.BlobRef, request *
 
 func (x *Index) PathsOfSignerTarget(signer, target *blobref.BlobRef) (paths []*search.Path, err error) {
 	paths = []*search.Path{}
-	keyId, err := x.keyId(signer)
+	keyIds, err := x.keyIds(signer)
 	if err != nil {
 		if err == ErrNotFound {
 			err = nil
@@ -402,7 +766,21 @@ func (x *Index) PathsOfSignerTarget(signer, target *blobref.BlobRef) (paths []*s
 
 	mostRecent := make(map[string]*search.Path)
 	maxClaimDates := make(map[string]string)
+	for _, keyId := range keyIds {
+		if err := x.keyPathsOfTarget(keyId, target, mostRecent, maxClaimDates); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range mostRecent {
+		paths = append(paths, v)
+	}
+	return paths, nil
+}
 
+// keyPathsOfTarget sets in mostRecent, by base and suffix, the most
+// recent active paths of keyId to target, tracking in maxClaimDates
+// the dates of the most recent claims.
+func (x *Index) keyPathsOfTarget(keyId string, target *blobref.BlobRef, mostRecent map[string]*search.Path, maxClaimDates map[string]string) (err error) {
 	it := x.queryPrefix(keyPathBackward, keyId, target)
 	defer closeIterator(it, &err)
 	for it.Next() {
@@ -416,6 +794,9 @@ func (x *Index) PathsOfSignerTarget(signer, target *blobref.BlobRef) (paths []*s
 		if claimRef == nil || baseRef == nil {
 			continue
 		}
+		if x.isDeleted(claimRef) || x.isDeleted(baseRef) {
+			continue
+		}
 		claimDate := valPart[0]
 		active := valPart[2]
 		suffix := urld(valPart[3])
@@ -436,22 +817,27 @@ func (x *Index) PathsOfSignerTarget(signer, target *blobref.BlobRef) (paths []*s
 			}
 		}
 	}
-	for _, v := range mostRecent {
-		paths = append(paths, v)
-	}
-	return paths, nil
+	return nil
 }
 
 func (x *Index) PathsLookup(signer, base *blobref.BlobRef, suffix string) (paths []*search.Path, err error) {
 	paths = []*search.Path{}
-	keyId, err := x.keyId(signer)
+	keyIds, err := x.keyIds(signer)
 	if err != nil {
 		if err == ErrNotFound {
 			err = nil
 		}
 		return
 	}
+	for _, keyId := range keyIds {
+		if paths, err = x.appendKeyPaths(paths, keyId, base, suffix); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
 
+func (x *Index) appendKeyPaths(paths []*search.Path, keyId string, base *blobref.BlobRef, suffix string) (_ []*search.Path, err error) {
 	it := x.queryPrefix(keyPathForward, keyId, base, suffix)
 	defer closeIterator(it, &err)
 	for it.Next() {
@@ -468,6 +854,9 @@ func (x *Index) PathsLookup(signer, base *blobref.BlobRef, suffix string) (paths
 		claimDate := unreverseTimeString(keyPart[3])
 		suffix := urld(keyPart[2])
 		target := blobref.Parse(valPart[1])
+		if x.isDeleted(claimRef) || (target != nil && x.isDeleted(target)) {
+			continue
+		}
 
 		// TODO(bradfitz): investigate what's up with deleted
 		// forward path claims here.  Needs docs with the
@@ -484,7 +873,7 @@ func (x *Index) PathsLookup(signer, base *blobref.BlobRef, suffix string) (paths
 		}
 		paths = append(paths, path)
 	}
-	return
+	return paths, nil
 }
 
 func (x *Index) PathLookup(signer, base *blobref.BlobRef, suffix string, at time.Time) (*search.Path, error) {
@@ -565,6 +954,50 @@ func (x *Index) GetFileInfo(fileRef *blobref.BlobRef) (*search.FileInfo, error)
 	return fi, nil
 }
 
+func (x *Index) GetImageInfo(fileRef *blobref.BlobRef) (*search.ImageInfo, error) {
+	key := keyImageSize.Key(fileRef)
+	v, err := x.s.Get(key)
+	if err == ErrNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	valPart := strings.Split(v, "|")
+	if len(valPart) != 2 {
+		log.Printf("index: bogus key %q = %q", key, v)
+		return nil, os.ErrNotExist
+	}
+	width, err := strconv.Atoi(valPart[0])
+	if err != nil {
+		log.Printf("index: bogus integer at position 0 in key %q = %q", key, v)
+		return nil, os.ErrNotExist
+	}
+	height, err := strconv.Atoi(valPart[1])
+	if err != nil {
+		log.Printf("index: bogus integer at position 1 in key %q = %q", key, v)
+		return nil, os.ErrNotExist
+	}
+	return &search.ImageInfo{Width: width, Height: height}, nil
+}
+
+func (x *Index) GetFileTime(fileRef *blobref.BlobRef) (time.Time, error) {
+	key := keyEXIFTime.Key(fileRef)
+	v, err := x.s.Get(key)
+	if err == ErrNotFound {
+		return time.Time{}, os.ErrNotExist
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		log.Printf("index: bogus time in key %q = %q", key, v)
+		return time.Time{}, os.ErrNotExist
+	}
+	return t, nil
+}
+
 func (x *Index) EdgesTo(ref *blobref.BlobRef, opts *search.EdgesToOpts) (edges []*search.Edge, err error) {
 	it := x.queryPrefix(keyEdgeBackward, ref)
 	defer closeIterator(it, &err)
@@ -585,6 +1018,14 @@ func (x *Index) EdgesTo(ref *blobref.BlobRef, opts *search.EdgesToOpts) (edges [
 		}
 		parentType, parentName := valPart[0], valPart[1]
 		if parentType == "permanode" {
+			if x.isDeleted(parentRef) {
+				continue
+			}
+			if len(keyPart) > 2 {
+				if claimRef := blobref.Parse(keyPart[2]); claimRef != nil && x.isDeleted(claimRef) {
+					continue
+				}
+			}
 			permanodeParents[parent] = parentRef
 		} else {
 			edges = append(edges, &search.Edge{
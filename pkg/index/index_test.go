@@ -21,10 +21,12 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"camlistore.org/pkg/index"
 	"camlistore.org/pkg/index/indextest"
@@ -43,6 +45,20 @@ func TestReverseTimeString(t *testing.T) {
 	}
 }
 
+func TestEXIFTime(t *testing.T) {
+	head, err := ioutil.ReadFile(filepath.Join("..", "images", "testdata", "f1-exif.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := index.ExpEXIFTime(head)
+	if want := "2012-11-04T05:42:02Z"; !ok || got.Format(time.RFC3339) != want {
+		t.Errorf("exifTime = %v, %v; want %s", got, ok, want)
+	}
+	if _, ok := index.ExpEXIFTime([]byte("not an image")); ok {
+		t.Errorf("exifTime of garbage is ok")
+	}
+}
+
 func TestIndex_Memory(t *testing.T) {
 	indextest.Index(t, index.NewMemoryIndex)
 }
@@ -59,6 +75,36 @@ func TestEdgesTo_Memory(t *testing.T) {
 	indextest.EdgesTo(t, index.NewMemoryIndex)
 }
 
+func TestDelegation_Memory(t *testing.T) {
+	indextest.Delegation(t, index.NewMemoryIndex)
+}
+
+func TestDeletion_Memory(t *testing.T) {
+	indextest.Deletion(t, index.NewMemoryIndex)
+}
+
+func TestClaimDates_Memory(t *testing.T) {
+	indextest.ClaimDates(t, index.NewMemoryIndex)
+}
+
+func TestPermanodeDates_Memory(t *testing.T) {
+	indextest.PermanodeDates(t, index.NewMemoryIndex)
+}
+
+func newWarmMemoryIndex() *index.Index {
+	ix := index.NewMemoryIndex()
+	ix.WarmUp()
+	return ix
+}
+
+func TestIndex_WarmMemory(t *testing.T) {
+	indextest.Index(t, newWarmMemoryIndex)
+}
+
+func TestEdgesTo_WarmMemory(t *testing.T) {
+	indextest.EdgesTo(t, newWarmMemoryIndex)
+}
+
 var (
 	// those dirs are not packages implementing indexers,
 	// hence we do not want to check them.
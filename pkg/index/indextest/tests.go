@@ -23,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -213,6 +214,54 @@ Enpn/oOOfYFa5h0AFndZd1blMvruXfdAobjVABEBAAE=
 	return id
 }
 
+// RotateKey signs a delegation from the current signer to the second
+// test key, keyid 4BEC5AB5, adds it to the index, and signs with that
+// key from then on. It returns the delegation's blobref.
+func (id *IndexDeps) RotateKey() *blobref.BlobRef {
+	camliRootPath, err := osutil.GoPackagePath("camlistore.org")
+	if err != nil {
+		id.Fatalf("RotateKey: %v", err)
+	}
+	secretRingFile := filepath.Join(camliRootPath, "pkg", "jsonsign", "testdata", "test-secring2.gpg")
+	pubKey := &test.Blob{Contents: `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+xsBNBEz61lcBCADRQhcb9LIQdV3LhU5f7cCjOctmLsL+y4k4VKmznssWORiNPEHQ
+13CxFLjRDN2OQYXi4NSqoUqHNMsRTUJTVW0CnznUUb11ibXLUYW/zbPN9dWs8PlI
+UZSScS1dxtGKKk+VfXrvc1LB6pqrjWmAgEwQxsBWToW2IFR/eMo1LiVU83dzpKU1
+n/yb8Jy9wizchspd9xecK2X0JnKLRIJklLTAKQ+XKP+cSwXmShcs+3pxu5f4piqF
+7oBfh9noFA0vdGYNBGVch3DfJwFcTmLkkGFZKdiehWncvVYT1jxUkJvc0K44ohDH
+smkG2VZm3rJCwi2GIWA/clLiDAhYM6vTI3oZABEBAAE=
+=aWwV
+-----END PGP PUBLIC KEY BLOCK-----`}
+	id.PublicKeyFetcher.AddBlob(pubKey)
+
+	m := schema.NewDelegation(pubKey.BlobRef())
+	m["claimDate"] = id.advanceTime()
+	delegation := id.uploadAndSignMap(m)
+
+	id.SignerBlobRef = pubKey.BlobRef()
+	id.EntityFetcher = &jsonsign.CachingEntityFetcher{
+		Fetcher: &jsonsign.FileEntityFetcher{File: secretRingFile},
+	}
+	return delegation
+}
+
+// Revoke signs a revocation of delegation and adds it to the index,
+// returning its blobref.
+func (id *IndexDeps) Revoke(delegation *blobref.BlobRef) *blobref.BlobRef {
+	m := schema.NewRevocation(delegation)
+	m["claimDate"] = id.advanceTime()
+	return id.uploadAndSignMap(m)
+}
+
+// Delete signs a delete claim of target, a permanode or a claim, and
+// adds it to the index, returning its blobref.
+func (id *IndexDeps) Delete(target *blobref.BlobRef) *blobref.BlobRef {
+	m := schema.NewDeleteClaim(target)
+	m["claimDate"] = id.advanceTime()
+	return id.uploadAndSignMap(m)
+}
+
 func Index(t *testing.T, initIdx func() *index.Index) {
 	id := NewIndexDeps(initIdx())
 	id.Fataler = t
@@ -277,6 +326,11 @@ func Index(t *testing.T, initIdx func() *index.Index) {
 	if g, e := id.Get(key), "50|100"; g != e {
 		t.Errorf("JPEG dude.jpg key %q = %q; want %q", key, g, e)
 	}
+	if ii, err := id.Index.GetImageInfo(jpegFileRef); err != nil {
+		t.Errorf("GetImageInfo(dude.jpg) = %v", err)
+	} else if ii.Width != 50 || ii.Height != 100 {
+		t.Errorf("GetImageInfo(dude.jpg) = %dx%d; want 50x100", ii.Width, ii.Height)
+	}
 
 	key = "have:" + pn.String()
 	pnSizeStr := id.Get(key)
@@ -545,3 +599,261 @@ func EdgesTo(t *testing.T, initIdx func() *index.Index) {
 		}
 	}
 }
+
+func Delegation(t *testing.T, initIdx func() *index.Index) {
+	id := NewIndexDeps(initIdx())
+	id.Fataler = t
+	oldSigner, oldEntityFetcher := id.SignerBlobRef, id.EntityFetcher
+	pn1 := id.NewPermanode()
+	id.SetAttribute(pn1, "title", "old key")
+
+	delegation := id.RotateKey()
+	newSigner := id.SignerBlobRef
+	pn2 := id.NewPermanode()
+	id.SetAttribute(pn2, "title", "new key")
+	id.SetAttribute(pn1, "tag", "rotated")
+	id.dumpIndex(t)
+
+	key := fmt.Sprintf("delegation|2931A67C26F5ABDA|851E08B24BEC5AB5|%s", delegation)
+	if g, e := id.Get(key), "1"; g != e {
+		t.Fatalf("%q = %q, want %q", key, g, e)
+	}
+
+	// The claims of either key are those of both.
+	for _, signer := range []*blobref.BlobRef{oldSigner, newSigner} {
+		ch := make(chan *search.Result, 10)
+		if err := id.Index.GetRecentPermanodes(ch, signer, 10); err != nil {
+			t.Fatalf("GetRecentPermanodes(%s) = %v", signer, err)
+		}
+		var got []string
+		for r := range ch {
+			got = append(got, r.BlobRef.String())
+		}
+		if want := []string{pn1.String(), pn2.String()}; !reflect.DeepEqual(got, want) {
+			t.Errorf("GetRecentPermanodes(%s) = %q; want %q", signer, got, want)
+		}
+
+		for _, title := range []string{"old key", "new key"} {
+			if _, err := id.Index.PermanodeOfSignerAttrValue(signer, "title", title); err != nil {
+				t.Errorf("PermanodeOfSignerAttrValue(%s, title, %q) = %v", signer, title, err)
+			}
+		}
+
+		claims, err := id.Index.GetOwnerClaims(pn1, signer)
+		if err != nil {
+			t.Fatalf("GetOwnerClaims(%s) = %v", signer, err)
+		}
+		if len(claims) != 2 {
+			t.Errorf("GetOwnerClaims(%s) got %d claims; want 2", signer, len(claims))
+		}
+	}
+
+	// Once the old key revokes the delegation, its claims are only
+	// its own again.
+	id.SignerBlobRef, id.EntityFetcher = oldSigner, oldEntityFetcher
+	id.Revoke(delegation)
+	ch := make(chan *search.Result, 10)
+	if err := id.Index.GetRecentPermanodes(ch, oldSigner, 10); err != nil {
+		t.Fatalf("GetRecentPermanodes = %v", err)
+	}
+	var got []string
+	for r := range ch {
+		got = append(got, r.BlobRef.String())
+	}
+	if want := []string{pn1.String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetRecentPermanodes after revocation = %q; want %q", got, want)
+	}
+	if _, err := id.Index.PermanodeOfSignerAttrValue(oldSigner, "title", "new key"); err == nil {
+		t.Errorf("PermanodeOfSignerAttrValue found the revoked key's claim")
+	}
+}
+
+func Deletion(t *testing.T, initIdx func() *index.Index) {
+	id := NewIndexDeps(initIdx())
+	id.Fataler = t
+	owner := id.SignerBlobRef
+	album := id.NewPermanode()
+	id.SetAttribute(album, "title", "album")
+	pn := id.NewPermanode()
+	id.SetAttribute(pn, "title", "deleted")
+	id.AddAttribute(album, "camliMember", pn.String())
+	id.SetAttribute(album, "camliPath:foo", pn.String())
+	tag := id.AddAttribute(album, "tag", "old")
+
+	recent := func() []string {
+		ch := make(chan *search.Result, 10)
+		if err := id.Index.GetRecentPermanodes(ch, owner, 10); err != nil {
+			t.Fatalf("GetRecentPermanodes = %v", err)
+		}
+		var got []string
+		for r := range ch {
+			got = append(got, r.BlobRef.String())
+		}
+		return got
+	}
+	claimAttrs := func(pn *blobref.BlobRef) []string {
+		claims, err := id.Index.GetOwnerClaims(pn, owner)
+		if err != nil {
+			t.Fatalf("GetOwnerClaims = %v", err)
+		}
+		var attrs []string
+		for _, cl := range claims {
+			attrs = append(attrs, cl.Attr)
+		}
+		return attrs
+	}
+
+	del := id.Delete(pn)
+	id.Delete(tag)
+	id.dumpIndex(t)
+	if got, want := recent(), []string{album.String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetRecentPermanodes after delete = %q; want %q", got, want)
+	}
+	if _, _, err := id.Index.GetBlobMimeType(pn); err != os.ErrNotExist {
+		t.Errorf("GetBlobMimeType of deleted permanode = %v; want os.ErrNotExist", err)
+	}
+	if got, want := claimAttrs(album), []string{"title"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("claims of album after delete = %q; want %q", got, want)
+	}
+	if _, err := id.Index.PermanodeOfSignerAttrValue(owner, "title", "deleted"); err == nil {
+		t.Error("PermanodeOfSignerAttrValue found the deleted permanode")
+	}
+	if _, err := id.Index.PathLookup(owner, album, "foo", time.Time{}); err != os.ErrNotExist {
+		t.Errorf("PathLookup of deleted target = %v; want os.ErrNotExist", err)
+	}
+	if edges, err := id.Index.EdgesTo(pn, nil); err != nil || len(edges) != 1 {
+		t.Errorf("EdgesTo deleted permanode = %v, %v; want the album's edge", edges, err)
+	}
+
+	// Deleting the delete claim undoes it.
+	id.Delete(del)
+	if got, want := recent(), []string{album.String(), pn.String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetRecentPermanodes after undelete = %q; want %q", got, want)
+	}
+	if _, _, err := id.Index.GetBlobMimeType(pn); err != nil {
+		t.Errorf("GetBlobMimeType of undeleted permanode = %v", err)
+	}
+	if got, want := claimAttrs(album), []string{"title", "camliMember", "camliPath:foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("claims of album after undelete = %q; want %q", got, want)
+	}
+	if _, err := id.Index.PathLookup(owner, album, "foo", time.Time{}); err != nil {
+		t.Errorf("PathLookup after undelete = %v", err)
+	}
+}
+
+func ClaimDates(t *testing.T, initIdx func() *index.Index) {
+	id := NewIndexDeps(initIdx())
+	id.Fataler = t
+	owner := id.SignerBlobRef
+	pn := id.NewPermanode()
+
+	setAt := func(value, claimDate string) *blobref.BlobRef {
+		m := schema.NewSetAttributeClaim(pn, "title", value)
+		m["claimDate"] = claimDate
+		return id.uploadAndSignMap(m)
+	}
+	// Out of order as strings, but not in time.
+	early := setAt("early", "2011-11-28T03:00:00+02:00")
+	late := setAt("late", "2011-11-28T01:30:00Z")
+	future := setAt("future", schema.RFC3339FromTime(time.Now().Add(365*24*time.Hour)))
+	bogus := setAt("bogus", "yesterday")
+
+	claims, err := id.Index.GetOwnerClaims(pn, owner)
+	if err != nil {
+		t.Fatalf("GetOwnerClaims = %v", err)
+	}
+	sort.Sort(claims)
+	var got []string
+	for _, cl := range claims {
+		got = append(got, cl.Value+" "+cl.Date.Format(time.RFC3339))
+	}
+	if want := []string{"early 2011-11-28T01:00:00Z", "late 2011-11-28T01:30:00Z"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("claims = %q; want %q", got, want)
+	}
+
+	for _, br := range []*blobref.BlobRef{early, late} {
+		received := id.Get("claimreceived|" + br.String())
+		if _, err := time.Parse(time.RFC3339, received); err != nil {
+			t.Errorf("receipt time of claim %v = %q; want a time", br, received)
+		}
+	}
+	for _, br := range []*blobref.BlobRef{future, bogus} {
+		if received := id.Get("claimreceived|" + br.String()); received != "" {
+			t.Errorf("rejected claim %v indexed, received at %q", br, received)
+		}
+	}
+}
+
+func PermanodeDates(t *testing.T, initIdx func() *index.Index) {
+	id := NewIndexDeps(initIdx())
+	id.Fataler = t
+	owner := id.SignerBlobRef
+
+	camliRootPath, err := osutil.GoPackagePath("camlistore.org")
+	if err != nil {
+		t.Fatal("Package camlistore.org no found in $GOPATH or $GOPATH not defined")
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(camliRootPath, "pkg", "images", "testdata", "f1-exif.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	photoRef, _ := id.UploadFile("f1-exif.jpg", string(contents))
+
+	photo := id.NewPermanode()
+	id.SetAttribute(photo, "camliContent", photoRef.String())
+	dated := id.NewPermanode()
+	id.SetAttribute(dated, "camliDate", "2010-05-01T00:00:00Z")
+	plain := id.NewPermanode()
+	id.SetAttribute(plain, "title", "plain")
+	plainTime := id.lastTime()
+
+	type datedRef struct {
+		Ref  string
+		Date string
+	}
+	datedPermanodes := func() []datedRef {
+		ch := make(chan *search.Result, 10)
+		if err := id.Index.GetDatedPermanodes(ch, owner, 10); err != nil {
+			t.Fatalf("GetDatedPermanodes = %v", err)
+		}
+		var got []datedRef
+		for r := range ch {
+			got = append(got, datedRef{r.BlobRef.String(), time.Unix(r.Date, 0).UTC().Format(time.RFC3339)})
+		}
+		return got
+	}
+	id.dumpIndex(t)
+	want := []datedRef{
+		{photo.String(), "2012-11-04T05:42:02Z"},
+		{plain.String(), plainTime.UTC().Format(time.RFC3339)},
+		{dated.String(), "2010-05-01T00:00:00Z"},
+	}
+	if got := datedPermanodes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetDatedPermanodes = %v; want %v", got, want)
+	}
+
+	// The camliDate overrides the EXIF time, and the rows of the
+	// replaced dates are ignored.
+	id.SetAttribute(photo, "camliDate", "2013-01-02T03:04:05Z")
+	id.SetAttribute(dated, "camliDate", "2009-05-01T00:00:00Z")
+	want = []datedRef{
+		{photo.String(), "2013-01-02T03:04:05Z"},
+		{plain.String(), plainTime.UTC().Format(time.RFC3339)},
+		{dated.String(), "2009-05-01T00:00:00Z"},
+	}
+	if got := datedPermanodes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetDatedPermanodes after new dates = %v; want %v", got, want)
+	}
+
+	// Without a date, a permanode falls back to its modification.
+	id.DelAttribute(dated, "camliDate")
+	datedTime := id.lastTime()
+	want = []datedRef{
+		{photo.String(), "2013-01-02T03:04:05Z"},
+		{dated.String(), datedTime.UTC().Format(time.RFC3339)},
+		{plain.String(), plainTime.UTC().Format(time.RFC3339)},
+	}
+	if got := datedPermanodes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetDatedPermanodes after deleting a date = %v; want %v", got, want)
+	}
+}
@@ -120,6 +120,21 @@ var (
 		nil,
 	}
 
+	// The dates of permanodes, to order them by date rather than
+	// by modification: from a claim setting a permanode's
+	// camliDate, or its camliContent to an image with an EXIF time,
+	// if the image was indexed first. A permanode has a row per such
+	// claim, and only the one of its current date is valid.
+	keyPermanodeDate = &keyType{
+		"pndate",
+		[]part{
+			{"owner", typeKeyId},
+			{"date", typeReverseTime},
+			{"claim", typeBlobRef},
+		},
+		nil,
+	}
+
 	keyPathBackward = &keyType{
 		"signertargetpath",
 		[]part{
@@ -187,14 +202,28 @@ var (
 		},
 	}
 
-	// TODO(mpl): we might want to add signer/owner
+	// When a claim was received by the index, as its claimDate is
+	// the signer's clock.
+	keyClaimReceived = &keyType{
+		"claimreceived",
+		[]part{
+			{"claim", typeBlobRef},
+		},
+		[]part{
+			{"received", typeTime},
+		},
+	}
+
+	// A "delete" claim of a permanode or claim.
 	keyDeleted = &keyType{
 		"deleted",
 		[]part{
 			{"blobref", typeBlobRef},  // the thing being deleted (a permanode or another claim)
 			{"claimref", typeBlobRef}, // the blobref with the delete claim
 		},
-		nil,
+		[]part{
+			{"signer", typeKeyId}, // of the delete claim
+		},
 	}
 
 	// Given a blobref (permanode or static file or directory), provide a mapping
@@ -217,6 +246,42 @@ var (
 		},
 	}
 
+	// A "delegation" blob, by which the delegator key accepts the
+	// claims of the delegate key as its own.
+	keyDelegation = &keyType{
+		"delegation",
+		[]part{
+			{"delegator", typeKeyId},
+			{"delegate", typeKeyId},
+			{"claim", typeBlobRef}, // the delegation blob
+		},
+		nil,
+	}
+
+	// The same delegation, to find the keys delegating to a key.
+	keyDelegatedBy = &keyType{
+		"delegatedby",
+		[]part{
+			{"delegate", typeKeyId},
+			{"delegator", typeKeyId},
+			{"claim", typeBlobRef}, // the delegation blob
+		},
+		nil,
+	}
+
+	// A "revocation" blob of a delegation, signed by the key id
+	// in the value.
+	keyRevocation = &keyType{
+		"revocation",
+		[]part{
+			{"delegation", typeBlobRef},
+			{"claim", typeBlobRef}, // the revocation blob
+		},
+		[]part{
+			{"signer", typeKeyId},
+		},
+	}
+
 	// Width and height after any EXIF rotation.
 	keyImageSize = &keyType{
 		"imagesize",
@@ -228,4 +293,15 @@ var (
 			{"height", typeStr},
 		},
 	}
+
+	// The time an image was taken, from its EXIF metadata.
+	keyEXIFTime = &keyType{
+		"exiftime",
+		[]part{
+			{"fileref", typeBlobRef}, // blobref of "file" schema blob
+		},
+		[]part{
+			{"time", typeTime},
+		},
+	}
 )
@@ -67,6 +67,7 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 		user       = config.RequiredString("user")
 		password   = config.OptionalString("password", "")
 		database   = config.RequiredString("database")
+		warmUp     = config.OptionalBool("warmUp", false)
 	)
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -103,6 +104,9 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 	// Good enough, for now:
 	ix.KeyFetcher = ix.BlobSource
 
+	if warmUp {
+		ix.WarmUp()
+	}
 	return ix, nil
 }
 
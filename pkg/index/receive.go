@@ -29,19 +29,26 @@ import (
 	"io/ioutil"
 	"log"
 	"strings"
+	"time"
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/jsonsign"
 	"camlistore.org/pkg/magic"
+	"camlistore.org/pkg/metrics"
 	"camlistore.org/pkg/schema"
 	"camlistore.org/pkg/search"
+	"camlistore.org/third_party/github.com/camlistore/goexif/exif"
+	"camlistore.org/third_party/github.com/camlistore/goexif/tiff"
 )
 
 func (ix *Index) GetBlobHub() blobserver.BlobHub {
 	return ix.SimpleBlobHubPartitionMap.GetBlobHub()
 }
 
+var batchSeconds = metrics.NewHistogram("camli_index_batch_seconds",
+	"Latencies of committing the index mutations of a received blob.", metrics.DefaultBuckets)
+
 func (ix *Index) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (retsb blobref.SizedBlobRef, err error) {
 	sniffer := new(BlobSniffer)
 	hash := blobRef.Hash()
@@ -64,7 +71,9 @@ func (ix *Index) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (retsb
 		return
 	}
 
+	t0 := time.Now()
 	err = ix.s.CommitBatch(bm)
+	batchSeconds.ObserveSince(t0)
 	if err != nil {
 		return
 	}
@@ -90,9 +99,23 @@ func (ix *Index) populateMutation(br *blobref.BlobRef, sniffer *BlobSniffer, bm
 	if camli, ok := sniffer.Superset(); ok {
 		switch camli.Type {
 		case "claim":
+			if camli.ClaimType == schema.DeleteClaim {
+				if err := ix.populateDeleteClaim(br, camli, sniffer, bm); err != nil {
+					return err
+				}
+				break
+			}
 			if err := ix.populateClaim(br, camli, sniffer, bm); err != nil {
 				return err
 			}
+		case "delegation":
+			if err := ix.populateDelegation(br, camli, sniffer, bm); err != nil {
+				return err
+			}
+		case "revocation":
+			if err := ix.populateRevocation(br, camli, sniffer, bm); err != nil {
+				return err
+			}
 		case "permanode":
 			//if err := mi.populatePermanode(blobRef, camli, bm); err != nil {
 			//return err
@@ -122,13 +145,17 @@ func (ix *Index) populateFile(blobRef *blobref.BlobRef, ss *schema.Superset, bm
 	}
 	defer fr.Close()
 	mime, reader := magic.MimeTypeFromReader(fr)
+	if mime == "" {
+		mime = magic.MimeTypeByExtension(ss.FileNameString())
+	}
 
 	sha1 := sha1.New()
 	var copyDest io.Writer = sha1
 	var withCopyErr func(error) // or nil
 	if strings.HasPrefix(mime, "image/") {
 		pr, pw := io.Pipe()
-		copyDest = io.MultiWriter(copyDest, pw)
+		head := &prefixWriter{max: maxEXIFSize}
+		copyDest = io.MultiWriter(copyDest, pw, head)
 		confc := make(chan *image.Config, 1)
 		go func() {
 			conf, _, err := image.DecodeConfig(pr)
@@ -144,6 +171,9 @@ func (ix *Index) populateFile(blobRef *blobref.BlobRef, ss *schema.Superset, bm
 			if conf := <-confc; conf != nil {
 				bm.Set(keyImageSize.Key(blobRef), keyImageSize.Val(fmt.Sprint(conf.Width), fmt.Sprint(conf.Height)))
 			}
+			if t, ok := exifTime(head.buf.Bytes()); ok {
+				bm.Set(keyEXIFTime.Key(blobRef), keyEXIFTime.Val(t.UTC().Format(time.RFC3339)))
+			}
 		}
 	}
 
@@ -168,12 +198,109 @@ func (ix *Index) populateFile(blobRef *blobref.BlobRef, ss *schema.Superset, bm
 	return nil
 }
 
+// maxEXIFSize is how much of the start of an image is kept to look
+// for EXIF metadata, which lives in a JPEG's first, 64 kB max, segment.
+const maxEXIFSize = 128 << 10
+
+// A prefixWriter keeps the first max bytes written to it.
+type prefixWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if n := w.max - w.buf.Len(); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		w.buf.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// exifTime returns the time an image was taken, from the EXIF
+// metadata at its start, head. EXIF times have no time zone, so
+// they're taken as UTC.
+func exifTime(head []byte) (t time.Time, ok bool) {
+	ex, err := exif.Decode(bytes.NewReader(head))
+	if err != nil {
+		return
+	}
+	for _, name := range []exif.FieldName{"DateTimeOriginal", "DateTime"} {
+		tag, err := ex.Get(name)
+		if err != nil || tag.Format() != tiff.StringVal {
+			continue
+		}
+		t, err = time.Parse("2006:01:02 15:04:05", strings.TrimRight(tag.StringVal(), "\x00"))
+		if err == nil && !t.IsZero() {
+			return t, true
+		}
+	}
+	return
+}
+
+// maxClaimDateSkew is how far in the future of its receipt a claim
+// may be dated. Claims dated later are from a device with a broken
+// clock, and aren't indexed, lest they stay the most recent forever.
+const maxClaimDateSkew = 24 * time.Hour
+
+// normalizeClaimDate returns the claimDate of ss in UTC, or an error
+// if it's missing, unparseable, or more than maxClaimDateSkew after
+// received.
+func normalizeClaimDate(ss *schema.Superset, received time.Time) (string, error) {
+	t, err := time.Parse(time.RFC3339, ss.ClaimDate)
+	if err != nil {
+		return "", fmt.Errorf("invalid claimDate %q: %v", ss.ClaimDate, err)
+	}
+	if t.After(received.Add(maxClaimDateSkew)) {
+		return "", fmt.Errorf("claimDate %s is too far in the future", ss.ClaimDate)
+	}
+	return schema.RFC3339FromTime(t), nil
+}
+
+// claimPermanodeDate returns the date, in UTC, that the claim ss gives
+// its permanode, if any: its camliDate, or the EXIF time of the image
+// it sets as camliContent.
+func (ix *Index) claimPermanodeDate(ss *schema.Superset) (string, bool) {
+	if ss.ClaimType != "set-attribute" && ss.ClaimType != "add-attribute" {
+		return "", false
+	}
+	var t time.Time
+	var err error
+	switch ss.Attribute {
+	case "camliDate":
+		t, err = time.Parse(time.RFC3339, ss.Value)
+	case "camliContent":
+		br := blobref.Parse(ss.Value)
+		if br == nil {
+			return "", false
+		}
+		t, err = ix.GetFileTime(br)
+	default:
+		return "", false
+	}
+	if err != nil {
+		return "", false
+	}
+	return t.UTC().Format(time.RFC3339), true
+}
+
 func (ix *Index) populateClaim(br *blobref.BlobRef, ss *schema.Superset, sniffer *BlobSniffer, bm BatchMutation) error {
 	pnbr := blobref.Parse(ss.Permanode)
 	if pnbr == nil {
 		// Skip bogus claim with malformed permanode.
 		return nil
 	}
+	received := time.Now()
+	claimDate, err := normalizeClaimDate(ss, received)
+	if err != nil {
+		// Skip bogus claim, but not the blob.
+		log.Printf("index: not indexing claim %v: %v", br, err)
+		return nil
+	}
+	// So that the claims of signers in other timezones sort
+	// in time order in the keys below.
+	ss.ClaimDate = claimDate
 
 	rawJson, err := sniffer.Body()
 	if err != nil {
@@ -192,10 +319,15 @@ func (ix *Index) populateClaim(br *blobref.BlobRef, ss *schema.Superset, sniffer
 	verifiedKeyId := vr.SignerKeyId
 
 	bm.Set("signerkeyid:"+vr.CamliSigner.String(), verifiedKeyId)
+	bm.Set(keyClaimReceived.Key(br), keyClaimReceived.Val(schema.RFC3339FromTime(received)))
 
 	recentKey := keyRecentPermanode.Key(verifiedKeyId, ss.ClaimDate, br)
 	bm.Set(recentKey, pnbr.String())
 
+	if date, ok := ix.claimPermanodeDate(ss); ok {
+		bm.Set(keyPermanodeDate.Key(verifiedKeyId, date, br), pnbr.String())
+	}
+
 	claimKey := pipes("claim", pnbr, verifiedKeyId, ss.ClaimDate, br)
 	bm.Set(claimKey, pipes(urle(ss.ClaimType), urle(ss.Attribute), urle(ss.Value)))
 
@@ -241,6 +373,91 @@ func (ix *Index) populateClaim(br *blobref.BlobRef, ss *schema.Superset, sniffer
 	return nil
 }
 
+// populateDeleteClaim indexes the "delete" claim br, once its
+// signature is verified, under the permanode or claim it deletes.
+func (ix *Index) populateDeleteClaim(br *blobref.BlobRef, ss *schema.Superset, sniffer *BlobSniffer, bm BatchMutation) error {
+	if ss.Target == nil {
+		// Skip bogus delete claim with no target.
+		return nil
+	}
+
+	rawJson, err := sniffer.Body()
+	if err != nil {
+		return err
+	}
+	vr := jsonsign.NewVerificationRequest(string(rawJson), ix.KeyFetcher)
+	if !vr.Verify() {
+		if vr.Err != nil {
+			return vr.Err
+		}
+		return errors.New("index: populateDeleteClaim verification failure")
+	}
+	bm.Set("signerkeyid:"+vr.CamliSigner.String(), vr.SignerKeyId)
+	bm.Set(keyDeleted.Key(ss.Target, br), keyDeleted.Val(vr.SignerKeyId))
+	return nil
+}
+
+// populateDelegation indexes the "delegation" blob br, once its
+// signature is verified, under the key ids of its signer and its
+// delegate.
+func (ix *Index) populateDelegation(br *blobref.BlobRef, ss *schema.Superset, sniffer *BlobSniffer, bm BatchMutation) error {
+	delegate := blobref.Parse(ss.Delegate)
+	if delegate == nil {
+		// Skip bogus delegation with malformed delegate.
+		return nil
+	}
+
+	rawJson, err := sniffer.Body()
+	if err != nil {
+		return err
+	}
+	vr := jsonsign.NewVerificationRequest(string(rawJson), ix.KeyFetcher)
+	if !vr.Verify() {
+		if vr.Err != nil {
+			return vr.Err
+		}
+		return errors.New("index: populateDelegation verification failure")
+	}
+	delegateKeyId, err := jsonsign.PublicKeyId(ix.KeyFetcher, delegate)
+	if err != nil {
+		return fmt.Errorf("index: delegation %s to public key %s: %v", br, delegate, err)
+	}
+	if delegateKeyId == vr.SignerKeyId {
+		return nil
+	}
+
+	bm.Set("signerkeyid:"+vr.CamliSigner.String(), vr.SignerKeyId)
+	bm.Set("signerkeyid:"+delegate.String(), delegateKeyId)
+	bm.Set(keyDelegation.Key(vr.SignerKeyId, delegateKeyId, br), "1")
+	bm.Set(keyDelegatedBy.Key(delegateKeyId, vr.SignerKeyId, br), "1")
+	return nil
+}
+
+// populateRevocation indexes the "revocation" blob br, once its
+// signature is verified, under the delegation it revokes. Whether its
+// signer may revoke it is checked when the delegation is used, since
+// the delegation may not be indexed yet.
+func (ix *Index) populateRevocation(br *blobref.BlobRef, ss *schema.Superset, sniffer *BlobSniffer, bm BatchMutation) error {
+	if ss.Target == nil {
+		// Skip bogus revocation with no delegation.
+		return nil
+	}
+
+	rawJson, err := sniffer.Body()
+	if err != nil {
+		return err
+	}
+	vr := jsonsign.NewVerificationRequest(string(rawJson), ix.KeyFetcher)
+	if !vr.Verify() {
+		if vr.Err != nil {
+			return vr.Err
+		}
+		return errors.New("index: populateRevocation verification failure")
+	}
+	bm.Set(keyRevocation.Key(ss.Target, br), keyRevocation.Val(vr.SignerKeyId))
+	return nil
+}
+
 // pipes returns args separated by pipes
 func pipes(args ...interface{}) string {
 	var buf bytes.Buffer
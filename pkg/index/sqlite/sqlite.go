@@ -59,6 +59,7 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 	var (
 		blobPrefix = config.RequiredString("blobSource")
 		file       = config.RequiredString("file")
+		warmUp     = config.OptionalBool("warmUp", false)
 	)
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -95,6 +96,9 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 	// Good enough, for now:
 	ix.KeyFetcher = ix.BlobSource
 
+	if warmUp {
+		ix.WarmUp()
+	}
 	return ix, nil
 }
 
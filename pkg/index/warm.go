@@ -0,0 +1,228 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/db"
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/memdb"
+)
+
+// warmPrefixes are the index rows preloaded by WarmUp: the ones hit
+// hardest when rendering the first UI page.
+var warmPrefixes = []string{
+	keyRecentPermanode.name + "|",
+	"signerkeyid:",
+	"meta:",
+}
+
+// WarmUp starts loading the hottest ranges of the index (recent
+// permanodes, signer keys and blob metadata) into memory in the
+// background. Once a range is loaded, reads of it are served from
+// memory and writes go to both memory and the underlying storage.
+//
+// It must be called before the index is used, typically from an
+// indexer's constructor.
+func (x *Index) WarmUp() {
+	ws := newWarmStorage(x.s, warmPrefixes)
+	x.s = ws
+	go ws.load()
+}
+
+// warmStorage is an IndexStorage wrapping another one and serving
+// some key prefixes from an in-memory copy.
+type warmStorage struct {
+	IndexStorage // the underlying storage
+
+	prefixes []string
+	mem      *memKeys
+	done     chan struct{} // closed once all prefixes are loaded
+
+	// loadMu is held while loading a prefix and while updating
+	// mem, so no write can be lost between the load's read of the
+	// underlying storage and the prefix being marked loaded.
+	loadMu sync.Mutex
+
+	mu     sync.Mutex
+	loaded map[string]bool // prefix -> in mem
+}
+
+func newWarmStorage(s IndexStorage, prefixes []string) *warmStorage {
+	return &warmStorage{
+		IndexStorage: s,
+		prefixes:     prefixes,
+		mem:          &memKeys{db: memdb.New(nil)},
+		done:         make(chan struct{}),
+		loaded:       make(map[string]bool),
+	}
+}
+
+func (ws *warmStorage) load() {
+	defer close(ws.done)
+	for _, prefix := range ws.prefixes {
+		start := time.Now()
+		n, err := ws.loadPrefix(prefix)
+		if err != nil {
+			log.Printf("index: error warming up %q rows: %v", prefix, err)
+			continue
+		}
+		log.Printf("index: warmed up %d %q rows in %v", n, prefix, time.Since(start))
+	}
+}
+
+func (ws *warmStorage) loadPrefix(prefix string) (n int, err error) {
+	ws.loadMu.Lock()
+	defer ws.loadMu.Unlock()
+	it := ws.IndexStorage.Find(prefix)
+	defer closeIterator(it, &err)
+	for it.Next() {
+		if !strings.HasPrefix(it.Key(), prefix) {
+			break
+		}
+		if err = ws.mem.Set(it.Key(), it.Value()); err != nil {
+			return
+		}
+		n++
+	}
+	if err = it.Close(); err != nil {
+		return
+	}
+	ws.mu.Lock()
+	ws.loaded[prefix] = true
+	ws.mu.Unlock()
+	return
+}
+
+// warmPrefix returns the prefix of key that's kept in memory, if any.
+func (ws *warmStorage) warmPrefix(key string) (prefix string, ok bool) {
+	for _, prefix := range ws.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// memPrefix is like warmPrefix, but only returns prefixes that are
+// done loading.
+func (ws *warmStorage) memPrefix(key string) (prefix string, ok bool) {
+	prefix, ok = ws.warmPrefix(key)
+	if !ok {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return prefix, ws.loaded[prefix]
+}
+
+func (ws *warmStorage) Get(key string) (string, error) {
+	if _, ok := ws.memPrefix(key); ok {
+		return ws.mem.Get(key)
+	}
+	return ws.IndexStorage.Get(key)
+}
+
+// Find for a key within a loaded prefix only iterates over the rows
+// of that prefix, which is all the Index ever needs.
+func (ws *warmStorage) Find(key string) Iterator {
+	if prefix, ok := ws.memPrefix(key); ok {
+		return &prefixIter{
+			prefix:   prefix,
+			Iterator: ws.mem.Find(key),
+		}
+	}
+	return ws.IndexStorage.Find(key)
+}
+
+func (ws *warmStorage) Set(key, value string) error {
+	if err := ws.IndexStorage.Set(key, value); err != nil {
+		return err
+	}
+	if _, ok := ws.warmPrefix(key); ok {
+		ws.loadMu.Lock()
+		defer ws.loadMu.Unlock()
+		return ws.mem.Set(key, value)
+	}
+	return nil
+}
+
+func (ws *warmStorage) Delete(key string) error {
+	if err := ws.IndexStorage.Delete(key); err != nil {
+		return err
+	}
+	if _, ok := ws.warmPrefix(key); ok {
+		ws.loadMu.Lock()
+		defer ws.loadMu.Unlock()
+		if err := ws.mem.Delete(key); err != nil && err != db.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmBatch forwards mutations to a batch of the underlying storage,
+// remembering those to apply to memory once that batch is committed.
+type warmBatch struct {
+	BatchMutation
+	mem batch
+}
+
+func (b *warmBatch) Set(key, value string) {
+	b.BatchMutation.Set(key, value)
+	b.mem.Set(key, value)
+}
+
+func (b *warmBatch) Delete(key string) {
+	b.BatchMutation.Delete(key)
+	b.mem.Delete(key)
+}
+
+func (ws *warmStorage) BeginBatch() BatchMutation {
+	return &warmBatch{BatchMutation: ws.IndexStorage.BeginBatch()}
+}
+
+func (ws *warmStorage) CommitBatch(bm BatchMutation) error {
+	b, ok := bm.(*warmBatch)
+	if !ok {
+		return errors.New("invalid batch type; not an instance returned by BeginBatch")
+	}
+	if err := ws.IndexStorage.CommitBatch(b.BatchMutation); err != nil {
+		return err
+	}
+	ws.loadMu.Lock()
+	defer ws.loadMu.Unlock()
+	for _, m := range b.mem.Mutations() {
+		if _, ok := ws.warmPrefix(m.Key()); !ok {
+			continue
+		}
+		var err error
+		if m.IsDelete() {
+			err = ws.mem.Delete(m.Key())
+		} else {
+			err = ws.mem.Set(m.Key(), m.Value())
+		}
+		if err != nil && err != db.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
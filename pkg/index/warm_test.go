@@ -0,0 +1,74 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/memdb"
+)
+
+func TestWarmStorage(t *testing.T) {
+	under := &memKeys{db: memdb.New(nil)}
+	under.Set("meta:foo-1", "1|text/plain")
+	under.Set("meta:foo-2", "2|text/plain")
+	under.Set("other:foo-1", "x")
+
+	ws := newWarmStorage(under, []string{"meta:"})
+	ws.load()
+
+	// Changes made behind the warm storage's back are only
+	// visible outside of the warmed prefixes.
+	under.Set("meta:foo-3", "3|text/plain")
+	under.Set("other:foo-2", "y")
+	if _, err := ws.Get("meta:foo-3"); err != ErrNotFound {
+		t.Errorf("Get of unwarmed meta row = %v; want ErrNotFound", err)
+	}
+	if v, _ := ws.Get("other:foo-2"); v != "y" {
+		t.Errorf("Get of other row = %q; want %q", v, "y")
+	}
+
+	// Writes through the warm storage go to both.
+	if err := ws.Set("meta:foo-4", "4|text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	b := ws.BeginBatch()
+	b.Delete("meta:foo-1")
+	b.Set("other:foo-3", "z")
+	if err := ws.CommitBatch(b); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := under.Get("meta:foo-4"); v != "4|text/plain" {
+		t.Errorf("underlying meta:foo-4 = %q", v)
+	}
+	if _, err := under.Get("meta:foo-1"); err != ErrNotFound {
+		t.Errorf("underlying meta:foo-1 not deleted")
+	}
+
+	var got []string
+	it := ws.Find("meta:")
+	for it.Next() {
+		got = append(got, it.Key())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"meta:foo-2", "meta:foo-4"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Find(meta:) = %q; want %q", got, want)
+	}
+}
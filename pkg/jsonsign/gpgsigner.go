@@ -0,0 +1,86 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonsign
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"camlistore.org/third_party/code.google.com/p/go.crypto/openpgp"
+)
+
+// A DetachedSigner makes armored detached signatures with a key whose
+// private part it doesn't expose, such as one on a smartcard or HSM.
+type DetachedSigner interface {
+	// ArmoredDetachSign writes to w the armored signature of message
+	// by the key with the given long key id.
+	ArmoredDetachSign(w io.Writer, keyId string, message io.Reader) error
+}
+
+// A GPGSigner signs by running GnuPG, so its keys can be wherever gpg
+// finds them: on an OpenPGP card through scdaemon, or on a PKCS#11
+// token through a scdaemon replacement like gnupg-pkcs11-scd. The
+// private key is then never on the filesystem. The signature time is
+// gpg's current time.
+type GPGSigner struct {
+	// Program is the gpg binary to run. If empty, "gpg" is used.
+	Program string
+}
+
+func (g *GPGSigner) program() string {
+	if g.Program != "" {
+		return g.Program
+	}
+	return "gpg"
+}
+
+func (g *GPGSigner) ArmoredDetachSign(w io.Writer, keyId string, message io.Reader) error {
+	var stderr bytes.Buffer
+	// The trailing "!" makes gpg use exactly that key, not the
+	// signing subkey it would otherwise pick.
+	cmd := exec.Command(g.program(), "--batch", "--no-tty", "--armor",
+		"--local-user", keyId+"!", "--detach-sign")
+	cmd.Stdin = message
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("jsonsign: %s signing with key %s: %v: %s", g.program(), keyId, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// PublicEntity returns the entity of keyId's public key, exported
+// from gpg's keyring. Its PrivateKey is nil.
+func (g *GPGSigner) PublicEntity(keyId string) (*openpgp.Entity, error) {
+	out, err := exec.Command(g.program(), "--batch", "--no-tty", "--export", keyId).Output()
+	if err != nil {
+		return nil, fmt.Errorf("jsonsign: %s exporting key %s: %v", g.program(), keyId, err)
+	}
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("jsonsign: reading key %s exported by %s: %v", keyId, g.program(), err)
+	}
+	for _, e := range el {
+		if pk := e.PrimaryKey; pk.KeyIdString() == keyId || pk.KeyIdShortString() == keyId {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("jsonsign: %s has no public key %s", g.program(), keyId)
+}
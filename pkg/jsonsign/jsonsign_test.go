@@ -19,6 +19,11 @@ package jsonsign
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -219,3 +224,126 @@ func entityString(ent *openpgp.Entity) string {
 	}
 	return buf.String()
 }
+
+func TestDecryptKeys(t *testing.T) {
+	ent, err := EntityFromSecring("C7C3E176", "testdata/password-foo-secring.gpg")
+	if err != nil {
+		t.Fatalf("EntityFromSecring: %v", err)
+	}
+	if !entityEncrypted(ent) {
+		t.Fatalf("entity of password-foo-secring.gpg not encrypted")
+	}
+	if err := decryptKeys(ent, []byte("bar")); err == nil {
+		t.Fatalf("decrypted with the wrong passphrase")
+	}
+	// The failed attempt mustn't have spoiled the key.
+	if err := decryptKeys(ent, []byte("foo")); err != nil {
+		t.Fatalf("decrypting with the right passphrase: %v", err)
+	}
+	if entityEncrypted(ent) {
+		t.Errorf("entity still encrypted")
+	}
+	if err := DecryptEntity(ent); err != nil {
+		t.Errorf("DecryptEntity of a decrypted entity: %v", err)
+	}
+}
+
+// entitySigner is a DetachedSigner with a key fetched from a secret ring,
+// standing in for a smartcard.
+type entitySigner struct {
+	fetcher EntityFetcher
+	keyIds  []string // of the signatures made
+}
+
+func (s *entitySigner) ArmoredDetachSign(w io.Writer, keyId string, message io.Reader) error {
+	s.keyIds = append(s.keyIds, keyId)
+	e, err := s.fetcher.FetchEntity(keyId)
+	if err != nil {
+		return err
+	}
+	return openpgp.ArmoredDetachSign(w, e, message)
+}
+
+func TestDetachedSigner(t *testing.T) {
+	signer := &entitySigner{fetcher: &FileEntityFetcher{File: "./testdata/test-secring2.gpg"}}
+	sr := &SignRequest{
+		UnsignedJSON:      fmt.Sprintf(`{"camliVersion": 1, "foo": "fooVal", "camliSigner": %q}`, pubKeyBlob2.BlobRef().String()),
+		Fetcher:           testFetcher,
+		ServerMode:        true,
+		SecretKeyringPath: "./testdata/no-such-secring.gpg",
+		Signer:            signer,
+	}
+	signed, err := sr.Sign()
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if want := []string{"851E08B24BEC5AB5"}; !reflect.DeepEqual(signer.keyIds, want) {
+		t.Errorf("signed with keys %q; want %q", signer.keyIds, want)
+	}
+	vr := NewVerificationRequest(signed, testFetcher)
+	if !vr.Verify() {
+		t.Fatalf("verification failed on signed json [%s]: %v", signed, vr.Err)
+	}
+	ExpectString(t, "851E08B24BEC5AB5", vr.SignerKeyId, "SignerKeyId")
+}
+
+func TestEncryptedKeyRing(t *testing.T) {
+	defer os.Setenv(SecringPassphraseEnv, os.Getenv(SecringPassphraseEnv))
+	dir, err := ioutil.TempDir("", "camli-secring-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plain, err := ioutil.ReadFile("testdata/test-secring.gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "secring.gpg")
+	if err := ioutil.WriteFile(file, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EncryptKeyRingFile(file, []byte("bar")); err != nil {
+		t.Fatalf("EncryptKeyRingFile: %v", err)
+	}
+	if enc, err := KeyRingFileEncrypted(file); !enc || err != nil {
+		t.Fatalf("KeyRingFileEncrypted = %v, %v; want true, nil", enc, err)
+	}
+	if b, _ := ioutil.ReadFile(file); bytes.Contains(b, plain[:64]) {
+		t.Fatalf("encrypted ring contains the plain one")
+	}
+
+	os.Setenv(SecringPassphraseEnv, "wrong")
+	if _, err := EntityFromSecring("26F5ABDA", file); err == nil {
+		t.Errorf("EntityFromSecring succeeded with the wrong passphrase")
+	}
+	os.Setenv(SecringPassphraseEnv, "bar")
+	e, err := EntityFromSecring("26F5ABDA", file)
+	if err != nil {
+		t.Fatalf("EntityFromSecring: %v", err)
+	}
+	ExpectString(t, "2931A67C26F5ABDA", e.PrimaryKey.KeyIdString(), "KeyIdString")
+
+	// A key added to the encrypted ring is encrypted with the rest.
+	ent, err := NewEntity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendKeyRing(file, ent); err != nil {
+		t.Fatalf("AppendKeyRing: %v", err)
+	}
+	el, err := ReadKeyRingFile(file)
+	if err != nil {
+		t.Fatalf("ReadKeyRingFile: %v", err)
+	}
+	if len(el) != 2 || el[1].PrimaryKey.KeyIdString() != ent.PrimaryKey.KeyIdString() {
+		t.Fatalf("ReadKeyRingFile read %d entities; want the 2 keys", len(el))
+	}
+
+	if err := DecryptKeyRingFile(file); err != nil {
+		t.Fatalf("DecryptKeyRingFile: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(file); !bytes.HasPrefix(b, plain) {
+		t.Errorf("decrypted ring doesn't start with the original one")
+	}
+}
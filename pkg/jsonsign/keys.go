@@ -27,6 +27,7 @@ import (
 	"strings"
 	"time"
 
+	"camlistore.org/pkg/blobref"
 	"camlistore.org/third_party/code.google.com/p/go.crypto/openpgp"
 	"camlistore.org/third_party/code.google.com/p/go.crypto/openpgp/armor"
 	"camlistore.org/third_party/code.google.com/p/go.crypto/openpgp/packet"
@@ -75,6 +76,20 @@ func openArmoredPublicKeyFile(reader io.ReadCloser) (*packet.PublicKey, error) {
 	return pk, nil
 }
 
+// PublicKeyId returns the key id, as in VerificationRequest's
+// SignerKeyId, of the armored public key blob key.
+func PublicKeyId(fetcher blobref.StreamingFetcher, key *blobref.BlobRef) (string, error) {
+	rc, _, err := fetcher.FetchStreaming(key)
+	if err != nil {
+		return "", err
+	}
+	pk, err := openArmoredPublicKeyFile(rc)
+	if err != nil {
+		return "", err
+	}
+	return pk.KeyIdString(), nil
+}
+
 func DefaultSecRingPath() string {
 	return filepath.Join(os.Getenv("HOME"), ".gnupg", "secring.gpg")
 }
@@ -85,15 +100,9 @@ func EntityFromSecring(keyId, keyFile string) (*openpgp.Entity, error) {
 	if keyFile == "" {
 		keyFile = DefaultSecRingPath()
 	}
-	secring, err := os.Open(keyFile)
-	if err != nil {
-		return nil, fmt.Errorf("jsonsign: failed to open keyring: %v", err)
-	}
-	defer secring.Close()
-
-	el, err := openpgp.ReadKeyRing(secring)
+	el, err := ReadKeyRingFile(keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("openpgp.ReadKeyRing of %q: %v", keyFile, err)
+		return nil, err
 	}
 	var entity *openpgp.Entity
 	for _, e := range el {
@@ -0,0 +1,284 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonsign
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"camlistore.org/pkg/misc/gpgagent"
+	"camlistore.org/pkg/misc/pinentry"
+	"camlistore.org/third_party/code.google.com/p/go.crypto/openpgp"
+)
+
+// A secret ring file may be encrypted as a whole with a passphrase,
+// like "gpg --symmetric" does, so its keys aren't in the clear on
+// disk. The passphrase is then read from this environment variable
+// if set, or else asked for with gpg-agent or pinentry.
+const SecringPassphraseEnv = "CAMLI_SECRING_PASSPHRASE"
+
+var errBadPassphrase = errors.New("jsonsign: wrong secret ring passphrase")
+
+// ringPassphrases are the passphrases that decrypted secret ring
+// files, by file name, so that reading one again, as the server does
+// when it starts, doesn't ask again.
+var (
+	ringPassMu      sync.Mutex
+	ringPassphrases = make(map[string][]byte)
+)
+
+// ReadKeyRingFile returns the entities of the secret ring file,
+// decrypting it first if it's encrypted.
+func ReadKeyRingFile(file string) (openpgp.EntityList, error) {
+	plain, _, err := readKeyRingFile(file)
+	if err != nil {
+		return nil, err
+	}
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(plain))
+	if err != nil {
+		return nil, fmt.Errorf("jsonsign: openpgp.ReadKeyRing of %q: %v", file, err)
+	}
+	return el, nil
+}
+
+// KeyRingFileEncrypted reports whether the secret ring file is
+// encrypted with a passphrase.
+func KeyRingFileEncrypted(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var b [1]byte
+	if _, err := io.ReadFull(f, b[:]); err != nil {
+		return false, err
+	}
+	return symmetricallyEncrypted(b[0]), nil
+}
+
+// EncryptKeyRingFile encrypts the secret ring file in place with
+// passphrase.
+func EncryptKeyRingFile(file string, passphrase []byte) error {
+	plain, oldPass, err := readKeyRingFile(file)
+	if err != nil {
+		return err
+	}
+	if oldPass != nil {
+		return fmt.Errorf("jsonsign: secret ring %s is already encrypted", file)
+	}
+	var out bytes.Buffer
+	if err := encryptKeyRing(&out, plain, passphrase); err != nil {
+		return err
+	}
+	return replaceFile(file, out.Bytes())
+}
+
+// DecryptKeyRingFile decrypts the secret ring file in place, asking
+// for its passphrase as ReadKeyRingFile does.
+func DecryptKeyRingFile(file string) error {
+	plain, pass, err := readKeyRingFile(file)
+	if err != nil {
+		return err
+	}
+	if pass == nil {
+		return fmt.Errorf("jsonsign: secret ring %s isn't encrypted", file)
+	}
+	return replaceFile(file, plain)
+}
+
+func replaceFile(file string, contents []byte) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func encryptKeyRing(w io.Writer, plain, passphrase []byte) error {
+	pw, err := openpgp.SymmetricallyEncrypt(w, passphrase, &openpgp.FileHints{IsBinary: true})
+	if err != nil {
+		return err
+	}
+	if _, err := pw.Write(plain); err != nil {
+		return err
+	}
+	return pw.Close()
+}
+
+// AppendKeyRing adds ent to the secret ring file, creating it if
+// needed, leaving its other keys as they are. An encrypted ring stays
+// encrypted with the same passphrase.
+func AppendKeyRing(file string, ent *openpgp.Entity) error {
+	var buf bytes.Buffer
+	if err := WriteKeyRing(&buf, openpgp.EntityList{ent}); err != nil {
+		return err
+	}
+	encrypted, err := KeyRingFileEncrypted(file)
+	if err != nil && !os.IsNotExist(err) && err != io.EOF {
+		return err
+	}
+	if !encrypted {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(buf.Bytes()); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	plain, passphrase, err := readKeyRingFile(file)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := encryptKeyRing(&out, append(plain, buf.Bytes()...), passphrase); err != nil {
+		return err
+	}
+	return replaceFile(file, out.Bytes())
+}
+
+// symmetricallyEncrypted reports whether an OpenPGP message starting
+// with the packet tag byte b is encrypted with a passphrase, its
+// first packet being a symmetric-key encrypted session key (tag 3).
+func symmetricallyEncrypted(b byte) bool {
+	const tagSymmetricKeyEncrypted = 3
+	if b&0x80 == 0 {
+		return false
+	}
+	if b&0x40 != 0 {
+		// new format packet
+		return b&0x3f == tagSymmetricKeyEncrypted
+	}
+	return (b&0x3f)>>2 == tagSymmetricKeyEncrypted
+}
+
+// readKeyRingFile returns the contents of the secret ring file,
+// decrypted, and the passphrase it was encrypted with, if any.
+func readKeyRingFile(file string) (plain, passphrase []byte, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("jsonsign: failed to open keyring: %v", err)
+	}
+	if len(b) == 0 || !symmetricallyEncrypted(b[0]) {
+		return b, nil, nil
+	}
+	ringPassMu.Lock()
+	pass, ok := ringPassphrases[file]
+	ringPassMu.Unlock()
+	if ok {
+		if plain, err := decryptKeyRing(b, pass); err == nil {
+			return plain, pass, nil
+		}
+	}
+	plain, passphrase, err = askDecryptKeyRing(file, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	ringPassMu.Lock()
+	ringPassphrases[file] = passphrase
+	ringPassMu.Unlock()
+	return plain, passphrase, nil
+}
+
+// askDecryptKeyRing decrypts the encrypted secret ring b of file with
+// the passphrase from the environment, gpg-agent, or pinentry.
+func askDecryptKeyRing(file string, b []byte) (plain, passphrase []byte, err error) {
+	if pass := os.Getenv(SecringPassphraseEnv); pass != "" {
+		plain, err := decryptKeyRing(b, []byte(pass))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v, from $%s, for %s", err, SecringPassphraseEnv, file)
+		}
+		return plain, []byte(pass), nil
+	}
+
+	desc := fmt.Sprintf("Need to unlock the secret ring %s to use it for signing.", file)
+	conn, err := gpgagent.NewConn()
+	switch err {
+	case gpgagent.ErrNoAgent:
+		fmt.Fprintf(os.Stderr, "Note: gpg-agent not found; resorting to on-demand password entry.\n")
+	case nil:
+		defer conn.Close()
+		req := &gpgagent.PassphraseRequest{
+			CacheKey: "camli:secring:" + file,
+			Prompt:   "Passphrase",
+			Desc:     desc,
+		}
+		for tries := 0; tries < 2; tries++ {
+			pass, err := conn.GetPassphrase(req)
+			if err == nil {
+				plain, err := decryptKeyRing(b, []byte(pass))
+				if err == nil {
+					return plain, []byte(pass), nil
+				}
+				req.Error = "Passphrase failed to decrypt: " + err.Error()
+				conn.RemoveFromCache(req.CacheKey)
+				continue
+			}
+			if err == gpgagent.ErrCancel {
+				return nil, nil, errors.New("jsonsign: failed to decrypt secret ring; action canceled")
+			}
+			log.Printf("jsonsign: gpgagent: %v", err)
+		}
+	default:
+		log.Printf("jsonsign: gpgagent: %v", err)
+	}
+
+	pinReq := &pinentry.Request{Desc: desc, Prompt: "Passphrase"}
+	for tries := 0; tries < 2; tries++ {
+		pass, err := pinReq.GetPIN()
+		if err == nil {
+			plain, err := decryptKeyRing(b, []byte(pass))
+			if err == nil {
+				return plain, []byte(pass), nil
+			}
+			pinReq.Error = "Passphrase failed to decrypt: " + err.Error()
+			continue
+		}
+		if err == pinentry.ErrCancel {
+			return nil, nil, errors.New("jsonsign: failed to decrypt secret ring; action canceled")
+		}
+		log.Printf("jsonsign: pinentry: %v", err)
+	}
+	return nil, nil, fmt.Errorf("jsonsign: failed to decrypt secret ring %s", file)
+}
+
+// decryptKeyRing decrypts the encrypted secret ring b with passphrase.
+func decryptKeyRing(b, passphrase []byte) ([]byte, error) {
+	tried := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		// Called again while the passphrase is wrong.
+		if tried || !symmetric {
+			return nil, errBadPassphrase
+		}
+		tried = true
+		return passphrase, nil
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(b), openpgp.EntityList{}, prompt)
+	if err != nil {
+		return nil, err
+	}
+	// Reading to the end also checks the message's integrity.
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
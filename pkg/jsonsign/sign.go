@@ -91,33 +91,31 @@ func (ce *CachingEntityFetcher) FetchEntity(keyId string) (*openpgp.Entity, erro
 }
 
 func (fe *FileEntityFetcher) FetchEntity(keyId string) (*openpgp.Entity, error) {
-	f, err := os.Open(fe.File)
+	el, err := ReadKeyRingFile(fe.File)
 	if err != nil {
 		return nil, fmt.Errorf("jsonsign: FetchEntity: %v", err)
 	}
-	defer f.Close()
-	el, err := openpgp.ReadKeyRing(f)
-	if err != nil {
-		return nil, fmt.Errorf("jsonsign: openpgp.ReadKeyRing of %q: %v", fe.File, err)
-	}
 	for _, e := range el {
 		pubk := &e.PrivateKey.PublicKey
 		if pubk.KeyIdString() != keyId {
 			continue
 		}
-		if e.PrivateKey.Encrypted {
-			if err := fe.decryptEntity(e); err == nil {
-				return e, nil
-			} else {
-				return nil, err
-			}
+		if err := DecryptEntity(e); err != nil {
+			return nil, err
 		}
 		return e, nil
 	}
 	return nil, fmt.Errorf("jsonsign: entity for keyid %q not found in %q", keyId, fe.File)
 }
 
-func (fe *FileEntityFetcher) decryptEntity(e *openpgp.Entity) error {
+// DecryptEntity decrypts the private keys of e, the primary key and
+// its subkeys, with the passphrase from gpg-agent, which may have it
+// cached, or else entered with pinentry. It does nothing if they're
+// not encrypted.
+func DecryptEntity(e *openpgp.Entity) error {
+	if !entityEncrypted(e) {
+		return nil
+	}
 	// TODO: syscall.Mlock a region and keep pass phrase in it.
 	pubk := &e.PrivateKey.PublicKey
 	desc := fmt.Sprintf("Need to unlock GPG key %s to use it for signing.",
@@ -137,7 +135,7 @@ func (fe *FileEntityFetcher) decryptEntity(e *openpgp.Entity) error {
 		for tries := 0; tries < 2; tries++ {
 			pass, err := conn.GetPassphrase(req)
 			if err == nil {
-				err = e.PrivateKey.Decrypt([]byte(pass))
+				err = decryptKeys(e, []byte(pass))
 				if err == nil {
 					return nil
 				}
@@ -158,7 +156,7 @@ func (fe *FileEntityFetcher) decryptEntity(e *openpgp.Entity) error {
 	for tries := 0; tries < 2; tries++ {
 		pass, err := pinReq.GetPIN()
 		if err == nil {
-			err = e.PrivateKey.Decrypt([]byte(pass))
+			err = decryptKeys(e, []byte(pass))
 			if err == nil {
 				return nil
 			}
@@ -173,6 +171,35 @@ func (fe *FileEntityFetcher) decryptEntity(e *openpgp.Entity) error {
 	return fmt.Errorf("jsonsign: failed to decrypt key %q", pubk.KeyIdShortString())
 }
 
+func entityEncrypted(e *openpgp.Entity) bool {
+	if e.PrivateKey != nil && e.PrivateKey.Encrypted {
+		return true
+	}
+	for _, sk := range e.Subkeys {
+		if sk.PrivateKey != nil && sk.PrivateKey.Encrypted {
+			return true
+		}
+	}
+	return false
+}
+
+// decryptKeys decrypts the private keys of e with passphrase.
+func decryptKeys(e *openpgp.Entity, passphrase []byte) error {
+	if e.PrivateKey != nil {
+		if err := e.PrivateKey.Decrypt(passphrase); err != nil {
+			return err
+		}
+	}
+	for _, sk := range e.Subkeys {
+		if sk.PrivateKey != nil {
+			if err := sk.PrivateKey.Decrypt(passphrase); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type SignRequest struct {
 	UnsignedJSON string
 	Fetcher      interface{} // blobref.Fetcher or blobref.StreamingFetcher
@@ -185,6 +212,12 @@ type SignRequest struct {
 	// the PrivateKey, if necessary)
 	EntityFetcher EntityFetcher
 
+	// Signer optionally makes the signature instead of an entity,
+	// for keys whose private part isn't readable, like those on a
+	// smartcard. If set, EntityFetcher and SecretKeyringPath are
+	// ignored.
+	Signer DetachedSigner
+
 	// SecretKeyringPath is only used if EntityFetcher is nil,
 	// in which case SecretKeyringPath is used if non-empty.
 	// As a final resort, the flag value (defaulting to
@@ -254,6 +287,13 @@ func (sr *SignRequest) Sign() (signedJSON string, err error) {
 	trimmedJSON = trimmedJSON[0 : len(trimmedJSON)-1]
 
 	// sign it
+	var buf bytes.Buffer
+	if sr.Signer != nil {
+		if err := sr.Signer.ArmoredDetachSign(&buf, pubk.KeyIdString(), strings.NewReader(trimmedJSON)); err != nil {
+			return "", err
+		}
+		return assembleSigned(trimmedJSON, buf.String())
+	}
 	entityFetcher := sr.EntityFetcher
 	if entityFetcher == nil {
 		file := sr.secretRingPath()
@@ -272,18 +312,20 @@ func (sr *SignRequest) Sign() (signedJSON string, err error) {
 		return "", err
 	}
 
-	var buf bytes.Buffer
 	err = openpgp.ArmoredDetachSignAt(&buf, signer, sr.SignatureTime, strings.NewReader(trimmedJSON))
 	if err != nil {
 		return "", err
 	}
+	return assembleSigned(trimmedJSON, buf.String())
+}
 
-	output := buf.String()
-
+// assembleSigned returns the signed JSON of trimmedJSON, lacking its
+// closing brace, and its armored detached signature.
+func assembleSigned(trimmedJSON, output string) (string, error) {
 	index1 := strings.Index(output, "\n\n")
 	index2 := strings.Index(output, "\n-----")
 	if index1 == -1 || index2 == -1 {
-		return execfail("Failed to parse signature from gpg.")
+		return "", errors.New("Failed to parse signature from gpg.")
 	}
 	inner := output[index1+2 : index2]
 	signature := strings.Replace(inner, "\n", "", -1)
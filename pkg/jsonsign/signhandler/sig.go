@@ -18,13 +18,17 @@ package signhandler
 
 import (
 	"crypto"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"camlistore.org/pkg/audit"
+	"camlistore.org/pkg/auth"
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/blobserver/gethandler"
@@ -32,12 +36,15 @@ import (
 	"camlistore.org/pkg/jsonconfig"
 	"camlistore.org/pkg/jsonsign"
 	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
 
 	"camlistore.org/third_party/code.google.com/p/go.crypto/openpgp"
 )
 
 var _ = log.Printf
 
+var _ schema.Signer = (*Handler)(nil)
+
 const kMaxJSONLength = 1024 * 1024
 
 type Handler struct {
@@ -55,6 +62,10 @@ type Handler struct {
 	pubKeyWritten bool
 
 	entity *openpgp.Entity
+
+	// signer, if not nil, makes the signatures instead of entity,
+	// which then has only the public key.
+	signer jsonsign.DetachedSigner
 }
 
 func (h *Handler) secretRingPath() string {
@@ -77,14 +88,31 @@ func newJSONSignFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Hand
 	h := &Handler{
 		secretRing: conf.OptionalString("secretRing", ""),
 	}
+	// The gpg program signing with a key on a smartcard or
+	// token, instead of one from secretRing.
+	gpgSigner := conf.OptionalString("gpgSigner", "")
 	var err error
 	if err = conf.Validate(); err != nil {
 		return nil, err
 	}
 
-	h.entity, err = jsonsign.EntityFromSecring(keyId, h.secretRingPath())
-	if err != nil {
-		return nil, err
+	if gpgSigner != "" {
+		gs := &jsonsign.GPGSigner{Program: gpgSigner}
+		h.entity, err = gs.PublicEntity(keyId)
+		if err != nil {
+			return nil, err
+		}
+		h.signer = gs
+	} else {
+		h.entity, err = jsonsign.EntityFromSecring(keyId, h.secretRingPath())
+		if err != nil {
+			return nil, err
+		}
+		// Decrypted once, at startup, so signing needs neither the
+		// passphrase nor the secret ring again.
+		if err := jsonsign.DecryptEntity(h.entity); err != nil {
+			return nil, err
+		}
 	}
 
 	armoredPublicKey, err := jsonsign.ArmoredPublicKey(h.entity)
@@ -132,6 +160,15 @@ func (h *Handler) uploadPublicKey(sto blobserver.Storage, key string) error {
 	return err
 }
 
+// FetchEntity returns the handler's entity, decrypted when the handler
+// was created, if keyId is its key's.
+func (h *Handler) FetchEntity(keyId string) (*openpgp.Entity, error) {
+	if keyId != h.entity.PrimaryKey.KeyIdString() {
+		return nil, fmt.Errorf("jsonsign: handler has no secret key %q", keyId)
+	}
+	return h.entity, nil
+}
+
 func (h *Handler) DiscoveryMap(base string) map[string]interface{} {
 	m := map[string]interface{}{
 		"publicKeyId":   h.entity.PrimaryKey.KeyIdString(),
@@ -218,6 +255,11 @@ func (h *Handler) handleSign(rw http.ResponseWriter, req *http.Request) {
 	}
 	// TODO: SECURITY: auth
 
+	if err := auth.CheckReplay(req); err != nil {
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	jsonStr := req.FormValue("json")
 	if jsonStr == "" {
 		badReq("missing \"json\" parameter")
@@ -228,11 +270,19 @@ func (h *Handler) handleSign(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	var fields unsignedFields
+	json.Unmarshal([]byte(jsonStr), &fields) // errors are the signing's
+	if !aclAllowsSigning(req, &fields) {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	sreq := &jsonsign.SignRequest{
-		UnsignedJSON:      jsonStr,
-		Fetcher:           h.pubKeyFetcher,
-		ServerMode:        true,
-		SecretKeyringPath: h.secretRing,
+		UnsignedJSON:  jsonStr,
+		Fetcher:       h.pubKeyFetcher,
+		ServerMode:    true,
+		EntityFetcher: h,
+		Signer:        h.signer,
 	}
 	signedJSON, err := sreq.Sign()
 	if err != nil {
@@ -240,20 +290,82 @@ func (h *Handler) handleSign(rw http.ResponseWriter, req *http.Request) {
 		badReq(fmt.Sprintf("%v", err))
 		return
 	}
+	signed := blobref.SHA1FromString(signedJSON)
+	switch {
+	case fields.CamliType == "permanode":
+		auth.ACLCreated(req, signed)
+	case fields.CamliType == "share":
+		audit.Log(req, audit.EventShare, "", fmt.Sprintf("%s of %s", signed, fields.Target))
+	case fields.CamliType == "claim" && fields.ClaimType == schema.DeleteClaim:
+		audit.Log(req, audit.EventDelete, "", fmt.Sprintf("%s of %s", signed, fields.Target))
+	}
 	rw.Write([]byte(signedJSON))
 }
 
+// unsignedFields are the fields of JSON to sign deciding who may
+// have it signed, and whether to audit it.
+type unsignedFields struct {
+	CamliType string `json:"camliType"`
+	ClaimType string `json:"claimType"`
+	Permanode string `json:"permaNode"`
+	Attribute string `json:"attribute"`
+	Value     string `json:"value"`
+	Target    string `json:"target"`
+}
+
+// aclAllowsSigning reports whether req may have the JSON of m signed.
+// ACL users may only sign new permanodes, the claims of the permanodes
+// they may write that only link to blobs they may link, and the delete
+// claims of those permanodes. They may not change ACLs.
+func aclAllowsSigning(req *http.Request, m *unsignedFields) bool {
+	if _, ok := auth.ACLUser(req); !ok {
+		return true
+	}
+	switch m.CamliType {
+	case "permanode":
+		return true
+	case "claim":
+		if m.ClaimType == schema.DeleteClaim {
+			target := blobref.Parse(m.Target)
+			return target != nil && auth.AllowedBlob(req, target, auth.OpSign)
+		}
+		pn := blobref.Parse(m.Permanode)
+		if pn == nil || !auth.AllowedBlob(req, pn, auth.OpSign) {
+			return false
+		}
+		switch {
+		case m.Attribute == search.ACLAttr:
+			return false
+		case m.Attribute == "camliMember", m.Attribute == "camliContent", strings.HasPrefix(m.Attribute, "camliPath:"):
+			if target := blobref.Parse(m.Value); target != nil {
+				return auth.AllowedLink(req, target)
+			}
+		}
+		return true
+	}
+	return false
+}
+
 func (h *Handler) SignMap(m schema.Map) (string, error) {
+	return h.SignMapAt(m, time.Time{})
+}
+
+// SignMapAt is like SignMap, but signs at t, or now if t is zero. A
+// planned permanode signed at a fixed time always has the same
+// blobref.
+func (h *Handler) SignMapAt(m schema.Map, t time.Time) (string, error) {
 	m["camliSigner"] = h.pubKeyBlobRef.String()
 	unsigned, err := m.JSON()
 	if err != nil {
 		return "", err
 	}
 	sreq := &jsonsign.SignRequest{
-		UnsignedJSON:      unsigned,
-		Fetcher:           h.pubKeyFetcher,
-		ServerMode:        true,
-		SecretKeyringPath: h.secretRing,
+		UnsignedJSON:  unsigned,
+		Fetcher:       h.pubKeyFetcher,
+		ServerMode:    true,
+		EntityFetcher: h,
+		Signer:        h.signer,
+		SignatureTime: t,
 	}
 	return sreq.Sign()
 }
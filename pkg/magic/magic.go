@@ -14,42 +14,140 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// Package magic detects the MIME types of files, from their first
+// bytes and, failing that, their names.
+//
+// Both are registries: signatures and extensions registered by
+// RegisterSignature and RegisterExtension, such as from the server
+// config's "mimeTypes", take precedence over the built-in ones, so the
+// indexer, the UI and the download handlers all agree on custom types.
 package magic
 
 import (
 	"bytes"
 	"io"
+	"mime"
 	"net/http"
+	"path"
 	"strings"
+	"sync"
 )
 
-type prefixEntry struct {
-	prefix []byte
+// A signature is the magic bytes at offset of the files of type mtype.
+type signature struct {
+	offset int
+	magic  []byte
 	mtype  string
 }
 
-var prefixTable = []prefixEntry{
-	{[]byte("GIF87a"), "image/gif"},
-	{[]byte("GIF89a"), "image/gif"}, // TODO: Others?
-	{[]byte("\xff\xd8\xff\xe2"), "image/jpeg"},
-	{[]byte("\xff\xd8\xff\xe1"), "image/jpeg"},
-	{[]byte("\xff\xd8\xff\xe0"), "image/jpeg"},
-	{[]byte("\xff\xd8\xff\xdb"), "image/jpeg"},
-	{[]byte{137, 'P', 'N', 'G', '\r', '\n', 26, 10}, "image/png"},
-	{[]byte("-----BEGIN PGP PUBLIC KEY BLOCK---"), "text/x-openpgp-public-key"},
-	// TODO(bradfitz): popular audio & video formats at least
+// builtinSignatures come after the registered ones, the more specific
+// of a family first.
+var builtinSignatures = []signature{
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{0, []byte("\xff\xd8\xff\xe2"), "image/jpeg"},
+	{0, []byte("\xff\xd8\xff\xe1"), "image/jpeg"},
+	{0, []byte("\xff\xd8\xff\xe0"), "image/jpeg"},
+	{0, []byte("\xff\xd8\xff\xdb"), "image/jpeg"},
+	{0, []byte{137, 'P', 'N', 'G', '\r', '\n', 26, 10}, "image/png"},
+	{0, []byte("II*\x00"), "image/tiff"},
+	{0, []byte("MM\x00*"), "image/tiff"},
+	{0, []byte("BM"), "image/bmp"},
+	{0, []byte("\x00\x00\x01\x00"), "image/x-icon"},
+	{0, []byte("8BPS"), "image/vnd.adobe.photoshop"},
+	{0, []byte("gimp xcf"), "image/x-xcf"},
+	{8, []byte("WEBP"), "image/webp"},
+	{0, []byte("-----BEGIN PGP PUBLIC KEY BLOCK---"), "text/x-openpgp-public-key"},
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("PK\x03\x04"), "application/zip"},
+	{0, []byte("\x1f\x8b"), "application/x-gzip"},
+	{257, []byte("ustar"), "application/x-tar"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("fLaC"), "audio/flac"},
+	{0, []byte("OggS"), "application/ogg"},
+	{8, []byte("WAVE"), "audio/x-wav"},
+	{4, []byte("ftypM4A "), "audio/mp4"},
+	{4, []byte("ftypqt  "), "video/quicktime"},
+	{4, []byte("ftyp"), "video/mp4"},
+	{8, []byte("AVI "), "video/x-msvideo"},
+	{0, []byte("\x1a\x45\xdf\xa3"), "video/x-matroska"},
 }
 
-// Returns the emptry string if unknown.
-func MimeType(hdr []byte) string {
-	hlen := len(hdr)
-	for _, pte := range prefixTable {
-		plen := len(pte.prefix)
-		if hlen > plen && bytes.Equal(hdr[:plen], pte.prefix) {
-			return pte.mtype
+// builtinExtensions are the types, by lowercase extension, of files
+// not sniffed, which mime.TypeByExtension doesn't know everywhere.
+var builtinExtensions = map[string]string{
+	".txt":      "text/plain",
+	".text":     "text/plain",
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".csv":      "text/csv",
+	".ics":      "text/calendar",
+	".vcf":      "text/vcard",
+	".json":     "application/json",
+	".mp3":      "audio/mpeg",
+	".m4a":      "audio/mp4",
+	".flac":     "audio/flac",
+	".ogg":      "application/ogg",
+	".wav":      "audio/x-wav",
+	".mp4":      "video/mp4",
+	".m4v":      "video/mp4",
+	".mov":      "video/quicktime",
+	".avi":      "video/x-msvideo",
+	".mkv":      "video/x-matroska",
+	".webm":     "video/webm",
+}
+
+var (
+	mu         sync.RWMutex
+	signatures []signature           // registered, the latest first
+	extensions = map[string]string{} // registered, by lowercase extension
+)
+
+// RegisterSignature registers mimeType as the type of the files whose
+// bytes at offset are magic. Signatures registered later take
+// precedence, and all over the built-in ones.
+func RegisterSignature(mimeType string, offset int, magic []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	sig := signature{offset, append([]byte(nil), magic...), mimeType}
+	signatures = append([]signature{sig}, signatures...)
+}
+
+// RegisterExtension registers mimeType as the type of the files named
+// with the extension ext, such as ".fb2", when their contents don't
+// tell.
+func RegisterExtension(ext, mimeType string) {
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	extensions[strings.ToLower(ext)] = mimeType
+}
+
+func matchSignature(hdr []byte, sigs []signature) string {
+	for _, sig := range sigs {
+		end := sig.offset + len(sig.magic)
+		if len(hdr) >= end && bytes.Equal(hdr[sig.offset:end], sig.magic) {
+			return sig.mtype
 		}
 	}
-	t := http.DetectContentType(hdr)
+	return ""
+}
+
+// MimeType returns the MIME type of the file starting with hdr, or the
+// empty string if unknown.
+func MimeType(hdr []byte) string {
+	mu.RLock()
+	t := matchSignature(hdr, signatures)
+	mu.RUnlock()
+	if t != "" {
+		return t
+	}
+	if t := matchSignature(hdr, builtinSignatures); t != "" {
+		return t
+	}
+	t = http.DetectContentType(hdr)
 	t = strings.Replace(t, "; charset=utf-8", "", 1)
 	if t != "application/octet-stream" && t != "text/plain" {
 		return t
@@ -57,6 +155,41 @@ func MimeType(hdr []byte) string {
 	return ""
 }
 
+// MimeTypeByExtension returns the MIME type of the file named name, by
+// its extension, or the empty string if unknown.
+func MimeTypeByExtension(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	mu.RLock()
+	t, ok := extensions[ext]
+	mu.RUnlock()
+	if ok {
+		return t
+	}
+	if t, ok := builtinExtensions[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		mtype, _, err := mime.ParseMediaType(t)
+		if err == nil {
+			return mtype
+		}
+	}
+	return ""
+}
+
+// FileMimeType returns the MIME type of the file named name, and
+// starting with hdr: sniffed from hdr if possible, else by the name's
+// extension. It returns the empty string if unknown.
+func FileMimeType(name string, hdr []byte) string {
+	if t := MimeType(hdr); t != "" {
+		return t
+	}
+	return MimeTypeByExtension(name)
+}
+
 // MimeTypeFromReader takes a reader, sniffs the beginning of it,
 // and returns the mime (if sniffed, else "") and a new reader
 // that's the concatenation of the bytes sniffed and the remaining
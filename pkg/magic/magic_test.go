@@ -31,6 +31,17 @@ type magicTest struct {
 var tests = []magicTest{
 	{fileName: "smile.jpg", want: "image/jpeg"},
 	{fileName: "smile.png", want: "image/png"},
+	{fileName: "smile.gif", want: "image/gif"},
+	{fileName: "smile.bmp", want: "image/bmp"},
+	{fileName: "smile.ico", want: "image/x-icon"},
+	{fileName: "smile.psd", want: "image/vnd.adobe.photoshop"},
+	{fileName: "smile.tiff", want: "image/tiff"},
+	{fileName: "smile.xcf", want: "image/x-xcf"},
+	{fileName: "foo.tar", want: "application/x-tar"},
+	{fileName: "foo.tar.gz", want: "application/x-gzip"},
+	{fileName: "foo.zip", want: "application/zip"},
+	{data: "\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00", want: "audio/mp4"},
+	{data: "\x00\x00\x00\x20ftypisom\x00\x00\x00\x00", want: "video/mp4"},
 	{data: "<html>foo</html>", want: "text/html"},
 	{data: "\xff", want: ""},
 }
@@ -49,3 +60,51 @@ func TestMagic(t *testing.T) {
 		}
 	}
 }
+
+func TestMimeTypeByExtension(t *testing.T) {
+	for _, tt := range []struct{ name, want string }{
+		{"notes.md", "text/markdown"},
+		{"NOTES.MD", "text/markdown"},
+		{"song.mp3", "audio/mpeg"},
+		{"index.html", "text/html"},
+		{"README", ""},
+		{"file.unknown-ext", ""},
+	} {
+		if got := MimeTypeByExtension(tt.name); got != tt.want {
+			t.Errorf("MimeTypeByExtension(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+	// Sniffing comes first.
+	if got := FileMimeType("smile.md", []byte("GIF89a...")); got != "image/gif" {
+		t.Errorf("FileMimeType of a GIF = %q; want image/gif", got)
+	}
+	if got := FileMimeType("notes.md", []byte("# Notes")); got != "text/markdown" {
+		t.Errorf("FileMimeType of notes.md = %q; want text/markdown", got)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	defer func(sigs []signature, exts map[string]string) {
+		signatures, extensions = sigs, exts
+	}(signatures, extensions)
+	extensions = map[string]string{}
+
+	RegisterExtension("FB2", "application/x-fictionbook+xml")
+	RegisterExtension(".md", "text/x-markdown")
+	RegisterSignature("application/x-foo", 2, []byte("FOO"))
+	RegisterSignature("image/x-custom-gif", 0, []byte("GIF89a"))
+
+	for _, tt := range []struct {
+		name, data, want string
+	}{
+		{"book.fb2", "", "application/x-fictionbook+xml"},
+		{"notes.md", "", "text/x-markdown"},
+		{"", "..FOO..", "application/x-foo"},
+		{"", "FOO....", ""},
+		{"", "GIF89a...", "image/x-custom-gif"},
+	} {
+		if got := FileMimeType(tt.name, []byte(tt.data)); got != tt.want {
+			t.Errorf("FileMimeType(%q, %q) = %q; want %q", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package markdown renders a common subset of Markdown to HTML.
+//
+// Supported are headings, paragraphs, block quotes, ordered and
+// unordered lists, fenced and indented code blocks, horizontal rules,
+// emphasis, code spans, links, images and autolinks.
+//
+// The output is safe to include in a page: raw HTML in the input is
+// escaped rather than passed through, and links and images may only
+// use http, https and mailto URLs, or relative ones.
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ToHTML returns the HTML rendering of the Markdown text.
+func ToHTML(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\t", "    ", -1)
+	var out []string
+	renderBlocks(&out, strings.Split(text, "\n"))
+	return strings.Join(out, "\n")
+}
+
+var (
+	headingRx = regexp.MustCompile(`^ {0,3}(#{1,6})[ ]+(.*?)[ #]*$`)
+	hrRx      = regexp.MustCompile(`^ {0,3}([-*_])( *([-*_]))+ *$`)
+	fenceRx   = regexp.MustCompile("^ {0,3}(```|~~~)")
+	quoteRx   = regexp.MustCompile(`^ {0,3}> ?`)
+	bulletRx  = regexp.MustCompile(`^( {0,3})([-*+])[ ]+`)
+	numberRx  = regexp.MustCompile(`^( {0,3})(\d{1,9})\.[ ]+`)
+)
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func isHR(line string) bool {
+	m := hrRx.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	// All the markers must be the same character.
+	return strings.Count(line, m[1]) >= 3 && strings.Trim(line, " "+m[1]) == ""
+}
+
+// listMarker returns the length of the list item marker starting
+// line, including the spaces around it, and whether the list is
+// ordered. It returns 0 if line doesn't start a list item.
+func listMarker(line string) (n int, ordered bool) {
+	if m := bulletRx.FindString(line); m != "" && !isHR(line) {
+		return len(m), false
+	}
+	if m := numberRx.FindString(line); m != "" {
+		return len(m), true
+	}
+	return 0, false
+}
+
+// startsBlock reports whether line starts a block other than a
+// paragraph, and so interrupts a paragraph.
+func startsBlock(line string) bool {
+	if headingRx.MatchString(line) || isHR(line) || fenceRx.MatchString(line) || quoteRx.MatchString(line) {
+		return true
+	}
+	n, _ := listMarker(line)
+	return n > 0
+}
+
+func renderBlocks(out *[]string, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case fenceRx.MatchString(line):
+			fence := fenceRx.FindStringSubmatch(line)[1]
+			var code []string
+			i++
+			for i < len(lines) && !strings.HasPrefix(strings.TrimLeft(lines[i], " "), fence) {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // closing fence
+			*out = append(*out, codeBlock(code))
+		case strings.HasPrefix(line, "    "):
+			var code []string
+			for i < len(lines) && (strings.HasPrefix(lines[i], "    ") || isBlank(lines[i])) {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+				i++
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			*out = append(*out, codeBlock(code))
+		case headingRx.MatchString(line):
+			m := headingRx.FindStringSubmatch(line)
+			tag := "h" + strconv.Itoa(len(m[1]))
+			*out = append(*out, "<"+tag+">"+inline(m[2])+"</"+tag+">")
+			i++
+		case isHR(line):
+			*out = append(*out, "<hr>")
+			i++
+		case quoteRx.MatchString(line):
+			var quoted []string
+			for i < len(lines) && !isBlank(lines[i]) {
+				l := lines[i]
+				if quoteRx.MatchString(l) {
+					l = l[len(quoteRx.FindString(l)):]
+				}
+				quoted = append(quoted, l)
+				i++
+			}
+			*out = append(*out, "<blockquote>")
+			renderBlocks(out, quoted)
+			*out = append(*out, "</blockquote>")
+		default:
+			if n, _ := listMarker(line); n > 0 {
+				i = renderList(out, lines, i)
+				continue
+			}
+			var para []string
+			for i < len(lines) && !isBlank(lines[i]) && (len(para) == 0 || !startsBlock(lines[i])) {
+				para = append(para, lines[i])
+				i++
+			}
+			*out = append(*out, "<p>"+paragraph(para)+"</p>")
+		}
+	}
+}
+
+// renderList renders the list starting at lines[i] and returns the
+// index of the line after it.
+func renderList(out *[]string, lines []string, i int) int {
+	_, ordered := listMarker(lines[i])
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	*out = append(*out, "<"+tag+">")
+	for i < len(lines) {
+		n, o := listMarker(lines[i])
+		if n == 0 || o != ordered {
+			break
+		}
+		item := []string{lines[i][n:]}
+		i++
+		for i < len(lines) {
+			l := lines[i]
+			if isBlank(l) {
+				// A blank line continues the item only if an
+				// indented line follows.
+				if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "  ") {
+					item = append(item, "")
+					i++
+					continue
+				}
+				break
+			}
+			if strings.HasPrefix(l, "  ") {
+				item = append(item, trimIndent(l, n))
+			} else if m, _ := listMarker(l); m == 0 && !startsBlock(l) {
+				item = append(item, l) // lazy continuation
+			} else {
+				break
+			}
+			i++
+		}
+		var inner []string
+		renderBlocks(&inner, item)
+		body := strings.Join(inner, "\n")
+		if len(inner) > 0 && strings.HasPrefix(inner[0], "<p>") && strings.HasSuffix(inner[0], "</p>") &&
+			!containsParagraph(inner[1:]) {
+			// A tight item.
+			inner[0] = inner[0][len("<p>") : len(inner[0])-len("</p>")]
+			body = strings.Join(inner, "\n")
+		}
+		*out = append(*out, "<li>"+body+"</li>")
+		// Skip a blank line between items of the same list.
+		if i+1 < len(lines) && isBlank(lines[i]) {
+			if m, o := listMarker(lines[i+1]); m > 0 && o == ordered {
+				i++
+			}
+		}
+	}
+	*out = append(*out, "</"+tag+">")
+	return i
+}
+
+func containsParagraph(blocks []string) bool {
+	for _, b := range blocks {
+		if strings.HasPrefix(b, "<p>") {
+			return true
+		}
+	}
+	return false
+}
+
+// trimIndent removes up to n leading spaces from line.
+func trimIndent(line string, n int) string {
+	for n > 0 && strings.HasPrefix(line, " ") {
+		line = line[1:]
+		n--
+	}
+	return line
+}
+
+func codeBlock(lines []string) string {
+	return "<pre><code>" + html.EscapeString(strings.Join(lines, "\n")) + "</code></pre>"
+}
+
+// paragraph renders the lines of a paragraph. A line ending in two
+// spaces is a hard line break.
+func paragraph(lines []string) string {
+	var buf []string
+	for i, l := range lines {
+		l = strings.TrimLeft(l, " ")
+		brk := strings.HasSuffix(l, "  ") && i < len(lines)-1
+		l = inline(strings.TrimRight(l, " "))
+		if brk {
+			l += "<br>"
+		}
+		buf = append(buf, l)
+	}
+	return strings.Join(buf, "\n")
+}
+
+const escapable = "\\`*_{}[]()#+-.!>~"
+
+// inline renders the inline markup of s.
+func inline(s string) string {
+	var buf []byte
+	text := func(t string) {
+		buf = append(buf, html.EscapeString(t)...)
+	}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(escapable, s[i+1]) >= 0:
+			text(s[i+1 : i+2])
+			i += 2
+			continue
+		case c == '`':
+			n := 0
+			for i+n < len(s) && s[i+n] == '`' {
+				n++
+			}
+			delim := s[i : i+n]
+			if end := strings.Index(s[i+n:], delim); end >= 0 {
+				code := strings.TrimSpace(s[i+n : i+n+end])
+				buf = append(buf, "<code>"+html.EscapeString(code)+"</code>"...)
+				i += n + end + n
+				continue
+			}
+			text(delim)
+			i += n
+			continue
+		case c == '!' && strings.HasPrefix(s[i+1:], "["):
+			if label, url, n, ok := parseLink(s[i+1:]); ok {
+				if safeURL(url) {
+					buf = append(buf, "<img src=\""+html.EscapeString(url)+"\" alt=\""+html.EscapeString(label)+"\">"...)
+				} else {
+					text(label)
+				}
+				i += 1 + n
+				continue
+			}
+		case c == '[':
+			if label, url, n, ok := parseLink(s[i:]); ok {
+				if safeURL(url) {
+					buf = append(buf, "<a href=\""+html.EscapeString(url)+"\">"+inline(label)+"</a>"...)
+				} else {
+					buf = append(buf, inline(label)...)
+				}
+				i += n
+				continue
+			}
+		case c == '<':
+			if end := strings.IndexByte(s[i:], '>'); end > 0 {
+				url := s[i+1 : i+end]
+				if (strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) && !strings.ContainsAny(url, " <") {
+					buf = append(buf, "<a href=\""+html.EscapeString(url)+"\">"+html.EscapeString(url)+"</a>"...)
+					i += end + 1
+					continue
+				}
+			}
+		case c == '*' || c == '_':
+			if c == '_' && i > 0 && isWordByte(s[i-1]) {
+				// No intraword underscore emphasis.
+				break
+			}
+			for _, d := range []string{strings.Repeat(string(c), 2), string(c)} {
+				if !strings.HasPrefix(s[i:], d) || i+len(d) >= len(s) || s[i+len(d)] == ' ' {
+					continue
+				}
+				end := closingDelim(s[i+len(d):], d)
+				if end < 0 {
+					continue
+				}
+				tag := "em"
+				if len(d) == 2 {
+					tag = "strong"
+				}
+				buf = append(buf, "<"+tag+">"+inline(s[i+len(d):i+len(d)+end])+"</"+tag+">"...)
+				i += len(d) + end + len(d)
+				goto next
+			}
+		}
+		text(s[i : i+1])
+		i++
+	next:
+	}
+	return string(buf)
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+// closingDelim returns the index in s of the delimiter d closing an
+// emphasis, or -1.
+func closingDelim(s, d string) int {
+	for i := 1; i+len(d) <= len(s); i++ {
+		if s[i:i+len(d)] != d || s[i-1] == ' ' || s[i-1] == '\\' {
+			continue
+		}
+		after := i + len(d)
+		if after < len(s) && s[after] == d[0] {
+			// Part of a longer run; only a single-char delimiter
+			// may close at the run's end.
+			if len(d) == 1 {
+				i++
+			}
+			continue
+		}
+		if d[0] == '_' && after < len(s) && isWordByte(s[after]) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// parseLink parses a link "[label](url)" or "[label](url "title")"
+// at the start of s, returning the number of bytes it spans.
+func parseLink(s string) (label, url string, n int, ok bool) {
+	depth := 0
+	closeBracket := -1
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				closeBracket = i
+			}
+		}
+		if closeBracket >= 0 {
+			break
+		}
+	}
+	if closeBracket < 0 || !strings.HasPrefix(s[closeBracket+1:], "(") {
+		return
+	}
+	rest := s[closeBracket+2:]
+	end := strings.IndexByte(rest, ')')
+	if end < 0 {
+		return
+	}
+	dest := strings.TrimSpace(rest[:end])
+	if sp := strings.IndexByte(dest, ' '); sp >= 0 {
+		dest = dest[:sp] // drop the title
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	return s[1:closeBracket], dest, closeBracket + 2 + end + 1, true
+}
+
+// safeURL reports whether url is relative or of an allowed scheme.
+func safeURL(url string) bool {
+	colon := strings.IndexByte(url, ':')
+	if colon < 0 {
+		return true
+	}
+	if i := strings.IndexAny(url, "/?#"); i >= 0 && i < colon {
+		return true // relative, with a colon later in the path
+	}
+	switch strings.ToLower(url[:colon]) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package markdown
+
+import (
+	"testing"
+)
+
+var htmlTests = []struct {
+	in, want string
+}{
+	{"", ""},
+	{"hello", "<p>hello</p>"},
+	{"a\nb\n\nc", "<p>a\nb</p>\n<p>c</p>"},
+	{"a  \nb", "<p>a<br>\nb</p>"},
+	{"# Title #\n## Sub", "<h1>Title</h1>\n<h2>Sub</h2>"},
+	{"para\n# head", "<p>para</p>\n<h1>head</h1>"},
+	{"---", "<hr>"},
+	{"* * *", "<hr>"},
+	{"*em* and **strong** and _u_", "<p><em>em</em> and <strong>strong</strong> and <em>u</em></p>"},
+	{"snake_case_name", "<p>snake_case_name</p>"},
+	{"2 * 3 * 4", "<p>2 * 3 * 4</p>"},
+	{"use `a<b>` here", "<p>use <code>a&lt;b&gt;</code> here</p>"},
+	{"\\*not em\\*", "<p>*not em*</p>"},
+	{"```\nx < y\n  z\n```", "<pre><code>x &lt; y\n  z</code></pre>"},
+	{"    code\n    more\n\ntext", "<pre><code>code\nmore</code></pre>\n<p>text</p>"},
+	{"> quoted\n> more", "<blockquote>\n<p>quoted\nmore</p>\n</blockquote>"},
+	{"- a\n- b\n  c", "<ul>\n<li>a</li>\n<li>b\nc</li>\n</ul>"},
+	{"1. one\n2. two", "<ol>\n<li>one</li>\n<li>two</li>\n</ol>"},
+	{"- a\n  - b", "<ul>\n<li>a\n<ul>\n<li>b</li>\n</ul></li>\n</ul>"},
+	{"[go](http://golang.org/) site", "<p><a href=\"http://golang.org/\">go</a> site</p>"},
+	{"[rel](../x \"title\")", "<p><a href=\"../x\">rel</a></p>"},
+	{"![pic](a.jpg)", "<p><img src=\"a.jpg\" alt=\"pic\"></p>"},
+	{"<http://x.org/?a=1&b=2>", "<p><a href=\"http://x.org/?a=1&amp;b=2\">http://x.org/?a=1&amp;b=2</a></p>"},
+
+	// Sanitizing.
+	{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+	{"[x](javascript:alert(1))", "<p>x)</p>"},
+	{"[x](JavaScript:alert)", "<p>x</p>"},
+	{"![x](data:text/html,hi)", "<p>x</p>"},
+	{"[a\"b](http://x/\"onclick=\"y)", "<p><a href=\"http://x/&#34;onclick=&#34;y\">a&#34;b</a></p>"},
+}
+
+func TestToHTML(t *testing.T) {
+	for _, tt := range htmlTests {
+		if got := ToHTML(tt.in); got != tt.want {
+			t.Errorf("ToHTML(%q) =\n%q\nwant:\n%q", tt.in, got, tt.want)
+		}
+	}
+}
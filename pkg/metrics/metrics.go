@@ -0,0 +1,286 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics provides counters and histograms for instrumenting
+// the server, and writes them in the Prometheus text exposition
+// format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of
+// latency histograms.
+var DefaultBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 60}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var (
+	mu      sync.Mutex
+	metrics = make(map[string]metric)
+)
+
+func register(name string, m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := metrics[name]; dup {
+		panic("metrics: duplicate metric " + name)
+	}
+	metrics[name] = m
+}
+
+// WriteTo writes all metrics to w, sorted by name.
+func WriteTo(w io.Writer) error {
+	mu.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	ms := make(map[string]metric, len(metrics))
+	for name, m := range metrics {
+		ms[name] = m
+	}
+	mu.Unlock()
+
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		ms[name].write(bw)
+	}
+	return bw.Flush()
+}
+
+// labels holds a metric's label names, and formats label values.
+type labels []string
+
+// key returns the formatted label set of values, which must match
+// the label names.
+func (l labels) key(values []string) string {
+	if len(values) != len(l) {
+		panic(fmt.Sprintf("metrics: got %d label values, want %d", len(values), len(l)))
+	}
+	if len(l) == 0 {
+		return ""
+	}
+	parts := make([]string, len(l))
+	for i, name := range l {
+		parts[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return strings.Join(parts, ",")
+}
+
+// series returns the series name for name with the label sets a and b.
+func series(name, a, b string) string {
+	switch {
+	case a == "" && b == "":
+		return name
+	case a == "":
+		return name + "{" + b + "}"
+	case b == "":
+		return name + "{" + a + "}"
+	}
+	return name + "{" + a + "," + b + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// A Counter is a monotonically increasing count, per set of label
+// values.
+type Counter struct {
+	name, help string
+	labels     labels
+
+	mu   sync.Mutex
+	vals map[string]int64
+}
+
+// NewCounter returns and registers a counter with the given label
+// names.
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		labels: labels(labelNames),
+		vals:   make(map[string]int64),
+	}
+	register(name, c)
+	return c
+}
+
+// Add adds n to the counter of labelValues.
+func (c *Counter) Add(n int64, labelValues ...string) {
+	k := c.labels.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vals[k] += n
+}
+
+// Inc adds one to the counter of labelValues.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.vals))
+	for k := range c.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s %d\n", series(c.name, k, ""), c.vals[k])
+	}
+}
+
+// A Gauge is a value that can go up and down, per set of label values.
+type Gauge struct {
+	name, help string
+	labels     labels
+
+	mu   sync.Mutex
+	vals map[string]float64
+}
+
+// NewGauge returns and registers a gauge with the given label names.
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{
+		name:   name,
+		help:   help,
+		labels: labels(labelNames),
+		vals:   make(map[string]float64),
+	}
+	register(name, g)
+	return g
+}
+
+// Set sets the gauge of labelValues to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	k := g.labels.key(labelValues)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.vals[k] = v
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	keys := make([]string, 0, len(g.vals))
+	for k := range g.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s %s\n", series(g.name, k, ""), formatFloat(g.vals[k]))
+	}
+}
+
+// A Histogram counts observed values into buckets, per set of label
+// values.
+type Histogram struct {
+	name, help string
+	labels     labels
+	buckets    []float64
+
+	mu   sync.Mutex
+	vals map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []int64 // per bucket, non-cumulative
+	count  int64
+	sum    float64
+}
+
+// NewHistogram returns and registers a histogram with the given
+// bucket upper bounds, in increasing order, and label names.
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels(labelNames),
+		buckets: buckets,
+		vals:    make(map[string]*histogramValue),
+	}
+	register(name, h)
+	return h
+}
+
+// Observe records v in the histogram of labelValues.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.labels.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.vals[k]
+	if !ok {
+		hv = &histogramValue{counts: make([]int64, len(h.buckets))}
+		h.vals[k] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+			break
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// ObserveSince records the seconds elapsed since t in the histogram of
+// labelValues.
+func (h *Histogram) ObserveSince(t time.Time, labelValues ...string) {
+	h.Observe(time.Since(t).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.vals))
+	for k := range h.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hv := h.vals[k]
+		var cum int64
+		for i, b := range h.buckets {
+			cum += hv.counts[i]
+			fmt.Fprintf(w, "%s %d\n", series(h.name+"_bucket", k, `le="`+formatFloat(b)+`"`), cum)
+		}
+		fmt.Fprintf(w, "%s %d\n", series(h.name+"_bucket", k, `le="+Inf"`), hv.count)
+		fmt.Fprintf(w, "%s %s\n", series(h.name+"_sum", k, ""), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s %d\n", series(h.name+"_count", k, ""), hv.count)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	c := NewCounter("test_ops_total", "Ops.", "op")
+	c.Inc("get")
+	c.Add(2, "put")
+	c.Inc("get")
+	g := NewGauge("test_queue", "Queue.")
+	g.Set(3)
+	g.Set(1.5)
+	h := NewHistogram("test_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	if err := WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_ops_total Ops.
+# TYPE test_ops_total counter
+test_ops_total{op="get"} 2
+test_ops_total{op="put"} 2
+# HELP test_queue Queue.
+# TYPE test_queue gauge
+test_queue 1.5
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 3.55
+test_seconds_count 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WriteTo =\n%s\nwant:\n%s", got, want)
+	}
+}
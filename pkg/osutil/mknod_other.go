@@ -0,0 +1,30 @@
+// +build !linux,!darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package osutil
+
+import (
+	"errors"
+	"os"
+)
+
+// Mknod creates the fifo, socket or device path. It's only supported
+// on Linux and OS X for now.
+func Mknod(path string, mode os.FileMode, major, minor uint32) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: errors.New("special files not supported on this OS")}
+}
@@ -0,0 +1,57 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package osutil
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Mknod creates the fifo, socket or device path, of the type and
+// permissions of mode, and with the device numbers major and minor.
+// Only root may create devices.
+func Mknod(path string, mode os.FileMode, major, minor uint32) error {
+	perm := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		perm |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		perm |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		perm |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		perm |= syscall.S_IFBLK
+	default:
+		return &os.PathError{Op: "mknod", Path: path, Err: errors.New("not a special file mode")}
+	}
+	if err := syscall.Mknod(path, perm, int(makedev(major, minor))); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
+
+func makedev(major, minor uint32) uint64 {
+	if runtime.GOOS == "darwin" {
+		return uint64(major)<<24 | uint64(minor)
+	}
+	maj, min := uint64(major), uint64(minor)
+	return min&0xff | (maj&0xfff)<<8 | (min&^0xff)<<12 | (maj&^0xfff)<<32
+}
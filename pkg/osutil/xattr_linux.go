@@ -0,0 +1,75 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package osutil
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// Xattrs returns the extended attributes of the file or directory at
+// path, by name. It follows symlinks.
+func Xattrs(path string) (map[string][]byte, error) {
+	n, err := syscall.Listxattr(path, nil)
+	if err != nil || n == 0 {
+		return nil, unsupportedOK(err)
+	}
+	buf := make([]byte, n)
+	n, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:n], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vn, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]byte, vn)
+		if vn > 0 {
+			vn, err = syscall.Getxattr(path, string(name), v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		xattrs[string(name)] = v[:vn]
+	}
+	return xattrs, nil
+}
+
+// SetXattrs sets the extended attributes of the file or directory at
+// path, by name.
+func SetXattrs(path string, xattrs map[string][]byte) error {
+	for name, v := range xattrs {
+		if err := syscall.Setxattr(path, name, v, 0); err != nil {
+			return &xattrError{path, name, err}
+		}
+	}
+	return nil
+}
+
+// unsupportedOK returns nil for the errors of file systems without
+// extended attributes.
+func unsupportedOK(err error) error {
+	if err == syscall.ENOTSUP {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+// +build !linux
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package osutil
+
+import "errors"
+
+// Xattrs returns the extended attributes of the file or directory at
+// path, by name. They're only supported on Linux for now; elsewhere
+// there are none.
+func Xattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// SetXattrs sets the extended attributes of the file or directory at
+// path, by name. They're only supported on Linux for now.
+func SetXattrs(path string, xattrs map[string][]byte) error {
+	for name := range xattrs {
+		return &xattrError{path, name, errors.New("extended attributes not supported on this OS")}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2013 The Camlistore Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package readerutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A Spool holds all of a reader's contents, to be read again and
+// again: in memory if they're small, and otherwise in a temporary file,
+// so reading a large or unbounded stream doesn't need that much memory.
+type Spool struct {
+	io.ReadSeeker
+	size int64
+	f    *os.File // or nil if in memory
+}
+
+// NewSpool reads r to EOF into a new Spool, keeping at most maxMem
+// bytes in memory. The Spool is positioned at its start, and must be
+// closed to remove its temporary file.
+func NewSpool(r io.Reader, maxMem int64) (*Spool, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, maxMem+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= maxMem {
+		return &Spool{ReadSeeker: bytes.NewReader(buf.Bytes()), size: n}, nil
+	}
+
+	f, err := ioutil.TempFile("", "camli-spool")
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{ReadSeeker: f, f: f}
+	s.size, err = io.Copy(f, io.MultiReader(&buf, r))
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Size returns the number of bytes spooled.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Close removes the spool's temporary file, if any. It may be called
+// more than once.
+func (s *Spool) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	f := s.f
+	s.f = nil
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2013 The Camlistore Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package readerutil
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	for _, maxMem := range []int64{0, 5, int64(len(text)), 100} {
+		s, err := NewSpool(strings.NewReader(text), maxMem)
+		if err != nil {
+			t.Fatalf("maxMem %d: %v", maxMem, err)
+		}
+		if s.Size() != int64(len(text)) {
+			t.Errorf("maxMem %d: size = %d; want %d", maxMem, s.Size(), len(text))
+		}
+		inFile := s.f != nil
+		if want := maxMem < int64(len(text)); inFile != want {
+			t.Errorf("maxMem %d: spooled to a file = %v; want %v", maxMem, inFile, want)
+		}
+		for pass := 0; pass < 2; pass++ {
+			got, err := ioutil.ReadAll(s)
+			if err != nil || string(got) != text {
+				t.Errorf("maxMem %d, pass %d: read %q, %v; want %q", maxMem, pass, got, err, text)
+			}
+			s.Seek(0, os.SEEK_SET)
+		}
+		var name string
+		if inFile {
+			name = s.f.Name()
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("maxMem %d: Close = %v", maxMem, err)
+		}
+		if name != "" {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("maxMem %d: temporary file %s not removed", maxMem, name)
+			}
+		}
+	}
+}
@@ -21,7 +21,10 @@ limitations under the License.
 // particular is at https://github.com/apenwarr/bup/blob/master/lib/bup/bupsplit.c
 package rollsum
 
-import ()
+import (
+	"encoding/binary"
+	"errors"
+)
 
 const windowSize = 64
 const charOffset = 31
@@ -70,3 +73,25 @@ func (rs *RollSum) Bits() int {
 func (rs *RollSum) Digest() uint32 {
 	return (rs.s1 << 16) | (rs.s2 & 0xffff)
 }
+
+// MarshalBinary returns the state of rs, from which UnmarshalBinary
+// can resume rolling.
+func (rs *RollSum) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 9, 9+windowSize)
+	binary.BigEndian.PutUint32(b[0:], rs.s1)
+	binary.BigEndian.PutUint32(b[4:], rs.s2)
+	b[8] = byte(rs.wofs)
+	return append(b, rs.window[:]...), nil
+}
+
+// UnmarshalBinary sets the state of rs to one from MarshalBinary.
+func (rs *RollSum) UnmarshalBinary(b []byte) error {
+	if len(b) != 9+windowSize || int(b[8]) >= windowSize {
+		return errors.New("rollsum: invalid state")
+	}
+	rs.s1 = binary.BigEndian.Uint32(b[0:])
+	rs.s2 = binary.BigEndian.Uint32(b[4:])
+	rs.wofs = int(b[8])
+	copy(rs.window[:], b[9:])
+	return nil
+}
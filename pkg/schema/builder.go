@@ -0,0 +1,201 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// A Signer signs schema maps, setting their "camliSigner", and
+// returns the signed JSON. It is implemented by *client.Client, with
+// the client's configured key, and by *signhandler.Handler, with the
+// server's.
+type Signer interface {
+	SignMap(m Map) (signedJSON string, err error)
+}
+
+// A Builder builds a schema blob, with setters that return the
+// Builder, to be chained. For example, to title a permanode:
+//
+//   pn, err := schema.NewPermanode().Sign(signer)
+//   ...
+//   claim, err := schema.NewClaim(blobref.SHA1FromString(pn)).
+//           SetAttribute("title", "Vacation").
+//           SetClaimDate(t).
+//           Sign(signer)
+//
+// The first error of a setter, such as one not applying to the blob's
+// type, is returned by Map, JSON or Sign, and the setters after it do
+// nothing.
+type Builder struct {
+	m   Map
+	err error
+}
+
+// NewFileBuilder returns a Builder of a "file" blob named fileName,
+// with no parts yet.
+func NewFileBuilder(fileName string) *Builder {
+	return &Builder{m: NewFileMap(fileName)}
+}
+
+// NewPermanode returns a Builder of a new random permanode.
+func NewPermanode() *Builder {
+	return &Builder{m: NewUnsignedPermanode()}
+}
+
+// NewClaim returns a Builder of a claim on permaNode, dated now. Its
+// change must be set by SetAttribute, AddAttribute or DelAttribute.
+func NewClaim(permaNode *blobref.BlobRef) *Builder {
+	m := newMap(1, "claim")
+	m["permaNode"] = permaNode.String()
+	m.SetClaimDate(time.Now())
+	return &Builder{m: m}
+}
+
+// NewBuilder returns a Builder of m, to use the setters on a Map made
+// by the other constructors of this package.
+func NewBuilder(m Map) *Builder {
+	return &Builder{m: m}
+}
+
+// check records, if there's no error yet, an error if the blob isn't
+// of camliType typ. It reports whether the setter calling it, named
+// setter, may proceed.
+func (b *Builder) check(setter, typ string) bool {
+	if b.err != nil {
+		return false
+	}
+	if t := b.m.Type(); t != typ {
+		b.err = fmt.Errorf("schema: %s on a %q blob; want %q", setter, t, typ)
+		return false
+	}
+	return true
+}
+
+// Set sets the field key of the blob to value.
+func (b *Builder) Set(key string, value interface{}) *Builder {
+	if b.err == nil {
+		b.m[key] = value
+	}
+	return b
+}
+
+// SetModTime sets the modification time of a file.
+func (b *Builder) SetModTime(t time.Time) *Builder {
+	if b.check("SetModTime", "file") {
+		b.m["unixMtime"] = RFC3339FromTime(t)
+	}
+	return b
+}
+
+// SetParts sets the parts of a file, whose sizes must sum to size, as
+// with PopulateParts.
+func (b *Builder) SetParts(size int64, parts []BytesPart) *Builder {
+	if b.check("SetParts", "file") {
+		b.err = PopulateParts(b.m, size, parts)
+	}
+	return b
+}
+
+// SetPlannedKey makes a permanode a planned one, of the fixed key,
+// rather than random. As with NewPlannedPermanode, it must be signed
+// at a fixed time to have the same blobref between runs.
+func (b *Builder) SetPlannedKey(key string) *Builder {
+	if b.check("SetPlannedKey", "permanode") {
+		delete(b.m, "random")
+		b.m["key"] = key
+	}
+	return b
+}
+
+// SetClaimDate sets the date of a claim.
+func (b *Builder) SetClaimDate(t time.Time) *Builder {
+	if b.check("SetClaimDate", "claim") {
+		b.m.SetClaimDate(t)
+	}
+	return b
+}
+
+// SetAttribute makes a claim set the attribute attr to value,
+// replacing its values.
+func (b *Builder) SetAttribute(attr, value string) *Builder {
+	return b.setChange("SetAttribute", SetAttribute, attr, value)
+}
+
+// AddAttribute makes a claim add value to the values of the
+// attribute attr.
+func (b *Builder) AddAttribute(attr, value string) *Builder {
+	return b.setChange("AddAttribute", AddAttribute, attr, value)
+}
+
+// DelAttribute makes a claim delete value from the values of the
+// attribute attr, or all of them if value is empty.
+func (b *Builder) DelAttribute(attr, value string) *Builder {
+	return b.setChange("DelAttribute", DelAttribute, attr, value)
+}
+
+func (b *Builder) setChange(setter, claimType, attr, value string) *Builder {
+	if !b.check(setter, "claim") {
+		return b
+	}
+	b.m["claimType"] = claimType
+	b.m["attribute"] = attr
+	if value == "" && claimType == DelAttribute {
+		delete(b.m, "value")
+	} else {
+		b.m["value"] = value
+	}
+	return b
+}
+
+var errNoClaimType = errors.New("schema: claim has no change; call SetAttribute, AddAttribute or DelAttribute")
+
+// Map returns the blob's Map, or the first error of the setters.
+func (b *Builder) Map() (Map, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.m.Type() == "claim" {
+		if _, ok := b.m["claimType"]; !ok {
+			return nil, errNoClaimType
+		}
+	}
+	return b.m, nil
+}
+
+// JSON returns the blob, unsigned, as for the blobs not needing a
+// signature, such as files.
+func (b *Builder) JSON() (string, error) {
+	m, err := b.Map()
+	if err != nil {
+		return "", err
+	}
+	return m.JSON()
+}
+
+// Sign returns the blob signed by s.
+func (b *Builder) Sign(s Signer) (string, error) {
+	m, err := b.Map()
+	if err != nil {
+		return "", err
+	}
+	return s.SignMap(m)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// fakeSigner "signs" maps by setting their camliSigner only.
+type fakeSigner struct {
+	signed []Map
+}
+
+func (s *fakeSigner) SignMap(m Map) (string, error) {
+	m["camliSigner"] = "sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007"
+	s.signed = append(s.signed, m)
+	return m.JSON()
+}
+
+func TestBuilderClaim(t *testing.T) {
+	pn := blobref.MustParse("sha1-f1d2d2f924e986ac86fdf7b36c94bcdf32beec15")
+	date := time.Date(2013, 5, 6, 7, 8, 9, 0, time.UTC)
+	s := new(fakeSigner)
+	signed, err := NewClaim(pn).SetAttribute("title", "Vacation").SetClaimDate(date).Sign(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, kExpectedHeader) {
+		t.Errorf("signed claim %q doesn't start with %q", signed, kExpectedHeader)
+	}
+	ss, err := ParseSuperset(strings.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.Type != "claim" || ss.ClaimType != SetAttribute || ss.Permanode != pn.String() ||
+		ss.Attribute != "title" || ss.Value != "Vacation" || ss.ClaimDate != "2013-05-06T07:08:09Z" ||
+		ss.Signer == "" {
+		t.Errorf("signed claim = %+v", ss)
+	}
+
+	m, err := NewClaim(pn).DelAttribute("tag", "").Map()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["value"]; ok || m["claimType"] != DelAttribute {
+		t.Errorf("del-attribute claim of all values = %v", m)
+	}
+
+	if _, err := NewClaim(pn).Sign(s); err != errNoClaimType {
+		t.Errorf("signing a claim with no change = %v; want %v", err, errNoClaimType)
+	}
+	if len(s.signed) != 1 {
+		t.Errorf("signed %d maps; want 1", len(s.signed))
+	}
+}
+
+func TestBuilderPermanode(t *testing.T) {
+	m, err := NewPermanode().SetPlannedKey("key1").Map()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["random"]; ok || m["key"] != "key1" || m.Type() != "permanode" {
+		t.Errorf("planned permanode = %v", m)
+	}
+	a, _ := NewPermanode().Map()
+	b, _ := NewPermanode().Map()
+	if a["random"] == b["random"] {
+		t.Errorf("two new permanodes have the same random %v", a["random"])
+	}
+}
+
+func TestBuilderFile(t *testing.T) {
+	part := blobref.MustParse("sha1-f1d2d2f924e986ac86fdf7b36c94bcdf32beec15")
+	mtime := time.Date(2013, 5, 6, 7, 8, 9, 0, time.UTC)
+	js, err := NewFileBuilder("/tmp/foo.txt").
+		SetModTime(mtime).
+		SetParts(4, []BytesPart{{Size: 4, BlobRef: part}}).
+		JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := ParseSuperset(strings.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.Type != "file" || ss.FileNameString() != "foo.txt" || ss.SumPartsSize() != 4 || !ss.ModTime().Equal(mtime) {
+		t.Errorf("file = %+v", ss)
+	}
+
+	// The parts must sum to the size.
+	if _, err := NewFileBuilder("foo.txt").SetParts(5, []BytesPart{{Size: 4, BlobRef: part}}).JSON(); err == nil {
+		t.Error("file of parts not summing to its size built")
+	}
+}
+
+func TestBuilderWrongType(t *testing.T) {
+	b := NewPermanode().SetModTime(time.Now()).SetPlannedKey("key1")
+	if _, err := b.Map(); err == nil || !strings.Contains(err.Error(), "SetModTime") {
+		t.Errorf("SetModTime on a permanode = %v; want an error", err)
+	}
+	if _, err := NewFileBuilder("foo.txt").SetAttribute("title", "foo").JSON(); err == nil {
+		t.Error("SetAttribute on a file succeeded")
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"strings"
+	"sync"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+var (
+	chunkConcMu sync.Mutex
+	chunkConc   = 1
+)
+
+// SetChunkUploadConcurrency sets how many chunks of a file
+// WriteFileMap and the other file writers upload at once, one by
+// default. With more than one, the chunks are also statted in
+// batches, to only upload those missing. Each chunk queued or in
+// flight is up to 1MB in memory, and with n there are at most 3n.
+func SetChunkUploadConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	chunkConcMu.Lock()
+	defer chunkConcMu.Unlock()
+	chunkConc = n
+}
+
+func chunkUploadConcurrency() int {
+	chunkConcMu.Lock()
+	defer chunkConcMu.Unlock()
+	return chunkConc
+}
+
+// chunkUploader uploads the chunks of a file concurrently. The chunks
+// added are queued until there are enough of them to stat at once,
+// then those missing are uploaded.
+type chunkUploader struct {
+	bs      blobserver.StatReceiver
+	gate    chan bool // one per upload in flight
+	batch   int       // chunks queued before a stat
+	pending []chunk
+	wg      sync.WaitGroup
+
+	mu  sync.Mutex
+	err error // first error of the uploads
+}
+
+type chunk struct {
+	br       *blobref.BlobRef
+	contents string
+}
+
+func newChunkUploader(bs blobserver.StatReceiver, concurrency int) *chunkUploader {
+	return &chunkUploader{
+		bs:    bs,
+		gate:  make(chan bool, concurrency),
+		batch: 2 * concurrency,
+	}
+}
+
+// add queues contents, of blob br, for upload. It returns the error of
+// any upload that failed so far.
+func (cu *chunkUploader) add(br *blobref.BlobRef, contents string) error {
+	cu.pending = append(cu.pending, chunk{br, contents})
+	if len(cu.pending) < cu.batch {
+		return cu.firstErr()
+	}
+	return cu.flush()
+}
+
+// flush stats the queued chunks and starts uploading those missing,
+// blocking while too many uploads are in flight.
+func (cu *chunkUploader) flush() error {
+	pending := cu.pending
+	cu.pending = nil
+	if len(pending) == 0 {
+		return cu.firstErr()
+	}
+	brs := make([]*blobref.BlobRef, 0, len(pending))
+	for _, c := range pending {
+		brs = append(brs, c.br)
+	}
+	have, err := serverHasBlobs(cu.bs, brs)
+	if err != nil {
+		return err
+	}
+	for _, c := range pending {
+		key := c.br.String()
+		if have[key] {
+			continue
+		}
+		// A file often repeats a chunk; upload it only once.
+		have[key] = true
+		cu.gate <- true
+		cu.wg.Add(1)
+		go func(c chunk) {
+			defer func() {
+				<-cu.gate
+				cu.wg.Done()
+			}()
+			if _, err := cu.bs.ReceiveBlob(c.br, strings.NewReader(c.contents)); err != nil {
+				cu.mu.Lock()
+				if cu.err == nil {
+					cu.err = err
+				}
+				cu.mu.Unlock()
+			}
+		}(c)
+	}
+	return cu.firstErr()
+}
+
+// wait uploads the queued chunks, and returns once all the uploads
+// are done.
+func (cu *chunkUploader) wait() error {
+	err := cu.flush()
+	cu.wg.Wait()
+	if err != nil {
+		return err
+	}
+	return cu.firstErr()
+}
+
+func (cu *chunkUploader) firstErr() error {
+	cu.mu.Lock()
+	defer cu.mu.Unlock()
+	return cu.err
+}
+
+// serverHasBlobs returns which of brs bs has, keyed by their string
+// form, with a single stat.
+func serverHasBlobs(bs blobserver.BlobStatter, brs []*blobref.BlobRef) (have map[string]bool, err error) {
+	have = make(map[string]bool)
+	ch := make(chan blobref.SizedBlobRef, len(brs))
+	go func() {
+		err = bs.StatBlobs(ch, brs, 0)
+		close(ch)
+	}()
+	for sb := range ch {
+		have[sb.BlobRef.String()] = true
+	}
+	return
+}
@@ -97,14 +97,39 @@ func (dr *DirReader) StaticSet() ([]*blobref.BlobRef, error) {
 	if ss.Type != "static-set" {
 		return nil, fmt.Errorf("schema/filereader: expected \"static-set\" schema blob for %s, got %q", staticSetBlobref, ss.Type)
 	}
+	dr.staticSet, err = ss.StaticSetMembers(dr.fetcher)
+	if err != nil {
+		return nil, err
+	}
+	return dr.staticSet, nil
+}
+
+// StaticSetMembers returns the members of the static-set ss, and
+// those of the static-sets it merges, which are fetched from fetcher.
+func (ss *Superset) StaticSetMembers(fetcher blobref.SeekFetcher) ([]*blobref.BlobRef, error) {
+	var members []*blobref.BlobRef
 	for _, s := range ss.Members {
 		member := blobref.Parse(s)
 		if member == nil {
 			return nil, fmt.Errorf("schema/filereader: invalid (static-set member) blobref\n")
 		}
-		dr.staticSet = append(dr.staticSet, member)
+		members = append(members, member)
 	}
-	return dr.staticSet, nil
+	for _, s := range ss.MergeSets {
+		sub := new(Superset)
+		if err := sub.setFromBlobRef(fetcher, blobref.Parse(s)); err != nil {
+			return nil, err
+		}
+		if sub.Type != "static-set" {
+			return nil, fmt.Errorf("schema/filereader: expected \"static-set\" schema blob for merged set %s, got %q", s, sub.Type)
+		}
+		subMembers, err := sub.StaticSetMembers(fetcher)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, subMembers...)
+	}
+	return members, nil
 }
 
 // Readdir implements the Directory interface.
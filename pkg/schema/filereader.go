@@ -17,6 +17,7 @@ limitations under the License.
 package schema
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -302,6 +303,8 @@ func (fr *FileReader) readerForOffset(off int64) (io.ReadCloser, error) {
 	switch {
 	case p0.BlobRef != nil && p0.BytesRef != nil:
 		return nil, fmt.Errorf("part illegally contained both a blobRef and bytesRef")
+	case p0.Bytes != nil:
+		rsc = inlineBytes{bytes.NewReader(p0.Bytes)}
 	case p0.BlobRef == nil && p0.BytesRef == nil:
 		return &nZeros{int(p0.Size - uint64(offRemain))}, nil
 	case p0.BlobRef != nil:
@@ -341,6 +344,13 @@ func (fr *FileReader) readerForOffset(off int64) (io.ReadCloser, error) {
 	}, nil
 }
 
+// inlineBytes is the ReadSeekCloser of the inline bytes of a part.
+type inlineBytes struct {
+	*bytes.Reader
+}
+
+func (inlineBytes) Close() error { return nil }
+
 // nZeros is a ReadCloser that reads remain zeros before EOF.
 type nZeros struct {
 	remain int
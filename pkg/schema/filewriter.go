@@ -19,11 +19,11 @@ package schema
 import (
 	"bufio"
 	"bytes"
-	"crypto"
 	"fmt"
 	"io"
 	"log"
 	"strings"
+	"sync"
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
@@ -57,8 +57,68 @@ const (
 	// boundaries are ignored if the current chunk being built is
 	// smaller than this.
 	tooSmallThreshold = 64 << 10
+
+	// maxInlineThreshold is the most SetInlineThreshold allows, so
+	// that file schema blobs stay small.
+	maxInlineThreshold = 64 << 10
+)
+
+var (
+	inlineMu        sync.Mutex
+	inlineThreshold = 0
 )
 
+// SetInlineThreshold sets the size under which WriteFileMap and the
+// other file writers put the contents of a file in its file schema
+// blob, as inline bytes, instead of in a blob of their own. It's 0,
+// never, by default, and at most 64 kB.
+func SetInlineThreshold(n int) {
+	if n < 0 {
+		n = 0
+	}
+	if n > maxInlineThreshold {
+		n = maxInlineThreshold
+	}
+	inlineMu.Lock()
+	defer inlineMu.Unlock()
+	inlineThreshold = n
+}
+
+func getInlineThreshold() int {
+	inlineMu.Lock()
+	defer inlineMu.Unlock()
+	return inlineThreshold
+}
+
+// readInline reads all of r if it's smaller than the inline
+// threshold, returning its contents and ok. Otherwise it returns a
+// reader of all of r, including what was read of it.
+func readInline(r io.Reader) (contents []byte, rest io.Reader, ok bool, err error) {
+	threshold := getInlineThreshold()
+	if threshold == 0 {
+		return nil, r, false, nil
+	}
+	buf := make([]byte, threshold)
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return buf[:n], nil, true, nil
+	case nil:
+		return nil, io.MultiReader(bytes.NewReader(buf), r), false, nil
+	}
+	return nil, nil, false, err
+}
+
+// populateInline populates the parts of fileMap with contents, as
+// inline bytes.
+func populateInline(fileMap Map, contents []byte) error {
+	var parts []BytesPart
+	if len(contents) > 0 {
+		parts = append(parts, BytesPart{Size: uint64(len(contents)), Bytes: contents})
+	}
+	return PopulateParts(fileMap, int64(len(contents)), parts)
+}
+
 var _ = log.Printf
 
 // WriteFileFromReader creates and uploads a "file" JSON schema
@@ -71,72 +131,13 @@ func WriteFileFromReader(bs blobserver.StatReceiver, filename string, r io.Reade
 
 // WriteFileMap uploads chunks of r to bs while populating fileMap and
 // finally uploading fileMap. The returned blobref is of fileMap's
-// JSON blob.
+// JSON blob. The chunks are cut where a rolling checksum of the
+// contents says so, not at fixed offsets, so a file edited in place
+// keeps most of the chunks of its previous version.
 func WriteFileMap(bs blobserver.StatReceiver, fileMap Map, r io.Reader) (*blobref.BlobRef, error) {
 	return writeFileMapRolling(bs, fileMap, r)
 }
 
-// This is the simple 1MB chunk version. The rolling checksum version is below.
-func writeFileMapOld(bs blobserver.StatReceiver, fileMap Map, r io.Reader) (*blobref.BlobRef, error) {
-	parts, size := []BytesPart{}, int64(0)
-
-	var buf bytes.Buffer
-	for {
-		buf.Reset()
-		n, err := io.Copy(&buf, io.LimitReader(r, maxBlobSize))
-		if err != nil {
-			return nil, err
-		}
-		if n == 0 {
-			break
-		}
-
-		hash := crypto.SHA1.New()
-		io.Copy(hash, bytes.NewBuffer(buf.Bytes()))
-		br := blobref.FromHash("sha1", hash)
-		hasBlob, err := serverHasBlob(bs, br)
-		if err != nil {
-			return nil, err
-		}
-		if !hasBlob {
-			sb, err := bs.ReceiveBlob(br, &buf)
-			if err != nil {
-				return nil, err
-			}
-			if expect := (blobref.SizedBlobRef{br, n}); !expect.Equal(sb) {
-				return nil, fmt.Errorf("schema/filewriter: wrote %s bytes, got %s ack'd", expect, sb)
-			}
-		}
-
-		size += n
-		parts = append(parts, BytesPart{
-			BlobRef: br,
-			Size:    uint64(n),
-			Offset:  0, // into BlobRef to read from (not of dest)
-		})
-	}
-
-	err := PopulateParts(fileMap, size, parts)
-	if err != nil {
-		return nil, err
-	}
-
-	json, err := fileMap.JSON()
-	if err != nil {
-		return nil, err
-	}
-	br := blobref.SHA1FromString(json)
-	sb, err := bs.ReceiveBlob(br, strings.NewReader(json))
-	if err != nil {
-		return nil, err
-	}
-	if expect := (blobref.SizedBlobRef{br, int64(len(json))}); !expect.Equal(sb) {
-		return nil, fmt.Errorf("schema/filewriter: wrote %s bytes, got %s ack'd", expect, sb)
-	}
-
-	return br, nil
-}
-
 func serverHasBlob(bs blobserver.BlobStatter, br *blobref.BlobRef) (have bool, err error) {
 	ch := make(chan blobref.SizedBlobRef, 1)
 	go func() {
@@ -221,6 +222,18 @@ func uploadBytes(bs blobserver.StatReceiver, mapSource func() Map, size int64, s
 	return uploadString(bs, json)
 }
 
+// uploadInline uploads fileMap, with contents inline.
+func uploadInline(bs blobserver.StatReceiver, fileMap Map, contents []byte) (*blobref.BlobRef, error) {
+	if err := populateInline(fileMap, contents); err != nil {
+		return nil, err
+	}
+	json, err := fileMap.JSON()
+	if err != nil {
+		return nil, err
+	}
+	return uploadString(bs, json)
+}
+
 // addBytesParts uploads the provided spans to bs, appending elements to *dst.
 func addBytesParts(bs blobserver.StatReceiver, dst *[]BytesPart, spans []span) error {
 	for _, sp := range spans {
@@ -265,6 +278,13 @@ func addBytesParts(bs blobserver.StatReceiver, dst *[]BytesPart, spans []span) e
 // finally uploading fileMap. The returned blobref is of fileMap's
 // JSON blob. It uses rolling checksum for the chunks sizes.
 func writeFileMapRolling(bs blobserver.StatReceiver, fileMap Map, r io.Reader) (outbr *blobref.BlobRef, outerr error) {
+	contents, r, inline, err := readInline(r)
+	if err != nil {
+		return nil, err
+	}
+	if inline {
+		return uploadInline(bs, fileMap, contents)
+	}
 	rootFile := func() Map { return fileMap }
 	n, spans, err := writeFileChunks(bs, fileMap, r)
 	if err != nil {
@@ -277,6 +297,13 @@ func writeFileMapRolling(bs blobserver.StatReceiver, fileMap Map, r io.Reader) (
 // WriteFileChunks uploads chunks of r to bs while populating fileMap.
 // It does not upload fileMap.
 func WriteFileChunks(bs blobserver.StatReceiver, fileMap Map, r io.Reader) error {
+	contents, r, inline, err := readInline(r)
+	if err != nil {
+		return err
+	}
+	if inline {
+		return populateInline(fileMap, contents)
+	}
 	rootFile := func() Map { return fileMap }
 
 	n, spans, err := writeFileChunks(bs, fileMap, r)
@@ -298,19 +325,109 @@ func WriteFileChunks(bs blobserver.StatReceiver, fileMap Map, r io.Reader) error
 	return topLevel(rootFile, n, spans)
 }
 
+// A Checkpoint is the progress of writing a file's chunks, from which
+// WriteFileMapCheckpointed can resume without reading again, or
+// uploading again, the bytes before its Offset.
+type Checkpoint struct {
+	// Offset is how many bytes of the file were chunked and
+	// uploaded.
+	Offset int64 `json:"offset"`
+	// RollSum is the state of the rolling checksum at Offset.
+	RollSum []byte `json:"rollSum"`
+	// Spans are the uploaded chunks, as a tree.
+	Spans []CheckpointSpan `json:"spans"`
+}
+
+// A CheckpointSpan is an uploaded chunk of a Checkpoint.
+type CheckpointSpan struct {
+	From     int64            `json:"from"`
+	To       int64            `json:"to"`
+	Bits     int              `json:"bits"`
+	BlobRef  *blobref.BlobRef `json:"blobRef"`
+	Children []CheckpointSpan `json:"children,omitempty"`
+}
+
+func checkpointSpans(spans []span) []CheckpointSpan {
+	cs := make([]CheckpointSpan, len(spans))
+	for i, sp := range spans {
+		cs[i] = CheckpointSpan{From: sp.from, To: sp.to, Bits: sp.bits, BlobRef: sp.br, Children: checkpointSpans(sp.children)}
+	}
+	return cs
+}
+
+func spansOfCheckpoint(cs []CheckpointSpan) []span {
+	spans := make([]span, len(cs))
+	for i, c := range cs {
+		spans[i] = span{from: c.From, to: c.To, bits: c.Bits, br: c.BlobRef, children: spansOfCheckpoint(c.Children)}
+	}
+	return spans
+}
+
+// WriteFileMapCheckpointed is like WriteFileMap, but calls checkpoint
+// about every interval bytes with the progress so far, after the
+// chunks before it are uploaded. If from is non-nil, writing resumes
+// from it: r must then return the bytes of the file after
+// from.Offset.
+func WriteFileMapCheckpointed(bs blobserver.StatReceiver, fileMap Map, r io.Reader, from *Checkpoint, interval int64, checkpoint func(*Checkpoint)) (*blobref.BlobRef, error) {
+	if from == nil {
+		contents, rest, inline, err := readInline(r)
+		if err != nil {
+			return nil, err
+		}
+		if inline {
+			return uploadInline(bs, fileMap, contents)
+		}
+		r = rest
+	}
+	rootFile := func() Map { return fileMap }
+	n, spans, err := writeFileChunksFrom(bs, r, from, interval, checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	return uploadBytes(bs, rootFile, n, spans)
+}
+
 func writeFileChunks(bs blobserver.StatReceiver, fileMap Map, r io.Reader) (n int64, spans []span, outerr error) {
+	return writeFileChunksFrom(bs, r, nil, 0, nil)
+}
+
+func writeFileChunksFrom(bs blobserver.StatReceiver, r io.Reader, from *Checkpoint, interval int64, checkpoint func(*Checkpoint)) (n int64, spans []span, outerr error) {
 	src := &noteEOFReader{r: r}
 	blobSize := 0 // of the next blob being built, should be same as buf.Len()
 	bufr := bufio.NewReaderSize(src, bufioReaderSize)
 	spans = []span{} // the tree of spans, cut on interesting rollsum boundaries
 	rs := rollsum.New()
+	if from != nil {
+		if err := rs.UnmarshalBinary(from.RollSum); err != nil {
+			return 0, nil, err
+		}
+		n = from.Offset
+		spans = spansOfCheckpoint(from.Spans)
+	}
 	last := n
+	lastCheckpoint := n
 	buf := new(bytes.Buffer)
 
-	// TODO: keep multiple of these in-flight at a time.
+	var cu *chunkUploader
+	if conc := chunkUploadConcurrency(); conc > 1 {
+		cu = newChunkUploader(bs, conc)
+		defer cu.wg.Wait()
+	}
+
 	uploadLastSpan := func() bool {
-		defer buf.Reset()
-		br, err := uploadString(bs, buf.String())
+		// The chunk is copied once, then buf is reused, so the
+		// memory used is bounded by the chunks queued or in
+		// flight, whatever the size of the file.
+		chunk := buf.String()
+		buf.Reset()
+		var br *blobref.BlobRef
+		var err error
+		if cu != nil {
+			br = blobref.SHA1FromString(chunk)
+			err = cu.add(br, chunk)
+		} else {
+			br, err = uploadString(bs, chunk)
+		}
 		if err != nil {
 			outerr = err
 			return false
@@ -328,6 +445,11 @@ func writeFileChunks(bs blobserver.StatReceiver, fileMap Map, r io.Reader) (n in
 					return
 				}
 			}
+			if cu != nil {
+				if err := cu.wait(); err != nil {
+					return 0, nil, err
+				}
+			}
 			break
 		}
 		if err != nil {
@@ -376,6 +498,21 @@ func writeFileChunks(bs blobserver.StatReceiver, fileMap Map, r io.Reader) (n in
 		if !uploadLastSpan() {
 			return
 		}
+		if checkpoint != nil && n-lastCheckpoint >= interval {
+			// The chunks must all be uploaded first.
+			if cu != nil {
+				if err := cu.wait(); err != nil {
+					return 0, nil, err
+				}
+			}
+			lastCheckpoint = n
+			state, _ := rs.MarshalBinary()
+			checkpoint(&Checkpoint{
+				Offset:  n,
+				RollSum: state,
+				Spans:   checkpointSpans(spans),
+			})
+		}
 	}
 
 	return n, spans, nil
@@ -17,6 +17,7 @@ limitations under the License.
 package schema
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/test"
 )
 
 func TestWriteFileMap(t *testing.T) {
@@ -67,6 +69,117 @@ func TestWriteFileMap(t *testing.T) {
 	}
 }
 
+// Tests that the chunk boundaries depend on the contents, not the
+// offsets, so an edited file shares most of its chunks with its
+// previous version.
+func TestWriteFileMapEdited(t *testing.T) {
+	data, _ := ioutil.ReadAll(&randReader{seed: 123, length: 5 << 20})
+	mid := len(data) / 2
+	edited := append(append(append([]byte{}, data[:mid]...), "some inserted bytes"...), data[mid:]...)
+
+	sr := new(statsStatReceiver)
+	if _, err := WriteFileMap(sr, NewFileMap("test-file"), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	before := sr.sumBlobSize()
+	if _, err := WriteFileMap(sr, NewFileMap("test-file"), bytes.NewReader(edited)); err != nil {
+		t.Fatal(err)
+	}
+	added := sr.sumBlobSize() - before
+	t.Logf("edited file added %d bytes of blobs", added)
+	if added > int64(len(data))/8 {
+		t.Errorf("edited file added %d bytes of blobs; want much less than its %d bytes", added, len(edited))
+	}
+}
+
+func TestWriteFileMapCheckpointed(t *testing.T) {
+	data, _ := ioutil.ReadAll(&randReader{seed: 123, length: 5 << 20})
+	want, err := WriteFileMap(new(statsStatReceiver), NewFileMap("test-file"), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cps []*Checkpoint
+	br, err := WriteFileMapCheckpointed(new(statsStatReceiver), NewFileMap("test-file"), bytes.NewReader(data), nil, 1<<20,
+		func(cp *Checkpoint) { cps = append(cps, cp) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !br.Equal(want) {
+		t.Fatalf("checkpointed file = %v; want %v", br, want)
+	}
+	if len(cps) < 2 {
+		t.Fatalf("got %d checkpoints; want a few", len(cps))
+	}
+	for _, cp := range cps {
+		sr := new(statsStatReceiver)
+		br, err := WriteFileMapCheckpointed(sr, NewFileMap("test-file"), bytes.NewReader(data[cp.Offset:]), cp, 1<<20, func(*Checkpoint) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !br.Equal(want) {
+			t.Errorf("resumed from offset %d: file = %v; want %v", cp.Offset, br, want)
+		}
+		if sr.sumBlobSize() >= int64(len(data)) {
+			t.Errorf("resumed from offset %d: uploaded %d bytes again", cp.Offset, sr.sumBlobSize())
+		}
+	}
+}
+
+func TestWriteFileMapConcurrent(t *testing.T) {
+	data, _ := ioutil.ReadAll(&randReader{seed: 123, length: 5 << 20})
+	serial := new(statsStatReceiver)
+	want, err := WriteFileMap(serial, NewFileMap("test-file"), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetChunkUploadConcurrency(4)
+	defer SetChunkUploadConcurrency(1)
+	sr := new(statsStatReceiver)
+	br, err := WriteFileMap(sr, NewFileMap("test-file"), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !br.Equal(want) {
+		t.Errorf("concurrently written file = %v; want %v", br, want)
+	}
+	if g, w := sr.numBlobs(), serial.numBlobs(); g != w {
+		t.Errorf("num blobs = %d; want %d", g, w)
+	}
+	if g, w := sr.sumBlobSize(), serial.sumBlobSize(); g != w {
+		t.Errorf("sum blob size = %d; want %d", g, w)
+	}
+}
+
+func TestWriteFileMapInline(t *testing.T) {
+	SetInlineThreshold(100)
+	defer SetInlineThreshold(0)
+	for _, size := range []int{0, 10, 99, 100, 1000} {
+		data, _ := ioutil.ReadAll(&randReader{seed: 123, length: size})
+		sto := new(test.Fetcher)
+		br, err := WriteFileMap(sto, NewFileMap("test-file"), bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		sr := new(statsStatReceiver)
+		if _, err := WriteFileMap(sr, NewFileMap("test-file"), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if inline, n := size < 100, sr.numBlobs(); inline != (n == 1) {
+			t.Errorf("size %d: %d blobs; want inline = %v", size, n, inline)
+		}
+		fr, err := NewFileReader(sto, br)
+		if err != nil {
+			t.Fatalf("size %d: NewFileReader: %v", size, err)
+		}
+		got, err := ioutil.ReadAll(fr)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: read back %d bytes, %v; want the %d written", size, len(got), err, len(data))
+		}
+	}
+}
+
 type randReader struct {
 	seed   int64
 	length int
@@ -250,14 +250,26 @@ type Superset struct {
 	UnixCtime      string `json:"unixCtime"`
 	UnixAtime      string `json:"unixAtime"`
 
+	UnixXattrs map[string][]byte `json:"unixXattrs"` // name => value
+
+	// DeviceMajor and DeviceMinor are the device numbers of a
+	// "char-device" or "block-device".
+	DeviceMajor uint32 `json:"deviceMajor"`
+	DeviceMinor uint32 `json:"deviceMinor"`
+
 	// Parts are references to the data chunks of a regular file (or a "bytes" schema blob).
 	// See doc/schema/bytes.txt and doc/schema/files/file.txt.
 	Parts []*BytesPart `json:"parts"`
 
 	Entries string   `json:"entries"` // for directories, a blobref to a static-set
 	Members []string `json:"members"` // for static sets (for directory static-sets: blobrefs to child dirs/files)
+	// MergeSets are the static-sets whose members a static-set too
+	// big for one blob is made of. See doc/schema/objects/static-set.txt.
+	MergeSets []string `json:"mergeSets"`
 
-	// Target is a "share" blob's target (the thing being shared)
+	// Target is a "share" blob's target (the thing being shared),
+	// the "delegation" blob a "revocation" blob revokes, or the
+	// permanode or claim a "delete" claim deletes.
 	Target *blobref.BlobRef `json:"target"`
 	// Transitive is a property of a "share" blob.
 	Transitive bool `json:"transitive"`
@@ -265,6 +277,13 @@ type Superset struct {
 	// Currently (2013-01-02) just "haveref" (if you know the share's blobref,
 	// you get access: the secret URL model)
 	AuthType string `json:"authType"`
+	// Expires optionally is the RFC 3339 time after which a "share"
+	// blob no longer grants access.
+	Expires string `json:"expires"`
+
+	// Delegate is the blobref of the public key a "delegation"
+	// blob's signer delegates its claims to.
+	Delegate string `json:"delegate"`
 }
 
 func ParseSuperset(r io.Reader) (*Superset, error) {
@@ -290,6 +309,11 @@ type BytesPart struct {
 	// Offset optionally specifies the offset into BlobRef to skip
 	// when reading Size bytes.
 	Offset uint64 `json:"offset,omitempty"`
+
+	// Bytes are the contents of the part itself, for the one part
+	// of a small file, instead of a BlobRef or BytesRef. See
+	// SetInlineThreshold.
+	Bytes []byte `json:"bytes,omitempty"`
 }
 
 // stringFromMixedArray joins a slice of either strings or float64
@@ -341,10 +365,18 @@ func (ss *Superset) FileMode() os.FileMode {
 	var mode os.FileMode
 	m64, err := strconv.ParseUint(ss.UnixPermission, 8, 64)
 	if err == nil {
-		mode = mode | os.FileMode(m64)
+		mode = mode | os.FileMode(m64)&os.ModePerm
+		if m64&unixSetuid != 0 {
+			mode |= os.ModeSetuid
+		}
+		if m64&unixSetgid != 0 {
+			mode |= os.ModeSetgid
+		}
+		if m64&unixSticky != 0 {
+			mode |= os.ModeSticky
+		}
 	}
 
-	// TODO: add other types (block, char, etc)
 	switch ss.Type {
 	case "directory":
 		mode = mode | os.ModeDir
@@ -352,6 +384,14 @@ func (ss *Superset) FileMode() os.FileMode {
 		// No extra bit.
 	case "symlink":
 		mode = mode | os.ModeSymlink
+	case "fifo":
+		mode = mode | os.ModeNamedPipe
+	case "socket":
+		mode = mode | os.ModeSocket
+	case "char-device":
+		mode = mode | os.ModeDevice | os.ModeCharDevice
+	case "block-device":
+		mode = mode | os.ModeDevice
 	}
 	return mode
 }
@@ -464,17 +504,54 @@ func NewHashPlannedPermanode(h hash.Hash) Map {
 
 // Map returns a Camli map of camliType "static-set"
 func (ss *StaticSet) Map() Map {
-	m := newMap(1, "static-set")
 	ss.l.Lock()
 	defer ss.l.Unlock()
+	return staticSetMap("members", ss.refs)
+}
+
+// maxStaticSetMembers is how many members or merged sets a
+// static-set made by Maps has at most.
+var maxStaticSetMembers = 10000
 
-	members := make([]string, 0, len(ss.refs))
-	if ss.refs != nil {
-		for _, ref := range ss.refs {
-			members = append(members, ref.String())
+// Maps returns the Camli maps of the static-set ss. If it has no more
+// than maxStaticSetMembers members, that's just top, as from Map.
+// Otherwise its members are spilled over into subsets, merged by top
+// with "mergeSets", in as many levels as needed.  The subsets must be
+// uploaded too, along with top, whose members they are.
+func (ss *StaticSet) Maps() (top Map, subsets []Map, err error) {
+	ss.l.Lock()
+	refs := append([]*blobref.BlobRef(nil), ss.refs...)
+	ss.l.Unlock()
+
+	field := "members"
+	for len(refs) > maxStaticSetMembers {
+		var setRefs []*blobref.BlobRef
+		for len(refs) > 0 {
+			n := len(refs)
+			if n > maxStaticSetMembers {
+				n = maxStaticSetMembers
+			}
+			m := staticSetMap(field, refs[:n])
+			json, err := m.JSON()
+			if err != nil {
+				return nil, nil, err
+			}
+			subsets = append(subsets, m)
+			setRefs = append(setRefs, blobref.SHA1FromString(json))
+			refs = refs[n:]
 		}
+		refs, field = setRefs, "mergeSets"
+	}
+	return staticSetMap(field, refs), subsets, nil
+}
+
+func staticSetMap(field string, refs []*blobref.BlobRef) Map {
+	m := newMap(1, "static-set")
+	members := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		members = append(members, ref.String())
 	}
-	m["members"] = members
+	m[field] = members
 	return m
 }
 
@@ -524,11 +601,39 @@ func newCommonFilenameMap(fileName string) Map {
 
 var populateSchemaStat []func(schemaMap Map, fi os.FileInfo)
 
+// deviceNumbers returns the major and minor device numbers of the
+// device fi, where the OS-specific files know how. See
+// SetSpecialFile.
+var deviceNumbers func(fi os.FileInfo) (major, minor uint32, ok bool)
+
+// The unix permission bits beyond os.ModePerm.
+const (
+	unixSetuid = 04000
+	unixSetgid = 02000
+	unixSticky = 01000
+)
+
+// unixPermission returns the unix permission bits of mode, including
+// the setuid, setgid and sticky bits.
+func unixPermission(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= unixSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= unixSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= unixSticky
+	}
+	return perm
+}
+
 func NewCommonFileMap(fileName string, fi os.FileInfo) Map {
 	m := newCommonFilenameMap(fileName)
 	// Common elements (from file-common.txt)
 	if fi.Mode()&os.ModeSymlink == 0 {
-		m["unixPermission"] = fmt.Sprintf("0%o", fi.Mode().Perm())
+		m["unixPermission"] = fmt.Sprintf("0%o", unixPermission(fi.Mode()))
 	}
 
 	// OS-specific population; defined in schema_posix.go, etc. (not on App Engine)
@@ -544,8 +649,8 @@ func NewCommonFileMap(fileName string, fi os.FileInfo) Map {
 
 // PopulateParts populates the "parts" field of m with the provided
 // parts.  The sum of the sizes of parts must match the provided size
-// or an error is returned.  Also, each BytesPart may only contain either
-// a BytesPart or a BlobRef, but not both.
+// or an error is returned.  Also, each BytesPart may only contain one
+// of a BytesPart, a BlobRef or inline Bytes.
 func PopulateParts(m Map, size int64, parts []BytesPart) error {
 	sumSize := int64(0)
 	mparts := make([]Map, len(parts))
@@ -555,10 +660,17 @@ func PopulateParts(m Map, size int64, parts []BytesPart) error {
 		switch {
 		case part.BlobRef != nil && part.BytesRef != nil:
 			return errors.New("schema: part contains both BlobRef and BytesRef")
+		case part.Bytes != nil && (part.BlobRef != nil || part.BytesRef != nil):
+			return errors.New("schema: part contains both inline Bytes and a BlobRef or BytesRef")
 		case part.BlobRef != nil:
 			mpart["blobRef"] = part.BlobRef.String()
 		case part.BytesRef != nil:
 			mpart["bytesRef"] = part.BytesRef.String()
+		case part.Bytes != nil:
+			if uint64(len(part.Bytes)) != part.Size {
+				return fmt.Errorf("schema: part of size %d has %d inline bytes", part.Size, len(part.Bytes))
+			}
+			mpart["bytes"] = part.Bytes
 		default:
 			return errors.New("schema: part must contain either a BlobRef or BytesRef")
 		}
@@ -585,6 +697,47 @@ func (m Map) SetSymlinkTarget(target string) {
 	}
 }
 
+// SetSpecialFile sets m to be of the type of the special file fi: a
+// "fifo", "socket", "char-device" or "block-device", with the device
+// numbers of the last two. It returns ErrUnimplemented for other
+// types, and for devices whose numbers are unknown on this OS.
+func (m Map) SetSpecialFile(fi os.FileInfo) error {
+	mode := fi.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		m["camliType"] = "fifo"
+	case mode&os.ModeSocket != 0:
+		m["camliType"] = "socket"
+	case mode&os.ModeDevice != 0:
+		if deviceNumbers == nil {
+			return ErrUnimplemented
+		}
+		major, minor, ok := deviceNumbers(fi)
+		if !ok {
+			return ErrUnimplemented
+		}
+		m["camliType"] = "block-device"
+		if mode&os.ModeCharDevice != 0 {
+			m["camliType"] = "char-device"
+		}
+		m["deviceMajor"] = major
+		m["deviceMinor"] = minor
+	default:
+		return ErrUnimplemented
+	}
+	return nil
+}
+
+// SetUnixXattrs sets the extended attributes of the file, directory
+// or symlink m, by name, if there are any.
+func (m Map) SetUnixXattrs(xattrs map[string][]byte) {
+	if len(xattrs) == 0 {
+		delete(m, "unixXattrs")
+		return
+	}
+	m["unixXattrs"] = xattrs
+}
+
 func newBytes() Map {
 	return newMap(1, "bytes")
 }
@@ -602,10 +755,48 @@ func NewShareRef(authType string, target *blobref.BlobRef, transitive bool) Map
 	return m
 }
 
+// SetShareExpiration sets the time after which the "share" blob m no
+// longer grants access.
+func (m Map) SetShareExpiration(t time.Time) {
+	m["expires"] = RFC3339FromTime(t)
+}
+
+// ShareExpired reports whether ss is a "share" blob with an expiration
+// time not after now. An unparseable expiration time counts as expired.
+func (ss *Superset) ShareExpired(now time.Time) bool {
+	if ss.Expires == "" {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, ss.Expires)
+	return err != nil || !now.Before(t)
+}
+
+// NewDelegation returns a "delegation" blob, not yet signed, by which
+// its signer accepts the claims signed by the key of the public key
+// blob delegate as its own, such as when rotating to a new key.
+func NewDelegation(delegate *blobref.BlobRef) Map {
+	m := newMap(1, "delegation")
+	m["delegate"] = delegate.String()
+	m["claimDate"] = RFC3339FromTime(time.Now())
+	return m
+}
+
+// NewRevocation returns a "revocation" blob, not yet signed, undoing
+// the "delegation" blob delegation, such as for the key of a lost
+// device. Signed by the delegator or the delegate, it drops all the
+// claims of the delegate's key, whenever they were made.
+func NewRevocation(delegation *blobref.BlobRef) Map {
+	m := newMap(1, "revocation")
+	m["target"] = delegation.String()
+	m["claimDate"] = RFC3339FromTime(time.Now())
+	return m
+}
+
 const (
 	SetAttribute = "set-attribute"
 	AddAttribute = "add-attribute"
 	DelAttribute = "del-attribute"
+	DeleteClaim  = "delete"
 )
 
 func newClaim(permaNode *blobref.BlobRef, t time.Time, claimType string) Map {
@@ -637,6 +828,18 @@ func NewDelAttributeClaim(permaNode *blobref.BlobRef, attr string) Map {
 	return m
 }
 
+// NewDeleteClaim returns a "delete" claim, not yet signed, of target,
+// a permanode or a claim. Signed by the owner, it makes the garbage
+// collector remove target, along with a permanode's claims and the
+// blobs only they reference. Deleting a delete claim undoes it.
+func NewDeleteClaim(target *blobref.BlobRef) Map {
+	m := newMap(1, "claim")
+	m["claimType"] = DeleteClaim
+	m["target"] = target.String()
+	m.SetClaimDate(time.Now())
+	return m
+}
+
 // MapFromReader parses a JSON schema map from the provided reader r.
 func MapFromReader(r io.Reader) (Map, error) {
 	m := make(Map)
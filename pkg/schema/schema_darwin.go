@@ -11,6 +11,7 @@ import (
 
 func init() {
 	populateSchemaStat = append(populateSchemaStat, populateSchemaCtime)
+	deviceNumbers = darwinDeviceNumbers
 }
 
 func populateSchemaCtime(m Map, fi os.FileInfo) {
@@ -26,3 +27,13 @@ func populateSchemaCtime(m Map, fi os.FileInfo) {
 		m["unixCtime"] = RFC3339FromTime(ctime)
 	}
 }
+
+// darwinDeviceNumbers decodes st_rdev like the major and minor macros.
+func darwinDeviceNumbers(fi os.FileInfo) (major, minor uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	rdev := uint32(st.Rdev)
+	return rdev >> 24, rdev & 0xffffff, true
+}
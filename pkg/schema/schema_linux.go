@@ -11,6 +11,7 @@ import (
 
 func init() {
 	populateSchemaStat = append(populateSchemaStat, populateSchemaCtime)
+	deviceNumbers = linuxDeviceNumbers
 }
 
 func populateSchemaCtime(m Map, fi os.FileInfo) {
@@ -26,3 +27,15 @@ func populateSchemaCtime(m Map, fi os.FileInfo) {
 		m["unixCtime"] = RFC3339FromTime(ctime)
 	}
 }
+
+// linuxDeviceNumbers decodes st_rdev like glibc's major and minor.
+func linuxDeviceNumbers(fi os.FileInfo) (major, minor uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	rdev := uint64(st.Rdev)
+	major = uint32((rdev>>8)&0xfff | (rdev>>32)&^0xfff)
+	minor = uint32(rdev&0xff | (rdev>>12)&^0xff)
+	return major, minor, true
+}
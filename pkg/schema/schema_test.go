@@ -18,11 +18,14 @@ package schema
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/test"
 	. "camlistore.org/pkg/test/asserts"
 )
 
@@ -69,6 +72,51 @@ func TestSymlink(t *testing.T) {
 	t.Logf("Got json for symlink file: [%s]\n", json)
 }
 
+type fakeFileInfo struct {
+	name string
+	mode os.FileMode
+}
+
+func (fi fakeFileInfo) Name() string       { return fi.name }
+func (fi fakeFileInfo) Size() int64        { return 0 }
+func (fi fakeFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fakeFileInfo) ModTime() time.Time { return time.Unix(1376000000, 0) }
+func (fi fakeFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fakeFileInfo) Sys() interface{}   { return nil }
+
+func TestFileMetaRoundTrip(t *testing.T) {
+	mode := os.ModeDir | os.ModeSetgid | os.ModeSticky | 0775
+	m := NewCommonFileMap("shared", fakeFileInfo{"shared", mode})
+	m["camliType"] = "directory"
+	if g, w := m["unixPermission"], "03775"; g != w {
+		t.Errorf("unixPermission = %v; want %v", g, w)
+	}
+	xattrs := map[string][]byte{"user.comment": []byte("hi"), "user.bin": {0, 255}}
+	m.SetUnixXattrs(xattrs)
+	json, err := m.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := ParseSuperset(strings.NewReader(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := ss.FileMode(); g != mode {
+		t.Errorf("FileMode = %v; want %v", g, mode)
+	}
+	if len(ss.UnixXattrs) != len(xattrs) {
+		t.Fatalf("got xattrs %v; want %v", ss.UnixXattrs, xattrs)
+	}
+	for name, v := range xattrs {
+		if g := string(ss.UnixXattrs[name]); g != string(v) {
+			t.Errorf("xattr %q = %q; want %q", name, g, v)
+		}
+	}
+	if g, w := ss.ModTime(), time.Unix(1376000000, 0); !g.Equal(w) {
+		t.Errorf("ModTime = %v; want %v", g, w)
+	}
+}
+
 type mixPartsTest struct {
 	json, expected string
 }
@@ -109,3 +157,122 @@ func TestRFC3339(t *testing.T) {
 		}
 	}
 }
+
+func TestShareExpired(t *testing.T) {
+	now := time.Unix(1360000000, 0)
+	m := NewShareRef(ShareHaveRef, blobref.MustParse("foo-abc"), false)
+	ss := &Superset{}
+	if ss.ShareExpired(now) {
+		t.Errorf("share without expiration is expired")
+	}
+	m.SetShareExpiration(now.Add(time.Hour))
+	ss.Expires = m["expires"].(string)
+	if ss.ShareExpired(now) {
+		t.Errorf("share expiring at %s is expired at %s", ss.Expires, now)
+	}
+	if !ss.ShareExpired(now.Add(time.Hour)) {
+		t.Errorf("share expiring at %s isn't expired at its expiration time", ss.Expires)
+	}
+	ss.Expires = "garbage"
+	if !ss.ShareExpired(now) {
+		t.Errorf("share with unparseable expiration isn't expired")
+	}
+}
+
+func TestStaticSetMaps(t *testing.T) {
+	defer func(n int) { maxStaticSetMembers = n }(maxStaticSetMembers)
+	maxStaticSetMembers = 3
+	for _, n := range []int{0, 3, 4, 9, 10, 30} {
+		ss := new(StaticSet)
+		var want []string
+		for i := 0; i < n; i++ {
+			br := blobref.SHA1FromString(fmt.Sprint(i))
+			ss.Add(br)
+			want = append(want, br.String())
+		}
+		top, subsets, err := ss.Maps()
+		if err != nil {
+			t.Fatalf("%d members: %v", n, err)
+		}
+		fetcher := &test.Fetcher{}
+		for _, m := range append(subsets, top) {
+			json, err := m.JSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fetcher.AddBlob(&test.Blob{Contents: json})
+		}
+		if n <= maxStaticSetMembers && len(subsets) != 0 {
+			t.Errorf("%d members: got %d subsets; want none", n, len(subsets))
+		}
+		json, _ := top.JSON()
+		topss, err := ParseSuperset(strings.NewReader(json))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(topss.Members)+len(topss.MergeSets) > maxStaticSetMembers {
+			t.Errorf("%d members: top has %d members and %d merged sets", n, len(topss.Members), len(topss.MergeSets))
+		}
+		members, err := topss.StaticSetMembers(fetcher)
+		if err != nil {
+			t.Fatalf("%d members: StaticSetMembers: %v", n, err)
+		}
+		var got []string
+		for _, br := range members {
+			got = append(got, br.String())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%d members: got members %v; want %v", n, got, want)
+		}
+	}
+}
+
+type specialFileInfo struct {
+	os.FileInfo // nil; only Mode and Sys are called
+	mode        os.FileMode
+}
+
+func (fi specialFileInfo) Mode() os.FileMode { return fi.mode }
+func (fi specialFileInfo) Sys() interface{}  { return nil }
+
+func TestSetSpecialFile(t *testing.T) {
+	tests := []struct {
+		mode os.FileMode
+		typ  string
+	}{
+		{os.ModeNamedPipe | 0640, "fifo"},
+		{os.ModeSocket | 0755, "socket"},
+		{os.ModeDevice | 0600, ""}, // no device numbers
+		{0644, ""},
+	}
+	for _, tt := range tests {
+		m := newMap(1, "file")
+		err := m.SetSpecialFile(specialFileInfo{mode: tt.mode})
+		if tt.typ == "" {
+			if err != ErrUnimplemented {
+				t.Errorf("mode %v: SetSpecialFile = %v; want ErrUnimplemented", tt.mode, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("mode %v: SetSpecialFile = %v", tt.mode, err)
+			continue
+		}
+		if m.Type() != tt.typ {
+			t.Errorf("mode %v: camliType %q; want %q", tt.mode, m.Type(), tt.typ)
+		}
+		ss := &Superset{Type: m.Type(), UnixPermission: fmt.Sprintf("0%o", tt.mode.Perm())}
+		if got := ss.FileMode(); got != tt.mode {
+			t.Errorf("mode %v: FileMode of the %s = %v", tt.mode, tt.typ, got)
+		}
+	}
+	for _, typ := range []string{"char-device", "block-device"} {
+		want := os.ModeDevice
+		if typ == "char-device" {
+			want |= os.ModeCharDevice
+		}
+		if got := (&Superset{Type: typ}).FileMode(); got != want {
+			t.Errorf("FileMode of a %s = %v; want %v", typ, got, want)
+		}
+	}
+}
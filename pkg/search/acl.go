@@ -0,0 +1,283 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+)
+
+// ACLAttr is the attribute of the permanodes granting users access to
+// themselves and to everything they lead to: a value of "read:user"
+// lets the ACL user user read them, and "write:user" also lets it
+// change the permanodes with claims.
+const ACLAttr = "camliACL"
+
+const (
+	// aclCacheTime is how long the blobs granted to a user are
+	// used before being looked up again, so changes of the grants
+	// and of the subtrees take up to that long to apply.
+	aclCacheTime = 30 * time.Second
+
+	// maxACLBlobs limits the blobs granted to a user.
+	maxACLBlobs = 100000
+)
+
+// An ACL is the auth.ACLChecker of the ACLAttr grants signed by the
+// owner of a search handler. A grant covers the permanode carrying
+// it and, recursively, its camliContent, camliMember and camliPath:
+// targets. With a blob source, it also covers the chunks of the files
+// and the contents of the directories it reaches.
+type ACL struct {
+	sh      *Handler
+	fetcher blobref.StreamingFetcher // or nil
+
+	mu      sync.Mutex
+	users   map[string]*aclGrants
+	created map[string]map[string]bool // user => permanodes it created
+}
+
+type aclGrants struct {
+	blobs   map[string]auth.Operation // blobref => OpGet, or with OpSign for writes
+	expires time.Time
+}
+
+// NewACL returns the ACL of sh's grants. fetcher, if not nil, is
+// the blob source to read file and directory schemas from.
+func NewACL(sh *Handler, fetcher blobref.StreamingFetcher) *ACL {
+	return &ACL{
+		sh:      sh,
+		fetcher: fetcher,
+		users:   make(map[string]*aclGrants),
+		created: make(map[string]map[string]bool),
+	}
+}
+
+func (a *ACL) ACLAllows(user string, br *blobref.BlobRef, op auth.Operation) bool {
+	a.mu.Lock()
+	created := a.created[user][br.String()]
+	a.mu.Unlock()
+	return created || a.grants(user)[br.String()]&op == op
+}
+
+// ACLCreated lets user read and write br. It's only remembered until
+// the server restarts: by then, user should have linked br to a
+// permanode it's granted.
+func (a *ACL) ACLCreated(user string, br *blobref.BlobRef) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.created[user] == nil {
+		a.created[user] = make(map[string]bool)
+	}
+	a.created[user][br.String()] = true
+}
+
+// ACLMayLink allows linking the blobs user may read, and the blobs
+// other than permanodes: it's the random permanodes that would reveal
+// what user isn't granted, while linking other blobs, such as the
+// files user uploaded, takes knowing their contents.
+func (a *ACL) ACLMayLink(user string, br *blobref.BlobRef) bool {
+	if a.ACLAllows(user, br, auth.OpGet) {
+		return true
+	}
+	mime, _, err := a.sh.index.GetBlobMimeType(br)
+	if err == os.ErrNotExist {
+		return true
+	}
+	return err == nil && mime != camliTypePrefix+"permanode"
+}
+
+func (a *ACL) grants(user string) map[string]auth.Operation {
+	now := time.Now()
+	a.mu.Lock()
+	g := a.users[user]
+	a.mu.Unlock()
+	if g != nil && now.Before(g.expires) {
+		return g.blobs
+	}
+
+	blobs := make(map[string]auth.Operation)
+	for _, grant := range []struct {
+		kind string
+		op   auth.Operation
+	}{
+		{"read", auth.OpGet},
+		{"write", auth.OpGet | auth.OpSign},
+	} {
+		roots, err := a.grantRoots(grant.kind + ":" + user)
+		if err != nil {
+			log.Printf("search: looking up the %s grants of %q: %v", grant.kind, user, err)
+			continue
+		}
+		for _, root := range roots {
+			a.walk(blobs, root, grant.op)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users[user] = &aclGrants{blobs: blobs, expires: now.Add(aclCacheTime)}
+	return blobs
+}
+
+// grantRoots returns the permanodes whose ACLAttr currently has the
+// value grant.
+func (a *ACL) grantRoots(grant string) ([]*blobref.BlobRef, error) {
+	ch := make(chan *blobref.BlobRef, buffered)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- a.sh.index.SearchPermanodesWithAttr(ch, &PermanodeByAttrRequest{
+			Signer:    a.sh.owner,
+			Attribute: ACLAttr,
+			Query:     grant,
+		})
+	}()
+	var candidates []*blobref.BlobRef
+	for pn := range ch {
+		candidates = append(candidates, pn)
+	}
+	if err := <-errch; err != nil {
+		return nil, err
+	}
+	// The index keeps the values an attribute ever had.
+	var roots []*blobref.BlobRef
+	for _, pn := range candidates {
+		attr, err := a.attributes(pn)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range attr[ACLAttr] {
+			if v == grant {
+				roots = append(roots, pn)
+				break
+			}
+		}
+	}
+	return roots, nil
+}
+
+// attributes returns the current attributes of the permanode pn.
+func (a *ACL) attributes(pn *blobref.BlobRef) (url.Values, error) {
+	claims, err := a.sh.index.GetOwnerClaims(pn, a.sh.owner)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(claims)
+	attr := make(url.Values)
+	for _, cl := range claims {
+		applyClaim(attr, cl)
+	}
+	return attr, nil
+}
+
+// walk adds op to blobs for root and the blobs it leads to.
+func (a *ACL) walk(blobs map[string]auth.Operation, root *blobref.BlobRef, op auth.Operation) {
+	pending := []*blobref.BlobRef{root}
+	for len(pending) > 0 {
+		br := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if blobs[br.String()]&op == op {
+			continue
+		}
+		if len(blobs) >= maxACLBlobs {
+			log.Printf("search: ACL grant of %s covers more than %d blobs; ignoring the rest", root, maxACLBlobs)
+			return
+		}
+		blobs[br.String()] |= op
+		children, err := a.children(br)
+		if err != nil {
+			log.Printf("search: following ACL grant of %s to %s: %v", root, br, err)
+			continue
+		}
+		pending = append(pending, children...)
+	}
+}
+
+// children returns the blobs br leads to.
+func (a *ACL) children(br *blobref.BlobRef) ([]*blobref.BlobRef, error) {
+	mime, _, err := a.sh.index.GetBlobMimeType(br)
+	if err == os.ErrNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var kids []*blobref.BlobRef
+	add := func(s string) {
+		if ref := blobref.Parse(s); ref != nil {
+			kids = append(kids, ref)
+		}
+	}
+	switch strings.TrimPrefix(mime, camliTypePrefix) {
+	case "permanode":
+		attr, err := a.attributes(br)
+		if err != nil {
+			return nil, err
+		}
+		if content := attr["camliContent"]; len(content) > 0 {
+			add(content[len(content)-1])
+		}
+		for k, vv := range attr {
+			if k == "camliMember" || strings.HasPrefix(k, "camliPath:") {
+				for _, v := range vv {
+					add(v)
+				}
+			}
+		}
+	case "file", "bytes", "directory", "static-set":
+		if a.fetcher == nil {
+			return nil, nil
+		}
+		rc, _, err := a.fetcher.FetchStreaming(br)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		// Only the fields of schema.Superset leading to other
+		// blobs; the schema package's tests depend on this one.
+		var ss struct {
+			Parts []struct {
+				BlobRef  string `json:"blobRef"`
+				BytesRef string `json:"bytesRef"`
+			} `json:"parts"`
+			Entries   string   `json:"entries"`
+			Members   []string `json:"members"`
+			MergeSets []string `json:"mergeSets"`
+		}
+		if err := json.NewDecoder(io.LimitReader(rc, 1<<20)).Decode(&ss); err != nil {
+			return nil, err
+		}
+		for _, part := range ss.Parts {
+			add(part.BlobRef)
+			add(part.BytesRef)
+		}
+		add(ss.Entries)
+		for _, m := range append(ss.Members, ss.MergeSets...) {
+			add(m)
+		}
+	}
+	return kids, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search_test
+
+import (
+	. "camlistore.org/pkg/search"
+
+	"testing"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/index/indextest"
+)
+
+func TestACL(t *testing.T) {
+	idx := index.NewMemoryIndex()
+	id := indextest.NewIndexDeps(idx)
+	id.Fataler = t
+
+	root := id.NewPermanode()
+	id.SetAttribute(root, ACLAttr, "read:alice")
+	child := id.NewPermanode()
+	id.AddAttribute(root, "camliMember", child.String())
+	fileRef, wholeRef := id.UploadFile("foo.txt", "some file contents")
+	id.SetAttribute(child, "camliContent", fileRef.String())
+
+	writable := id.NewPermanode()
+	id.SetAttribute(writable, ACLAttr, "write:alice")
+	revoked := id.NewPermanode()
+	id.SetAttribute(revoked, ACLAttr, "read:alice")
+	id.DelAttribute(revoked, ACLAttr)
+	other := id.NewPermanode()
+
+	acl := NewACL(NewHandler(idx, id.SignerBlobRef), id.BlobSource)
+	tests := []struct {
+		user string
+		br   *blobref.BlobRef
+		op   auth.Operation
+		want bool
+	}{
+		{"alice", root, auth.OpGet, true},
+		{"alice", child, auth.OpGet, true},
+		{"alice", fileRef, auth.OpGet, true},
+		{"alice", wholeRef, auth.OpGet, true},
+		{"alice", child, auth.OpSign, false},
+		{"alice", writable, auth.OpSign, true},
+		{"alice", revoked, auth.OpGet, false},
+		{"alice", other, auth.OpGet, false},
+		{"bob", root, auth.OpGet, false},
+	}
+	for _, tt := range tests {
+		if got := acl.ACLAllows(tt.user, tt.br, tt.op); got != tt.want {
+			t.Errorf("ACLAllows(%q, %s, %v) = %v; want %v", tt.user, tt.br, tt.op, got, tt.want)
+		}
+	}
+
+	if acl.ACLMayLink("alice", other) {
+		t.Errorf("alice may link another permanode")
+	}
+	if !acl.ACLMayLink("bob", wholeRef) {
+		t.Errorf("bob may not link a file's contents")
+	}
+	acl.ACLCreated("alice", other)
+	if !acl.ACLAllows("alice", other, auth.OpSign) {
+		t.Errorf("alice may not write the permanode it created")
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/httputil"
+)
+
+const (
+	defaultCalendarLimit = 5000
+	maxCalendarLimit     = 50000
+	maxCalendarSamples   = 20
+
+	// maxCalendarDateSamples is the maximum number of samples of
+	// the buckets of a requested date, such as to list all of a
+	// day's permanodes.
+	maxCalendarDateSamples = 1000
+)
+
+// calendarLayouts are the date layouts of the calendar granularities.
+var calendarLayouts = map[string]string{
+	"day":   "2006-01-02",
+	"month": "2006-01",
+	"year":  "2006",
+}
+
+// A calendarBucket is the permanodes of one day, month or year.
+type calendarBucket struct {
+	date    string
+	count   int
+	samples []*blobref.BlobRef
+}
+
+// calendarBuckets groups permanodes by date, in the given layout,
+// keeping the first maxSamples of each.
+type calendarBuckets struct {
+	layout     string
+	maxSamples int
+	m          map[string]*calendarBucket
+}
+
+func (cb *calendarBuckets) add(pn *blobref.BlobRef, t time.Time) {
+	date := t.UTC().Format(cb.layout)
+	b, ok := cb.m[date]
+	if !ok {
+		b = &calendarBucket{date: date}
+		cb.m[date] = b
+	}
+	b.count++
+	if len(b.samples) < cb.maxSamples {
+		b.samples = append(b.samples, pn)
+	}
+}
+
+// sorted returns the buckets, most recent first.
+func (cb *calendarBuckets) sorted() []*calendarBucket {
+	var s []*calendarBucket
+	for _, b := range cb.m {
+		s = append(s, b)
+	}
+	sort.Sort(bucketsByDateDesc(s))
+	return s
+}
+
+type bucketsByDateDesc []*calendarBucket
+
+func (s bucketsByDateDesc) Len() int           { return len(s) }
+func (s bucketsByDateDesc) Less(i, j int) bool { return s[i].date > s[j].date }
+func (s bucketsByDateDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// serveCalendar counts the owner's most recent permanodes per day,
+// month or year, for browsing by date. A permanode's date is its
+// camliDate attribute, or when its camliContent image was taken, per
+// its EXIF metadata, or else its last modification.
+//
+// Optional parameters are "granularity" ("day", "month", the default,
+// or "year"), "samples", the number of permanodes of each date
+// to list and describe (default 3), "limit", the number of recent
+// permanodes to look at, and "date", a date prefix like "2011" or
+// "2011-07" that the listed dates must have. With "date", samples may
+// be up to 1000. With "sort" set to "modtime", the permanodes looked
+// at are the most recently modified rather than the most recent by
+// date, and camliDate is ignored.
+func (sh *Handler) serveCalendar(rw http.ResponseWriter, req *http.Request) {
+	version := apiVersion(req)
+	ret := newResponse(version)
+	defer httputil.ReturnJSON(rw, ret)
+
+	granularity := req.FormValue("granularity")
+	if granularity == "" {
+		granularity = "month"
+	}
+	layout, ok := calendarLayouts[granularity]
+	if !ok {
+		ret["error"] = "Invalid 'granularity' param; want day, month or year"
+		ret["errorType"] = "input"
+		return
+	}
+	date := req.FormValue("date")
+	maxSamples := maxCalendarSamples
+	if date != "" {
+		maxSamples = maxCalendarDateSamples
+	}
+	samples := 3
+	if v := req.FormValue("samples"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxSamples {
+			ret["error"] = "Invalid 'samples' param"
+			ret["errorType"] = "input"
+			return
+		}
+		samples = n
+	}
+	limit := defaultCalendarLimit
+	if v := req.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			ret["error"] = "Invalid 'limit' param"
+			ret["errorType"] = "input"
+			return
+		}
+		if n < maxCalendarLimit {
+			limit = n
+		} else {
+			limit = maxCalendarLimit
+		}
+	}
+
+	sortBy := req.FormValue("sort")
+	if sortBy == "" {
+		sortBy = "date"
+	}
+	getRecent, ok := sh.recentSource(sortBy)
+	if !ok {
+		ret["error"] = "Invalid 'sort' param; want date or modtime"
+		ret["errorType"] = "input"
+		return
+	}
+
+	ch := make(chan *Result)
+	errch := make(chan error)
+	go func() {
+		errch <- getRecent(ch, sh.owner, limit)
+	}()
+	var recent []*Result
+	scan := sh.NewDescribeRequest()
+	for res := range ch {
+		scan.Describe(res.BlobRef, 1)
+		recent = append(recent, res)
+	}
+	if err := <-errch; err != nil {
+		ret["error"] = err.Error()
+		ret["errorType"] = "server"
+		return
+	}
+	des, err := scan.Result()
+	if err != nil {
+		ret["error"] = err.Error()
+		ret["errorType"] = "server"
+		return
+	}
+
+	cb := &calendarBuckets{layout: layout, maxSamples: samples, m: make(map[string]*calendarBucket)}
+	for _, res := range recent {
+		var t time.Time
+		if sortBy == "date" {
+			// Already the EXIF time, if any.
+			t = time.Unix(res.Date, 0)
+		} else {
+			t = time.Unix(res.LastModTime, 0)
+			if cref, ok := des[res.BlobRef.String()].ContentRef(); ok {
+				if et, err := sh.index.GetFileTime(cref); err == nil {
+					t = et
+				}
+			}
+		}
+		if strings.HasPrefix(t.UTC().Format(layout), date) {
+			cb.add(res.BlobRef, t)
+		}
+	}
+
+	dr := sh.NewDescribeRequest()
+	buckets := jsonMapList()
+	for _, b := range cb.sorted() {
+		jm := jsonMap()
+		jm["date"] = b.date
+		jm["count"] = b.count
+		refs := make([]string, 0, len(b.samples))
+		for _, br := range b.samples {
+			dr.Describe(br, 2)
+			refs = append(refs, br.String())
+		}
+		jm["samples"] = refs
+		buckets = append(buckets, jm)
+	}
+	ret["granularity"] = granularity
+	ret["calendar"] = buckets
+	ret["total"] = len(recent)
+	ret["truncated"] = len(recent) == limit
+
+	thumbSize := 0
+	if req.FormValue("thumbnails") != "" {
+		thumbSize = 50
+		if i, _ := strconv.Atoi(req.FormValue("thumbnails")); i >= 25 && i < 800 {
+			thumbSize = i
+		}
+	}
+	dr.populateResponse(ret, version, thumbSize)
+}
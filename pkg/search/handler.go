@@ -29,6 +29,7 @@ import (
 	"sync"
 	"time"
 
+	"camlistore.org/pkg/auth"
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/httputil"
@@ -54,6 +55,7 @@ func NewHandler(index Index, owner *blobref.BlobRef) *Handler {
 func newHandlerFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
 	indexPrefix := conf.RequiredString("index") // TODO: add optional help tips here?
 	ownerBlobStr := conf.RequiredString("owner")
+	blobRoot := conf.OptionalString("blobRoot", "")
 	devBlockStartupPrefix := conf.OptionalString("devBlockStartupOn", "")
 	if err := conf.Validate(); err != nil {
 		return nil, err
@@ -79,10 +81,18 @@ func newHandlerFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handl
 		return nil, fmt.Errorf("search 'owner' has malformed blobref %q; expecting e.g. sha1-xxxxxxxxxxxx",
 			ownerBlobStr)
 	}
-	return &Handler{
+	h := &Handler{
 		index: indexer,
 		owner: ownerBlobRef,
-	}, nil
+	}
+	var fetcher blobref.StreamingFetcher
+	if blobRoot != "" {
+		if fetcher, err = ld.GetStorage(blobRoot); err != nil {
+			return nil, fmt.Errorf("search handler's blobRoot of %q error: %v", blobRoot, err)
+		}
+	}
+	auth.SetACLChecker(NewACL(h, fetcher))
+	return h, nil
 }
 
 // TODO: figure out a plan for an owner having multiple active public keys, or public
@@ -104,10 +114,32 @@ func jsonMapList() []map[string]interface{} {
 }
 
 func (sh *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	ret := jsonMap()
 	_ = req.Header.Get("X-PrefixHandler-PathBase")
 	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
 
+	version, err := parseAPIVersion(req)
+	if err != nil {
+		ret := jsonMap()
+		ret["error"] = err.Error()
+		ret["errorType"] = "input"
+		httputil.ReturnJSON(rw, ret)
+		return
+	}
+	ret := newResponse(version)
+
+	if _, ok := auth.ACLUser(req); ok {
+		// ACL users only get the describe results of the
+		// blobs they're granted.
+		switch suffix {
+		case "camli/search/recent", "camli/search/permanodeattr", "camli/search/describe":
+		default:
+			ret["error"] = "Forbidden search path"
+			ret["errorType"] = "input"
+			httputil.ReturnJSON(rw, ret)
+			return
+		}
+	}
+
 	if req.Method == "GET" {
 		switch suffix {
 		case "camli/search/recent":
@@ -134,6 +166,15 @@ func (sh *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		case "camli/search/edgesto":
 			sh.serveEdgesTo(rw, req)
 			return
+		case "camli/search/history":
+			sh.servePermanodeHistory(rw, req)
+			return
+		case "camli/search/versions":
+			sh.serveContentVersions(rw, req)
+			return
+		case "camli/search/calendar":
+			sh.serveCalendar(rw, req)
+			return
 		}
 	}
 
@@ -143,36 +184,79 @@ func (sh *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	httputil.ReturnJSON(rw, ret)
 }
 
+// recentSource returns the index method listing the owner's permanodes
+// in the order of sortBy: "modtime", the default, for the most recently
+// modified first, or "date", for the most recent camliDate or photo
+// first.
+func (sh *Handler) recentSource(sortBy string) (func(dest chan *Result, owner *blobref.BlobRef, limit int) error, bool) {
+	switch sortBy {
+	case "", "modtime":
+		return sh.index.GetRecentPermanodes, true
+	case "date":
+		return sh.index.GetDatedPermanodes, true
+	}
+	return nil, false
+}
+
 func (sh *Handler) serveRecentPermanodes(rw http.ResponseWriter, req *http.Request) {
-	ret := jsonMap()
+	version := apiVersion(req)
+	ret := newResponse(version)
 	defer httputil.ReturnJSON(rw, ret)
 
+	imc, err := imageConstraintFromRequest(req)
+	if err != nil {
+		ret["error"] = err.Error()
+		ret["errorType"] = "input"
+		return
+	}
+	sortBy := req.FormValue("sort")
+	getRecent, ok := sh.recentSource(sortBy)
+	if !ok {
+		ret["error"] = "Invalid 'sort' param; want modtime or date"
+		ret["errorType"] = "input"
+		return
+	}
+
 	ch := make(chan *Result)
 	errch := make(chan error)
 	go func() {
-		errch <- sh.index.GetRecentPermanodes(ch, sh.owner, 50)
+		errch <- getRecent(ch, sh.owner, 50)
 	}()
 
-	dr := sh.NewDescribeRequest()
+	dr := sh.newDescribeRequestFor(req)
 
 	recent := jsonMapList()
 	for res := range ch {
+		if !dr.allowed(res.BlobRef) {
+			continue
+		}
 		dr.Describe(res.BlobRef, 2)
 		jm := jsonMap()
 		jm["blobref"] = res.BlobRef.String()
 		jm["owner"] = res.Signer.String()
 		t := time.Unix(res.LastModTime, 0).UTC()
 		jm["modtime"] = t.Format(time.RFC3339)
+		if sortBy == "date" {
+			jm["date"] = time.Unix(res.Date, 0).UTC().Format(time.RFC3339)
+		}
 		recent = append(recent, jm)
 	}
 
-	err := <-errch
+	err = <-errch
 	if err != nil {
 		// TODO: return error status code
 		ret["error"] = err.Error()
+		if version >= 2 {
+			ret["errorType"] = "server"
+		}
 		return
 	}
 
+	if imc != nil {
+		// TODO: the index limit applies before filtering, so
+		// fewer than 50 results may be returned.
+		recent = dr.filterImages(recent, "blobref", imc)
+	}
 	ret["recent"] = recent
 
 	thumbSize := 0
@@ -182,7 +266,7 @@ func (sh *Handler) serveRecentPermanodes(rw http.ResponseWriter, req *http.Reque
 			thumbSize = i
 		}
 	}
-	dr.populateJSONThumbnails(ret, thumbSize)
+	dr.populateResponse(ret, version, thumbSize)
 }
 
 // servePermanodesWithAttr uses the indexer to search for the permanodes matching
@@ -190,7 +274,8 @@ func (sh *Handler) serveRecentPermanodes(rw http.ResponseWriter, req *http.Reque
 // The valid values for the "attr" key in the request (i.e the only attributes
 // for a permanode which are actually indexed as such) are "tag" and "title".
 func (sh *Handler) servePermanodesWithAttr(rw http.ResponseWriter, req *http.Request) {
-	ret := jsonMap()
+	version := apiVersion(req)
+	ret := newResponse(version)
 	defer httputil.ReturnJSON(rw, ret)
 	defer setPanicError(ret)
 
@@ -208,6 +293,12 @@ func (sh *Handler) servePermanodesWithAttr(rw http.ResponseWriter, req *http.Req
 	if attr == "" {               // and force fuzzy in that case.
 		fuzzyMatch = true
 	}
+	imc, err := imageConstraintFromRequest(req)
+	if err != nil {
+		ret["error"] = err.Error()
+		ret["errorType"] = "input"
+		return
+	}
 	maxResults := maxPermanodes
 	max := req.FormValue("max")
 	if max != "" {
@@ -232,33 +323,46 @@ func (sh *Handler) servePermanodesWithAttr(rw http.ResponseWriter, req *http.Req
 				MaxResults: maxResults})
 	}()
 
-	dr := sh.NewDescribeRequest()
+	dr := sh.newDescribeRequestFor(req)
 
 	withAttr := jsonMapList()
 	for res := range ch {
+		if !dr.allowed(res) {
+			continue
+		}
 		dr.Describe(res, 2)
 		jm := jsonMap()
 		jm["permanode"] = res.String()
 		withAttr = append(withAttr, jm)
 	}
 
-	err := <-errch
+	err = <-errch
 	if err != nil {
 		ret["error"] = err.Error()
 		ret["errorType"] = "server"
 		return
 	}
 
+	if imc != nil {
+		withAttr = dr.filterImages(withAttr, "permanode", imc)
+	}
 	ret["withAttr"] = withAttr
-	dr.PopulateJSON(ret)
+	dr.populateResponse(ret, version, 0)
 }
 
 func (sh *Handler) serveClaims(rw http.ResponseWriter, req *http.Request) {
-	ret := jsonMap()
+	version := apiVersion(req)
+	ret := newResponse(version)
 
 	pn := blobref.Parse(req.FormValue("permanode"))
 	if pn == nil {
-		http.Error(rw, "Missing or invalid 'permanode' param", 400)
+		if version < 2 {
+			http.Error(rw, "Missing or invalid 'permanode' param", 400)
+			return
+		}
+		ret["error"] = "Missing or invalid 'permanode' param"
+		ret["errorType"] = "input"
+		httputil.ReturnJSON(rw, ret)
 		return
 	}
 
@@ -266,6 +370,10 @@ func (sh *Handler) serveClaims(rw http.ResponseWriter, req *http.Request) {
 	claims, err := sh.index.GetOwnerClaims(pn, sh.owner)
 	if err != nil {
 		log.Printf("Error getting claims of %s: %v", pn.String(), err)
+		if version >= 2 {
+			ret["error"] = err.Error()
+			ret["errorType"] = "server"
+		}
 	} else {
 		sort.Sort(claims)
 		jclaims := jsonMapList()
@@ -295,6 +403,10 @@ func (sh *Handler) serveClaims(rw http.ResponseWriter, req *http.Request) {
 type DescribeRequest struct {
 	sh *Handler
 
+	// req, if not nil, is the request of an ACL user, whose
+	// results are limited to the blobs it's granted.
+	req *http.Request
+
 	mu   sync.Mutex // protects following:
 	m    map[string]*DescribedBlob
 	done map[string]bool  // blobref -> described
@@ -318,6 +430,9 @@ type DescribedBlob struct {
 	// if camliType "file"
 	File *FileInfo
 
+	// if camliType "file" and the file is an image
+	Image *ImageInfo
+
 	Stub bool // if not loaded, but referenced
 }
 
@@ -483,12 +598,13 @@ func (b *DescribedBlob) thumbnail(thumbSize int) (path string, width, height int
 			if peer.File.IsImage() {
 				image := fmt.Sprintf("thumbnail/%s/%s?mw=%d&mh=%d", peer.BlobRef,
 					url.QueryEscape(peer.File.FileName), thumbSize, thumbSize)
-				// TODO: return the correct thumbSizes here,
-				// once we know from the indexer the
-				// dimensions (after correction for exif
-				// orientation).  For now the thumbnails will
-				// all be stretched fat squares.
-				return image, thumbSize, thumbSize, true
+				// TODO: the indexed dimensions aren't yet
+				// corrected for EXIF orientation.
+				width, height = thumbSize, thumbSize
+				if ii := peer.Image; ii != nil && ii.Width > 0 && ii.Height > 0 {
+					width, height = scaleToFit(ii.Width, ii.Height, thumbSize)
+				}
+				return image, width, height, true
 			}
 
 			// TODO: different thumbnails based on peer.File.MimeType.
@@ -499,6 +615,27 @@ func (b *DescribedBlob) thumbnail(thumbSize int) (path string, width, height int
 	return "node.png", thumbSize, thumbSize, true
 }
 
+// scaleToFit returns the dimensions of a width x height image
+// shrunk to fit in a max x max box, preserving its aspect ratio.
+// Images already smaller than the box are returned as is.
+func scaleToFit(width, height, max int) (int, int) {
+	if width <= max && height <= max {
+		return width, height
+	}
+	if width > height {
+		h := height * max / width
+		if h < 1 {
+			h = 1
+		}
+		return max, h
+	}
+	w := width * max / height
+	if w < 1 {
+		w = 1
+	}
+	return w, max
+}
+
 func (b *DescribedBlob) jsonMap() map[string]interface{} {
 	m := jsonMap()
 	m["blobRef"] = b.BlobRef.String()
@@ -515,6 +652,9 @@ func (b *DescribedBlob) jsonMap() map[string]interface{} {
 	if b.File != nil {
 		m["file"] = b.File
 	}
+	if b.Image != nil {
+		m["image"] = b.Image
+	}
 	return m
 }
 
@@ -549,6 +689,21 @@ func (sh *Handler) NewDescribeRequest() *DescribeRequest {
 	}
 }
 
+// newDescribeRequestFor returns a new DescribeRequest for the results
+// to send in response to req.
+func (sh *Handler) newDescribeRequestFor(req *http.Request) *DescribeRequest {
+	dr := sh.NewDescribeRequest()
+	if _, ok := auth.ACLUser(req); ok {
+		dr.req = req
+	}
+	return dr
+}
+
+// allowed reports whether br may be described to the request of dr.
+func (dr *DescribeRequest) allowed(br *blobref.BlobRef) bool {
+	return dr.req == nil || auth.AllowedBlob(dr.req, br, auth.OpGet)
+}
+
 // Given a blobref and a few hex characters of the digest of the next hop, return the complete
 // blobref of the prefix, if that's a valid next hop.
 func (sh *Handler) ResolvePrefixHop(parent *blobref.BlobRef, prefix string) (child *blobref.BlobRef, err error) {
@@ -634,6 +789,21 @@ func (dr *DescribeRequest) populateJSONThumbnails(dest map[string]interface{}, t
 	}
 }
 
+// filterImages waits for dr to finish loading and returns the
+// elements of results whose permanode (the blobref string at key
+// refKey) has image content satisfying imc.
+func (dr *DescribeRequest) filterImages(results []map[string]interface{}, refKey string, imc *ImageConstraint) []map[string]interface{} {
+	dr.wg.Wait()
+	filtered := jsonMapList()
+	for _, jm := range results {
+		ref, _ := jm[refKey].(string)
+		if des := dr.DescribedBlobStr(ref); des != nil && imc.matchDescribed(des) {
+			filtered = append(filtered, jm)
+		}
+	}
+	return filtered
+}
+
 func (dr *DescribeRequest) describedBlob(b *blobref.BlobRef) *DescribedBlob {
 	dr.mu.Lock()
 	defer dr.mu.Unlock()
@@ -656,7 +826,7 @@ func (dr *DescribeRequest) DescribeSync(br *blobref.BlobRef) (*DescribedBlob, er
 }
 
 func (dr *DescribeRequest) Describe(br *blobref.BlobRef, depth int) {
-	if depth <= 0 {
+	if depth <= 0 || !dr.allowed(br) {
 		return
 	}
 	dr.mu.Lock()
@@ -711,12 +881,20 @@ func (dr *DescribeRequest) describeReally(br *blobref.BlobRef, depth int) {
 		des.File, err = dr.sh.index.GetFileInfo(br)
 		if err != nil {
 			dr.addError(br, err)
+			return
+		}
+		if des.File.IsImage() {
+			des.Image, err = dr.sh.index.GetImageInfo(br)
+			if err != nil && err != os.ErrNotExist {
+				dr.addError(br, err)
+			}
 		}
 	}
 }
 
 func (sh *Handler) serveDescribe(rw http.ResponseWriter, req *http.Request) {
-	ret := jsonMap()
+	version := apiVersion(req)
+	ret := newResponse(version)
 	defer httputil.ReturnJSON(rw, ret)
 
 	br := blobref.Parse(req.FormValue("blobref"))
@@ -726,7 +904,7 @@ func (sh *Handler) serveDescribe(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	dr := sh.NewDescribeRequest()
+	dr := sh.newDescribeRequestFor(req)
 	dr.Describe(br, 4)
 	thumbSize := 0
 	if req.FormValue("thumbnails") != "" {
@@ -735,11 +913,12 @@ func (sh *Handler) serveDescribe(rw http.ResponseWriter, req *http.Request) {
 			thumbSize = i
 		}
 	}
-	dr.populateJSONThumbnails(ret, thumbSize)
+	dr.populateResponse(ret, version, thumbSize)
 }
 
 func (sh *Handler) serveFiles(rw http.ResponseWriter, req *http.Request) {
-	ret := jsonMap()
+	version := apiVersion(req)
+	ret := newResponse(version)
 	defer httputil.ReturnJSON(rw, ret)
 
 	br := blobref.Parse(req.FormValue("wholedigest"))
@@ -776,42 +955,8 @@ func (dr *DescribeRequest) populatePermanodeFields(pi *DescribedPermanode, pn, s
 	}
 
 	sort.Sort(claims)
-claimLoop:
 	for _, cl := range claims {
-		switch cl.Type {
-		case "del-attribute":
-			if cl.Value == "" {
-				delete(attr, cl.Attr)
-			} else {
-				sl := attr[cl.Attr]
-				filtered := make([]string, 0, len(sl))
-				for _, val := range sl {
-					if val != cl.Value {
-						filtered = append(filtered, val)
-					}
-				}
-				attr[cl.Attr] = filtered
-			}
-		case "set-attribute":
-			delete(attr, cl.Attr)
-			fallthrough
-		case "add-attribute":
-			if cl.Value == "" {
-				continue
-			}
-			sl, ok := attr[cl.Attr]
-			if ok {
-				for _, exist := range sl {
-					if exist == cl.Value {
-						continue claimLoop
-					}
-				}
-			} else {
-				sl = make([]string, 0, 1)
-				attr[cl.Attr] = sl
-			}
-			attr[cl.Attr] = append(sl, cl.Value)
-		}
+		applyClaim(attr, cl)
 	}
 
 	// If the content permanode is now known, look up its type
@@ -831,6 +976,46 @@ claimLoop:
 	}
 }
 
+// applyClaim mutates attr, a permanode's attributes, according to
+// the set-attribute, add-attribute or del-attribute claim cl.
+// Claims must be applied in date order.
+func applyClaim(attr url.Values, cl *Claim) {
+	switch cl.Type {
+	case "del-attribute":
+		if cl.Value == "" {
+			delete(attr, cl.Attr)
+		} else {
+			sl := attr[cl.Attr]
+			filtered := make([]string, 0, len(sl))
+			for _, val := range sl {
+				if val != cl.Value {
+					filtered = append(filtered, val)
+				}
+			}
+			attr[cl.Attr] = filtered
+		}
+	case "set-attribute":
+		delete(attr, cl.Attr)
+		fallthrough
+	case "add-attribute":
+		if cl.Value == "" {
+			return
+		}
+		sl, ok := attr[cl.Attr]
+		if ok {
+			for _, exist := range sl {
+				if exist == cl.Value {
+					return
+				}
+			}
+		} else {
+			sl = make([]string, 0, 1)
+			attr[cl.Attr] = sl
+		}
+		attr[cl.Attr] = append(sl, cl.Value)
+	}
+}
+
 func mustGet(req *http.Request, param string) string {
 	v := req.FormValue(param)
 	if v == "" {
@@ -849,7 +1034,8 @@ func setPanicError(m map[string]interface{}) {
 }
 
 func (sh *Handler) serveSignerAttrValue(rw http.ResponseWriter, req *http.Request) {
-	ret := jsonMap()
+	version := apiVersion(req)
+	ret := newResponse(version)
 	defer httputil.ReturnJSON(rw, ret)
 	defer setPanicError(ret)
 
@@ -859,26 +1045,35 @@ func (sh *Handler) serveSignerAttrValue(rw http.ResponseWriter, req *http.Reques
 	pn, err := sh.index.PermanodeOfSignerAttrValue(signer, attr, value)
 	if err != nil {
 		ret["error"] = err.Error()
+		if version >= 2 {
+			ret["errorType"] = "server"
+		}
 	} else {
 		ret["permanode"] = pn.String()
 
 		dr := sh.NewDescribeRequest()
 		dr.Describe(pn, 2)
-		dr.PopulateJSON(ret)
+		dr.populateResponse(ret, version, 0)
 	}
 }
 
 // Unlike the index interface's EdgesTo method, the "edgesto" Handler
 // here additionally filters out since-deleted permanode edges.
 func (sh *Handler) serveEdgesTo(rw http.ResponseWriter, req *http.Request) {
-	ret := jsonMap()
+	version := apiVersion(req)
+	ret := newResponse(version)
 	defer httputil.ReturnJSON(rw, ret)
 	defer setPanicError(ret)
 
 	toRef := blobref.MustParse(mustGet(req, "blobref"))
 	toRefStr := toRef.String()
 	blobInfo := jsonMap()
-	ret[toRefStr] = blobInfo
+	if version < 2 {
+		ret[toRefStr] = blobInfo
+	} else {
+		ret["blobref"] = toRefStr
+		blobInfo = ret
+	}
 
 	jsonEdges := jsonMapList()
 
@@ -944,7 +1139,8 @@ func (sh *Handler) serveEdgesTo(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (sh *Handler) serveSignerPaths(rw http.ResponseWriter, req *http.Request) {
-	ret := jsonMap()
+	version := apiVersion(req)
+	ret := newResponse(version)
 	defer httputil.ReturnJSON(rw, ret)
 	defer setPanicError(ret)
 
@@ -953,6 +1149,9 @@ func (sh *Handler) serveSignerPaths(rw http.ResponseWriter, req *http.Request) {
 	paths, err := sh.index.PathsOfSignerTarget(signer, target)
 	if err != nil {
 		ret["error"] = err.Error()
+		if version >= 2 {
+			ret["errorType"] = "server"
+		}
 	} else {
 		jpaths := []map[string]interface{}{}
 		for _, path := range paths {
@@ -967,7 +1166,7 @@ func (sh *Handler) serveSignerPaths(rw http.ResponseWriter, req *http.Request) {
 		for _, path := range paths {
 			dr.Describe(path.Base, 2)
 		}
-		dr.PopulateJSON(ret)
+		dr.populateResponse(ret, version, 0)
 	}
 }
 
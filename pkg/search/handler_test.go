@@ -135,6 +135,46 @@ var handlerTests = []handlerTest{
 		},
 	},
 
+	// Test the versioned describe layout.
+	{
+		setup: func(fi *test.FakeIndex) Index {
+			fi.AddMeta(blobref.MustParse("abc-555"), "image/jpeg", 999)
+			return fi
+		},
+		query: "describe?blobref=abc-555&version=2",
+		want: map[string]interface{}{
+			"version": 2,
+			"meta": map[string]interface{}{
+				"abc-555": map[string]interface{}{
+					"blobRef":  "abc-555",
+					"mimeType": "image/jpeg",
+					"size":     999,
+				},
+			},
+		},
+	},
+
+	// Test an unsupported version.
+	{
+		setup: func(fi *test.FakeIndex) Index { return fi },
+		query: "describe?blobref=abc-555&version=99",
+		want: map[string]interface{}{
+			"error":     "unsupported search API version \"99\"; supported versions are 1 through 2",
+			"errorType": "input",
+		},
+	},
+
+	// Test versioned claims errors are JSON.
+	{
+		setup: func(fi *test.FakeIndex) Index { return fi },
+		query: "claims?version=2",
+		want: map[string]interface{}{
+			"version":   2,
+			"error":     "Missing or invalid 'permanode' param",
+			"errorType": "input",
+		},
+	},
+
 	// Test recent permanodes
 	{
 		setup: func(*test.FakeIndex) Index {
@@ -200,6 +240,264 @@ var handlerTests = []handlerTest{
                }`),
 	},
 
+	// Test the calendar of permanodes by day.
+	{
+		setup: func(*test.FakeIndex) Index {
+			idx := index.NewMemoryIndex()
+			id := indextest.NewIndexDeps(idx)
+
+			pn := id.NewPlannedPermanode("pn1")
+			id.SetAttribute(pn, "title", "Some title")
+			return indexAndOwner{idx, id.SignerBlobRef}
+		},
+		query: "calendar?granularity=day&samples=1",
+		want: parseJSON(`{
+                "granularity": "day",
+                "calendar": [
+                    {"date": "2011-11-28",
+                     "count": 1,
+                     "samples": ["sha1-7ca7743e38854598680d94ef85348f2c48a44513"]}
+                ],
+                "total": 1,
+                "truncated": false,
+                "sha1-7ca7743e38854598680d94ef85348f2c48a44513": {
+		 "blobRef": "sha1-7ca7743e38854598680d94ef85348f2c48a44513",
+		 "camliType": "permanode",
+                 "mimeType": "application/json; camliType=permanode",
+                 "permanode": {
+                   "attr": { "title": [ "Some title" ] }
+                 },
+                 "size": 534
+                }
+               }`),
+	},
+
+	// Test the calendar of permanodes of one month, by day.
+	{
+		setup: func(*test.FakeIndex) Index {
+			idx := index.NewMemoryIndex()
+			id := indextest.NewIndexDeps(idx)
+
+			pn := id.NewPlannedPermanode("pn1")
+			id.SetAttribute(pn, "title", "Some title")
+			return indexAndOwner{idx, id.SignerBlobRef}
+		},
+		query: "calendar?granularity=day&date=2011-11&samples=100",
+		want: parseJSON(`{
+                "granularity": "day",
+                "calendar": [
+                    {"date": "2011-11-28",
+                     "count": 1,
+                     "samples": ["sha1-7ca7743e38854598680d94ef85348f2c48a44513"]}
+                ],
+                "total": 1,
+                "truncated": false,
+                "sha1-7ca7743e38854598680d94ef85348f2c48a44513": {
+		 "blobRef": "sha1-7ca7743e38854598680d94ef85348f2c48a44513",
+		 "camliType": "permanode",
+                 "mimeType": "application/json; camliType=permanode",
+                 "permanode": {
+                   "attr": { "title": [ "Some title" ] }
+                 },
+                 "size": 534
+                }
+               }`),
+	},
+
+	// Test that the calendar of another year is empty.
+	{
+		setup: func(*test.FakeIndex) Index {
+			idx := index.NewMemoryIndex()
+			id := indextest.NewIndexDeps(idx)
+
+			pn := id.NewPlannedPermanode("pn1")
+			id.SetAttribute(pn, "title", "Some title")
+			return indexAndOwner{idx, id.SignerBlobRef}
+		},
+		query: "calendar?granularity=month&date=2010",
+		want: parseJSON(`{
+                "granularity": "month",
+                "calendar": [],
+                "total": 1,
+                "truncated": false
+               }`),
+	},
+
+	// Test recent permanodes by date.
+	{
+		setup: func(*test.FakeIndex) Index {
+			idx := index.NewMemoryIndex()
+			id := indextest.NewIndexDeps(idx)
+
+			pn := id.NewPlannedPermanode("pn1")
+			id.SetAttribute(pn, "camliDate", "2010-05-01T12:00:00Z")
+			return indexAndOwner{idx, id.SignerBlobRef}
+		},
+		query: "recent?sort=date",
+		want: parseJSON(`{
+                "recent": [
+                    {"blobref": "sha1-7ca7743e38854598680d94ef85348f2c48a44513",
+                     "date": "2010-05-01T12:00:00Z",
+                     "modtime": "2011-11-28T01:32:37Z",
+                     "owner": "sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007"}
+                ],
+                "sha1-7ca7743e38854598680d94ef85348f2c48a44513": {
+		 "blobRef": "sha1-7ca7743e38854598680d94ef85348f2c48a44513",
+		 "camliType": "permanode",
+                 "mimeType": "application/json; camliType=permanode",
+                 "permanode": {
+                   "attr": { "camliDate": [ "2010-05-01T12:00:00Z" ] }
+                 },
+                 "size": 534
+                }
+               }`),
+	},
+
+	// Test that the calendar goes by camliDate, unless sorting by
+	// modtime.
+	{
+		setup: func(*test.FakeIndex) Index {
+			idx := index.NewMemoryIndex()
+			id := indextest.NewIndexDeps(idx)
+
+			pn := id.NewPlannedPermanode("pn1")
+			id.SetAttribute(pn, "camliDate", "2010-05-01T12:00:00Z")
+			return indexAndOwner{idx, id.SignerBlobRef}
+		},
+		query: "calendar?granularity=month&samples=0",
+		want: parseJSON(`{
+                "granularity": "month",
+                "calendar": [
+                    {"date": "2010-05",
+                     "count": 1,
+                     "samples": []}
+                ],
+                "total": 1,
+                "truncated": false
+               }`),
+	},
+	{
+		setup: func(*test.FakeIndex) Index {
+			idx := index.NewMemoryIndex()
+			id := indextest.NewIndexDeps(idx)
+
+			pn := id.NewPlannedPermanode("pn1")
+			id.SetAttribute(pn, "camliDate", "2010-05-01T12:00:00Z")
+			return indexAndOwner{idx, id.SignerBlobRef}
+		},
+		query: "calendar?granularity=month&samples=0&sort=modtime",
+		want: parseJSON(`{
+                "granularity": "month",
+                "calendar": [
+                    {"date": "2011-11",
+                     "count": 1,
+                     "samples": []}
+                ],
+                "total": 1,
+                "truncated": false
+               }`),
+	},
+
+	// Test an invalid sort.
+	{
+		setup: func(*test.FakeIndex) Index {
+			return indexAndOwner{index.NewMemoryIndex(), nil}
+		},
+		query: "recent?sort=size",
+		want: parseJSON(`{
+                "error": "Invalid 'sort' param; want modtime or date",
+                "errorType": "input"
+               }`),
+	},
+
+	// Test the history of a permanode, filtered to one attribute.
+	{
+		setup: func(*test.FakeIndex) Index {
+			idx := index.NewMemoryIndex()
+			id := indextest.NewIndexDeps(idx)
+
+			pn := id.NewPlannedPermanode("pn1")
+			id.SetAttribute(pn, "title", "First title")
+			id.AddAttribute(pn, "tag", "foo")
+			id.SetAttribute(pn, "title", "Second title")
+			id.DelAttribute(pn, "title")
+			return indexAndOwner{idx, id.SignerBlobRef}
+		},
+		query: "history?permanode=sha1-7ca7743e38854598680d94ef85348f2c48a44513&attr=title",
+		want: parseJSON(`{
+                "history": [
+                    {"attr": "title",
+                     "blobref": "sha1-b4fe9b79d51adf2539cffcef71ca3d2dadaec52d",
+                     "date": "2011-11-28T01:32:37Z",
+                     "signer": "sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007",
+                     "type": "set-attribute",
+                     "value": "First title",
+                     "values": ["First title"]},
+                    {"attr": "title",
+                     "blobref": "sha1-204ac135b4662d99f54e2612c26d0209b403eee8",
+                     "date": "2011-11-28T01:32:39Z",
+                     "signer": "sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007",
+                     "type": "set-attribute",
+                     "value": "Second title",
+                     "values": ["Second title"]},
+                    {"attr": "title",
+                     "blobref": "sha1-513ac68b2e932c07b18de9dc6813594c4eee2c27",
+                     "date": "2011-11-28T01:32:40Z",
+                     "signer": "sha1-ad87ca5c78bd0ce1195c46f7c98e6025abbaf007",
+                     "type": "del-attribute",
+                     "values": []}
+                ],
+                "permanode": "sha1-7ca7743e38854598680d94ef85348f2c48a44513"
+               }`),
+	},
+
+	// Test the versions of a permanode's content: setting the same
+	// content again isn't a new version, but setting it back after
+	// another one is.
+	{
+		setup: func(*test.FakeIndex) Index {
+			idx := index.NewMemoryIndex()
+			id := indextest.NewIndexDeps(idx)
+
+			pn := id.NewPlannedPermanode("pn1")
+			f1, _ := id.UploadFile("a.txt", "first version")
+			f2, _ := id.UploadFile("a.txt", "second, longer, version")
+			id.SetAttribute(pn, "camliContent", f1.String())
+			id.SetAttribute(pn, "title", "A file")
+			id.SetAttribute(pn, "camliContent", f2.String())
+			id.SetAttribute(pn, "camliContent", f2.String())
+			id.SetAttribute(pn, "camliContent", f1.String())
+			return indexAndOwner{idx, id.SignerBlobRef}
+		},
+		query: "versions?permanode=sha1-7ca7743e38854598680d94ef85348f2c48a44513",
+		want: parseJSON(`{
+                "versions": [
+                    {"camliType": "file",
+                     "claim": "sha1-2b8739a46762dafc29e7728239ab9daa964f4d6c",
+                     "content": "sha1-0d86e6c5368d6579b37437834ff5cf2d88f76b38",
+                     "date": "2011-11-28T01:32:37Z",
+                     "fileName": "a.txt",
+                     "mimeType": "text/plain",
+                     "size": 13},
+                    {"camliType": "file",
+                     "claim": "sha1-ae1f431b5cc98a3758676a47ddc080a0c35697a4",
+                     "content": "sha1-a505ad6221c69c2b46c0e4c803164806807f38f5",
+                     "date": "2011-11-28T01:32:39Z",
+                     "fileName": "a.txt",
+                     "mimeType": "text/plain",
+                     "size": 23},
+                    {"camliType": "file",
+                     "claim": "sha1-2b45c304b9dc0ce0bffd48e56bcc8039e1dcb914",
+                     "content": "sha1-0d86e6c5368d6579b37437834ff5cf2d88f76b38",
+                     "date": "2011-11-28T01:32:41Z",
+                     "fileName": "a.txt",
+                     "mimeType": "text/plain",
+                     "size": 13}
+                ],
+                "permanode": "sha1-7ca7743e38854598680d94ef85348f2c48a44513"
+               }`),
+	},
+
 	// edgeto handler: put a permanode (member) in two parent
 	// permanodes, then delete the second and verify that edges
 	// back from member only reveal the first parent.
@@ -258,3 +556,26 @@ func TestHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestImageConstraint(t *testing.T) {
+	tests := []struct {
+		c    ImageConstraint
+		ii   *ImageInfo
+		want bool
+	}{
+		{ImageConstraint{}, nil, false},
+		{ImageConstraint{}, &ImageInfo{Width: 10, Height: 10}, true},
+		{ImageConstraint{MinWidth: 256}, &ImageInfo{Width: 100, Height: 300}, false},
+		{ImageConstraint{MinWidth: 256}, &ImageInfo{Width: 256, Height: 300}, true},
+		{ImageConstraint{MaxHeight: 200}, &ImageInfo{Width: 100, Height: 300}, false},
+		{ImageConstraint{MinAspect: 2}, &ImageInfo{Width: 4000, Height: 1000}, true},
+		{ImageConstraint{MinAspect: 2}, &ImageInfo{Width: 1600, Height: 1200}, false},
+		{ImageConstraint{MaxAspect: 1}, &ImageInfo{Width: 50, Height: 100}, true},
+		{ImageConstraint{MaxAspect: 1}, &ImageInfo{Width: 50, Height: 0}, false},
+	}
+	for i, tt := range tests {
+		if got := tt.c.Match(tt.ii); got != tt.want {
+			t.Errorf("%d. %+v.Match(%+v) = %v; want %v", i, tt.c, tt.ii, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/httputil"
+)
+
+// servePermanodeHistory returns the ordered claim history of a
+// permanode: every claim the owner made on it, oldest first, along
+// with the values of the claim's attribute once that claim was
+// applied.
+//
+// Optional parameters are "attr", to only list the claims on one
+// attribute, and "at", an RFC 3339 time after which claims are
+// ignored.
+func (sh *Handler) servePermanodeHistory(rw http.ResponseWriter, req *http.Request) {
+	version := apiVersion(req)
+	ret := newResponse(version)
+	defer httputil.ReturnJSON(rw, ret)
+	defer setPanicError(ret)
+
+	pn := blobref.MustParse(mustGet(req, "permanode"))
+	onlyAttr := req.FormValue("attr")
+	var at time.Time
+	if v := req.FormValue("at"); v != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			ret["error"] = "Invalid 'at' param: " + err.Error()
+			ret["errorType"] = "input"
+			return
+		}
+	}
+
+	claims, err := sh.index.GetOwnerClaims(pn, sh.owner)
+	if err != nil {
+		ret["error"] = err.Error()
+		ret["errorType"] = "server"
+		return
+	}
+	sort.Sort(claims)
+
+	attr := make(url.Values)
+	history := jsonMapList()
+	for _, cl := range claims {
+		if !at.IsZero() && cl.Date.After(at) {
+			break
+		}
+		applyClaim(attr, cl)
+		if onlyAttr != "" && cl.Attr != onlyAttr {
+			continue
+		}
+		jm := jsonMap()
+		jm["blobref"] = cl.BlobRef.String()
+		jm["signer"] = cl.Signer.String()
+		jm["date"] = cl.Date.Format(time.RFC3339)
+		jm["type"] = cl.Type
+		jm["attr"] = cl.Attr
+		if cl.Value != "" {
+			jm["value"] = cl.Value
+		}
+		values := make([]string, len(attr[cl.Attr]))
+		copy(values, attr[cl.Attr])
+		jm["values"] = values
+		history = append(history, jm)
+	}
+	ret["permanode"] = pn.String()
+	ret["history"] = history
+}
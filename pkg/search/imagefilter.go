@@ -0,0 +1,129 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ImageConstraint restricts search results to images of certain
+// dimensions. Zero-valued fields are unconstrained.
+type ImageConstraint struct {
+	MinWidth, MaxWidth   int
+	MinHeight, MaxHeight int
+
+	// MinAspect and MaxAspect bound the ratio of width to height.
+	// For example, a MinAspect of 2 selects only panoramas.
+	MinAspect, MaxAspect float64
+}
+
+// Match reports whether the image described by ii satisfies c.
+// A nil ImageInfo never matches.
+func (c *ImageConstraint) Match(ii *ImageInfo) bool {
+	if ii == nil {
+		return false
+	}
+	if c.MinWidth > 0 && ii.Width < c.MinWidth {
+		return false
+	}
+	if c.MaxWidth > 0 && ii.Width > c.MaxWidth {
+		return false
+	}
+	if c.MinHeight > 0 && ii.Height < c.MinHeight {
+		return false
+	}
+	if c.MaxHeight > 0 && ii.Height > c.MaxHeight {
+		return false
+	}
+	if c.MinAspect > 0 || c.MaxAspect > 0 {
+		if ii.Height <= 0 {
+			return false
+		}
+		aspect := float64(ii.Width) / float64(ii.Height)
+		if c.MinAspect > 0 && aspect < c.MinAspect {
+			return false
+		}
+		if c.MaxAspect > 0 && aspect > c.MaxAspect {
+			return false
+		}
+	}
+	return true
+}
+
+// matchDescribed reports whether the permanode b has a camliContent
+// image satisfying c. The describe request b belongs to must be done
+// loading.
+func (c *ImageConstraint) matchDescribed(b *DescribedBlob) bool {
+	cref, ok := b.ContentRef()
+	if !ok {
+		return false
+	}
+	content := b.PeerBlob(cref)
+	return c.Match(content.Image)
+}
+
+// imageConstraintFromRequest parses the optional minWidth, maxWidth,
+// minHeight, maxHeight, minAspect and maxAspect parameters of req.
+// It returns nil if none are present.
+func imageConstraintFromRequest(req *http.Request) (*ImageConstraint, error) {
+	c := new(ImageConstraint)
+	any := false
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{
+		{"minWidth", &c.MinWidth},
+		{"maxWidth", &c.MaxWidth},
+		{"minHeight", &c.MinHeight},
+		{"maxHeight", &c.MaxHeight},
+	} {
+		v := req.FormValue(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %q value %q", p.name, v)
+		}
+		*p.dst = n
+		any = true
+	}
+	for _, p := range []struct {
+		name string
+		dst  *float64
+	}{
+		{"minAspect", &c.MinAspect},
+		{"maxAspect", &c.MaxAspect},
+	} {
+		v := req.FormValue(p.name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("invalid %q value %q", p.name, v)
+		}
+		*p.dst = f
+		any = true
+	}
+	if !any {
+		return nil, nil
+	}
+	return c, nil
+}
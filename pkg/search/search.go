@@ -29,6 +29,7 @@ type Result struct {
 	BlobRef     *blobref.BlobRef
 	Signer      *blobref.BlobRef // may be nil
 	LastModTime int64            // seconds since epoch
+	Date        int64            // seconds since epoch; only set by GetDatedPermanodes
 }
 
 // Results exists mostly for debugging, to provide a String method on
@@ -98,6 +99,12 @@ func (fi *FileInfo) IsImage() bool {
 	return strings.HasPrefix(fi.MimeType, "image/")
 }
 
+// ImageInfo describes the dimensions of an indexed image file.
+type ImageInfo struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
 type Path struct {
 	Claim, Base, Target *blobref.BlobRef
 	ClaimDate           string
@@ -150,6 +157,14 @@ type Index interface {
 		owner *blobref.BlobRef,
 		limit int) error
 
+	// GetDatedPermanodes is like GetRecentPermanodes, but orders
+	// the permanodes by their date, set in the Results' Date: their
+	// camliDate attribute, or the time their camliContent image was
+	// taken, per its EXIF metadata, or else their last modification.
+	GetDatedPermanodes(dest chan *Result,
+		owner *blobref.BlobRef,
+		limit int) error
+
 	// SearchPermanodes finds permanodes matching the provided
 	// request and sends unique permanode blobrefs to dest.
 	// In particular, if request.FuzzyMatch is true, a fulltext
@@ -193,6 +208,17 @@ type Index interface {
 	// Should return os.ErrNotExist if not found.
 	GetFileInfo(fileRef *blobref.BlobRef) (*FileInfo, error)
 
+	// GetImageInfo returns the dimensions of the image file
+	// fileRef. Should return os.ErrNotExist if not found or if
+	// the file isn't a decodable image.
+	GetImageInfo(fileRef *blobref.BlobRef) (*ImageInfo, error)
+
+	// GetFileTime returns the time the image file fileRef was
+	// taken, from its EXIF metadata. Should return
+	// os.ErrNotExist if not found or if the file has no such
+	// metadata.
+	GetFileTime(fileRef *blobref.BlobRef) (time.Time, error)
+
 	// Given an owner key, a camliType 'claim', 'attribute' name,
 	// and specific 'value', find the most recent permanode that has
 	// a corresponding 'set-attribute' claim attached.
@@ -236,7 +262,7 @@ type Index interface {
 // (PermanodeOfSignerAttrValue), and not about indexed attributes in general.
 func IsIndexedAttribute(attr string) bool {
 	switch attr {
-	case "camliRoot", "tag", "title":
+	case "camliRoot", "tag", "title", ACLAttr:
 		return true
 	}
 	return false
@@ -0,0 +1,94 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Versions of the search handler's JSON responses. Clients select a
+// version with the "version" request parameter. Requests without one
+// get LegacyAPIVersion, so existing clients keep working; new clients
+// should always ask for a specific version.
+//
+// Any change to the shape of a response requires a new version, with
+// the previous one still served on request.
+const (
+	// LegacyAPIVersion is the original layout: described blobs are
+	// mixed in at the top level of the response, keyed by blobref,
+	// and there is no "version" field.
+	LegacyAPIVersion = 1
+
+	// APIVersion is the current layout. Every response has a
+	// "version" field, described blobs are under "meta", and
+	// errors are always reported as JSON "error" and "errorType"
+	// fields.
+	APIVersion = 2
+)
+
+// parseAPIVersion returns the response version requested by req.
+func parseAPIVersion(req *http.Request) (int, error) {
+	v := req.FormValue("version")
+	if v == "" {
+		return LegacyAPIVersion, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < LegacyAPIVersion || n > APIVersion {
+		return 0, fmt.Errorf("unsupported search API version %q; supported versions are %d through %d",
+			v, LegacyAPIVersion, APIVersion)
+	}
+	return n, nil
+}
+
+// apiVersion is like parseAPIVersion but for use once ServeHTTP has
+// already rejected invalid versions.
+func apiVersion(req *http.Request) int {
+	v, err := parseAPIVersion(req)
+	if err != nil {
+		return LegacyAPIVersion
+	}
+	return v
+}
+
+// newResponse returns a new top-level response map for version.
+func newResponse(version int) map[string]interface{} {
+	ret := jsonMap()
+	if version >= 2 {
+		ret["version"] = version
+	}
+	return ret
+}
+
+// populateResponse waits for dr to finish loading and adds the
+// described blobs to ret, laid out according to version. thumbSize of
+// zero means to not include thumbnails.
+func (dr *DescribeRequest) populateResponse(ret map[string]interface{}, version, thumbSize int) {
+	if version < 2 {
+		dr.populateJSONThumbnails(ret, thumbSize)
+		return
+	}
+	meta := jsonMap()
+	dr.populateJSONThumbnails(meta, thumbSize)
+	if errStr, ok := meta["error"]; ok {
+		delete(meta, "error")
+		ret["error"] = errStr
+		ret["errorType"] = "server"
+	}
+	ret["meta"] = meta
+}
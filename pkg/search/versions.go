@@ -0,0 +1,98 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/httputil"
+)
+
+// serveContentVersions returns the versions of a permanode's
+// content: each camliContent it was given by the owner's claims,
+// oldest first, with the date of the claim, the camliType of the
+// content and, for files, their size and name, when the index knows
+// them.
+func (sh *Handler) serveContentVersions(rw http.ResponseWriter, req *http.Request) {
+	version := apiVersion(req)
+	ret := newResponse(version)
+	defer httputil.ReturnJSON(rw, ret)
+	defer setPanicError(ret)
+
+	pn := blobref.MustParse(mustGet(req, "permanode"))
+	claims, err := sh.index.GetOwnerClaims(pn, sh.owner)
+	if err != nil {
+		ret["error"] = err.Error()
+		ret["errorType"] = "server"
+		return
+	}
+	sort.Sort(claims)
+
+	attr := make(url.Values)
+	current := ""
+	versions := jsonMapList()
+	for _, cl := range claims {
+		if cl.Attr != "camliContent" {
+			continue
+		}
+		applyClaim(attr, cl)
+		content := attr.Get("camliContent")
+		if content == current {
+			continue
+		}
+		current = content
+		if content == "" {
+			continue
+		}
+		jm := jsonMap()
+		jm["content"] = content
+		jm["claim"] = cl.BlobRef.String()
+		jm["date"] = cl.Date.Format(time.RFC3339)
+		if br := blobref.Parse(content); br != nil {
+			sh.addVersionInfo(jm, br)
+		}
+		versions = append(versions, jm)
+	}
+	ret["permanode"] = pn.String()
+	ret["versions"] = versions
+}
+
+// addVersionInfo adds to jm what the index knows of br, the content
+// of a version.
+func (sh *Handler) addVersionInfo(jm map[string]interface{}, br *blobref.BlobRef) {
+	mime, _, err := sh.index.GetBlobMimeType(br)
+	if err != nil || !strings.HasPrefix(mime, camliTypePrefix) {
+		return
+	}
+	camliType := mime[len(camliTypePrefix):]
+	jm["camliType"] = camliType
+	if camliType != "file" {
+		return
+	}
+	if fi, err := sh.index.GetFileInfo(br); err == nil {
+		jm["size"] = fi.Size
+		jm["fileName"] = fi.FileName
+		if fi.MimeType != "" {
+			jm["mimeType"] = fi.MimeType
+		}
+	}
+}
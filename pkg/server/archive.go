@@ -0,0 +1,372 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+)
+
+// ArchiveHandler streams an archive of a directory schema blob, or
+// of a permanode and its camliMember collection, recursively.
+// Nothing is buffered: files are written to the response as their
+// chunks are fetched.
+type ArchiveHandler struct {
+	Fetcher blobref.StreamingFetcher
+	Search  *search.Handler // or nil, in which case only directories can be archived
+
+	// Format is "zip" or "tar".
+	Format string
+}
+
+func (ah *ArchiveHandler) storageSeekFetcher() blobref.SeekFetcher {
+	return blobref.SeekerFromStreamingFetcher(ah.Fetcher)
+}
+
+// archiveWriter is the part of an archive format used by an
+// archiver. Names are slash-separated, relative paths.
+type archiveWriter interface {
+	Dir(name string, ss *schema.Superset) error
+	File(name string, ss *schema.Superset, r io.Reader) error
+	Close() error
+}
+
+var archiveContentType = map[string]string{
+	"zip": "application/zip",
+	"tar": "application/x-tar",
+}
+
+// ServeHTTP serves the archive of root. name is the recommended
+// download name; if empty, one is derived from root.
+func (ah *ArchiveHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request, root *blobref.BlobRef, name string) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(rw, "Invalid download method", 400)
+		return
+	}
+	ctype, ok := archiveContentType[ah.Format]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("Unsupported archive format %q", ah.Format), 500)
+		return
+	}
+
+	ss, err := ah.superset(root)
+	if err != nil {
+		http.Error(rw, "Can't archive blob: "+err.Error(), 500)
+		return
+	}
+	a := &archiver{
+		ah:    ah,
+		seen:  make(map[string]bool),
+		names: make(map[string]bool),
+	}
+	var add func() error
+	switch ss.Type {
+	case "directory":
+		add = func() error { return a.addDir("", root) }
+	case "permanode":
+		if ah.Search == nil {
+			http.Error(rw, "Can't archive a permanode without a search handler", 500)
+			return
+		}
+		a.dr = ah.Search.NewDescribeRequest()
+		add = func() error { return a.addPermanode("", root, true) }
+	default:
+		http.Error(rw, fmt.Sprintf("Can't archive blob of camliType %q", ss.Type), 400)
+		return
+	}
+
+	if name == "" {
+		name = root.String() + "." + ah.Format
+	}
+	rw.Header().Set("Content-Type", ctype)
+	rw.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(name))
+	if req.Method == "HEAD" {
+		return
+	}
+
+	switch ah.Format {
+	case "zip":
+		a.w = zipWriter{zip.NewWriter(rw)}
+	case "tar":
+		a.w = tarWriter{tar.NewWriter(rw)}
+	}
+	// From here on the response is committed, so errors can only be
+	// logged, and the client will see a truncated archive.
+	if err := add(); err != nil {
+		log.Printf("error serving %s of %s: %v", ah.Format, root, err)
+		return
+	}
+	if err := a.w.Close(); err != nil {
+		log.Printf("error serving %s of %s: %v", ah.Format, root, err)
+	}
+}
+
+func (ah *ArchiveHandler) superset(br *blobref.BlobRef) (*schema.Superset, error) {
+	rc, _, err := ah.Fetcher.FetchStreaming(br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	ss, err := schema.ParseSuperset(rc)
+	if err != nil {
+		return nil, fmt.Errorf("blob %s is not a schema blob: %v", br, err)
+	}
+	ss.BlobRef = br
+	return ss, nil
+}
+
+// archiver holds the state of writing one archive.
+type archiver struct {
+	ah *ArchiveHandler
+	w  archiveWriter
+	dr *search.DescribeRequest // for permanodes
+
+	seen  map[string]bool // permanodes already visited, against cycles
+	names map[string]bool // archive paths already used
+}
+
+// uniqueName returns name, or name with a "-N" suffix before its
+// extension if it's already in the archive.
+func (a *archiver) uniqueName(name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; a.names[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	a.names[name] = true
+	return name
+}
+
+// cleanName makes a file or directory name, from a schema blob or a
+// permanode title, safe to use as an archive path element.
+func cleanName(name string) string {
+	name = strings.Replace(name, "/", "_", -1)
+	name = strings.Replace(name, "\\", "_", -1)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+func (a *archiver) addFile(dir string, file *blobref.BlobRef) error {
+	fr, err := schema.NewFileReader(a.ah.storageSeekFetcher(), file)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	ss := fr.FileSchema()
+	return a.w.File(a.uniqueName(path.Join(dir, cleanName(ss.FileNameString()))), ss, fr)
+}
+
+func (a *archiver) addDir(dir string, dirRef *blobref.BlobRef) error {
+	de, err := schema.NewDirectoryEntryFromBlobRef(a.ah.storageSeekFetcher(), dirRef)
+	if err != nil {
+		return err
+	}
+	d, err := de.Directory()
+	if err != nil {
+		return err
+	}
+	entries, err := d.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	if dir != "" {
+		// Explicit entry, so empty directories are kept. The
+		// children go in it, under its name made unique.
+		ss, err := a.ah.superset(dirRef)
+		if err != nil {
+			return err
+		}
+		dir = a.uniqueName(dir)
+		if err := a.w.Dir(dir, ss); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		switch e.CamliType() {
+		case "file":
+			err = a.addFile(dir, e.BlobRef())
+		case "directory":
+			err = a.addDir(path.Join(dir, cleanName(e.FileName())), e.BlobRef())
+		default:
+			// TODO: symlinks
+			log.Printf("archive of %s: skipping %q of camliType %q", dirRef, e.FileName(), e.CamliType())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addContent adds the camliContent of the permanode des, if it's a
+// file or directory, to the archive directory dir.
+func (a *archiver) addContent(dir string, des *search.DescribedBlob) error {
+	cref, ok := des.ContentRef()
+	if !ok {
+		return nil
+	}
+	ss, err := a.ah.superset(cref)
+	if err != nil {
+		return err
+	}
+	switch ss.Type {
+	case "file":
+		return a.addFile(dir, cref)
+	case "directory":
+		return a.addDir(path.Join(dir, cleanName(ss.FileNameString())), cref)
+	}
+	return nil
+}
+
+// addPermanode adds the content of the permanode pn to dir. If pn is
+// a collection, its members are added too: directly in dir if top,
+// otherwise in a subdirectory named after pn.
+func (a *archiver) addPermanode(dir string, pn *blobref.BlobRef, top bool) error {
+	if a.seen[pn.String()] {
+		return nil
+	}
+	a.seen[pn.String()] = true
+
+	des, err := a.dr.DescribeSync(pn)
+	if err != nil {
+		return err
+	}
+	if des == nil || des.Permanode == nil {
+		return nil
+	}
+	members := des.Permanode.Attr["camliMember"]
+	if len(members) > 0 && !top {
+		title := des.Title()
+		if title == "" {
+			title = pn.String()
+		}
+		dir = a.uniqueName(path.Join(dir, cleanName(title)))
+		if err := a.w.Dir(dir, nil); err != nil {
+			return err
+		}
+	}
+	if err := a.addContent(dir, des); err != nil {
+		return err
+	}
+	for _, m := range members {
+		if mref := blobref.Parse(m); mref != nil {
+			if err := a.addPermanode(dir, mref, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveMode returns the permission bits of ss, or def if ss is nil
+// or has none.
+func archiveMode(ss *schema.Superset, def os.FileMode) os.FileMode {
+	if ss != nil {
+		if perm := ss.FileMode().Perm(); perm != 0 {
+			return perm
+		}
+	}
+	return def
+}
+
+// archiveModTime returns the modification time of ss, or now if ss
+// is nil or has none.
+func archiveModTime(ss *schema.Superset) time.Time {
+	if ss != nil {
+		if mt := ss.ModTime(); !mt.IsZero() {
+			return mt
+		}
+	}
+	return time.Now()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w zipWriter) Dir(name string, ss *schema.Superset) error {
+	fh := &zip.FileHeader{Name: name + "/"}
+	fh.SetModTime(archiveModTime(ss))
+	fh.SetMode(archiveMode(ss, 0755) | os.ModeDir)
+	_, err := w.zw.CreateHeader(fh)
+	return err
+}
+
+func (w zipWriter) File(name string, ss *schema.Superset, r io.Reader) error {
+	fh := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	fh.SetModTime(archiveModTime(ss))
+	fh.SetMode(archiveMode(ss, 0644))
+	fw, err := w.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (w zipWriter) Close() error { return w.zw.Close() }
+
+type tarWriter struct {
+	tw *tar.Writer
+}
+
+func (w tarWriter) Dir(name string, ss *schema.Superset) error {
+	return w.tw.WriteHeader(&tar.Header{
+		Name:     name + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     int64(archiveMode(ss, 0755)),
+		ModTime:  archiveModTime(ss),
+	})
+}
+
+func (w tarWriter) File(name string, ss *schema.Superset, r io.Reader) error {
+	// tar needs the size up front; the file schema's size is
+	// what the reader will produce.
+	size := int64(ss.SumPartsSize())
+	err := w.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     int64(archiveMode(ss, 0644)),
+		ModTime:  archiveModTime(ss),
+		Size:     size,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w.tw, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("file %s: read %d bytes; schema says %d", name, n, size)
+	}
+	return err
+}
+
+func (w tarWriter) Close() error { return w.tw.Close() }
@@ -0,0 +1,191 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/test"
+)
+
+// archiveTree holds the blobs of directory trees to archive.
+type archiveTree struct {
+	t *testing.T
+	f *test.Fetcher
+}
+
+func newArchiveTree(t *testing.T) *archiveTree {
+	return &archiveTree{t: t, f: new(test.Fetcher)}
+}
+
+func (at *archiveTree) add(m schema.Map) *blobref.BlobRef {
+	js, err := m.JSON()
+	if err != nil {
+		at.t.Fatal(err)
+	}
+	b := &test.Blob{Contents: js}
+	at.f.AddBlob(b)
+	return b.BlobRef()
+}
+
+func (at *archiveTree) file(name, contents string) *blobref.BlobRef {
+	br, err := schema.WriteFileFromReader(at.f, name, strings.NewReader(contents))
+	if err != nil {
+		at.t.Fatal(err)
+	}
+	return br
+}
+
+func (at *archiveTree) dir(name string, entries ...*blobref.BlobRef) *blobref.BlobRef {
+	ss := new(schema.StaticSet)
+	for _, e := range entries {
+		ss.Add(e)
+	}
+	m := schema.Map{"camliVersion": 1, "fileName": name}
+	schema.PopulateDirectoryMap(m, at.add(ss.Map()))
+	return at.add(m)
+}
+
+// serve returns the response to a GET of the archive of root.
+func (at *archiveTree) serve(format string, root *blobref.BlobRef) *httptest.ResponseRecorder {
+	ah := &ArchiveHandler{Fetcher: at.f, Format: format}
+	req, _ := http.NewRequest("GET", "http://example.com/ui/"+format+"/"+root.String(), nil)
+	rec := httptest.NewRecorder()
+	ah.ServeHTTP(rec, req, root, "")
+	if rec.Code != 200 {
+		at.t.Fatalf("GET %s = %d, %s", format, rec.Code, rec.Body)
+	}
+	return rec
+}
+
+func TestTarArchive(t *testing.T) {
+	at := newArchiveTree(t)
+	// Two directories of the same name, whose files must each end
+	// up in their own.
+	root := at.dir("root",
+		at.file("top.txt", "top"),
+		at.dir("photos", at.file("a.txt", "aaa")),
+		at.dir("photos", at.file("b.txt", "bb")),
+		at.dir("empty"),
+	)
+	rec := at.serve("tar", root)
+	if ct := rec.HeaderMap.Get("Content-Type"); ct != "application/x-tar" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	got := make(map[string]string)
+	tr := tar.NewReader(rec.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(b)
+	}
+	want := map[string]string{
+		"top.txt":        "top",
+		"photos/":        "",
+		"photos/a.txt":   "aaa",
+		"photos-2/":      "",
+		"photos-2/b.txt": "bb",
+		"empty/":         "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tar entries = %q; want %q", got, want)
+	}
+}
+
+func TestZipArchive(t *testing.T) {
+	at := newArchiveTree(t)
+	file := at.file("a.txt", "hello")
+	root := at.dir("root", file, at.dir("sub", at.file("b.txt", "world")))
+	rec := at.serve("zip", root)
+	if ct := rec.HeaderMap.Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cd, want := rec.HeaderMap.Get("Content-Disposition"), `attachment; filename="`+root.String()+`.zip"`; cd != want {
+		t.Errorf("Content-Disposition = %q; want %q", cd, want)
+	}
+
+	body := rec.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[f.Name] = string(b)
+	}
+	want := map[string]string{
+		"a.txt":     "hello",
+		"sub/":      "",
+		"sub/b.txt": "world",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("zip entries = %q; want %q", got, want)
+	}
+
+	// Only directories and permanodes are archived, and only by
+	// GET or HEAD.
+	ah := &ArchiveHandler{Fetcher: at.f, Format: "zip"}
+	for _, tt := range []struct {
+		method string
+		br     *blobref.BlobRef
+		want   int
+	}{
+		{"HEAD", root, 200},
+		{"GET", file, 400},
+		{"POST", root, 400},
+	} {
+		req, _ := http.NewRequest(tt.method, "http://example.com/ui/zip/"+tt.br.String(), nil)
+		rec := httptest.NewRecorder()
+		ah.ServeHTTP(rec, req, tt.br, "")
+		if rec.Code != tt.want {
+			t.Errorf("%s of %s = %d; want %d", tt.method, tt.br, rec.Code, tt.want)
+		}
+		if tt.method == "HEAD" && rec.Body.Len() != 0 {
+			t.Errorf("HEAD wrote a %d bytes body", rec.Body.Len())
+		}
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/jsonsign/signhandler"
+	"camlistore.org/pkg/schema"
+)
+
+// AttrHandler edits permanodes' attributes on behalf of clients
+// without a signing key: it builds the claims, signs them with the
+// server's identity, and stores them.
+//
+// A POST to the handler's root applies one attribute change, given by
+// the parameters "permanode", "op" ("set", "add" or "del"), "attr" and
+// "value" (optional for "del", which then deletes all values). A POST
+// with a JSON body instead applies a list of changes, in order:
+//
+//   {"permanode": "sha1-...",
+//    "ops": [{"op": "set", "attr": "title", "value": "Trip"},
+//            {"op": "add", "attr": "tag", "value": "travel"}]}
+//
+// A POST to <prefix>new creates a new permanode and applies the
+// changes, if any, to it. Either way, the response lists the
+// "permanode" and the blobrefs of the "claims" made.
+type AttrHandler struct {
+	Storage blobserver.Storage
+	Sign    *signhandler.Handler
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("attr", newAttrFromConfig)
+}
+
+func newAttrFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	blobRoot := conf.RequiredString("blobRoot")
+	signRoot := conf.RequiredString("jsonSignRoot")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	bs, err := ld.GetStorage(blobRoot)
+	if err != nil {
+		return nil, fmt.Errorf("attr handler's blobRoot of %q error: %v", blobRoot, err)
+	}
+	h, err := ld.GetHandler(signRoot)
+	if err != nil {
+		return nil, fmt.Errorf("attr handler's jsonSignRoot of %q error: %v", signRoot, err)
+	}
+	sigh, ok := h.(*signhandler.Handler)
+	if !ok {
+		return nil, fmt.Errorf("attr handler's jsonSignRoot of %q is of type %T, expecting a jsonsign handler",
+			signRoot, h)
+	}
+	return &AttrHandler{Storage: bs, Sign: sigh}, nil
+}
+
+// An attrOp is one attribute change.
+type attrOp struct {
+	Op    string  `json:"op"`
+	Attr  string  `json:"attr"`
+	Value *string `json:"value"` // nil to delete all values
+}
+
+type attrRequest struct {
+	Permanode string   `json:"permanode"`
+	Ops       []attrOp `json:"ops"`
+}
+
+// check reports whether o is a valid change.
+func (o attrOp) check() error {
+	if o.Attr == "" {
+		return errors.New("missing attribute name")
+	}
+	switch o.Op {
+	case "set", "add":
+		if o.Value == nil {
+			return fmt.Errorf("missing value to %s attribute %q", o.Op, o.Attr)
+		}
+	case "del":
+	default:
+		return fmt.Errorf("invalid op %q", o.Op)
+	}
+	return nil
+}
+
+// claim returns the unsigned claim making the valid change o to pn.
+func (o attrOp) claim(pn *blobref.BlobRef) schema.Map {
+	switch o.Op {
+	case "set":
+		return schema.NewSetAttributeClaim(pn, o.Attr, *o.Value)
+	case "add":
+		return schema.NewAddAttributeClaim(pn, o.Attr, *o.Value)
+	}
+	m := schema.NewDelAttributeClaim(pn, o.Attr)
+	if o.Value != nil {
+		m["value"] = *o.Value
+	}
+	return m
+}
+
+// parseAttrRequest reads the changes asked for by req.
+func parseAttrRequest(req *http.Request) (*attrRequest, error) {
+	ar := new(attrRequest)
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(ar); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %v", err)
+		}
+		return ar, nil
+	}
+	ar.Permanode = req.FormValue("permanode")
+	if op := req.FormValue("op"); op != "" {
+		o := attrOp{Op: op, Attr: req.FormValue("attr")}
+		if _, ok := req.Form["value"]; ok {
+			v := req.FormValue("value")
+			o.Value = &v
+		}
+		ar.Ops = append(ar.Ops, o)
+	}
+	return ar, nil
+}
+
+func (ah *AttrHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
+	if req.Method != "POST" || (suffix != "" && suffix != "new") {
+		httputil.ErrorRouting(rw, req)
+		return
+	}
+	if err := auth.CheckReplay(req); err != nil {
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+	ar, err := parseAttrRequest(req)
+	if err != nil {
+		httputil.BadRequestError(rw, "%v", err)
+		return
+	}
+
+	var pn *blobref.BlobRef
+	if suffix == "" {
+		pn = blobref.Parse(ar.Permanode)
+		if pn == nil {
+			httputil.BadRequestError(rw, "Missing or invalid 'permanode' param")
+			return
+		}
+		if len(ar.Ops) == 0 {
+			httputil.BadRequestError(rw, "No attribute changes given")
+			return
+		}
+	}
+	for _, o := range ar.Ops {
+		if err := o.check(); err != nil {
+			httputil.BadRequestError(rw, "%v", err)
+			return
+		}
+	}
+
+	if pn == nil {
+		pn, err = signAndStore(ah.Sign, ah.Storage, "permanode", schema.NewUnsignedPermanode())
+		if err != nil {
+			httputil.ServerError(rw, req, err)
+			return
+		}
+	}
+	claims := []string{}
+	for _, o := range ar.Ops {
+		br, err := signAndStore(ah.Sign, ah.Storage, o.Op+"-attribute claim", o.claim(pn))
+		if err != nil {
+			httputil.ServerError(rw, req, err)
+			return
+		}
+		claims = append(claims, br.String())
+	}
+	httputil.ReturnJSON(rw, map[string]interface{}{
+		"permanode": pn.String(),
+		"claims":    claims,
+	})
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/auth"
+)
+
+func TestParseAttrRequest(t *testing.T) {
+	tests := []struct {
+		ctype, body string
+		want        string // ops, space separated op:attr[=value]
+		wantErr     bool
+	}{
+		{"application/x-www-form-urlencoded", url.Values{"permanode": {"sha1-abc"}, "op": {"set"}, "attr": {"title"}, "value": {"x"}}.Encode(), "set:title=x", false},
+		{"application/x-www-form-urlencoded", url.Values{"op": {"del"}, "attr": {"tag"}}.Encode(), "del:tag", false},
+		{"application/x-www-form-urlencoded", url.Values{"op": {"add"}, "attr": {"tag"}}.Encode(), "add:tag", true},
+		{"application/json", `{"permanode": "sha1-abc", "ops": [{"op": "add", "attr": "tag", "value": "a"}, {"op": "del", "attr": "tag", "value": "b"}]}`, "add:tag=a del:tag=b", false},
+		{"application/json", `{"ops": [{"op": "frob", "attr": "tag", "value": "a"}]}`, "frob:tag=a", true},
+		{"application/json", `{"ops": [{"op": "set", "value": "a"}]}`, "set:=a", true},
+	}
+	for i, tt := range tests {
+		req, _ := http.NewRequest("POST", "/attr/", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.ctype)
+		ar, err := parseAttrRequest(req)
+		if err != nil {
+			t.Errorf("%d: parse error: %v", i, err)
+			continue
+		}
+		var ops []string
+		var checkErr error
+		for _, o := range ar.Ops {
+			s := o.Op + ":" + o.Attr
+			if o.Value != nil {
+				s += "=" + *o.Value
+			}
+			ops = append(ops, s)
+			if err := o.check(); err != nil && checkErr == nil {
+				checkErr = err
+			}
+		}
+		if got := strings.Join(ops, " "); got != tt.want {
+			t.Errorf("%d: ops = %q; want %q", i, got, tt.want)
+		}
+		if (checkErr != nil) != tt.wantErr {
+			t.Errorf("%d: check error = %v; want error: %v", i, checkErr, tt.wantErr)
+		}
+	}
+}
+
+func TestAttrReplay(t *testing.T) {
+	auth.SetReplayWindow(time.Minute)
+	defer auth.SetReplayWindow(0)
+
+	ah := new(AttrHandler)
+	post := func(addHeaders func(*http.Request)) int {
+		req, _ := http.NewRequest("POST", "/attr/", strings.NewReader(url.Values{"op": {"set"}, "attr": {"title"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		addHeaders(req)
+		rec := httptest.NewRecorder()
+		ah.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := post(func(*http.Request) {}); code != http.StatusForbidden {
+		t.Errorf("POST with no replay headers = %d; want 403", code)
+	}
+	// Past the replay check, the request lacks its permanode.
+	if code := post(auth.AddReplayHeaders); code != http.StatusBadRequest {
+		t.Errorf("POST with replay headers = %d; want 400", code)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/xml"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/markdown"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+)
+
+// In blog mode, the publish handler renders a collection permanode
+// as a blog: its members are the posts, newest first. A post's text
+// is its camliContent, if that's a text file (rendered as markdown if
+// it's a markdown file), else its "description" attribute. A post's
+// date is its "datePublished" attribute (in RFC 3339 format) if set,
+// else the date of its first claim.
+
+// maxPostSize is the most bytes of a post's text content rendered.
+const maxPostSize = 1 << 20
+
+// A blogPost is a member of a blog collection.
+type blogPost struct {
+	des      *search.DescribedBlob
+	date     time.Time
+	text     string
+	markdown bool // text is markdown
+}
+
+// bodyHTML returns the post's text rendered as HTML.
+func (p *blogPost) bodyHTML() string {
+	if p.markdown {
+		return markdown.ToHTML(p.text)
+	}
+	return postBodyHTML(p.text)
+}
+
+// isTextFile reports whether fi looks like a text or markdown file.
+func isTextFile(fi *search.FileInfo) bool {
+	if strings.HasPrefix(fi.MimeType, "text/") {
+		return true
+	}
+	switch strings.ToLower(path.Ext(fi.FileName)) {
+	case ".txt", ".text", ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// isMarkdownFile reports whether fi looks like a markdown file.
+func isMarkdownFile(fi *search.FileInfo) bool {
+	switch fi.MimeType {
+	case "text/markdown", "text/x-markdown":
+		return true
+	}
+	switch strings.ToLower(path.Ext(fi.FileName)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// postDate returns the publication date of the permanode des.
+func (pr *publishRequest) postDate(des *search.DescribedBlob) time.Time {
+	if des.Permanode != nil {
+		if v := des.Permanode.Attr.Get("datePublished"); v != "" {
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				return t
+			}
+		}
+	}
+	claims, err := pr.ph.Search.Index().GetOwnerClaims(des.BlobRef, pr.ph.Search.Owner())
+	if err != nil || len(claims) == 0 {
+		return time.Time{}
+	}
+	first := claims[0].Date
+	for _, cl := range claims[1:] {
+		if cl.Date.Before(first) {
+			first = cl.Date
+		}
+	}
+	return first
+}
+
+// fileText returns up to maxPostSize bytes of the file fileref.
+func (pr *publishRequest) fileText(fileref *blobref.BlobRef) (string, error) {
+	fr, err := schema.NewFileReader(blobref.SeekerFromStreamingFetcher(pr.ph.Storage), fileref)
+	if err != nil {
+		return "", err
+	}
+	defer fr.Close()
+	slurp, err := ioutil.ReadAll(io.LimitReader(fr, maxPostSize))
+	return string(slurp), err
+}
+
+// postText returns the text of the permanode des, and whether it's
+// markdown.
+func (pr *publishRequest) postText(des *search.DescribedBlob) (text string, isMarkdown bool) {
+	if path, fi, ok := des.PermanodeFile(); ok && isTextFile(fi) {
+		fileref := path[len(path)-1]
+		text, err := pr.fileText(fileref)
+		if err != nil {
+			log.Printf("blog: error reading post %s content %s: %v", des.BlobRef, fileref, err)
+		}
+		return text, isMarkdownFile(fi)
+	}
+	return des.Description(), false
+}
+
+// newBlogPost returns the post des, without its text: see loadText.
+func (pr *publishRequest) newBlogPost(des *search.DescribedBlob) *blogPost {
+	return &blogPost{
+		des:  des,
+		date: pr.postDate(des),
+	}
+}
+
+// loadText reads the text of the posts, which are only those
+// rendered, as it may take reading a file each.
+func (pr *publishRequest) loadText(posts []*blogPost) {
+	for _, post := range posts {
+		post.text, post.markdown = pr.postText(post.des)
+	}
+}
+
+type byPostDate []*blogPost
+
+func (s byPostDate) Len() int           { return len(s) }
+func (s byPostDate) Less(i, j int) bool { return s[i].date.After(s[j].date) }
+func (s byPostDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// blogPosts returns the members of the collection des as posts,
+// newest first, without their text.
+func (pr *publishRequest) blogPosts(des *search.DescribedBlob) []*blogPost {
+	var posts []*blogPost
+	for _, member := range des.Members() {
+		if member.Stub || member.Permanode == nil {
+			continue
+		}
+		posts = append(posts, pr.newBlogPost(member))
+	}
+	sort.Sort(byPostDate(posts))
+	return posts
+}
+
+// postBodyHTML renders the text of a post as HTML, one paragraph per
+// run of non-blank lines.
+func postBodyHTML(text string) string {
+	var buf []string
+	for _, para := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		buf = append(buf, "<p>"+strings.Replace(html.EscapeString(para), "\n", "<br>\n", -1)+"</p>")
+	}
+	return strings.Join(buf, "\n")
+}
+
+// feedPath returns the URL path of the Atom feed of the subject.
+func (pr *publishRequest) feedPath() string {
+	if strings.HasSuffix(pr.subjectBasePath, "/") {
+		return pr.subjectBasePath + "-/=a"
+	}
+	return addPathComponent(pr.subjectBasePath, "=a")
+}
+
+// serveBlogSubject renders the subject des in blog mode: as the page,
+// chosen by the "page" parameter, of posts if it's a collection, else
+// as a single post.
+func (pr *publishRequest) serveBlogSubject(des *search.DescribedBlob) {
+	if members := des.Members(); len(members) == 0 {
+		post := pr.newBlogPost(des)
+		pr.loadText([]*blogPost{post})
+		pr.pf("<div class='camlipostdate'>%s</div>\n",
+			html.EscapeString(post.date.Format("January 2, 2006")))
+		pr.pf("<div class='camlipost'>%s</div>\n", post.bodyHTML())
+		return
+	}
+
+	posts := pr.blogPosts(des)
+	pageSize := pr.ph.BlogPostsPerPage
+	page, _ := strconv.Atoi(pr.req.FormValue("page"))
+	start, end, pages := galleryPage(len(posts), pageSize, page)
+	page = start / pageSize
+	posts = posts[start:end]
+	pr.loadText(posts)
+	for _, post := range posts {
+		pr.pf("<div id='%s' class='camlipost'>\n", post.des.DomID())
+		pr.pf(" <h2><a href='%s'>%s</a></h2>\n",
+			pr.memberPath(post.des.BlobRef), html.EscapeString(post.des.Title()))
+		pr.pf(" <div class='camlipostdate'>%s</div>\n",
+			html.EscapeString(post.date.Format("January 2, 2006")))
+		pr.pf(" %s\n", post.bodyHTML())
+		pr.pf("</div>\n")
+	}
+	if pages > 1 {
+		pr.pf("<div class='camligallerynav'>")
+		if page+1 < pages {
+			pr.pf("<a href='?page=%d'>&laquo; older</a> ", page+1)
+		}
+		pr.pf("page %d of %d", page+1, pages)
+		if page > 0 {
+			pr.pf(" <a href='?page=%d'>newer &raquo;</a>", page-1)
+		}
+		pr.pf("</div>\n")
+	}
+	pr.pf("<div class='camlifeed'><a href='%s'>Atom feed</a></div>\n", pr.feedPath())
+}
+
+// maxFeedEntries is the number of most recent posts in a feed.
+const maxFeedEntries = 20
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entry   []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// absURL returns the absolute URL of the path p on the requested host.
+func (pr *publishRequest) absURL(p string) string {
+	scheme := "http"
+	if httputil.IsSecure(pr.req) {
+		scheme = "https"
+	}
+	return scheme + "://" + pr.req.Host + p
+}
+
+// serveSubresAtom serves the Atom feed of the subject's posts.
+func (pr *publishRequest) serveSubresAtom() {
+	dr := pr.ph.Search.NewDescribeRequest()
+	dr.Describe(pr.subject, 3)
+	res, err := dr.Result()
+	if err != nil {
+		log.Printf("Errors loading %s, permanode %s: %v", pr.req.URL, pr.subject, err)
+		pr.rw.WriteHeader(500)
+		return
+	}
+	des := res[pr.subject.String()]
+	posts := pr.blogPosts(des)
+	if len(posts) > maxFeedEntries {
+		posts = posts[:maxFeedEntries]
+	}
+	pr.loadText(posts)
+
+	selfURL := pr.absURL(pr.feedPath())
+	feed := &atomFeed{
+		Title: des.Title(),
+		ID:    pr.absURL(pr.subjectBasePath),
+		Link: []atomLink{
+			{Rel: "self", Href: selfURL},
+			{Href: pr.absURL(pr.subjectBasePath)},
+		},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(posts) > 0 {
+		feed.Updated = posts[0].date.UTC().Format(time.RFC3339)
+	}
+	for _, post := range posts {
+		postURL := pr.absURL(pr.memberPath(post.des.BlobRef))
+		feed.Entry = append(feed.Entry, atomEntry{
+			Title:   post.des.Title(),
+			ID:      postURL,
+			Link:    []atomLink{{Href: postURL}},
+			Updated: post.date.UTC().Format(time.RFC3339),
+			Content: atomContent{Type: "html", Body: post.bodyHTML()},
+		})
+	}
+
+	pr.rw.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	io.WriteString(pr.rw, xml.Header)
+	enc := xml.NewEncoder(pr.rw)
+	if err := enc.Encode(feed); err != nil {
+		log.Printf("blog: error writing feed of %s: %v", pr.subject, err)
+	}
+}
@@ -0,0 +1,821 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/buildinfo"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/search"
+)
+
+// DLNAHandler is a UPnP AV (DLNA) media server, letting TVs and media
+// players on the LAN browse and play the archive's videos, music and
+// pictures.
+//
+// Players can't authenticate, so the handler only answers requests
+// from loopback and private network addresses, unless "lanOnly" is
+// false. Requests through a reverse proxy count as from the proxy's
+// client, which is only known if the proxy is a trusted one, so the
+// others are refused. Only the media files the content directory may
+// list, of video, audio and image MIME types, are served. Since players need an address they can reach, "baseURL" must
+// be the server's root URL as seen from the LAN, such as
+// "http://192.168.1.10:3179".
+//
+// The content directory's objects are identified by their path from
+// the root, "0":
+//
+//   video, audio, image  the recent permanodes of that media type
+//   roots                the roots (permanodes with a camliRoot)
+//   <parent>/<blobref>   a permanode: an item if its camliContent is
+//                        a media file, else a container of its members
+//                        and path claim targets
+type DLNAHandler struct {
+	Storage blobserver.Storage
+	Search  *search.Handler
+
+	baseURL      string // the handler's absolute URL, with a trailing slash
+	friendlyName string
+	uuid         string
+	lanOnly      bool
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("dlna", newDLNAFromConfig)
+}
+
+func newDLNAFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	blobRoot := conf.RequiredString("blobRoot")
+	searchRoot := conf.RequiredString("searchRoot")
+	baseURL := conf.RequiredString("baseURL")
+	hostname, _ := os.Hostname()
+	friendlyName := conf.OptionalString("friendlyName", "Camlistore on "+hostname)
+	announce := conf.OptionalBool("announce", true)
+	lanOnly := conf.OptionalBool("lanOnly", true)
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	bs, err := ld.GetStorage(blobRoot)
+	if err != nil {
+		return nil, fmt.Errorf("dlna handler's blobRoot of %q error: %v", blobRoot, err)
+	}
+	h, err := ld.GetHandler(searchRoot)
+	if err != nil {
+		return nil, fmt.Errorf("dlna handler's searchRoot of %q error: %v", searchRoot, err)
+	}
+	sh, ok := h.(*search.Handler)
+	if !ok {
+		return nil, fmt.Errorf("dlna handler's searchRoot of %q is of type %T, expecting a search handler",
+			searchRoot, h)
+	}
+	dh := &DLNAHandler{
+		Storage:      bs,
+		Search:       sh,
+		baseURL:      strings.TrimRight(baseURL, "/") + ld.MyPrefix(),
+		friendlyName: friendlyName,
+		lanOnly:      lanOnly,
+	}
+	dh.uuid = dlnaUUID(dh.baseURL)
+	if announce {
+		a := &ssdpAnnouncer{
+			location: dh.baseURL + "description.xml",
+			uuid:     dh.uuid,
+			server:   fmt.Sprintf("%s/1.0 UPnP/1.0 Camlistore/%s", runtime.GOOS, buildinfo.Version()),
+			types: []string{
+				"urn:schemas-upnp-org:device:MediaServer:1",
+				"urn:schemas-upnp-org:service:ContentDirectory:1",
+				"urn:schemas-upnp-org:service:ConnectionManager:1",
+			},
+		}
+		go a.run()
+	}
+	return dh, nil
+}
+
+// dlnaUUID returns a UUID derived from the handler's URL, so players
+// recognize the server across restarts.
+func dlnaUUID(url string) string {
+	s := sha1.New()
+	io.WriteString(s, url)
+	b := s.Sum(nil)
+	b[6] = b[6]&0x0f | 0x50 // version 5
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// maxDLNAItems is the most permanodes looked at to fill a media
+// type's container.
+const maxDLNAItems = 1000
+
+// isLANAddr reports whether the host:port addr is a loopback or
+// private network address.
+func isLANAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			ip4[0] == 172 && ip4[1]&0xf0 == 16 ||
+			ip4[0] == 192 && ip4[1] == 168
+	}
+	return ip[0]&0xfe == 0xfc // fc00::/7, unique local
+}
+
+func (dh *DLNAHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if dh.lanOnly && (!isLANAddr(req.RemoteAddr) || httputil.IsProxied(req)) {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
+	switch {
+	case suffix == "description.xml":
+		dh.serveXML(rw, fmt.Sprintf(dlnaDeviceDescription,
+			xmlEscape(dh.friendlyName), xmlEscape(buildinfo.Version()), dh.uuid))
+	case suffix == "ContentDirectory.xml":
+		dh.serveXML(rw, dlnaContentDirectorySCPD)
+	case suffix == "ConnectionManager.xml":
+		dh.serveXML(rw, dlnaConnectionManagerSCPD)
+	case suffix == "control/ContentDirectory":
+		dh.serveContentDirectory(rw, req)
+	case suffix == "control/ConnectionManager":
+		dh.serveConnectionManager(rw, req)
+	case strings.HasPrefix(suffix, "event/"):
+		// We never change, so there's nothing to send, but
+		// some players won't browse if they can't subscribe.
+		if req.Method != "SUBSCRIBE" && req.Method != "UNSUBSCRIBE" {
+			httputil.ErrorRouting(rw, req)
+			return
+		}
+		if req.Method == "SUBSCRIBE" {
+			rw.Header().Set("SID", "uuid:"+dlnaUUID(dh.uuid+suffix))
+			rw.Header().Set("TIMEOUT", "Second-1800")
+		}
+	case strings.HasPrefix(suffix, "media/"):
+		dh.serveMedia(rw, req, strings.TrimPrefix(suffix, "media/"))
+	default:
+		httputil.ErrorRouting(rw, req)
+	}
+}
+
+func (dh *DLNAHandler) serveXML(rw http.ResponseWriter, body string) {
+	rw.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	io.WriteString(rw, xml.Header)
+	io.WriteString(rw, body)
+}
+
+// serveMedia serves the file of a media URL, "<blobref>/<filename>",
+// if it's a media file.
+func (dh *DLNAHandler) serveMedia(rw http.ResponseWriter, req *http.Request, suffix string) {
+	if i := strings.Index(suffix, "/"); i >= 0 {
+		suffix = suffix[:i]
+	}
+	file := blobref.Parse(suffix)
+	if file == nil {
+		http.Error(rw, "invalid blobref", http.StatusBadRequest)
+		return
+	}
+	fi, err := dh.Search.Index().GetFileInfo(file)
+	if err != nil || mediaType(fi.MimeType) == "" {
+		http.NotFound(rw, req)
+		return
+	}
+	rw.Header().Set("TransferMode.DLNA.ORG", "Streaming")
+	rw.Header().Set("ContentFeatures.DLNA.ORG", dlnaFeatures)
+	dl := &DownloadHandler{Fetcher: dh.Storage, ForceMime: fi.MimeType}
+	dl.ServeHTTP(rw, req, file)
+}
+
+// dlnaFeatures are the DLNA flags of our media: seekable by byte
+// range, streamed.
+const dlnaFeatures = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+
+// A soapAction is a parsed SOAP request.
+type soapAction struct {
+	Name string
+	Args map[string]string
+}
+
+// parseSOAP reads the action and its arguments from a SOAP request body.
+func parseSOAP(r io.Reader) (*soapAction, error) {
+	var env struct {
+		Body struct {
+			Action struct {
+				XMLName xml.Name
+				Args    []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		}
+	}
+	if err := xml.NewDecoder(io.LimitReader(r, 1<<20)).Decode(&env); err != nil {
+		return nil, err
+	}
+	a := &soapAction{Name: env.Body.Action.XMLName.Local, Args: make(map[string]string)}
+	if a.Name == "" {
+		return nil, fmt.Errorf("no action in SOAP body")
+	}
+	for _, arg := range env.Body.Action.Args {
+		a.Args[arg.XMLName.Local] = arg.Value
+	}
+	return a, nil
+}
+
+// soapReply writes the response to action of service, with the
+// arguments, which are name/value pairs.
+func soapReply(rw http.ResponseWriter, service, action string, args ...string) {
+	rw.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	rw.Header().Set("EXT", "")
+	fmt.Fprintf(rw, `%s<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%sResponse xmlns:u="%s">`,
+		xml.Header, action, service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(rw, "<%s>%s</%s>", args[i], xmlEscape(args[i+1]), args[i])
+	}
+	fmt.Fprintf(rw, "</u:%sResponse></s:Body></s:Envelope>", action)
+}
+
+// soapFail writes a UPnP error.
+func soapFail(rw http.ResponseWriter, code int, desc string) {
+	rw.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	rw.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(rw, `%s<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`,
+		xml.Header, code, xmlEscape(desc))
+}
+
+const (
+	contentDirectoryService  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	connectionManagerService = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+	upnpInvalidAction = 401
+	upnpInvalidArgs   = 402
+	upnpActionFailed  = 501
+	upnpNoSuchObject  = 701
+)
+
+func (dh *DLNAHandler) serveConnectionManager(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		httputil.ErrorRouting(rw, req)
+		return
+	}
+	a, err := parseSOAP(req.Body)
+	if err != nil {
+		soapFail(rw, upnpInvalidAction, err.Error())
+		return
+	}
+	switch a.Name {
+	case "GetProtocolInfo":
+		soapReply(rw, connectionManagerService, a.Name,
+			"Source", "http-get:*:video/*:*,http-get:*:audio/*:*,http-get:*:image/*:*",
+			"Sink", "")
+	case "GetCurrentConnectionIDs":
+		soapReply(rw, connectionManagerService, a.Name, "ConnectionIDs", "0")
+	case "GetCurrentConnectionInfo":
+		soapReply(rw, connectionManagerService, a.Name,
+			"RcsID", "-1", "AVTransportID", "-1", "ProtocolInfo", "",
+			"PeerConnectionManager", "", "PeerConnectionID", "-1",
+			"Direction", "Output", "Status", "OK")
+	default:
+		soapFail(rw, upnpInvalidAction, "Invalid Action")
+	}
+}
+
+func (dh *DLNAHandler) serveContentDirectory(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		httputil.ErrorRouting(rw, req)
+		return
+	}
+	a, err := parseSOAP(req.Body)
+	if err != nil {
+		soapFail(rw, upnpInvalidAction, err.Error())
+		return
+	}
+	switch a.Name {
+	case "GetSystemUpdateID":
+		soapReply(rw, contentDirectoryService, a.Name, "Id", "0")
+	case "GetSearchCapabilities":
+		soapReply(rw, contentDirectoryService, a.Name, "SearchCaps", "")
+	case "GetSortCapabilities":
+		soapReply(rw, contentDirectoryService, a.Name, "SortCaps", "")
+	case "Browse":
+		dh.browse(rw, a)
+	default:
+		soapFail(rw, upnpInvalidAction, "Invalid Action")
+	}
+}
+
+func (dh *DLNAHandler) browse(rw http.ResponseWriter, a *soapAction) {
+	id := a.Args["ObjectID"]
+	start, _ := strconv.Atoi(a.Args["StartingIndex"])
+	count, _ := strconv.Atoi(a.Args["RequestedCount"])
+	if start < 0 || count < 0 {
+		soapFail(rw, upnpInvalidArgs, "Invalid Args")
+		return
+	}
+	var objs []*dlnaObject
+	switch a.Args["BrowseFlag"] {
+	case "BrowseMetadata":
+		o, err := dh.object(id)
+		if err != nil {
+			soapFail(rw, upnpNoSuchObject, "No such object")
+			return
+		}
+		objs = []*dlnaObject{o}
+	case "BrowseDirectChildren":
+		var err error
+		objs, err = dh.children(id)
+		if err == os.ErrNotExist {
+			soapFail(rw, upnpNoSuchObject, "No such object")
+			return
+		}
+		if err != nil {
+			log.Printf("dlna: error browsing %q: %v", id, err)
+			soapFail(rw, upnpActionFailed, "Action Failed")
+			return
+		}
+	default:
+		soapFail(rw, upnpInvalidArgs, "Invalid Args")
+		return
+	}
+	total := len(objs)
+	if start > len(objs) {
+		start = len(objs)
+	}
+	objs = objs[start:]
+	if count > 0 && count < len(objs) {
+		objs = objs[:count]
+	}
+	didl, err := dh.didl(objs)
+	if err != nil {
+		soapFail(rw, upnpActionFailed, "Action Failed")
+		return
+	}
+	soapReply(rw, contentDirectoryService, a.Name,
+		"Result", didl,
+		"NumberReturned", strconv.Itoa(len(objs)),
+		"TotalMatches", strconv.Itoa(total),
+		"UpdateID", "0")
+}
+
+// A dlnaObject is an item or container of the content directory.
+type dlnaObject struct {
+	id, parentID string
+	title        string
+	container    bool
+
+	// For items:
+	file  *blobref.BlobRef
+	fi    *search.FileInfo
+	image *search.ImageInfo
+}
+
+var dlnaTopContainers = []struct{ id, title string }{
+	{"video", "Videos"},
+	{"audio", "Music"},
+	{"image", "Pictures"},
+	{"roots", "Folders"},
+}
+
+// splitDLNAID returns the parent of the object id and the permanode
+// it names, if any.
+func splitDLNAID(id string) (parent string, pn *blobref.BlobRef) {
+	i := strings.LastIndex(id, "/")
+	if i < 0 {
+		return "0", nil
+	}
+	return id[:i], blobref.Parse(id[i+1:])
+}
+
+func (dh *DLNAHandler) object(id string) (*dlnaObject, error) {
+	if id == "0" {
+		return &dlnaObject{id: "0", parentID: "-1", title: dh.friendlyName, container: true}, nil
+	}
+	for _, c := range dlnaTopContainers {
+		if id == c.id {
+			return &dlnaObject{id: c.id, parentID: "0", title: c.title, container: true}, nil
+		}
+	}
+	parent, pn := splitDLNAID(id)
+	if pn == nil {
+		return nil, os.ErrNotExist
+	}
+	des, err := dh.describe(pn)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	if o := dlnaPermanode(parent, des); o != nil {
+		return o, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// mediaType returns the media type, "video", "audio" or "image", of a
+// file's MIME type, or the empty string.
+func mediaType(mimeType string) string {
+	for _, t := range []string{"video", "audio", "image"} {
+		if strings.HasPrefix(mimeType, t+"/") {
+			return t
+		}
+	}
+	return ""
+}
+
+// dlnaPermanode returns the object for the described permanode des,
+// under parent, or nil if it's neither a media file nor a container.
+func dlnaPermanode(parent string, des *search.DescribedBlob) *dlnaObject {
+	o := &dlnaObject{id: parent + "/" + des.BlobRef.String(), parentID: parent, title: des.Title()}
+	if o.title == "" {
+		o.title = des.BlobRef.String()
+	}
+	if path, fi, ok := des.PermanodeFile(); ok {
+		if mediaType(fi.MimeType) == "" {
+			return nil
+		}
+		o.file, o.fi = path[len(path)-1], fi
+		o.image = des.PeerBlob(o.file).Image
+		return o
+	}
+	if _, ok := des.ContentRef(); ok {
+		return nil
+	}
+	o.container = true
+	return o
+}
+
+func (dh *DLNAHandler) describe(br *blobref.BlobRef) (*search.DescribedBlob, error) {
+	dr := dh.Search.NewDescribeRequest()
+	dr.Describe(br, 3)
+	res, err := dr.Result()
+	if err != nil {
+		return nil, err
+	}
+	des, ok := res[br.String()]
+	if !ok || des.Permanode == nil {
+		return nil, os.ErrNotExist
+	}
+	return des, nil
+}
+
+// describeAll describes the permanodes pns, each with its content.
+func (dh *DLNAHandler) describeAll(pns []*blobref.BlobRef) ([]*search.DescribedBlob, error) {
+	dr := dh.Search.NewDescribeRequest()
+	for _, pn := range pns {
+		dr.Describe(pn, 2)
+	}
+	res, err := dr.Result()
+	if err != nil {
+		return nil, err
+	}
+	var all []*search.DescribedBlob
+	for _, pn := range pns {
+		if des, ok := res[pn.String()]; ok && des.Permanode != nil {
+			all = append(all, des)
+		}
+	}
+	return all, nil
+}
+
+func (dh *DLNAHandler) children(id string) ([]*dlnaObject, error) {
+	idx := dh.Search.Index()
+	owner := dh.Search.Owner()
+	switch id {
+	case "0":
+		var objs []*dlnaObject
+		for _, c := range dlnaTopContainers {
+			objs = append(objs, &dlnaObject{id: c.id, parentID: "0", title: c.title, container: true})
+		}
+		return objs, nil
+	case "video", "audio", "image":
+		ch := make(chan *search.Result, 100)
+		errch := make(chan error, 1)
+		go func() {
+			errch <- idx.GetRecentPermanodes(ch, owner, maxDLNAItems)
+		}()
+		var pns []*blobref.BlobRef
+		for res := range ch {
+			pns = append(pns, res.BlobRef)
+		}
+		if err := <-errch; err != nil {
+			return nil, err
+		}
+		all, err := dh.describeAll(pns)
+		if err != nil {
+			return nil, err
+		}
+		var objs []*dlnaObject
+		for _, des := range all {
+			if o := dlnaPermanode(id, des); o != nil && !o.container && mediaType(o.fi.MimeType) == id {
+				objs = append(objs, o)
+			}
+		}
+		return objs, nil
+	case "roots":
+		ch := make(chan *blobref.BlobRef, 100)
+		errch := make(chan error, 1)
+		go func() {
+			errch <- idx.SearchPermanodesWithAttr(ch, &search.PermanodeByAttrRequest{
+				Signer:    owner,
+				Attribute: "camliRoot",
+			})
+		}()
+		var pns []*blobref.BlobRef
+		for br := range ch {
+			pns = append(pns, br)
+		}
+		if err := <-errch; err != nil {
+			return nil, err
+		}
+		all, err := dh.describeAll(pns)
+		if err != nil {
+			return nil, err
+		}
+		var objs []*dlnaObject
+		for _, des := range all {
+			o := dlnaPermanode(id, des)
+			if o == nil || !o.container {
+				continue
+			}
+			if name := des.Permanode.Attr.Get("camliRoot"); name != "" && des.Permanode.Attr.Get("title") == "" {
+				o.title = name
+			}
+			objs = append(objs, o)
+		}
+		return objs, nil
+	}
+
+	_, pn := splitDLNAID(id)
+	if pn == nil {
+		return nil, os.ErrNotExist
+	}
+	des, err := dh.describe(pn)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	var kids []*blobref.BlobRef
+	for _, m := range des.Permanode.Attr["camliMember"] {
+		if br := blobref.Parse(m); br != nil {
+			kids = append(kids, br)
+		}
+	}
+	for attr, vals := range des.Permanode.Attr {
+		if strings.HasPrefix(attr, "camliPath:") && len(vals) > 0 {
+			if br := blobref.Parse(vals[0]); br != nil {
+				kids = append(kids, br)
+			}
+		}
+	}
+	all, err := dh.describeAll(kids)
+	if err != nil {
+		return nil, err
+	}
+	var objs []*dlnaObject
+	for _, kdes := range all {
+		if o := dlnaPermanode(id, kdes); o != nil {
+			objs = append(objs, o)
+		}
+	}
+	return objs, nil
+}
+
+type didlLite struct {
+	XMLName    xml.Name        `xml:"DIDL-Lite"`
+	Xmlns      string          `xml:"xmlns,attr"`
+	XmlnsDC    string          `xml:"xmlns:dc,attr"`
+	XmlnsUPnP  string          `xml:"xmlns:upnp,attr"`
+	Containers []didlContainer `xml:"container"`
+	Items      []didlItem      `xml:"item"`
+}
+
+type didlContainer struct {
+	ID         string `xml:"id,attr"`
+	ParentID   string `xml:"parentID,attr"`
+	Restricted int    `xml:"restricted,attr"`
+	Title      string `xml:"dc:title"`
+	Class      string `xml:"upnp:class"`
+}
+
+type didlItem struct {
+	ID         string  `xml:"id,attr"`
+	ParentID   string  `xml:"parentID,attr"`
+	Restricted int     `xml:"restricted,attr"`
+	Title      string  `xml:"dc:title"`
+	Class      string  `xml:"upnp:class"`
+	Res        didlRes `xml:"res"`
+}
+
+type didlRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Size         int64  `xml:"size,attr,omitempty"`
+	Resolution   string `xml:"resolution,attr,omitempty"`
+	URL          string `xml:",chardata"`
+}
+
+var dlnaItemClass = map[string]string{
+	"video": "object.item.videoItem",
+	"audio": "object.item.audioItem.musicTrack",
+	"image": "object.item.imageItem.photo",
+}
+
+// didl returns the DIDL-Lite document describing objs.
+func (dh *DLNAHandler) didl(objs []*dlnaObject) (string, error) {
+	d := &didlLite{
+		Xmlns:     "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/",
+		XmlnsDC:   "http://purl.org/dc/elements/1.1/",
+		XmlnsUPnP: "urn:schemas-upnp-org:metadata-1-0/upnp/",
+	}
+	for _, o := range objs {
+		if o.container {
+			d.Containers = append(d.Containers, didlContainer{
+				ID:         o.id,
+				ParentID:   o.parentID,
+				Restricted: 1,
+				Title:      o.title,
+				Class:      "object.container.storageFolder",
+			})
+			continue
+		}
+		res := didlRes{
+			ProtocolInfo: "http-get:*:" + o.fi.MimeType + ":" + dlnaFeatures,
+			Size:         o.fi.Size,
+			URL:          dh.baseURL + "media/" + o.file.String() + "/" + mediaFileName(o.fi),
+		}
+		if o.image != nil && o.image.Width > 0 {
+			res.Resolution = fmt.Sprintf("%dx%d", o.image.Width, o.image.Height)
+		}
+		d.Items = append(d.Items, didlItem{
+			ID:         o.id,
+			ParentID:   o.parentID,
+			Restricted: 1,
+			Title:      o.title,
+			Class:      dlnaItemClass[mediaType(o.fi.MimeType)],
+			Res:        res,
+		})
+	}
+	b, err := xml.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// mediaFileName returns the last path element of a media URL: the
+// file's name, which some players want for its extension.
+func mediaFileName(fi *search.FileInfo) string {
+	name := fi.FileName
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" {
+		return "file"
+	}
+	return strings.Replace(strings.Replace(name, "%", "%25", -1), " ", "%20", -1)
+}
+
+const dlnaDeviceDescription = `<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+    <friendlyName>%s</friendlyName>
+    <manufacturer>Camlistore</manufacturer>
+    <manufacturerURL>http://camlistore.org/</manufacturerURL>
+    <modelName>Camlistore</modelName>
+    <modelNumber>%s</modelNumber>
+    <UDN>uuid:%s</UDN>
+    <dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:ContentDirectory:1</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>ContentDirectory.xml</SCPDURL>
+        <controlURL>control/ContentDirectory</controlURL>
+        <eventSubURL>event/ContentDirectory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:ConnectionManager:1</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>ConnectionManager.xml</SCPDURL>
+        <controlURL>control/ConnectionManager</controlURL>
+        <eventSubURL>event/ConnectionManager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>
+`
+
+const dlnaContentDirectorySCPD = `<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>GetSearchCapabilities</name><argumentList>
+      <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSortCapabilities</name><argumentList>
+      <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSystemUpdateID</name><argumentList>
+      <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>Browse</name><argumentList>
+      <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+      <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+      <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+      <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+      <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+      <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+      <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
+
+const dlnaConnectionManagerSCPD = `<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>GetProtocolInfo</name><argumentList>
+      <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+      <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetCurrentConnectionIDs</name><argumentList>
+      <argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetCurrentConnectionInfo</name><argumentList>
+      <argument><name>ConnectionID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+      <argument><name>RcsID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_RcsID</relatedStateVariable></argument>
+      <argument><name>AVTransportID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_AVTransportID</relatedStateVariable></argument>
+      <argument><name>ProtocolInfo</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ProtocolInfo</relatedStateVariable></argument>
+      <argument><name>PeerConnectionManager</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionManager</relatedStateVariable></argument>
+      <argument><name>PeerConnectionID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+      <argument><name>Direction</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Direction</relatedStateVariable></argument>
+      <argument><name>Status</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionStatus</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionStatus</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>OK</allowedValue><allowedValue>ContentFormatMismatch</allowedValue><allowedValue>InsufficientBandwidth</allowedValue><allowedValue>UnreliableChannel</allowedValue><allowedValue>Unknown</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionManager</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Direction</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>Input</allowedValue><allowedValue>Output</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionID</name><dataType>i4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_AVTransportID</name><dataType>i4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_RcsID</name><dataType>i4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>
+`
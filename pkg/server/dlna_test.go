@@ -0,0 +1,197 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+	"camlistore.org/pkg/test"
+)
+
+func TestParseSOAP(t *testing.T) {
+	body := `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:Browse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1">
+<ObjectID>video</ObjectID><BrowseFlag>BrowseDirectChildren</BrowseFlag>
+<Filter>*</Filter><StartingIndex>0</StartingIndex><RequestedCount>10</RequestedCount>
+<SortCriteria></SortCriteria></u:Browse></s:Body></s:Envelope>`
+	a, err := parseSOAP(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "Browse" || a.Args["ObjectID"] != "video" || a.Args["RequestedCount"] != "10" {
+		t.Errorf("got %+v", a)
+	}
+}
+
+func TestSplitDLNAID(t *testing.T) {
+	tests := []struct {
+		id, parent, pn string
+	}{
+		{"video", "0", ""},
+		{"video/foo-abc", "video", "foo-abc"},
+		{"roots/foo-abc/foo-def", "roots/foo-abc", "foo-def"},
+	}
+	for _, tt := range tests {
+		parent, pn := splitDLNAID(tt.id)
+		if parent != tt.parent || pn.String() != (blobref.Parse(tt.pn)).String() {
+			t.Errorf("splitDLNAID(%q) = %q, %v; want %q, %q", tt.id, parent, pn, tt.parent, tt.pn)
+		}
+	}
+}
+
+func TestIsLANAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:1234":   true,
+		"192.168.1.20:80":  true,
+		"10.1.2.3:80":      true,
+		"172.20.0.1:80":    true,
+		"172.32.0.1:80":    false,
+		"8.8.8.8:53":       false,
+		"[::1]:80":         true,
+		"[fd00::1]:80":     true,
+		"[2001:db8::1]:80": false,
+	} {
+		if got := isLANAddr(addr); got != want {
+			t.Errorf("isLANAddr(%q) = %v; want %v", addr, got, want)
+		}
+	}
+}
+
+func TestDIDL(t *testing.T) {
+	dh := &DLNAHandler{baseURL: "http://192.168.1.10:3179/dlna/"}
+	didl, err := dh.didl([]*dlnaObject{
+		{id: "roots/foo-abc", parentID: "roots", title: "Trips", container: true},
+		{id: "video/foo-def", parentID: "video", title: "Beach & sun",
+			file: blobref.MustParse("foo-123"),
+			fi:   &search.FileInfo{Size: 42, FileName: "beach day.mp4", MimeType: "video/mp4"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"`,
+		`<container id="roots/foo-abc" parentID="roots" restricted="1"><dc:title>Trips</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+		`<dc:title>Beach &amp; sun</dc:title><upnp:class>object.item.videoItem</upnp:class>`,
+		`size="42">http://192.168.1.10:3179/dlna/media/foo-123/beach%20day.mp4</res>`,
+	} {
+		if !strings.Contains(didl, want) {
+			t.Errorf("DIDL lacks %s; got:\n%s", want, didl)
+		}
+	}
+}
+
+func TestSSDPMatches(t *testing.T) {
+	a := &ssdpAnnouncer{uuid: "1234", types: []string{"urn:schemas-upnp-org:device:MediaServer:1"}}
+	if got := len(a.matches("ssdp:all")); got != 3 {
+		t.Errorf("ssdp:all matched %d targets; want 3", got)
+	}
+	if got := a.matches("urn:schemas-upnp-org:device:MediaServer:1"); len(got) != 1 {
+		t.Errorf("MediaServer matched %v", got)
+	}
+	if got := a.matches("urn:schemas-upnp-org:device:Printer:1"); len(got) != 0 {
+		t.Errorf("Printer matched %v", got)
+	}
+	if got, want := a.usn("upnp:rootdevice"), "uuid:1234::upnp:rootdevice"; got != want {
+		t.Errorf("usn = %q; want %q", got, want)
+	}
+	if got, want := a.usn("uuid:1234"), "uuid:1234"; got != want {
+		t.Errorf("usn = %q; want %q", got, want)
+	}
+}
+
+// fileInfoIndex is a FakeIndex knowing the FileInfo of files.
+type fileInfoIndex struct {
+	*test.FakeIndex
+	files map[string]*search.FileInfo
+}
+
+func (fi *fileInfoIndex) GetFileInfo(fileRef *blobref.BlobRef) (*search.FileInfo, error) {
+	if inf, ok := fi.files[fileRef.String()]; ok {
+		return inf, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func TestDLNAMedia(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-dlna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sto, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := &fileInfoIndex{FakeIndex: test.NewFakeIndex(), files: make(map[string]*search.FileInfo)}
+	addFile := func(name, mimeType string) *blobref.BlobRef {
+		br, err := schema.WriteFileFromReader(sto, name, strings.NewReader("contents of "+name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.files[br.String()] = &search.FileInfo{FileName: name, MimeType: mimeType}
+		return br
+	}
+	movie := addFile("beach.mp4", "video/mp4")
+	secret := addFile("passwords.txt", "text/plain")
+	dh := &DLNAHandler{
+		Storage: sto,
+		Search:  search.NewHandler(idx, blobref.MustParse("foo-123")),
+		lanOnly: true,
+	}
+	get := func(file *blobref.BlobRef, remoteAddr string, hdr ...string) int {
+		suffix := "media/" + file.String() + "/x"
+		req, _ := http.NewRequest("GET", "http://192.168.1.10:3179/dlna/"+suffix, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-PrefixHandler-PathSuffix", suffix)
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		rec := httptest.NewRecorder()
+		dh.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tt := range []struct {
+		file       *blobref.BlobRef
+		remoteAddr string
+		hdr        []string
+		want       int
+	}{
+		{movie, "192.168.1.20:5000", nil, 200},
+		{movie, "127.0.0.1:5000", nil, 200},
+		{movie, "8.8.8.8:5000", nil, http.StatusForbidden},
+		// Through a proxy on the host, for any client.
+		{movie, "127.0.0.1:5000", []string{"X-Forwarded-For", "203.0.113.5"}, http.StatusForbidden},
+		{movie, "127.0.0.1:5000", []string{"Forwarded", "for=203.0.113.5"}, http.StatusForbidden},
+		// Not a media file.
+		{secret, "192.168.1.20:5000", nil, http.StatusNotFound},
+	} {
+		if got := get(tt.file, tt.remoteAddr, tt.hdr...); got != tt.want {
+			t.Errorf("GET of %s from %s with %q: status %d; want %d", tt.file, tt.remoteAddr, tt.hdr, got, tt.want)
+		}
+	}
+}
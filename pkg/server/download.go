@@ -17,10 +17,9 @@ limitations under the License.
 package server
 
 import (
-	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"os"
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
@@ -51,10 +50,12 @@ func (dh *DownloadHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request,
 	}
 	defer fr.Close()
 
-	schema := fr.FileSchema()
-	rw.Header().Set("Content-Length", fmt.Sprintf("%d", schema.SumPartsSize()))
+	size := int64(fr.FileSchema().SumPartsSize())
+	content := io.NewSectionReader(fr, 0, size)
 
-	mimeType, reader := magic.MimeTypeFromReader(fr)
+	var hdr [1024]byte
+	n, _ := io.ReadFull(content, hdr[:])
+	mimeType := magic.FileMimeType(fr.FileSchema().FileNameString(), hdr[:n])
 	if dh.ForceMime != "" {
 		mimeType = dh.ForceMime
 	}
@@ -71,31 +72,20 @@ func (dh *DownloadHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request,
 	}
 
 	if req.Method == "HEAD" {
-		vbr := blobref.Parse(req.FormValue("verifycontents"))
-		if vbr == nil {
-			return
+		if vbr := blobref.Parse(req.FormValue("verifycontents")); vbr != nil {
+			if hash := vbr.Hash(); hash != nil {
+				io.Copy(hash, io.NewSectionReader(fr, 0, size)) // ignore errors, caught later
+				if vbr.HashMatches(hash) {
+					rw.Header().Set("X-Camli-Contents", vbr.String())
+				}
+			}
 		}
-		hash := vbr.Hash()
-		if hash == nil {
-			return
-		}
-		io.Copy(hash, reader) // ignore errors, caught later
-		if vbr.HashMatches(hash) {
-			rw.Header().Set("X-Camli-Contents", vbr.String())
-		}
-		return
-	}
-
-	n, err := io.Copy(rw, reader)
-	log.Printf("For %q request of %s: copied %d, %v", req.Method, req.URL.Path, n, err)
-	if err != nil {
-		log.Printf("error serving download of file schema %s: %v", file, err)
-		return
-	}
-	if size := schema.SumPartsSize(); n != int64(size) {
-		log.Printf("error serving download of file schema %s: sent %d, expected size of %d",
-			file, n, size)
-		return
 	}
 
+	// A file schema blob's contents never change, so its blobref
+	// is a strong ETag. ServeContent handles conditional and Range
+	// requests.
+	rw.Header().Set("ETag", `"`+file.String()+`"`)
+	content.Seek(0, os.SEEK_SET)
+	http.ServeContent(rw, req, "", fr.FileSchema().ModTime(), content)
 }
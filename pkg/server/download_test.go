@@ -0,0 +1,85 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/test"
+)
+
+func TestDownload(t *testing.T) {
+	const contents = "Hello, download"
+	fetcher := new(test.Fetcher)
+	file, err := schema.WriteFileFromReader(fetcher, "hello.txt", strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh := &DownloadHandler{Fetcher: fetcher}
+	serve := func(method, query string, hdr ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://example.com/ui/download/"+file.String()+query, nil)
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		rec := httptest.NewRecorder()
+		dh.ServeHTTP(rec, req, file)
+		return rec
+	}
+
+	rec := serve("GET", "")
+	etag := rec.HeaderMap.Get("ETag")
+	if rec.Code != 200 || rec.Body.String() != contents || etag != `"`+file.String()+`"` {
+		t.Fatalf("GET = %d, %q with ETag %q", rec.Code, rec.Body, etag)
+	}
+
+	rec = serve("GET", "", "Range", "bytes=7-14")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "download" ||
+		rec.HeaderMap.Get("Content-Range") != "bytes 7-14/15" {
+		t.Errorf("Range GET = %d, %q, Content-Range %q; want 206, download",
+			rec.Code, rec.Body, rec.HeaderMap.Get("Content-Range"))
+	}
+	if rec := serve("GET", "", "Range", "bytes=100-"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable Range GET = %d; want 416", rec.Code)
+	}
+
+	if rec := serve("GET", "", "If-None-Match", etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("If-None-Match GET = %d, %q; want 304", rec.Code, rec.Body)
+	}
+	if rec := serve("GET", "", "If-None-Match", `"sha1-0000000000000000000000000000000000000000"`); rec.Code != 200 {
+		t.Errorf("If-None-Match GET of another ETag = %d; want 200", rec.Code)
+	}
+
+	sum := blobref.SHA1FromString(contents)
+	if rec := serve("HEAD", "?verifycontents="+sum.String()); rec.Code != 200 ||
+		rec.HeaderMap.Get("X-Camli-Contents") != sum.String() {
+		t.Errorf("HEAD verifycontents = %d, X-Camli-Contents %q; want %s",
+			rec.Code, rec.HeaderMap.Get("X-Camli-Contents"), sum)
+	}
+	other := blobref.SHA1FromString("something else")
+	if rec := serve("HEAD", "?verifycontents="+other.String()); rec.HeaderMap.Get("X-Camli-Contents") != "" {
+		t.Errorf("HEAD verifycontents of other contents set X-Camli-Contents %q", rec.HeaderMap.Get("X-Camli-Contents"))
+	}
+
+	if rec := serve("POST", ""); rec.Code != 400 {
+		t.Errorf("POST = %d; want 400", rec.Code)
+	}
+}
@@ -0,0 +1,410 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"camlistore.org/pkg/audit"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/schema"
+)
+
+// GCHandler is the garbage collector of a storage. It removes the
+// permanodes and claims deleted by the owner's "delete" claims, the
+// claims of the deleted permanodes, and the blobs only they reference,
+// such as the files of their camliContent and the chunks of those.
+// Blobs referenced by nothing, such as files uploaded without a
+// permanode, are kept.
+//
+// Instead, the "root" parameters, which may be repeated, select the
+// roots of the collection: only the blobs they reference, directly or
+// not, and the claims of the permanodes among those, are kept.
+//
+// A GET reports the garbage without removing it; a POST removes it.
+//
+//   "/gc/": {
+//       "handler": "gc",
+//       "handlerArgs": {
+//           "storage": "/bs/",
+//           "owner": "sha1-xxx"
+//       }
+//   }
+type GCHandler struct {
+	storage blobserver.Storage
+	owner   *blobref.BlobRef
+
+	mu      sync.Mutex
+	running bool
+}
+
+const (
+	// maxSchemaBlobSize is the size of the largest blobs read as
+	// schema blobs, as ParseSuperset limits them.
+	maxSchemaBlobSize = 1 << 20
+
+	// gcAttempts is how many times a collection starts over when
+	// blobs are added to the storage while it finds the garbage,
+	// before giving up.
+	gcAttempts = 3
+)
+
+func init() {
+	blobserver.RegisterHandlerConstructor("gc", newGCFromConfig)
+}
+
+func newGCFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	storagePrefix := conf.RequiredString("storage")
+	ownerBlobStr := conf.RequiredString("owner")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	sto, err := ld.GetStorage(storagePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("gc handler's storage %q error: %v", storagePrefix, err)
+	}
+	owner := blobref.Parse(ownerBlobStr)
+	if owner == nil {
+		return nil, fmt.Errorf("gc handler's owner %q is not a valid blobref", ownerBlobStr)
+	}
+	return &GCHandler{storage: sto, owner: owner}, nil
+}
+
+// A gcBlob is what the collector knows of a blob of the storage.
+type gcBlob struct {
+	size      int64
+	camliType string   // of a schema blob
+	refs      []string // the blobrefs in a schema blob
+	permanode string   // of a claim
+	deletes   string   // the target of a valid delete claim by the owner
+}
+
+// A GCReport is the result of a collection.
+type GCReport struct {
+	Blobs       int         `json:"blobs"` // in the storage
+	Garbage     []GCGarbage `json:"garbage"`
+	GarbageSize int64       `json:"garbageSize"`
+	Removed     bool        `json:"removed"` // false for dry runs
+}
+
+type GCGarbage struct {
+	BlobRef string `json:"blobRef"`
+	Size    int64  `json:"size"`
+	Type    string `json:"type,omitempty"` // camliType, or "" if not a schema blob
+}
+
+func (gh *GCHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var dryRun bool
+	switch req.Method {
+	case "GET", "HEAD":
+		dryRun = true
+	case "POST":
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var roots []string
+	req.ParseForm()
+	for _, s := range req.Form["root"] {
+		br := blobref.Parse(s)
+		if br == nil {
+			http.Error(rw, fmt.Sprintf("invalid root blobref %q", s), http.StatusBadRequest)
+			return
+		}
+		roots = append(roots, br.String())
+	}
+	gh.mu.Lock()
+	if gh.running {
+		gh.mu.Unlock()
+		http.Error(rw, "garbage collection already running", http.StatusConflict)
+		return
+	}
+	gh.running = true
+	gh.mu.Unlock()
+	defer func() {
+		gh.mu.Lock()
+		gh.running = false
+		gh.mu.Unlock()
+	}()
+
+	report, err := gh.collect(roots, dryRun)
+	if err != nil {
+		httputil.ServerError(rw, req, err)
+		return
+	}
+	if report.Removed && len(report.Garbage) > 0 {
+		audit.Log(req, audit.EventRemove, "", fmt.Sprintf("gc of %d blobs, %d bytes", len(report.Garbage), report.GarbageSize))
+	}
+	httputil.ReturnJSON(rw, report)
+}
+
+// collect finds the garbage of the storage, from roots if not nil, and
+// removes it unless dryRun.
+func (gh *GCHandler) collect(roots []string, dryRun bool) (*GCReport, error) {
+	for attempt := 1; ; attempt++ {
+		blobs, err := gh.scan()
+		if err != nil {
+			return nil, err
+		}
+		report := &GCReport{Blobs: len(blobs)}
+		for _, br := range findGarbage(blobs, roots) {
+			b := blobs[br]
+			report.Garbage = append(report.Garbage, GCGarbage{BlobRef: br, Size: b.size, Type: b.camliType})
+			report.GarbageSize += b.size
+		}
+		if dryRun || len(report.Garbage) == 0 {
+			return report, nil
+		}
+		// A blob added since the scan may reference garbage,
+		// such as a new file reusing the chunks of a deleted one.
+		added, err := gh.addedSince(blobs)
+		if err != nil {
+			return nil, err
+		}
+		if added {
+			if attempt == gcAttempts {
+				return nil, fmt.Errorf("gc: storage changed during each of %d attempts", gcAttempts)
+			}
+			continue
+		}
+		if err := gh.remove(report.Garbage); err != nil {
+			return nil, err
+		}
+		report.Removed = true
+		log.Printf("gc: removed %d blobs, %d bytes", len(report.Garbage), report.GarbageSize)
+		return report, nil
+	}
+}
+
+// scan reads every blob of the storage.
+func (gh *GCHandler) scan() (map[string]*gcBlob, error) {
+	blobs := make(map[string]*gcBlob)
+	err := enumerateAll(gh.storage, func(sb blobref.SizedBlobRef) error {
+		b, err := gh.readBlob(sb)
+		if err != nil {
+			return err
+		}
+		blobs[sb.BlobRef.String()] = b
+		return nil
+	})
+	return blobs, err
+}
+
+func (gh *GCHandler) readBlob(sb blobref.SizedBlobRef) (*gcBlob, error) {
+	b := &gcBlob{size: sb.Size}
+	if sb.Size > maxSchemaBlobSize {
+		return b, nil
+	}
+	rc, _, err := gh.storage.FetchStreaming(sb.BlobRef)
+	if err != nil {
+		return nil, fmt.Errorf("gc: fetching %s: %v", sb.BlobRef, err)
+	}
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(rc, maxSchemaBlobSize))
+	if err != nil {
+		return nil, fmt.Errorf("gc: reading %s: %v", sb.BlobRef, err)
+	}
+	if !schema.LikelySchemaBlob(buf) {
+		return b, nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return b, nil
+	}
+	b.camliType, _ = m["camliType"].(string)
+	b.refs = jsonBlobRefs(m, nil)
+	if m["camliType"] != "claim" {
+		return b, nil
+	}
+	b.permanode, _ = m["permaNode"].(string)
+	if m["claimType"] != schema.DeleteClaim {
+		return b, nil
+	}
+	vr := jsonsign.NewVerificationRequest(string(buf), gh.storage)
+	if !vr.Verify() {
+		log.Printf("gc: ignoring delete claim %s: %v", sb.BlobRef, vr.Err)
+		return b, nil
+	}
+	if vr.CamliSigner.String() != gh.owner.String() {
+		log.Printf("gc: ignoring delete claim %s, signed by %s, not the owner", sb.BlobRef, vr.CamliSigner)
+		return b, nil
+	}
+	if target := blobref.Parse(fmt.Sprint(m["target"])); target != nil {
+		b.deletes = target.String()
+	}
+	return b, nil
+}
+
+// jsonBlobRefs appends to refs the strings of the JSON value v that
+// are blobrefs.
+func jsonBlobRefs(v interface{}, refs []string) []string {
+	switch v := v.(type) {
+	case string:
+		if br := blobref.Parse(v); br != nil {
+			refs = append(refs, br.String())
+		}
+	case []interface{}:
+		for _, e := range v {
+			refs = jsonBlobRefs(e, refs)
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			refs = jsonBlobRefs(e, refs)
+		}
+	}
+	return refs
+}
+
+// findGarbage returns, sorted, the blobs that are deleted, or only
+// referenced by garbage. If roots is not nil, the blobs not reachable
+// from roots are garbage too.
+func findGarbage(blobs map[string]*gcBlob, roots []string) []string {
+	deletes := make(map[string]string) // delete claim => target
+	targeted := make(map[string]bool)
+	for br, b := range blobs {
+		if b.deletes != "" {
+			deletes[br] = b.deletes
+			targeted[b.deletes] = true
+		}
+	}
+	dead := make(map[string]bool)
+	for claim, target := range deletes {
+		// A delete claim that is itself deleted is undone.
+		if !targeted[claim] {
+			dead[target] = true
+		}
+	}
+	claims := make(map[string][]string) // permanode => its claims
+	for br, b := range blobs {
+		if b.permanode != "" {
+			if dead[b.permanode] {
+				dead[br] = true
+			}
+			claims[b.permanode] = append(claims[b.permanode], br)
+		}
+	}
+
+	live := make(map[string]bool)
+	stack := append([]string(nil), roots...)
+	if roots == nil {
+		referenced := make(map[string]bool)
+		for _, b := range blobs {
+			for _, ref := range b.refs {
+				referenced[ref] = true
+			}
+		}
+		for br := range blobs {
+			if !referenced[br] && !dead[br] {
+				stack = append(stack, br)
+			}
+		}
+	}
+	for len(stack) > 0 {
+		br := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		b, ok := blobs[br]
+		if !ok || live[br] || dead[br] {
+			continue
+		}
+		live[br] = true
+		stack = append(stack, b.refs...)
+		stack = append(stack, claims[br]...)
+	}
+
+	var garbage []string
+	for br := range blobs {
+		if !live[br] {
+			garbage = append(garbage, br)
+		}
+	}
+	sort.Strings(garbage)
+	return garbage
+}
+
+// addedSince reports whether the storage has blobs not in blobs.
+func (gh *GCHandler) addedSince(blobs map[string]*gcBlob) (bool, error) {
+	added := false
+	err := enumerateAll(gh.storage, func(sb blobref.SizedBlobRef) error {
+		if _, ok := blobs[sb.BlobRef.String()]; !ok {
+			added = true
+		}
+		return nil
+	})
+	return added, err
+}
+
+func (gh *GCHandler) remove(garbage []GCGarbage) error {
+	const batch = 100
+	for len(garbage) > 0 {
+		n := batch
+		if n > len(garbage) {
+			n = len(garbage)
+		}
+		brs := make([]*blobref.BlobRef, 0, n)
+		for _, g := range garbage[:n] {
+			brs = append(brs, blobref.MustParse(g.BlobRef))
+		}
+		if err := gh.storage.RemoveBlobs(brs); err != nil {
+			return fmt.Errorf("gc: removing blobs: %v", err)
+		}
+		garbage = garbage[n:]
+	}
+	return nil
+}
+
+// enumerateAll calls fn with each blob of e, in order, stopping at
+// the first error.
+func enumerateAll(e blobserver.BlobEnumerator, fn func(blobref.SizedBlobRef) error) error {
+	const batch = 1000
+	after := ""
+	for {
+		ch := make(chan blobref.SizedBlobRef)
+		errch := make(chan error, 1)
+		go func() {
+			errch <- e.EnumerateBlobs(ch, after, batch, 0)
+		}()
+		got := 0
+		var fnErr error
+		for sb := range ch {
+			got++
+			after = sb.BlobRef.String()
+			if fnErr == nil {
+				fnErr = fn(sb)
+			}
+		}
+		if err := <-errch; err != nil {
+			return err
+		}
+		if fnErr != nil {
+			return fnErr
+		}
+		if got < batch {
+			return nil
+		}
+	}
+}
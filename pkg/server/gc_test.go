@@ -0,0 +1,152 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/schema"
+)
+
+const testSecretRing = "../jsonsign/testdata/test-secring.gpg"
+
+func TestGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sto, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(s string) *blobref.BlobRef {
+		br := blobref.SHA1FromString(s)
+		if _, err := sto.ReceiveBlob(br, strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+		return br
+	}
+	entity, err := jsonsign.EntityFromSecring("26F5ABDA", testSecretRing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := jsonsign.ArmoredPublicKey(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := put(armored)
+	sign := func(m schema.Map) *blobref.BlobRef {
+		m["camliSigner"] = owner.String()
+		unsigned, err := m.JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr := &jsonsign.SignRequest{
+			UnsignedJSON:  unsigned,
+			Fetcher:       sto,
+			EntityFetcher: &jsonsign.FileEntityFetcher{File: testSecretRing},
+		}
+		signed, err := sr.Sign()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return put(signed)
+	}
+
+	chunk := put("some file contents")
+	file := put(fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "fileName": "foo.txt", "parts": [{"blobRef": %q, "size": 18}]}`, chunk))
+	loose := put("uploaded without a permanode")
+	deleted := sign(schema.NewUnsignedPermanode())
+	content := sign(schema.NewSetAttributeClaim(deleted, "camliContent", file.String()))
+	kept := sign(schema.NewUnsignedPermanode())
+	title := sign(schema.NewSetAttributeClaim(kept, "title", "kept"))
+	del := sign(schema.NewDeleteClaim(deleted))
+	undone := sign(schema.NewDeleteClaim(kept))
+	undo := sign(schema.NewDeleteClaim(undone))
+
+	gh := &GCHandler{storage: sto, owner: owner}
+	report, err := gh.collect(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	types := make(map[string]string)
+	for _, g := range report.Garbage {
+		got = append(got, g.BlobRef)
+		types[g.BlobRef] = g.Type
+	}
+	want := []string{deleted.String(), content.String(), file.String(), chunk.String(), undone.String()}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("garbage = %v; want %v", got, want)
+	}
+	if report.Removed {
+		t.Error("dry run removed blobs")
+	}
+	if types[file.String()] != "file" || types[deleted.String()] != "permanode" || types[chunk.String()] != "" {
+		t.Errorf("garbage types = %v", types)
+	}
+
+	// Only the blobs reachable from the roots, with the claims of
+	// their permanodes, are kept.
+	report, err = gh.collect([]string{kept.String()}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, g := range report.Garbage {
+		got = append(got, g.BlobRef)
+	}
+	rootsWant := []string{chunk.String(), file.String(), loose.String(), deleted.String(), content.String(), del.String(), undone.String(), undo.String()}
+	sort.Strings(rootsWant)
+	if !reflect.DeepEqual(got, rootsWant) {
+		t.Errorf("garbage from root %s = %v; want %v", kept, got, rootsWant)
+	}
+	if _, err := blobserver.StatBlob(sto, chunk); err != nil {
+		t.Errorf("after dry run, chunk stat = %v", err)
+	}
+
+	report, err = gh.collect(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Removed || len(report.Garbage) != len(want) {
+		t.Errorf("collection report = %+v; want %d blobs removed", report, len(want))
+	}
+	for _, br := range []*blobref.BlobRef{deleted, content, file, chunk, undone} {
+		if _, err := blobserver.StatBlob(sto, br); err != os.ErrNotExist {
+			t.Errorf("after collection, stat of garbage %s = %v; want os.ErrNotExist", br, err)
+		}
+	}
+	for _, br := range []*blobref.BlobRef{owner, loose, kept, title, del, undo} {
+		if _, err := blobserver.StatBlob(sto, br); err != nil {
+			t.Errorf("after collection, stat of live %s = %v", br, err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+// HealthHandler is an unauthenticated health check for load
+// balancers. It stats a blob in each of its configured storages,
+// including indexes, and replies "ok" if they all answer within the
+// timeout, else 503. The failures are only logged.
+//
+//   "/healthz/": {
+//       "handler": "healthz",
+//       "handlerArgs": {
+//           "storage": ["/bs/", "/index-mem/"],
+//           "timeout": 5
+//       }
+//   }
+type HealthHandler struct {
+	storage map[string]blobserver.Storage // keyed by prefix
+	timeout time.Duration
+
+	mu     sync.Mutex
+	probes map[string]*healthProbeRun // in flight, keyed by prefix
+}
+
+// A healthProbeRun is a stat of the probe blob in a storage, whose
+// result is shared by the checks waiting for it.
+type healthProbeRun struct {
+	done chan struct{} // closed when err is set
+	err  error
+}
+
+// healthProbe is the blob statted by health checks. It's the empty
+// blob, which won't usually exist, but it doesn't matter.
+var healthProbe = blobref.SHA1FromString("")
+
+func init() {
+	blobserver.RegisterHandlerConstructor("healthz", newHealthFromConfig)
+}
+
+func newHealthFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	storage := conf.RequiredList("storage")
+	timeout := conf.OptionalInt("timeout", 5)
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("healthz handler's timeout must be positive; got %d", timeout)
+	}
+	hh := &HealthHandler{
+		storage: make(map[string]blobserver.Storage),
+		timeout: time.Duration(timeout) * time.Second,
+	}
+	for _, prefix := range storage {
+		sto, err := ld.GetStorage(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("healthz handler's storage %q error: %v", prefix, err)
+		}
+		hh.storage[prefix] = sto
+	}
+	return hh, nil
+}
+
+// probe returns the stat of the probe blob in sto, at prefix, in
+// flight, starting it if there's none: a storage not answering is
+// only statted once at a time, however many checks wait for it.
+func (hh *HealthHandler) probe(prefix string, sto blobserver.Storage) *healthProbeRun {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	if p, ok := hh.probes[prefix]; ok {
+		return p
+	}
+	if hh.probes == nil {
+		hh.probes = make(map[string]*healthProbeRun)
+	}
+	p := &healthProbeRun{done: make(chan struct{})}
+	hh.probes[prefix] = p
+	go func() {
+		_, err := blobserver.StatBlob(sto, healthProbe)
+		if err == os.ErrNotExist {
+			err = nil
+		}
+		hh.mu.Lock()
+		delete(hh.probes, prefix)
+		hh.mu.Unlock()
+		p.err = err
+		close(p.done)
+	}()
+	return p
+}
+
+// check stats the probe blob in each storage, concurrently, and
+// returns the failures keyed by prefix. A storage still not done by
+// the timeout has failed; its stat is left running, for the next
+// checks to wait for.
+func (hh *HealthHandler) check() map[string]error {
+	probes := make(map[string]*healthProbeRun)
+	for prefix, sto := range hh.storage {
+		probes[prefix] = hh.probe(prefix, sto)
+	}
+
+	failed := make(map[string]error)
+	timer := time.NewTimer(hh.timeout)
+	defer timer.Stop()
+	timedOut := false
+	for prefix, p := range probes {
+		if !timedOut {
+			select {
+			case <-p.done:
+			case <-timer.C:
+				timedOut = true
+			}
+		}
+		select {
+		case <-p.done:
+			if p.err != nil {
+				failed[prefix] = p.err
+			}
+		default:
+			failed[prefix] = fmt.Errorf("no answer after %v", hh.timeout)
+		}
+	}
+	return failed
+}
+
+func (hh *HealthHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-cache")
+	failed := hh.check()
+	if len(failed) == 0 {
+		fmt.Fprintf(rw, "ok\n")
+		return
+	}
+	for prefix, err := range failed {
+		log.Printf("healthz: storage %s unhealthy: %v", prefix, err)
+	}
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(rw, "unhealthy: %d of %d checks failed\n", len(failed), len(hh.storage))
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+// statStorage is a storage whose stats fail with err, after waiting
+// for block to be closed if it's not nil, and are counted.
+type statStorage struct {
+	blobserver.Storage // nil; only StatBlobs is used
+	block              chan struct{}
+	err                error
+
+	mu    sync.Mutex
+	stats int
+}
+
+func (s *statStorage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
+	s.mu.Lock()
+	s.stats++
+	s.mu.Unlock()
+	if s.block != nil {
+		<-s.block
+	}
+	return s.err
+}
+
+func (s *statStorage) statCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func TestHealthz(t *testing.T) {
+	good, bad, hung := new(statStorage), &statStorage{err: errors.New("disk on fire")}, &statStorage{block: make(chan struct{})}
+	get := func(hh *HealthHandler, method string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://example.com/healthz/", nil)
+		rec := httptest.NewRecorder()
+		hh.ServeHTTP(rec, req)
+		return rec
+	}
+	newHandler := func(storage map[string]blobserver.Storage) *HealthHandler {
+		return &HealthHandler{storage: storage, timeout: 50 * time.Millisecond}
+	}
+
+	if rec := get(newHandler(map[string]blobserver.Storage{"/bs/": good}), "GET"); rec.Code != 200 || rec.Body.String() != "ok\n" {
+		t.Errorf("healthy: %d, %q; want 200, ok", rec.Code, rec.Body)
+	}
+	if rec := get(newHandler(map[string]blobserver.Storage{"/bs/": good}), "POST"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d; want 405", rec.Code)
+	}
+	rec := get(newHandler(map[string]blobserver.Storage{"/bs/": good, "/index/": bad}), "GET")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "1 of 2") {
+		t.Errorf("failing storage: %d, %q; want 503, 1 of 2 failed", rec.Code, rec.Body)
+	}
+
+	// A hung storage fails the checks, and is only statted once
+	// however many of them wait for it.
+	hh := newHandler(map[string]blobserver.Storage{"/bs/": good, "/remote/": hung})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := get(hh, "GET"); rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("hung storage: %d; want 503", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if rec := get(hh, "GET"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("hung storage, later check: %d; want 503", rec.Code)
+	}
+	if n := hung.statCount(); n != 1 {
+		t.Errorf("hung storage statted %d times; want 1", n)
+	}
+
+	close(hung.block)
+	deadline := time.Now().Add(time.Second)
+	for {
+		rec := get(hh, "GET")
+		if rec.Code == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after the hung storage answered: %d; want 200", rec.Code)
+		}
+	}
+}
@@ -38,6 +38,9 @@ import (
 
 const imageDebug = false
 
+// thumbnailMaxAge is how long, in seconds, clients may cache scaled images.
+const thumbnailMaxAge = 365 * 24 * 60 * 60
+
 type ImageHandler struct {
 	Fetcher             blobref.StreamingFetcher
 	Cache               blobserver.Storage // optional
@@ -110,16 +113,21 @@ func (ih *ImageHandler) cached(fileRef *blobref.BlobRef) (*schema.FileReader, er
 	return fr, nil
 }
 
-// Key format: "scaled:" + bref + ":" + width "x" + height
-// where bref is the blobref of the unscaled image.
-func cacheKey(bref string, width int, height int) string {
-	return fmt.Sprintf("scaled:%v:%dx%d", bref, width, height)
+// Key format: "scaled:" + bref + ":" + width "x" + height, with a
+// ":square" suffix for square crops, where bref is the blobref of the
+// unscaled image.
+func cacheKey(bref string, width int, height int, square bool) string {
+	key := fmt.Sprintf("scaled:%v:%dx%d", bref, width, height)
+	if square {
+		key += ":square"
+	}
+	return key
 }
 
 // ScaledCached reads the scaled version of the image in file,
 // if it is in cache. On success, the image format is returned.
 func (ih *ImageHandler) scaledCached(buf *bytes.Buffer, file *blobref.BlobRef) (format string, err error) {
-	name := cacheKey(file.String(), ih.MaxWidth, ih.MaxHeight)
+	name := cacheKey(file.String(), ih.MaxWidth, ih.MaxHeight, ih.Square)
 	br, err := ih.sc.Get(name)
 	if err != nil {
 		return format, fmt.Errorf("%v: %v", name, err)
@@ -160,16 +168,19 @@ func (ih *ImageHandler) scaleImage(buf *bytes.Buffer, file *blobref.BlobRef) (fo
 	if err != nil {
 		return format, fmt.Errorf("image resize: error reading image %s: %v", file, err)
 	}
+	conf, err := images.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return format, err
+	}
 	i, format, err := images.Decode(bytes.NewReader(buf.Bytes()), nil)
 	if err != nil {
 		return format, err
 	}
 	b := i.Bounds()
 
-	// TODO(mpl): sort the useBytesUnchanged story out,
-	// so that a rotation/flip is not being ignored
-	// when there was no rescaling required.
-	useBytesUnchanged := true
+	// The original bytes can only be served as is if decoding
+	// didn't rotate or flip the image per its EXIF orientation.
+	useBytesUnchanged := !conf.Modified
 
 	isSquare := b.Dx() == b.Dy()
 	if ih.Square && !isSquare {
@@ -221,6 +232,18 @@ func (ih *ImageHandler) scaleImage(buf *bytes.Buffer, file *blobref.BlobRef) (fo
 	return format, nil
 }
 
+// noneMatch reports whether req's If-None-Match header, a list of
+// ETags or "*", matches etag, weakly, as RFC 7232 says it must.
+func noneMatch(req *http.Request, etag string) bool {
+	for _, v := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 func (ih *ImageHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request, file *blobref.BlobRef) {
 	if req.Method != "GET" && req.Method != "HEAD" {
 		http.Error(rw, "Invalid method", 400)
@@ -232,6 +255,20 @@ func (ih *ImageHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request, fil
 		return
 	}
 
+	// The scaled image for a given file and size never changes, so
+	// let browsers cache it for good.
+	// A 304 must have the same cache headers as the 200.
+	etag := `"` + cacheKey(file.String(), mw, mh, ih.Square) + `"`
+	setCacheHeaders := func() {
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", thumbnailMaxAge))
+	}
+	if noneMatch(req, etag) {
+		setCacheHeaders()
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	var buf bytes.Buffer
 	var err error
 	format := ""
@@ -252,7 +289,7 @@ func (ih *ImageHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request, fil
 			return
 		}
 		if ih.sc != nil {
-			name := cacheKey(file.String(), mw, mh)
+			name := cacheKey(file.String(), mw, mh, ih.Square)
 			bufcopy := buf.Bytes()
 			err = ih.cacheScaled(bytes.NewBuffer(bufcopy), name)
 			if err != nil {
@@ -262,6 +299,7 @@ func (ih *ImageHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request, fil
 	}
 
 	rw.Header().Set("Content-Type", imageContentTypeOfFormat(format))
+	setCacheHeaders()
 	size := buf.Len()
 	rw.Header().Set("Content-Length", fmt.Sprintf("%d", size))
 	n, err := io.Copy(rw, &buf)
@@ -0,0 +1,53 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+)
+
+func TestImageNotModified(t *testing.T) {
+	file := blobref.MustParse("sha1-f1d2d2f924e986ac86fdf7b36c94bcdf32beec15")
+	ih := &ImageHandler{MaxWidth: 100, MaxHeight: 100}
+	etag := `"` + cacheKey(file.String(), 100, 100, false) + `"`
+	for _, inm := range []string{
+		etag,
+		`"other", ` + etag,
+		"W/" + etag,
+		"*",
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/ui/thumbnail/"+file.String()+"/x.jpg", nil)
+		req.Header.Set("If-None-Match", inm)
+		rec := httptest.NewRecorder()
+		ih.ServeHTTP(rec, req, file)
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: status %d; want 304", inm, rec.Code)
+			continue
+		}
+		if rec.HeaderMap.Get("ETag") != etag || rec.HeaderMap.Get("Cache-Control") == "" {
+			t.Errorf("If-None-Match %s: 304 with ETag %q, Cache-Control %q; want the 200's",
+				inm, rec.HeaderMap.Get("ETag"), rec.HeaderMap.Get("Cache-Control"))
+		}
+	}
+	if noneMatch(&http.Request{Header: http.Header{"If-None-Match": {`"other"`}}}, etag) {
+		t.Errorf("If-None-Match of another ETag matched %s", etag)
+	}
+}
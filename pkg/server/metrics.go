@@ -0,0 +1,53 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/metrics"
+)
+
+// MetricsHandler serves the server's metrics in the Prometheus text
+// format, for scraping at e.g. "/metrics/".
+type MetricsHandler struct{}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("metrics", newMetricsFromConfig)
+}
+
+func newMetricsFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return MetricsHandler{}, nil
+}
+
+func (MetricsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		httputil.ErrorRouting(rw, req)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.WriteTo(rw); err != nil {
+		log.Printf("metrics: error writing metrics: %v", err)
+	}
+}
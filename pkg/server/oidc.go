@@ -0,0 +1,510 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/audit"
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+// pendingLoginTTL is how long a browser has to log in with the
+// provider.
+const pendingLoginTTL = 10 * time.Minute
+
+// maxPendingLogins is the most logins in progress kept. Past it, the
+// oldest is forgotten, since anyone can start one.
+const maxPendingLogins = 1000
+
+// stateCookie is the name of the cookie binding a login's state to
+// the browser that started it.
+const stateCookie = "camli_oidc_state"
+
+// OIDCHandler logs browsers in with an OpenID Connect provider, for
+// the "oidc" auth mode.
+//
+// A GET of the handler's root, optionally with a "next" path to return
+// to, sends the browser to the provider; the provider sends it back to
+// <prefix>callback, where the handler checks the browser is the one
+// it sent, by a cookie, checks the ID token, maps the user's groups to
+// a role, and gives the browser a session cookie.
+// <prefix>logout ends the session. The handlers requiring
+// authentication send browsers without a session to the handler's
+// root.
+type OIDCHandler struct {
+	issuer, clientID, clientSecret string
+	redirectURL                    string // or "" to derive from requests
+	scopes                         []string
+	groupsClaim                    string
+	roles                          map[string]auth.Operation // group => role
+	defaultOps                     auth.Operation
+	sessionTTL                     time.Duration
+	home                           string
+
+	prefix string
+	client *http.Client
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	keys     map[string]*rsa.PublicKey // kid => key
+	keysTime time.Time
+	pending  map[string]pendingLogin // state => login
+}
+
+// oidcProvider is the part of an OpenID provider's configuration the
+// handler uses.
+type oidcProvider struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+type pendingLogin struct {
+	nonce, next string
+	expires     time.Time
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("oidc", newOIDCFromConfig)
+}
+
+func newOIDCFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	h := &OIDCHandler{
+		issuer:       strings.TrimSuffix(conf.RequiredString("issuer"), "/"),
+		clientID:     conf.RequiredString("clientID"),
+		clientSecret: conf.RequiredString("clientSecret"),
+		redirectURL:  conf.OptionalString("redirectURL", ""),
+		scopes:       conf.OptionalList("scopes"),
+		groupsClaim:  conf.OptionalString("groupsClaim", "groups"),
+		sessionTTL:   time.Duration(conf.OptionalInt("sessionHours", 24)) * time.Hour,
+		home:         conf.OptionalString("home", "/"),
+		roles:        make(map[string]auth.Operation),
+		prefix:       ld.MyPrefix(),
+		client:       http.DefaultClient,
+		pending:      make(map[string]pendingLogin),
+	}
+	roles := conf.OptionalObject("roles")
+	defaultRole := conf.OptionalString("defaultRole", "")
+	sessionKey := conf.OptionalString("sessionKey", "")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if len(h.scopes) == 0 {
+		h.scopes = []string{"openid", "email", "profile"}
+	}
+	for group, v := range roles {
+		name, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("oidc handler: role of group %q is a %T, not a string", group, v)
+		}
+		ops, err := auth.ParseRole(name)
+		if err != nil {
+			return nil, fmt.Errorf("oidc handler: group %q: %v", group, err)
+		}
+		h.roles[group] = ops
+	}
+	if defaultRole != "" {
+		ops, err := auth.ParseRole(defaultRole)
+		if err != nil {
+			return nil, fmt.Errorf("oidc handler: defaultRole: %v", err)
+		}
+		h.defaultOps = ops
+	}
+	if sessionKey != "" {
+		auth.SetSessionKey([]byte(sessionKey))
+	}
+	auth.SetLoginPath(h.prefix)
+	return h, nil
+}
+
+func (h *OIDCHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Header.Get("X-PrefixHandler-PathSuffix") {
+	case "":
+		h.serveLogin(rw, req)
+	case "callback":
+		h.serveCallback(rw, req)
+	case "logout":
+		auth.ClearSession(rw)
+		http.Redirect(rw, req, h.home, http.StatusFound)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// localPath reports whether next is a path on this server, and not
+// elsewhere.
+func localPath(next string) bool {
+	return strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\")
+}
+
+func (h *OIDCHandler) callbackURL(req *http.Request) string {
+	if h.redirectURL != "" {
+		return h.redirectURL
+	}
+	scheme := "http"
+	if httputil.IsSecure(req) {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + h.prefix + "callback"
+}
+
+func (h *OIDCHandler) serveLogin(rw http.ResponseWriter, req *http.Request) {
+	p, err := h.getProvider()
+	if err != nil {
+		httputil.ServerError(rw, req, err)
+		return
+	}
+	next := req.FormValue("next")
+	if !localPath(next) {
+		next = h.home
+	}
+	state, nonce := randomString(), randomString()
+	h.mu.Lock()
+	now := time.Now()
+	oldest := ""
+	for s, pl := range h.pending {
+		if now.After(pl.expires) {
+			delete(h.pending, s)
+			continue
+		}
+		if oldest == "" || pl.expires.Before(h.pending[oldest].expires) {
+			oldest = s
+		}
+	}
+	if len(h.pending) >= maxPendingLogins {
+		delete(h.pending, oldest)
+	}
+	h.pending[state] = pendingLogin{nonce: nonce, next: next, expires: now.Add(pendingLoginTTL)}
+	h.mu.Unlock()
+	// The callback must come back to the browser logging in, not to
+	// one an attacker sent its own login's callback to.
+	http.SetCookie(rw, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     h.prefix,
+		MaxAge:   int(pendingLoginTTL.Seconds()),
+		Secure:   httputil.IsSecure(req),
+		HttpOnly: true,
+	})
+
+	v := url.Values{
+		"response_type": {"code"},
+		"client_id":     {h.clientID},
+		"redirect_uri":  {h.callbackURL(req)},
+		"scope":         {strings.Join(h.scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(rw, req, p.AuthEndpoint+sep+v.Encode(), http.StatusFound)
+}
+
+func (h *OIDCHandler) serveCallback(rw http.ResponseWriter, req *http.Request) {
+	if e := req.FormValue("error"); e != "" {
+		httputil.ForbiddenError(rw, "Login failed: %s %s", e, req.FormValue("error_description"))
+		return
+	}
+	state := req.FormValue("state")
+	c, err := req.Cookie(stateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		httputil.BadRequestError(rw, "Login not started by this browser; please try again.")
+		return
+	}
+	http.SetCookie(rw, &http.Cookie{Name: stateCookie, Value: "", Path: h.prefix, MaxAge: -1, HttpOnly: true})
+	h.mu.Lock()
+	pl, ok := h.pending[state]
+	delete(h.pending, state)
+	h.mu.Unlock()
+	if !ok || time.Now().After(pl.expires) {
+		httputil.BadRequestError(rw, "Unknown or expired login; please try again.")
+		return
+	}
+	claims, err := h.exchange(req.FormValue("code"), h.callbackURL(req), pl.nonce)
+	if err != nil {
+		log.Printf("oidc: login failed: %v", err)
+		httputil.ForbiddenError(rw, "Login failed: %v", err)
+		return
+	}
+	user := claimString(claims, "email")
+	if user == "" {
+		user = claimString(claims, "preferred_username")
+	}
+	if user == "" {
+		user = claimString(claims, "sub")
+	}
+	ops := h.claimOps(claims)
+	if ops == 0 {
+		log.Printf("oidc: %s has no role", user)
+		httputil.ForbiddenError(rw, "%s isn't allowed to use this server.", user)
+		return
+	}
+	log.Printf("oidc: %s logged in", user)
+	auth.SetSession(rw, req, user, ops, h.sessionTTL)
+	audit.Log(req, audit.EventLogin, user, "oidc")
+	http.Redirect(rw, req, pl.next, http.StatusFound)
+}
+
+// claimOps returns the operations allowed by the roles of the groups
+// in claims, or by the default role.
+func (h *OIDCHandler) claimOps(claims map[string]interface{}) auth.Operation {
+	ops := h.defaultOps
+	switch groups := claims[h.groupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				ops |= h.roles[s]
+			}
+		}
+	case string:
+		ops |= h.roles[groups]
+	}
+	return ops
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+func (h *OIDCHandler) getJSON(url string, v interface{}) error {
+	res, err := h.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// getProvider returns the provider's configuration, fetching it the
+// first time.
+func (h *OIDCHandler) getProvider() (*oidcProvider, error) {
+	h.mu.Lock()
+	p := h.provider
+	h.mu.Unlock()
+	if p != nil {
+		return p, nil
+	}
+	p = new(oidcProvider)
+	if err := h.getJSON(h.issuer+"/.well-known/openid-configuration", p); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %v", err)
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != h.issuer || p.AuthEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: bogus configuration of issuer %s", h.issuer)
+	}
+	h.mu.Lock()
+	h.provider = p
+	h.mu.Unlock()
+	return p, nil
+}
+
+// exchange trades the provider's code for an ID token, and returns
+// its claims once checked.
+func (h *OIDCHandler) exchange(code, redirectURI, nonce string) (map[string]interface{}, error) {
+	if code == "" {
+		return nil, errors.New("no code")
+	}
+	p, err := h.getProvider()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(h.clientID), url.QueryEscape(h.clientSecret))
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var tr struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("token response: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || tr.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", res.Status, tr.Error)
+	}
+	return verifyIDToken(tr.IDToken, h.key, h.issuer, h.clientID, nonce, time.Now())
+}
+
+// key returns the provider's signing key named kid, refetching the
+// provider's keys at most once a minute when it doesn't know kid.
+func (h *OIDCHandler) key(kid string) (*rsa.PublicKey, error) {
+	h.mu.Lock()
+	k, ok := h.keys[kid]
+	stale := time.Since(h.keysTime) > time.Minute
+	h.mu.Unlock()
+	if ok {
+		return k, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p, err := h.getProvider()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := h.getJSON(p.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jk := range set.Keys {
+		if jk.Kty != "RSA" {
+			continue
+		}
+		n, err1 := decodeSegment(jk.N)
+		e, err2 := decodeSegment(jk.E)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		keys[jk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	h.mu.Lock()
+	h.keys, h.keysTime = keys, time.Now()
+	h.mu.Unlock()
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// decodeSegment decodes the unpadded base64url of JWTs.
+func decodeSegment(s string) ([]byte, error) {
+	if m := len(s) % 4; m != 0 {
+		s += strings.Repeat("=", 4-m)
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// verifyIDToken checks the RS256 signature of the ID token raw, with
+// the key named by its header, and that it was issued by issuer to
+// clientID for the login of nonce, and hasn't expired. It returns its
+// claims.
+func verifyIDToken(raw string, key func(kid string) (*rsa.PublicKey, error), issuer, clientID, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := decodeSegment(parts[0])
+	if err != nil || json.Unmarshal(b, &hdr) != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	if hdr.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", hdr.Alg)
+	}
+	pub, err := key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.New("bad ID token signature")
+	}
+	var claims map[string]interface{}
+	b, err = decodeSegment(parts[1])
+	if err != nil || json.Unmarshal(b, &claims) != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+	if iss := claimString(claims, "iss"); strings.TrimSuffix(iss, "/") != issuer {
+		return nil, fmt.Errorf("ID token from issuer %q", iss)
+	}
+	audOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOK = aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				audOK = true
+			}
+		}
+	}
+	if !audOK {
+		return nil, errors.New("ID token not for this client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.Unix() > int64(exp) {
+		return nil, errors.New("ID token expired")
+	}
+	if claimString(claims, "nonce") != nonce {
+		return nil, errors.New("ID token of another login")
+	}
+	return claims, nil
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/auth"
+)
+
+func encodeSegment(b []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(b), "=")
+}
+
+func signIDToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	body, _ := json.Marshal(claims)
+	input := encodeSegment(hdr) + "." + encodeSegment(body)
+	sum := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + encodeSegment(sig)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var provider *httptest.Server
+	var nonce string
+	provider = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(rw).Encode(map[string]string{
+				"issuer":                 provider.URL,
+				"authorization_endpoint": provider.URL + "/auth",
+				"token_endpoint":         provider.URL + "/token",
+				"jwks_uri":               provider.URL + "/keys",
+			})
+		case "/keys":
+			json.NewEncoder(rw).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA", "kid": "k1",
+				"n": encodeSegment(key.N.Bytes()),
+				"e": encodeSegment(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		case "/token":
+			if user, pass, _ := req.BasicAuth(); user != "camli" || pass != "secret" || req.FormValue("code") != "thecode" {
+				http.Error(rw, `{"error":"invalid_grant"}`, 400)
+				return
+			}
+			json.NewEncoder(rw).Encode(map[string]string{"id_token": signIDToken(t, key, map[string]interface{}{
+				"iss":    provider.URL,
+				"aud":    "camli",
+				"exp":    time.Now().Add(time.Hour).Unix(),
+				"nonce":  nonce,
+				"email":  "kid@example.com",
+				"groups": []string{"family"},
+			})})
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer provider.Close()
+
+	h := &OIDCHandler{
+		issuer:       provider.URL,
+		clientID:     "camli",
+		clientSecret: "secret",
+		groupsClaim:  "groups",
+		roles:        map[string]auth.Operation{"family": auth.RoleRead},
+		sessionTTL:   time.Hour,
+		home:         "/",
+		prefix:       "/login/",
+		client:       http.DefaultClient,
+		pending:      make(map[string]pendingLogin),
+	}
+	var cookie string // of the login
+	serve := func(suffix, query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://camli.example.com/login/"+suffix+"?"+query, nil)
+		req.Header.Set("X-PrefixHandler-PathSuffix", suffix)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Another browser's login, whose callback its cookie doesn't match.
+	other := serve("", "")
+	otherLoc, _ := url.Parse(other.Header().Get("Location"))
+	otherState := otherLoc.Query().Get("state")
+
+	rec := serve("", "next=/ui/%3Fp=sha1-abc")
+	cookie = rec.Header().Get("Set-Cookie")
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || err != nil || !strings.HasPrefix(loc.String(), provider.URL+"/auth?") {
+		t.Fatalf("login = %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	q := loc.Query()
+	if q.Get("redirect_uri") != "http://camli.example.com/login/callback" || q.Get("client_id") != "camli" {
+		t.Errorf("authorization request = %v", q)
+	}
+	nonce = q.Get("nonce")
+
+	if rec := serve("callback", "code=thecode&state=bogus"); rec.Code != http.StatusBadRequest {
+		t.Errorf("callback of an unknown state = %d; want 400", rec.Code)
+	}
+	if rec := serve("callback", "code=thecode&state="+otherState); rec.Code != http.StatusBadRequest {
+		t.Errorf("callback of another browser's login = %d; want 400", rec.Code)
+	}
+	saved := cookie
+	cookie = ""
+	if rec := serve("callback", "code=thecode&state="+q.Get("state")); rec.Code != http.StatusBadRequest {
+		t.Errorf("callback without the state cookie = %d; want 400", rec.Code)
+	}
+	cookie = saved
+	rec = serve("callback", "code=thecode&state="+q.Get("state"))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/ui/?p=sha1-abc" {
+		t.Fatalf("callback = %d to %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	req, _ := http.NewRequest("GET", "http://camli.example.com/ui/", nil)
+	for _, c := range rec.HeaderMap["Set-Cookie"] {
+		req.Header.Add("Cookie", c)
+	}
+	user, ops, ok := auth.Session(req)
+	if !ok || user != "kid@example.com" || ops != auth.RoleRead {
+		t.Errorf("session = %q, %v, %v; want kid@example.com with the read role", user, ops, ok)
+	}
+	if rec := serve("callback", "code=thecode&state="+q.Get("state")); rec.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback = %d; want 400", rec.Code)
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := func(mod func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://idp", "aud": "camli", "exp": now.Add(time.Hour).Unix(), "nonce": "n"}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+	keyFn := func(string) (*rsa.PublicKey, error) { return &key.PublicKey, nil }
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"good", signIDToken(t, key, claims(nil)), true},
+		{"other key", signIDToken(t, other, claims(nil)), false},
+		{"issuer", signIDToken(t, key, claims(func(c map[string]interface{}) { c["iss"] = "https://evil" })), false},
+		{"audience", signIDToken(t, key, claims(func(c map[string]interface{}) { c["aud"] = []string{"x"} })), false},
+		{"expired", signIDToken(t, key, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() })), false},
+		{"nonce", signIDToken(t, key, claims(func(c map[string]interface{}) { c["nonce"] = "m" })), false},
+	}
+	for _, tt := range tests {
+		_, err := verifyIDToken(tt.token, keyFn, "https://idp", "camli", "n", now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v; want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestOIDCPendingCap(t *testing.T) {
+	h := &OIDCHandler{
+		prefix:   "/login/",
+		home:     "/",
+		provider: &oidcProvider{AuthEndpoint: "https://idp.example.com/auth"},
+		pending:  make(map[string]pendingLogin),
+	}
+	var first string
+	for i := 0; i < maxPendingLogins+10; i++ {
+		req, _ := http.NewRequest("GET", "http://camli.example.com/login/", nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if i == 0 {
+			loc, _ := url.Parse(rec.Header().Get("Location"))
+			first = loc.Query().Get("state")
+		}
+	}
+	if n := len(h.pending); n != maxPendingLogins {
+		t.Errorf("%d pending logins; want %d", n, maxPendingLogins)
+	}
+	if _, ok := h.pending[first]; ok {
+		t.Errorf("oldest pending login kept")
+	}
+}
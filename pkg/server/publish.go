@@ -30,11 +30,13 @@ import (
 	"strings"
 	"time"
 
+	"camlistore.org/pkg/auth"
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/client" // just for NewUploadHandleFromString.  move elsewhere?
 	"camlistore.org/pkg/jsonconfig"
 	"camlistore.org/pkg/jsonsign/signhandler"
+	"camlistore.org/pkg/markdown"
 	"camlistore.org/pkg/schema"
 	"camlistore.org/pkg/search"
 	"net/url"
@@ -51,6 +53,19 @@ type PublishHandler struct {
 
 	JSFiles, CSSFiles []string
 
+	// GalleryPageSize is the number of members shown per page of a
+	// collection. Zero means all members on one page.
+	GalleryPageSize int
+	// GalleryThumbSize is the maximum dimension of the gallery
+	// thumbnails, in pixels.
+	GalleryThumbSize int
+
+	// Mode is "" for the default rendering, or "blog" to render
+	// collections as blogs, with Atom feeds.
+	Mode string
+	// BlogPostsPerPage is the number of posts per page in blog mode.
+	BlogPostsPerPage int
+
 	bsLoader      blobserver.Loader
 	staticHandler http.Handler
 }
@@ -66,10 +81,15 @@ func newPublishFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (h http.Han
 	ph.RootName = conf.RequiredString("rootName")
 	ph.JSFiles = conf.OptionalList("js")
 	ph.CSSFiles = conf.OptionalList("css")
+	ph.GalleryPageSize = conf.OptionalInt("galleryPageSize", 0)
+	ph.GalleryThumbSize = conf.OptionalInt("galleryThumbSize", 200)
+	ph.Mode = conf.OptionalString("mode", "")
+	ph.BlogPostsPerPage = conf.OptionalInt("blogPostsPerPage", 10)
 	blobRoot := conf.RequiredString("blobRoot")
 	searchRoot := conf.RequiredString("searchRoot")
 	cachePrefix := conf.OptionalString("cache", "")
 	scType := conf.OptionalString("scaledImage", "")
+	scFile := conf.OptionalString("scaledImageFile", "")
 	bootstrapSignRoot := conf.OptionalString("devBootstrapPermanodeUsing", "")
 	rootNode := conf.OptionalList("rootPermanode")
 	if err = conf.Validate(); err != nil {
@@ -79,6 +99,18 @@ func newPublishFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (h http.Han
 	if ph.RootName == "" {
 		return nil, errors.New("invalid empty rootName")
 	}
+	if ph.GalleryPageSize < 0 || ph.GalleryThumbSize <= 0 {
+		return nil, errors.New("invalid galleryPageSize or galleryThumbSize")
+	}
+	switch ph.Mode {
+	case "":
+	case "blog":
+		if ph.BlogPostsPerPage <= 0 {
+			return nil, errors.New("invalid blogPostsPerPage")
+		}
+	default:
+		return nil, fmt.Errorf("invalid publish mode %q", ph.Mode)
+	}
 
 	bs, err := ld.GetStorage(blobRoot)
 	if err != nil {
@@ -130,12 +162,11 @@ func newPublishFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (h http.Han
 			return nil, fmt.Errorf("publish handler's cache of %q error: %v", cachePrefix, err)
 		}
 		ph.Cache = bs
-		switch scType {
-		case "lrucache":
-			ph.sc = NewScaledImageLru()
-		case "":
-		default:
-			return nil, fmt.Errorf("unsupported publish handler's scType: %q ", scType)
+		if scType != "" {
+			ph.sc, err = newScaledImage(scType, scFile)
+			if err != nil {
+				return nil, fmt.Errorf("publish handler's scaledImage: %v", err)
+			}
 		}
 	}
 
@@ -210,6 +241,11 @@ type publishRequest struct {
 	inSubjectChain       map[string]bool // blobref -> true
 	subjectBasePath      string
 
+	// The subject's predecessor in the path, if the subject was
+	// reached by a member hop, and its base path.
+	parent         *blobref.BlobRef
+	parentBasePath string
+
 	// A describe request that we can reuse, sharing its map of
 	// blobs already described.
 	dr *search.DescribeRequest
@@ -316,6 +352,7 @@ func (pr *publishRequest) findSubject() error {
 				memberPrefix, subject, err)
 		}
 
+		pr.parent, pr.parentBasePath = subject, pr.subjectBasePath
 		subject, err = pr.ph.Search.ResolvePrefixHop(subject, memberPrefix)
 		if err != nil {
 			return err
@@ -350,6 +387,11 @@ func (pr *publishRequest) serveHTTP() {
 		return
 	}
 
+	if pr.subject != nil && !pr.viewerAllowed() {
+		auth.SendUnauthorized(pr.rw)
+		return
+	}
+
 	if pr.Debug() {
 		pr.pf("<p><b>Subject:</b> <a href='/ui/?p=%s'>%s</a></p>", pr.subject, pr.subject)
 		return
@@ -364,6 +406,12 @@ func (pr *publishRequest) serveHTTP() {
 		pr.serveSubresFileDownload()
 	case "i": // image, scaled
 		pr.serveSubresImage()
+	case "a": // Atom feed, in blog mode
+		if pr.ph.Mode != "blog" {
+			pr.rw.WriteHeader(404)
+			return
+		}
+		pr.serveSubresAtom()
 	case "s": // static
 		pr.req.URL.Path = pr.subres[len("/=s"):]
 		pr.ph.staticHandler.ServeHTTP(pr.rw, pr.req)
@@ -373,6 +421,23 @@ func (pr *publishRequest) serveHTTP() {
 	}
 }
 
+// viewerAllowed reports whether the viewer may see the subject. It's
+// public unless the root permanode carries ACL grants, which limit it
+// to the server's users and the ACL users granted the subject.
+func (pr *publishRequest) viewerAllowed() bool {
+	root, err := pr.ph.Search.NewDescribeRequest().DescribeSync(pr.rootpn)
+	if err != nil || root == nil || root.Permanode == nil {
+		return false
+	}
+	if len(root.Permanode.Attr[search.ACLAttr]) == 0 {
+		return true
+	}
+	if _, ok := auth.ACLUser(pr.req); ok {
+		return auth.AllowedBlob(pr.req, pr.subject, auth.OpGet)
+	}
+	return auth.Allowed(pr.req, auth.OpGet)
+}
+
 func (pr *publishRequest) pf(format string, args ...interface{}) {
 	fmt.Fprintf(pr.rw, format, args...)
 }
@@ -434,6 +499,10 @@ func (pr *publishRequest) serveSubject() {
 				pr.pf(" <script src='%s'></script>\n", pr.base+"?camli.mode=config&cb=onConfiguration")
 			}
 		}
+		if pr.ph.Mode == "blog" && len(subdes.Members()) > 0 {
+			pr.pf(" <link rel='alternate' type='application/atom+xml' title='%s' href='%s'>\n",
+				html.EscapeString(title), pr.feedPath())
+		}
 		pr.pf(" <script>\n")
 		pr.pf("var camliViewIsOwner = %v;\n", pr.ViewerIsOwner())
 		pr.pf("var camliPagePermanode = %q;\n", pr.subject)
@@ -448,6 +517,11 @@ func (pr *publishRequest) serveSubject() {
 		pr.pf("<h1>%s</h1>\n", html.EscapeString(title))
 	}
 
+	if pr.ph.Mode == "blog" {
+		pr.serveBlogSubject(subdes)
+		return
+	}
+
 	if cref, ok := subdes.ContentRef(); ok {
 		des, err := pr.dr.DescribeSync(cref)
 		if err == nil && des.File != nil {
@@ -465,10 +539,21 @@ func (pr *publishRequest) serveSubject() {
 			pr.pf("<div id='%s' class='camlifile'>[<a href='%s'>download</a>]</div>",
 				cref.DomID(),
 				downloadURL)
+			if isMarkdownFile(des.File) {
+				pr.serveMarkdown(cref)
+			}
+		}
+		if pr.ph.GalleryPageSize > 0 {
+			pr.serveParentNav()
 		}
 	}
 
-	if members := subdes.Members(); len(members) > 0 {
+	members := subdes.Members()
+	if len(members) > 0 && pr.ph.GalleryPageSize > 0 {
+		pr.serveGallery(members)
+		return
+	}
+	if len(members) > 0 {
 		pr.pf("<ul>\n")
 		for _, member := range members {
 			des := member.Description()
@@ -497,6 +582,123 @@ func (pr *publishRequest) serveSubject() {
 	}
 }
 
+// serveMarkdown renders the markdown file fileref, or shows its
+// source if the "raw" parameter is set.
+func (pr *publishRequest) serveMarkdown(fileref *blobref.BlobRef) {
+	text, err := pr.fileText(fileref)
+	if err != nil {
+		log.Printf("publish: error reading markdown file %s: %v", fileref, err)
+		return
+	}
+	if raw, _ := strconv.ParseBool(pr.req.FormValue("raw")); raw {
+		pr.pf("<div class='camlimarkdowntoggle'>[<a href='?'>rendered</a>]</div>\n")
+		pr.pf("<pre class='camlimarkdownraw'>%s</pre>\n", html.EscapeString(text))
+		return
+	}
+	pr.pf("<div class='camlimarkdowntoggle'>[<a href='?raw=1'>raw</a>]</div>\n")
+	pr.pf("<div class='camlimarkdown'>%s</div>\n", markdown.ToHTML(text))
+}
+
+// galleryPage returns the bounds [start, end) of the members shown
+// on the zero-based page of a gallery of n members, with pageSize
+// members per page, and the number of pages. Out of range pages are
+// clamped.
+func galleryPage(n, pageSize, page int) (start, end, pages int) {
+	pages = (n + pageSize - 1) / pageSize
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+	start = page * pageSize
+	end = start + pageSize
+	if end > n {
+		end = n
+	}
+	return
+}
+
+// serveGallery renders one page, chosen by the "page" parameter, of
+// the subject's members as a grid of thumbnails linking to the
+// members' own pages.
+func (pr *publishRequest) serveGallery(members []*search.DescribedBlob) {
+	page, _ := strconv.Atoi(pr.req.FormValue("page"))
+	start, end, pages := galleryPage(len(members), pr.ph.GalleryPageSize, page)
+	page = start / pr.ph.GalleryPageSize
+
+	pr.pf("<div class='camligallery'>\n")
+	for _, member := range members[start:end] {
+		var thumbnail string
+		if path, fileInfo, ok := member.PermanodeFile(); ok && fileInfo.IsImage() {
+			thumbnail = fmt.Sprintf("<img src='%s'>",
+				html.EscapeString(pr.SubresThumbnailURL(path, fileInfo.FileName, pr.ph.GalleryThumbSize)))
+		}
+		pr.pf("  <div id='%s' class='camligalleryitem'><a href='%s'>%s<span>%s</span></a></div>\n",
+			member.DomID(),
+			pr.memberPath(member.BlobRef),
+			thumbnail,
+			html.EscapeString(member.Title()))
+	}
+	pr.pf("</div>\n")
+
+	if pages > 1 {
+		pr.pf("<div class='camligallerynav'>")
+		if page > 0 {
+			pr.pf("<a href='?page=%d'>&laquo; previous</a> ", page-1)
+		}
+		pr.pf("page %d of %d", page+1, pages)
+		if page+1 < pages {
+			pr.pf(" <a href='?page=%d'>next &raquo;</a>", page+1)
+		}
+		pr.pf("</div>\n")
+	}
+}
+
+// serveParentNav renders links to the subject's neighbours in its
+// parent collection, and back to the parent's gallery page holding
+// the subject, if the subject was reached from a collection.
+func (pr *publishRequest) serveParentNav() {
+	if pr.parent == nil {
+		return
+	}
+	pdes, err := pr.dr.DescribeSync(pr.parent)
+	if err != nil || pdes.Permanode == nil {
+		return
+	}
+	members := pdes.Permanode.Attr["camliMember"]
+	idx := -1
+	for i, m := range members {
+		if m == pr.subject.String() {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return
+	}
+	siblingPath := func(i int) string {
+		br := blobref.Parse(members[i])
+		if br == nil {
+			return ""
+		}
+		return addPathComponent(pr.parentBasePath, "/h"+br.DigestPrefix(10))
+	}
+	pr.pf("<div class='camligallerynav'>")
+	if idx > 0 {
+		if p := siblingPath(idx - 1); p != "" {
+			pr.pf("<a href='%s'>&laquo; previous</a> ", p)
+		}
+	}
+	pr.pf("<a href='%s?page=%d'>up</a>", pr.parentBasePath, idx/pr.ph.GalleryPageSize)
+	if idx+1 < len(members) {
+		if p := siblingPath(idx + 1); p != "" {
+			pr.pf(" <a href='%s'>next &raquo;</a>", p)
+		}
+	}
+	pr.pf("</div>\n")
+}
+
 func (pr *publishRequest) validPathChain(path []*blobref.BlobRef) bool {
 	bi := pr.subject
 	for len(path) > 0 {
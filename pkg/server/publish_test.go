@@ -31,6 +31,7 @@ import (
 type publishURLTest struct {
 	path            string // input
 	subject, subres string // expected
+	parent          string // expected, if non-empty
 }
 
 var publishURLTests = []publishURLTest{
@@ -50,6 +51,7 @@ var publishURLTests = []publishURLTest{
 	{
 		path:    "/pics/camping/-/h9876543210",
 		subject: "picpn-98765432100",
+		parent:  "gal-123",
 	},
 
 	// URL to a gallery -> picture permanode -> its file
@@ -57,6 +59,7 @@ var publishURLTests = []publishURLTest{
 	{
 		path:    "/pics/camping/-/h9876543210/hf00f00f00a",
 		subject: "picfile-f00f00f00a5",
+		parent:  "picpn-98765432100",
 	},
 
 	// URL to a gallery -> picture permanode -> its file
@@ -143,6 +146,9 @@ func TestPublishURLs(t *testing.T) {
 						t.Errorf("test #%d, got subject %q, want %q", ti, pr.subject, tt.subject)
 					}
 				}
+				if tt.parent != "" && pr.parent.String() != tt.parent {
+					t.Errorf("test #%d, got parent %q, want %q", ti, pr.parent, tt.parent)
+				}
 				if pr.subres != tt.subres {
 					t.Errorf("test #%d, got subres %q, want %q", ti, pr.subres, tt.subres)
 				}
@@ -151,3 +157,41 @@ func TestPublishURLs(t *testing.T) {
 		pfxh.ServeHTTP(rw, req)
 	}
 }
+
+func TestGalleryPage(t *testing.T) {
+	tests := []struct {
+		n, pageSize, page       int
+		wantStart, wantEnd, pgs int
+	}{
+		{10, 4, 0, 0, 4, 3},
+		{10, 4, 1, 4, 8, 3},
+		{10, 4, 2, 8, 10, 3},
+		{10, 4, 7, 8, 10, 3},
+		{10, 4, -1, 0, 4, 3},
+		{8, 4, 1, 4, 8, 2},
+		{3, 10, 0, 0, 3, 1},
+	}
+	for _, tt := range tests {
+		start, end, pages := galleryPage(tt.n, tt.pageSize, tt.page)
+		if start != tt.wantStart || end != tt.wantEnd || pages != tt.pgs {
+			t.Errorf("galleryPage(%d, %d, %d) = %d, %d, %d; want %d, %d, %d",
+				tt.n, tt.pageSize, tt.page, start, end, pages, tt.wantStart, tt.wantEnd, tt.pgs)
+		}
+	}
+}
+
+func TestPostBodyHTML(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"hello", "<p>hello</p>"},
+		{"a\nb\n\nc & d\n", "<p>a<br>\nb</p>\n<p>c &amp; d</p>"},
+		{"x\r\n\r\n\r\n<y>", "<p>x</p>\n<p>&lt;y&gt;</p>"},
+	}
+	for _, tt := range tests {
+		if got := postBodyHTML(tt.in); got != tt.want {
+			t.Errorf("postBodyHTML(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
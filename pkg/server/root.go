@@ -38,9 +38,10 @@ type RootHandler struct {
 	OwnerName string // for display purposes only
 
 	// URL prefixes (path or full URL) to the primary blob and
-	// search root.
+	// search root, and to the garbage collector, if any.
 	BlobRoot   string
 	SearchRoot string
+	GCRoot     string
 
 	Storage blobserver.Storage // of BlobRoot, or nil
 	Search  *search.Handler    // of SearchRoot, or nil
@@ -60,6 +61,7 @@ func newRootFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (h http.Handle
 	root := &RootHandler{
 		BlobRoot:   conf.OptionalString("blobRoot", ""),
 		SearchRoot: conf.OptionalString("searchRoot", ""),
+		GCRoot:     conf.OptionalString("gcRoot", ""),
 		OwnerName:  conf.OptionalString("ownerName", u.Name),
 	}
 	root.Stealth = conf.OptionalBool("stealth", false)
@@ -120,6 +122,9 @@ func (rh *RootHandler) serveDiscovery(rw http.ResponseWriter, req *http.Request)
 		"searchRoot": rh.SearchRoot,
 		"ownerName":  rh.OwnerName,
 	}
+	if rh.GCRoot != "" {
+		m["gcRoot"] = rh.GCRoot
+	}
 	if gener, ok := rh.Storage.(blobserver.Generationer); ok {
 		initTime, gen, err := gener.StorageGeneration()
 		if err != nil {
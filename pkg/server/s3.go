@@ -0,0 +1,644 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/jsonsign/signhandler"
+	"camlistore.org/pkg/search"
+)
+
+// S3Handler is a gateway speaking a subset of the Amazon S3 API,
+// path-style, with the handler's prefix as the endpoint:
+//
+//   GET <prefix>                  lists the buckets
+//   GET <prefix><bucket>          lists keys (ListObjects, v1 and v2)
+//   GET/HEAD <prefix><bucket>/key gets an object, with Range support
+//   PUT <prefix><bucket>          creates a bucket
+//   PUT <prefix><bucket>/key      puts an object
+//
+// The buckets are the roots (permanodes with a camliRoot attribute,
+// named by it). A bucket's keys are the paths made by following
+// "camliPath:<name>" attributes from the root, down to permanodes whose
+// camliContent is a file.
+//
+// The gateway is read-only unless a "jsonSignRoot" is configured to
+// sign the permanodes and claims of PUTs. A PUT object stores the body
+// as a file, and makes it the camliContent of the key's permanode,
+// which is created, titled by the key, if new, with the permanodes of
+// the key's "directories".
+//
+// Requests are allowed if they carry the server's normal
+// authentication or, if "accessKey" and "secretKey" are configured, an
+// AWS Signature Version 4 Authorization header made with them. ACL
+// users are denied, as the buckets and keys aren't filtered by their
+// grants.
+type S3Handler struct {
+	Storage blobserver.Storage
+	Search  *search.Handler
+	Sign    *signhandler.Handler // or nil, if read-only
+
+	accessKey, secretKey string
+
+	putMu sync.Mutex // serializes the permanode updates of PUTs
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("s3", newS3FromConfig)
+}
+
+func newS3FromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	blobRoot := conf.RequiredString("blobRoot")
+	searchRoot := conf.RequiredString("searchRoot")
+	accessKey := conf.OptionalString("accessKey", "")
+	secretKey := conf.OptionalString("secretKey", "")
+	signRoot := conf.OptionalString("jsonSignRoot", "")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if (accessKey == "") != (secretKey == "") {
+		return nil, fmt.Errorf("s3 handler needs both or neither of accessKey and secretKey")
+	}
+	bs, err := ld.GetStorage(blobRoot)
+	if err != nil {
+		return nil, fmt.Errorf("s3 handler's blobRoot of %q error: %v", blobRoot, err)
+	}
+	h, err := ld.GetHandler(searchRoot)
+	if err != nil {
+		return nil, fmt.Errorf("s3 handler's searchRoot of %q error: %v", searchRoot, err)
+	}
+	sh, ok := h.(*search.Handler)
+	if !ok {
+		return nil, fmt.Errorf("s3 handler's searchRoot of %q is of type %T, expecting a search handler",
+			searchRoot, h)
+	}
+	s3h := &S3Handler{
+		Storage:   bs,
+		Search:    sh,
+		accessKey: accessKey,
+		secretKey: secretKey,
+	}
+	if signRoot != "" {
+		h, err := ld.GetHandler(signRoot)
+		if err != nil {
+			return nil, fmt.Errorf("s3 handler's jsonSignRoot of %q error: %v", signRoot, err)
+		}
+		sigh, ok := h.(*signhandler.Handler)
+		if !ok {
+			return nil, fmt.Errorf("s3 handler's jsonSignRoot of %q is of type %T, expecting a jsonsign handler",
+				signRoot, h)
+		}
+		s3h.Sign = sigh
+	}
+	return s3h, nil
+}
+
+// maxS3Keys is the most keys listed in one response.
+const maxS3Keys = 1000
+
+// maxS3Depth is the deepest chain of path claims followed.
+const maxS3Depth = 16
+
+// maxS3Objects caps the keys found when walking a bucket.
+const maxS3Objects = 100000
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func s3Fail(rw http.ResponseWriter, code int, s3code, msg string) {
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(code)
+	io.WriteString(rw, xml.Header)
+	xml.NewEncoder(rw).Encode(&s3Error{Code: s3code, Message: msg})
+}
+
+func s3Reply(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/xml")
+	io.WriteString(rw, xml.Header)
+	if err := xml.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("s3: error writing response: %v", err)
+	}
+}
+
+func (h *S3Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	op := auth.OpGet
+	if req.Method == "PUT" {
+		op = auth.OpUpload | auth.OpSign
+	}
+	if _, ok := auth.ACLUser(req); ok {
+		s3Fail(rw, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+	var sig *s3Sig // of a signed request
+	if !auth.Allowed(req, op) {
+		if h.secretKey == "" || req.Header.Get("Authorization") == "" {
+			s3Fail(rw, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return
+		}
+		var err error
+		if sig, err = h.checkSignature(req); err != nil {
+			s3Fail(rw, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+			return
+		}
+	}
+	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
+	bucket, key := suffix, ""
+	if i := strings.Index(suffix, "/"); i >= 0 {
+		bucket, key = suffix[:i], suffix[i+1:]
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		switch {
+		case h.Sign == nil:
+			s3Fail(rw, http.StatusNotImplemented, "NotImplemented", "This gateway is read-only.")
+		case bucket == "":
+			s3Fail(rw, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+		case key == "":
+			h.servePutBucket(rw, req, bucket)
+		default:
+			h.servePutObject(rw, req, bucket, key, sig)
+		}
+		return
+	default:
+		s3Fail(rw, http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented.")
+		return
+	}
+	switch {
+	case bucket == "":
+		h.serveBuckets(rw, req)
+	case key == "":
+		h.serveList(rw, req, bucket)
+	default:
+		h.serveObject(rw, req, bucket, key)
+	}
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBuckets struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+func (h *S3Handler) serveBuckets(rw http.ResponseWriter, req *http.Request) {
+	ch := make(chan *blobref.BlobRef, 100)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- h.Search.Index().SearchPermanodesWithAttr(ch, &search.PermanodeByAttrRequest{
+			Signer:    h.Search.Owner(),
+			Attribute: "camliRoot",
+		})
+	}()
+	var roots []*blobref.BlobRef
+	for br := range ch {
+		roots = append(roots, br)
+	}
+	if err := <-errch; err != nil {
+		log.Printf("s3: error listing roots: %v", err)
+		s3Fail(rw, 500, "InternalError", "error listing buckets")
+		return
+	}
+	res := &s3ListAllMyBuckets{
+		Owner: s3Owner{ID: h.Search.Owner().String(), DisplayName: h.Search.Owner().String()},
+	}
+	seen := make(map[string]bool)
+	for _, br := range roots {
+		des, err := h.describe(br)
+		if err != nil {
+			continue
+		}
+		name := des.Permanode.Attr.Get("camliRoot")
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		res.Buckets = append(res.Buckets, s3Bucket{
+			Name:         name,
+			CreationDate: startTime.UTC().Format(time.RFC3339),
+		})
+	}
+	sort.Sort(s3BucketsByName(res.Buckets))
+	s3Reply(rw, res)
+}
+
+type s3BucketsByName []s3Bucket
+
+func (s s3BucketsByName) Len() int           { return len(s) }
+func (s s3BucketsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s s3BucketsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (h *S3Handler) describe(br *blobref.BlobRef) (*search.DescribedBlob, error) {
+	dr := h.Search.NewDescribeRequest()
+	dr.Describe(br, 3)
+	res, err := dr.Result()
+	if err != nil {
+		return nil, err
+	}
+	des, ok := res[br.String()]
+	if !ok || des.Permanode == nil {
+		return nil, fmt.Errorf("%s is not a known permanode", br)
+	}
+	return des, nil
+}
+
+// An s3Object is a key of a bucket.
+type s3Object struct {
+	key     string
+	fileRef *blobref.BlobRef
+	size    int64
+}
+
+// objects appends to objs the keys under the permanode pn, which is
+// reached by the key prefix keyPrefix, recursing through path claims.
+func (h *S3Handler) objects(pn *blobref.BlobRef, keyPrefix string, depth int, objs *[]s3Object) error {
+	if depth > maxS3Depth || len(*objs) >= maxS3Objects {
+		return nil
+	}
+	des, err := h.describe(pn)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for attr := range des.Permanode.Attr {
+		if strings.HasPrefix(attr, "camliPath:") {
+			names = append(names, attr[len("camliPath:"):])
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		target := blobref.Parse(des.Permanode.Attr.Get("camliPath:" + name))
+		if target == nil {
+			continue
+		}
+		tdes, err := h.describe(target)
+		if err != nil {
+			log.Printf("s3: skipping %s%s: %v", keyPrefix, name, err)
+			continue
+		}
+		if path, fi, ok := tdes.PermanodeFile(); ok {
+			*objs = append(*objs, s3Object{key: keyPrefix + name, fileRef: path[len(path)-1], size: fi.Size})
+			continue
+		}
+		if err := h.objects(target, keyPrefix+name+"/", depth+1, objs); err != nil {
+			log.Printf("s3: skipping %s%s: %v", keyPrefix, name, err)
+		}
+	}
+	return nil
+}
+
+func (h *S3Handler) bucketRoot(bucket string) (*blobref.BlobRef, bool) {
+	pn, err := h.Search.Index().PermanodeOfSignerAttrValue(h.Search.Owner(), "camliRoot", bucket)
+	return pn, err == nil
+}
+
+type s3Contents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucket struct {
+	XMLName               xml.Name     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string       `xml:"Name"`
+	Prefix                string       `xml:"Prefix"`
+	Delimiter             string       `xml:"Delimiter,omitempty"`
+	MaxKeys               int          `xml:"MaxKeys"`
+	IsTruncated           bool         `xml:"IsTruncated"`
+	Marker                *string      `xml:"Marker"`
+	NextMarker            string       `xml:"NextMarker,omitempty"`
+	KeyCount              *int         `xml:"KeyCount"`
+	ContinuationToken     string       `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string       `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string       `xml:"StartAfter,omitempty"`
+	Contents              []s3Contents `xml:"Contents"`
+	CommonPrefixes        []s3Prefix   `xml:"CommonPrefixes"`
+}
+
+func (h *S3Handler) serveList(rw http.ResponseWriter, req *http.Request, bucket string) {
+	root, ok := h.bucketRoot(bucket)
+	if !ok {
+		s3Fail(rw, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	q := req.URL.Query()
+	if _, ok := q["location"]; ok {
+		s3Reply(rw, &struct {
+			XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+		}{})
+		return
+	}
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := maxS3Keys
+	if v := q.Get("max-keys"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < maxKeys {
+			maxKeys = n
+		}
+	}
+	v2 := q.Get("list-type") == "2"
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if tok := q.Get("continuation-token"); tok != "" {
+			after = tok
+		}
+	}
+
+	var objs []s3Object
+	if err := h.objects(root, "", 0, &objs); err != nil {
+		log.Printf("s3: error listing bucket %q: %v", bucket, err)
+		s3Fail(rw, 500, "InternalError", "error listing bucket")
+		return
+	}
+	sort.Sort(s3ObjectsByKey(objs))
+
+	res := &s3ListBucket{
+		Name:      bucket,
+		Prefix:    prefix,
+		Delimiter: delim,
+		MaxKeys:   maxKeys,
+	}
+	n, last := res.fill(objs, after)
+	if v2 {
+		res.KeyCount = &n
+		res.ContinuationToken = q.Get("continuation-token")
+		res.StartAfter = q.Get("start-after")
+		if res.IsTruncated {
+			res.NextContinuationToken = last
+		}
+	} else {
+		marker := q.Get("marker")
+		res.Marker = &marker
+		if res.IsTruncated && delim != "" {
+			res.NextMarker = last
+		}
+	}
+	s3Reply(rw, res)
+}
+
+// fill adds to res, which has its Prefix, Delimiter and MaxKeys set,
+// the keys and common prefixes of the sorted objs that sort after
+// after. It returns how many it added and the last one.
+func (res *s3ListBucket) fill(objs []s3Object, after string) (n int, last string) {
+	prefix, delim, maxKeys := res.Prefix, res.Delimiter, res.MaxKeys
+	seenPrefix := make(map[string]bool)
+	for _, o := range objs {
+		if !strings.HasPrefix(o.key, prefix) || o.key <= after {
+			continue
+		}
+		entry := o.key
+		if delim != "" {
+			if i := strings.Index(o.key[len(prefix):], delim); i >= 0 {
+				entry = o.key[:len(prefix)+i+len(delim)]
+				if seenPrefix[entry] || entry <= after {
+					continue
+				}
+			}
+		}
+		if n == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		n++
+		last = entry
+		if entry != o.key {
+			seenPrefix[entry] = true
+			res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{entry})
+			continue
+		}
+		res.Contents = append(res.Contents, s3Contents{
+			Key:          o.key,
+			LastModified: startTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         `"` + o.fileRef.String() + `"`,
+			Size:         o.size,
+			StorageClass: "STANDARD",
+		})
+	}
+	return n, last
+}
+
+type s3ObjectsByKey []s3Object
+
+func (s s3ObjectsByKey) Len() int           { return len(s) }
+func (s s3ObjectsByKey) Less(i, j int) bool { return s[i].key < s[j].key }
+func (s s3ObjectsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (h *S3Handler) serveObject(rw http.ResponseWriter, req *http.Request, bucket, key string) {
+	pn, ok := h.bucketRoot(bucket)
+	if !ok {
+		s3Fail(rw, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	noKey := func() {
+		s3Fail(rw, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	}
+	for _, name := range strings.Split(key, "/") {
+		path, err := h.Search.Index().PathLookup(h.Search.Owner(), pn, name, time.Time{})
+		if err != nil {
+			noKey()
+			return
+		}
+		pn = path.Target
+	}
+	des, err := h.describe(pn)
+	if err != nil {
+		noKey()
+		return
+	}
+	path, fi, ok := des.PermanodeFile()
+	if !ok {
+		noKey()
+		return
+	}
+	dl := &DownloadHandler{Fetcher: h.Storage, ForceMime: fi.MimeType}
+	dl.ServeHTTP(rw, req, path[len(path)-1])
+}
+
+// s3Sig is the Signature Version 4 signature of a request, which
+// aws-chunked bodies continue.
+type s3Sig struct {
+	key       []byte // the signing key
+	amzDate   string
+	scope     string // such as "20130524/us-east-1/s3/aws4_request"
+	signature string
+}
+
+// checkSignature verifies the AWS Signature Version 4 Authorization
+// header of req against the handler's keys.
+func (h *S3Handler) checkSignature(req *http.Request) (*s3Sig, error) {
+	const algo = "AWS4-HMAC-SHA256"
+	authz := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authz, algo+" ") {
+		return nil, fmt.Errorf("unsupported authorization; only %s is", algo)
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Split(authz[len(algo)+1:], ",") {
+		f = strings.TrimSpace(f)
+		if i := strings.Index(f, "="); i > 0 {
+			fields[f[:i]] = f[i+1:]
+		}
+	}
+	cred := strings.Split(fields["Credential"], "/")
+	if len(cred) != 5 || cred[4] != "aws4_request" {
+		return nil, fmt.Errorf("malformed Credential")
+	}
+	if cred[0] != h.accessKey {
+		return nil, fmt.Errorf("unknown access key")
+	}
+	amzDate := req.Header.Get("X-Amz-Date")
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return nil, fmt.Errorf("missing or invalid X-Amz-Date")
+	}
+	if d := time.Since(t); d > 15*time.Minute || d < -15*time.Minute {
+		return nil, fmt.Errorf("request time too skewed")
+	}
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	want := s3Signature(h.secretKey, req, amzDate, cred[1:4], signedHeaders)
+	if !hmac.Equal([]byte(want), []byte(fields["Signature"])) {
+		return nil, fmt.Errorf("signature mismatch")
+	}
+	return &s3Sig{
+		key:       s3SigningKey(h.secretKey, cred[1:4]),
+		amzDate:   amzDate,
+		scope:     strings.Join(cred[1:5], "/"),
+		signature: want,
+	}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	io.WriteString(m, data)
+	return m.Sum(nil)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape escapes s as AWS's canonical requests want: everything but
+// the RFC 3986 unreserved characters, and "/" if keepSlash.
+func s3Escape(s string, keepSlash bool) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			buf = append(buf, c)
+			continue
+		}
+		buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+	}
+	return string(buf)
+}
+
+// s3Signature returns the Signature Version 4 signature of req, with
+// the credential scope's date, region and service.
+func s3Signature(secretKey string, req *http.Request, amzDate string, scope []string, signedHeaders []string) string {
+	q := req.URL.Query()
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var query []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			query = append(query, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+
+	var headers []string
+	for _, name := range signedHeaders {
+		var v string
+		if name == "host" {
+			v = req.Host
+		} else {
+			v = strings.Join(req.Header[http.CanonicalHeaderKey(name)], ",")
+		}
+		headers = append(headers, name+":"+strings.TrimSpace(v)+"\n")
+	}
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = "UNSIGNED-PAYLOAD"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(query, "&"),
+		strings.Join(headers, ""),
+		strings.Join(signedHeaders, ";"),
+		payload,
+	}, "\n")
+
+	scopeStr := strings.Join(append(scope, "aws4_request"), "/")
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scopeStr,
+		sha256Hex(canonical),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(s3SigningKey(secretKey, scope), toSign))
+}
+
+// s3SigningKey returns the key signing the requests of the credential
+// scope's date, region and service.
+func s3SigningKey(secretKey string, scope []string) []byte {
+	key := []byte("AWS4" + secretKey)
+	for _, s := range append(scope, "aws4_request") {
+		key = hmacSHA256(key, s)
+	}
+	return key
+}
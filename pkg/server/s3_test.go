@@ -0,0 +1,167 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+)
+
+// The GET Object example from Amazon's Signature Version 4
+// documentation.
+func TestS3Signature(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://examplebucket.s3.amazonaws.com/test.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("X-Amz-Content-Sha256", sha256Hex(""))
+	req.Header.Set("X-Amz-Date", "20130524T000000Z")
+	got := s3Signature("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", req, "20130524T000000Z",
+		[]string{"20130524", "us-east-1", "s3"},
+		[]string{"host", "range", "x-amz-content-sha256", "x-amz-date"})
+	const want = "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41"
+	if got != want {
+		t.Errorf("signature = %s; want %s", got, want)
+	}
+}
+
+// The aws-chunked PUT Object example from Amazon's Signature Version 4
+// documentation.
+func TestS3ChunkedReader(t *testing.T) {
+	const secret = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+	scope := []string{"20130524", "us-east-1", "s3"}
+	req, err := http.NewRequest("PUT", "http://s3.amazonaws.com/examplebucket/chunkObject.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "aws-chunked")
+	req.Header.Set("Content-Length", "66824")
+	req.Header.Set("X-Amz-Content-Sha256", s3StreamingPayload)
+	req.Header.Set("X-Amz-Date", "20130524T000000Z")
+	req.Header.Set("X-Amz-Decoded-Content-Length", "66560")
+	req.Header.Set("X-Amz-Storage-Class", "REDUCED_REDUNDANCY")
+	seed := s3Signature(secret, req, "20130524T000000Z", scope,
+		[]string{"content-encoding", "content-length", "host", "x-amz-content-sha256",
+			"x-amz-date", "x-amz-decoded-content-length", "x-amz-storage-class"})
+	if want := "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9"; seed != want {
+		t.Fatalf("seed signature = %s; want %s", seed, want)
+	}
+	sig := &s3Sig{
+		key:       s3SigningKey(secret, scope),
+		amzDate:   "20130524T000000Z",
+		scope:     "20130524/us-east-1/s3/aws4_request",
+		signature: seed,
+	}
+	body := "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n" +
+		strings.Repeat("a", 65536) + "\r\n" +
+		"400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n" +
+		strings.Repeat("a", 1024) + "\r\n" +
+		"0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n\r\n"
+	got, err := ioutil.ReadAll(newS3ChunkedReader(strings.NewReader(body), sig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.Repeat([]byte("a"), 66560)) {
+		t.Errorf("decoded %d bytes; want 66560 a's", len(got))
+	}
+
+	// Unsigned, the signatures aren't checked.
+	tampered := strings.Replace(body, "aaaa", "aaab", 1)
+	if _, err := ioutil.ReadAll(newS3ChunkedReader(strings.NewReader(tampered), nil)); err != nil {
+		t.Errorf("unsigned: %v", err)
+	}
+	if _, err := ioutil.ReadAll(newS3ChunkedReader(strings.NewReader(tampered), sig)); err != errS3ChunkSignature {
+		t.Errorf("tampered chunk: err = %v; want %v", err, errS3ChunkSignature)
+	}
+	if _, err := ioutil.ReadAll(newS3ChunkedReader(strings.NewReader(body[:66000]), sig)); err == nil {
+		t.Errorf("truncated body: no error")
+	}
+}
+
+func TestS3ListFill(t *testing.T) {
+	ref := blobref.MustParse("foo-abc")
+	var objs []s3Object
+	for _, k := range []string{"a.txt", "photos/2012/x.jpg", "photos/2013/y.jpg", "photos/z.jpg", "z.txt"} {
+		objs = append(objs, s3Object{key: k, fileRef: ref})
+	}
+	tests := []struct {
+		prefix, delim, after string
+		max                  int
+		keys, prefixes       []string
+		truncated            bool
+	}{
+		{max: 1000, keys: []string{"a.txt", "photos/2012/x.jpg", "photos/2013/y.jpg", "photos/z.jpg", "z.txt"}},
+		{delim: "/", max: 1000, keys: []string{"a.txt", "z.txt"}, prefixes: []string{"photos/"}},
+		{prefix: "photos/", delim: "/", max: 1000, keys: []string{"photos/z.jpg"}, prefixes: []string{"photos/2012/", "photos/2013/"}},
+		{prefix: "photos/", delim: "/", after: "photos/2012/", max: 1, prefixes: []string{"photos/2013/"}, truncated: true},
+		{max: 2, keys: []string{"a.txt", "photos/2012/x.jpg"}, truncated: true},
+	}
+	for i, tt := range tests {
+		res := &s3ListBucket{Prefix: tt.prefix, Delimiter: tt.delim, MaxKeys: tt.max}
+		res.fill(objs, tt.after)
+		var keys, prefixes []string
+		for _, c := range res.Contents {
+			keys = append(keys, c.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !reflect.DeepEqual(keys, tt.keys) || !reflect.DeepEqual(prefixes, tt.prefixes) || res.IsTruncated != tt.truncated {
+			t.Errorf("%d. got keys %v, prefixes %v, truncated %v; want %v, %v, %v", i,
+				keys, prefixes, res.IsTruncated, tt.keys, tt.prefixes, tt.truncated)
+		}
+	}
+}
+
+func TestS3Escape(t *testing.T) {
+	if got, want := s3Escape("a b/c~", true), "a%20b/c~"; got != want {
+		t.Errorf("s3Escape = %q; want %q", got, want)
+	}
+	if got := s3Escape("a/b", false); !strings.Contains(got, "%2F") {
+		t.Errorf("s3Escape = %q; want escaped slash", got)
+	}
+}
+
+func TestS3DeniesACLUsers(t *testing.T) {
+	am, err := auth.NewMode("userpass:alice:secret:acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.SetPrefixModes(map[string]auth.AuthMode{"/s3/": am})
+	defer auth.SetPrefixModes(nil)
+
+	h := new(S3Handler)
+	for _, method := range []string{"GET", "PUT"} {
+		req, _ := http.NewRequest(method, "http://example.com/s3/bucket/key", nil)
+		req.Header.Set("X-PrefixHandler-PathSuffix", "bucket/key")
+		req.SetBasicAuth("alice", "secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "AccessDenied") {
+			t.Errorf("%s by an ACL user = %d, %q; want 403 AccessDenied", method, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+)
+
+// maxS3ChunkSize is the largest chunk of an aws-chunked body accepted,
+// as each is buffered to check its signature.
+const maxS3ChunkSize = 16 << 20
+
+// The X-Amz-Content-Sha256 of aws-chunked bodies.
+const s3StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+// errS3ChunkSignature is returned by s3ChunkedReader for chunks whose
+// signature doesn't match.
+var errS3ChunkSignature = errors.New("chunk signature mismatch")
+
+// s3ChunkedReader decodes an aws-chunked body, each chunk of which is
+// preceded by its size, in hex, and signature:
+//
+//   10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n
+//   <65536 bytes>\r\n
+//   0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n
+//   \r\n
+//
+// If sig is non-nil, each chunk's signature is checked, chaining from
+// the request's.
+type s3ChunkedReader struct {
+	r       *bufio.Reader
+	sig     *s3Sig
+	prevSig string
+	chunk   []byte // unread data of the current chunk
+	err     error
+}
+
+func newS3ChunkedReader(r io.Reader, sig *s3Sig) *s3ChunkedReader {
+	cr := &s3ChunkedReader{r: bufio.NewReader(r), sig: sig}
+	if sig != nil {
+		cr.prevSig = sig.signature
+	}
+	return cr
+}
+
+func (cr *s3ChunkedReader) Read(p []byte) (n int, err error) {
+	for len(cr.chunk) == 0 && cr.err == nil {
+		cr.err = cr.readChunk()
+	}
+	if len(cr.chunk) == 0 {
+		return 0, cr.err
+	}
+	n = copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+// readChunk reads the next chunk, returning io.EOF after the last.
+func (cr *s3ChunkedReader) readChunk() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	line = strings.TrimRight(line, "\r\n")
+	sizeHex, chunkSig := line, ""
+	if i := strings.Index(line, ";"); i >= 0 {
+		sizeHex = line[:i]
+		chunkSig = strings.TrimPrefix(line[i+1:], "chunk-signature=")
+	}
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxS3ChunkSize {
+		return fmt.Errorf("invalid chunk header %q", line)
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if string(data[size:]) != "\r\n" {
+		return errors.New("chunk not terminated by CRLF")
+	}
+	data = data[:size]
+	if cr.sig != nil {
+		toSign := strings.Join([]string{
+			"AWS4-HMAC-SHA256-PAYLOAD",
+			cr.sig.amzDate,
+			cr.sig.scope,
+			cr.prevSig,
+			sha256Hex(""),
+			sha256Hex(string(data)),
+		}, "\n")
+		want := hex.EncodeToString(hmacSHA256(cr.sig.key, toSign))
+		if !hmac.Equal([]byte(want), []byte(chunkSig)) {
+			return errS3ChunkSignature
+		}
+		cr.prevSig = want
+	}
+	if size == 0 {
+		return io.EOF
+	}
+	cr.chunk = data
+	return nil
+}
+
+// s3ValidName reports whether name is a valid bucket name, or a valid
+// component of a key.
+func s3ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func (h *S3Handler) servePutBucket(rw http.ResponseWriter, req *http.Request, bucket string) {
+	if !s3ValidName(bucket) {
+		s3Fail(rw, http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid.")
+		return
+	}
+	h.putMu.Lock()
+	defer h.putMu.Unlock()
+	if _, ok := h.bucketRoot(bucket); !ok {
+		if err := h.newBucket(bucket); err != nil {
+			log.Printf("s3: error creating bucket %q: %v", bucket, err)
+			s3Fail(rw, 500, "InternalError", "error creating bucket")
+			return
+		}
+	}
+	// Like us-east-1, an existing bucket of the same owner is a
+	// success too.
+	rw.Header().Set("Location", "/"+bucket)
+}
+
+func (h *S3Handler) newBucket(bucket string) error {
+	pn, err := h.newPermanode(bucket)
+	if err != nil {
+		return err
+	}
+	return h.setAttr(pn, "camliRoot", bucket)
+}
+
+func (h *S3Handler) newPermanode(title string) (*blobref.BlobRef, error) {
+	pn, err := signAndStore(h.Sign, h.Storage, "permanode", schema.NewUnsignedPermanode())
+	if err != nil {
+		return nil, err
+	}
+	if err := h.setAttr(pn, "title", title); err != nil {
+		return nil, err
+	}
+	return pn, nil
+}
+
+func (h *S3Handler) setAttr(pn *blobref.BlobRef, attr, value string) error {
+	_, err := signAndStore(h.Sign, h.Storage, attr+" claim", schema.NewSetAttributeClaim(pn, attr, value))
+	return err
+}
+
+// lookupOrCreate returns the target of the camliPath:name attribute of
+// parent, creating a permanode titled title for it if it has none.
+func (h *S3Handler) lookupOrCreate(parent *blobref.BlobRef, name, title string) (*blobref.BlobRef, error) {
+	p, err := h.Search.Index().PathLookup(h.Search.Owner(), parent, name, time.Time{})
+	if err == nil {
+		return p.Target, nil
+	}
+	if err != os.ErrNotExist {
+		return nil, err
+	}
+	pn, err := h.newPermanode(title)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.setAttr(parent, "camliPath:"+name, pn.String()); err != nil {
+		return nil, err
+	}
+	return pn, nil
+}
+
+func (h *S3Handler) servePutObject(rw http.ResponseWriter, req *http.Request, bucket, key string, sig *s3Sig) {
+	names := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for _, name := range names {
+		if !s3ValidName(name) {
+			s3Fail(rw, http.StatusBadRequest, "InvalidArgument", "The specified key is not valid.")
+			return
+		}
+	}
+	root, ok := h.bucketRoot(bucket)
+	if !ok {
+		s3Fail(rw, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	md5h, sha256h := md5.New(), sha256.New()
+	var body io.Reader = req.Body
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == s3StreamingPayload {
+		body = newS3ChunkedReader(body, sig)
+	}
+	body = io.TeeReader(body, io.MultiWriter(md5h, sha256h))
+
+	var fileRef *blobref.BlobRef
+	var err error
+	if strings.HasSuffix(key, "/") {
+		// A "directory" marker, with no contents.
+		_, err = io.Copy(ioutil.Discard, body)
+	} else {
+		fileRef, err = schema.WriteFileFromReader(h.Storage, names[len(names)-1], body)
+	}
+	switch {
+	case err == errS3ChunkSignature:
+		s3Fail(rw, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	case err != nil:
+		log.Printf("s3: error storing %s/%s: %v", bucket, key, err)
+		s3Fail(rw, http.StatusBadRequest, "IncompleteBody", "error reading the body")
+		return
+	}
+	if !s3DigestsMatch(req, payloadHash, md5h, sha256h) {
+		s3Fail(rw, http.StatusBadRequest, "BadDigest", "The digest of the body did not match what was specified.")
+		return
+	}
+
+	h.putMu.Lock()
+	defer h.putMu.Unlock()
+	if err := h.putPath(root, names, key, fileRef); err != nil {
+		log.Printf("s3: error putting %s/%s: %v", bucket, key, err)
+		s3Fail(rw, 500, "InternalError", "error putting object")
+		return
+	}
+	rw.Header().Set("ETag", `"`+hex.EncodeToString(md5h.Sum(nil))+`"`)
+}
+
+// s3DigestsMatch reports whether the MD5 and SHA-256 of the body,
+// given by md5h and sha256h, match the request's Content-MD5 header
+// and X-Amz-Content-Sha256 payloadHash, if it's one.
+func s3DigestsMatch(req *http.Request, payloadHash string, md5h, sha256h hash.Hash) bool {
+	if want := req.Header.Get("Content-MD5"); want != "" && want != base64.StdEncoding.EncodeToString(md5h.Sum(nil)) {
+		return false
+	}
+	switch payloadHash {
+	case "", "UNSIGNED-PAYLOAD", s3StreamingPayload:
+		return true
+	}
+	return strings.ToLower(payloadHash) == hex.EncodeToString(sha256h.Sum(nil))
+}
+
+// putPath makes fileRef, or nothing for a directory marker, the
+// content of the permanode reached from root by the path claims of
+// names, creating the permanodes missing.
+func (h *S3Handler) putPath(root *blobref.BlobRef, names []string, key string, fileRef *blobref.BlobRef) error {
+	pn := root
+	for i, name := range names {
+		title := name
+		if i == len(names)-1 && fileRef != nil {
+			title = key
+		}
+		var err error
+		if pn, err = h.lookupOrCreate(pn, name, title); err != nil {
+			return err
+		}
+	}
+	if fileRef == nil {
+		return nil
+	}
+	return h.setAttr(pn, "camliContent", fileRef.String())
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/gethandler"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/jsonsign/signhandler"
+	"camlistore.org/pkg/schema"
+)
+
+// ShareHandler mints "share" claims and serves the blobs they grant
+// access to.
+//
+// A POST to the handler's root, by an authenticated user other than
+// an ACL user, with the parameters "blobref", and optionally
+// "transitive" and "expires", signs and stores a new share of blobref
+// and returns its blobref and URL as JSON. "expires" is either an RFC
+// 3339 time or a duration from now, such as "72h".
+//
+// GET requests of <prefix>camli/<blobref>[?via=<share>,...] are
+// served without authentication as long as they're reached through
+// an unexpired, unrevoked share, following the normal blob GET
+// protocol, so the share URL <prefix>camli/<share> can be given to
+// camget -shared.
+//
+// Authenticated users, other than ACL users, can also GET the
+// handler's root for the list of active shares minted by the handler
+// (or all known shares, including revoked and expired ones, with
+// "all=1"), and POST to <prefix>revoke with a "share" parameter to
+// revoke any share, immediately. The revocation applies to the accesses through all get handlers,
+// including the blob root's /camli/<blobref>?via=<share>, every one
+// of which is logged, and appended to the optional "auditLog" file.
+type ShareHandler struct {
+	Storage blobserver.Storage
+	Sign    *signhandler.Handler
+
+	prefix string
+	getter *gethandler.Handler
+	state  *shareState
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("share", newShareFromConfig)
+}
+
+func newShareFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	blobRoot := conf.RequiredString("blobRoot")
+	signRoot := conf.RequiredString("jsonSignRoot")
+	stateFile := conf.OptionalString("stateFile", "")
+	auditLog := conf.OptionalString("auditLog", "")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	bs, err := ld.GetStorage(blobRoot)
+	if err != nil {
+		return nil, fmt.Errorf("share handler's blobRoot of %q error: %v", blobRoot, err)
+	}
+	h, err := ld.GetHandler(signRoot)
+	if err != nil {
+		return nil, fmt.Errorf("share handler's jsonSignRoot of %q error: %v", signRoot, err)
+	}
+	sigh, ok := h.(*signhandler.Handler)
+	if !ok {
+		return nil, fmt.Errorf("share handler's jsonSignRoot of %q is of type %T, expecting a jsonsign handler",
+			signRoot, h)
+	}
+	state, err := newShareState(stateFile, auditLog)
+	if err != nil {
+		return nil, fmt.Errorf("share handler's state: %v", err)
+	}
+	allShareStates.register(ld.MyPrefix(), state)
+	return &ShareHandler{
+		Storage: bs,
+		Sign:    sigh,
+		prefix:  ld.MyPrefix(),
+		getter:  &gethandler.Handler{Fetcher: bs},
+		state:   state,
+	}, nil
+}
+
+func (sh *ShareHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
+	switch {
+	// ACL users may not share what their grants don't cover, nor
+	// see or revoke others' shares.
+	case suffix == "" && req.Method == "POST":
+		auth.DenyACLUsers(sh.serveCreate)(rw, req)
+	case suffix == "" && req.Method == "GET":
+		auth.DenyACLUsers(sh.serveList)(rw, req)
+	case suffix == "revoke" && req.Method == "POST":
+		auth.DenyACLUsers(sh.serveRevoke)(rw, req)
+	case strings.HasPrefix(suffix, "camli/") && (req.Method == "GET" || req.Method == "HEAD"):
+		sh.getter.ServeHTTP(rw, req)
+	default:
+		httputil.ErrorRouting(rw, req)
+	}
+}
+
+// parseExpires parses the "expires" parameter of a share creation,
+// relative to now.
+func parseExpires(v string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("non-positive expiration duration %q", v)
+		}
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiration %q; want a duration or an RFC 3339 time", v)
+	}
+	if !t.After(now) {
+		return time.Time{}, fmt.Errorf("expiration %q is in the past", v)
+	}
+	return t, nil
+}
+
+func (sh *ShareHandler) serveCreate(rw http.ResponseWriter, req *http.Request) {
+	if !auth.Allowed(req, auth.OpSign) {
+		auth.SendUnauthorized(rw)
+		return
+	}
+	target := blobref.Parse(req.FormValue("blobref"))
+	if target == nil {
+		httputil.BadRequestError(rw, "Missing or invalid 'blobref' param")
+		return
+	}
+	transitive := false
+	if v := req.FormValue("transitive"); v != "" {
+		var err error
+		transitive, err = strconv.ParseBool(v)
+		if err != nil {
+			httputil.BadRequestError(rw, "Invalid 'transitive' param")
+			return
+		}
+	}
+	m := schema.NewShareRef(schema.ShareHaveRef, target, transitive)
+	ret := map[string]interface{}{}
+	if v := req.FormValue("expires"); v != "" {
+		t, err := parseExpires(v, time.Now())
+		if err != nil {
+			httputil.BadRequestError(rw, "%v", err)
+			return
+		}
+		m.SetShareExpiration(t)
+		ret["expires"] = m["expires"]
+	}
+
+	share, err := signAndStore(sh.Sign, sh.Storage, "share", m)
+	if err != nil {
+		httputil.ServerError(rw, req, err)
+		return
+	}
+	expires, _ := m["expires"].(string)
+	err = sh.state.record(shareEvent{
+		Op:         "create",
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Share:      share.String(),
+		Target:     target.String(),
+		Transitive: transitive,
+		Expires:    expires,
+	})
+	if err != nil {
+		httputil.ServerError(rw, req, fmt.Errorf("error recording share: %v", err))
+		return
+	}
+
+	scheme := "http"
+	if httputil.IsSecure(req) {
+		scheme = "https"
+	}
+	ret["share"] = share.String()
+	ret["url"] = scheme + "://" + req.Host + sh.prefix + "camli/" + share.String()
+	httputil.ReturnJSON(rw, ret)
+}
+
+func (sh *ShareHandler) serveList(rw http.ResponseWriter, req *http.Request) {
+	if !auth.Allowed(req, auth.OpGet) {
+		auth.SendUnauthorized(rw)
+		return
+	}
+	all, _ := strconv.ParseBool(req.FormValue("all"))
+	httputil.ReturnJSON(rw, map[string]interface{}{
+		"shares": sh.state.list(all, time.Now()),
+	})
+}
+
+func (sh *ShareHandler) serveRevoke(rw http.ResponseWriter, req *http.Request) {
+	if !auth.Allowed(req, auth.OpSign) {
+		auth.SendUnauthorized(rw)
+		return
+	}
+	share := blobref.Parse(req.FormValue("share"))
+	if share == nil {
+		httputil.BadRequestError(rw, "Missing or invalid 'share' param")
+		return
+	}
+	if err := sh.state.revoke(share, time.Now()); err != nil {
+		httputil.ServerError(rw, req, err)
+		return
+	}
+	httputil.ReturnJSON(rw, map[string]interface{}{
+		"revoked": share.String(),
+	})
+}
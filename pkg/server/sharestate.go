@@ -0,0 +1,300 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver/gethandler"
+)
+
+// errShareRevoked is returned by shareState.ShareAccess for revoked shares.
+var errShareRevoked = errors.New("share revoked")
+
+// A shareEvent is one line of a share handler's state file.
+type shareEvent struct {
+	Op         string `json:"op"` // "create" or "revoke"
+	Time       string `json:"time"`
+	Share      string `json:"share"`
+	Target     string `json:"target,omitempty"`
+	Transitive bool   `json:"transitive,omitempty"`
+	Expires    string `json:"expires,omitempty"`
+}
+
+// shareInfo is what's known about a share.
+type shareInfo struct {
+	Share      string `json:"share"`
+	Target     string `json:"target,omitempty"`
+	Transitive bool   `json:"transitive,omitempty"`
+	Expires    string `json:"expires,omitempty"`
+	Created    string `json:"created,omitempty"`
+	Revoked    string `json:"revoked,omitempty"`
+
+	// Accesses and LastAccess count accesses since the server
+	// started.
+	Accesses   int    `json:"accesses"`
+	LastAccess string `json:"lastAccess,omitempty"`
+}
+
+// active reports whether the share is neither revoked nor expired at now.
+func (si *shareInfo) active(now time.Time) bool {
+	if si.Revoked != "" {
+		return false
+	}
+	if si.Expires != "" {
+		t, err := time.Parse(time.RFC3339, si.Expires)
+		if err != nil || !now.Before(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// shareAccess is one line of a share handler's audit log.
+type shareAccess struct {
+	Time       string `json:"time"`
+	Share      string `json:"share"`
+	Blob       string `json:"blob"`
+	RemoteAddr string `json:"remoteAddr"`
+	UserAgent  string `json:"userAgent,omitempty"`
+}
+
+// shareState tracks the shares minted and revoked through a share
+// handler, persisted as an append-only log of shareEvents, and audits
+// the accesses made through shares, by any get handler: see
+// shareStates.
+type shareState struct {
+	mu     sync.Mutex
+	f      *os.File  // state file, or nil if not persisted
+	audit  io.Writer // audit log, or nil
+	shares map[string]*shareInfo
+}
+
+// newShareState returns a shareState loaded from, and persisted to,
+// stateFile (if non-empty), and appending accesses to auditFile (if
+// non-empty).
+func newShareState(stateFile, auditFile string) (*shareState, error) {
+	st := &shareState{shares: make(map[string]*shareInfo)}
+	if stateFile != "" {
+		f, err := os.OpenFile(stateFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var ev shareEvent
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("error parsing share state file %s: %v", stateFile, err)
+			}
+			st.apply(ev)
+		}
+		if err := scanner.Err(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error reading share state file %s: %v", stateFile, err)
+		}
+		st.f = f
+	}
+	if auditFile != "" {
+		f, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		st.audit = f
+	}
+	return st, nil
+}
+
+func (st *shareState) info(share string) *shareInfo {
+	si, ok := st.shares[share]
+	if !ok {
+		si = &shareInfo{Share: share}
+		st.shares[share] = si
+	}
+	return si
+}
+
+// apply applies ev to st. st.mu must be held, or st not yet shared.
+func (st *shareState) apply(ev shareEvent) {
+	si := st.info(ev.Share)
+	switch ev.Op {
+	case "create":
+		si.Target = ev.Target
+		si.Transitive = ev.Transitive
+		si.Expires = ev.Expires
+		si.Created = ev.Time
+	case "revoke":
+		if si.Revoked == "" {
+			si.Revoked = ev.Time
+		}
+	}
+}
+
+// record persists and applies ev.
+func (st *shareState) record(ev shareEvent) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.f != nil {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := st.f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	} else if ev.Op == "revoke" {
+		// A revocation that's forgotten at the next restart would
+		// silently re-enable the share.
+		return errors.New("revoking shares requires a share handler stateFile")
+	}
+	st.apply(ev)
+	return nil
+}
+
+// revoke revokes the share, taking effect for all later accesses.
+func (st *shareState) revoke(share *blobref.BlobRef, now time.Time) error {
+	return st.record(shareEvent{
+		Op:    "revoke",
+		Time:  now.UTC().Format(time.RFC3339),
+		Share: share.String(),
+	})
+}
+
+// list returns the known shares, sorted by share blobref. Unless all
+// is set, only the active ones at now are returned.
+func (st *shareState) list(all bool, now time.Time) []shareInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var keys []string
+	for k, si := range st.shares {
+		if all || (si.Created != "" && si.active(now)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	infos := make([]shareInfo, 0, len(keys))
+	for _, k := range keys {
+		infos = append(infos, *st.shares[k])
+	}
+	return infos
+}
+
+// revoked reports whether share is revoked.
+func (st *shareState) revoked(share *blobref.BlobRef) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	si, ok := st.shares[share.String()]
+	return ok && si.Revoked != ""
+}
+
+// ShareAccess denies the access if share is revoked, and else counts
+// and audits it.
+func (st *shareState) ShareAccess(req *http.Request, share, blob *blobref.BlobRef) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	si, ok := st.shares[share.String()]
+	if ok && si.Revoked != "" {
+		return errShareRevoked
+	}
+	if ok {
+		si.Accesses++
+		si.LastAccess = now
+	}
+	acc := shareAccess{
+		Time:       now,
+		Share:      share.String(),
+		Blob:       blob.String(),
+		RemoteAddr: req.RemoteAddr,
+		UserAgent:  req.UserAgent(),
+	}
+	log.Printf("Share access: %s via share %s from %s", acc.Blob, acc.Share, acc.RemoteAddr)
+	if st.audit != nil {
+		line, err := json.Marshal(acc)
+		if err != nil {
+			return err
+		}
+		if _, err := st.audit.Write(append(line, '\n')); err != nil {
+			// Don't serve what can't be audited.
+			return fmt.Errorf("error writing share audit log: %v", err)
+		}
+	}
+	return nil
+}
+
+// shareStates are the states of the share handlers, by prefix.
+// Registered with gethandler.SetShareGuard, they guard the accesses
+// through shares of all get handlers, including the blob root's: a
+// share revoked by any share handler is revoked for all.
+type shareStates struct {
+	mu sync.Mutex
+	m  map[string]*shareState
+}
+
+var allShareStates = &shareStates{m: make(map[string]*shareState)}
+
+// register sets the state of the share handler at prefix, replacing
+// the one of a previous configuration.
+func (ss *shareStates) register(prefix string, st *shareState) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.m[prefix] = st
+	gethandler.SetShareGuard(ss)
+}
+
+func (ss *shareStates) list() []*shareState {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var prefixes []string
+	for prefix := range ss.m {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	sts := make([]*shareState, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		sts = append(sts, ss.m[prefix])
+	}
+	return sts
+}
+
+// ShareAccess denies the access if any share handler revoked share,
+// and else has each of them audit it.
+func (ss *shareStates) ShareAccess(req *http.Request, share, blob *blobref.BlobRef) error {
+	sts := ss.list()
+	for _, st := range sts {
+		if st.revoked(share) {
+			return errShareRevoked
+		}
+	}
+	for _, st := range sts {
+		if err := st.ShareAccess(req, share, blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
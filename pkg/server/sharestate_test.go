@@ -0,0 +1,203 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver/gethandler"
+	"camlistore.org/pkg/test"
+)
+
+func TestShareState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-sharestate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "shares")
+	auditFile := filepath.Join(dir, "audit")
+
+	now := time.Unix(1360000000, 0)
+	share1 := blobref.MustParse("foo-111")
+	share2 := blobref.MustParse("foo-222")
+	blob := blobref.MustParse("foo-999")
+	req, _ := http.NewRequest("GET", "http://example.com/camli/foo-999", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	st, err := newShareState(stateFile, auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, share := range []*blobref.BlobRef{share1, share2} {
+		if err := st.record(shareEvent{Op: "create", Time: "2013-02-04T00:00:00Z", Share: share.String(), Target: blob.String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.ShareAccess(req, share1, blob); err != nil {
+		t.Fatalf("access via share1: %v", err)
+	}
+	if err := st.revoke(share1, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.ShareAccess(req, share1, blob); err != errShareRevoked {
+		t.Errorf("access via revoked share1 = %v; want errShareRevoked", err)
+	}
+	if got := st.list(false, now); len(got) != 1 || got[0].Share != share2.String() {
+		t.Errorf("active shares = %+v; want just %s", got, share2)
+	}
+
+	// Reload from the state file.
+	st, err = newShareState(stateFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.ShareAccess(req, share1, blob); err != errShareRevoked {
+		t.Errorf("after reload, access via revoked share1 = %v; want errShareRevoked", err)
+	}
+	if err := st.ShareAccess(req, share2, blob); err != nil {
+		t.Errorf("after reload, access via share2: %v", err)
+	}
+	if got := st.list(true, now); len(got) != 2 {
+		t.Errorf("all shares = %+v; want 2", got)
+	}
+
+	audit, err := ioutil.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(audit), "\n"); n != 1 {
+		t.Errorf("audit log has %d lines; want 1:\n%s", n, audit)
+	}
+	if !strings.Contains(string(audit), `"remoteAddr":"10.0.0.1:1234"`) {
+		t.Errorf("audit log lacks remote address:\n%s", audit)
+	}
+}
+
+func TestShareStateRevokeNeedsFile(t *testing.T) {
+	st, err := newShareState("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.revoke(blobref.MustParse("foo-111"), time.Now()); err == nil {
+		t.Errorf("revoke without a state file succeeded")
+	}
+}
+
+func TestShareGuard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-sharestate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := newShareState(filepath.Join(dir, "shares"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := auth.NewMode("userpass:alice:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.SetPrefixModes(map[string]auth.AuthMode{"/share/": am, "/bs/": am})
+	defer auth.SetPrefixModes(nil)
+
+	blob := &test.Blob{Contents: "Hello, share"}
+	share := &test.Blob{Contents: `{"camliVersion": 1,
+  "camliType": "share",
+  "authType": "haveref",
+  "target": "` + blob.BlobRef().String() + `",
+  "transitive": false
+}`}
+	fetcher := new(test.Fetcher)
+	fetcher.AddBlob(blob)
+	fetcher.AddBlob(share)
+	err = st.record(shareEvent{Op: "create", Share: share.BlobRef().String(), Target: blob.BlobRef().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &shareStates{m: make(map[string]*shareState)}
+	ss.register("/share/", st)
+	defer gethandler.SetShareGuard(nil)
+
+	// The share handler's own get handler, and the blob root's.
+	shareGet := &gethandler.Handler{Fetcher: fetcher}
+	blobGet := http.HandlerFunc(gethandler.CreateGetHandler(fetcher))
+	get := func(h http.Handler, prefix string) int {
+		req, _ := http.NewRequest("GET", "http://example.com"+prefix+"camli/"+blob.BlobRef().String()+"?via="+share.BlobRef().String(), nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get(shareGet, "/share/"); code != 200 {
+		t.Fatalf("GET via share: status %d; want 200", code)
+	}
+	if code := get(blobGet, "/bs/"); code != 200 {
+		t.Fatalf("GET via share from the blob root: status %d; want 200", code)
+	}
+	if got := st.list(true, time.Now()); len(got) != 1 || got[0].Accesses != 2 {
+		t.Errorf("shares after 2 accesses = %+v; want 1 of 2 accesses", got)
+	}
+	if err := st.revoke(share.BlobRef(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(shareGet, "/share/"); code != http.StatusUnauthorized {
+		t.Errorf("GET via revoked share: status %d; want 401", code)
+	}
+	if code := get(blobGet, "/bs/"); code != http.StatusUnauthorized {
+		t.Errorf("GET via revoked share from the blob root: status %d; want 401", code)
+	}
+}
+
+func TestShareHandlerDeniesACLUsers(t *testing.T) {
+	st, err := newShareState("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	am, err := auth.NewMode("userpass:alice:secret:acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.SetPrefixModes(map[string]auth.AuthMode{"/share/": am})
+	defer auth.SetPrefixModes(nil)
+	sh := &ShareHandler{prefix: "/share/", state: st}
+	for _, tt := range []struct {
+		method, suffix, query string
+	}{
+		{"POST", "", "blobref=foo-111&transitive=1"},
+		{"GET", "", "all=1"},
+		{"POST", "revoke", "share=foo-222"},
+	} {
+		req, _ := http.NewRequest(tt.method, "http://example.com/share/"+tt.suffix+"?"+tt.query, nil)
+		req.Header.Set("X-PrefixHandler-PathSuffix", tt.suffix)
+		req.SetBasicAuth("alice", "secret")
+		rec := httptest.NewRecorder()
+		sh.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s %q by an ACL user: status %d; want 403", tt.method, tt.suffix, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/audit"
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/gethandler"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+// SignedURLHandler mints signed URLs of blobs on the blob handler at
+// blobRoot, granting anyone GET access to one blob for a limited time,
+// such as to embed an image in an email or on another site. A GET
+// with the parameters "blob" and, optionally, "ttl" in seconds (one
+// hour by default, and at most maxTTL) replies with the "url" and
+// when it "expires":
+//
+//   "/signedurl/": {
+//       "handler": "signedurl",
+//       "handlerArgs": {
+//           "blobRoot": "/bs/",
+//           "maxTTL": 604800,
+//           "key": "some long random string"
+//       }
+//   }
+//
+// The optional key signs the URLs, so they stay valid across
+// restarts; by default it's random.
+type SignedURLHandler struct {
+	blobRoot string
+	maxTTL   time.Duration
+}
+
+const defaultSignedURLTTL = time.Hour
+
+func init() {
+	blobserver.RegisterHandlerConstructor("signedurl", newSignedURLFromConfig)
+}
+
+func newSignedURLFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	blobRoot := conf.RequiredString("blobRoot")
+	maxTTL := conf.OptionalInt("maxTTL", 7*24*3600)
+	key := conf.OptionalString("key", "")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if maxTTL <= 0 {
+		return nil, fmt.Errorf("signedurl handler's maxTTL must be positive; got %d", maxTTL)
+	}
+	if _, err := ld.GetStorage(blobRoot); err != nil {
+		return nil, fmt.Errorf("signedurl handler's blobRoot of %q error: %v", blobRoot, err)
+	}
+	if key != "" {
+		gethandler.SetURLSigningKey([]byte(key))
+	}
+	return &SignedURLHandler{
+		blobRoot: strings.TrimSuffix(blobRoot, "/") + "/",
+		maxTTL:   time.Duration(maxTTL) * time.Second,
+	}, nil
+}
+
+func (h *SignedURLHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(rw, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	br := blobref.Parse(req.FormValue("blob"))
+	if br == nil {
+		httputil.BadRequestError(rw, "Missing or invalid blob parameter")
+		return
+	}
+	ttl := defaultSignedURLTTL
+	if s := req.FormValue("ttl"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs <= 0 {
+			httputil.BadRequestError(rw, "Invalid ttl parameter")
+			return
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+	if ttl > h.maxTTL {
+		http.Error(rw, fmt.Sprintf("ttl is over the maximum of %d seconds", int(h.maxTTL.Seconds())), http.StatusBadRequest)
+		return
+	}
+	// Only the blobs its user may get themselves.
+	if !auth.AllowedBlob(req, br, auth.OpGet) {
+		httputil.ForbiddenError(rw, "No access to %s", br)
+		return
+	}
+	base, err := httputil.BaseURL(h.blobRoot, req)
+	if err != nil {
+		httputil.ServerError(rw, req, err)
+		return
+	}
+	expires := time.Now().Add(ttl)
+	audit.Log(req, audit.EventSignedURL, "", fmt.Sprintf("%s until %s", br, expires.UTC().Format(time.RFC3339)))
+	httputil.ReturnJSON(rw, map[string]interface{}{
+		"url":     base + "/camli/" + br.String() + "?" + gethandler.SignedURLQuery(br, expires),
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+}
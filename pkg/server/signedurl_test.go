@@ -0,0 +1,92 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobserver/gethandler"
+	"camlistore.org/pkg/test"
+)
+
+func TestSignedURL(t *testing.T) {
+	blob := &test.Blob{Contents: "Hello, signed URL"}
+	fetcher := new(test.Fetcher)
+	fetcher.AddBlob(blob)
+	gh := &gethandler.Handler{Fetcher: fetcher}
+
+	get := func(rawurl string) int {
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		rec := httptest.NewRecorder()
+		gh.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	sh := &SignedURLHandler{blobRoot: "/bs/", maxTTL: 24 * time.Hour}
+	req, _ := http.NewRequest("GET", "http://example.com/signedurl/?ttl=60&blob="+blob.BlobRef().String(), nil)
+	rec := httptest.NewRecorder()
+	sh.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("minting signed URL: status %d, %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		URL     string `json:"url"`
+		Expires string `json:"expires"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	want := "http://example.com/bs/camli/" + blob.BlobRef().String() + "?"
+	if !strings.HasPrefix(res.URL, want) {
+		t.Fatalf("url = %q; want prefix %q", res.URL, want)
+	}
+	if code := get(res.URL); code != 200 {
+		t.Errorf("GET of signed URL: status %d; want 200", code)
+	}
+
+	u, _ := url.Parse(res.URL)
+	q := u.Query()
+	q.Set("expires", "9999999999")
+	u.RawQuery = q.Encode()
+	if code := get(u.String()); code != http.StatusForbidden {
+		t.Errorf("GET of tampered signed URL: status %d; want 403", code)
+	}
+
+	other := "http://example.com/bs/camli/sha1-0000000000000000000000000000000000000000?" + u.Query().Encode()
+	if code := get(other); code != http.StatusForbidden {
+		t.Errorf("GET of other blob with signed URL: status %d; want 403", code)
+	}
+
+	br := blob.BlobRef()
+	expired := "http://example.com/bs/camli/" + br.String() + "?" + gethandler.SignedURLQuery(br, time.Now().Add(-time.Minute))
+	if code := get(expired); code != http.StatusForbidden {
+		t.Errorf("GET of expired signed URL: status %d; want 403", code)
+	}
+
+	req, _ = http.NewRequest("GET", "http://example.com/signedurl/?ttl=999999&blob="+br.String(), nil)
+	rec = httptest.NewRecorder()
+	sh.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("minting with ttl over maxTTL: status %d; want 400", rec.Code)
+	}
+}
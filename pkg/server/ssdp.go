@@ -0,0 +1,147 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+const (
+	ssdpMaxAge         = 1800
+	ssdpNotifyInterval = 15 * time.Minute
+)
+
+// An ssdpAnnouncer makes a UPnP device discoverable with SSDP: it
+// answers M-SEARCH requests and multicasts ssdp:alive notifications.
+type ssdpAnnouncer struct {
+	location string // URL of the device description
+	uuid     string
+	server   string   // SERVER header
+	types    []string // device and service types, besides the uuid and upnp:rootdevice
+}
+
+// targets returns the notification types of the device.
+func (a *ssdpAnnouncer) targets() []string {
+	return append([]string{"upnp:rootdevice", "uuid:" + a.uuid}, a.types...)
+}
+
+// usn returns the unique service name for the notification type nt.
+func (a *ssdpAnnouncer) usn(nt string) string {
+	if nt == "uuid:"+a.uuid {
+		return nt
+	}
+	return "uuid:" + a.uuid + "::" + nt
+}
+
+// matches returns which of the device's targets the search target st
+// matches.
+func (a *ssdpAnnouncer) matches(st string) []string {
+	if st == "ssdp:all" {
+		return a.targets()
+	}
+	for _, t := range a.targets() {
+		if t == st {
+			return []string{t}
+		}
+	}
+	return nil
+}
+
+func (a *ssdpAnnouncer) searchResponse(st string) []byte {
+	return []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+		"CACHE-CONTROL: max-age=%d\r\n"+
+		"DATE: %s\r\n"+
+		"EXT:\r\n"+
+		"LOCATION: %s\r\n"+
+		"SERVER: %s\r\n"+
+		"ST: %s\r\n"+
+		"USN: %s\r\n\r\n",
+		ssdpMaxAge, time.Now().UTC().Format(http.TimeFormat), a.location, a.server, st, a.usn(st)))
+}
+
+func (a *ssdpAnnouncer) notify(nt, nts string) []byte {
+	return []byte(fmt.Sprintf("NOTIFY * HTTP/1.1\r\n"+
+		"HOST: %s\r\n"+
+		"CACHE-CONTROL: max-age=%d\r\n"+
+		"LOCATION: %s\r\n"+
+		"NT: %s\r\n"+
+		"NTS: %s\r\n"+
+		"SERVER: %s\r\n"+
+		"USN: %s\r\n\r\n",
+		ssdpAddr, ssdpMaxAge, a.location, nt, nts, a.server, a.usn(nt)))
+}
+
+// run announces the device until the multicast socket fails, which it
+// logs.
+func (a *ssdpAnnouncer) run() {
+	conn, err := net.ListenMulticastUDP("udp4", nil, ssdpAddr)
+	if err != nil {
+		log.Printf("SSDP: not announcing %s: %v", a.location, err)
+		return
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			for _, nt := range a.targets() {
+				if _, err := conn.WriteToUDP(a.notify(nt, "ssdp:alive"), ssdpAddr); err != nil {
+					log.Printf("SSDP: error sending notification: %v", err)
+				}
+			}
+			time.Sleep(ssdpNotifyInterval)
+		}
+	}()
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("SSDP: stopped announcing %s: %v", a.location, err)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		sts := a.matches(req.Header.Get("St"))
+		if len(sts) == 0 {
+			continue
+		}
+		// Spread responses over the MX seconds the searcher
+		// waits, as the spec asks.
+		mx, _ := strconv.Atoi(req.Header.Get("Mx"))
+		if mx > 5 {
+			mx = 5
+		}
+		go func(from *net.UDPAddr, sts []string, mx int) {
+			if mx > 0 {
+				time.Sleep(time.Duration(rand.Int63n(int64(mx) * int64(time.Second))))
+			}
+			for _, st := range sts {
+				conn.WriteToUDP(a.searchResponse(st), from)
+			}
+		}(from, sts, mx)
+	}
+}
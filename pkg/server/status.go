@@ -0,0 +1,206 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/buildinfo"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+// startTime is when the server process started, for its uptime.
+var startTime = time.Now()
+
+// maxStatusCount is the most blobs counted in a storage or sync queue
+// for a status report.
+const maxStatusCount = 100000
+
+// StatusHandler serves, as JSON, the status of the server and of the
+// storage, sync and importer handlers it's configured with:
+//
+//   "/status/": {
+//       "handler": "status",
+//       "handlerArgs": {
+//           "storage": ["/bs/", "/index-mem/"],
+//           "sync": ["/sync/"],
+//           "importers": ["/importer-flickr/"]
+//       }
+//   }
+//
+// The index's backlog is the queue depth of the sync handler feeding
+// it. Blob counts stop at maxStatusCount, with "countTruncated" set.
+type StatusHandler struct {
+	storage     map[string]blobserver.Storage // keyed by prefix
+	storageType map[string]string
+	sync        map[string]*SyncHandler
+	importers   map[string]statusMapper
+}
+
+// A statusMapper is a handler reporting its status, such as an
+// importer handler.
+type statusMapper interface {
+	StatusMap() map[string]interface{}
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("status", newStatusFromConfig)
+}
+
+func newStatusFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	storage := conf.OptionalList("storage")
+	syncs := conf.OptionalList("sync")
+	importers := conf.OptionalList("importers")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	sh := &StatusHandler{
+		storage:     make(map[string]blobserver.Storage),
+		storageType: make(map[string]string),
+		sync:        make(map[string]*SyncHandler),
+		importers:   make(map[string]statusMapper),
+	}
+	for _, prefix := range storage {
+		sto, err := ld.GetStorage(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("status handler's storage %q error: %v", prefix, err)
+		}
+		sh.storage[prefix] = sto
+		sh.storageType[prefix] = ld.GetHandlerType(prefix)
+	}
+	for _, prefix := range syncs {
+		h, err := ld.GetHandler(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("status handler's sync %q error: %v", prefix, err)
+		}
+		synch, ok := h.(*SyncHandler)
+		if !ok {
+			return nil, fmt.Errorf("status handler's sync %q is of type %T, expecting a sync handler", prefix, h)
+		}
+		sh.sync[prefix] = synch
+	}
+	for _, prefix := range importers {
+		h, err := ld.GetHandler(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("status handler's importer %q error: %v", prefix, err)
+		}
+		imph, ok := h.(statusMapper)
+		if !ok {
+			return nil, fmt.Errorf("status handler's importer %q is of type %T, expecting an importer handler", prefix, h)
+		}
+		sh.importers[prefix] = imph
+	}
+	return sh, nil
+}
+
+// countBlobs enumerates e, counting at most max blobs. It returns the
+// number and total size of the blobs counted, and whether it stopped
+// at max.
+func countBlobs(e blobserver.BlobEnumerator, max int) (n int, size int64, truncated bool, err error) {
+	const batch = 1000
+	after := ""
+	for n < max {
+		ch := make(chan blobref.SizedBlobRef)
+		errch := make(chan error, 1)
+		go func() {
+			errch <- e.EnumerateBlobs(ch, after, batch, 0)
+		}()
+		got := 0
+		for sb := range ch {
+			got++
+			size += sb.Size
+			after = sb.BlobRef.String()
+		}
+		if err := <-errch; err != nil {
+			return n, size, false, err
+		}
+		n += got
+		if got < batch {
+			return n, size, false, nil
+		}
+	}
+	return n, size, true, nil
+}
+
+func (sh *StatusHandler) storageStatus(prefix string) map[string]interface{} {
+	sto := sh.storage[prefix]
+	m := map[string]interface{}{
+		"type": sh.storageType[prefix],
+	}
+	if gener, ok := sto.(blobserver.Generationer); ok {
+		initTime, gen, err := gener.StorageGeneration()
+		if err != nil {
+			m["storageGenerationError"] = err.Error()
+		} else {
+			m["storageInitTime"] = initTime.UTC().Format(time.RFC3339)
+			m["storageGeneration"] = gen
+		}
+	}
+	n, size, truncated, err := countBlobs(sto, maxStatusCount)
+	if err != nil {
+		m["error"] = err.Error()
+		return m
+	}
+	m["blobs"] = n
+	m["bytes"] = size
+	if truncated {
+		m["countTruncated"] = true
+	}
+	return m
+}
+
+func (sh *StatusHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		httputil.ErrorRouting(rw, req)
+		return
+	}
+	now := time.Now()
+	hostname, _ := os.Hostname()
+	ret := map[string]interface{}{
+		"version":       buildinfo.Version(),
+		"goVersion":     runtime.Version(),
+		"hostname":      hostname,
+		"startTime":     startTime.UTC().Format(time.RFC3339),
+		"uptimeSeconds": int64(now.Sub(startTime).Seconds()),
+		"goroutines":    runtime.NumGoroutine(),
+	}
+	storage := make(map[string]interface{})
+	for prefix := range sh.storage {
+		storage[prefix] = sh.storageStatus(prefix)
+	}
+	ret["storage"] = storage
+	syncs := make(map[string]interface{})
+	for prefix, synch := range sh.sync {
+		syncs[prefix] = synch.statusMap()
+	}
+	ret["sync"] = syncs
+	if len(sh.importers) > 0 {
+		importers := make(map[string]interface{})
+		for prefix, imph := range sh.importers {
+			importers[prefix] = imph.StatusMap()
+		}
+		ret["importers"] = importers
+	}
+	httputil.ReturnJSON(rw, ret)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/test"
+)
+
+type fakeImporter map[string]interface{}
+
+func (fi fakeImporter) StatusMap() map[string]interface{} { return fi }
+
+func TestStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-status-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newStorage := func(name string, contents ...string) blobserver.Storage {
+		d := filepath.Join(dir, name)
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+		sto, err := localdisk.New(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range contents {
+			b := &test.Blob{Contents: c}
+			if _, err := sto.ReceiveBlob(b.BlobRef(), strings.NewReader(c)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return sto
+	}
+
+	sh := &StatusHandler{
+		storage:     map[string]blobserver.Storage{"/bs/": newStorage("bs", "foo", "bar", "bazz")},
+		storageType: map[string]string{"/bs/": "filesystem"},
+		sync: map[string]*SyncHandler{"/sync/": {
+			fromName: "/bs/",
+			toName:   "/index/",
+			fromq:    newStorage("queue", "foo", "bar"),
+			status:   "idle",
+		}},
+		importers: map[string]statusMapper{"/importer-flickr/": fakeImporter{"running": false}},
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/status/", nil)
+	rec := httptest.NewRecorder()
+	sh.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("GET = %d: %s", rec.Code, rec.Body)
+	}
+	var ret struct {
+		Version   string
+		Storage   map[string]map[string]interface{}
+		Sync      map[string]map[string]interface{}
+		Importers map[string]map[string]interface{}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &ret); err != nil {
+		t.Fatal(err)
+	}
+	bs := ret.Storage["/bs/"]
+	if bs["type"] != "filesystem" || bs["blobs"] != 3.0 || bs["bytes"] != 10.0 || bs["storageGeneration"] == nil {
+		t.Errorf("storage status = %v; want 3 blobs of 10 bytes, with a generation", bs)
+	}
+	if s := ret.Sync["/sync/"]; s["queueDepth"] != 2.0 || s["to"] != "/index/" || s["status"] != "idle" {
+		t.Errorf("sync status = %v; want a queue of 2 to /index/", s)
+	}
+	if imp, ok := ret.Importers["/importer-flickr/"]; !ok || imp["running"] != false {
+		t.Errorf("importers status = %v", ret.Importers)
+	}
+
+	req, _ = http.NewRequest("POST", "http://example.com/status/", nil)
+	rec = httptest.NewRecorder()
+	sh.ServeHTTP(rec, req)
+	if rec.Code == 200 {
+		t.Errorf("POST = 200; want an error")
+	}
+}
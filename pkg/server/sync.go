@@ -28,6 +28,7 @@ import (
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/metrics"
 	"camlistore.org/pkg/misc"
 )
 
@@ -35,6 +36,17 @@ var queueSyncInterval = 5 * time.Second
 
 const maxErrors = 20
 
+var (
+	syncCopies = metrics.NewCounter("camli_sync_copied_blobs_total",
+		"Blobs copied by sync handlers.", "from", "to")
+	syncCopyBytes = metrics.NewCounter("camli_sync_copied_bytes_total",
+		"Bytes copied by sync handlers.", "from", "to")
+	syncErrors = metrics.NewCounter("camli_sync_errors_total",
+		"Failed blob copies of sync handlers.", "from", "to")
+	syncQueueDepth = metrics.NewGauge("camli_sync_queue_blobs",
+		"Blobs of the current batch waiting in sync handlers' queues.", "from", "to")
+)
+
 var _ = log.Printf
 
 // TODO: rate control + tunable
@@ -45,6 +57,9 @@ type SyncHandler struct {
 
 	copierPoolSize int
 
+	shutdownc chan bool // closed by Shutdown
+	loopDone  chan bool // closed when syncQueueLoop returns
+
 	lk             sync.Mutex // protects following
 	status         string
 	blobStatus     map[string]fmt.Stringer // stringer called with lk held
@@ -119,6 +134,8 @@ func createSyncHandler(fromName, toName string, from blobserver.StorageQueueCrea
 		toName:         toName,
 		status:         "not started",
 		blobStatus:     make(map[string]fmt.Stringer),
+		shutdownc:      make(chan bool),
+		loopDone:       make(chan bool),
 	}
 	h.fromqName = strings.Replace(strings.Trim(toName, "/"), "/", "-", -1)
 	var err error
@@ -166,6 +183,44 @@ func (sh *SyncHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// statusMap returns the handler's status for the status handler.
+func (sh *SyncHandler) statusMap() map[string]interface{} {
+	depth, _, truncated, qerr := countBlobs(sh.fromq, maxStatusCount)
+
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
+	m := map[string]interface{}{
+		"from":           sh.fromName,
+		"to":             sh.toName,
+		"status":         sh.status,
+		"totalCopies":    sh.totalCopies,
+		"totalCopyBytes": sh.totalCopyBytes,
+		"totalErrors":    sh.totalErrors,
+		"copying":        len(sh.blobStatus),
+	}
+	if qerr != nil {
+		m["queueError"] = qerr.Error()
+	} else {
+		m["queueDepth"] = depth
+		if truncated {
+			m["queueDepthTruncated"] = true
+		}
+	}
+	if !sh.recentCopyTime.IsZero() {
+		m["recentCopyTime"] = sh.recentCopyTime.Format(time.RFC3339)
+	}
+	// The lag is how long blobs have been waiting without any
+	// getting copied.
+	if depth > 0 && !sh.recentCopyTime.IsZero() {
+		m["lagSeconds"] = int64(time.Since(sh.recentCopyTime).Seconds())
+	}
+	if n := len(sh.recentErrors); n > 0 {
+		te := sh.recentErrors[n-1]
+		m["lastError"] = te.t.Format(time.RFC3339) + ": " + te.err.Error()
+	}
+	return m
+}
+
 func (sh *SyncHandler) setStatus(s string, args ...interface{}) {
 	s = time.Now().UTC().Format(time.RFC3339) + ": " + fmt.Sprintf(s, args...)
 	sh.lk.Lock()
@@ -224,8 +279,12 @@ func (sh *SyncHandler) runSync(srcName string, enumSrc blobserver.Storage, longP
 		sh.setStatus("Enumerating queued blobs: %d", toCopy)
 	}
 	close(workch)
+	isQueue := srcName == sh.fromqName
 	for i := 0; i < toCopy; i++ {
 		sh.setStatus("Copied %d/%d of batch of queued blobs", nCopied, toCopy)
+		if isQueue {
+			syncQueueDepth.Set(float64(toCopy-nCopied), sh.fromName, sh.toName)
+		}
 		res := <-resch
 		nCopied++
 		sh.lk.Lock()
@@ -233,12 +292,18 @@ func (sh *SyncHandler) runSync(srcName string, enumSrc blobserver.Storage, longP
 			sh.totalCopies++
 			sh.totalCopyBytes += res.sb.Size
 			sh.recentCopyTime = time.Now().UTC()
+			syncCopies.Inc(sh.fromName, sh.toName)
+			syncCopyBytes.Add(res.sb.Size, sh.fromName, sh.toName)
 		} else {
 			sh.totalErrors++
+			syncErrors.Inc(sh.fromName, sh.toName)
 		}
 		sh.lk.Unlock()
 	}
 
+	if isQueue {
+		syncQueueDepth.Set(0, sh.fromName, sh.toName)
+	}
 	if err := <-errch; err != nil {
 		sh.addErrorToLog(fmt.Errorf("replication error for source %q, enumerate from source: %v", srcName, err))
 		return nCopied
@@ -247,14 +312,46 @@ func (sh *SyncHandler) runSync(srcName string, enumSrc blobserver.Storage, longP
 }
 
 func (sh *SyncHandler) syncQueueLoop() {
-	every(queueSyncInterval, func() {
-		for sh.runSync(sh.fromqName, sh.fromq, queueSyncInterval) > 0 {
+	defer close(sh.loopDone)
+	every(queueSyncInterval, sh.shutdownc, func() {
+		for !sh.shuttingDown() && sh.runSync(sh.fromqName, sh.fromq, queueSyncInterval) > 0 {
 			// Loop, before sleeping.
 		}
 		sh.setStatus("Sleeping briefly before next long poll.")
 	})
 }
 
+func (sh *SyncHandler) shuttingDown() bool {
+	select {
+	case <-sh.shutdownc:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the queue sync loop once its current batch is
+// copied, then copies what's left in the queue, until the deadline.
+func (sh *SyncHandler) Shutdown(deadline time.Time) error {
+	if sh.shuttingDown() {
+		return nil
+	}
+	close(sh.shutdownc)
+	select {
+	case <-sh.loopDone:
+	case <-time.After(deadline.Sub(time.Now())):
+		return fmt.Errorf("sync from %q to %q: shutdown deadline passed during a batch", sh.fromName, sh.toName)
+	}
+	sh.setStatus("Shutting down; copying the rest of the queue.")
+	for sh.runSync(sh.fromqName, sh.fromq, 0) > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("sync from %q to %q: shutdown deadline passed with blobs still queued", sh.fromName, sh.toName)
+		}
+	}
+	sh.setStatus("Shut down.")
+	return nil
+}
+
 func (sh *SyncHandler) copyWorker(res chan<- copyResult, work <-chan blobref.SizedBlobRef) {
 	for sb := range work {
 		res <- copyResult{sb, sh.copyBlob(sb)}
@@ -314,13 +411,23 @@ func (sh *SyncHandler) copyBlob(sb blobref.SizedBlobRef) error {
 	return nil
 }
 
-func every(interval time.Duration, f func()) {
+// every runs f every interval until stop is closed.
+func every(interval time.Duration, stop <-chan bool, f func()) {
 	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
 		t1 := time.Now()
 		f()
 		sleepUntil := t1.Add(interval)
 		if sleep := sleepUntil.Sub(time.Now()); sleep > 0 {
-			time.Sleep(sleep)
+			select {
+			case <-time.After(sleep):
+			case <-stop:
+				return
+			}
 		}
 	}
 }
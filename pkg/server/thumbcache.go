@@ -17,7 +17,12 @@ limitations under the License.
 package server
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/lru"
@@ -62,3 +67,81 @@ func (sc *ScaledImageLru) Put(key string, br *blobref.BlobRef) error {
 	sc.nameToBlob.Add(key, br)
 	return nil
 }
+
+// ScaledImageFile is a ScaledImage persisted to a local file, so
+// scaled images stored in a cache survive server restarts. The whole
+// mapping is kept in memory and new entries are appended to the file.
+type ScaledImageFile struct {
+	mu sync.Mutex
+	m  map[string]*blobref.BlobRef
+	f  *os.File
+}
+
+// NewScaledImageFile opens or creates the ScaledImageFile at path.
+func NewScaledImageFile(path string) (*ScaledImageFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sc := &ScaledImageFile{
+		m: make(map[string]*blobref.BlobRef),
+		f: f,
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines are "<key> <blobref>"; keys contain no spaces.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if br := blobref.Parse(fields[1]); br != nil {
+			sc.m[fields[0]] = br
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading scaled image file %s: %v", path, err)
+	}
+	return sc, nil
+}
+
+func (sc *ScaledImageFile) Get(key string) (*blobref.BlobRef, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	br, ok := sc.m[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return br, nil
+}
+
+func (sc *ScaledImageFile) Put(key string, br *blobref.BlobRef) error {
+	if strings.ContainsAny(key, " \n") {
+		return fmt.Errorf("invalid scaled image key %q", key)
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if old, ok := sc.m[key]; ok && old.String() == br.String() {
+		return nil
+	}
+	if _, err := fmt.Fprintf(sc.f, "%s %s\n", key, br); err != nil {
+		return err
+	}
+	sc.m[key] = br
+	return nil
+}
+
+// newScaledImage returns the ScaledImage for the "scaledImage" handler
+// config value scType. file is the path used by the "file" type.
+func newScaledImage(scType, file string) (ScaledImage, error) {
+	switch scType {
+	case "lrucache":
+		return NewScaledImageLru(), nil
+	case "file":
+		if file == "" {
+			return nil, errors.New(`scaledImage type "file" requires a "scaledImageFile" path`)
+		}
+		return NewScaledImageFile(file)
+	}
+	return nil, fmt.Errorf("unsupported scaledImage type: %q", scType)
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+)
+
+func TestScaledImageFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-scaledimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "scaled")
+
+	sc, err := NewScaledImageFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := cacheKey("sha1-abc", 100, 50, false)
+	if _, err := sc.Get(key); err != ErrCacheMiss {
+		t.Fatalf("Get on empty cache = %v; want ErrCacheMiss", err)
+	}
+	if err := sc.Put(key, blobref.MustParse("foo-def")); err != nil {
+		t.Fatal(err)
+	}
+	sc.f.Close()
+
+	// Reopening must restore the mapping.
+	sc, err = NewScaledImageFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.f.Close()
+	br, err := sc.Get(key)
+	if err != nil || br.String() != "foo-def" {
+		t.Fatalf("Get after reopen = %v, %v; want foo-def", br, err)
+	}
+	if _, err := sc.Get(cacheKey("sha1-abc", 100, 50, true)); err != ErrCacheMiss {
+		t.Errorf("square key should be distinct; got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+)
+
+// thumbnailHandlerPattern matches the path suffix of a ThumbnailHandler
+// request:
+//   $1: blobref of the file schema blob to scale
+//   $2: optional "/filename", ignored
+var thumbnailHandlerPattern = regexp.MustCompile(`^([^/]+)(/.*)?$`)
+
+// ThumbnailHandler serves scaled versions of images on demand, with
+// the same URL layout and parameters as the UI handler's thumbnail
+// helper: <prefix><fileref>[/<name>]?mw=<width>&mh=<height>[&square=1].
+//
+// Scaled images are stored as files in the Cache storage, and their
+// blobrefs remembered in a ScaledImage, so they're only generated once.
+type ThumbnailHandler struct {
+	Fetcher blobref.StreamingFetcher
+	Cache   blobserver.Storage
+	sc      ScaledImage
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("thumbnail", newThumbnailFromConfig)
+}
+
+func newThumbnailFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	blobRoot := conf.RequiredString("blobRoot")
+	cachePrefix := conf.RequiredString("cache")
+	scFile := conf.OptionalString("scaledImageFile", "")
+	defaultSCType := "lrucache"
+	if scFile != "" {
+		defaultSCType = "file"
+	}
+	scType := conf.OptionalString("scaledImage", defaultSCType)
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	bs, err := ld.GetStorage(blobRoot)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnail handler's blobRoot of %q error: %v", blobRoot, err)
+	}
+	cache, err := ld.GetStorage(cachePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnail handler's cache of %q error: %v", cachePrefix, err)
+	}
+	sc, err := newScaledImage(scType, scFile)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnail handler's scaledImage: %v", err)
+	}
+	return &ThumbnailHandler{
+		Fetcher: bs,
+		Cache:   cache,
+		sc:      sc,
+	}, nil
+}
+
+func (th *ThumbnailHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
+	m := thumbnailHandlerPattern.FindStringSubmatch(suffix)
+	if m == nil {
+		httputil.ErrorRouting(rw, req)
+		return
+	}
+	file := blobref.Parse(m[1])
+	if file == nil {
+		http.Error(rw, "Invalid blobref", 400)
+		return
+	}
+	width, err := strconv.Atoi(req.FormValue("mw"))
+	if err != nil {
+		http.Error(rw, "Invalid specified max width 'mw'", 400)
+		return
+	}
+	height, err := strconv.Atoi(req.FormValue("mh"))
+	if err != nil {
+		http.Error(rw, "Invalid specified max height 'mh'", 400)
+		return
+	}
+	square, _ := strconv.ParseBool(req.FormValue("square"))
+
+	ih := &ImageHandler{
+		Fetcher:   th.Fetcher,
+		Cache:     th.Cache,
+		MaxWidth:  width,
+		MaxHeight: height,
+		Square:    square,
+		sc:        th.sc,
+	}
+	ih.ServeHTTP(rw, req, file)
+}
@@ -33,6 +33,7 @@ import (
 	"sync"
 	"time"
 
+	"camlistore.org/pkg/auth"
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/httputil"
@@ -59,6 +60,12 @@ var (
 	thumbnailPattern = regexp.MustCompile(`^thumbnail/([^/]+)(/.*)?$`)
 	treePattern      = regexp.MustCompile(`^tree/([^/]+)(/.*)?$`)
 	closurePattern   = regexp.MustCompile(`^new/closure/(([^/]+)(/.*)?)$`)
+
+	// Archive URL suffix:
+	//   $1: "zip" or "tar", the archive format
+	//   $2: blobref of a directory or permanode
+	//   $3: optional "/filename" to be sent as recommended download name
+	archivePattern = regexp.MustCompile(`^(zip|tar)/([^/]+)(/.*)?$`)
 )
 
 var uiFiles = uistatic.Files
@@ -83,6 +90,9 @@ type UIHandler struct {
 	Cache blobserver.Storage // or nil
 	sc    ScaledImage        // cache for scaled images, optional
 
+	uploadDir string // of resumable browser upload sessions
+	uploads   uploadSessions
+
 	// for the new ui
 	closureHandler http.Handler // or nil
 }
@@ -99,6 +109,8 @@ func newUIFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (h http.Handler,
 	pubRoots := conf.OptionalList("publishRoots")
 	cachePrefix := conf.OptionalString("cache", "")
 	scType := conf.OptionalString("scaledImage", "")
+	scFile := conf.OptionalString("scaledImageFile", "")
+	ui.uploadDir = conf.OptionalString("uploadTempDir", filepath.Join(os.TempDir(), "camli-uploads"))
 	if err = conf.Validate(); err != nil {
 		return
 	}
@@ -148,11 +160,9 @@ func newUIFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (h http.Handler,
 			return nil, fmt.Errorf("UI handler's cache of %q error: %v", cachePrefix, err)
 		}
 		ui.Cache = bs
-		switch scType {
-		case "lrucache":
-			ui.sc = NewScaledImageLru()
-		default:
-			return nil, fmt.Errorf("unsupported ui handler's scType: %q ", scType)
+		ui.sc, err = newScaledImage(scType, scFile)
+		if err != nil {
+			return nil, fmt.Errorf("UI handler's scaledImage: %v", err)
 		}
 	}
 
@@ -232,12 +242,16 @@ func (ui *UIHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		ui.root.serveDiscovery(rw, req)
 	case wantsUploadHelper(req):
 		ui.serveUploadHelper(rw, req)
+	case suffix == "upload":
+		ui.serveUpload(rw, req)
 	case strings.HasPrefix(suffix, "download/"):
 		ui.serveDownload(rw, req)
 	case strings.HasPrefix(suffix, "thumbnail/"):
 		ui.serveThumbnail(rw, req)
 	case strings.HasPrefix(suffix, "tree/"):
 		ui.serveFileTree(rw, req)
+	case strings.HasPrefix(suffix, "zip/"), strings.HasPrefix(suffix, "tar/"):
+		ui.serveArchive(rw, req)
 	case wantsNewUI(req):
 		ui.serveNewUI(rw, req)
 	default:
@@ -300,8 +314,11 @@ func (ui *UIHandler) populateDiscoveryMap(m map[string]interface{}) {
 	uiDisco := map[string]interface{}{
 		"jsonSignRoot":    ui.JSONSignRoot,
 		"uploadHelper":    ui.prefix + "?camli.mode=uploadhelper", // hack; remove with better javascript
+		"uploadHandler":   path.Join(ui.prefix, "upload"),
 		"downloadHelper":  path.Join(ui.prefix, "download") + "/",
 		"directoryHelper": path.Join(ui.prefix, "tree") + "/",
+		"zipHelper":       path.Join(ui.prefix, "zip") + "/",
+		"tarHelper":       path.Join(ui.prefix, "tar") + "/",
 		"publishRoots":    pubRoots,
 	}
 	if ui.sigh != nil {
@@ -315,6 +332,16 @@ func (ui *UIHandler) populateDiscoveryMap(m map[string]interface{}) {
 	}
 }
 
+// blobAllowed reports whether req may access br, as its content
+// or as the root of what it leads to, and replies to req if not.
+func blobAllowed(rw http.ResponseWriter, req *http.Request, br *blobref.BlobRef) bool {
+	if auth.AllowedBlob(req, br, auth.OpGet) {
+		return true
+	}
+	http.Error(rw, "Forbidden", http.StatusForbidden)
+	return false
+}
+
 func (ui *UIHandler) serveDownload(rw http.ResponseWriter, req *http.Request) {
 	if ui.root.Storage == nil {
 		http.Error(rw, "No BlobRoot configured", 500)
@@ -333,6 +360,9 @@ func (ui *UIHandler) serveDownload(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Invalid blobref", 400)
 		return
 	}
+	if !blobAllowed(rw, req, fbr) {
+		return
+	}
 
 	dh := &DownloadHandler{
 		Fetcher: ui.root.Storage,
@@ -371,6 +401,9 @@ func (ui *UIHandler) serveThumbnail(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Invalid blobref", 400)
 		return
 	}
+	if !blobAllowed(rw, req, blobref) {
+		return
+	}
 
 	th := &ImageHandler{
 		Fetcher:   ui.root.Storage,
@@ -400,6 +433,9 @@ func (ui *UIHandler) serveFileTree(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Invalid blobref", 400)
 		return
 	}
+	if !blobAllowed(rw, req, blobref) {
+		return
+	}
 
 	fth := &FileTreeHandler{
 		Fetcher: ui.root.Storage,
@@ -408,6 +444,36 @@ func (ui *UIHandler) serveFileTree(rw http.ResponseWriter, req *http.Request) {
 	fth.ServeHTTP(rw, req)
 }
 
+func (ui *UIHandler) serveArchive(rw http.ResponseWriter, req *http.Request) {
+	if ui.root.Storage == nil {
+		http.Error(rw, "No BlobRoot configured", 500)
+		return
+	}
+
+	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
+	m := archivePattern.FindStringSubmatch(suffix)
+	if m == nil {
+		httputil.ErrorRouting(rw, req)
+		return
+	}
+
+	br := blobref.Parse(m[2])
+	if br == nil {
+		http.Error(rw, "Invalid blobref", 400)
+		return
+	}
+	if !blobAllowed(rw, req, br) {
+		return
+	}
+
+	ah := &ArchiveHandler{
+		Fetcher: ui.root.Storage,
+		Search:  ui.root.Search,
+		Format:  m[1],
+	}
+	ah.ServeHTTP(rw, req, br, strings.TrimPrefix(m[3], "/"))
+}
+
 func (ui *UIHandler) serveNewUI(rw http.ResponseWriter, req *http.Request) {
 	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
 	if ui.closureHandler == nil {
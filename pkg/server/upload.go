@@ -0,0 +1,339 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/client" // just for NewUploadHandleFromString
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonsign/signhandler"
+	"camlistore.org/pkg/schema"
+)
+
+// The UI handler's upload endpoint, for browsers, at <ui>upload. The
+// server does the file schema chunking, and by default also creates
+// a permanode for each file, with the file as its camliContent.
+// Responses are JSON, with "got" listing, per file, its "filename",
+// "fileref" and "permanode".
+//
+//   POST, multipart/form-data: each file part is a file.
+//   POST, other body, ?filename=NAME: the body is the file. It may
+//     use chunked transfer encoding.
+//   POST ?session=new: starts a resumable upload session, with the
+//     body as its first bytes, and returns its "session" ID.
+//   POST ?session=ID&offset=N: the body is appended to the session
+//     ID, whose current size must be N. Add &filename=NAME&done=1 to
+//     finish the session and store the file.
+//   GET ?session=ID: returns the session's current "offset", for
+//     resuming an interrupted upload.
+//
+// Session IDs are chosen by the server, so only the browser that
+// started a session knows it. Sessions not written to for
+// uploadSessionMaxAge are removed.
+//
+// The params are those of the URL's query. Any POST may add
+// permanode=0 to not create permanodes.
+
+var uploadSessionPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// uploadSessionMaxAge is how long an upload session is kept after its
+// last write.
+const uploadSessionMaxAge = 24 * time.Hour
+
+// uploadSessions serializes the requests on each resumable upload
+// session.
+type uploadSessions struct {
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+var errSessionBusy = errors.New("upload session busy")
+
+func (us *uploadSessions) lock(id string) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.busy == nil {
+		us.busy = make(map[string]bool)
+	}
+	if us.busy[id] {
+		return errSessionBusy
+	}
+	us.busy[id] = true
+	return nil
+}
+
+func (us *uploadSessions) unlock(id string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.busy, id)
+}
+
+// prune removes the files of the sessions in dir last written to
+// before maxAge ago, unless busy.
+func (us *uploadSessions) prune(dir string, maxAge time.Duration) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	for _, fi := range fis {
+		name := fi.Name()
+		if !uploadSessionPattern.MatchString(name) || us.busy[name] || time.Since(fi.ModTime()) < maxAge {
+			continue
+		}
+		os.Remove(filepath.Join(dir, name))
+	}
+}
+
+// signAndStore signs m with sigh and stores it in sto. name describes
+// m in errors.
+func signAndStore(sigh *signhandler.Handler, sto blobserver.Storage, name string, m schema.Map) (*blobref.BlobRef, error) {
+	signed, err := sigh.SignMap(m)
+	if err != nil {
+		return nil, fmt.Errorf("error signing %s: %v", name, err)
+	}
+	uh := client.NewUploadHandleFromString(signed)
+	if _, err := sto.ReceiveBlob(uh.BlobRef, uh.Contents); err != nil {
+		return nil, fmt.Errorf("error uploading %s: %v", name, err)
+	}
+	return uh.BlobRef, nil
+}
+
+// uploadFile stores the contents of r as the file fileName and, if
+// wantPermanode, creates a permanode for it. It returns the "got"
+// entry describing the result.
+func (ui *UIHandler) uploadFile(fileName string, r io.Reader, wantPermanode bool) (map[string]interface{}, error) {
+	sto := ui.root.Storage
+	br, err := schema.WriteFileFromReader(sto, fileName, r)
+	if err != nil {
+		return nil, fmt.Errorf("writing to blobserver: %v", err)
+	}
+	got := map[string]interface{}{
+		"filename": fileName,
+		"fileref":  br.String(),
+	}
+	if !wantPermanode {
+		return got, nil
+	}
+	if ui.sigh == nil {
+		return nil, errors.New("no jsonSignRoot configured; can't create permanodes")
+	}
+	pn, err := signAndStore(ui.sigh, sto, "permanode", schema.NewUnsignedPermanode())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := signAndStore(ui.sigh, sto, "camliContent claim", schema.NewSetAttributeClaim(pn, "camliContent", br.String())); err != nil {
+		return nil, err
+	}
+	got["permanode"] = pn.String()
+	return got, nil
+}
+
+func (ui *UIHandler) serveUpload(rw http.ResponseWriter, req *http.Request) {
+	ret := make(map[string]interface{})
+	defer httputil.ReturnJSON(rw, ret)
+	fail := func(code int, errorType string, err error) {
+		rw.WriteHeader(code)
+		ret["error"] = err.Error()
+		ret["errorType"] = errorType
+	}
+
+	if ui.root.Storage == nil {
+		fail(500, "server", errors.New("No BlobRoot configured"))
+		return
+	}
+	if req.Method != "GET" && req.Method != "POST" {
+		fail(400, "input", errors.New("invalid method"))
+		return
+	}
+	if req.Method == "POST" {
+		// POSTs may sign permanodes and claims.
+		if err := auth.CheckReplay(req); err != nil {
+			fail(403, "input", err)
+			return
+		}
+	}
+	// The params are all in the URL: parsing the body as a form
+	// would consume a multipart upload.
+	q := req.URL.Query()
+	wantPermanode := q.Get("permanode") != "0"
+
+	if session := q.Get("session"); session != "" {
+		isNew := session == "new"
+		if isNew {
+			if req.Method != "POST" {
+				fail(400, "input", errors.New("starting a session requires a POST"))
+				return
+			}
+			ui.uploads.prune(ui.uploadDir, uploadSessionMaxAge)
+			session = randomString()
+		}
+		if !uploadSessionPattern.MatchString(session) {
+			fail(400, "input", errors.New("invalid 'session' param"))
+			return
+		}
+		if err := ui.uploads.lock(session); err != nil {
+			fail(409, "input", err)
+			return
+		}
+		defer ui.uploads.unlock(session)
+		ui.serveUploadSession(rw, req, q, session, isNew, wantPermanode, ret, fail)
+		return
+	}
+	if req.Method != "POST" {
+		fail(400, "input", errors.New("GET requires a 'session' param"))
+		return
+	}
+
+	var got []map[string]interface{}
+	defer func() { ret["got"] = got }()
+	if mr, err := req.MultipartReader(); err == nil {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fail(400, "input", fmt.Errorf("reading body: %v", err))
+				return
+			}
+			fileName := part.FileName()
+			if fileName == "" {
+				continue
+			}
+			g, err := ui.uploadFile(fileName, part, wantPermanode)
+			if err != nil {
+				fail(500, "server", err)
+				return
+			}
+			g["formname"] = part.FormName()
+			got = append(got, g)
+		}
+		return
+	}
+
+	fileName := q.Get("filename")
+	if fileName == "" {
+		fail(400, "input", errors.New("non-multipart upload requires a 'filename' param"))
+		return
+	}
+	g, err := ui.uploadFile(fileName, req.Body, wantPermanode)
+	if err != nil {
+		fail(500, "server", err)
+		return
+	}
+	got = append(got, g)
+}
+
+// serveUploadSession handles a request on the resumable upload
+// session, which the caller has locked, and created if isNew. The bytes
+// received so far are kept in a file in the UI handler's upload
+// directory.
+func (ui *UIHandler) serveUploadSession(rw http.ResponseWriter, req *http.Request, q url.Values, session string, isNew, wantPermanode bool,
+	ret map[string]interface{}, fail func(int, string, error)) {
+	if err := os.MkdirAll(ui.uploadDir, 0700); err != nil {
+		fail(500, "server", err)
+		return
+	}
+	path := filepath.Join(ui.uploadDir, session)
+	flag := os.O_RDWR
+	if isNew {
+		flag |= os.O_CREATE | os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flag, 0600)
+	if os.IsNotExist(err) {
+		fail(404, "input", errors.New("unknown or expired upload session"))
+		return
+	}
+	if err != nil {
+		fail(500, "server", err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		fail(500, "server", err)
+		return
+	}
+	size := fi.Size()
+	ret["session"] = session
+	ret["offset"] = size
+	if req.Method == "GET" {
+		return
+	}
+
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			fail(400, "input", errors.New("invalid 'offset' param"))
+			return
+		}
+		if offset != size {
+			// The browser must resume from what we have.
+			fail(409, "input", fmt.Errorf("offset %d doesn't match the session's size %d", offset, size))
+			return
+		}
+	}
+	if _, err := f.Seek(size, os.SEEK_SET); err != nil {
+		fail(500, "server", err)
+		return
+	}
+	n, err := io.Copy(f, req.Body)
+	size += n
+	ret["offset"] = size
+	if err != nil {
+		fail(500, "server", fmt.Errorf("reading body: %v", err))
+		return
+	}
+	if q.Get("done") != "1" {
+		return
+	}
+
+	fileName := q.Get("filename")
+	if fileName == "" {
+		fail(400, "input", errors.New("finishing an upload session requires a 'filename' param"))
+		return
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		fail(500, "server", err)
+		return
+	}
+	g, err := ui.uploadFile(strings.TrimSpace(fileName), f, wantPermanode)
+	if err != nil {
+		fail(500, "server", err)
+		return
+	}
+	ret["got"] = []map[string]interface{}{g}
+	os.Remove(path)
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/schema"
+)
+
+// uploadTest is a UI handler storing uploads to a temporary
+// directory.
+type uploadTest struct {
+	t   *testing.T
+	dir string
+	ui  *UIHandler
+}
+
+func newUploadTest(t *testing.T) *uploadTest {
+	dir, err := ioutil.TempDir("", "camli-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobDir := filepath.Join(dir, "blobs")
+	if err := os.Mkdir(blobDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	sto, err := localdisk.New(blobDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &uploadTest{t: t, dir: dir, ui: &UIHandler{
+		root:      &RootHandler{Storage: sto},
+		uploadDir: filepath.Join(dir, "sessions"),
+	}}
+}
+
+func (ut *uploadTest) close() { os.RemoveAll(ut.dir) }
+
+// do serves the upload request of method, query and body, and returns
+// the response's code and JSON.
+func (ut *uploadTest) do(method, query, ctype string, body io.Reader) (int, map[string]interface{}) {
+	req, _ := http.NewRequest(method, "http://example.com/ui/upload?"+query, body)
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	return ut.serve(req)
+}
+
+func (ut *uploadTest) serve(req *http.Request) (int, map[string]interface{}) {
+	rec := httptest.NewRecorder()
+	ut.ui.serveUpload(rec, req)
+	ret := make(map[string]interface{})
+	if err := json.Unmarshal(rec.Body.Bytes(), &ret); err != nil {
+		ut.t.Fatalf("%s %s: %v in %q", req.Method, req.URL, err, rec.Body)
+	}
+	return rec.Code, ret
+}
+
+// gotFile returns the contents of the file of the i-th "got" entry of
+// ret.
+func (ut *uploadTest) gotFile(ret map[string]interface{}, i int) string {
+	got, _ := ret["got"].([]interface{})
+	if i >= len(got) {
+		ut.t.Fatalf("response %v has no got[%d]", ret, i)
+	}
+	ref, _ := got[i].(map[string]interface{})["fileref"].(string)
+	br := blobref.Parse(ref)
+	if br == nil {
+		ut.t.Fatalf("got[%d] of %v has no fileref", i, ret)
+	}
+	fr, err := schema.NewFileReader(blobref.SeekerFromStreamingFetcher(ut.ui.root.Storage), br)
+	if err != nil {
+		ut.t.Fatal(err)
+	}
+	defer fr.Close()
+	b, err := ioutil.ReadAll(fr)
+	if err != nil {
+		ut.t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUploadMultipart(t *testing.T) {
+	ut := newUploadTest(t)
+	defer ut.close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file1", "a.txt")
+	io.WriteString(fw, "apple")
+	mw.WriteField("comment", "not a file")
+	fw, _ = mw.CreateFormFile("file2", "b.txt")
+	io.WriteString(fw, "banana")
+	mw.Close()
+
+	code, ret := ut.do("POST", "permanode=0", mw.FormDataContentType(), &body)
+	if code != 200 || ret["error"] != nil {
+		t.Fatalf("multipart upload = %d, %v", code, ret)
+	}
+	if got, _ := ret["got"].([]interface{}); len(got) != 2 {
+		t.Fatalf("got %v; want 2 files", ret["got"])
+	}
+	if a, b := ut.gotFile(ret, 0), ut.gotFile(ret, 1); a != "apple" || b != "banana" {
+		t.Errorf("files = %q, %q; want apple, banana", a, b)
+	}
+}
+
+func TestUploadRawBody(t *testing.T) {
+	ut := newUploadTest(t)
+	defer ut.close()
+
+	code, ret := ut.do("POST", "permanode=0&filename=raw.txt", "application/octet-stream", strings.NewReader("raw contents"))
+	if code != 200 || ret["error"] != nil {
+		t.Fatalf("raw upload = %d, %v", code, ret)
+	}
+	if got := ut.gotFile(ret, 0); got != "raw contents" {
+		t.Errorf("file = %q; want %q", got, "raw contents")
+	}
+	if code, _ := ut.do("POST", "permanode=0", "application/octet-stream", strings.NewReader("x")); code != 400 {
+		t.Errorf("raw upload with no filename = %d; want 400", code)
+	}
+}
+
+func TestUploadSession(t *testing.T) {
+	ut := newUploadTest(t)
+	defer ut.close()
+
+	code, ret := ut.do("POST", "session=new", "", strings.NewReader("hel"))
+	session, _ := ret["session"].(string)
+	if code != 200 || !uploadSessionPattern.MatchString(session) || ret["offset"] != 3.0 {
+		t.Fatalf("starting a session = %d, %v", code, ret)
+	}
+	if code, ret := ut.do("POST", "session="+session+"&offset=0", "", strings.NewReader("xx")); code != 409 || ret["offset"] != 3.0 {
+		t.Errorf("append at a wrong offset = %d, %v; want 409 at offset 3", code, ret)
+	}
+	if code, ret := ut.do("POST", "session="+session+"&offset=3", "", strings.NewReader("lo")); code != 200 || ret["offset"] != 5.0 {
+		t.Errorf("append = %d, %v; want offset 5", code, ret)
+	}
+	if code, ret := ut.do("GET", "session="+session, "", nil); code != 200 || ret["offset"] != 5.0 {
+		t.Errorf("resume point = %d, %v; want offset 5", code, ret)
+	}
+
+	code, ret = ut.do("POST", "session="+session+"&offset=5&done=1&filename=hello.txt&permanode=0", "", strings.NewReader(""))
+	if code != 200 || ret["error"] != nil {
+		t.Fatalf("finishing the session = %d, %v", code, ret)
+	}
+	if got := ut.gotFile(ret, 0); got != "hello" {
+		t.Errorf("session's file = %q; want hello", got)
+	}
+	if code, _ := ut.do("GET", "session="+session, "", nil); code != 404 {
+		t.Errorf("finished session = %d; want 404", code)
+	}
+
+	// IDs are the server's to choose.
+	if code, _ := ut.do("POST", "session=my-own-session", "", strings.NewReader("x")); code != 400 {
+		t.Errorf("session chosen by the browser = %d; want 400", code)
+	}
+	if code, _ := ut.do("POST", "session="+randomString()+"&offset=0", "", strings.NewReader("x")); code != 404 {
+		t.Errorf("unknown session = %d; want 404", code)
+	}
+}
+
+func TestUploadSessionExpiry(t *testing.T) {
+	ut := newUploadTest(t)
+	defer ut.close()
+
+	_, ret := ut.do("POST", "session=new", "", strings.NewReader("stale"))
+	stale, _ := ret["session"].(string)
+	old := time.Now().Add(-2 * uploadSessionMaxAge)
+	if err := os.Chtimes(filepath.Join(ut.ui.uploadDir, stale), old, old); err != nil {
+		t.Fatal(err)
+	}
+	_, ret = ut.do("POST", "session=new", "", strings.NewReader("fresh"))
+	fresh, _ := ret["session"].(string)
+
+	if code, _ := ut.do("GET", "session="+stale, "", nil); code != 404 {
+		t.Errorf("stale session = %d; want 404", code)
+	}
+	if code, _ := ut.do("GET", "session="+fresh, "", nil); code != 200 {
+		t.Errorf("fresh session = %d; want 200", code)
+	}
+}
+
+func TestUploadReplay(t *testing.T) {
+	ut := newUploadTest(t)
+	defer ut.close()
+	auth.SetReplayWindow(time.Minute)
+	defer auth.SetReplayWindow(0)
+
+	newReq := func() *http.Request {
+		req, _ := http.NewRequest("POST", "http://example.com/ui/upload?permanode=0&filename=a.txt", strings.NewReader("a"))
+		return req
+	}
+	if code, _ := ut.serve(newReq()); code != 403 {
+		t.Errorf("upload with no replay headers = %d; want 403", code)
+	}
+	req := newReq()
+	auth.AddReplayHeaders(req)
+	if code, ret := ut.serve(req); code != 200 {
+		t.Errorf("upload with replay headers = %d, %v; want 200", code, ret)
+	}
+	again := newReq()
+	again.Header = req.Header
+	if code, _ := ut.serve(again); code != 403 {
+		t.Errorf("replayed upload = %d; want 403", code)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"io"
 	"net/http"
 
+	"camlistore.org/pkg/auth"
 	"camlistore.org/pkg/httputil"
 	"camlistore.org/pkg/schema"
 )
@@ -34,6 +35,12 @@ func (ui *UIHandler) serveUploadHelper(rw http.ResponseWriter, req *http.Request
 		return
 	}
 
+	if err := auth.CheckReplay(req); err != nil {
+		ret["error"] = err.Error()
+		ret["errorType"] = "input"
+		return
+	}
+
 	mr, err := req.MultipartReader()
 	if err != nil {
 		ret["error"] = "reading body: " + err.Error()
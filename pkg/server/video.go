@@ -0,0 +1,250 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/singleflight"
+)
+
+// videoPattern matches the path suffix of a VideoHandler request:
+//   $1: blobref of the video's file schema blob
+//   $2: the rendition wanted; a key of videoRenditions
+var videoPattern = regexp.MustCompile(`^([^/]+)/([a-z0-9]+\.[a-z0-9]+)$`)
+
+type videoRendition struct {
+	mimeType string
+	// args returns the ffmpeg arguments to convert the file in to
+	// the file out.
+	args func(in, out string) []string
+}
+
+var videoRenditions = map[string]videoRendition{
+	"poster.jpg": {
+		mimeType: "image/jpeg",
+		args: func(in, out string) []string {
+			// Seek a second in, to skip the black frames
+			// many videos start with.
+			return []string{"-y", "-ss", "1", "-i", in, "-vframes", "1", "-f", "image2", out}
+		},
+	},
+	"video.mp4": {
+		mimeType: "video/mp4",
+		args: func(in, out string) []string {
+			return []string{"-y", "-i", in,
+				"-c:v", "libx264", "-preset", "fast", "-pix_fmt", "yuv420p",
+				"-c:a", "aac", "-strict", "experimental",
+				"-movflags", "+faststart", out}
+		},
+	},
+	"video.webm": {
+		mimeType: "video/webm",
+		args: func(in, out string) []string {
+			return []string{"-y", "-i", in,
+				"-c:v", "libvpx", "-b:v", "1M",
+				"-c:a", "libvorbis", out}
+		},
+	},
+}
+
+// VideoHandler serves poster frames and browser-playable renditions
+// of stored videos, at <prefix><fileref>/poster.jpg,
+// <prefix><fileref>/video.mp4 and <prefix><fileref>/video.webm.
+//
+// Renditions are made by running ffmpeg, and stored as files in the
+// Cache storage so they're only made once.
+type VideoHandler struct {
+	Fetcher blobref.StreamingFetcher
+	Cache   blobserver.Storage
+	FFmpeg  string // path to the ffmpeg binary
+
+	sc    ScaledImage // rendition key -> file blobref in Cache
+	group singleflight.Group
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("video", newVideoFromConfig)
+}
+
+func newVideoFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	blobRoot := conf.RequiredString("blobRoot")
+	cachePrefix := conf.RequiredString("cache")
+	ffmpeg := conf.OptionalString("ffmpeg", "ffmpeg")
+	scFile := conf.OptionalString("scaledImageFile", "")
+	defaultSCType := "lrucache"
+	if scFile != "" {
+		defaultSCType = "file"
+	}
+	scType := conf.OptionalString("scaledImage", defaultSCType)
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	ffmpegPath, err := exec.LookPath(ffmpeg)
+	if err != nil {
+		return nil, fmt.Errorf("video handler's ffmpeg %q not found: %v", ffmpeg, err)
+	}
+	bs, err := ld.GetStorage(blobRoot)
+	if err != nil {
+		return nil, fmt.Errorf("video handler's blobRoot of %q error: %v", blobRoot, err)
+	}
+	cache, err := ld.GetStorage(cachePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("video handler's cache of %q error: %v", cachePrefix, err)
+	}
+	sc, err := newScaledImage(scType, scFile)
+	if err != nil {
+		return nil, fmt.Errorf("video handler's scaledImage: %v", err)
+	}
+	return &VideoHandler{
+		Fetcher: bs,
+		Cache:   cache,
+		FFmpeg:  ffmpegPath,
+		sc:      sc,
+	}, nil
+}
+
+func videoCacheKey(file *blobref.BlobRef, rendition string) string {
+	return "video:" + file.String() + ":" + rendition
+}
+
+func (vh *VideoHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(rw, "Invalid method", 400)
+		return
+	}
+	suffix := req.Header.Get("X-PrefixHandler-PathSuffix")
+	m := videoPattern.FindStringSubmatch(suffix)
+	if m == nil {
+		httputil.ErrorRouting(rw, req)
+		return
+	}
+	file := blobref.Parse(m[1])
+	if file == nil {
+		http.Error(rw, "Invalid blobref", 400)
+		return
+	}
+	rend, ok := videoRenditions[m[2]]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+
+	key := videoCacheKey(file, m[2])
+	etag := `"` + key + `"`
+	if req.Header.Get("If-None-Match") == etag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	br, err := vh.sc.Get(key)
+	if err != nil {
+		// TODO: transcoding can take a long time; consider
+		// doing it in the background and returning early.
+		v, err := vh.group.Do(key, func() (interface{}, error) {
+			return vh.makeRendition(file, key, rend)
+		})
+		if err != nil {
+			log.Printf("video: error making %s: %v", key, err)
+			http.Error(rw, "Error making video rendition", 500)
+			return
+		}
+		br = v.(*blobref.BlobRef)
+	}
+
+	fr, err := schema.NewFileReader(blobref.SeekerFromStreamingFetcher(vh.Cache), br)
+	if err != nil {
+		http.Error(rw, "Can't serve video rendition: "+err.Error(), 500)
+		return
+	}
+	defer fr.Close()
+	rw.Header().Set("Content-Type", rend.mimeType)
+	rw.Header().Set("ETag", etag)
+	rw.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", thumbnailMaxAge))
+	size := fr.FileSchema().SumPartsSize()
+	http.ServeContent(rw, req, "", time.Time{}, io.NewSectionReader(fr, 0, int64(size)))
+}
+
+// makeRendition runs ffmpeg on file to produce rend, stores the
+// result in the cache and returns its file blobref.
+func (vh *VideoHandler) makeRendition(file *blobref.BlobRef, key string, rend videoRendition) (*blobref.BlobRef, error) {
+	dir, err := ioutil.TempDir("", "camli-video")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in")
+	if err := vh.fetchToFile(file, in); err != nil {
+		return nil, err
+	}
+	out := filepath.Join(dir, "out"+filepath.Ext(key))
+	cmd := exec.Command(vh.FFmpeg, rend.args(in, out)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v\n%s", err, output)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil {
+		return nil, err
+	} else if fi.Size() == 0 {
+		return nil, errors.New("ffmpeg produced an empty file")
+	}
+	br, err := schema.WriteFileFromReader(vh.Cache, key, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache %s: %v", key, err)
+	}
+	if err := vh.sc.Put(key, br); err != nil {
+		log.Printf("video: error remembering %s: %v", key, err)
+	}
+	return br, nil
+}
+
+func (vh *VideoHandler) fetchToFile(file *blobref.BlobRef, dst string) error {
+	fr, err := schema.NewFileReader(blobref.SeekerFromStreamingFetcher(vh.Fetcher), file)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, fr); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobserver/localdisk"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/test"
+)
+
+// fakeFFmpeg is an ffmpeg writing "rendition of " and its input to
+// its output, its last argument, and logging its runs to the file
+// named by $FAKE_FFMPEG_LOG.
+const fakeFFmpeg = `#!/bin/sh
+for arg; do out=$arg; done
+while [ "$1" != "-i" ]; do shift; done
+echo run >> "$FAKE_FFMPEG_LOG"
+{ printf 'rendition of '; cat "$2"; } > "$out"
+`
+
+func TestVideo(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as ffmpeg")
+	}
+	dir, err := ioutil.TempDir("", "camli-video-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := ioutil.WriteFile(ffmpeg, []byte(fakeFFmpeg), 0700); err != nil {
+		t.Fatal(err)
+	}
+	runLog := filepath.Join(dir, "runs")
+	defer os.Setenv("FAKE_FFMPEG_LOG", os.Getenv("FAKE_FFMPEG_LOG"))
+	os.Setenv("FAKE_FFMPEG_LOG", runLog)
+	runs := func() int {
+		b, _ := ioutil.ReadFile(runLog)
+		return strings.Count(string(b), "run\n")
+	}
+
+	cacheDir := filepath.Join(dir, "cache")
+	if err := os.Mkdir(cacheDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := localdisk.New(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := new(test.Fetcher)
+	file, err := schema.WriteFileFromReader(fetcher, "movie.avi", strings.NewReader("movie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vh := &VideoHandler{Fetcher: fetcher, Cache: cache, FFmpeg: ffmpeg, sc: NewScaledImageLru()}
+	serve := func(method, suffix string, hdr ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://example.com/video/"+suffix, nil)
+		req.Header.Set("X-PrefixHandler-PathSuffix", suffix)
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		rec := httptest.NewRecorder()
+		vh.ServeHTTP(rec, req)
+		return rec
+	}
+
+	poster := file.String() + "/poster.jpg"
+	for i := 0; i < 2; i++ {
+		rec := serve("GET", poster)
+		if rec.Code != 200 || rec.Body.String() != "rendition of movie" || rec.HeaderMap.Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("GET %d of poster = %d, %q, %q", i, rec.Code, rec.HeaderMap.Get("Content-Type"), rec.Body)
+		}
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("ffmpeg ran %d times for 2 GETs of the poster; want 1", n)
+	}
+	etag := `"` + videoCacheKey(file, "poster.jpg") + `"`
+	if rec := serve("GET", poster, "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match GET of poster = %d; want 304", rec.Code)
+	}
+	if rec := serve("GET", file.String()+"/video.webm"); rec.Code != 200 || rec.HeaderMap.Get("Content-Type") != "video/webm" {
+		t.Errorf("GET of webm = %d, %q", rec.Code, rec.HeaderMap.Get("Content-Type"))
+	}
+
+	if rec := serve("GET", file.String()+"/video.ogv"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET of unknown rendition = %d; want 404", rec.Code)
+	}
+	if rec := serve("POST", poster); rec.Code != 400 {
+		t.Errorf("POST = %d; want 400", rec.Code)
+	}
+
+	vh.FFmpeg = filepath.Join(dir, "no-such-ffmpeg")
+	if rec := serve("GET", file.String()+"/video.mp4"); rec.Code != 500 {
+		t.Errorf("GET with a failing ffmpeg = %d; want 500", rec.Code)
+	}
+}
@@ -0,0 +1,733 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/jsonsign/signhandler"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+)
+
+// DAVHandler serves the archive over WebDAV, so file managers can
+// mount it.
+//
+// The top-level folders are the roots (permanodes with a camliRoot
+// attribute, named by it), and "recent", of the most recently
+// modified permanodes. A permanode is a file if its camliContent is a
+// file, else a folder of its camliMember permanodes and, if its
+// camliContent is a static directory, of that directory's entries.
+// Items are named by their titles, falling back to their file names.
+//
+// Writes only go in permanode folders: PUT stores a file and
+// creates a member permanode for it (or, for an existing name,
+// replaces the member's camliContent), MKCOL creates a member
+// permanode (at the top level, a new root), DELETE removes a member,
+// and MOVE renames and moves members. Static directories are
+// read-only. Locks are accepted but not enforced, as file managers
+// won't write without them.
+type DAVHandler struct {
+	Storage blobserver.Storage
+	Search  *search.Handler
+	Sign    *signhandler.Handler
+
+	prefix string
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("webdav", newDAVFromConfig)
+}
+
+func newDAVFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (http.Handler, error) {
+	blobRoot := conf.RequiredString("blobRoot")
+	searchRoot := conf.RequiredString("searchRoot")
+	signRoot := conf.RequiredString("jsonSignRoot")
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	bs, err := ld.GetStorage(blobRoot)
+	if err != nil {
+		return nil, fmt.Errorf("webdav handler's blobRoot of %q error: %v", blobRoot, err)
+	}
+	h, err := ld.GetHandler(searchRoot)
+	if err != nil {
+		return nil, fmt.Errorf("webdav handler's searchRoot of %q error: %v", searchRoot, err)
+	}
+	sh, ok := h.(*search.Handler)
+	if !ok {
+		return nil, fmt.Errorf("webdav handler's searchRoot of %q is of type %T, expecting a search handler",
+			searchRoot, h)
+	}
+	h, err = ld.GetHandler(signRoot)
+	if err != nil {
+		return nil, fmt.Errorf("webdav handler's jsonSignRoot of %q error: %v", signRoot, err)
+	}
+	sigh, ok := h.(*signhandler.Handler)
+	if !ok {
+		return nil, fmt.Errorf("webdav handler's jsonSignRoot of %q is of type %T, expecting a jsonsign handler",
+			signRoot, h)
+	}
+	return &DAVHandler{
+		Storage: bs,
+		Search:  sh,
+		Sign:    sigh,
+		prefix:  ld.MyPrefix(),
+	}, nil
+}
+
+// maxDAVRecent is the number of permanodes in the "recent" folder.
+const maxDAVRecent = 50
+
+var errDAVNotFound = errors.New("webdav: not found")
+
+type davKind int
+
+const (
+	davTop    davKind = iota // the top-level folder
+	davRecent                // the "recent" folder
+	davPermanode
+	davStaticDir
+	davStaticFile
+)
+
+// A davNode is a file or folder.
+type davNode struct {
+	name string
+	kind davKind
+	ref  *blobref.BlobRef // permanode, directory or file schema blob
+
+	// For permanodes.
+	des  *search.DescribedBlob
+	file *search.FileInfo // if the permanode's camliContent is a file
+
+	size int64
+}
+
+func (n *davNode) isDir() bool {
+	switch n.kind {
+	case davTop, davRecent, davStaticDir:
+		return true
+	case davPermanode:
+		return n.file == nil
+	}
+	return false
+}
+
+// fileRef returns the file schema blob of the file n.
+func (n *davNode) fileRef() *blobref.BlobRef {
+	if n.kind == davPermanode {
+		br, _ := n.des.ContentRef()
+		return br
+	}
+	return n.ref
+}
+
+// davName makes s usable as a path component.
+func davName(s string) string {
+	s = strings.Replace(s, "/", "_", -1)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+func (dh *DAVHandler) describe(br *blobref.BlobRef) (*search.DescribedBlob, error) {
+	dr := dh.Search.NewDescribeRequest()
+	dr.Describe(br, 3)
+	res, err := dr.Result()
+	if err != nil {
+		return nil, err
+	}
+	des, ok := res[br.String()]
+	if !ok || des.Permanode == nil {
+		return nil, errDAVNotFound
+	}
+	return des, nil
+}
+
+func permanodeNode(des *search.DescribedBlob) *davNode {
+	n := &davNode{kind: davPermanode, ref: des.BlobRef, des: des}
+	n.name = des.Title()
+	if n.name == "" {
+		n.name = des.BlobRef.String()
+	}
+	n.name = davName(n.name)
+	if _, fi, ok := des.PermanodeFile(); ok {
+		n.file = fi
+		n.size = fi.Size
+	}
+	return n
+}
+
+// root returns the root permanode named name.
+func (dh *DAVHandler) root(name string) (*davNode, error) {
+	pn, err := dh.Search.Index().PermanodeOfSignerAttrValue(dh.Search.Owner(), "camliRoot", name)
+	if err != nil {
+		return nil, errDAVNotFound
+	}
+	des, err := dh.describe(pn)
+	if err != nil {
+		return nil, err
+	}
+	n := permanodeNode(des)
+	n.name = name
+	return n, nil
+}
+
+// children returns the contents of the folder n. Names are unique;
+// the first item with a name wins.
+func (dh *DAVHandler) children(n *davNode) ([]*davNode, error) {
+	var kids []*davNode
+	switch n.kind {
+	case davTop:
+		ch := make(chan *blobref.BlobRef, 100)
+		errch := make(chan error, 1)
+		go func() {
+			errch <- dh.Search.Index().SearchPermanodesWithAttr(ch, &search.PermanodeByAttrRequest{
+				Signer:    dh.Search.Owner(),
+				Attribute: "camliRoot",
+			})
+		}()
+		var roots []*blobref.BlobRef
+		for br := range ch {
+			roots = append(roots, br)
+		}
+		if err := <-errch; err != nil {
+			return nil, err
+		}
+		kids = append(kids, &davNode{name: "recent", kind: davRecent})
+		for _, br := range roots {
+			des, err := dh.describe(br)
+			if err != nil {
+				continue
+			}
+			kid := permanodeNode(des)
+			kid.name = davName(des.Permanode.Attr.Get("camliRoot"))
+			kids = append(kids, kid)
+		}
+	case davRecent:
+		ch := make(chan *search.Result, 100)
+		errch := make(chan error, 1)
+		go func() {
+			errch <- dh.Search.Index().GetRecentPermanodes(ch, dh.Search.Owner(), maxDAVRecent)
+		}()
+		var recent []*blobref.BlobRef
+		for res := range ch {
+			recent = append(recent, res.BlobRef)
+		}
+		if err := <-errch; err != nil {
+			return nil, err
+		}
+		for _, br := range recent {
+			if des, err := dh.describe(br); err == nil {
+				kids = append(kids, permanodeNode(des))
+			}
+		}
+	case davPermanode:
+		for _, member := range n.des.Members() {
+			if member.Stub || member.Permanode == nil {
+				continue
+			}
+			kids = append(kids, permanodeNode(member))
+		}
+		if cref, ok := n.des.ContentRef(); ok && n.file == nil {
+			if cdes := n.des.PeerBlob(cref); cdes.CamliType == "directory" {
+				static, err := dh.staticChildren(cref)
+				if err != nil {
+					return nil, err
+				}
+				kids = append(kids, static...)
+			}
+		}
+	case davStaticDir:
+		return dh.staticChildren(n.ref)
+	}
+
+	seen := make(map[string]bool)
+	uniq := kids[:0]
+	for _, kid := range kids {
+		if !seen[kid.name] {
+			seen[kid.name] = true
+			uniq = append(uniq, kid)
+		}
+	}
+	return uniq, nil
+}
+
+func (dh *DAVHandler) staticChildren(dirRef *blobref.BlobRef) ([]*davNode, error) {
+	de, err := schema.NewDirectoryEntryFromBlobRef(blobref.SeekerFromStreamingFetcher(dh.Storage), dirRef)
+	if err != nil {
+		return nil, err
+	}
+	d, err := de.Directory()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := d.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	var kids []*davNode
+	for _, e := range entries {
+		kid := &davNode{name: davName(e.FileName()), ref: e.BlobRef()}
+		switch e.CamliType() {
+		case "directory":
+			kid.kind = davStaticDir
+		case "file":
+			kid.kind = davStaticFile
+			if fi, err := dh.Search.Index().GetFileInfo(e.BlobRef()); err == nil {
+				kid.size = fi.Size
+			}
+		default:
+			continue
+		}
+		kids = append(kids, kid)
+	}
+	return kids, nil
+}
+
+// child returns the item of the folder n named name.
+func (dh *DAVHandler) child(n *davNode, name string) (*davNode, error) {
+	if n.kind == davTop && name != "recent" {
+		return dh.root(name)
+	}
+	kids, err := dh.children(n)
+	if err != nil {
+		return nil, err
+	}
+	for _, kid := range kids {
+		if kid.name == name {
+			return kid, nil
+		}
+	}
+	return nil, errDAVNotFound
+}
+
+// splitDAVPath returns the path components of the path p relative to
+// the handler.
+func splitDAVPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// lookup returns the item at the path components.
+func (dh *DAVHandler) lookup(parts []string) (*davNode, error) {
+	n := &davNode{kind: davTop}
+	for _, name := range parts {
+		if !n.isDir() {
+			return nil, errDAVNotFound
+		}
+		var err error
+		if n, err = dh.child(n, name); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// href returns the URL path of the item at the path components.
+func (dh *DAVHandler) href(parts []string, dir bool) string {
+	p := dh.prefix + strings.Join(parts, "/")
+	if dir && len(parts) > 0 {
+		p += "/"
+	}
+	return (&url.URL{Path: p}).String()
+}
+
+func (dh *DAVHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	parts := splitDAVPath(req.Header.Get("X-PrefixHandler-PathSuffix"))
+	rw.Header().Set("DAV", "1, 2")
+	var err error
+	switch req.Method {
+	case "OPTIONS":
+		rw.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, MOVE, PROPFIND, LOCK, UNLOCK")
+		rw.Header().Set("MS-Author-Via", "DAV")
+	case "GET", "HEAD":
+		err = dh.serveGet(rw, req, parts)
+	case "PROPFIND":
+		err = dh.servePropfind(rw, req, parts)
+	case "PUT":
+		err = dh.servePut(rw, req, parts)
+	case "MKCOL":
+		err = dh.serveMkcol(rw, req, parts)
+	case "DELETE":
+		err = dh.serveDelete(rw, req, parts)
+	case "MOVE":
+		err = dh.serveMove(rw, req, parts)
+	case "LOCK":
+		dh.serveLock(rw, req)
+	case "UNLOCK":
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+	switch err {
+	case nil:
+	case errDAVNotFound:
+		http.NotFound(rw, req)
+	case errDAVReadOnly:
+		http.Error(rw, err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("webdav: %s %s: %v", req.Method, req.URL.Path, err)
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+	}
+}
+
+func (dh *DAVHandler) serveGet(rw http.ResponseWriter, req *http.Request, parts []string) error {
+	n, err := dh.lookup(parts)
+	if err != nil {
+		return err
+	}
+	if n.isDir() {
+		kids, err := dh.children(n)
+		if err != nil {
+			return err
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(rw, "<html><body><ul>\n")
+		for _, kid := range kids {
+			name := kid.name
+			if kid.isDir() {
+				name += "/"
+			}
+			fmt.Fprintf(rw, "<li><a href='%s'>%s</a></li>\n",
+				dh.href(append(parts[:len(parts):len(parts)], kid.name), kid.isDir()), xmlEscape(name))
+		}
+		fmt.Fprintf(rw, "</ul></body></html>\n")
+		return nil
+	}
+	dl := &DownloadHandler{Fetcher: dh.Storage}
+	if n.kind == davPermanode && n.file.MimeType != "" {
+		dl.ForceMime = n.file.MimeType
+	}
+	dl.ServeHTTP(rw, req, n.fileRef())
+	return nil
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+type davMultistatus struct {
+	XMLName  xml.Name      `xml:"D:multistatus"`
+	XMLNS    string        `xml:"xmlns:D,attr"`
+	Response []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string           `xml:"D:displayname"`
+	ResourceType  davResourceType  `xml:"D:resourcetype"`
+	ContentLength *int64           `xml:"D:getcontentlength,omitempty"`
+	ContentType   string           `xml:"D:getcontenttype,omitempty"`
+	LastModified  string           `xml:"D:getlastmodified"`
+	CreationDate  string           `xml:"D:creationdate"`
+	ETag          string           `xml:"D:getetag,omitempty"`
+	SupportedLock *davSupportedLck `xml:"D:supportedlock"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+type davSupportedLck struct {
+	LockEntry struct {
+		LockScope struct {
+			Exclusive struct{} `xml:"D:exclusive"`
+		} `xml:"D:lockscope"`
+		LockType struct {
+			Write struct{} `xml:"D:write"`
+		} `xml:"D:locktype"`
+	} `xml:"D:lockentry"`
+}
+
+func (dh *DAVHandler) propResponse(parts []string, n *davNode) davResponse {
+	// The archive doesn't track modification times of permanodes
+	// cheaply, so all items claim the server's start time.
+	prop := davProp{
+		DisplayName:   n.name,
+		LastModified:  startTime.UTC().Format(http.TimeFormat),
+		CreationDate:  startTime.UTC().Format(time.RFC3339),
+		SupportedLock: new(davSupportedLck),
+	}
+	if n.isDir() {
+		prop.ResourceType.Collection = new(struct{})
+	} else {
+		size := n.size
+		prop.ContentLength = &size
+		if n.file != nil {
+			prop.ContentType = n.file.MimeType
+		}
+		prop.ETag = `"` + n.fileRef().String() + `"`
+	}
+	return davResponse{
+		Href: dh.href(parts, n.isDir()),
+		Propstat: davPropstat{
+			Prop:   prop,
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+func (dh *DAVHandler) servePropfind(rw http.ResponseWriter, req *http.Request, parts []string) error {
+	n, err := dh.lookup(parts)
+	if err != nil {
+		return err
+	}
+	// All properties are always returned, whatever the request
+	// body asks for. An infinite depth is treated as a depth of 1.
+	ms := &davMultistatus{XMLNS: "DAV:"}
+	ms.Response = append(ms.Response, dh.propResponse(parts, n))
+	if n.isDir() && req.Header.Get("Depth") != "0" {
+		kids, err := dh.children(n)
+		if err != nil {
+			return err
+		}
+		for _, kid := range kids {
+			ms.Response = append(ms.Response, dh.propResponse(append(parts[:len(parts):len(parts)], kid.name), kid))
+		}
+	}
+	rw.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	rw.WriteHeader(207)
+	io.WriteString(rw, xml.Header)
+	return xml.NewEncoder(rw).Encode(ms)
+}
+
+var errDAVReadOnly = errors.New("webdav: read-only location")
+
+// parent returns the permanode folder that would contain the item at
+// the path components, and the item's name.
+func (dh *DAVHandler) parent(parts []string) (*davNode, string, error) {
+	if len(parts) == 0 {
+		return nil, "", errDAVReadOnly
+	}
+	dir, err := dh.lookup(parts[:len(parts)-1])
+	if err != nil {
+		return nil, "", err
+	}
+	if dir.kind != davPermanode || !dir.isDir() {
+		return nil, "", errDAVReadOnly
+	}
+	return dir, parts[len(parts)-1], nil
+}
+
+func (dh *DAVHandler) sign(name string, m schema.Map) (*blobref.BlobRef, error) {
+	return signAndStore(dh.Sign, dh.Storage, name, m)
+}
+
+// isMember reports whether n is a member of the permanode dir.
+func isMember(dir, n *davNode) bool {
+	if n.kind != davPermanode {
+		return false
+	}
+	for _, member := range dir.des.Permanode.Attr["camliMember"] {
+		if member == n.ref.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (dh *DAVHandler) servePut(rw http.ResponseWriter, req *http.Request, parts []string) error {
+	dir, name, err := dh.parent(parts)
+	if err != nil {
+		return err
+	}
+	existing, err := dh.child(dir, name)
+	if err != nil && err != errDAVNotFound {
+		return err
+	}
+	if existing != nil && (existing.isDir() || !isMember(dir, existing)) {
+		return errDAVReadOnly
+	}
+	fileRef, err := schema.WriteFileFromReader(dh.Storage, name, req.Body)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if _, err := dh.sign("camliContent claim", schema.NewSetAttributeClaim(existing.ref, "camliContent", fileRef.String())); err != nil {
+			return err
+		}
+		rw.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	pn, err := dh.sign("permanode", schema.NewUnsignedPermanode())
+	if err != nil {
+		return err
+	}
+	if _, err := dh.sign("camliContent claim", schema.NewSetAttributeClaim(pn, "camliContent", fileRef.String())); err != nil {
+		return err
+	}
+	if _, err := dh.sign("camliMember claim", schema.NewAddAttributeClaim(dir.ref, "camliMember", pn.String())); err != nil {
+		return err
+	}
+	rw.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (dh *DAVHandler) serveMkcol(rw http.ResponseWriter, req *http.Request, parts []string) error {
+	if len(parts) == 1 {
+		// A new root.
+		if _, err := dh.root(parts[0]); err == nil || parts[0] == "recent" {
+			http.Error(rw, "already exists", http.StatusMethodNotAllowed)
+			return nil
+		}
+		pn, err := dh.sign("permanode", schema.NewUnsignedPermanode())
+		if err != nil {
+			return err
+		}
+		if _, err := dh.sign("camliRoot claim", schema.NewSetAttributeClaim(pn, "camliRoot", parts[0])); err != nil {
+			return err
+		}
+		if _, err := dh.sign("title claim", schema.NewSetAttributeClaim(pn, "title", parts[0])); err != nil {
+			return err
+		}
+		rw.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	dir, name, err := dh.parent(parts)
+	if err != nil {
+		return err
+	}
+	if _, err := dh.child(dir, name); err == nil {
+		http.Error(rw, "already exists", http.StatusMethodNotAllowed)
+		return nil
+	}
+	pn, err := dh.sign("permanode", schema.NewUnsignedPermanode())
+	if err != nil {
+		return err
+	}
+	if _, err := dh.sign("title claim", schema.NewSetAttributeClaim(pn, "title", name)); err != nil {
+		return err
+	}
+	if _, err := dh.sign("camliMember claim", schema.NewAddAttributeClaim(dir.ref, "camliMember", pn.String())); err != nil {
+		return err
+	}
+	rw.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// member returns the member of a permanode folder at the path
+// components, and that folder.
+func (dh *DAVHandler) member(parts []string) (dir, n *davNode, err error) {
+	dir, name, err := dh.parent(parts)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err = dh.child(dir, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isMember(dir, n) {
+		return nil, nil, errDAVReadOnly
+	}
+	return dir, n, nil
+}
+
+func (dh *DAVHandler) serveDelete(rw http.ResponseWriter, req *http.Request, parts []string) error {
+	dir, n, err := dh.member(parts)
+	if err != nil {
+		return err
+	}
+	m := schema.NewDelAttributeClaim(dir.ref, "camliMember")
+	m["value"] = n.ref.String()
+	if _, err := dh.sign("camliMember claim", m); err != nil {
+		return err
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (dh *DAVHandler) serveMove(rw http.ResponseWriter, req *http.Request, parts []string) error {
+	dest, err := url.Parse(req.Header.Get("Destination"))
+	if err != nil || !strings.HasPrefix(dest.Path, dh.prefix) {
+		http.Error(rw, "invalid Destination", http.StatusBadRequest)
+		return nil
+	}
+	destParts := splitDAVPath(strings.TrimPrefix(dest.Path, dh.prefix))
+	dir, n, err := dh.member(parts)
+	if err != nil {
+		return err
+	}
+	destDir, destName, err := dh.parent(destParts)
+	if err != nil {
+		return err
+	}
+	if _, err := dh.child(destDir, destName); err == nil {
+		// Overwriting would mean also deleting the existing
+		// member; not worth the surprise.
+		http.Error(rw, "destination exists", http.StatusPreconditionFailed)
+		return nil
+	}
+	if destName != n.name {
+		if _, err := dh.sign("title claim", schema.NewSetAttributeClaim(n.ref, "title", destName)); err != nil {
+			return err
+		}
+	}
+	if destDir.ref.String() != dir.ref.String() {
+		if _, err := dh.sign("camliMember claim", schema.NewAddAttributeClaim(destDir.ref, "camliMember", n.ref.String())); err != nil {
+			return err
+		}
+		m := schema.NewDelAttributeClaim(dir.ref, "camliMember")
+		m["value"] = n.ref.String()
+		if _, err := dh.sign("camliMember claim", m); err != nil {
+			return err
+		}
+	}
+	rw.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// serveLock grants a lock that's never enforced or checked.
+func (dh *DAVHandler) serveLock(rw http.ResponseWriter, req *http.Request) {
+	token := "opaquelocktoken:" + blobref.SHA1FromString(fmt.Sprintf("%s %s %d", req.URL.Path, req.RemoteAddr, time.Now().UnixNano())).String()
+	rw.Header().Set("Lock-Token", "<"+token+">")
+	rw.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	fmt.Fprintf(rw, `%s<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`+
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>`+
+		`<D:depth>0</D:depth><D:timeout>Second-3600</D:timeout>`+
+		`<D:locktoken><D:href>%s</D:href></D:locktoken>`+
+		`</D:activelock></D:lockdiscovery></D:prop>`, xml.Header, token)
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/search"
+)
+
+func TestSplitDAVPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"/", nil},
+		{"a/b/", []string{"a", "b"}},
+		{"a/../../b", []string{"b"}},
+		{"//a//b", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := splitDAVPath(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitDAVPath(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDAVPropResponse(t *testing.T) {
+	dh := &DAVHandler{prefix: "/dav/"}
+	ms := &davMultistatus{XMLNS: "DAV:"}
+	ms.Response = append(ms.Response,
+		dh.propResponse([]string{"my root"}, &davNode{name: "my root", kind: davStaticDir}),
+		dh.propResponse([]string{"my root", "a&b.txt"}, &davNode{
+			name: "a&b.txt",
+			kind: davStaticFile,
+			ref:  blobref.MustParse("foo-abc"),
+			size: 42,
+			file: &search.FileInfo{MimeType: "text/plain"},
+		}))
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(ms); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		`<D:multistatus xmlns:D="DAV:">`,
+		`<D:href>/dav/my%20root/</D:href>`,
+		`<D:resourcetype><D:collection></D:collection></D:resourcetype>`,
+		`<D:href>/dav/my%20root/a&amp;b.txt</D:href>`,
+		`<D:getcontentlength>42</D:getcontentlength>`,
+		`<D:getcontenttype>text/plain</D:getcontenttype>`,
+		`<D:getetag>&#34;foo-abc&#34;</D:getetag>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("multistatus lacks %s:\n%s", want, got)
+		}
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"strconv"
 	"strings"
 
+	"camlistore.org/pkg/audit"
 	"camlistore.org/pkg/auth"
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/httputil"
@@ -240,6 +241,7 @@ func handleSetupChange(rw http.ResponseWriter, req *http.Request) {
 			httputil.ServerError(rw, req, err)
 			return
 		}
+		audit.Log(req, audit.EventConfigChange, "", osutil.UserServerConfigPath())
 	}
 	sendWizard(rw, req, hasChanged)
 	return
@@ -17,3 +17,7 @@ limitations under the License.
 package serverconfig
 
 var GenLowLevelConfig = genLowLevelConfig
+
+var SetupMimeTypes = setupMimeTypes
+
+var ParseCORS = parseCORS
@@ -26,6 +26,7 @@ import (
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/jsonconfig"
 	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/third_party/code.google.com/p/go.crypto/openpgp"
 )
 
 // various parameters derived from the high-level user config
@@ -33,6 +34,7 @@ import (
 type configPrefixesParams struct {
 	secretRing  string
 	keyId       string
+	gpgSigner   string
 	indexerPath string
 	blobPath    string
 	searchOwner *blobref.BlobRef
@@ -211,6 +213,7 @@ func genLowLevelPrefixes(params *configPrefixesParams) (m jsonconfig.Obj) {
 			"stealth":    false,
 			"blobRoot":   "/bs-and-maybe-also-index/",
 			"searchRoot": "/my-search/",
+			"gcRoot":     "/gc/",
 		},
 	}
 
@@ -226,13 +229,18 @@ func genLowLevelPrefixes(params *configPrefixesParams) (m jsonconfig.Obj) {
 		},
 	}
 
+	sigArgs := map[string]interface{}{
+		"keyId":         params.keyId,
+		"publicKeyDest": "/bs-and-index/",
+	}
+	if params.gpgSigner != "" {
+		sigArgs["gpgSigner"] = params.gpgSigner
+	} else {
+		sigArgs["secretRing"] = params.secretRing
+	}
 	m["/sighelper/"] = map[string]interface{}{
-		"handler": "jsonsign",
-		"handlerArgs": map[string]interface{}{
-			"secretRing":    params.secretRing,
-			"keyId":         params.keyId,
-			"publicKeyDest": "/bs-and-index/",
-		},
+		"handler":     "jsonsign",
+		"handlerArgs": sigArgs,
 	}
 
 	m["/bs-and-index/"] = map[string]interface{}{
@@ -276,6 +284,14 @@ func genLowLevelPrefixes(params *configPrefixesParams) (m jsonconfig.Obj) {
 		},
 	}
 
+	m["/gc/"] = map[string]interface{}{
+		"handler": "gc",
+		"handlerArgs": map[string]interface{}{
+			"storage": "/bs/",
+			"owner":   params.searchOwner.String(),
+		},
+	}
+
 	return
 }
 
@@ -284,13 +300,16 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 	var (
 		baseURL    = conf.OptionalString("baseURL", "")
 		listen     = conf.OptionalString("listen", "")
+		sockMode   = conf.OptionalString("listenSocketMode", "")
 		auth       = conf.RequiredString("auth")
 		keyId      = conf.RequiredString("identity")
-		secretRing = conf.RequiredString("identitySecretRing")
+		gpgSigner  = conf.OptionalString("identityGPGSigner", "")
 		blobPath   = conf.RequiredString("blobPath")
 		tlsOn      = conf.OptionalBool("https", false)
 		tlsCert    = conf.OptionalString("HTTPSCertFile", "")
 		tlsKey     = conf.OptionalString("HTTPSKeyFile", "")
+		acmeHost   = conf.OptionalString("ACMEHostname", "")
+		acmeEmail  = conf.OptionalString("ACMEEmail", "")
 		dbname     = conf.OptionalString("dbname", "")
 		mysql      = conf.OptionalString("mysql", "")
 		postgres   = conf.OptionalString("postgres", "")
@@ -298,7 +317,23 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 		_          = conf.OptionalList("replicateTo")
 		s3         = conf.OptionalString("s3", "")
 		publish    = conf.OptionalObject("publish")
+		readTO     = conf.OptionalInt("readTimeout", 0)
+		idleTO     = conf.OptionalInt("idleTimeout", 0)
+		shutdownTO = conf.OptionalInt("shutdownTimeout", 0)
+		tokens     = conf.OptionalString("tokens", "")
+		replayWin  = conf.OptionalInt("replayWindow", 0)
+		proxies    = conf.OptionalList("trustedProxies")
+		hstsMaxAge = conf.OptionalInt("HSTSMaxAge", 0)
+		hstsSubs   = conf.OptionalBool("HSTSIncludeSubdomains", false)
+		frameOpts  = conf.OptionalString("frameOptions", "")
+		mimeTypes  = conf.OptionalObject("mimeTypes")
 	)
+	// With identityGPGSigner, gpg signs with the identity's key,
+	// which may be on a smartcard, so there's no secret ring.
+	var secretRing string
+	if gpgSigner == "" {
+		secretRing = conf.RequiredString("identitySecretRing")
+	}
 	if err := conf.Validate(); err != nil {
 		return nil, err
 	}
@@ -308,10 +343,19 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 		if (tlsCert != "") != (tlsKey != "") {
 			return nil, errors.New("Must set both TLSCertFile and TLSKeyFile (or neither to generate a self-signed cert)")
 		}
-		if tlsCert != "" {
+		switch {
+		case acmeHost != "":
+			if tlsCert != "" {
+				return nil, errors.New("ACMEHostname and HTTPSCertFile are mutually exclusive")
+			}
+			obj["ACMEHostname"] = acmeHost
+			if acmeEmail != "" {
+				obj["ACMEEmail"] = acmeEmail
+			}
+		case tlsCert != "":
 			obj["TLSCertFile"] = tlsCert
 			obj["TLSKeyFile"] = tlsKey
-		} else {
+		default:
 			obj["TLSCertFile"] = "config/selfgen_cert.pem"
 			obj["TLSKeyFile"] = "config/selfgen_key.pem"
 		}
@@ -326,8 +370,45 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 	if listen != "" {
 		obj["listen"] = listen
 	}
+	if sockMode != "" {
+		obj["listenSocketMode"] = sockMode
+	}
 	obj["https"] = tlsOn
 	obj["auth"] = auth
+	if tokens != "" {
+		obj["tokens"] = tokens
+	}
+	if replayWin > 0 {
+		obj["replayWindow"] = float64(replayWin)
+	}
+	if len(proxies) > 0 {
+		var l []interface{}
+		for _, p := range proxies {
+			l = append(l, p)
+		}
+		obj["trustedProxies"] = l
+	}
+	if readTO > 0 {
+		obj["readTimeout"] = float64(readTO)
+	}
+	if idleTO > 0 {
+		obj["idleTimeout"] = float64(idleTO)
+	}
+	if shutdownTO > 0 {
+		obj["shutdownTimeout"] = float64(shutdownTO)
+	}
+	if hstsMaxAge > 0 {
+		obj["HSTSMaxAge"] = float64(hstsMaxAge)
+		if hstsSubs {
+			obj["HSTSIncludeSubdomains"] = true
+		}
+	}
+	if frameOpts != "" {
+		obj["frameOptions"] = frameOpts
+	}
+	if len(mimeTypes) > 0 {
+		obj["mimeTypes"] = map[string]interface{}(mimeTypes)
+	}
 
 	if dbname == "" {
 		username := os.Getenv("USER")
@@ -351,7 +432,12 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 		indexerPath = "/index-mem/"
 	}
 
-	entity, err := jsonsign.EntityFromSecring(keyId, secretRing)
+	var entity *openpgp.Entity
+	if gpgSigner != "" {
+		entity, err = (&jsonsign.GPGSigner{Program: gpgSigner}).PublicEntity(keyId)
+	} else {
+		entity, err = jsonsign.EntityFromSecring(keyId, secretRing)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -363,6 +449,7 @@ func genLowLevelConfig(conf *Config) (lowLevelConf *Config, err error) {
 	prefixesParams := &configPrefixesParams{
 		secretRing:  secretRing,
 		keyId:       keyId,
+		gpgSigner:   gpgSigner,
 		indexerPath: indexerPath,
 		blobPath:    blobPath,
 		searchOwner: blobref.SHA1FromString(armoredPublicKey),
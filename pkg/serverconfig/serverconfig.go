@@ -20,14 +20,17 @@ limitations under the License.
 package serverconfig
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"camlistore.org/pkg/auth"
 	"camlistore.org/pkg/blobserver"
@@ -35,6 +38,8 @@ import (
 	"camlistore.org/pkg/blobserver/handlers"
 	"camlistore.org/pkg/httputil"
 	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/magic"
+	"camlistore.org/pkg/metrics"
 )
 
 const camliPrefix = "/camli/"
@@ -45,6 +50,9 @@ type handlerConfig struct {
 	prefix string         // "/foo/"
 	htype  string         // "localdisk", etc
 	conf   jsonconfig.Obj // never nil
+	auth   string         // optional "auth" of the prefix; see authMode
+	cors   *httputil.CORS // or nil
+	csp    string         // Content-Security-Policy of its responses, or empty
 
 	settingUp, setupDone bool
 }
@@ -113,7 +121,7 @@ func handleCamliUsingStorage(conn http.ResponseWriter, req *http.Request, action
 	case "GET":
 		switch action {
 		case "enumerate-blobs":
-			handler = auth.RequireAuth(handlers.CreateEnumerateHandler(storage), auth.OpGet)
+			handler = auth.RequireAuth(auth.DenyACLUsers(handlers.CreateEnumerateHandler(storage)), auth.OpGet)
 		case "stat":
 			handler = auth.RequireAuth(handlers.CreateStatHandler(storage), auth.OpAll)
 		default:
@@ -164,6 +172,12 @@ func makeCamliHandler(prefix, baseURL string, storage blobserver.Storage, hf blo
 			unsupportedHandler(conn, req)
 			return
 		}
+		op := action
+		if req.Method == "GET" && action != "enumerate-blobs" && action != "stat" {
+			op = "get"
+		}
+		defer blobOpSeconds.ObserveSince(time.Now(), prefix, op)
+		blobOps.Inc(prefix, op)
 		handleCamliUsingStorage(conn, req, action, storageConfig)
 	})
 }
@@ -274,7 +288,7 @@ func (hl *handlerLoader) setupHandler(prefix string) {
 				h.prefix, stype, err)
 		}
 		hl.handler[h.prefix] = pstorage
-		hl.installer.Handle(prefix+"camli/", makeCamliHandler(prefix, hl.baseURL, pstorage, hl))
+		hl.installer.Handle(prefix+"camli/", h.withCORS(h.withCSP(makeCamliHandler(prefix, hl.baseURL, pstorage, hl))))
 		return
 	}
 
@@ -285,17 +299,162 @@ func (hl *handlerLoader) setupHandler(prefix string) {
 	}
 	hl.handler[prefix] = hh
 	var wrappedHandler http.Handler = &httputil.PrefixHandler{prefix, hh}
-	if handerTypeWantsAuth(h.htype) {
-		wrappedHandler = auth.Handler{wrappedHandler}
+	if h.wantsAuth() {
+		readOp, writeOp := handlerTypeOps(h.htype)
+		wrappedHandler = auth.RoleHandler{Handler: wrappedHandler, ReadOp: readOp, WriteOp: writeOp}
+		if !handlerTypeChecksACLs(h.htype) {
+			wrappedHandler = http.HandlerFunc(auth.DenyACLUsers(wrappedHandler.ServeHTTP))
+		}
+	}
+	hl.installer.Handle(prefix, timedHandler(prefix, h.withCORS(h.withCSP(wrappedHandler))))
+}
+
+// withCORS returns hh, wrapped by the handler's CORS policy if any.
+// It wraps any authentication, so preflight requests, which browsers
+// send without credentials, are answered.
+func (h *handlerConfig) withCORS(hh http.Handler) http.Handler {
+	if h.cors == nil {
+		return hh
 	}
-	hl.installer.Handle(prefix, wrappedHandler)
+	return h.cors.Handler(hh)
+}
+
+// withCSP returns hh, setting the handler's Content-Security-Policy
+// header if it has one.
+func (h *handlerConfig) withCSP(hh http.Handler) http.Handler {
+	if h.csp == "" {
+		return hh
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Security-Policy", h.csp)
+		hh.ServeHTTP(rw, req)
+	})
+}
+
+// DefaultCSP is the Content-Security-Policy of the ui and publish
+// handlers, unless their prefix's "contentSecurityPolicy" says
+// otherwise. The UI's pages need inline and eval'ed scripts.
+const DefaultCSP = "default-src 'self'; script-src 'self' 'unsafe-inline' 'unsafe-eval'; " +
+	"style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; frame-ancestors 'self'"
+
+// handlerTypeCSP returns the default Content-Security-Policy of the
+// handlers of handlerType, if any.
+func handlerTypeCSP(handlerType string) string {
+	switch handlerType {
+	case "ui", "publish":
+		return DefaultCSP
+	}
+	return ""
+}
+
+// parseCORS returns the CORS policy of a prefix's optional "cors"
+// object, or nil if it has none.
+func parseCORS(conf jsonconfig.Obj) (*httputil.CORS, error) {
+	if len(conf) == 0 {
+		return nil, nil
+	}
+	c := &httputil.CORS{
+		Origins:       conf.RequiredList("origins"),
+		Methods:       conf.OptionalList("methods"),
+		Headers:       conf.OptionalList("headers"),
+		ExposeHeaders: conf.OptionalList("exposeHeaders"),
+		MaxAge:        conf.OptionalInt("maxAge", 600),
+		Credentials:   conf.OptionalBool("credentials", false),
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Credentials {
+		// Any site could then read the handler with its
+		// visitors' cookies or HTTP authentication.
+		for _, o := range c.Origins {
+			if o == "*" {
+				return nil, errors.New(`"credentials" may not be used with the "*" origin`)
+			}
+		}
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{"GET", "HEAD", "POST"}
+	}
+	if len(c.Headers) == 0 {
+		c.Headers = []string{"Authorization", "Content-Type"}
+	}
+	return c, nil
+}
+
+var (
+	blobOps = metrics.NewCounter("camli_blob_requests_total",
+		"Blob protocol requests, by storage prefix and operation.", "storage", "op")
+	blobOpSeconds = metrics.NewHistogram("camli_blob_request_seconds",
+		"Blob protocol request latencies, by storage prefix and operation.",
+		metrics.DefaultBuckets, "storage", "op")
+	handlerSeconds = metrics.NewHistogram("camli_handler_request_seconds",
+		"Handler request latencies, by handler prefix and method.",
+		metrics.DefaultBuckets, "handler", "method")
+)
+
+// timedHandler returns h, recording its latencies in handlerSeconds.
+func timedHandler(prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		defer handlerSeconds.ObserveSince(time.Now(), prefix, req.Method)
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// wantsAuth reports whether the handler's requests must all be
+// authenticated, by the auth mode of its prefix.
+func (h *handlerConfig) wantsAuth() bool {
+	switch h.auth {
+	case "":
+		return handerTypeWantsAuth(h.htype)
+	case "public":
+		return false
+	}
+	return true
+}
+
+// authMode returns the auth mode scoped to the prefix by its config's
+// optional "auth" key, or nil to use the server's. The key's value is
+// "public", for no authentication, "server", to require the server's
+// authentication even of handlers that wouldn't otherwise, or an auth
+// string of the same syntax as the top-level "auth" key, such as
+// "userpass:admin:secret".
+func (h *handlerConfig) authMode() (auth.AuthMode, error) {
+	switch h.auth {
+	case "", "server":
+		return nil, nil
+	case "public":
+		return auth.None{}, nil
+	}
+	return auth.NewMode(h.auth)
 }
 
 func handerTypeWantsAuth(handlerType string) bool {
 	// TODO(bradfitz): ask the handler instead? This is a bit of a
 	// weird spot for this policy maybe?
 	switch handlerType {
-	case "ui", "search", "jsonsign", "sync":
+	case "ui", "search", "jsonsign", "sync", "thumbnail", "video", "status", "metrics", "attr", "webdav", "audit", "signedurl", "gc", "importer":
+		return true
+	}
+	return false
+}
+
+// handlerTypeOps returns the operations a user must be allowed to
+// make reading and other requests to a handler of handlerType.
+func handlerTypeOps(handlerType string) (readOp, writeOp auth.Operation) {
+	switch handlerType {
+	case "sync", "status", "metrics", "setup", "audit", "gc", "importer":
+		return auth.RoleAdmin, auth.RoleAdmin
+	}
+	return auth.RoleRead, auth.RoleReadWrite
+}
+
+// handlerTypeChecksACLs reports whether the handlers of handlerType
+// limit the requests of ACL users to the blobs they're granted. ACL
+// users are denied the others.
+func handlerTypeChecksACLs(handlerType string) bool {
+	switch handlerType {
+	case "ui", "search", "jsonsign", "publish", "signedurl":
 		return true
 	}
 	return false
@@ -308,6 +467,8 @@ type Config struct {
 	jsonconfig.Obj
 	UIPath     string // Not valid until after InstallHandlers
 	configPath string // Filesystem path
+
+	shutdowners []blobserver.Shutdowner // set by InstallHandlers
 }
 
 // Load returns a low-level "handler config" from the provided filename.
@@ -342,8 +503,75 @@ func Load(filename string) (*Config, error) {
 
 func (config *Config) checkValidAuth() error {
 	authConfig := config.OptionalString("auth", "")
-	_, err := auth.FromConfig(authConfig)
-	return err
+	if _, err := auth.FromConfig(authConfig); err != nil {
+		return err
+	}
+	auth.SetReplayWindow(time.Duration(config.OptionalInt("replayWindow", 0)) * time.Second)
+	return auth.SetTokensFile(config.OptionalString("tokens", ""))
+}
+
+// setupMimeTypes registers the custom MIME types of the config's
+// optional "mimeTypes", which the indexer and the handlers detect:
+//
+//   "mimeTypes": {
+//     "extensions": {".fb2": "application/x-fictionbook+xml"},
+//     "signatures": {"application/x-foo": ["464f4f31", "4:464f4f32"]}
+//   }
+//
+// A signature is the hex of the magic bytes starting the file, or
+// starting at a decimal offset, given before a colon.
+func setupMimeTypes(conf jsonconfig.Obj) error {
+	exts := conf.OptionalObject("extensions")
+	sigs := conf.OptionalObject("signatures")
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	for _, ext := range configKeys(exts) {
+		magic.RegisterExtension(ext, exts.RequiredString(ext))
+	}
+	if err := exts.Validate(); err != nil {
+		return fmt.Errorf("extensions: %v", err)
+	}
+	for _, mimeType := range configKeys(sigs) {
+		for _, sig := range sigs.RequiredList(mimeType) {
+			offset, b, err := parseSignature(sig)
+			if err != nil {
+				return fmt.Errorf("signature %q of %s: %v", sig, mimeType, err)
+			}
+			magic.RegisterSignature(mimeType, offset, b)
+		}
+	}
+	return sigs.Validate()
+}
+
+// configKeys returns the keys of conf, sorted, except the comments
+// and the keys jsonconfig keeps.
+func configKeys(conf jsonconfig.Obj) []string {
+	var keys []string
+	for k := range conf {
+		if !strings.HasPrefix(k, "_") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseSignature parses a signature of the "mimeTypes" config:
+// "[<offset>:]<hex>".
+func parseSignature(sig string) (offset int, b []byte, err error) {
+	if i := strings.Index(sig, ":"); i >= 0 {
+		offset, err = strconv.Atoi(sig[:i])
+		if err != nil || offset < 0 {
+			return 0, nil, errors.New("invalid offset")
+		}
+		sig = sig[i+1:]
+	}
+	b, err = hex.DecodeString(sig)
+	if err != nil || len(b) == 0 {
+		return 0, nil, errors.New("invalid hex bytes")
+	}
+	return offset, b, nil
 }
 
 // InstallHandlers creates and registers all the HTTP Handlers needed by config
@@ -361,6 +589,9 @@ func (config *Config) InstallHandlers(hi HandlerInstaller, baseURL string, conte
 	if err := config.checkValidAuth(); err != nil {
 		return fmt.Errorf("error while configuring auth: %v", err)
 	}
+	if err := setupMimeTypes(config.OptionalObject("mimeTypes")); err != nil {
+		return fmt.Errorf("error in mimeTypes: %v", err)
+	}
 	prefixes := config.RequiredObject("prefixes")
 	if err := config.Validate(); err != nil {
 		return fmt.Errorf("configuration error in root object's keys: %v", err)
@@ -374,6 +605,7 @@ func (config *Config) InstallHandlers(hi HandlerInstaller, baseURL string, conte
 		context:   context,
 	}
 
+	prefixModes := make(map[string]auth.AuthMode)
 	for prefix, vei := range prefixes {
 		if !strings.HasPrefix(prefix, "/") {
 			exitFailure("prefix %q doesn't start with /", prefix)
@@ -392,20 +624,63 @@ func (config *Config) InstallHandlers(hi HandlerInstaller, baseURL string, conte
 		}
 		handlerType := pconf.RequiredString("handler")
 		handlerArgs := pconf.OptionalObject("handlerArgs")
+		authConf := pconf.OptionalString("auth", "")
+		corsConf := pconf.OptionalObject("cors")
+		csp := pconf.OptionalString("contentSecurityPolicy", handlerTypeCSP(handlerType))
 		if err := pconf.Validate(); err != nil {
 			exitFailure("configuration error in prefix %s: %v", prefix, err)
 		}
+		cors, err := parseCORS(corsConf)
+		if err != nil {
+			exitFailure("configuration error in cors of prefix %s: %v", prefix, err)
+		}
 		h := &handlerConfig{
 			prefix: prefix,
 			htype:  handlerType,
 			conf:   handlerArgs,
+			auth:   authConf,
+			cors:   cors,
+			csp:    csp,
 		}
 		hl.config[prefix] = h
+		am, err := h.authMode()
+		if err != nil {
+			exitFailure("invalid auth of prefix %s: %v", prefix, err)
+		}
+		if am != nil {
+			prefixModes[prefix] = am
+		}
 
 		if handlerType == "ui" {
 			config.UIPath = prefix
 		}
 	}
+	auth.SetPrefixModes(prefixModes)
+	hi.Handle(auth.DiscoveryPath, http.HandlerFunc(auth.DiscoveryHandler))
 	hl.setupAll()
+	for _, h := range hl.handler {
+		if s, ok := h.(blobserver.Shutdowner); ok {
+			config.shutdowners = append(config.shutdowners, s)
+		}
+	}
 	return nil
 }
+
+// Shutdown asks the installed handlers with work in progress, such as
+// sync handlers, to finish it by deadline. It returns the first of
+// their errors.
+func (config *Config) Shutdown(deadline time.Time) error {
+	errc := make(chan error, len(config.shutdowners))
+	for _, s := range config.shutdowners {
+		go func(s blobserver.Shutdowner) {
+			errc <- s.Shutdown(deadline)
+		}(s)
+	}
+	var first error
+	for i := 0; i < len(config.shutdowners); i++ {
+		if err := <-errc; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
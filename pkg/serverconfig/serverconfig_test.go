@@ -29,6 +29,7 @@ import (
 	"testing"
 
 	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/pkg/magic"
 	"camlistore.org/pkg/serverconfig"
 )
 
@@ -159,3 +160,51 @@ func tempFile(prefix string, b []byte) *os.File {
 	f.Close()
 	return f
 }
+
+func TestSetupMimeTypes(t *testing.T) {
+	err := serverconfig.SetupMimeTypes(jsonconfig.Obj{
+		"extensions": map[string]interface{}{".fb2": "application/x-fictionbook+xml"},
+		"signatures": map[string]interface{}{
+			"application/x-serverconfig-test": []interface{}{"5a5a31", "4:5a5a32"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ name, data, want string }{
+		{"book.fb2", "", "application/x-fictionbook+xml"},
+		{"", "ZZ1...", "application/x-serverconfig-test"},
+		{"", "....ZZ2", "application/x-serverconfig-test"},
+	} {
+		if got := magic.FileMimeType(tt.name, []byte(tt.data)); got != tt.want {
+			t.Errorf("FileMimeType(%q, %q) = %q; want %q", tt.name, tt.data, got, tt.want)
+		}
+	}
+
+	for _, sig := range []string{"zz", "", "-1:00", "x:00"} {
+		conf := jsonconfig.Obj{"signatures": map[string]interface{}{"application/x-bad": []interface{}{sig}}}
+		if err := serverconfig.SetupMimeTypes(conf); err == nil {
+			t.Errorf("signature %q: no error", sig)
+		}
+	}
+	if err := serverconfig.SetupMimeTypes(jsonconfig.Obj{"extension": map[string]interface{}{}}); err == nil {
+		t.Errorf("unknown key: no error")
+	}
+}
+
+func TestParseCORS(t *testing.T) {
+	for _, tt := range []struct {
+		conf  jsonconfig.Obj
+		valid bool
+	}{
+		{jsonconfig.Obj{"origins": []interface{}{"*"}}, true},
+		{jsonconfig.Obj{"origins": []interface{}{"https://app.example.com"}, "credentials": true}, true},
+		{jsonconfig.Obj{"origins": []interface{}{"*"}, "credentials": true}, false},
+		{jsonconfig.Obj{"origins": []interface{}{"https://app.example.com", "*"}, "credentials": true}, false},
+	} {
+		_, err := serverconfig.ParseCORS(tt.conf)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseCORS(%v) = %v; want valid %v", tt.conf, err, tt.valid)
+		}
+	}
+}
@@ -115,6 +115,10 @@ func (fi *FakeIndex) GetRecentPermanodes(dest chan *search.Result, owner *blobre
 	panic("NOIMPL")
 }
 
+func (fi *FakeIndex) GetDatedPermanodes(dest chan *search.Result, owner *blobref.BlobRef, limit int) error {
+	panic("NOIMPL")
+}
+
 // TODO(mpl): write real tests
 func (fi *FakeIndex) SearchPermanodesWithAttr(dest chan<- *blobref.BlobRef, request *search.PermanodeByAttrRequest) error {
 	panic("NOIMPL")
@@ -145,6 +149,14 @@ func (fi *FakeIndex) GetFileInfo(fileRef *blobref.BlobRef) (*search.FileInfo, er
 	panic("NOIMPL")
 }
 
+func (fi *FakeIndex) GetImageInfo(fileRef *blobref.BlobRef) (*search.ImageInfo, error) {
+	panic("NOIMPL")
+}
+
+func (fi *FakeIndex) GetFileTime(fileRef *blobref.BlobRef) (time.Time, error) {
+	panic("NOIMPL")
+}
+
 func (fi *FakeIndex) PermanodeOfSignerAttrValue(signer *blobref.BlobRef, attr, val string) (*blobref.BlobRef, error) {
 	fi.lk.Lock()
 	defer fi.lk.Unlock()
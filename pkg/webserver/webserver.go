@@ -18,8 +18,10 @@ package webserver
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"log"
@@ -28,8 +30,10 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"camlistore.org/pkg/httputil"
 	"camlistore.org/pkg/throttle"
 	"camlistore.org/third_party/github.com/bradfitz/runsit/listen"
 )
@@ -43,8 +47,32 @@ type Server struct {
 
 	enableTLS               bool
 	tlsCertFile, tlsKeyFile string
+	clientCAs               *x509.CertPool // or nil
+	proxies                 httputil.TrustedProxies
+
+	// getCertificate, if not nil, returns the TLS certificates
+	// instead of tlsCertFile and tlsKeyFile.
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	readTimeout, idleTimeout time.Duration
+
+	headers SecurityHeaders
+
+	socketMode os.FileMode // of a unix socket listened on, if non-zero
+
+	mu  sync.Mutex   // guards srv
+	srv *http.Server // set by Serve
 }
 
+// DefaultIdleTimeout is how long, by default, a keep-alive connection
+// may sit idle between requests before the server closes it.
+const DefaultIdleTimeout = 2 * time.Minute
+
+// tcpKeepAlivePeriod is the interval of TCP keep-alive probes on
+// accepted connections, to notice dead peers of long-lived
+// connections such as WebSockets.
+const tcpKeepAlivePeriod = 3 * time.Minute
+
 func New() *Server {
 	return &Server{
 		mux: http.NewServeMux(),
@@ -57,6 +85,118 @@ func (s *Server) SetTLS(certFile, keyFile string) {
 	s.tlsKeyFile = keyFile
 }
 
+// SetGetCertificate makes the server use TLS, with the certificates
+// returned by fn, such as a renewed ACME certificate, rather than
+// those of files.
+func (s *Server) SetGetCertificate(fn func(*tls.ClientHelloInfo) (*tls.Certificate, error)) {
+	s.enableTLS = true
+	s.getCertificate = fn
+}
+
+// SetClientCAs makes the server ask TLS clients for certificates
+// signed by pool, for client certificate authentication.
+func (s *Server) SetClientCAs(pool *x509.CertPool) {
+	s.clientCAs = pool
+}
+
+// SetTrustedProxies sets the reverse proxies whose forwarding headers
+// tell the client's address and requested URL.
+func (s *Server) SetTrustedProxies(tp httputil.TrustedProxies) {
+	s.proxies = tp
+}
+
+// SetTimeouts sets how long a client may take to send a request's
+// headers, and how long a keep-alive connection may be idle between
+// requests. Zero means the default: no limit to read headers, and
+// DefaultIdleTimeout for idle connections.
+func (s *Server) SetTimeouts(read, idle time.Duration) {
+	s.readTimeout = read
+	s.idleTimeout = idle
+}
+
+// SecurityHeaders are the headers the server adds to all its
+// responses, to harden the browsers' handling of them.
+type SecurityHeaders struct {
+	// HSTSMaxAge, if non-zero, is how long browsers should only
+	// use HTTPS to reach the server, sent in the
+	// Strict-Transport-Security header of HTTPS responses.
+	HSTSMaxAge time.Duration
+	// HSTSIncludeSubdomains makes the HSTS policy apply to the
+	// subdomains of the server's host too.
+	HSTSIncludeSubdomains bool
+	// NoSniff sets "X-Content-Type-Options: nosniff", so browsers
+	// don't guess the type of blobs served as something else.
+	NoSniff bool
+	// FrameOptions, if non-empty, is the X-Frame-Options header,
+	// such as "SAMEORIGIN" or "DENY".
+	FrameOptions string
+}
+
+// SetSecurityHeaders sets the headers added to all responses.
+func (s *Server) SetSecurityHeaders(h SecurityHeaders) {
+	s.headers = h
+}
+
+func (s *Server) setSecurityHeaders(rw http.ResponseWriter, req *http.Request) {
+	h := rw.Header()
+	if s.headers.HSTSMaxAge > 0 && httputil.IsSecure(req) {
+		v := fmt.Sprintf("max-age=%d", int64(s.headers.HSTSMaxAge/time.Second))
+		if s.headers.HSTSIncludeSubdomains {
+			v += "; includeSubDomains"
+		}
+		h.Set("Strict-Transport-Security", v)
+	}
+	if s.headers.NoSniff {
+		h.Set("X-Content-Type-Options", "nosniff")
+	}
+	if s.headers.FrameOptions != "" {
+		h.Set("X-Frame-Options", s.headers.FrameOptions)
+	}
+}
+
+// SetSocketMode sets the permissions of the unix socket the server
+// listens on, if it does, such as 0660 to let only a reverse proxy in
+// the socket's group connect. By default, they're those of the umask.
+func (s *Server) SetSocketMode(mode os.FileMode) {
+	s.socketMode = mode
+}
+
+// UnixSocketPath returns the path of the unix socket a listen address
+// names, either "unix:" and the path or just an absolute path, and
+// whether it names one.
+func UnixSocketPath(addr string) (path string, ok bool) {
+	if strings.HasPrefix(addr, "unix:") {
+		return addr[len("unix:"):], true
+	}
+	if strings.HasPrefix(addr, "/") {
+		return addr, true
+	}
+	return "", false
+}
+
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	// A socket left behind by a server that didn't shut down
+	// cleanly would fail the listen.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("another server is listening on %s", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if s.socketMode != 0 {
+		if err := os.Chmod(path, s.socketMode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
 func (s *Server) ListenURL() string {
 	scheme := "http"
 	if s.enableTLS {
@@ -89,6 +229,8 @@ func (s *Server) Handle(pattern string, handler http.Handler) {
 }
 
 func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.proxies.FixRequest(req)
+	s.setSecurityHeaders(rw, req)
 	for _, hp := range s.premux {
 		handler, ok := hp(req)
 		if ok {
@@ -99,7 +241,8 @@ func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	s.mux.ServeHTTP(rw, req)
 }
 
-// Listen starts listening on the given host:port addr.
+// Listen starts listening on the given host:port addr, or on the unix
+// socket it names, as UnixSocketPath says.
 func (s *Server) Listen(addr string) error {
 	if s.listener != nil {
 		return nil
@@ -111,12 +254,20 @@ func (s *Server) Listen(addr string) error {
 	}
 
 	var err error
-	s.listener, err = listen.Listen(addr)
+	if path, ok := UnixSocketPath(addr); ok {
+		s.listener, err = s.listenUnix(path)
+	} else {
+		s.listener, err = listen.Listen(addr)
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to listen on %s: %v", addr, err)
 	}
+	s.listener = keepAliveListener{s.listener}
 	base := s.ListenURL()
 	if doLog {
+		if base == "" {
+			base = addr
+		}
 		log.Printf("Starting to listen on %s\n", base)
 	}
 
@@ -126,10 +277,18 @@ func (s *Server) Listen(addr string) error {
 			Time:       time.Now,
 			NextProtos: []string{"http/1.1"},
 		}
-		config.Certificates = make([]tls.Certificate, 1)
-		config.Certificates[0], err = tls.LoadX509KeyPair(s.tlsCertFile, s.tlsKeyFile)
-		if err != nil {
-			return fmt.Errorf("Failed to load TLS cert: %v", err)
+		if s.clientCAs != nil {
+			config.ClientCAs = s.clientCAs
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		if s.getCertificate != nil {
+			config.GetCertificate = s.getCertificate
+		} else {
+			config.Certificates = make([]tls.Certificate, 1)
+			config.Certificates[0], err = tls.LoadX509KeyPair(s.tlsCertFile, s.tlsKeyFile)
+			if err != nil {
+				return fmt.Errorf("Failed to load TLS cert: %v", err)
+			}
 		}
 		s.listener = tls.NewListener(s.listener, config)
 	}
@@ -163,13 +322,65 @@ func (s *Server) Serve() {
 		log.Fatalf("Listen error: %v", err)
 	}
 	go runTestHarnessIntegration(s.listener)
-	err := http.Serve(s.throttleListener(), s)
+	idle := s.idleTimeout
+	if idle == 0 {
+		idle = DefaultIdleTimeout
+	}
+	srv := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: s.readTimeout,
+		IdleTimeout:       idle,
+	}
+	s.mu.Lock()
+	s.srv = srv
+	s.mu.Unlock()
+	err := srv.Serve(s.throttleListener())
+	if err == http.ErrServerClosed {
+		return
+	}
 	if err != nil {
 		log.Printf("Error in http server: %v\n", err)
 		os.Exit(1)
 	}
 }
 
+// Shutdown stops the server from accepting new connections and waits
+// for the requests in progress, such as uploads, to finish, up to
+// timeout. Hijacked connections, such as WebSockets, aren't waited
+// for.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.mu.Lock()
+	srv := s.srv
+	s.mu.Unlock()
+	if srv == nil {
+		if s.listener != nil {
+			return s.listener.Close()
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// keepAliveListener turns on TCP keep-alives on the connections it
+// accepts.
+type keepAliveListener struct {
+	net.Listener
+}
+
+func (ln keepAliveListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(tcpKeepAlivePeriod)
+	}
+	return c, nil
+}
+
 // Signals the test harness that we've started listening.
 // TODO: write back the port number that we randomly selected?
 // For now just writes back a single byte.
@@ -0,0 +1,156 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	s := New()
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	release := make(chan bool)
+	s.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+		rw.Write([]byte("done"))
+	})
+	go s.Serve()
+
+	resc := make(chan string, 1)
+	go func() {
+		res, err := http.Get(s.ListenURL() + "/")
+		if err != nil {
+			resc <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		resc <- string(body)
+	}()
+	<-started
+
+	shutc := make(chan error, 1)
+	go func() { shutc <- s.Shutdown(5 * time.Second) }()
+	select {
+	case err := <-shutc:
+		t.Fatalf("Shutdown returned with a request in progress: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutc; err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+	if got := <-resc; got != "done" {
+		t.Errorf("in-flight request got %q; want %q", got, "done")
+	}
+	if _, err := http.Get(s.ListenURL() + "/"); err == nil {
+		t.Errorf("request after Shutdown succeeded")
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	s := New()
+	s.SetSecurityHeaders(SecurityHeaders{
+		HSTSMaxAge:            24 * time.Hour,
+		HSTSIncludeSubdomains: true,
+		NoSniff:               true,
+		FrameOptions:          "DENY",
+	})
+	s.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {})
+
+	get := func(secure bool) http.Header {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if secure {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Header()
+	}
+	h := get(true)
+	if got, want := h.Get("Strict-Transport-Security"), "max-age=86400; includeSubDomains"; got != want {
+		t.Errorf("Strict-Transport-Security = %q; want %q", got, want)
+	}
+	if got := h.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q; want nosniff", got)
+	}
+	if got := h.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options = %q; want DENY", got)
+	}
+	if got := get(false).Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Strict-Transport-Security over HTTP = %q; want none", got)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camli-webserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "camli.sock")
+
+	s := New()
+	s.SetSocketMode(0600)
+	if err := s.Listen("unix:" + sock); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(time.Second)
+	if fi, err := os.Stat(sock); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v; want 0600", fi.Mode().Perm())
+	}
+	if u := s.ListenURL(); u != "" {
+		t.Errorf("ListenURL = %q; want none", u)
+	}
+	s.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	})
+	go s.Serve()
+
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, _ := http.NewRequest("GET", "http://camli/", nil)
+	if err := req.Write(c); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "hello" {
+		t.Errorf("response = %q; want hello", body)
+	}
+}
@@ -0,0 +1,321 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webserver
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket message types.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// DefaultMaxMessageSize is the default limit of the size of messages
+// read from a WebSocket.
+const DefaultMaxMessageSize = 1 << 20
+
+var (
+	ErrNotWebSocket  = errors.New("webserver: not a WebSocket upgrade request")
+	ErrMessageTooBig = errors.New("webserver: WebSocket message too big")
+	errBadFrame      = errors.New("webserver: malformed WebSocket frame")
+	errBadOrigin     = errors.New("webserver: WebSocket Origin doesn't match Host")
+)
+
+const webSocketKeyMagic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// A WebSocket is the server side of an RFC 6455 WebSocket connection.
+// One goroutine may read from it while others write.
+type WebSocket struct {
+	// MaxMessageSize is the largest message ReadMessage accepts.
+	MaxMessageSize int
+
+	conn net.Conn
+	br   *bufio.Reader
+
+	wmu    sync.Mutex // guards writes and closed
+	closed bool
+}
+
+// IsWebSocketUpgrade reports whether req asks to switch to the
+// WebSocket protocol.
+func IsWebSocketUpgrade(req *http.Request) bool {
+	return req.Method == "GET" &&
+		headerHasToken(req.Header, "Connection", "upgrade") &&
+		headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for a
+// handshake's Sec-WebSocket-Key.
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+webSocketKeyMagic)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// UpgradeWebSocket switches the connection of req, which must be a
+// WebSocket handshake, to the WebSocket protocol. On error, it has
+// replied to the request.
+//
+// Browsers send credentials with cross-origin WebSocket handshakes,
+// so handshakes with an Origin header must come from a page of the
+// same host.
+func UpgradeWebSocket(rw http.ResponseWriter, req *http.Request) (*WebSocket, error) {
+	if !IsWebSocketUpgrade(req) {
+		http.Error(rw, "Expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(rw, "Unsupported WebSocket version", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(rw, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, req.Host) {
+			http.Error(rw, "Cross-origin WebSocket not allowed", http.StatusForbidden)
+			return nil, errBadOrigin
+		}
+	}
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("webserver: ResponseWriter isn't a Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Drop any timeouts the HTTP server set: the connection is
+	// now long-lived.
+	conn.SetDeadline(time.Time{})
+	_, err = fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(key))
+	if err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocket{
+		MaxMessageSize: DefaultMaxMessageSize,
+		conn:           conn,
+		br:             brw.Reader,
+	}, nil
+}
+
+// readFrame reads a frame and unmasks its payload, of at most max bytes.
+func (ws *WebSocket) readFrame(max int) (fin bool, opcode int, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(ws.br, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	opcode = int(hdr[0] & 0x0f)
+	if hdr[0]&0x70 != 0 || hdr[1]&0x80 == 0 {
+		// Reserved bits set, or unmasked client frame.
+		err = errBadFrame
+		return
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(ws.br, b[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(ws.br, b[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if opcode >= opClose && (n > 125 || !fin) {
+		err = errBadFrame
+		return
+	}
+	if opcode < opClose && n > uint64(max) {
+		err = ErrMessageTooBig
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(ws.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage returns the next text or binary message. It answers
+// pings, and returns io.EOF once the peer closes the connection.
+func (ws *WebSocket) ReadMessage() (messageType int, p []byte, err error) {
+	messageType = -1
+	for {
+		fin, opcode, payload, err := ws.readFrame(ws.MaxMessageSize - len(p))
+		if err != nil {
+			switch err {
+			case errBadFrame:
+				ws.closeWith(1002) // protocol error
+			case ErrMessageTooBig:
+				ws.closeWith(1009)
+			}
+			return 0, nil, err
+		}
+		switch opcode {
+		case opPing:
+			if err := ws.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			ws.closeWith(1000)
+			return 0, nil, io.EOF
+		case opContinuation:
+			if messageType < 0 {
+				ws.closeWith(1002)
+				return 0, nil, errBadFrame
+			}
+		case TextMessage, BinaryMessage:
+			if messageType >= 0 {
+				ws.closeWith(1002)
+				return 0, nil, errBadFrame
+			}
+			messageType = opcode
+		default:
+			ws.closeWith(1002)
+			return 0, nil, errBadFrame
+		}
+		p = append(p, payload...)
+		if fin {
+			return messageType, p, nil
+		}
+	}
+}
+
+func (ws *WebSocket) writeFrame(opcode int, p []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closed {
+		return errors.New("webserver: WebSocket closed")
+	}
+	return writeFrame(ws.conn, opcode, p)
+}
+
+func writeFrame(w io.Writer, opcode int, p []byte) error {
+	hdr := []byte{0x80 | byte(opcode), 0}
+	switch n := len(p); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n < 1<<16:
+		hdr[1] = 126
+		hdr = append(hdr, byte(n>>8), byte(n))
+	default:
+		hdr[1] = 127
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		hdr = append(hdr, b[:]...)
+	}
+	if _, err := w.Write(append(hdr, p...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteMessage sends p as a message of the given type, TextMessage or
+// BinaryMessage.
+func (ws *WebSocket) WriteMessage(messageType int, p []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("webserver: invalid WebSocket message type %d", messageType)
+	}
+	return ws.writeFrame(messageType, p)
+}
+
+// KeepAlive pings the peer every interval until the connection is
+// closed, so proxies and NATs don't drop it while it's idle.
+func (ws *WebSocket) KeepAlive(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			if err := ws.writeFrame(opPing, nil); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (ws *WebSocket) closeWith(code int) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closed {
+		return nil
+	}
+	ws.closed = true
+	writeFrame(ws.conn, opClose, []byte{byte(code >> 8), byte(code)})
+	return ws.conn.Close()
+}
+
+// Close sends a close message and closes the connection.
+func (ws *WebSocket) Close() error {
+	return ws.closeWith(1000)
+}
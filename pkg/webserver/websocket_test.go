@@ -0,0 +1,123 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// From RFC 6455, section 1.3.
+	if got, want := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("webSocketAccept = %q; want %q", got, want)
+	}
+}
+
+// clientFrame returns a masked frame, as clients send them.
+func clientFrame(fin bool, opcode int, p []byte) []byte {
+	var buf bytes.Buffer
+	writeFrame(&buf, opcode, p)
+	b := buf.Bytes()
+	if !fin {
+		b[0] &^= 0x80
+	}
+	hdrLen := len(b) - len(p)
+	mask := []byte{1, 2, 3, 4}
+	out := append([]byte(nil), b[:hdrLen]...)
+	out[1] |= 0x80
+	out = append(out, mask...)
+	for i, c := range p {
+		out = append(out, c^mask[i%4])
+	}
+	return out
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ws, err := UpgradeWebSocket(rw, req)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			mt, p, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(mt, bytes.ToUpper(p))
+		}
+	}))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: "+strings.TrimPrefix(ts.URL, "http://")+"\r\n"+
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 101 || res.Header.Get("Sec-Websocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake response = %v %v", res.Status, res.Header)
+	}
+
+	// A ping, then a message in two fragments with a ping between.
+	c.Write(clientFrame(true, opPing, []byte("hi")))
+	c.Write(clientFrame(false, TextMessage, []byte("hel")))
+	c.Write(clientFrame(true, opPing, nil))
+	c.Write(clientFrame(true, opContinuation, []byte("lo")))
+
+	want := [][]byte{
+		{0x80 | opPong, 2, 'h', 'i'},
+		{0x80 | opPong, 0},
+		{0x80 | TextMessage, 5, 'H', 'E', 'L', 'L', 'O'},
+	}
+	for i, w := range want {
+		got := make([]byte, len(w))
+		if _, err := io.ReadFull(br, got); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, w) {
+			t.Errorf("frame %d = %q; want %q", i, got, w)
+		}
+	}
+}
+
+func TestWebSocketCrossOrigin(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://camli.example.com/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Origin", "http://evil.example.com")
+	rec := httptest.NewRecorder()
+	if _, err := UpgradeWebSocket(rec, req); err == nil || rec.Code != http.StatusForbidden {
+		t.Errorf("cross-origin upgrade: err = %v, code = %d; want an error and 403", err, rec.Code)
+	}
+}
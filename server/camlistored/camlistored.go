@@ -17,8 +17,11 @@ limitations under the License.
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/json"
@@ -29,14 +32,21 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"camlistore.org/pkg/acme"
+	"camlistore.org/pkg/audit"
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/httputil"
 	"camlistore.org/pkg/jsonsign"
 	"camlistore.org/pkg/osutil"
 	"camlistore.org/pkg/serverconfig"
@@ -56,21 +66,35 @@ import (
 	_ "camlistore.org/pkg/index/postgres"
 
 	// Handlers:
+	_ "camlistore.org/pkg/importer"
 	_ "camlistore.org/pkg/search"
 	_ "camlistore.org/pkg/server" // UI, publish, etc
 
+	// Importers:
+	_ "camlistore.org/pkg/importer/bookmarks"
+	_ "camlistore.org/pkg/importer/calendar"
+	_ "camlistore.org/pkg/importer/checkins"
+	_ "camlistore.org/pkg/importer/dir"
+	_ "camlistore.org/pkg/importer/flickr"
+	_ "camlistore.org/pkg/importer/git"
+	_ "camlistore.org/pkg/importer/picasa"
+
 	"camlistore.org/third_party/code.google.com/p/go.crypto/openpgp"
 )
 
 const (
 	defCert = "config/selfgen_cert.pem"
 	defKey  = "config/selfgen_key.pem"
+
+	// defaultShutdownTimeout is how many seconds, by default, a
+	// shutdown waits for work in progress.
+	defaultShutdownTimeout = 30
 )
 
 var (
 	flagConfigFile = flag.String("configfile", "",
 		"Config file to use, relative to the Camlistore configuration directory root. If blank, the default is used or auto-generated.")
-	listenFlag = flag.String("listen", "", "host:port to listen on, or :0 to auto-select. If blank, the value in the config will be used instead.")
+	listenFlag = flag.String("listen", "", "host:port to listen on, :0 to auto-select, or unix:/path of a unix socket. If blank, the value in the config will be used instead.")
 )
 
 func exitf(pattern string, args ...interface{}) {
@@ -81,36 +105,78 @@ func exitf(pattern string, args ...interface{}) {
 	os.Exit(1)
 }
 
-// Mostly copied from $GOROOT/src/pkg/crypto/tls/generate_cert.go
-func genSelfTLS(listen string) error {
-	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+// genSelfTLS writes a self-signed certificate and its key to defCert
+// and defKey, for the host of listen and that of baseURL, if any.
+// Adapted from $GOROOT/src/pkg/crypto/tls/generate_cert.go
+func genSelfTLS(listen, baseURL string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return fmt.Errorf("failed to generate private key: %s", err)
 	}
 
 	now := time.Now()
 
-	hostname, _, err := net.SplitHostPort(listen)
-	if err != nil {
-		return fmt.Errorf("splitting listen failed: %q", err)
+	var hostname string
+	if _, ok := webserver.UnixSocketPath(listen); !ok {
+		hostname, _, err = net.SplitHostPort(listen)
+		if err != nil {
+			return fmt.Errorf("splitting listen failed: %q", err)
+		}
+	}
+	if hostname == "" || net.ParseIP(hostname) != nil && net.ParseIP(hostname).IsUnspecified() {
+		hostname = "localhost"
+	}
+	hosts := []string{hostname}
+	if baseURL != "" {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return fmt.Errorf("parsing baseURL failed: %q", err)
+		}
+		if h := u.Host; h != "" {
+			if bh, _, err := net.SplitHostPort(h); err == nil {
+				h = bh
+			}
+			if h != hostname {
+				hosts = append(hosts, h)
+			}
+		}
 	}
 
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %s", err)
+	}
 	template := x509.Certificate{
-		SerialNumber: new(big.Int).SetInt64(0),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName:   hostname,
 			Organization: []string{hostname},
 		},
-		NotBefore:    now.Add(-5 * time.Minute).UTC(),
-		NotAfter:     now.AddDate(1, 0, 0).UTC(),
-		SubjectKeyId: []byte{1, 2, 3, 4},
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		NotBefore:             now.Add(-5 * time.Minute).UTC(),
+		NotAfter:              now.AddDate(1, 0, 0).UTC(),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if hostname == "localhost" {
+		template.IPAddresses = append(template.IPAddresses, net.IPv4(127, 0, 0, 1), net.IPv6loopback)
 	}
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
 	if err != nil {
 		return fmt.Errorf("Failed to create certificate: %s", err)
 	}
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal private key: %s", err)
+	}
 
 	certOut, err := os.Create(defCert)
 	if err != nil {
@@ -122,14 +188,56 @@ func genSelfTLS(listen string) error {
 
 	keyOut, err := os.OpenFile(defKey, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return fmt.Errorf("failed to open %s for writing:", defKey, err)
+		return fmt.Errorf("failed to open %s for writing: %s", defKey, err)
 	}
-	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
 	keyOut.Close()
 	log.Printf("written %s\n", defKey)
 	return nil
 }
 
+// weakSelfCert reports whether the self-signed certificate in file
+// predates genSelfTLS making certificates modern clients accept: with
+// an RSA key under 2048 bits, or without subject alternative names.
+func weakSelfCert(file string) bool {
+	cert, err := parseCertFile(file)
+	if err != nil {
+		return false
+	}
+	if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok && pub.N.BitLen() < 2048 {
+		return true
+	}
+	return len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 0
+}
+
+func parseCertFile(file string) (*x509.Certificate, error) {
+	pemBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// logCertFingerprint logs the SHA-256 fingerprint of the certificate
+// in file, so clients can pin the self-signed certificate.
+func logCertFingerprint(file string) {
+	cert, err := parseCertFile(file)
+	if err != nil {
+		log.Printf("Could not read certificate %s: %v", file, err)
+		return
+	}
+	sum := sha256.Sum256(cert.Raw)
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = fmt.Sprintf("%02X", b)
+	}
+	log.Printf("TLS certificate %s SHA-256 fingerprint: %s", file, strings.Join(hexes, ":"))
+}
+
 // findConfigFile returns the absolute path of the user's
 // config file.
 // The provided file may be absolute or relative
@@ -160,12 +268,7 @@ func findConfigFile(file string) (absPath string, err error) {
 }
 
 func keyIdFromRing(filename string) (keyId string, err error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return "", fmt.Errorf("reading identity secret ring file: %v", err)
-	}
-	defer f.Close()
-	el, err := openpgp.ReadKeyRing(f)
+	el, err := jsonsign.ReadKeyRingFile(filename)
 	if err != nil {
 		return "", fmt.Errorf("reading identity secret ring file %s: %v", filename, err)
 	}
@@ -249,7 +352,7 @@ func newDefaultConfigFile(path string) error {
 	return nil
 }
 
-func setupTLS(ws *webserver.Server, config *serverconfig.Config, listen string) {
+func setupTLS(ws *webserver.Server, config *serverconfig.Config, listen, baseURL string) {
 	cert, key := config.OptionalString("TLSCertFile", ""), config.OptionalString("TLSKeyFile", "")
 	if !config.OptionalBool("https", true) {
 		return
@@ -257,34 +360,77 @@ func setupTLS(ws *webserver.Server, config *serverconfig.Config, listen string)
 	if (cert != "") != (key != "") {
 		exitf("TLSCertFile and TLSKeyFile must both be either present or absent")
 	}
+	if host := config.OptionalString("ACMEHostname", ""); host != "" {
+		if cert != "" {
+			exitf("ACMEHostname and TLSCertFile are mutually exclusive")
+		}
+		setupACME(ws, config, host)
+		return
+	}
 
 	if cert == defCert && key == defKey {
 		_, err1 := os.Stat(cert)
 		_, err2 := os.Stat(key)
 		if err1 != nil || err2 != nil {
 			if os.IsNotExist(err1) || os.IsNotExist(err2) {
-				if err := genSelfTLS(listen); err != nil {
+				if err := genSelfTLS(listen, baseURL); err != nil {
 					exitf("Could not generate self-signed TLS cert: %q", err)
 				}
 			} else {
 				exitf("Could not stat cert or key: %q, %q", err1, err2)
 			}
+		} else if weakSelfCert(cert) {
+			log.Printf("Replacing self-signed TLS cert %s, which clients would reject", cert)
+			if err := genSelfTLS(listen, baseURL); err != nil {
+				exitf("Could not generate self-signed TLS cert: %q", err)
+			}
 		}
+		logCertFingerprint(cert)
 	}
 	if cert == "" && key == "" {
-		err := genSelfTLS(listen)
+		err := genSelfTLS(listen, baseURL)
 		if err != nil {
 			exitf("Could not generate self signed creds: %q", err)
 		}
 		cert = defCert
 		key = defKey
+		logCertFingerprint(cert)
 	}
 	ws.SetTLS(cert, key)
 }
 
-func handleSignals() {
+// setupACME makes ws serve the certificate of host obtained, and
+// renewed, from an ACME CA, answering its challenges on port 80.
+func setupACME(ws *webserver.Server, config *serverconfig.Config, host string) {
+	m := &acme.Manager{
+		Hostname:     host,
+		Email:        config.OptionalString("ACMEEmail", ""),
+		DirectoryURL: config.OptionalString("ACMEDirectory", acme.LetsEncryptURL),
+		CacheDir:     filepath.Join(osutil.CamliConfigDir(), "acme"),
+	}
+	challengeListen := config.OptionalString("ACMEChallengeListen", ":80")
+	ln, err := net.Listen("tcp", challengeListen)
+	if err != nil {
+		exitf("Could not listen on %s for the ACME challenges: %v", challengeListen, err)
+	}
+	go func() {
+		if err := http.Serve(ln, m.HTTPHandler(nil)); err != nil {
+			log.Printf("Serving the ACME challenges: %v", err)
+		}
+	}()
+	log.Printf("Getting the TLS certificate of %s from %s", host, m.DirectoryURL)
+	if err := m.Start(); err != nil {
+		exitf("Could not get a TLS certificate of %s: %v", host, err)
+	}
+	ws.SetGetCertificate(m.GetCertificate)
+}
+
+// handleSignals restarts the server on SIGHUP, and shuts it down
+// gracefully on SIGINT or SIGTERM; a second one exits at once.
+func handleSignals(ws *webserver.Server, config *serverconfig.Config, timeout time.Duration) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	shuttingDown := false
 	for {
 		sig := <-c
 		sysSig, ok := sig.(syscall.Signal)
@@ -294,16 +440,39 @@ func handleSignals() {
 		switch sysSig {
 		case syscall.SIGHUP:
 			log.Print("SIGHUP: restarting camli")
+			audit.Log(nil, audit.EventRestart, "", "SIGHUP")
 			err := osutil.RestartProcess()
 			if err != nil {
 				log.Fatal("Failed to restart: " + err.Error())
 			}
+		case syscall.SIGINT, syscall.SIGTERM:
+			if shuttingDown {
+				log.Fatalf("%v: exiting without finishing shutdown", sig)
+			}
+			shuttingDown = true
+			log.Printf("%v: shutting down, waiting up to %v for work in progress", sig, timeout)
+			go shutdown(ws, config, timeout)
 		default:
 			log.Fatal("Received another signal, should not happen.")
 		}
 	}
 }
 
+// shutdown stops accepting connections, lets the requests in progress
+// finish, then the handlers' own work, such as sync queues, and exits.
+func shutdown(ws *webserver.Server, config *serverconfig.Config, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if err := ws.Shutdown(timeout); err != nil {
+		log.Printf("Shutdown of HTTP server: %v", err)
+	}
+	if err := config.Shutdown(deadline); err != nil {
+		log.Printf("Shutdown of handlers: %v", err)
+		os.Exit(1)
+	}
+	log.Printf("Shut down cleanly.")
+	os.Exit(0)
+}
+
 // listenAndBaseURL finds the configured, default, or inferred listen address
 // and base URL from the command-line flags and provided config.
 func listenAndBaseURL(config *serverconfig.Config) (listen, baseURL string) {
@@ -336,20 +505,48 @@ func main() {
 	ws := webserver.New()
 	listen, baseURL := listenAndBaseURL(config)
 
-	setupTLS(ws, config, listen)
+	setupTLS(ws, config, listen, baseURL)
+	ws.SetTimeouts(
+		time.Duration(config.OptionalInt("readTimeout", 0))*time.Second,
+		time.Duration(config.OptionalInt("idleTimeout", 0))*time.Second)
+	ws.SetSecurityHeaders(webserver.SecurityHeaders{
+		HSTSMaxAge:            time.Duration(config.OptionalInt("HSTSMaxAge", 0)) * time.Second,
+		HSTSIncludeSubdomains: config.OptionalBool("HSTSIncludeSubdomains", false),
+		NoSniff:               config.OptionalBool("contentTypeNosniff", true),
+		FrameOptions:          config.OptionalString("frameOptions", "SAMEORIGIN"),
+	})
+	proxies, err := httputil.ParseTrustedProxies(config.OptionalList("trustedProxies"))
+	if err != nil {
+		exitf("Invalid trustedProxies: %v", err)
+	}
+	ws.SetTrustedProxies(proxies)
+	if m := config.OptionalString("listenSocketMode", ""); m != "" {
+		mode, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			exitf("Invalid listenSocketMode %q: %v", m, err)
+		}
+		ws.SetSocketMode(os.FileMode(mode))
+	}
+	shutdownTimeout := time.Duration(config.OptionalInt("shutdownTimeout", defaultShutdownTimeout)) * time.Second
 	err = config.InstallHandlers(ws, baseURL, nil)
 	if err != nil {
 		exitf("Error parsing config: %v", err)
 	}
+	audit.Log(nil, audit.EventServerStart, "", fileName)
+	if pool := auth.ClientCAs(); pool != nil {
+		ws.SetClientCAs(pool)
+	}
 
 	err = ws.Listen(listen)
 	if err != nil {
 		exitf("Listen: %v", err)
 	}
 
+	// Listening on a unix socket, there's no URL to open.
+	listenURL := ws.ListenURL()
 	urlOpened := false
-	if config.UIPath != "" {
-		uiURL := ws.ListenURL() + config.UIPath
+	if config.UIPath != "" && listenURL != "" {
+		uiURL := listenURL + config.UIPath
 		log.Printf("UI available at %s", uiURL)
 		if runtime.GOOS == "windows" {
 			// Might be double-clicking an icon with no shell window?
@@ -358,7 +555,7 @@ func main() {
 			go osutil.OpenURL(uiURL)
 		}
 	}
-	if *flagConfigFile == "" && !urlOpened {
+	if *flagConfigFile == "" && !urlOpened && listenURL != "" {
 		go func() {
 			err := osutil.OpenURL(ws.ListenURL())
 			if err != nil {
@@ -368,6 +565,6 @@ func main() {
 	}
 
 	go ws.Serve()
-	go handleSignals()
+	go handleSignals(ws, config, shutdownTimeout)
 	select {}
 }
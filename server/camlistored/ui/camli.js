@@ -143,6 +143,19 @@ function camliDescribeBlogURL(blobref) {
     return Camli.config.searchRoot + 'camli/search/describe?blobref=' + blobref;
 }
 
+// camliAddReplayHeaders sets the timestamp and a new nonce of the
+// state-changing request xhr, for servers with replay protection on.
+function camliAddReplayHeaders(xhr) {
+    var b = new Uint8Array(16);
+    window.crypto.getRandomValues(b);
+    var nonce = "";
+    for (var i = 0; i < b.length; i++) {
+        nonce += (b[i] < 16 ? "0" : "") + b[i].toString(16);
+    }
+    xhr.setRequestHeader("X-Camli-Timestamp", "" + Math.floor(new Date().getTime() / 1000));
+    xhr.setRequestHeader("X-Camli-Nonce", nonce);
+}
+
 function camliSign(clearObj, opts) {
     opts = Camli.saneOpts(opts);
     var sigConf = Camli.config.signing;
@@ -165,6 +178,7 @@ function camliSign(clearObj, opts) {
     };
     xhr.open("POST", sigConf.signHandler, true);
     xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+    camliAddReplayHeaders(xhr);
     xhr.send("json=" + encodeURIComponent(clearText));
 }
 
@@ -237,6 +251,7 @@ function camliUploadFileHelper(file, contentsBlobRef, opts) {
         };
         var xhr = camliJsonXhr("camliUploadFileHelper", uploadCb);
         xhr.open("POST", Camli.config.uploadHelper);
+        camliAddReplayHeaders(xhr);
         xhr.send(fd);
     };
 
@@ -433,6 +448,12 @@ function changeAttribute(permanode, claimType, attribute, value, opts) {
         "attribute": attribute,
         "value": value
     };
+    signAndUploadClaim(json, opts);
+}
+
+// Signs and uploads the claim json.
+function signAndUploadClaim(json, opts) {
+    var claimType = json.claimType;
     camliSign(json, {
         success: function(signedBlob) {
             camliUploadString(signedBlob, {
@@ -503,6 +524,19 @@ function camliNewDelAttributeClaim(permanode, attribute, value, opts) {
     changeAttribute(permanode, "del-attribute", attribute, value, opts);
 }
 
+// Create and upload a new delete claim of target, a permanode or a
+// claim. Deleting a delete claim undoes it.
+function camliNewDeleteClaim(target, opts) {
+    opts = Camli.saneOpts(opts);
+    signAndUploadClaim({
+        "camliVersion": 1,
+        "camliType": "claim",
+        "claimType": "delete",
+        "claimDate": dateToRfc3339String(new Date()),
+        "target": target
+    }, opts);
+}
+
 // camliCondCall calls fn, if non-null, with the remaining parameters.
 function camliCondCall(fn /*, ... */) {
     if (!fn) {
@@ -617,6 +617,23 @@ function btnGoToGallery(e) {
     }
 }
 
+function btnDeletePermanode(e) {
+    var permanode = getPermanodeParam();
+    if (!permanode || !confirm("Delete permanode " + permanode + "?")) {
+        return;
+    }
+    e.target.disabled = true;
+    camliNewDeleteClaim(permanode, {
+        success: function() {
+            window.location = "./";
+        },
+        fail: function(msg) {
+            alert(msg);
+            e.target.disabled = false;
+        }
+    });
+}
+
 function permanodePageOnLoad() {
     var permanode = getPermanodeParam();
     if (permanode) {
@@ -635,6 +652,8 @@ function permanodePageOnLoad() {
     selectType.addEventListener("change", onTypeChange);
     var btnGallery = document.getElementById("btnGallery");
     btnGallery.addEventListener("click", btnGoToGallery);
+    var btnDelete = document.getElementById("btnDelete");
+    btnDelete.addEventListener("click", btnDeletePermanode);
 
     setupRootsDropdown();
     setupFilesHandlers();
@@ -50,6 +50,7 @@ function doSign() {
     };
     xhr.open("POST", sigdisco.signHandler, true);
     xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+    camliAddReplayHeaders(xhr);
     xhr.send("json=" + encodeURIComponent(clearta.value));
 }
 
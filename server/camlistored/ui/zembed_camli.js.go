@@ -7,7 +7,7 @@ import "time"
 import "camlistore.org/pkg/fileembed"
 
 func init() {
-	Files.Add("camli.js", 17159, fileembed.String("/*\n"+
+	Files.Add("camli.js", 18300, fileembed.String("/*\n"+
 		"Copyright 2011 Google Inc.\n"+
 		"\n"+
 		"Licensed under the Apache License, Version 2.0 (the \"License\");\n"+
@@ -156,6 +156,20 @@ func init() {
 		"    return Camli.config.searchRoot + 'camli/search/describe?blobref=' + blobref;\n"+
 		"}\n"+
 		"\n"+
+		"// camliAddReplayHeaders sets the timestamp and a new nonce of the\n"+
+		"// state-changing request xhr, for servers with replay protection on.\n"+
+		"function camliAddReplayHeaders(xhr) {\n"+
+		"    var b = new Uint8Array(16);\n"+
+		"    window.crypto.getRandomValues(b);\n"+
+		"    var nonce = \"\";\n"+
+		"    for (var i = 0; i < b.length; i++) {\n"+
+		"        nonce += (b[i] < 16 ? \"0\" : \"\") + b[i].toString(16);\n"+
+		"    }\n"+
+		"    xhr.setRequestHeader(\"X-Camli-Timestamp\", \"\" + Math.floor(new Date().getTime("+
+		") / 1000));\n"+
+		"    xhr.setRequestHeader(\"X-Camli-Nonce\", nonce);\n"+
+		"}\n"+
+		"\n"+
 		"function camliSign(clearObj, opts) {\n"+
 		"    opts = Camli.saneOpts(opts);\n"+
 		"    var sigConf = Camli.config.signing;\n"+
@@ -178,6 +192,7 @@ func init() {
 		"    };\n"+
 		"    xhr.open(\"POST\", sigConf.signHandler, true);\n"+
 		"    xhr.setRequestHeader(\"Content-Type\", \"application/x-www-form-urlencoded\");\n"+
+		"    camliAddReplayHeaders(xhr);\n"+
 		"    xhr.send(\"json=\" + encodeURIComponent(clearText));\n"+
 		"}\n"+
 		"\n"+
@@ -256,6 +271,7 @@ func init() {
 		"        };\n"+
 		"        var xhr = camliJsonXhr(\"camliUploadFileHelper\", uploadCb);\n"+
 		"        xhr.open(\"POST\", Camli.config.uploadHelper);\n"+
+		"        camliAddReplayHeaders(xhr);\n"+
 		"        xhr.send(fd);\n"+
 		"    };\n"+
 		"\n"+
@@ -461,6 +477,12 @@ func init() {
 		"        \"attribute\": attribute,\n"+
 		"        \"value\": value\n"+
 		"    };\n"+
+		"    signAndUploadClaim(json, opts);\n"+
+		"}\n"+
+		"\n"+
+		"// Signs and uploads the claim json.\n"+
+		"function signAndUploadClaim(json, opts) {\n"+
+		"    var claimType = json.claimType;\n"+
 		"    camliSign(json, {\n"+
 		"        success: function(signedBlob) {\n"+
 		"            camliUploadString(signedBlob, {\n"+
@@ -533,6 +555,19 @@ func init() {
 		"    changeAttribute(permanode, \"del-attribute\", attribute, value, opts);\n"+
 		"}\n"+
 		"\n"+
+		"// Create and upload a new delete claim of target, a permanode or a\n"+
+		"// claim. Deleting a delete claim undoes it.\n"+
+		"function camliNewDeleteClaim(target, opts) {\n"+
+		"    opts = Camli.saneOpts(opts);\n"+
+		"    signAndUploadClaim({\n"+
+		"        \"camliVersion\": 1,\n"+
+		"        \"camliType\": \"claim\",\n"+
+		"        \"claimType\": \"delete\",\n"+
+		"        \"claimDate\": dateToRfc3339String(new Date()),\n"+
+		"        \"target\": target\n"+
+		"    }, opts);\n"+
+		"}\n"+
+		"\n"+
 		"// camliCondCall calls fn, if non-null, with the remaining parameters.\n"+
 		"function camliCondCall(fn /*, ... */) {\n"+
 		"    if (!fn) {\n"+
@@ -540,5 +575,5 @@ func init() {
 		"    }\n"+
 		"    fn.apply(null, Array.prototype.slice.call(arguments, 1));\n"+
 		"}\n"+
-		""), time.Unix(0, 1357701658000000000))
+		""), time.Unix(0, 1791999177639660150))
 }
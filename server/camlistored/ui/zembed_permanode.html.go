@@ -7,7 +7,7 @@ import "time"
 import "camlistore.org/pkg/fileembed"
 
 func init() {
-	Files.Add("permanode.html", 2667, fileembed.String("<!doctype html>\n"+
+	Files.Add("permanode.html", 2710, fileembed.String("<!doctype html>\n"+
 		"<html>\n"+
 		"<head>\n"+
 		"  <title>Permanode</title>\n"+
@@ -82,6 +82,7 @@ func init() {
 		"\n"+
 		"  <p>\n"+
 		"  <button id=\"btnGallery\"> Show gallery </button> \n"+
+		"  <button id=\"btnDelete\"> Delete </button>\n"+
 		"  </p>\n"+
 		"\n"+
 		"  <div id=\"content\"></div>\n"+
@@ -102,5 +103,5 @@ func init() {
 		"\n"+
 		"</body>\n"+
 		"</html>\n"+
-		""), time.Unix(0, 1354832601372888952))
+		""), time.Unix(0, 1791999177640808423))
 }
@@ -7,7 +7,7 @@ import "time"
 import "camlistore.org/pkg/fileembed"
 
 func init() {
-	Files.Add("permanode.js", 20694, fileembed.String("/*\n"+
+	Files.Add("permanode.js", 21240, fileembed.String("/*\n"+
 		"Copyright 2011 Google Inc.\n"+
 		"\n"+
 		"Licensed under the Apache License, Version 2.0 (the \"License\");\n"+
@@ -637,6 +637,23 @@ func init() {
 		"    }\n"+
 		"}\n"+
 		"\n"+
+		"function btnDeletePermanode(e) {\n"+
+		"    var permanode = getPermanodeParam();\n"+
+		"    if (!permanode || !confirm(\"Delete permanode \" + permanode + \"?\")) {\n"+
+		"        return;\n"+
+		"    }\n"+
+		"    e.target.disabled = true;\n"+
+		"    camliNewDeleteClaim(permanode, {\n"+
+		"        success: function() {\n"+
+		"            window.location = \"./\";\n"+
+		"        },\n"+
+		"        fail: function(msg) {\n"+
+		"            alert(msg);\n"+
+		"            e.target.disabled = false;\n"+
+		"        }\n"+
+		"    });\n"+
+		"}\n"+
+		"\n"+
 		"function permanodePageOnLoad() {\n"+
 		"    var permanode = getPermanodeParam();\n"+
 		"    if (permanode) {\n"+
@@ -657,6 +674,8 @@ func init() {
 		"    selectType.addEventListener(\"change\", onTypeChange);\n"+
 		"    var btnGallery = document.getElementById(\"btnGallery\");\n"+
 		"    btnGallery.addEventListener(\"click\", btnGoToGallery);\n"+
+		"    var btnDelete = document.getElementById(\"btnDelete\");\n"+
+		"    btnDelete.addEventListener(\"click\", btnDeletePermanode);\n"+
 		"\n"+
 		"    setupRootsDropdown();\n"+
 		"    setupFilesHandlers();\n"+
@@ -666,5 +685,5 @@ func init() {
 		"}\n"+
 		"\n"+
 		"window.addEventListener(\"load\", permanodePageOnLoad);\n"+
-		""), time.Unix(0, 1357701478000000000))
+		""), time.Unix(0, 1791999177641583370))
 }
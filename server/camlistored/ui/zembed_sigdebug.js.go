@@ -7,7 +7,7 @@ import "time"
 import "camlistore.org/pkg/fileembed"
 
 func init() {
-	Files.Add("sigdebug.js", 2315, fileembed.String("var sigdisco = null;\n"+
+	Files.Add("sigdebug.js", 2347, fileembed.String("var sigdisco = null;\n"+
 		"\n"+
 		"function discoverJsonSign() {\n"+
 		"    var xhr = new XMLHttpRequest();\n"+
@@ -60,6 +60,7 @@ func init() {
 		"    };\n"+
 		"    xhr.open(\"POST\", sigdisco.signHandler, true);\n"+
 		"    xhr.setRequestHeader(\"Content-Type\", \"application/x-www-form-urlencoded\");\n"+
+		"    camliAddReplayHeaders(xhr);\n"+
 		"    xhr.send(\"json=\" + encodeURIComponent(clearta.value));\n"+
 		"}\n"+
 		"\n"+
@@ -85,5 +86,5 @@ func init() {
 		"    xhr.setRequestHeader(\"Content-Type\", \"application/x-www-form-urlencoded\");\n"+
 		"    xhr.send(\"sjson=\" + encodeURIComponent(signedta.value));\n"+
 		"}\n"+
-		""), time.Unix(0, 1349725494303779986))
+		""), time.Unix(0, 1791995502801274134))
 }